@@ -0,0 +1,416 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// accountDeletionTTL is how long an account deletion link stays valid
+const accountDeletionTTL = time.Hour
+
+// errDeletionToken is returned for a missing, expired or foreign
+// account deletion token
+var errDeletionToken = errors.New("invalid or expired deletion token")
+
+// accountTable is a table holding rows that belong to a user
+type accountTable struct {
+	name string
+	// Selects the user's rows, with the email as its only parameter;
+	// "email = ?" when empty
+	where string
+	// Selects rows whose user (or parent row) no longer exists; rows
+	// without a users row when empty
+	orphaned string
+	// Columns left out of exports: credentials, and content exported
+	// separately or regenerated on demand
+	omit []string
+	// Columns holding JSON, embedded as is in exports
+	json []string
+	// Columns holding a board encoded by the BoardCodec
+	board []string
+	// Selects the user's rows that clash with another account's when the
+	// user's address changes to it, with its email as the only parameter.
+	// They're dropped, keeping the other account's; no rows clash when
+	// empty.
+	collides string
+}
+
+// accountTables lists every table with user rows, children before the
+// tables they reference so deleting in order satisfies foreign keys
+var accountTables = []accountTable{
+	{name: "webhook_deliveries", where: "webhook_id IN (SELECT id FROM webhooks WHERE email = ?)", orphaned: "webhook_id NOT IN (SELECT id FROM webhooks)", json: []string{"payload"}},
+	{name: "webhooks", omit: []string{"secret"}},
+	{name: "external_mappings", collides: "provider IN (SELECT provider FROM external_connections WHERE email = ?)"},
+	{name: "external_connections", omit: []string{"access_token", "refresh_token"}, collides: sameKey("external_connections", "provider")},
+	{name: "webauthn_credentials", json: []string{"credential"}, collides: hasRow("webauthn_users")},
+	{name: "webauthn_users", collides: hasRow("webauthn_users")},
+	{name: "totp_backup_codes", omit: []string{"code_hash"}, collides: hasRow("user_totp")},
+	{name: "user_totp", omit: []string{"secret"}, collides: hasRow("user_totp")},
+	{name: "exports", omit: []string{"content"}},
+	{name: "attachments", omit: []string{"storage_key"}},
+	{name: "comments"},
+	{name: "activity_log"},
+	{name: "board_changes", collides: hasRow("user_data")},
+	{name: "archived_tasks", json: []string{"task"}, collides: sameKey("archived_tasks", "task_id")},
+	{name: "trashed_tasks", json: []string{"task"}, collides: sameKey("trashed_tasks", "task_id")},
+	{name: "board_snapshots", board: []string{"data"}},
+	{name: "user_settings", json: []string{"settings"}, collides: hasRow("user_settings")},
+	{name: "feature_flag_overrides", collides: sameKey("feature_flag_overrides", "flag")},
+	{name: "macros", json: []string{"operations"}},
+	{name: "templates", json: []string{"content"}},
+	{name: "saved_filters", json: []string{"filter"}},
+	{name: "devices"},
+	{name: "item_clocks", collides: hasRow("user_data")},
+	{name: "open_task_counts", collides: sameKey("open_task_counts", "day")},
+	{name: "api_keys", omit: []string{"key_hash"}},
+	{name: "share_links", omit: []string{"token_hash"}},
+	{name: "calendar_tokens", omit: []string{"token"}, collides: hasRow("calendar_tokens")},
+	{name: "homeassistant_tokens", omit: []string{"token"}, collides: hasRow("homeassistant_tokens")},
+	{name: "grafana_tokens", omit: []string{"token"}, collides: hasRow("grafana_tokens")},
+	{name: "websub_subscriptions", omit: []string{"secret"}, collides: sameKey("websub_subscriptions", "callback")},
+	{name: "websub_tokens", omit: []string{"token"}, collides: hasRow("websub_tokens")},
+	{name: "inbound_email_tokens", omit: []string{"token"}, collides: hasRow("inbound_email_tokens")},
+	{name: "backup_webhooks", omit: []string{"secret"}, collides: hasRow("backup_webhooks")},
+	{name: "slack_installations", omit: []string{"webhook_url"}, collides: hasRow("slack_installations")},
+	{name: "crdt_documents", omit: []string{"document"}, collides: hasRow("user_data")},
+	{name: "workspace_members", collides: sameKey("workspace_members", "workspace_id")},
+	{name: "user_data", board: []string{"data"}, collides: hasRow("user_data")},
+	{name: "users"},
+}
+
+// hasRow makes a collides condition for rows that clash with any row the
+// other account has in table, such as its one row of settings
+func hasRow(table string) string {
+	return "EXISTS (SELECT 1 FROM " + table + " WHERE email = ?)"
+}
+
+// sameKey makes a collides condition for rows whose column matches one of
+// the other account's rows in table
+func sameKey(table, column string) string {
+	return column + " IN (SELECT " + column + " FROM " + table + " WHERE email = ?)"
+}
+
+func (t accountTable) filter() string {
+	if t.where == "" {
+		return "email = ?"
+	}
+	return t.where
+}
+
+func (t accountTable) orphanFilter() string {
+	if t.orphaned == "" {
+		return "email NOT IN (SELECT email FROM users)"
+	}
+	return t.orphaned
+}
+
+// AccountArchive is the machine-readable part of an account export
+type AccountArchive struct {
+	Email      string                      `json:"email"`
+	ExportedAt time.Time                   `json:"exportedAt"`
+	Tables     map[string][]map[string]any `json:"tables"`
+	// Archive paths of attachment files by attachment ID
+	Files map[string]string `json:"files"`
+
+	attachments []Attachment
+}
+
+// AccountService exports and deletes everything stored for a user
+type AccountService struct {
+	db                *DB
+	authService       *AuthService
+	dataService       *DataService
+	attachmentService *AttachmentService
+	hub               *Hub
+}
+
+func NewAccountService(db *DB, authService *AuthService, dataService *DataService, attachmentService *AttachmentService, hub *Hub) *AccountService {
+	return &AccountService{
+		db:                db,
+		authService:       authService,
+		dataService:       dataService,
+		attachmentService: attachmentService,
+		hub:               hub,
+	}
+}
+
+// RequestDeletion emails the user a link confirming the deletion of their
+// account and returns it. The email is in the user's language, or else
+// locale (the request's).
+func (s *AccountService) RequestDeletion(email, baseURL, locale string) (string, error) {
+	token, err := s.authService.CreateStateToken(email, "delete-account", accountDeletionTTL)
+	if err != nil {
+		return "", err
+	}
+	link := baseURL + "/?delete-account=" + token
+
+	if s.authService.EmailEnabled() {
+		locale = s.authService.EmailLocale(email, locale)
+		subject := translate(locale, "Confirm deleting your %s account", s.authService.branding.AppName)
+		body := translate(locale, "Someone asked to delete the %s account for %s, with all of its boards, attachments and settings. This can't be undone.\n\nTo delete it, open the link below while signed in:\n\n%s\n\nThe link expires in an hour. If you didn't ask for this, ignore this email; your account is safe.", s.authService.branding.AppName, email, link)
+		if err := s.authService.SendEmail(email, locale, subject, body); err != nil {
+			return "", err
+		}
+	}
+	return link, nil
+}
+
+// Delete removes every row stored for the user and their attachment files,
+// given the token from the confirmation email
+func (s *AccountService) Delete(ctx context.Context, email, token string) error {
+	confirmed, err := s.authService.VerifyStateToken(token, "delete-account")
+	if err != nil || confirmed != email {
+		return errDeletionToken
+	}
+
+	attachments, err := s.attachmentService.ListAll(email)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteAccountRows(tx, email); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.dataService.cache.Invalidate(email)
+	s.attachmentService.DeleteContent(ctx, attachments)
+	s.hub.Disconnect(email)
+	log.Printf("Deleted account %s", email)
+	return nil
+}
+
+// deleteAccountRows deletes every row stored under an email, in the
+// caller's transaction
+func deleteAccountRows(tx *Tx, email string) error {
+	for _, table := range accountTables {
+		if _, err := tx.Exec("DELETE FROM "+table.name+" WHERE "+table.filter(), email); err != nil {
+			return fmt.Errorf("failed to delete from %s: %w", table.name, err)
+		}
+	}
+	return nil
+}
+
+// Archive collects the user's rows from every table
+func (s *AccountService) Archive(email string) (*AccountArchive, error) {
+	archive := &AccountArchive{
+		Email:      email,
+		ExportedAt: time.Now().UTC(),
+		Tables:     make(map[string][]map[string]any),
+		Files:      make(map[string]string),
+	}
+
+	attachments, err := s.attachmentService.ListAll(email)
+	if err != nil {
+		return nil, err
+	}
+	archive.attachments = attachments
+
+	for _, table := range accountTables {
+		rows, err := s.tableRows(table, email)
+		if err != nil {
+			return nil, err
+		}
+		archive.Tables[table.name] = rows
+	}
+	return archive, nil
+}
+
+// tableRows returns the user's rows of one table as column -> value maps
+func (s *AccountService) tableRows(table accountTable, email string) ([]map[string]any, error) {
+	rows, err := s.db.Query("SELECT * FROM "+table.name+" WHERE "+table.filter(), email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %w", table.name, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s columns: %w", table.name, err)
+	}
+
+	omit := make(map[string]bool)
+	for _, column := range table.omit {
+		omit[column] = true
+	}
+
+	result := []map[string]any{}
+	for rows.Next() {
+		values := make([]any, len(columns))
+		ptrs := make([]any, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", table.name, err)
+		}
+
+		row := make(map[string]any)
+		for i, column := range columns {
+			if omit[column] {
+				continue
+			}
+			value, err := s.exportValue(table, column, values[i])
+			if err != nil {
+				return nil, fmt.Errorf("failed to export %s.%s: %w", table.name, column, err)
+			}
+			row[column] = value
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// exportValue converts a column value for the archive, decoding boards and
+// embedding JSON so the archive doesn't hold JSON inside strings
+func (s *AccountService) exportValue(table accountTable, column string, value any) (any, error) {
+	text, isText := value.(string)
+	if b, ok := value.([]byte); ok && (containsString(table.board, column) || containsString(table.json, column)) {
+		text, isText = string(b), true
+	}
+	if !isText {
+		return value, nil
+	}
+
+	if containsString(table.board, column) {
+		return s.dataService.codec.Decode(text)
+	}
+	if containsString(table.json, column) && json.Valid([]byte(text)) {
+		return json.RawMessage(text), nil
+	}
+	return text, nil
+}
+
+// Export writes a zip archive of everything stored for the user:
+// account.json with their rows from every table, and their attachment files
+// under attachments/
+func (s *AccountService) Export(ctx context.Context, w io.Writer, archive *AccountArchive) error {
+	zw := zip.NewWriter(w)
+
+	for _, a := range archive.attachments {
+		name := fmt.Sprintf("attachments/%s/%s", a.ID, a.Filename)
+		archive.Files[a.ID] = name
+
+		content, err := s.attachmentService.Open(ctx, &a)
+		if err != nil {
+			return fmt.Errorf("failed to open attachment %s: %w", a.ID, err)
+		}
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: a.CreatedAt})
+		if err == nil {
+			_, err = io.Copy(f, content)
+		}
+		content.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write attachment %s: %w", a.ID, err)
+		}
+	}
+
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "account.json", Method: zip.Deflate, Modified: archive.ExportedAt})
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(archive); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	return zw.Close()
+}
+
+// AccountHandler serves account export and deletion
+type AccountHandler struct {
+	accountService *AccountService
+}
+
+func NewAccountHandler(accountService *AccountService) *AccountHandler {
+	return &AccountHandler{accountService: accountService}
+}
+
+// Delete emails a confirmation link when called without a token, and
+// deletes the account when called with the token from that link
+func (h *AccountHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if r.ContentLength != 0 {
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+	}
+
+	email := requestEmail(r)
+	if req.Token == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		link, err := h.accountService.RequestDeletion(email, fmt.Sprintf("%s://%s", scheme, r.Host), requestLocale(r))
+		if err != nil {
+			log.Printf("Error requesting account deletion: %v", err)
+			writeError(w, http.StatusInternalServerError, "Failed to send confirmation email")
+			return
+		}
+
+		resp := map[string]any{
+			"status":  "pending",
+			"message": "Check your email to confirm deleting your account",
+		}
+		if h.accountService.authService.RevealLinks() {
+			resp["confirmUrl"] = link // For development only
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	err := h.accountService.Delete(r.Context(), email, req.Token)
+	if err == errDeletionToken {
+		writeError(w, http.StatusBadRequest, "Invalid or expired confirmation link")
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting account: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to delete account")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+	})
+}
+
+// Export downloads a zip archive of all the user's stored data
+func (h *AccountHandler) Export(w http.ResponseWriter, r *http.Request) {
+	archive, err := h.accountService.Archive(requestEmail(r))
+	if err != nil {
+		log.Printf("Error building account export: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	filename := fmt.Sprintf("account-%s.zip", archive.ExportedAt.Format("2006-01-02"))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Content-Type", "application/zip")
+	if err := h.accountService.Export(r.Context(), w, archive); err != nil {
+		// Headers are gone; the truncated zip won't open
+		log.Printf("Error writing account export: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Task activity actions recorded in the activity log
+const (
+	ActivityCreated = "created"
+	ActivityUpdated = "updated"
+	ActivityMoved   = "moved"
+	ActivityDeleted = "deleted"
+
+	// A task marked completed. Moves, and completions logged before tasks
+	// had a completed flag (as moves into a done column), have "old -> new"
+	// column IDs as the detail, "none" for unassigned.
+	ActivityCompleted = "completed"
+
+	// A priority change, with "old -> new" as the detail
+	ActivityPrioritized = "prioritized"
+)
+
+// TaskActivity is one entry of a board's activity log
+type TaskActivity struct {
+	TaskID    string    `json:"taskId"`
+	Action    string    `json:"action"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// TaskAge describes how long a task has gone without activity
+type TaskAge struct {
+	LastActivityAt time.Time `json:"lastActivityAt"`
+	StaleDays      int       `json:"staleDays"`
+}
+
+// sameColumn reports whether two optional column IDs are equal
+func sameColumn(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// columnLabel describes an optional column for activity details
+func columnLabel(columnID *string) string {
+	if columnID == nil {
+		return "none"
+	}
+	return *columnID
+}
+
+// priorityLabel describes an optional priority for activity details
+func priorityLabel(priority *string) string {
+	if priority == nil {
+		return "none"
+	}
+	return *priority
+}
+
+// diffTaskActivity lists the task changes between two versions of a board
+func diffTaskActivity(before, after *KanbanData) []TaskActivity {
+	previous := make(map[string]Task, len(before.Tasks))
+	for _, task := range before.Tasks {
+		previous[task.ID] = task
+	}
+
+	var activity []TaskActivity
+	for _, task := range after.Tasks {
+		old, existed := previous[task.ID]
+		switch {
+		case !existed:
+			if !task.Deleted {
+				activity = append(activity, TaskActivity{TaskID: task.ID, Action: ActivityCreated})
+			}
+		case task.Deleted && !old.Deleted:
+			activity = append(activity, TaskActivity{TaskID: task.ID, Action: ActivityDeleted})
+		case !sameColumn(old.ColumnID, task.ColumnID):
+			activity = append(activity, TaskActivity{
+				TaskID: task.ID,
+				Action: ActivityMoved,
+				Detail: columnLabel(old.ColumnID) + " -> " + columnLabel(task.ColumnID),
+			})
+		case old.Title != task.Title || old.Description != task.Description ||
+			old.DueDate != task.DueDate || old.Hidden != task.Hidden || old.Deleted != task.Deleted ||
+			old.Completed && !task.Completed:
+			activity = append(activity, TaskActivity{TaskID: task.ID, Action: ActivityUpdated})
+		}
+
+		// Priority changes are logged on their own, alongside any other change
+		if existed && !task.Deleted && !sameColumn(old.Priority, task.Priority) {
+			activity = append(activity, TaskActivity{
+				TaskID: task.ID,
+				Action: ActivityPrioritized,
+				Detail: priorityLabel(old.Priority) + " -> " + priorityLabel(task.Priority),
+			})
+		}
+
+		// And so are completions
+		if existed && !task.Deleted && task.Completed && !old.Completed {
+			activity = append(activity, TaskActivity{TaskID: task.ID, Action: ActivityCompleted})
+		}
+	}
+	return activity
+}
+
+// stampTaskCompletion keeps completion times in step with the completed
+// flag: set when a task is completed, kept while it stays completed and
+// cleared when it's reopened. Moving a task from an open column into a done
+// one completes it, for clients that don't set the flag themselves.
+func stampTaskCompletion(previous, data *KanbanData, now time.Time) {
+	old := make(map[string]Task, len(previous.Tasks))
+	for _, task := range previous.Tasks {
+		old[task.ID] = task
+	}
+	done := make(map[string]bool)
+	for _, col := range data.Columns {
+		done[col.ID] = col.IsDone && !col.Deleted
+	}
+	inDoneColumn := func(columnID *string) bool {
+		return columnID != nil && done[*columnID]
+	}
+
+	for i := range data.Tasks {
+		task := &data.Tasks[i]
+		prev, existed := old[task.ID]
+		if existed && !prev.Completed && !sameColumn(prev.ColumnID, task.ColumnID) &&
+			inDoneColumn(task.ColumnID) && !inDoneColumn(prev.ColumnID) {
+			task.Completed = true
+		}
+		switch {
+		case !task.Completed:
+			task.CompletedAt = nil
+		case task.CompletedAt != nil:
+		case existed && prev.Completed && prev.CompletedAt != nil:
+			task.CompletedAt = prev.CompletedAt
+		default:
+			at := now.UTC()
+			task.CompletedAt = &at
+		}
+	}
+}
+
+// recordActivity appends entries to a user's activity log
+func recordActivity(tx *Tx, email string, activity []TaskActivity) error {
+	for _, entry := range activity {
+		_, err := tx.Exec(`
+			INSERT INTO activity_log (id, email, task_id, action, detail, created_at)
+			VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		`, generateID(), email, entry.TaskID, entry.Action, entry.Detail)
+		if err != nil {
+			return fmt.Errorf("failed to record activity: %w", err)
+		}
+	}
+	return nil
+}
+
+// TaskAging returns the age of each task with logged activity, keyed by task ID
+func (s *DataService) TaskAging(ctx context.Context, email string) (map[string]TaskAge, error) {
+	ctx, cancel := s.db.WithQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT task_id, created_at FROM activity_log WHERE email = ?
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query activity: %w", err)
+	}
+	defer rows.Close()
+
+	latest := make(map[string]time.Time)
+	for rows.Next() {
+		var taskID string
+		var at time.Time
+		if err := rows.Scan(&taskID, &at); err != nil {
+			return nil, fmt.Errorf("failed to scan activity: %w", err)
+		}
+		if at.After(latest[taskID]) {
+			latest[taskID] = at
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate activity: %w", err)
+	}
+
+	now := time.Now()
+	aging := make(map[string]TaskAge, len(latest))
+	for taskID, at := range latest {
+		aging[taskID] = TaskAge{
+			LastActivityAt: at,
+			StaleDays:      int(now.Sub(at).Hours() / 24),
+		}
+	}
+	return aging, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// errUserNotFound is returned when an admin action names an unknown user
+var errUserNotFound = errors.New("user not found")
+
+// errAccountDisabled rejects every credential of a disabled user
+var errAccountDisabled = errors.New("account disabled")
+
+// errSessionRevoked rejects session tokens issued before a revocation
+var errSessionRevoked = errors.New("session revoked")
+
+// StorageUsage is how many bytes a user's data takes up, by kind
+type StorageUsage struct {
+	Board       int64 `json:"board"`
+	Archive     int64 `json:"archive"`
+	Snapshots   int64 `json:"snapshots"`
+	Attachments int64 `json:"attachments"`
+	Exports     int64 `json:"exports"`
+	Total       int64 `json:"total"`
+}
+
+// UserSummary is a user as shown to admins
+type UserSummary struct {
+	Email             string       `json:"email"`
+	CreatedAt         time.Time    `json:"createdAt"`
+	DisabledAt        *time.Time   `json:"disabledAt,omitempty"`
+	SessionsRevokedAt *time.Time   `json:"sessionsRevokedAt,omitempty"`
+	Storage           StorageUsage `json:"storage"`
+}
+
+// AdminService manages user accounts for admins
+type AdminService struct {
+	db    *DB
+	hub   *Hub
+	cache *BoardCache
+}
+
+func NewAdminService(db *DB, hub *Hub, cache *BoardCache) *AdminService {
+	return &AdminService{db: db, hub: hub, cache: cache}
+}
+
+// userSummaryQuery selects users with their storage usage, leaving out the
+// rows workspace boards are stored under; the caller appends any further
+// condition with AND
+func (s *AdminService) userSummaryQuery() string {
+	size := s.db.ByteLength
+	return `
+		SELECT u.email, u.created_at, u.disabled_at, u.sessions_revoked_at,
+			COALESCE((SELECT ` + size("data") + ` FROM user_data d WHERE d.email = u.email), 0),
+			COALESCE((SELECT SUM(` + size("task") + `) FROM archived_tasks t WHERE t.email = u.email), 0),
+			COALESCE((SELECT SUM(` + size("data") + `) FROM board_snapshots b WHERE b.email = u.email), 0),
+			COALESCE((SELECT SUM(size) FROM attachments a WHERE a.email = u.email), 0),
+			COALESCE((SELECT SUM(size) FROM exports e WHERE e.email = u.email), 0)
+		FROM users u WHERE u.workspace_id = ''`
+}
+
+func scanUserSummary(row interface{ Scan(...any) error }) (*UserSummary, error) {
+	var u UserSummary
+	var createdAt, disabledAt, revokedAt sql.NullTime
+	err := row.Scan(&u.Email, &createdAt, &disabledAt, &revokedAt,
+		&u.Storage.Board, &u.Storage.Archive, &u.Storage.Snapshots, &u.Storage.Attachments, &u.Storage.Exports)
+	if err != nil {
+		return nil, err
+	}
+
+	u.CreatedAt = createdAt.Time
+	if disabledAt.Valid {
+		u.DisabledAt = &disabledAt.Time
+	}
+	if revokedAt.Valid {
+		u.SessionsRevokedAt = &revokedAt.Time
+	}
+	u.Storage.Total = u.Storage.Board + u.Storage.Archive + u.Storage.Snapshots + u.Storage.Attachments + u.Storage.Exports
+	return &u, nil
+}
+
+// ListUsers returns every user with their storage usage
+func (s *AdminService) ListUsers() ([]UserSummary, error) {
+	rows, err := s.db.Query(s.userSummaryQuery() + " ORDER BY u.email")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []UserSummary{}
+	for rows.Next() {
+		u, err := scanUserSummary(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, *u)
+	}
+	return users, rows.Err()
+}
+
+// GetUser returns one user with their storage usage
+func (s *AdminService) GetUser(email string) (*UserSummary, error) {
+	u, err := scanUserSummary(s.db.QueryRow(s.userSummaryQuery()+" AND u.email = ?", email))
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user: %w", err)
+	}
+	return u, nil
+}
+
+// SetDisabled disables or re-enables an account. Disabling closes the
+// user's WebSocket connections; their tokens and API keys stop working
+// until the account is enabled again.
+func (s *AdminService) SetDisabled(email string, disabled bool) error {
+	var disabledAt any
+	if disabled {
+		disabledAt = time.Now().UTC()
+	}
+	res, err := s.db.Exec("UPDATE users SET disabled_at = ? WHERE email = ? AND workspace_id = ''", disabledAt, email)
+	if err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errUserNotFound
+	}
+
+	if disabled {
+		s.hub.Disconnect(email)
+	}
+	return nil
+}
+
+// RevokeSessions expires every session token issued to a user so far and
+// closes their WebSocket connections. API keys keep working.
+func (s *AdminService) RevokeSessions(email string) error {
+	// Token issue times have second precision, so a token issued in the same
+	// second as the revocation is revoked as well
+	res, err := s.db.Exec("UPDATE users SET sessions_revoked_at = ? WHERE email = ? AND workspace_id = ''", time.Now().UTC().Truncate(time.Second), email)
+	if err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errUserNotFound
+	}
+
+	s.hub.Disconnect(email)
+	return nil
+}
+
+// CheckAccount is the AccountCheck rejecting disabled users and revoked
+// session tokens
+func (s *AdminService) CheckAccount(email string, issuedAt time.Time) error {
+	var disabledAt, revokedAt sql.NullTime
+	err := s.db.QueryRow("SELECT disabled_at, sessions_revoked_at FROM users WHERE email = ?", email).Scan(&disabledAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		// Users get a row once they store something
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check account: %w", err)
+	}
+
+	if disabledAt.Valid {
+		return errAccountDisabled
+	}
+	if revokedAt.Valid && !issuedAt.IsZero() && !issuedAt.After(revokedAt.Time) {
+		return errSessionRevoked
+	}
+	return nil
+}
+
+// writeSignInError answers a sign-in that couldn't issue a session token
+func writeSignInError(w http.ResponseWriter, err error) {
+	if err == errAccountDisabled {
+		writeError(w, http.StatusForbidden, "Account disabled")
+		return
+	}
+	if err == errNotInDirectory {
+		writeError(w, http.StatusForbidden, "Not allowed to sign in to this server")
+		return
+	}
+	log.Printf("Error creating JWT: %v", err)
+	writeError(w, http.StatusInternalServerError, "Authentication error")
+}
+
+// AdminHandler serves the user management API
+type AdminHandler struct {
+	adminService *AdminService
+}
+
+func NewAdminHandler(adminService *AdminService) *AdminHandler {
+	return &AdminHandler{adminService: adminService}
+}
+
+// ListUsers returns every user with their storage usage
+func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := h.adminService.ListUsers()
+	if err != nil {
+		log.Printf("Error listing users: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"users":  users,
+	})
+}
+
+// GetUser returns one user with their storage usage
+func (h *AdminHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	user, err := h.adminService.GetUser(mux.Vars(r)["email"])
+	if err == errUserNotFound {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading user: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"user":   user,
+	})
+}
+
+// Disable disables an account; admins can't disable their own
+func (h *AdminHandler) Disable(w http.ResponseWriter, r *http.Request) {
+	email := mux.Vars(r)["email"]
+	if email == requestEmail(r) {
+		writeError(w, http.StatusBadRequest, "You can't disable your own account")
+		return
+	}
+	h.setDisabled(w, email, true)
+}
+
+// Enable re-enables a disabled account
+func (h *AdminHandler) Enable(w http.ResponseWriter, r *http.Request) {
+	h.setDisabled(w, mux.Vars(r)["email"], false)
+}
+
+func (h *AdminHandler) setDisabled(w http.ResponseWriter, email string, disabled bool) {
+	err := h.adminService.SetDisabled(email, disabled)
+	if err == errUserNotFound {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating user: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"disabled": disabled,
+	})
+}
+
+// RevokeSessions signs a user out everywhere
+func (h *AdminHandler) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	err := h.adminService.RevokeSessions(mux.Vars(r)["email"])
+	if err == errUserNotFound {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+	})
+}
+
+// WebSocketStats reports the hub's connections and how many messages were
+// delivered and dropped
+func (h *AdminHandler) WebSocketStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"stats":  h.adminService.hub.Stats(),
+	})
+}
+
+// CacheStats reports the board cache's size and hit rate
+func (h *AdminHandler) CacheStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"stats":  h.adminService.cache.Stats(),
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// API key scopes
+const (
+	APIKeyScopeRead      = "read"
+	APIKeyScopeReadWrite = "read-write"
+)
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to recognise
+const apiKeyPrefix = "tdk_"
+
+// APIKey describes a user's API key. The key itself is only returned when
+// it's created; the server keeps a hash.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	Prefix     string     `json:"prefix"` // First characters, to tell keys apart
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// errAPIKeyNotFound is returned when an API key doesn't exist
+var errAPIKeyNotFound = errors.New("API key not found")
+
+// hashAPIKey returns the stored form of a key. Keys are random, so a fast
+// hash is enough.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyService issues, lists and verifies API keys
+type APIKeyService struct {
+	db          *DB
+	authService *AuthService
+}
+
+func NewAPIKeyService(db *DB, authService *AuthService) *APIKeyService {
+	return &APIKeyService{db: db, authService: authService}
+}
+
+// Create issues a new key, returning it along with its description
+func (s *APIKeyService) Create(email, name, scope string) (string, *APIKey, error) {
+	secret, err := s.authService.generateSecureToken(32)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	key := apiKeyPrefix + secret
+
+	if err := ensureUser(s.db, email); err != nil {
+		return "", nil, err
+	}
+
+	apiKey := &APIKey{
+		ID:        generateID(),
+		Name:      name,
+		Scope:     scope,
+		Prefix:    key[:len(apiKeyPrefix)+6],
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO api_keys (id, email, name, scope, prefix, key_hash, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, apiKey.ID, email, apiKey.Name, apiKey.Scope, apiKey.Prefix, hashAPIKey(key), apiKey.CreatedAt)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to store API key: %w", err)
+	}
+
+	return key, apiKey, nil
+}
+
+// List returns a user's keys, newest first
+func (s *APIKeyService) List(email string) ([]APIKey, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, scope, prefix, created_at, last_used_at
+		FROM api_keys WHERE email = ? ORDER BY created_at DESC
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&key.ID, &key.Name, &key.Scope, &key.Prefix, &key.CreatedAt, &lastUsed); err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		if lastUsed.Valid {
+			key.LastUsedAt = &lastUsed.Time
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Revoke deletes one of a user's keys
+func (s *APIKeyService) Revoke(email, id string) error {
+	result, err := s.db.Exec("DELETE FROM api_keys WHERE id = ? AND email = ?", id, email)
+	if err != nil {
+		return fmt.Errorf("failed to delete API key: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+// Authenticate returns the user and scope of a key, recording its use
+func (s *APIKeyService) Authenticate(key string) (string, string, error) {
+	hash := hashAPIKey(key)
+
+	var email, scope string
+	err := s.db.QueryRow("SELECT email, scope FROM api_keys WHERE key_hash = ?", hash).Scan(&email, &scope)
+	if err == sql.ErrNoRows {
+		return "", "", errors.New("invalid API key")
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to query API key: %w", err)
+	}
+
+	if _, err := s.db.Exec("UPDATE api_keys SET last_used_at = ? WHERE key_hash = ?", time.Now().UTC(), hash); err != nil {
+		log.Printf("Error recording API key use: %v", err)
+	}
+	return email, scope, nil
+}
+
+// APIKeyHandler serves API key management
+type APIKeyHandler struct {
+	apiKeyService *APIKeyService
+}
+
+func NewAPIKeyHandler(apiKeyService *APIKeyService) *APIKeyHandler {
+	return &APIKeyHandler{apiKeyService: apiKeyService}
+}
+
+// List returns the user's keys without their secrets
+func (h *APIKeyHandler) List(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.apiKeyService.List(requestEmail(r))
+	if err != nil {
+		log.Printf("Error listing API keys: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"keys":   keys,
+	})
+}
+
+// Create issues a key. The response is the only time the key is shown.
+func (h *APIKeyHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name  string `json:"name"`
+		Scope string `json:"scope"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = APIKeyScopeRead
+	}
+	if req.Scope != APIKeyScopeRead && req.Scope != APIKeyScopeReadWrite {
+		writeError(w, http.StatusBadRequest, "scope must be read or read-write")
+		return
+	}
+
+	key, apiKey, err := h.apiKeyService.Create(requestEmail(r), req.Name, req.Scope)
+	if err != nil {
+		log.Printf("Error creating API key: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"key":    key,
+		"apiKey": apiKey,
+	})
+}
+
+// Delete revokes a key
+func (h *APIKeyHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	err := h.apiKeyService.Revoke(requestEmail(r), mux.Vars(r)["id"])
+	if err == errAPIKeyNotFound {
+		writeError(w, http.StatusNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking API key: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
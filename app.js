@@ -180,6 +180,11 @@ class KanbanApp {
 
     // Set up drag and drop after rendering
     this.setupDragAndDrop();
+
+    // Re-mark cards other people are editing
+    if (this.authManager) {
+      this.authManager.applyEditingIndicators();
+    }
   }
 
   /**
@@ -333,6 +338,12 @@ class KanbanApp {
 
       // Show delete button for existing tasks
       this.deleteTaskBtn.classList.remove('hidden');
+
+      // Let others on the board know this card is being edited
+      this.editingTaskId = taskId;
+      if (this.authManager) {
+        this.authManager.sendEditing(taskId, true);
+      }
     } else {
       // Add new task
       modalTitle.textContent = 'Add Task';
@@ -359,6 +370,13 @@ class KanbanApp {
   closeTaskModal() {
     this.taskModalOverlay.style.display = 'none';
     this.taskForm.reset();
+
+    if (this.editingTaskId) {
+      if (this.authManager) {
+        this.authManager.sendEditing(this.editingTaskId, false);
+      }
+      this.editingTaskId = null;
+    }
   }
 
   /**
@@ -442,7 +460,7 @@ class KanbanApp {
    */
   deleteTask() {
     const taskId = document.getElementById('task-id').value;
-    if (taskId && confirm('Tasks cannot be permanently deleted due to database sync. The task will be marked as deleted instead. Continue?')) {
+    if (taskId && confirm('The task will be moved to the trash, where it can be restored for 30 days. Continue?')) {
       this.taskHandler.markTaskAsDeleted(taskId);
       this.closeTaskModal();
     }
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Archive listing page sizes
+const (
+	defaultArchivePageSize = 50
+	maxArchivePageSize     = 200
+)
+
+// ArchivedTask is a task moved off the active board
+type ArchivedTask struct {
+	Task        Task      `json:"task"`
+	ColumnTitle string    `json:"columnTitle,omitempty"`
+	ArchivedAt  time.Time `json:"archivedAt"`
+}
+
+// ArchiveQuery selects a page of archived tasks; zero times are unbounded
+type ArchiveQuery struct {
+	From   time.Time
+	To     time.Time
+	Limit  int
+	Offset int
+}
+
+// errArchivedTaskNotFound is returned when a task isn't in the archive
+var errArchivedTaskNotFound = errors.New("archived task not found")
+
+// errTaskExists is returned when restoring a task whose ID is on the board
+var errTaskExists = errors.New("a task with this ID is already on the board")
+
+// ArchiveService moves tasks between the board and the archive
+type ArchiveService struct {
+	db          *DB
+	dataService *DataService
+}
+
+func NewArchiveService(db *DB, dataService *DataService) *ArchiveService {
+	return &ArchiveService{db: db, dataService: dataService}
+}
+
+// archiveTasks removes the given live tasks from the board and stores them
+// in the archive, in the caller's transaction
+func archiveTasks(tx *Tx, email string, data *KanbanData, taskIDs []string, now time.Time) error {
+	titles := make(map[string]string)
+	for _, col := range data.Columns {
+		titles[col.ID] = col.Title
+	}
+
+	for _, taskID := range taskIDs {
+		i := findTask(data, taskID)
+		if i < 0 {
+			return errTaskNotFound
+		}
+		task := data.Tasks[i]
+
+		encoded, err := json.Marshal(task)
+		if err != nil {
+			return fmt.Errorf("failed to encode task: %w", err)
+		}
+		columnTitle := ""
+		if task.ColumnID != nil {
+			columnTitle = titles[*task.ColumnID]
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO archived_tasks (email, task_id, task, column_title, archived_at)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(email, task_id) DO UPDATE SET
+				task = excluded.task,
+				column_title = excluded.column_title,
+				archived_at = excluded.archived_at
+		`, email, task.ID, string(encoded), columnTitle, now)
+		if err != nil {
+			return fmt.Errorf("failed to archive task: %w", err)
+		}
+
+		data.Tasks = append(data.Tasks[:i], data.Tasks[i+1:]...)
+	}
+	return nil
+}
+
+// dropArchivedTasks removes tasks that are in the archive from a board, so
+// a client that still holds an archived task can't sync it back
+func (s *DataService) dropArchivedTasks(q querier, email string, data *KanbanData) error {
+	rows, err := q.Query("SELECT task_id FROM archived_tasks WHERE email = ?", email)
+	if err != nil {
+		return fmt.Errorf("failed to query archived tasks: %w", err)
+	}
+	defer rows.Close()
+
+	archived := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("failed to scan archived task: %w", err)
+		}
+		archived[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(archived) == 0 {
+		return nil
+	}
+
+	tasks := data.Tasks[:0]
+	for _, task := range data.Tasks {
+		if !archived[task.ID] {
+			tasks = append(tasks, task)
+		}
+	}
+	data.Tasks = tasks
+	return nil
+}
+
+// Archive moves a task from the user's board into the archive
+func (s *ArchiveService) Archive(ctx context.Context, email, taskID string) (*KanbanData, error) {
+	return s.dataService.UpdateUserDataTx(ctx, email, func(tx *Tx, data *KanbanData) error {
+		return archiveTasks(tx, email, data, []string{taskID}, time.Now().UTC())
+	})
+}
+
+// List returns a page of the user's archived tasks, newest first, and the
+// total matching the query's date range
+func (s *ArchiveService) List(email string, q ArchiveQuery) ([]ArchivedTask, int, error) {
+	where := "email = ?"
+	args := []any{email}
+	if !q.From.IsZero() {
+		where += " AND archived_at >= ?"
+		args = append(args, q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		where += " AND archived_at < ?"
+		args = append(args, q.To.UTC())
+	}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM archived_tasks WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count archived tasks: %w", err)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT task, column_title, archived_at FROM archived_tasks
+		WHERE `+where+`
+		ORDER BY archived_at DESC, task_id
+		LIMIT ? OFFSET ?
+	`, append(args, q.Limit, q.Offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query archived tasks: %w", err)
+	}
+	defer rows.Close()
+
+	archived := []ArchivedTask{}
+	for rows.Next() {
+		var a ArchivedTask
+		var encoded string
+		if err := rows.Scan(&encoded, &a.ColumnTitle, &a.ArchivedAt); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan archived task: %w", err)
+		}
+		if err := json.Unmarshal([]byte(encoded), &a.Task); err != nil {
+			return nil, 0, fmt.Errorf("failed to decode archived task: %w", err)
+		}
+		archived = append(archived, a)
+	}
+	return archived, total, rows.Err()
+}
+
+// Restore moves a task from the archive back onto the board. It returns to
+// its column if that still exists, otherwise it becomes unassigned.
+func (s *ArchiveService) Restore(ctx context.Context, email, taskID string) (*KanbanData, error) {
+	return s.dataService.UpdateUserDataTx(ctx, email, func(tx *Tx, data *KanbanData) error {
+		var encoded string
+		err := tx.QueryRow(`
+			SELECT task FROM archived_tasks WHERE email = ? AND task_id = ?
+		`, email, taskID).Scan(&encoded)
+		if err == sql.ErrNoRows {
+			return errArchivedTaskNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to query archived task: %w", err)
+		}
+
+		var task Task
+		if err := json.Unmarshal([]byte(encoded), &task); err != nil {
+			return fmt.Errorf("failed to decode archived task: %w", err)
+		}
+
+		for _, existing := range data.Tasks {
+			if existing.ID == task.ID {
+				return errTaskExists
+			}
+		}
+		if task.ColumnID != nil && findColumn(data, *task.ColumnID) < 0 {
+			task.ColumnID = nil
+		}
+		data.Tasks = append(data.Tasks, task)
+
+		_, err = tx.Exec("DELETE FROM archived_tasks WHERE email = ? AND task_id = ?", email, taskID)
+		if err != nil {
+			return fmt.Errorf("failed to remove archived task: %w", err)
+		}
+		return nil
+	})
+}
+
+// ArchiveHandler exposes the archive over HTTP
+type ArchiveHandler struct {
+	archiveService *ArchiveService
+	hub            *Hub
+}
+
+func NewArchiveHandler(archiveService *ArchiveService, hub *Hub) *ArchiveHandler {
+	return &ArchiveHandler{archiveService: archiveService, hub: hub}
+}
+
+// Archive moves a task into the archive
+func (h *ArchiveHandler) Archive(w http.ResponseWriter, r *http.Request) {
+	data, err := h.archiveService.Archive(r.Context(), requestEmail(r), mux.Vars(r)["id"])
+	if err == errTaskNotFound {
+		writeError(w, http.StatusNotFound, "Task not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error archiving task: %v", err)
+		writeServerError(w, err, "Failed to archive task")
+		return
+	}
+
+	// Push the smaller board to connected clients
+	h.hub.PublishBoard(canonicalBoardID(requestEmail(r), ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"data":   data,
+	})
+}
+
+// parseArchiveDate parses a from/to filter as a date or RFC 3339 time
+func parseArchiveDate(raw string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", raw); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+// List returns archived tasks, paginated with limit/offset and filtered by
+// archive date with from (inclusive) and to (exclusive)
+func (h *ArchiveHandler) List(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := ArchiveQuery{Limit: defaultArchivePageSize}
+
+	var err error
+	if raw := query.Get("limit"); raw != "" {
+		if q.Limit, err = strconv.Atoi(raw); err != nil || q.Limit < 1 || q.Limit > maxArchivePageSize {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxArchivePageSize))
+			return
+		}
+	}
+	if raw := query.Get("offset"); raw != "" {
+		if q.Offset, err = strconv.Atoi(raw); err != nil || q.Offset < 0 {
+			writeError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+	}
+	if raw := query.Get("from"); raw != "" {
+		if q.From, err = parseArchiveDate(raw); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid from date")
+			return
+		}
+	}
+	if raw := query.Get("to"); raw != "" {
+		if q.To, err = parseArchiveDate(raw); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid to date")
+			return
+		}
+	}
+
+	archived, total, err := h.archiveService.List(requestEmail(r), q)
+	if err != nil {
+		log.Printf("Error listing archive: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"tasks":  archived,
+		"total":  total,
+		"limit":  q.Limit,
+		"offset": q.Offset,
+	})
+}
+
+// Restore moves an archived task back onto the board
+func (h *ArchiveHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	data, err := h.archiveService.Restore(r.Context(), requestEmail(r), mux.Vars(r)["id"])
+	if err == errArchivedTaskNotFound {
+		writeError(w, http.StatusNotFound, "Archived task not found")
+		return
+	}
+	if err == errTaskExists {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error restoring task: %v", err)
+		writeServerError(w, err, "Failed to restore task")
+		return
+	}
+
+	h.hub.PublishBoard(canonicalBoardID(requestEmail(r), ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"data":   data,
+	})
+}
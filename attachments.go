@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AttachmentConfig selects where attachment content is stored and what
+// uploads are accepted
+type AttachmentConfig struct {
+	// "local" or "s3"
+	Storage      string
+	Dir          string
+	MaxSize      int64
+	AllowedTypes []string
+	S3           S3Config
+}
+
+// S3Config addresses an S3-compatible bucket
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+// defaultAttachmentTypes are accepted when ATTACHMENT_ALLOWED_TYPES is unset
+var defaultAttachmentTypes = []string{"image/*", "application/pdf", "text/plain", "text/csv", "text/markdown"}
+
+// AttachmentStore holds attachment content, keyed by opaque storage keys
+type AttachmentStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// NewAttachmentStore returns the store selected by the configuration
+func NewAttachmentStore(cfg AttachmentConfig) (AttachmentStore, error) {
+	switch cfg.Storage {
+	case "local":
+		if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create attachment directory: %w", err)
+		}
+		return &localAttachmentStore{dir: cfg.Dir}, nil
+	case "s3":
+		return newS3AttachmentStore(cfg.S3), nil
+	default:
+		return nil, fmt.Errorf("unknown attachment storage %q", cfg.Storage)
+	}
+}
+
+// localAttachmentStore keeps attachments as files in a directory
+type localAttachmentStore struct {
+	dir string
+}
+
+func (s *localAttachmentStore) path(key string) string {
+	// Keys are generated IDs, but never let one escape the directory
+	return filepath.Join(s.dir, filepath.Base(key))
+}
+
+func (s *localAttachmentStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	f, err := os.OpenFile(s.path(key), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return f.Close()
+}
+
+func (s *localAttachmentStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+func (s *localAttachmentStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// List returns the keys of the files whose names start with prefix
+func (s *localAttachmentStore) List(ctx context.Context, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasPrefix(entry.Name(), prefix) {
+			keys = append(keys, entry.Name())
+		}
+	}
+	return keys, nil
+}
+
+// Attachment is the metadata of a file attached to a task
+type Attachment struct {
+	ID          string    `json:"id"`
+	TaskID      string    `json:"taskId"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"createdAt"`
+
+	storageKey string
+}
+
+// errAttachmentNotFound is returned when an attachment doesn't exist
+var errAttachmentNotFound = errors.New("attachment not found")
+
+// errTaskNotFound is returned when a task isn't on the user's board
+var errTaskNotFound = errors.New("task not found")
+
+// AttachmentService stores attachment metadata and content
+type AttachmentService struct {
+	db           *DB
+	dataService  *DataService
+	store        AttachmentStore
+	allowedTypes []string
+
+	// Total bytes of attachments a user may keep; 0 is unlimited
+	quota int64
+}
+
+func NewAttachmentService(db *DB, dataService *DataService, store AttachmentStore, cfg AttachmentConfig) *AttachmentService {
+	return &AttachmentService{
+		db:           db,
+		dataService:  dataService,
+		store:        store,
+		allowedTypes: cfg.AllowedTypes,
+	}
+}
+
+// LimitStorage caps the total size of each user's attachments
+func (s *AttachmentService) LimitStorage(quota int64) {
+	s.quota = quota
+}
+
+// checkQuota refuses an upload that would take a user's attachments over
+// the quota
+func (s *AttachmentService) checkQuota(email string, size int64) error {
+	if s.quota <= 0 {
+		return nil
+	}
+	var used int64
+	if err := s.db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM attachments WHERE email = ?", email).Scan(&used); err != nil {
+		return fmt.Errorf("failed to query attachment usage: %w", err)
+	}
+	if used+size > s.quota {
+		return &QuotaError{Quota: QuotaAttachmentBytes, Limit: s.quota, Requested: used + size}
+	}
+	return nil
+}
+
+// typeAllowed reports whether a content type matches the allowlist, where
+// "image/*" matches any image type
+func (s *AttachmentService) typeAllowed(contentType string) bool {
+	for _, allowed := range s.allowedTypes {
+		if allowed == contentType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(contentType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Create stores an upload and its metadata for a task on the user's board
+func (s *AttachmentService) Create(ctx context.Context, email, taskID, filename, contentType string, size int64, content io.Reader) (*Attachment, error) {
+	data, err := s.dataService.GetUserData(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if findTask(data, taskID) < 0 {
+		return nil, errTaskNotFound
+	}
+
+	if err := s.checkQuota(email, size); err != nil {
+		return nil, err
+	}
+	if err := ensureUser(s.db, email); err != nil {
+		return nil, err
+	}
+
+	id := generateID()
+	key := email + "/" + id
+	if err := s.store.Put(ctx, key, content, size, contentType); err != nil {
+		return nil, fmt.Errorf("failed to store attachment: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO attachments (id, email, task_id, filename, content_type, size, storage_key, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`, id, email, taskID, filename, contentType, size, key)
+	if err != nil {
+		s.store.Delete(ctx, key)
+		return nil, fmt.Errorf("failed to save attachment: %w", err)
+	}
+
+	return s.Get(id)
+}
+
+// List returns the attachments of one of the user's tasks
+func (s *AttachmentService) List(email, taskID string) ([]Attachment, error) {
+	rows, err := s.db.Query(`
+		SELECT id, task_id, filename, content_type, size, storage_key, created_at
+		FROM attachments WHERE email = ? AND task_id = ? ORDER BY created_at
+	`, email, taskID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attachments: %w", err)
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.TaskID, &a.Filename, &a.ContentType, &a.Size, &a.storageKey, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan attachment: %w", err)
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// ListAll returns all of the user's attachments
+func (s *AttachmentService) ListAll(email string) ([]Attachment, error) {
+	rows, err := s.db.Query(`
+		SELECT id, task_id, filename, content_type, size, storage_key, created_at
+		FROM attachments WHERE email = ? ORDER BY created_at
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attachments: %w", err)
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.TaskID, &a.Filename, &a.ContentType, &a.Size, &a.storageKey, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan attachment: %w", err)
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// Get returns an attachment's metadata
+func (s *AttachmentService) Get(id string) (*Attachment, error) {
+	var a Attachment
+	err := s.db.QueryRow(`
+		SELECT id, task_id, filename, content_type, size, storage_key, created_at
+		FROM attachments WHERE id = ?
+	`, id).Scan(&a.ID, &a.TaskID, &a.Filename, &a.ContentType, &a.Size, &a.storageKey, &a.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errAttachmentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attachment: %w", err)
+	}
+	return &a, nil
+}
+
+// Owner returns the email that owns an attachment
+func (s *AttachmentService) Owner(id string) (string, error) {
+	var email string
+	err := s.db.QueryRow("SELECT email FROM attachments WHERE id = ?", id).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", errAttachmentNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query attachment: %w", err)
+	}
+	return email, nil
+}
+
+// Open returns an attachment's content
+func (s *AttachmentService) Open(ctx context.Context, a *Attachment) (io.ReadCloser, error) {
+	return s.store.Get(ctx, a.storageKey)
+}
+
+// Delete removes an attachment's metadata and content
+func (s *AttachmentService) Delete(ctx context.Context, id string) error {
+	a, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec("DELETE FROM attachments WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete attachment: %w", err)
+	}
+
+	s.DeleteContent(ctx, []Attachment{*a})
+	return nil
+}
+
+// DeleteContent removes the stored content of attachments whose metadata
+// is already gone
+func (s *AttachmentService) DeleteContent(ctx context.Context, attachments []Attachment) {
+	for _, a := range attachments {
+		if err := s.store.Delete(ctx, a.storageKey); err != nil {
+			// The metadata is gone, so the content is unreachable; just log it
+			log.Printf("Error deleting attachment content %s: %v", a.storageKey, err)
+		}
+	}
+}
+
+// AttachmentHandler exposes task attachments over HTTP
+type AttachmentHandler struct {
+	attachmentService *AttachmentService
+	maxSize           int64
+}
+
+func NewAttachmentHandler(attachmentService *AttachmentService, cfg AttachmentConfig) *AttachmentHandler {
+	return &AttachmentHandler{attachmentService: attachmentService, maxSize: cfg.MaxSize}
+}
+
+// attachmentOwner resolves the owner of the attachment in the route, for OwnsResource
+func (h *AttachmentHandler) attachmentOwner(r *http.Request) (string, error) {
+	return h.attachmentService.Owner(mux.Vars(r)["id"])
+}
+
+// Upload stores a multipart "file" upload as an attachment of the task
+func (h *AttachmentHandler) Upload(w http.ResponseWriter, r *http.Request) {
+	// Leave room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxSize+64*1024)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Expected a multipart/form-data upload")
+		return
+	}
+
+	var part io.Reader
+	var filename, contentType string
+	for {
+		p, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid multipart upload")
+			return
+		}
+		if p.FormName() == "file" {
+			part, filename, contentType = p, filepath.Base(p.FileName()), p.Header.Get("Content-Type")
+			break
+		}
+	}
+	if part == nil || filename == "" || filename == "." {
+		writeError(w, http.StatusBadRequest, "file is required")
+		return
+	}
+
+	// Trust the content, not the client, when the declared type is generic
+	buffered := bufio.NewReaderSize(part, 512)
+	if contentType == "" || contentType == "application/octet-stream" {
+		head, _ := buffered.Peek(512)
+		contentType = http.DetectContentType(head)
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	if !h.attachmentService.typeAllowed(contentType) {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Attachments of type %s are not allowed", contentType))
+		return
+	}
+
+	// Spool to a temp file so the size is known and enforced before storing
+	tmp, err := os.CreateTemp("", "attachment-*")
+	if err != nil {
+		log.Printf("Error creating temp file: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, io.LimitReader(buffered, h.maxSize+1))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "Upload too large or interrupted")
+		return
+	}
+	if size > h.maxSize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Attachments are limited to %d bytes", h.maxSize))
+		return
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Error rewinding temp file: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	attachment, err := h.attachmentService.Create(r.Context(), requestEmail(r), mux.Vars(r)["id"], filename, contentType, size, tmp)
+	if err == errTaskNotFound {
+		writeError(w, http.StatusNotFound, "Task not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating attachment: %v", err)
+		writeServerError(w, err, "Failed to save attachment")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     "success",
+		"attachment": attachment,
+	})
+}
+
+// List returns a task's attachments
+func (h *AttachmentHandler) List(w http.ResponseWriter, r *http.Request) {
+	attachments, err := h.attachmentService.List(requestEmail(r), mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Error listing attachments: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":      "success",
+		"attachments": attachments,
+	})
+}
+
+// Download streams an attachment's content
+func (h *AttachmentHandler) Download(w http.ResponseWriter, r *http.Request) {
+	attachment, err := h.attachmentService.Get(mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Error loading attachment: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	content, err := h.attachmentService.Open(r.Context(), attachment)
+	if err != nil {
+		log.Printf("Error opening attachment: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", fmt.Sprint(attachment.Size))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, content)
+}
+
+// Delete removes an attachment
+func (h *AttachmentHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if err := h.attachmentService.Delete(r.Context(), mux.Vars(r)["id"]); err != nil {
+		log.Printf("Error deleting attachment: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
@@ -1,4 +1,5 @@
 // Authentication components and functions
+import { base64urlToBuffer, bufferToBase64url, generateId } from './utils.js';
 
 class AuthManager {
   constructor(app) {
@@ -7,6 +8,27 @@ class AuthManager {
     this.email = null;
     this.authToken = null;
     this.syncIntervalId = null;
+    this.mfaChallenge = null;
+
+    // Other users editing tasks on this board: task ID -> Set of emails
+    this.editors = new Map();
+
+    // Realtime updates come over a WebSocket, or over Server-Sent Events
+    // where WebSockets don't get through (see realtimeTransport)
+    this.ws = null;
+    this.events = null;
+    this.lastEventId = null;
+    this.wsFailures = 0;
+
+    // The WebSocket's delivery session and the last board message seq
+    // received in it, for resuming after a dropped connection
+    this.wsSession = null;
+    this.wsSeq = 0;
+    this.wsAckTimer = null;
+
+    // Whether the last sync failed, leaving local changes unsaved
+    this.syncFailed = false;
+    this.useEventStream = false;
 
     // Initialize authentication-related DOM elements
     this.loginOverlay = document.getElementById('login-overlay');
@@ -15,6 +37,15 @@ class AuthManager {
     this.loginButton = document.getElementById('login-button');
     this.loginStatus = document.getElementById('login-status');
     this.logoutButton = document.getElementById('logout-button');
+    this.passkeyLoginButton = document.getElementById('passkey-login-button');
+    this.addPasskeyButton = document.getElementById('add-passkey-button');
+
+    // Offer passkeys when the server and browser both support them
+    const modes = (window.appConfig && window.appConfig.auth && window.appConfig.auth.modes) || [];
+    if (modes.includes('passkey') && window.PublicKeyCredential) {
+      this.passkeyLoginButton.classList.remove('hidden');
+      this.addPasskeyButton.classList.remove('hidden');
+    }
 
     this.bindEvents();
     this.checkForExistingSession();
@@ -28,13 +59,25 @@ class AuthManager {
     // Login form submission
     this.loginForm.addEventListener('submit', (e) => {
       e.preventDefault();
-      this.requestMagicLink();
+      if (this.mfaChallenge) {
+        this.verifyCode();
+      } else {
+        this.requestMagicLink();
+      }
     });
 
     // Logout button click
     this.logoutButton.addEventListener('click', () => {
       this.logout();
     });
+
+    this.passkeyLoginButton.addEventListener('click', () => {
+      this.loginWithPasskey();
+    });
+
+    this.addPasskeyButton.addEventListener('click', () => {
+      this.registerPasskey();
+    });
   }
 
   /**
@@ -46,27 +89,378 @@ class AuthManager {
 
     if (token && email) {
       this.verifyToken(token, email);
+    } else if (this.csrfToken()) {
+      // A cookie session; the server knows who we are
+      this.verifyToken(null, null);
     } else {
       this.showLoginForm();
     }
   }
 
   /**
-   * Check URL for magic link token parameter
+   * The CSRF token of a cookie session, or null with a Bearer token
+   */
+  csrfToken() {
+    const cookie = document.cookie.split('; ').find(c => c.startsWith('csrf_token='));
+    return cookie ? cookie.slice('csrf_token='.length) : null;
+  }
+
+  /**
+   * ID for this browser, sent with syncs so the server can tell which
+   * client last had which board
+   */
+  clientId() {
+    let id = localStorage.getItem('kanbanClientId');
+    if (!id) {
+      id = generateId();
+      localStorage.setItem('kanbanClientId', id);
+    }
+    return id;
+  }
+
+  /**
+   * Headers authenticating a request: the Bearer token, or with a cookie
+   * session the CSRF token the server checks against its cookie
+   */
+  authHeaders(headers = {}) {
+    const token = this.authToken || localStorage.getItem('authToken');
+    if (token) {
+      return { ...headers, 'Authorization': `Bearer ${token}` };
+    }
+    const csrf = this.csrfToken();
+    return csrf ? { ...headers, 'X-CSRF-Token': csrf } : headers;
+  }
+
+  /**
+   * Check URL for the code a followed magic link redirects with
    */
   checkForMagicLinkToken() {
     const urlParams = new URLSearchParams(window.location.search);
-    const token = urlParams.get('token');
+    const code = urlParams.get('code');
     const email = urlParams.get('email');
+    const challenge = urlParams.get('mfa');
+    const deletion = urlParams.get('delete-account');
+    const emailChange = urlParams.get('change-email');
+    const invitation = urlParams.get('workspace-invite');
 
-    if (token && email) {
-      // Remove token from URL (for security)
+    if (deletion) {
+      window.history.replaceState({}, document.title, window.location.pathname);
+      this.confirmAccountDeletion(deletion);
+      return;
+    }
+
+    if (emailChange && email) {
       window.history.replaceState({}, document.title, window.location.pathname);
+      this.confirmEmailChange(emailChange, email);
+      return;
+    }
+
+    if (invitation) {
+      window.history.replaceState({}, document.title, window.location.pathname);
+      this.acceptWorkspaceInvitation(invitation);
+      return;
+    }
+
+    if (challenge && email) {
+      window.history.replaceState({}, document.title, window.location.pathname);
+      this.promptForCode(challenge, email);
+      return;
+    }
+
+    if (code) {
+      // Remove code from URL (for security)
+      window.history.replaceState({}, document.title, window.location.pathname);
+      this.exchangeCode(code);
+    }
+  }
+
+  /**
+   * Swap a magic link's one-time code for a session token
+   */
+  async exchangeCode(code) {
+    try {
+      const response = await fetch('/api/auth/exchange', {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json'
+        },
+        body: JSON.stringify({ code })
+      });
+
+      if (response.ok) {
+        const data = await response.json();
+        this.authenticateUser(data.token || null, data.email);
+      } else {
+        this.loginStatus.textContent = response.status === 403
+          ? 'This account has been disabled.'
+          : 'That login link has expired. Please request a new one.';
+        this.loginStatus.className = 'status-error';
+        this.showLoginForm();
+      }
+    } catch (error) {
+      console.error('Login link exchange error:', error);
+      this.loginStatus.textContent = 'Login failed. Please try again.';
+      this.loginStatus.className = 'status-error';
+      this.showLoginForm();
+    }
+  }
+
+  /**
+   * Switch the login form to ask for a two-factor code after a magic link
+   */
+  promptForCode(challenge, email) {
+    this.mfaChallenge = challenge;
+    this.loginForm.querySelector('label[for="email-input"]').textContent = 'Two-Factor Code';
+    this.emailInput.type = 'text';
+    this.emailInput.value = '';
+    this.emailInput.placeholder = 'Authenticator or backup code';
+    this.emailInput.autocomplete = 'one-time-code';
+    this.loginButton.textContent = 'Verify';
+    this.loginStatus.textContent = `Enter the code from your authenticator app for ${email}`;
+    this.loginStatus.className = 'status-info';
+    this.showLoginForm();
+    this.emailInput.focus();
+  }
+
+  /**
+   * Put the login form back to requesting a magic link
+   */
+  resetLoginForm() {
+    this.mfaChallenge = null;
+    this.loginForm.querySelector('label[for="email-input"]').textContent = 'Email Address';
+    this.emailInput.type = 'email';
+    this.emailInput.value = '';
+    this.emailInput.placeholder = 'Enter your email';
+    this.emailInput.autocomplete = 'email';
+    this.loginButton.textContent = 'Send Login Link';
+    this.loginStatus.textContent = '';
+    this.loginStatus.className = 'login-status';
+  }
+
+  /**
+   * Exchange a two-factor code and the pending challenge for a session
+   */
+  async verifyCode() {
+    const code = this.emailInput.value.trim();
+    if (!code) {
+      this.loginStatus.textContent = 'Please enter a code';
+      this.loginStatus.className = 'status-error';
+      return;
+    }
+
+    this.loginButton.disabled = true;
+    try {
+      const response = await fetch('/api/auth/totp/verify', {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json'
+        },
+        body: JSON.stringify({ challenge: this.mfaChallenge, code })
+      });
+
+      if (response.ok) {
+        const data = await response.json();
+        this.resetLoginForm();
+        this.authenticateUser(data.token || null, data.email);
+      } else if ((await response.json().catch(() => ({}))).code === 'invalid_challenge') {
+        this.resetLoginForm();
+        this.loginStatus.textContent = 'That sign-in has expired. Please request a new login link.';
+        this.loginStatus.className = 'status-error';
+      } else {
+        this.loginStatus.textContent = response.status === 429
+          ? 'Too many attempts. Please try again later.'
+          : 'That code is invalid or was already used.';
+        this.loginStatus.className = 'status-error';
+      }
+    } catch (error) {
+      console.error('Code verification error:', error);
+      this.loginStatus.textContent = 'Verification failed. Please try again.';
+      this.loginStatus.className = 'status-error';
+    } finally {
+      this.loginButton.disabled = false;
+    }
+  }
+
+  /**
+   * Sign in with a passkey: the server's options go to the browser's
+   * authenticator, and its signed answer back to the server for a token
+   */
+  async loginWithPasskey() {
+    this.passkeyLoginButton.disabled = true;
+    try {
+      const begin = await fetch('/api/auth/webauthn/login/begin', { method: 'POST' });
+      if (!begin.ok) throw new Error(await begin.text());
+      const { ceremony, options } = await begin.json();
+
+      const publicKey = options.publicKey;
+      publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+      (publicKey.allowCredentials || []).forEach(cred => {
+        cred.id = base64urlToBuffer(cred.id);
+      });
+
+      const credential = await navigator.credentials.get({ publicKey });
+      const finish = await fetch(`/api/auth/webauthn/login/finish?ceremony=${encodeURIComponent(ceremony)}`, {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json'
+        },
+        body: JSON.stringify({
+          id: credential.id,
+          rawId: bufferToBase64url(credential.rawId),
+          type: credential.type,
+          response: {
+            clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+            authenticatorData: bufferToBase64url(credential.response.authenticatorData),
+            signature: bufferToBase64url(credential.response.signature),
+            userHandle: credential.response.userHandle ? bufferToBase64url(credential.response.userHandle) : null
+          }
+        })
+      });
+      if (!finish.ok) throw new Error(await finish.text());
+
+      const data = await finish.json();
+      this.resetLoginForm();
+      this.authenticateUser(data.token, data.email);
+    } catch (error) {
+      console.error('Passkey login error:', error);
+      this.loginStatus.textContent = 'Passkey sign-in failed. Please try again or use a login link.';
+      this.loginStatus.className = 'status-error';
+    } finally {
+      this.passkeyLoginButton.disabled = false;
+    }
+  }
+
+  /**
+   * Add a passkey for the signed-in user
+   */
+  async registerPasskey() {
+    const headers = this.authHeaders();
+
+    try {
+      const begin = await fetch('/api/auth/webauthn/register/begin', { method: 'POST', headers });
+      if (!begin.ok) throw new Error(await begin.text());
+      const { ceremony, options } = await begin.json();
+
+      const publicKey = options.publicKey;
+      publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+      publicKey.user.id = base64urlToBuffer(publicKey.user.id);
+      (publicKey.excludeCredentials || []).forEach(cred => {
+        cred.id = base64urlToBuffer(cred.id);
+      });
+
+      const credential = await navigator.credentials.create({ publicKey });
+      const name = navigator.platform || 'Passkey';
+      const finish = await fetch(`/api/auth/webauthn/register/finish?ceremony=${encodeURIComponent(ceremony)}&name=${encodeURIComponent(name)}`, {
+        method: 'POST',
+        headers: { ...headers, 'Content-Type': 'application/json' },
+        body: JSON.stringify({
+          id: credential.id,
+          rawId: bufferToBase64url(credential.rawId),
+          type: credential.type,
+          response: {
+            clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+            attestationObject: bufferToBase64url(credential.response.attestationObject)
+          }
+        })
+      });
+      if (!finish.ok) throw new Error(await finish.text());
+
+      alert('Passkey added. You can use it to sign in from now on.');
+    } catch (error) {
+      console.error('Passkey registration error:', error);
+      alert('Could not add a passkey.');
+    }
+  }
+
+  /**
+   * Delete the account after following the link from the confirmation email
+   */
+  async confirmAccountDeletion(token) {
+    if (!localStorage.getItem('userEmail')) {
+      alert('Sign in, then open the link from the email again to delete your account.');
+      return;
+    }
+    if (!confirm('Delete your account and all of its data? This cannot be undone.')) {
+      return;
+    }
+
+    try {
+      const response = await fetch('/api/account', {
+        method: 'DELETE',
+        headers: this.authHeaders({
+          'Content-Type': 'application/json'
+        }),
+        body: JSON.stringify({ token })
+      });
+      if (!response.ok) throw new Error((await response.json()).message);
+
+      alert('Your account has been deleted.');
+      this.logout();
+    } catch (error) {
+      console.error('Account deletion error:', error);
+      alert('Could not delete your account. The link may have expired.');
+    }
+  }
+
+  /**
+   * Move the account to a new address after following the link sent to
+   * it, offering to merge when an account already exists there
+   */
+  async confirmEmailChange(token, email, merge = false) {
+    if (!localStorage.getItem('userEmail')) {
+      alert('Sign in, then open the link from the email again to change your address.');
+      return;
+    }
+
+    try {
+      const response = await fetch('/api/account/email', {
+        method: 'POST',
+        headers: this.authHeaders({
+          'Content-Type': 'application/json'
+        }),
+        body: JSON.stringify({ token, email, merge })
+      });
+      const data = await response.json();
+      if (response.status === 409 && data.code === 'account_exists' && !merge) {
+        if (confirm(`${email} already has an account. Merge yours into it? Where both have the same item or setting, theirs is kept.`)) {
+          await this.confirmEmailChange(token, email, true);
+        }
+        return;
+      }
+      if (!response.ok) throw new Error(data.message);
 
-      // Save token and authenticate
-      this.authToken = token;
-      this.email = email;
-      this.authenticateUser(token, email);
+      this.authenticateUser(data.token || null, data.email);
+      alert(`Your account now uses ${data.email}.`);
+    } catch (error) {
+      console.error('Email change error:', error);
+      alert('Could not change your email. The link may have expired.');
+    }
+  }
+
+  /**
+   * Join a workspace after following the link from an invitation email
+   */
+  async acceptWorkspaceInvitation(token) {
+    if (!localStorage.getItem('userEmail')) {
+      alert('Sign in with the invited address, then open the invitation link again.');
+      return;
+    }
+
+    try {
+      const response = await fetch('/api/workspaces/invitations/accept', {
+        method: 'POST',
+        headers: this.authHeaders({
+          'Content-Type': 'application/json'
+        }),
+        body: JSON.stringify({ token })
+      });
+      const data = await response.json();
+      if (!response.ok) throw new Error(data.message);
+
+      alert(`You joined ${data.workspace.name}.`);
+    } catch (error) {
+      console.error('Workspace invitation error:', error);
+      alert(`Could not join the workspace: ${error.message}`);
     }
   }
 
@@ -140,21 +534,20 @@ class AuthManager {
   }
 
   /**
-   * Verify a JWT token with the server
+   * Verify a JWT token, or the session cookie when token is null, with the
+   * server
    */
   async verifyToken(token, email) {
     try {
       const response = await fetch('/api/auth/verify', {
         method: 'GET',
-        headers: {
-          'Authorization': `Bearer ${token}`
-        }
+        headers: token ? { 'Authorization': `Bearer ${token}` } : {}
       });
 
       if (response.ok) {
         const data = await response.json();
-        if (data.status === 'valid' && data.email === email) {
-          this.authenticateUser(token, email);
+        if (data.status === 'valid' && (token === null || data.email === email)) {
+          this.authenticateUser(token, data.email);
           return;
         }
       }
@@ -175,8 +568,13 @@ class AuthManager {
     this.email = email;
     this.isAuthenticated = true;
 
-    // Store auth data in localStorage
-    localStorage.setItem('authToken', token);
+    // Store auth data in localStorage; cookie sessions keep the token in
+    // an HttpOnly cookie instead
+    if (token) {
+      localStorage.setItem('authToken', token);
+    } else {
+      localStorage.removeItem('authToken');
+    }
     localStorage.setItem('userEmail', email);
 
     // Update UI for authenticated state
@@ -202,9 +600,7 @@ class AuthManager {
       // First, get server data without sending local data
       const response = await fetch('/api/data/get', {
         method: 'GET',
-        headers: {
-          'Authorization': `Bearer ${this.authToken}`
-        }
+        headers: this.authHeaders()
       });
 
       if (response.ok) {
@@ -252,10 +648,18 @@ class AuthManager {
    * Log the user out
    */
   logout() {
+    // End a cookie session on the server, which clears its cookies
+    if (!this.authToken && this.csrfToken()) {
+      fetch('/api/auth/logout', { method: 'POST', headers: this.authHeaders() })
+        .catch(error => console.error('Logout error:', error));
+    }
+
     // Clear auth data
     this.authToken = null;
     this.email = null;
     this.isAuthenticated = false;
+    this.wsSession = null;
+    this.wsSeq = 0;
 
     // Close WebSocket connection
     this.closeWebSocket();
@@ -303,6 +707,39 @@ class AuthManager {
     }, 60000); // 60 seconds (longer interval since we have WebSockets)
   }
 
+  /**
+   * Save the column order on the server, which numbers the columns and
+   * pushes the board to every device. Falls back to a full sync.
+   * @param {string[]} ids - Live column IDs, left to right
+   */
+  async reorderColumns(ids) {
+    if (!this.isAuthenticated) return;
+
+    try {
+      const response = await fetch('/api/columns/reorder', {
+        method: 'PATCH',
+        headers: this.authHeaders({
+          'Content-Type': 'application/json',
+          'X-Client-ID': this.clientId()
+        }),
+        body: JSON.stringify({ ids })
+      });
+      if (response.ok) {
+        const body = await response.json();
+        body.columns.forEach(column => {
+          const local = this.app.data.columns.find(c => c.id === column.id);
+          if (local) local.order = column.order;
+        });
+        localStorage.setItem('kanbanData', JSON.stringify(this.app.data));
+        return;
+      }
+      console.warn('Server refused column order:', response.status);
+    } catch (error) {
+      console.error('Column reorder error:', error);
+    }
+    this.syncData();
+  }
+
   /**
    * Synchronize data with the server
    */
@@ -313,13 +750,14 @@ class AuthManager {
       console.log('Syncing data with server...');
       const response = await fetch('/api/data/sync', {
         method: 'POST',
-        headers: {
+        headers: this.authHeaders({
           'Content-Type': 'application/json',
-          'Authorization': `Bearer ${this.authToken}`
-        },
+          'X-Client-ID': this.clientId()
+        }),
         body: JSON.stringify(this.app.data)
       });
 
+      this.syncFailed = !response.ok;
       if (response.ok) {
         const body = await response.json();
         
@@ -339,6 +777,12 @@ class AuthManager {
         } else {
           console.warn('Server returned success but no data');
         }
+
+        // Where the saved board differs from what we sent, e.g. another
+        // device's edit was kept; let views tell the user
+        if (body.conflicts && body.conflicts.length > 0) {
+          document.dispatchEvent(new CustomEvent('kanban:conflicts', { detail: body.conflicts }));
+        }
         
         console.log('Data synchronized with server (two-way sync)');
         
@@ -360,10 +804,151 @@ class AuthManager {
       }
     } catch (error) {
       console.error('Data sync error:', error);
-      // Continue using local data if sync fails
+      // Continue using local data if sync fails, and sync again on the next
+      // connection
+      this.syncFailed = true;
     }
   }
   
+  /**
+   * Show how many people are viewing the board when it's more than just us
+   */
+  updatePresence(board, users) {
+    // The board shown is the user's own, which is named by their email
+    const indicator = document.getElementById('presence-indicator');
+    if (!indicator || board !== this.email) return;
+
+    const viewers = users.filter(u => u.viewing === board).length;
+    indicator.textContent = `${viewers} people viewing`;
+    indicator.classList.toggle('hidden', viewers < 2);
+  }
+
+  /**
+   * Tell the board's other viewers that we started or stopped editing a task
+   */
+  sendEditing(taskId, editing) {
+    if (this.ws && this.ws.readyState === WebSocket.OPEN) {
+      this.ws.send(JSON.stringify({ type: 'editing', data: { taskId, editing } }));
+    }
+  }
+
+  /**
+   * Record another user's editing event and mark the task's card
+   */
+  updateEditing(user, data) {
+    const users = this.editors.get(data.taskId) || new Set();
+    if (data.editing) {
+      users.add(user);
+    } else {
+      users.delete(user);
+    }
+    if (users.size > 0) {
+      this.editors.set(data.taskId, users);
+    } else {
+      this.editors.delete(data.taskId);
+    }
+    this.applyEditingIndicators();
+  }
+
+  /**
+   * Mark the cards of tasks someone else is editing
+   */
+  applyEditingIndicators() {
+    document.querySelectorAll('.task[data-task-id]').forEach(element => {
+      const users = this.editors.get(element.dataset.taskId);
+      element.classList.toggle('being-edited', !!users);
+      if (users) {
+        element.dataset.editingBy = `${[...users].join(', ')} editing`;
+      } else {
+        delete element.dataset.editingBy;
+      }
+    });
+  }
+
+  /**
+   * Apply a realtime message from the WebSocket or the event stream
+   */
+  handleRealtimeMessage(message) {
+    if (message.type === 'sync') {
+      console.log('Received sync update from server');
+      // Server is the source of truth - always apply its data
+      this.app.data = message.data;
+      localStorage.setItem('kanbanData', JSON.stringify(message.data));
+      console.log('Rendering board with data from server');
+      this.app.renderBoard();
+    } else if (message.type === 'taskMove') {
+      console.log('Received task move update:', message.data);
+      
+      // Handle the specific task move locally for faster response
+      if (message.data && message.data.taskId) {
+        // Find the task in our local data
+        const taskId = message.data.taskId;
+        const taskIndex = this.app.data.tasks.findIndex(t => t.id === taskId);
+        
+        if (taskIndex !== -1) {
+          // Update the task's columnId (null for unassigned)
+          const columnId = message.data.columnId;
+          console.log(`Updating task ${taskId} columnId to ${columnId === null ? "null (unassigned)" : columnId}`);
+          this.app.data.tasks[taskIndex].columnId = columnId;
+          
+          // Save to local storage
+          localStorage.setItem('kanbanData', JSON.stringify(this.app.data));
+          
+          // Render the board with the updated task
+          this.app.renderBoard();
+        }
+      }
+      
+      // After quick local update, still do a full sync to ensure consistency
+      console.log('Requesting full data sync after taskMove message');
+      this.syncData();
+    } else if (message.type === 'state' && !message.data.board) {
+      // A connection opens with the board's version; sync when ours is
+      // behind, or when changes made while offline haven't been saved
+      if (message.data.version !== this.app.data.version || this.syncFailed) {
+        console.log('Board changed while disconnected, syncing');
+        this.syncData();
+      }
+    } else if (message.type === 'state') {
+      console.log('Received full board state from server');
+      this.app.data = message.data.board;
+      localStorage.setItem('kanbanData', JSON.stringify(message.data.board));
+      this.app.renderBoard();
+    } else if (message.type === 'delta') {
+      // Another client changed the board; fetch the full state over the
+      // socket, or over HTTP when receiving events
+      console.log('Received delta, requesting resync');
+      if (this.ws && this.ws.readyState === WebSocket.OPEN) {
+        this.ws.send(JSON.stringify({ type: 'resync' }));
+      } else {
+        this.syncData();
+      }
+    } else if (message.type === 'lock' || message.type === 'unlock') {
+      // Another client claimed or gave up an edit lock; the server keeps
+      // the locked items as they are, so views only need to show it
+      document.dispatchEvent(new CustomEvent('kanban:lock', { detail: message }));
+    } else if (message.type === 'comment') {
+      // Comments don't change the board; let interested views react
+      document.dispatchEvent(new CustomEvent('kanban:comment', { detail: message.data }));
+    } else if (message.type === 'editing') {
+      // Someone else opened or closed a task; nothing is stored
+      this.updateEditing(message.user, message.data);
+    } else if (message.type === 'presence') {
+      // Who else has the board open; doesn't change the board
+      this.updatePresence(message.board, message.data.users || []);
+      document.dispatchEvent(new CustomEvent('kanban:presence', { detail: message }));
+    } else if (message.type === 'error') {
+      // The server rejected one of our messages; the board is unchanged
+      console.warn('WebSocket message rejected:', message.data);
+    } else if (message.type === 'pong') {
+      console.log('Received pong from server');
+    } else {
+      console.log('Unhandled message type:', message.type);
+      // For unknown message types, do a full sync to ensure consistency
+      this.syncData();
+    }
+  }
+
   /**
    * Setup WebSocket connection for real-time updates
    */
@@ -372,6 +957,11 @@ class AuthManager {
       console.log('Cannot setup WebSocket: Not authenticated');
       return;
     }
+
+    if (this.realtimeTransport() === 'sse') {
+      this.setupEventStream();
+      return;
+    }
     
     // If WebSocket exists and is connecting or open, don't create a new one
     if (this.ws && (this.ws.readyState === WebSocket.CONNECTING || this.ws.readyState === WebSocket.OPEN)) {
@@ -385,16 +975,32 @@ class AuthManager {
     try {
       // Create new WebSocket connection
       const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-      const wsUrl = `${protocol}//${window.location.host}/api/ws`;
+      const wsConfig = (window.appConfig && window.appConfig.websocket) || {};
+      const wsUrl = wsConfig.url || `${protocol}//${window.location.host}${wsConfig.path || '/api/ws'}`;
       
       console.log('Attempting to connect WebSocket to:', wsUrl);
       
-      // Create WebSocket with Authorization header in the URL
-      this.ws = new WebSocket(`${wsUrl}?token=${this.authToken}`);
+      // Pass the token in the URL; cookie sessions send the cookie instead.
+      // The delivery session picks up where the last connection left off.
+      const params = new URLSearchParams();
+      if (this.authToken) {
+        params.set('token', this.authToken);
+      }
+      // Ops sent over the socket count as this client's for edit locks
+      params.set('clientId', this.clientId());
+      if (this.wsSession) {
+        params.set('session', this.wsSession);
+        params.set('seq', String(this.wsSeq));
+      }
+      const query = params.toString();
+      this.ws = new WebSocket(query ? `${wsUrl}?${query}` : wsUrl);
       
       // Handle connection open
+      let opened = false;
       this.ws.onopen = () => {
         console.log('WebSocket connected successfully');
+        opened = true;
+        this.wsFailures = 0;
         
         // Send a ping message to verify connection is working
         const pingMessage = {
@@ -405,10 +1011,16 @@ class AuthManager {
         
         console.log('Sending ping to verify connection:', pingMessage);
         this.ws.send(JSON.stringify(pingMessage));
-        
-        // Request latest data on connection to ensure we're in sync
-        console.log('Requesting data sync after WebSocket connection');
-        this.syncData();
+
+        // Editing events sent while disconnected were missed; start over
+        this.editors.clear();
+        this.applyEditingIndicators();
+        if (this.app.editingTaskId) {
+          this.sendEditing(this.app.editingTaskId, true);
+        }
+
+        // The server follows up with the board's version, and we sync if
+        // it's moved on
       };
       
       // Handle messages
@@ -416,47 +1028,16 @@ class AuthManager {
         try {
           const message = JSON.parse(event.data);
           console.log('Received WebSocket message:', message.type);
-          
-          if (message.type === 'sync') {
-            console.log('Received sync update from server');
-            // Server is the source of truth - always apply its data
-            this.app.data = message.data;
-            localStorage.setItem('kanbanData', JSON.stringify(message.data));
-            console.log('Rendering board with data from server');
-            this.app.renderBoard();
-          } else if (message.type === 'taskMove') {
-            console.log('Received task move update:', message.data);
-            
-            // Handle the specific task move locally for faster response
-            if (message.data && message.data.taskId) {
-              // Find the task in our local data
-              const taskId = message.data.taskId;
-              const taskIndex = this.app.data.tasks.findIndex(t => t.id === taskId);
-              
-              if (taskIndex !== -1) {
-                // Update the task's columnId (null for unassigned)
-                const columnId = message.data.columnId;
-                console.log(`Updating task ${taskId} columnId to ${columnId === null ? "null (unassigned)" : columnId}`);
-                this.app.data.tasks[taskIndex].columnId = columnId;
-                
-                // Save to local storage
-                localStorage.setItem('kanbanData', JSON.stringify(this.app.data));
-                
-                // Render the board with the updated task
-                this.app.renderBoard();
-              }
-            }
-            
-            // After quick local update, still do a full sync to ensure consistency
-            console.log('Requesting full data sync after taskMove message');
-            this.syncData();
-          } else if (message.type === 'pong') {
-            console.log('Received pong from server');
-          } else {
-            console.log('Unhandled message type:', message.type);
-            // For unknown message types, do a full sync to ensure consistency
-            this.syncData();
+
+          if (message.type === 'session') {
+            this.startDeliverySession(message.data);
+            return;
           }
+          if (message.seq && !this.receiveSeq(message.seq)) {
+            return;
+          }
+          
+          this.handleRealtimeMessage(message);
         } catch (error) {
           console.error('Error processing WebSocket message:', error);
           // Request a full sync if we encounter an error
@@ -475,25 +1056,34 @@ class AuthManager {
       // Handle disconnection
       this.ws.onclose = (event) => {
         console.log('WebSocket disconnected, code:', event.code, 'reason:', event.reason);
+
+        // Sockets that never open were probably stopped by a proxy; after
+        // the second, the reconnect switches to Server-Sent Events
+        if (!opened && ++this.wsFailures >= 2 && window.EventSource) {
+          console.log('WebSockets look blocked, falling back to Server-Sent Events');
+          this.useEventStream = true;
+        }
+        
+        // The account was disabled or its sessions revoked (4001)
+        if (this.isAuthenticated && event.code === 4001) {
+          this.logout();
+          return;
+        }
         
-        // Only attempt to reconnect if still authenticated and not a normal closure
-        if (this.isAuthenticated && event.code !== 1000) {
+        // Only attempt to reconnect if still authenticated and not a normal
+        // closure, or closed for a newer connection (4008)
+        if (this.isAuthenticated && event.code !== 1000 && event.code !== 4008) {
           console.log('Attempting to reconnect in 3 seconds...');
           // Clear any existing reconnection timer
           if (this.wsReconnectTimer) {
             clearTimeout(this.wsReconnectTimer);
           }
           
-          // Set up reconnection timer
+          // Set up reconnection timer; messages missed in between are
+          // replayed when the delivery session resumes
           this.wsReconnectTimer = setTimeout(() => {
             console.log('Reconnecting WebSocket now');
             this.setupWebSocket();
-            
-            // Perform a sync after reconnection to catch any missed updates
-            setTimeout(() => {
-              console.log('Syncing data after WebSocket reconnection');
-              this.syncData();
-            }, 1000);
           }, 3000);
         }
       };
@@ -518,6 +1108,127 @@ class AuthManager {
       console.error('Error setting up WebSocket:', error);
     }
   }
+
+  /**
+   * Start or resume the WebSocket's delivery session, reloading the board
+   * if messages sent while disconnected were lost
+   */
+  startDeliverySession(session) {
+    if (!session.resumed) {
+      this.wsSeq = 0;
+    }
+    this.wsSession = session.id;
+    if (session.missed) {
+      console.log('Messages were lost while disconnected, resyncing');
+      this.syncData();
+    }
+  }
+
+  /**
+   * Record a board message's seq and schedule its acknowledgement. Returns
+   * false for a message already received; a gap means messages were
+   * dropped, and the board is reloaded.
+   */
+  receiveSeq(seq) {
+    if (seq <= this.wsSeq) {
+      return false;
+    }
+    if (seq > this.wsSeq + 1 && this.wsSeq > 0) {
+      console.log('WebSocket messages were dropped, resyncing');
+      this.syncData();
+    }
+    this.wsSeq = seq;
+
+    // Acknowledge once a second at most
+    if (!this.wsAckTimer) {
+      this.wsAckTimer = setTimeout(() => {
+        this.wsAckTimer = null;
+        if (this.ws && this.ws.readyState === WebSocket.OPEN) {
+          this.ws.send(JSON.stringify({ type: 'ack', data: { seq: this.wsSeq } }));
+        }
+      }, 1000);
+    }
+    return true;
+  }
+
+  /**
+   * Which transport realtime updates use: 'sse' when chosen with
+   * localStorage.realtimeTransport or after WebSockets failed, otherwise
+   * 'websocket'
+   */
+  realtimeTransport() {
+    const chosen = localStorage.getItem('realtimeTransport');
+    if (chosen === 'sse' || chosen === 'websocket') {
+      return chosen;
+    }
+    return this.useEventStream ? 'sse' : 'websocket';
+  }
+
+  /**
+   * Receive realtime updates over Server-Sent Events. The stream only
+   * carries messages from the server; changes are still saved over HTTP.
+   */
+  setupEventStream() {
+    if (this.events && this.events.readyState !== EventSource.CLOSED) {
+      console.log('Event stream already connected or connecting');
+      return;
+    }
+    this.closeWebSocket();
+
+    const eventsConfig = (window.appConfig && window.appConfig.events) || {};
+    const params = new URLSearchParams();
+    if (this.authToken) {
+      params.set('token', this.authToken);
+    }
+    // EventSource resends Last-Event-ID itself, but not on a new stream
+    if (this.lastEventId) {
+      params.set('lastEventId', this.lastEventId);
+    }
+    const query = params.toString();
+    const url = `${eventsConfig.path || '/api/events'}${query ? `?${query}` : ''}`;
+    console.log('Connecting event stream');
+    this.events = new EventSource(url);
+
+    this.events.onopen = () => {
+      console.log('Event stream connected');
+      // Editing events sent while disconnected were missed; start over
+      this.editors.clear();
+      this.applyEditingIndicators();
+      this.syncData();
+    };
+
+    this.events.onmessage = (event) => {
+      if (event.lastEventId) {
+        this.lastEventId = event.lastEventId;
+      }
+      try {
+        const message = JSON.parse(event.data);
+        if (message.type !== 'close') {
+          this.handleRealtimeMessage(message);
+          return;
+        }
+
+        // The server ended the stream, with a WebSocket close code saying why
+        console.log('Event stream closed by server, code:', message.data.code);
+        if (message.data.code === 4001) {
+          this.logout();
+        } else if (message.data.code === 4008) {
+          this.closeWebSocket();
+        }
+      } catch (error) {
+        console.error('Error processing event stream message:', error);
+        this.syncData();
+      }
+    };
+
+    this.events.onerror = () => {
+      // EventSource reconnects by itself unless the request failed outright
+      if (this.events && this.events.readyState === EventSource.CLOSED && this.isAuthenticated) {
+        console.log('Event stream failed, retrying in 3 seconds...');
+        this.wsReconnectTimer = setTimeout(() => this.setupWebSocket(), 3000);
+      }
+    };
+  }
   
   /**
    * Close WebSocket connection
@@ -535,6 +1246,11 @@ class AuthManager {
       this.heartbeatInterval = null;
     }
     
+    if (this.events) {
+      this.events.close();
+      this.events = null;
+    }
+
     // Close WebSocket if it exists
     if (this.ws) {
       // Only attempt to close if not already closed
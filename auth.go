@@ -6,48 +6,104 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"net/smtp"
-	"os"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// magicLinkTTL is how long a magic link works
+const magicLinkTTL = 15 * time.Minute
+
+// magicLinkToken is a magic link waiting to be followed
+type magicLinkToken struct {
+	email   string
+	expires time.Time
+}
+
 type AuthService struct {
-	tokens     map[string]string // Map of token -> email
+	tokensMu   sync.Mutex
+	tokens     map[string]magicLinkToken
 	jwtSecret  []byte
 	smtpConfig SMTPConfig
+	dkim       *DKIMSigner
+	branding   BrandingConfig
+
+	// One-time codes from magic links, exchanged for sessions
+	codesMu sync.Mutex
+	codes   map[string]exchangeCode
+
+	// Sign-ins set a session cookie rather than returning a token
+	cookieSessions bool
+
+	// Production servers never return links meant to be emailed
+	production bool
+
+	// Vets the user of every session token; see OnAuthenticate
+	accountCheck AccountCheck
+
+	// Looks up a user's language setting; see OnLanguage
+	userLanguage func(email string) string
 }
 
+// AccountCheck vets a user when a session token is issued or used. issuedAt
+// is when the token was issued, or the zero time for other credentials such
+// as API keys. A non-nil error rejects the credential.
+type AccountCheck func(email string, issuedAt time.Time) error
+
 type SMTPConfig struct {
 	Host     string
 	Port     string
 	Username string
 	Password string
 	From     string
+
+	// "starttls", "tls" (implicit) or "none"
+	TLS string
+	// Display name shown with the From address
+	FromName string
+	ReplyTo  string
+
+	// DKIM signing of outgoing email; off without a domain
+	DKIMDomain   string
+	DKIMSelector string
+	DKIMKeyFile  string
 }
 
-func NewAuthService() *AuthService {
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "your-default-secret-key-change-in-production"
-	}
+func NewAuthService(cfg *Config) *AuthService {
+	s := &AuthService{
+		tokens:     make(map[string]magicLinkToken),
+		jwtSecret:  []byte(cfg.JWTSecret),
+		smtpConfig: cfg.SMTP,
+		branding:   cfg.Branding,
+		codes:      make(map[string]exchangeCode),
 
-	return &AuthService{
-		tokens:    make(map[string]string),
-		jwtSecret: []byte(jwtSecret),
-		smtpConfig: SMTPConfig{
-			Host:     os.Getenv("SMTP_HOST"),
-			Port:     os.Getenv("SMTP_PORT"),
-			Username: os.Getenv("SMTP_USERNAME"),
-			Password: os.Getenv("SMTP_PASSWORD"),
-			From:     os.Getenv("SMTP_FROM"),
-		},
+		cookieSessions: cfg.AuthSession == "cookie",
+		production:     cfg.Production,
 	}
+	if cfg.SMTP.DKIMDomain != "" {
+		dkim, err := LoadDKIMSigner(cfg.SMTP.DKIMDomain, cfg.SMTP.DKIMSelector, cfg.SMTP.DKIMKeyFile)
+		if err != nil {
+			log.Printf("Warning: sending email without DKIM signatures: DKIM_KEY_FILE %v", err)
+		} else {
+			s.dkim = dkim
+		}
+	}
+	return s
 }
 
-// GenerateMagicLink creates a one-time token and email magic link
-func (s *AuthService) GenerateMagicLink(email string, baseURL string) (string, error) {
+// GenerateMagicLink creates a one-time token and email magic link. The
+// email is in the user's language, or else locale (the request's).
+func (s *AuthService) GenerateMagicLink(email, baseURL, locale string) (string, error) {
+	return s.GenerateMagicLinkTo(email, baseURL, "/api/auth/magic-link", locale)
+}
+
+// GenerateMagicLinkTo is GenerateMagicLink for a link landing on another
+// path, which must verify the token with VerifyMagicLinkToken
+func (s *AuthService) GenerateMagicLinkTo(email, baseURL, path, locale string) (string, error) {
 	// Generate a random token
 	token, err := s.generateSecureToken(32)
 	if err != nil {
@@ -55,14 +111,16 @@ func (s *AuthService) GenerateMagicLink(email string, baseURL string) (string, e
 	}
 
 	// Store the token -> email mapping
-	s.tokens[token] = email
+	s.tokensMu.Lock()
+	s.tokens[token] = magicLinkToken{email: email, expires: time.Now().Add(magicLinkTTL)}
+	s.tokensMu.Unlock()
 
 	// Create the magic link URL
-	magicLink := fmt.Sprintf("%s/api/auth/magic-link?token=%s", baseURL, token)
+	magicLink := fmt.Sprintf("%s%s?token=%s", baseURL, path, token)
 
 	// Send the email (if SMTP is configured)
-	if s.smtpConfig.Host != "" {
-		if err := s.sendMagicLinkEmail(email, magicLink); err != nil {
+	if s.EmailEnabled() {
+		if err := s.sendMagicLinkEmail(email, magicLink, s.EmailLocale(email, locale)); err != nil {
 			log.Printf("Warning: Failed to send email: %v", err)
 		}
 	}
@@ -73,23 +131,93 @@ func (s *AuthService) GenerateMagicLink(email string, baseURL string) (string, e
 
 // VerifyMagicLinkToken verifies a one-time token and returns the associated email
 func (s *AuthService) VerifyMagicLinkToken(token string) (string, error) {
-	email, exists := s.tokens[token]
-	if !exists {
+	s.tokensMu.Lock()
+	defer s.tokensMu.Unlock()
+
+	t, exists := s.tokens[token]
+	if !exists || time.Now().After(t.expires) {
 		return "", errors.New("invalid or expired token")
 	}
 
 	// Remove the token (one-time use)
 	delete(s.tokens, token)
 
-	return email, nil
+	return t.email, nil
+}
+
+// PurgeExpiredTokens forgets magic link tokens and exchange codes that
+// have expired unused, returning how many of each it dropped
+func (s *AuthService) PurgeExpiredTokens() (magicLinks, codes int) {
+	now := time.Now()
+
+	s.tokensMu.Lock()
+	for token, t := range s.tokens {
+		if now.After(t.expires) {
+			delete(s.tokens, token)
+			magicLinks++
+		}
+	}
+	s.tokensMu.Unlock()
+
+	s.codesMu.Lock()
+	for code, c := range s.codes {
+		if now.After(c.expires) {
+			delete(s.codes, code)
+			codes++
+		}
+	}
+	s.codesMu.Unlock()
+
+	return magicLinks, codes
+}
+
+// OnAuthenticate installs the check run on every session token and API key
+func (s *AuthService) OnAuthenticate(check AccountCheck) {
+	s.accountCheck = check
+}
+
+// OnLanguage installs the lookup of users' language settings
+func (s *AuthService) OnLanguage(userLanguage func(email string) string) {
+	s.userLanguage = userLanguage
+}
+
+// UserLocale returns the locale a user picked, or "" if they didn't
+func (s *AuthService) UserLocale(email string) string {
+	if s.userLanguage == nil {
+		return ""
+	}
+	return s.userLanguage(email)
+}
+
+// EmailLocale returns the locale to email a user in: their own setting,
+// or else fallback
+func (s *AuthService) EmailLocale(email, fallback string) string {
+	if locale := s.UserLocale(email); supportedLocale(locale) {
+		return locale
+	}
+	return fallback
+}
+
+// CheckAccount runs the account check for a credential issued at issuedAt
+func (s *AuthService) CheckAccount(email string, issuedAt time.Time) error {
+	if s.accountCheck == nil {
+		return nil
+	}
+	return s.accountCheck(email, issuedAt)
 }
 
 // CreateJWT generates a JWT token for a user
 func (s *AuthService) CreateJWT(email string) (string, error) {
+	now := time.Now()
+	if err := s.CheckAccount(email, time.Time{}); err != nil {
+		return "", err
+	}
+
 	// Create token with claims
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"email": email,
-		"exp":   time.Now().Add(time.Hour * 24 * 7).Unix(), // 7 days
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour * 24 * 7).Unix(), // 7 days
 	})
 
 	// Sign the token
@@ -133,6 +261,101 @@ func (s *AuthService) VerifyJWT(tokenString string) (string, error) {
 		return "", errors.New("email claim missing")
 	}
 
+	// Tokens from before issue times were recorded count as issued at the
+	// epoch, so revoking sessions covers them too
+	issuedAt := time.Unix(0, 0)
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		issuedAt = iat.Time
+	}
+	if err := s.CheckAccount(email, issuedAt); err != nil {
+		return "", err
+	}
+
+	return email, nil
+}
+
+// CreateStateToken signs a short-lived token tying a redirect flow (such as
+// an OAuth authorization) to a user. It carries no "email" claim, so it can
+// never be used as a session token.
+func (s *AuthService) CreateStateToken(email, purpose string, ttl time.Duration) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":     email,
+		"purpose": purpose,
+		"exp":     time.Now().Add(ttl).Unix(),
+	})
+
+	tokenString, err := token.SignedString(s.jwtSecret)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign state: %w", err)
+	}
+	return tokenString, nil
+}
+
+// VerifyStateToken checks a token from CreateStateToken and returns its email
+func (s *AuthService) VerifyStateToken(tokenString, purpose string) (string, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return s.jwtSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return "", errors.New("invalid or expired state")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != purpose {
+		return "", errors.New("invalid state")
+	}
+	email, ok := claims["sub"].(string)
+	if !ok || email == "" {
+		return "", errors.New("invalid state")
+	}
+	return email, nil
+}
+
+// bearerToken returns the Bearer token in a request's Authorization header
+func bearerToken(r *http.Request) (string, error) {
+	// Get token from Authorization header
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", fmt.Errorf("missing authorization header")
+	}
+
+	// Extract token from Bearer format
+	authParts := strings.Split(authHeader, " ")
+	if len(authParts) != 2 || authParts[0] != "Bearer" {
+		return "", fmt.Errorf("invalid authorization format")
+	}
+
+	return authParts[1], nil
+}
+
+// sessionToken returns a request's session token: the Bearer token, or
+// without an Authorization header the session cookie
+func sessionToken(r *http.Request) (string, error) {
+	if r.Header.Get("Authorization") == "" {
+		if cookie, err := r.Cookie(sessionCookie); err == nil && cookie.Value != "" {
+			return cookie.Value, nil
+		}
+	}
+	return bearerToken(r)
+}
+
+// AuthenticateRequest verifies the session token in a request's
+// Authorization header or session cookie and returns the authenticated email
+func (s *AuthService) AuthenticateRequest(r *http.Request) (string, error) {
+	tokenString, err := sessionToken(r)
+	if err != nil {
+		return "", err
+	}
+
+	// Verify token
+	email, err := s.VerifyJWT(tokenString)
+	if err != nil {
+		return "", fmt.Errorf("invalid token: %w", err)
+	}
+
 	return email, nil
 }
 
@@ -147,33 +370,77 @@ func (s *AuthService) generateSecureToken(length int) (string, error) {
 }
 
 // Helper to send a magic link email
-func (s *AuthService) sendMagicLinkEmail(to, magicLink string) error {
+func (s *AuthService) sendMagicLinkEmail(to, magicLink, locale string) error {
+	subject := translate(locale, "Your Login Link for %s", s.branding.AppName)
+	body := translate(locale, "Click the link below to log in to %s:\n\n%s\n\nIf you didn't request this link, you can safely ignore this email.", s.branding.AppName, magicLink)
+	return s.SendEmail(to, locale, subject, body)
+}
+
+// EmailEnabled reports whether SMTP is configured, so emails are sent
+func (s *AuthService) EmailEnabled() bool {
+	return s.smtpConfig.Host != ""
+}
+
+// RevealLinks reports whether responses may carry the links otherwise
+// emailed, such as magic links: only in development, without SMTP. Anyone
+// could sign in as anyone with them.
+func (s *AuthService) RevealLinks() bool {
+	return !s.production && !s.EmailEnabled()
+}
+
+// SendEmail sends a plain-text email written in locale, adding the support
+// contact if branded
+func (s *AuthService) SendEmail(to, locale, subject, body string) error {
 	// Skip if SMTP not configured
 	if s.smtpConfig.Host == "" || s.smtpConfig.Port == "" ||
 		s.smtpConfig.Username == "" || s.smtpConfig.Password == "" {
 		return errors.New("SMTP not fully configured")
 	}
 
-	// Set up authentication
-	auth := smtp.PlainAuth("", s.smtpConfig.Username, s.smtpConfig.Password, s.smtpConfig.Host)
-
 	// Prepare email content
-	from := s.smtpConfig.From
-	if from == "" {
-		from = s.smtpConfig.Username
+	from, err := s.sender()
+	if err != nil {
+		return err
 	}
 
-	subject := "Your Login Link for Todo App"
-	body := fmt.Sprintf("Click the link below to log in to your Todo App:\n\n%s\n\nIf you didn't request this link, you can safely ignore this email.", magicLink)
+	if s.branding.SupportEmail != "" {
+		body += "\n\n" + translate(locale, "Questions? Contact %s.", s.branding.SupportEmail)
+	}
 
-	message := fmt.Sprintf("From: %s\nTo: %s\nSubject: %s\n\n%s", from, to, subject, body)
+	now := time.Now()
+	headers, encoded, err := composeEmail(from, s.smtpConfig.ReplyTo, to, subject, body, now)
+	if err != nil {
+		return err
+	}
+	if s.dkim != nil {
+		signature, err := s.dkim.Sign(headers, encoded, now)
+		if err != nil {
+			return err
+		}
+		headers = append([]mailHeader{signature}, headers...)
+	}
 
 	// Send email
-	addr := fmt.Sprintf("%s:%s", s.smtpConfig.Host, s.smtpConfig.Port)
-	err := smtp.SendMail(addr, auth, from, []string{to}, []byte(message))
-	if err != nil {
+	if err := sendSMTP(s.smtpConfig, from.Address, to, renderEmail(headers, encoded)); err != nil {
 		return fmt.Errorf("failed to send email: %w", err)
 	}
 
 	return nil
 }
+
+// sender returns the From address: SMTP_FROM, or the SMTP username, shown
+// with SMTP_FROM_NAME when set
+func (s *AuthService) sender() (*mail.Address, error) {
+	from := s.smtpConfig.From
+	if from == "" {
+		from = s.smtpConfig.Username
+	}
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", from, err)
+	}
+	if s.smtpConfig.FromName != "" {
+		addr.Name = s.smtpConfig.FromName
+	}
+	return addr, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// AutoArchiveService archives tasks that have sat in a done column for
+// longer than their board's autoArchiveDays setting
+type AutoArchiveService struct {
+	db              *DB
+	dataService     *DataService
+	settingsService *SettingsService
+	hub             *Hub
+}
+
+func NewAutoArchiveService(db *DB, dataService *DataService, settingsService *SettingsService, hub *Hub) *AutoArchiveService {
+	return &AutoArchiveService{
+		db:              db,
+		dataService:     dataService,
+		settingsService: settingsService,
+		hub:             hub,
+	}
+}
+
+// dueForArchive lists the live tasks in done columns with no activity
+// since the cutoff. Tasks without logged activity are left alone.
+func dueForArchive(data *KanbanData, aging map[string]TaskAge, cutoff time.Time) []string {
+	done := make(map[string]bool)
+	for _, col := range data.Columns {
+		if col.IsDone && !col.Deleted {
+			done[col.ID] = true
+		}
+	}
+
+	var taskIDs []string
+	for _, task := range data.Tasks {
+		if task.Deleted || task.ColumnID == nil || !done[*task.ColumnID] {
+			continue
+		}
+		if age, ok := aging[task.ID]; ok && age.LastActivityAt.Before(cutoff) {
+			taskIDs = append(taskIDs, task.ID)
+		}
+	}
+	return taskIDs
+}
+
+// ArchiveBoard archives a board's due tasks and returns how many it moved
+func (s *AutoArchiveService) ArchiveBoard(ctx context.Context, email string, days int) (int, error) {
+	aging, err := s.dataService.TaskAging(ctx, email)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	cutoff := now.AddDate(0, 0, -days)
+
+	var count int
+	data, err := s.dataService.UpdateUserDataTx(ctx, email, func(tx *Tx, data *KanbanData) error {
+		taskIDs := dueForArchive(data, aging, cutoff)
+		if len(taskIDs) == 0 {
+			return errNothingToSync
+		}
+		count = len(taskIDs)
+		return archiveTasks(tx, email, data, taskIDs, now)
+	})
+	if err == errNothingToSync {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to archive tasks: %w", err)
+	}
+
+	// Drop the archived tasks from open boards
+	s.hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+	return count, nil
+}
+
+// ArchiveAll runs ArchiveBoard for every board with auto-archiving enabled
+func (s *AutoArchiveService) ArchiveAll() {
+	all, err := s.settingsService.List()
+	if err != nil {
+		log.Printf("Error loading settings for auto-archive: %v", err)
+		return
+	}
+
+	for email, settings := range all {
+		if settings.AutoArchiveDays <= 0 {
+			continue
+		}
+		count, err := s.ArchiveBoard(context.Background(), email, settings.AutoArchiveDays)
+		if err != nil {
+			log.Printf("Error auto-archiving board for %s: %v", email, err)
+			continue
+		}
+		if count > 0 {
+			log.Printf("Auto-archived %d tasks for %s", count, email)
+		}
+	}
+}
+
+// RunSchedule auto-archives once immediately and then on every interval tick
+func (s *AutoArchiveService) RunSchedule(interval time.Duration) {
+	s.ArchiveAll()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.ArchiveAll()
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// signatureHeader carries the HMAC-SHA256 of a delivered payload
+const signatureHeader = "X-Signature-256"
+
+// webhookClient delivers outgoing webhook requests
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// signPayload returns the "sha256=<hex>" HMAC signature of a payload
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validateWebhookURL checks a user-supplied URL is an absolute http(s) URL
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// BackupWebhook is a user's registered off-site backup endpoint
+type BackupWebhook struct {
+	URL            string     `json:"url"`
+	Secret         string     `json:"secret,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	LastDeliveryAt *time.Time `json:"lastDeliveryAt,omitempty"`
+	LastStatus     string     `json:"lastStatus,omitempty"`
+}
+
+// errBackupWebhookNotFound is returned when a user has no backup webhook
+var errBackupWebhookNotFound = errors.New("backup webhook not found")
+
+// BackupWebhookService stores backup endpoints and delivers signed exports to them
+type BackupWebhookService struct {
+	db             *DB
+	dataService    *DataService
+	authService    *AuthService
+	commentService *CommentService
+	jobs           *JobQueue
+}
+
+func NewBackupWebhookService(db *DB, dataService *DataService, authService *AuthService, commentService *CommentService, jobs *JobQueue) *BackupWebhookService {
+	return &BackupWebhookService{
+		db:             db,
+		dataService:    dataService,
+		authService:    authService,
+		commentService: commentService,
+		jobs:           jobs,
+	}
+}
+
+// Register sets a user's backup URL and returns the webhook with a fresh
+// signing secret
+func (s *BackupWebhookService) Register(email string, rawURL string) (*BackupWebhook, error) {
+	secret, err := s.authService.generateSecureToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+
+	if err := ensureUser(s.db, email); err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO backup_webhooks (email, url, secret, created_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(email) DO UPDATE SET
+			url = excluded.url,
+			secret = excluded.secret,
+			created_at = CURRENT_TIMESTAMP,
+			last_delivery_at = NULL,
+			last_status = NULL
+	`, email, rawURL, secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save backup webhook: %w", err)
+	}
+
+	return s.Get(email)
+}
+
+// Get returns a user's backup webhook
+func (s *BackupWebhookService) Get(email string) (*BackupWebhook, error) {
+	row := s.db.QueryRow(`
+		SELECT url, secret, created_at, last_delivery_at, last_status
+		FROM backup_webhooks WHERE email = ?
+	`, email)
+
+	var hook BackupWebhook
+	var lastDelivery sql.NullTime
+	var lastStatus sql.NullString
+	err := row.Scan(&hook.URL, &hook.Secret, &hook.CreatedAt, &lastDelivery, &lastStatus)
+	if err == sql.ErrNoRows {
+		return nil, errBackupWebhookNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query backup webhook: %w", err)
+	}
+
+	if lastDelivery.Valid {
+		hook.LastDeliveryAt = &lastDelivery.Time
+	}
+	hook.LastStatus = lastStatus.String
+	return &hook, nil
+}
+
+// Delete removes a user's backup webhook
+func (s *BackupWebhookService) Delete(email string) error {
+	if _, err := s.db.Exec("DELETE FROM backup_webhooks WHERE email = ?", email); err != nil {
+		return fmt.Errorf("failed to delete backup webhook: %w", err)
+	}
+	return nil
+}
+
+// ScheduleAll queues a backup delivery for every registered webhook
+func (s *BackupWebhookService) ScheduleAll() error {
+	rows, err := s.db.Query("SELECT email FROM backup_webhooks")
+	if err != nil {
+		return fmt.Errorf("failed to query backup webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return fmt.Errorf("failed to scan backup webhook: %w", err)
+		}
+		emails = append(emails, email)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate backup webhooks: %w", err)
+	}
+
+	for _, email := range emails {
+		email := email
+		err := s.jobs.Enqueue(Job{
+			Name:        "backup-webhook:" + email,
+			MaxAttempts: 3,
+			Run: func(ctx context.Context) error {
+				return s.Deliver(ctx, email)
+			},
+		})
+		if err != nil {
+			log.Printf("Error queueing backup for %s: %v", email, err)
+		}
+	}
+
+	return nil
+}
+
+// Deliver posts a signed JSON export of the user's board to their webhook
+// and records the outcome
+func (s *BackupWebhookService) Deliver(ctx context.Context, email string) error {
+	hook, err := s.Get(email)
+	if err == errBackupWebhookNotFound {
+		// Unregistered since being scheduled
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := s.dataService.GetUserData(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	export := buildBoardExport(email, data, true)
+	if export.Comments, err = s.commentService.ListBoard(email); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(export)
+	if err != nil {
+		return fmt.Errorf("failed to marshal export: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureHeader, signPayload(hook.Secret, payload))
+
+	status := ""
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		status = "error: " + err.Error()
+	} else {
+		resp.Body.Close()
+		status = resp.Status
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("backup endpoint returned %s", resp.Status)
+		}
+	}
+
+	_, dbErr := s.db.Exec(`
+		UPDATE backup_webhooks SET last_delivery_at = CURRENT_TIMESTAMP, last_status = ?
+		WHERE email = ?
+	`, status, email)
+	if dbErr != nil {
+		log.Printf("Error recording backup delivery for %s: %v", email, dbErr)
+	}
+
+	return err
+}
+
+// RunSchedule queues backups for all webhooks on every interval tick
+func (s *BackupWebhookService) RunSchedule(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.ScheduleAll(); err != nil {
+			log.Printf("Error scheduling backups: %v", err)
+		}
+	}
+}
+
+// BackupWebhookHandler manages a user's backup webhook over HTTP
+type BackupWebhookHandler struct {
+	backupService *BackupWebhookService
+}
+
+func NewBackupWebhookHandler(backupService *BackupWebhookService) *BackupWebhookHandler {
+	return &BackupWebhookHandler{backupService: backupService}
+}
+
+// Register sets the backup URL and returns the signing secret, which is
+// only shown in this response
+func (h *BackupWebhookHandler) Register(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+
+	var req struct {
+		URL string `json:"url"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := validateWebhookURL(req.URL); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	hook, err := h.backupService.Register(email, req.URL)
+	if err != nil {
+		log.Printf("Error registering backup webhook: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to save backup webhook")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"webhook": hook,
+	})
+}
+
+// Get returns the backup webhook and its last delivery status
+func (h *BackupWebhookHandler) Get(w http.ResponseWriter, r *http.Request) {
+	hook, err := h.backupService.Get(requestEmail(r))
+	if err == errBackupWebhookNotFound {
+		writeError(w, http.StatusNotFound, "No backup webhook registered")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading backup webhook: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	// The secret is only revealed at registration
+	hook.Secret = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"webhook": hook,
+	})
+}
+
+// Delete unregisters the backup webhook
+func (h *BackupWebhookHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if err := h.backupService.Delete(requestEmail(r)); err != nil {
+		log.Printf("Error deleting backup webhook: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ConfigHandler serves the public runtime configuration the frontend
+// bootstraps from. Nothing secret belongs here; the endpoint is public.
+type ConfigHandler struct {
+	cfg *Config
+}
+
+func NewConfigHandler(cfg *Config) *ConfigHandler {
+	return &ConfigHandler{cfg: cfg}
+}
+
+// Get returns the instance's public configuration
+func (h *ConfigHandler) Get(w http.ResponseWriter, r *http.Request) {
+	emailLogin := h.cfg.SMTP.Host != ""
+	modes := []string{"magic-link"}
+	if h.cfg.WebAuthn.Enabled() {
+		modes = append(modes, "passkey")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"version":  version,
+		"branding": h.cfg.Branding,
+		"auth": map[string]any{
+			"modes": modes,
+			// "token" or "cookie" (HttpOnly session cookie plus CSRF token)
+			"session": h.cfg.AuthSession,
+			// Without SMTP the magic link is returned to the client instead
+			"magicLinkEmail": emailLogin,
+		},
+		"websocket": map[string]string{
+			"url":  h.cfg.WebSocketURL,
+			"path": "/api/ws",
+		},
+		"events": map[string]string{
+			"path": "/api/events",
+		},
+		"features": map[string]bool{
+			"uniqueColumnTitles":      h.cfg.UniqueColumnTitles,
+			"reconcileDefaultColumns": h.cfg.ReconcileDefaultColumns,
+			"googleTasks":             h.cfg.GoogleTasks.Enabled(),
+			"microsoftTodo":           h.cfg.MicrosoftTodo.Enabled(),
+		},
+		"limits": map[string]int{
+			"maxWebSocketMessageBytes": maxMessageSize,
+			"maxRequestBodyBytes":      maxRequestBodySize,
+			"maxBoardBodyBytes":        int(maxBoardBodySize(h.cfg.Quotas)),
+			"maxMarkdownImportBytes":   maxMarkdownImportSize,
+			"maxBatchChanges":          maxBatchChanges,
+			"maxMacroOperations":       maxMacroOperations,
+			"maxAttachmentBytes":       int(h.cfg.Attachments.MaxSize),
+		},
+	})
+}
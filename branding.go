@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Branding defaults match the stock frontend
+const (
+	defaultAppName     = "Kanban Todo App"
+	defaultAccentColor = "#4a6fa5"
+)
+
+// hexColorPattern matches #rgb and #rrggbb colors
+var hexColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// BrandingConfig lets self-hosters rebrand their instance
+type BrandingConfig struct {
+	AppName      string `json:"appName"`
+	AccentColor  string `json:"accentColor"`
+	SupportEmail string `json:"supportEmail,omitempty"`
+	LogoURL      string `json:"logoUrl,omitempty"`
+}
+
+// brandIndex applies branding to the frontend's index page: the title and
+// heading, the accent color and an optional logo
+func brandIndex(page []byte, branding BrandingConfig) []byte {
+	name := html.EscapeString(branding.AppName)
+
+	heading := name
+	if branding.LogoURL != "" {
+		heading = fmt.Sprintf(`<img class="brand-logo" src="%s" alt="" height="32"> %s`, html.EscapeString(branding.LogoURL), name)
+	}
+
+	// The accent color is validated as hex in LoadConfig
+	style := fmt.Sprintf("<style>:root { --primary-color: %s; }</style>\n</head>", branding.AccentColor)
+
+	replacer := strings.NewReplacer(
+		"<title>"+defaultAppName+"</title>", "<title>"+name+"</title>",
+		"<h1>"+defaultAppName+"</h1>", "<h1>"+heading+"</h1>",
+		"<h2>Login to Todo App</h2>", "<h2>Login to "+name+"</h2>",
+		"</head>", style,
+	)
+	return []byte(replacer.Replace(string(page)))
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Default limits of the board cache
+const (
+	defaultBoardCacheSize = 1000
+	defaultBoardCacheTTL  = 10 * time.Minute
+)
+
+// BoardCache keeps decoded boards in memory so repeated reads skip the
+// database and JSON decoding. Entries are replaced whenever DataService
+// writes a board, dropped when another instance does, and otherwise kept
+// for up to a TTL. Past its size, the least recently used board is evicted.
+type BoardCache struct {
+	mu      sync.Mutex
+	boards  map[string]*list.Element
+	recency *list.List // Of *cachedBoard, most recently used first
+
+	// Bumped on every write so a slow read can't overwrite newer data
+	generations map[string]uint64
+
+	size int // 0 disables caching
+	ttl  time.Duration
+
+	hits, misses, evictions, expirations uint64
+
+	// Told about every write, so other instances can drop their copies
+	onWrite func(email string)
+}
+
+type cachedBoard struct {
+	email   string
+	data    *KanbanData
+	expires time.Time
+}
+
+// BoardCacheStats is a snapshot of the board cache's size and counters
+type BoardCacheStats struct {
+	Entries     int     `json:"entries"`
+	Size        int     `json:"size"`
+	TTLSeconds  float64 `json:"ttlSeconds"`
+	Hits        uint64  `json:"hits"`
+	Misses      uint64  `json:"misses"`
+	HitRate     float64 `json:"hitRate"`
+	Evictions   uint64  `json:"evictions"`
+	Expirations uint64  `json:"expirations"`
+}
+
+func NewBoardCache() *BoardCache {
+	return &BoardCache{
+		boards:      make(map[string]*list.Element),
+		recency:     list.New(),
+		generations: make(map[string]uint64),
+		size:        defaultBoardCacheSize,
+		ttl:         defaultBoardCacheTTL,
+	}
+}
+
+// Limit sets how many boards are cached (0 disables caching) and for how
+// long. It must be called before the cache is used.
+func (c *BoardCache) Limit(size int, ttl time.Duration) {
+	c.size = size
+	c.ttl = ttl
+}
+
+// Get returns a copy of the cached board for a user
+func (c *BoardCache) Get(email string) (*KanbanData, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.boards[email]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	entry := elem.Value.(*cachedBoard)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		c.expirations++
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.recency.MoveToFront(elem)
+	return cloneKanbanData(entry.data), true
+}
+
+// Generation returns the write generation of a user's board. Pass it to
+// Fill after reading from the database.
+func (c *BoardCache) Generation(email string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generations[email]
+}
+
+// Fill caches a board read from the database, unless a write happened since
+// generation was taken
+func (c *BoardCache) Fill(email string, data *KanbanData, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generations[email] == generation {
+		c.store(email, data)
+	}
+}
+
+// Set stores a copy of a user's board after a write
+func (c *BoardCache) Set(email string, data *KanbanData) {
+	c.mu.Lock()
+	c.generations[email]++
+	c.store(email, data)
+	c.mu.Unlock()
+	c.notify(email)
+}
+
+// store caches a copy of a board, evicting the least recently used ones
+// past the size. c.mu must be held.
+func (c *BoardCache) store(email string, data *KanbanData) {
+	if c.size <= 0 {
+		return
+	}
+	entry := &cachedBoard{email: email, data: cloneKanbanData(data), expires: time.Now().Add(c.ttl)}
+	if elem, ok := c.boards[email]; ok {
+		elem.Value = entry
+		c.recency.MoveToFront(elem)
+		return
+	}
+	c.boards[email] = c.recency.PushFront(entry)
+	for c.recency.Len() > c.size {
+		c.remove(c.recency.Back())
+		c.evictions++
+	}
+}
+
+// remove drops a cached board. c.mu must be held.
+func (c *BoardCache) remove(elem *list.Element) {
+	c.recency.Remove(elem)
+	delete(c.boards, elem.Value.(*cachedBoard).email)
+}
+
+// Invalidate drops a user's cached board
+func (c *BoardCache) Invalidate(email string) {
+	c.Drop(email)
+	c.notify(email)
+}
+
+// Drop drops a user's cached board without notifying, as when another
+// instance wrote it
+func (c *BoardCache) Drop(email string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generations[email]++
+	if elem, ok := c.boards[email]; ok {
+		c.remove(elem)
+	}
+}
+
+// NotifyWrites calls fn after every Set or Invalidate. It must be called
+// before the cache is used.
+func (c *BoardCache) NotifyWrites(fn func(email string)) {
+	c.onWrite = fn
+}
+
+func (c *BoardCache) notify(email string) {
+	if c.onWrite != nil {
+		c.onWrite(email)
+	}
+}
+
+// Clear drops every cached board, as after the database is restored
+func (c *BoardCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for email := range c.generations {
+		c.generations[email]++
+	}
+	for email := range c.boards {
+		c.generations[email]++
+	}
+	c.boards = make(map[string]*list.Element)
+	c.recency.Init()
+}
+
+// Stats returns the cache's size and hit counters
+func (c *BoardCache) Stats() BoardCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := BoardCacheStats{
+		Entries:     c.recency.Len(),
+		Size:        c.size,
+		TTLSeconds:  c.ttl.Seconds(),
+		Hits:        c.hits,
+		Misses:      c.misses,
+		Evictions:   c.evictions,
+		Expirations: c.expirations,
+	}
+	if lookups := c.hits + c.misses; lookups > 0 {
+		stats.HitRate = float64(c.hits) / float64(lookups)
+	}
+	return stats
+}
+
+// cloneKanbanData copies a board's slices so callers can modify the result
+// without affecting the cached value. Task pointer fields are shared, as
+// callers replace rather than mutate them.
+func cloneKanbanData(data *KanbanData) *KanbanData {
+	clone := *data
+	clone.Columns = append([]Column{}, data.Columns...)
+	if data.Swimlanes != nil {
+		clone.Swimlanes = append([]Swimlane{}, data.Swimlanes...)
+	}
+	clone.Tasks = append([]Task{}, data.Tasks...)
+	if data.UnassignedTasks != nil {
+		clone.UnassignedTasks = append([]Task{}, data.UnassignedTasks...)
+	}
+	return &clone
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CalendarService manages the per-user secret tokens that protect ICS feeds
+type CalendarService struct {
+	db          *DB
+	authService *AuthService
+}
+
+func NewCalendarService(db *DB, authService *AuthService) *CalendarService {
+	return &CalendarService{db: db, authService: authService}
+}
+
+// RotateToken creates a new feed token for a user, invalidating any old one
+func (s *CalendarService) RotateToken(email string) (string, error) {
+	token, err := s.authService.generateSecureToken(24)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	if err := ensureUser(s.db, email); err != nil {
+		return "", err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO calendar_tokens (email, token, created_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(email) DO UPDATE SET
+			token = excluded.token,
+			created_at = CURRENT_TIMESTAMP
+	`, email, token)
+	if err != nil {
+		return "", fmt.Errorf("failed to store calendar token: %w", err)
+	}
+
+	return token, nil
+}
+
+// EmailForToken returns the user owning a feed token
+func (s *CalendarService) EmailForToken(token string) (string, error) {
+	row := s.db.QueryRow("SELECT email FROM calendar_tokens WHERE token = ?", token)
+
+	var email string
+	if err := row.Scan(&email); err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("unknown calendar token")
+		}
+		return "", fmt.Errorf("failed to query calendar token: %w", err)
+	}
+
+	return email, nil
+}
+
+// CalendarHandler serves ICS feeds of tasks with due dates
+type CalendarHandler struct {
+	calendarService *CalendarService
+	dataService     *DataService
+}
+
+func NewCalendarHandler(calendarService *CalendarService, dataService *DataService) *CalendarHandler {
+	return &CalendarHandler{
+		calendarService: calendarService,
+		dataService:     dataService,
+	}
+}
+
+// CreateFeedToken issues a new secret feed URL for the authenticated user
+func (h *CalendarHandler) CreateFeedToken(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+
+	token, err := h.calendarService.RotateToken(email)
+	if err != nil {
+		log.Printf("Error rotating calendar token: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to create calendar feed")
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"feedUrl": fmt.Sprintf("%s://%s/api/calendar.ics?token=%s", scheme, r.Host, token),
+	})
+}
+
+// Feed serves the user's tasks with due dates as an iCalendar document.
+// Tasks are emitted as all-day VEVENTs by default, or as VTODOs with
+// ?type=todo for clients that support them.
+func (h *CalendarHandler) Feed(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "Missing token")
+		return
+	}
+
+	email, err := h.calendarService.EmailForToken(token)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Invalid token")
+		return
+	}
+
+	asTodos := r.URL.Query().Get("type") == "todo"
+
+	data, err := h.dataService.GetUserData(r.Context(), email)
+	if err != nil {
+		log.Printf("Error getting user data: %v", err)
+		writeServerError(w, err, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="tasks.ics"`)
+	if err := writeTaskCalendar(w, buildBoardExport(email, data, false).Tasks, asTodos); err != nil {
+		log.Printf("Error writing calendar feed: %v", err)
+	}
+}
+
+// parseDueDate accepts the date-only format used by the frontend as well as
+// full RFC 3339 timestamps
+func parseDueDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// writeTaskCalendar renders tasks with due dates as an iCalendar document
+func writeTaskCalendar(w io.Writer, tasks []Task, asTodos bool) error {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Kanban Todo App//Tasks//EN",
+		"CALSCALE:GREGORIAN",
+		"X-WR-CALNAME:Kanban Tasks",
+	}
+
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	for _, task := range tasks {
+		due, ok := parseDueDate(task.DueDate)
+		if !ok {
+			continue
+		}
+
+		component := "VEVENT"
+		if asTodos {
+			component = "VTODO"
+		}
+
+		lines = append(lines,
+			"BEGIN:"+component,
+			"UID:"+task.ID+"@kanban-todo-app",
+			"DTSTAMP:"+stamp,
+			"SUMMARY:"+escapeICSText(task.Title),
+		)
+		if task.Description != "" {
+			lines = append(lines, "DESCRIPTION:"+escapeICSText(task.Description))
+		}
+		if task.Priority != nil {
+			lines = append(lines, fmt.Sprintf("PRIORITY:%d", icsPriority(*task.Priority)))
+		}
+		if asTodos {
+			lines = append(lines, "DUE;VALUE=DATE:"+due.Format("20060102"))
+			if task.Completed {
+				lines = append(lines, "STATUS:COMPLETED")
+				if task.CompletedAt != nil {
+					lines = append(lines, "COMPLETED:"+task.CompletedAt.UTC().Format("20060102T150405Z"))
+				}
+			} else {
+				lines = append(lines, "STATUS:NEEDS-ACTION")
+			}
+		} else {
+			lines = append(lines,
+				"DTSTART;VALUE=DATE:"+due.Format("20060102"),
+				"DTEND;VALUE=DATE:"+due.AddDate(0, 0, 1).Format("20060102"),
+			)
+		}
+		lines = append(lines, "END:"+component)
+	}
+
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, line := range lines {
+		if _, err := io.WriteString(w, foldICSLine(line)+"\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// icsPriority maps task priorities onto the RFC 5545 1 (high) - 9 (low) scale
+func icsPriority(priority string) int {
+	switch priority {
+	case PriorityUrgent:
+		return 1
+	case PriorityHigh:
+		return 3
+	case PriorityMedium:
+		return 5
+	case PriorityLow:
+		return 9
+	default:
+		return 0
+	}
+}
+
+// escapeICSText escapes a TEXT property value per RFC 5545
+func escapeICSText(value string) string {
+	replacer := strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	)
+	return replacer.Replace(value)
+}
+
+// foldICSLine splits content lines longer than 75 octets, continuing them
+// on lines that start with a space
+func foldICSLine(line string) string {
+	const limit = 75
+	if len(line) <= limit {
+		return line
+	}
+
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > limit {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+	return b.String()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Incremental sync:
+//
+//	GET /api/data/changes?since=<version or time>
+//
+// returns the tasks, columns and swimlanes changed after a board version (or
+// at or after an RFC 3339 time), and tombstones for those deleted or taken
+// off the board since. A client that was at the version, or synced at the
+// time, applies them and continues from the returned version. Every save
+// records the version at which each item last changed in board_changes.
+// Maintenance deletes old tombstones, so a client catching up from before
+// the newest deleted one gets a 410 and must fetch the whole board.
+
+// errChangesPruned is returned for a cursor older than the board's pruned
+// tombstones
+var errChangesPruned = errors.New("board changes since then were pruned")
+
+// Item types recorded in board_changes
+const (
+	changeTask     = "task"
+	changeColumn   = "column"
+	changeSwimlane = "swimlane"
+)
+
+// boardItemKey identifies a task, column or swimlane
+type boardItemKey struct {
+	kind string
+	id   string
+}
+
+// Tombstone marks an item deleted or taken off the board, e.g. archived
+type Tombstone struct {
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Version int64  `json:"version"`
+}
+
+// BoardChanges lists the items changed since a cursor, as of Version
+type BoardChanges struct {
+	Version    int64       `json:"version"`
+	Columns    []Column    `json:"columns"`
+	Swimlanes  []Swimlane  `json:"swimlanes"`
+	Tasks      []Task      `json:"tasks"`
+	Tombstones []Tombstone `json:"tombstones"`
+}
+
+// boardItems indexes a board's tasks, columns and swimlanes
+func boardItems(data *KanbanData) map[boardItemKey]any {
+	items := make(map[boardItemKey]any, len(data.Tasks)+len(data.Columns)+len(data.Swimlanes))
+	for _, col := range data.Columns {
+		items[boardItemKey{changeColumn, col.ID}] = col
+	}
+	for _, lane := range data.Swimlanes {
+		items[boardItemKey{changeSwimlane, lane.ID}] = lane
+	}
+	for _, tasks := range [][]Task{data.UnassignedTasks, data.Tasks} {
+		for _, task := range tasks {
+			items[boardItemKey{changeTask, task.ID}] = task
+		}
+	}
+	return items
+}
+
+// recordBoardChanges records the items that changed from previous to data,
+// at data's version. The first save after board_changes was added records
+// every item, so clients from before then get the whole board.
+func recordBoardChanges(tx *Tx, email string, previous, data *KanbanData) error {
+	var one int
+	err := tx.QueryRow("SELECT 1 FROM board_changes WHERE email = ? LIMIT 1", email).Scan(&one)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to query board changes: %w", err)
+	}
+	backfill := err == sql.ErrNoRows
+
+	record := func(key boardItemKey, removed int) error {
+		_, err := tx.Exec(`
+			INSERT INTO board_changes (email, item_type, item_id, version, removed, changed_at)
+			VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT (email, item_type, item_id) DO UPDATE SET
+				version = excluded.version,
+				removed = excluded.removed,
+				changed_at = excluded.changed_at
+		`, email, key.kind, key.id, data.Version, removed)
+		if err != nil {
+			return fmt.Errorf("failed to record board change: %w", err)
+		}
+		return nil
+	}
+
+	before := boardItems(previous)
+	for key, item := range boardItems(data) {
+		old, existed := before[key]
+		delete(before, key)
+		if backfill || !existed || !reflect.DeepEqual(old, item) {
+			if err := record(key, 0); err != nil {
+				return err
+			}
+		}
+	}
+	for key := range before {
+		if err := record(key, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Changes lists the items changed after a version, or at or after a time
+// when since is set. Items are taken from the current board; ones recorded
+// by a save after it was read are left for the next call.
+func (s *DataService) Changes(ctx context.Context, email string, version int64, since time.Time) (*BoardChanges, error) {
+	data, err := s.GetUserData(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := s.db.WithQueryTimeout(ctx)
+	defer cancel()
+
+	var prunedVersion int64
+	var prunedAt sql.NullTime
+	err = s.db.QueryRowContext(ctx, "SELECT changes_pruned_version, changes_pruned_at FROM users WHERE email = ?", email).Scan(&prunedVersion, &prunedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to query pruned board changes: %w", err)
+	}
+	pruned := version < prunedVersion
+	if !since.IsZero() {
+		pruned = prunedAt.Valid && since.Before(prunedAt.Time)
+	}
+	if pruned {
+		return nil, errChangesPruned
+	}
+
+	query := "SELECT item_type, item_id, version, removed FROM board_changes WHERE email = ? AND version > ?"
+	args := []any{email, version}
+	if !since.IsZero() {
+		query = "SELECT item_type, item_id, version, removed FROM board_changes WHERE email = ? AND changed_at >= ?"
+		args = []any{email, since}
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY version", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query board changes: %w", err)
+	}
+	defer rows.Close()
+
+	changes := &BoardChanges{
+		Version:    data.Version,
+		Columns:    []Column{},
+		Swimlanes:  []Swimlane{},
+		Tasks:      []Task{},
+		Tombstones: []Tombstone{},
+	}
+	items := boardItems(data)
+	for rows.Next() {
+		var key boardItemKey
+		var changedIn int64
+		var removed int
+		if err := rows.Scan(&key.kind, &key.id, &changedIn, &removed); err != nil {
+			return nil, fmt.Errorf("failed to scan board change: %w", err)
+		}
+
+		item, onBoard := items[key]
+		if !onBoard {
+			if removed == 1 && changedIn <= data.Version {
+				changes.Tombstones = append(changes.Tombstones, Tombstone{Type: key.kind, ID: key.id, Version: changedIn})
+			}
+			continue
+		}
+		switch item := item.(type) {
+		case Column:
+			if item.Deleted {
+				changes.Tombstones = append(changes.Tombstones, Tombstone{Type: key.kind, ID: key.id, Version: changedIn})
+			} else {
+				changes.Columns = append(changes.Columns, item)
+			}
+		case Swimlane:
+			if item.Deleted {
+				changes.Tombstones = append(changes.Tombstones, Tombstone{Type: key.kind, ID: key.id, Version: changedIn})
+			} else {
+				changes.Swimlanes = append(changes.Swimlanes, item)
+			}
+		case Task:
+			if item.Deleted {
+				changes.Tombstones = append(changes.Tombstones, Tombstone{Type: key.kind, ID: key.id, Version: changedIn})
+			} else {
+				changes.Tasks = append(changes.Tasks, item)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate board changes: %w", err)
+	}
+	return changes, nil
+}
+
+// Changes returns the items changed since a board version or time, for
+// clients catching up after a reconnect. ?board= reads a workspace board's.
+func (h *DataHandler) Changes(w http.ResponseWriter, r *http.Request) {
+	board := canonicalBoardID(requestEmail(r), queryBoard(r))
+
+	raw := r.URL.Query().Get("since")
+	if raw == "" {
+		writeError(w, http.StatusBadRequest, "since is required")
+		return
+	}
+	var version int64
+	var since time.Time
+	if n, err := strconv.ParseInt(raw, 10, 64); err == nil && n >= 0 {
+		version = n
+	} else if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		since = t
+	} else {
+		writeError(w, http.StatusBadRequest, "since must be a board version or an RFC 3339 time")
+		return
+	}
+
+	changes, err := h.dataService.Changes(r.Context(), board, version, since)
+	if err != nil {
+		writeChangesError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"changes": changes,
+	})
+}
+
+// writeChangesError answers a failed Changes call
+func writeChangesError(w http.ResponseWriter, err error) {
+	if err == errChangesPruned {
+		writeErrorCode(w, http.StatusGone, "changes_pruned", "Changes this old are no longer kept; fetch the whole board")
+		return
+	}
+	log.Printf("Error getting board changes: %v", err)
+	writeServerError(w, err, "Server error")
+}
@@ -0,0 +1,370 @@
+// Package client is a Go client for the todo-app HTTP API.
+//
+// A Client authenticates with a session token (from a magic link sign-in)
+// or an API key. Board changes go through the batch sync endpoint as a
+// registered device, the same path offline clients use, so they are applied
+// atomically and conflicts are reported per change.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client talks to one server
+type Client struct {
+	// Server base URL, such as https://todo.example.com
+	BaseURL string
+	// Session token, sent as a Bearer token
+	Token string
+	// API key, used when there's no Token
+	APIKey string
+
+	HTTP *http.Client
+}
+
+// New returns a client for the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		HTTP:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Error is an error response from the server
+type Error struct {
+	Status      int          `json:"-"`
+	Code        string       `json:"code"`
+	Message     string       `json:"message"`
+	FieldErrors []FieldError `json:"fieldErrors,omitempty"`
+}
+
+// FieldError is a problem with one field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server returned %d", e.Status)
+	}
+	return e.Message
+}
+
+// Board is a user's board
+type Board struct {
+	Version   int64      `json:"version,omitempty"`
+	Columns   []Column   `json:"columns"`
+	Swimlanes []Swimlane `json:"swimlanes,omitempty"`
+	Tasks     []Task     `json:"tasks"`
+}
+
+type Column struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Order    int    `json:"order"`
+	Deleted  bool   `json:"deleted,omitempty"`
+	Hidden   bool   `json:"hidden,omitempty"`
+	IsDone   bool   `json:"isDone,omitempty"`
+	WIPLimit int    `json:"wipLimit,omitempty"`
+}
+
+type Swimlane struct {
+	ID      string `json:"id"`
+	Title   string `json:"title"`
+	Order   int    `json:"order"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+type Task struct {
+	ID          string  `json:"id"`
+	Title       string  `json:"title"`
+	Description string  `json:"description"`
+	DueDate     string  `json:"dueDate"`
+	Priority    *string `json:"priority"`
+	ColumnID    *string `json:"columnId"`
+	SwimlaneID  *string `json:"swimlaneId,omitempty"`
+	Language    string  `json:"language,omitempty"`
+	Deleted     bool    `json:"deleted,omitempty"`
+	Hidden      bool    `json:"hidden,omitempty"`
+}
+
+// Operation types
+const (
+	OpCreateTask = "createTask"
+	OpUpdateTask = "updateTask"
+	OpMoveTask   = "moveTask"
+	OpDeleteTask = "deleteTask"
+)
+
+// Operation is a single change to a board
+type Operation struct {
+	Type     string `json:"type"`
+	TaskID   string `json:"taskId,omitempty"`
+	ColumnID string `json:"columnId,omitempty"`
+
+	// Full task for createTask
+	Task *Task `json:"task,omitempty"`
+	// Changed fields for updateTask
+	Changes *Changes `json:"changes,omitempty"`
+}
+
+// Changes lists the task fields an updateTask sets; nil fields are left
+// unchanged
+type Changes struct {
+	Title       *string `json:"title,omitempty"`
+	Description *string `json:"description,omitempty"`
+	DueDate     *string `json:"dueDate,omitempty"`
+	Priority    *string `json:"priority,omitempty"`
+}
+
+// Change outcomes
+const (
+	ChangeApplied  = "applied"
+	ChangeConflict = "conflict"
+	ChangeFailed   = "failed"
+)
+
+// ChangeResult is the outcome of one operation passed to Apply
+type ChangeResult struct {
+	Index     int        `json:"index"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	Operation *Operation `json:"operation,omitempty"`
+}
+
+// Device is a registered client installation
+type Device struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// SignIn is where following a magic link led: a Token, or a two-factor
+// Challenge to pass to VerifyTOTP
+type SignIn struct {
+	Token     string
+	Challenge string
+}
+
+// do sends a request and decodes a JSON response into out, which may be nil
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	resp, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// send sends an authenticated request, turning error responses into *Error
+func (c *Client) send(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return nil, readError(resp)
+	}
+	return resp, nil
+}
+
+// readError decodes an error envelope, falling back to the body as text
+func readError(resp *http.Response) error {
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	e := &Error{Status: resp.StatusCode}
+	if json.Unmarshal(raw, e) != nil || e.Message == "" {
+		e.Message = strings.TrimSpace(string(raw))
+	}
+	return e
+}
+
+// RequestLogin asks the server to email a magic link to email
+func (c *Client) RequestLogin(ctx context.Context, email string) error {
+	return c.do(ctx, http.MethodPost, "/api/auth/login", map[string]string{"email": email}, nil)
+}
+
+// FollowMagicLink signs in with a magic link from a login email
+func (c *Client) FollowMagicLink(ctx context.Context, link string) (*SignIn, error) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Query().Get("token") == "" || !strings.HasSuffix(u.Path, "/api/auth/magic-link") {
+		return nil, errors.New("not a sign-in link")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Stop at the redirect, which carries what's needed next
+	noRedirect := *c.HTTP
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := noRedirect.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, readError(resp)
+	}
+
+	// Servers with cookie sessions sign in right away
+	if token := sessionCookie(resp); token != "" {
+		return &SignIn{Token: token}, nil
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return nil, fmt.Errorf("unexpected sign-in response: %s", resp.Status)
+	}
+	query := location.Query()
+	if challenge := query.Get("mfa"); challenge != "" {
+		return &SignIn{Challenge: challenge}, nil
+	}
+	if code := query.Get("code"); code != "" {
+		token, err := c.exchange(ctx, code)
+		if err != nil {
+			return nil, err
+		}
+		return &SignIn{Token: token}, nil
+	}
+	return nil, fmt.Errorf("unexpected sign-in redirect to %s", location.Path)
+}
+
+// exchange swaps a magic link's one-time code for a session token
+func (c *Client) exchange(ctx context.Context, code string) (string, error) {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/auth/exchange", map[string]string{"code": code, "session": "token"}, &resp)
+	return resp.Token, err
+}
+
+// VerifyTOTP finishes a sign-in that stopped for a two-factor code
+func (c *Client) VerifyTOTP(ctx context.Context, challenge, code string) (string, error) {
+	resp, err := c.send(ctx, http.MethodPost, "/api/auth/totp/verify", map[string]string{"challenge": challenge, "code": code})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if token := sessionCookie(resp); token != "" {
+		return token, nil
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	return body.Token, nil
+}
+
+// sessionCookie returns the session token a response set as a cookie
+func sessionCookie(resp *http.Response) string {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "session" && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// Board fetches the user's board
+func (c *Client) Board(ctx context.Context) (*Board, error) {
+	var resp struct {
+		Data Board `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/data/get", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// RegisterDevice registers a device to pass to Apply
+func (c *Client) RegisterDevice(ctx context.Context, name string) (*Device, error) {
+	var resp struct {
+		Device Device `json:"device"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/devices", map[string]string{"name": name}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Device, nil
+}
+
+// Apply applies operations as changes made now by a device, returning the
+// outcome of each and the resulting board
+func (c *Client) Apply(ctx context.Context, deviceID string, ops ...Operation) ([]ChangeResult, *Board, error) {
+	type change struct {
+		ClientTimestamp time.Time `json:"clientTimestamp"`
+		Operation       Operation `json:"operation"`
+	}
+	changes := make([]change, len(ops))
+	now := time.Now()
+	for i, op := range ops {
+		changes[i] = change{ClientTimestamp: now, Operation: op}
+	}
+
+	var resp struct {
+		Results []ChangeResult `json:"results"`
+		Data    Board          `json:"data"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/data/sync/batch", map[string]any{"deviceId": deviceID, "changes": changes}, &resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Results, &resp.Data, nil
+}
+
+// Archive moves a task to the archive
+func (c *Client) Archive(ctx context.Context, taskID string) error {
+	return c.do(ctx, http.MethodPost, "/api/tasks/"+url.PathEscape(taskID)+"/archive", nil, nil)
+}
+
+// Export writes the board in format (json, csv or markdown) to w
+func (c *Client) Export(ctx context.Context, format string, w io.Writer) error {
+	resp, err := c.send(ctx, http.MethodGet, "/api/data/export?format="+url.QueryEscape(format), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// config is what login saves for later commands
+type config struct {
+	Server string `json:"server"`
+	Token  string `json:"token,omitempty"`
+	APIKey string `json:"apiKey,omitempty"`
+
+	// Device the CLI's changes are applied as, registered on first use
+	DeviceID string `json:"deviceId,omitempty"`
+}
+
+// configPath is $XDG_CONFIG_HOME/todo/config.json or the platform's
+// equivalent
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "todo", "config.json"), nil
+}
+
+// loadConfig reads the saved config; see newClient for the environment
+// variables that override it
+func loadConfig() (*config, error) {
+	cfg := &config{}
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(raw, cfg); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+	return cfg, nil
+}
+
+// save writes the config, readable only by the user as it holds credentials
+func (c *config) save() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(raw, '\n'), 0o600)
+}
@@ -0,0 +1,537 @@
+// Command todo manages a todo-app board from the terminal.
+//
+//	todo login -server https://todo.example.com -email you@example.com
+//	todo add -due tomorrow -priority high "Pay rent"
+//	todo list -due today
+//	todo move <task> <column>
+//	todo done <task>
+//	todo export -format markdown -o board.md
+//
+// Tasks and columns are named by ID, a unique ID prefix, or title.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/example/todo-app/client"
+)
+
+const usage = `usage: todo <command> [flags]
+
+commands:
+  login   sign in with a magic link (-email) or an API key (-api-key)
+  logout  forget the saved credentials
+  add     add a task: todo add [-column C] [-due D] [-priority P] TITLE
+  list    list tasks: todo list [-due today|tomorrow|overdue|YYYY-MM-DD] [-column C]
+  move    move a task: todo move TASK COLUMN
+  done    complete a task: todo done TASK
+  export  export the board: todo export [-format json|csv|markdown] [-o FILE]
+
+TODO_SERVER, TODO_TOKEN and TODO_API_KEY override the saved login.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	commands := map[string]func(context.Context, []string) error{
+		"login":  runLogin,
+		"logout": runLogout,
+		"add":    runAdd,
+		"list":   runList,
+		"ls":     runList,
+		"move":   runMove,
+		"mv":     runMove,
+		"done":   runDone,
+		"export": runExport,
+	}
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err := run(context.Background(), os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "todo:", err)
+		os.Exit(1)
+	}
+}
+
+// newClient returns a client for the saved login, which TODO_SERVER,
+// TODO_TOKEN and TODO_API_KEY override
+func newClient(cfg *config) (*client.Client, error) {
+	server := cfg.Server
+	if env := os.Getenv("TODO_SERVER"); env != "" {
+		server = env
+	}
+	if server == "" {
+		return nil, errors.New("not signed in; run todo login first")
+	}
+
+	c := client.New(server)
+	c.Token, c.APIKey = cfg.Token, cfg.APIKey
+	if env := os.Getenv("TODO_TOKEN"); env != "" {
+		c.Token, c.APIKey = env, ""
+	}
+	if env := os.Getenv("TODO_API_KEY"); env != "" {
+		c.Token, c.APIKey = "", env
+	}
+	if c.Token == "" && c.APIKey == "" {
+		return nil, errors.New("not signed in; run todo login first")
+	}
+	return c, nil
+}
+
+func runLogin(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:3001", "server URL")
+	email := fs.String("email", "", "email address to send a magic link to")
+	apiKey := fs.String("api-key", "", "API key to sign in with instead")
+	fs.Parse(args)
+
+	if (*email == "") == (*apiKey == "") {
+		return errors.New("login takes -email or -api-key")
+	}
+
+	c := client.New(*server)
+	cfg := &config{Server: c.BaseURL}
+	if *apiKey != "" {
+		// Check the key before saving it
+		c.APIKey = *apiKey
+		if _, err := c.Board(ctx); err != nil {
+			return fmt.Errorf("failed to sign in: %w", err)
+		}
+		cfg.APIKey = *apiKey
+		if err := cfg.save(); err != nil {
+			return err
+		}
+		fmt.Println("Signed in with an API key")
+		return nil
+	}
+
+	if err := c.RequestLogin(ctx, *email); err != nil {
+		return fmt.Errorf("failed to request a sign-in link: %w", err)
+	}
+	stdin := bufio.NewReader(os.Stdin)
+	link, err := prompt(stdin, "We've emailed you a sign-in link. Paste it here: ")
+	if err != nil {
+		return err
+	}
+	signIn, err := c.FollowMagicLink(ctx, link)
+	if err != nil {
+		return fmt.Errorf("failed to sign in: %w", err)
+	}
+	if signIn.Challenge != "" {
+		code, err := prompt(stdin, "Two-factor code: ")
+		if err != nil {
+			return err
+		}
+		if signIn.Token, err = c.VerifyTOTP(ctx, signIn.Challenge, code); err != nil {
+			return fmt.Errorf("failed to sign in: %w", err)
+		}
+	}
+
+	cfg.Token = signIn.Token
+	if err := cfg.save(); err != nil {
+		return err
+	}
+	fmt.Println("Signed in as", *email)
+	return nil
+}
+
+// prompt asks for one line of input
+func prompt(r *bufio.Reader, question string) (string, error) {
+	fmt.Print(question)
+	line, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func runLogout(ctx context.Context, args []string) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	fmt.Println("Signed out")
+	return nil
+}
+
+func runAdd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	column := fs.String("column", "", "column to add the task to (default unassigned)")
+	due := fs.String("due", "", "due date: today, tomorrow or YYYY-MM-DD")
+	priority := fs.String("priority", "", "priority, such as low, medium or high")
+	description := fs.String("description", "", "task description")
+	fs.Parse(args)
+
+	title := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if title == "" {
+		return errors.New("add takes a task title")
+	}
+	task := &client.Task{Title: title, Description: *description}
+	if *due != "" {
+		date, err := parseDate(*due)
+		if err != nil {
+			return err
+		}
+		task.DueDate = date
+	}
+	if *priority != "" {
+		task.Priority = priority
+	}
+
+	s, err := open()
+	if err != nil {
+		return err
+	}
+	if *column != "" {
+		board, err := s.client.Board(ctx)
+		if err != nil {
+			return err
+		}
+		col, err := findColumn(board, *column)
+		if err != nil {
+			return err
+		}
+		task.ColumnID = &col.ID
+	}
+
+	if _, err := s.apply(ctx, client.Operation{Type: client.OpCreateTask, Task: task}); err != nil {
+		return err
+	}
+	fmt.Printf("Added %q\n", title)
+	return nil
+}
+
+func runList(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	due := fs.String("due", "", "only tasks due today, tomorrow, overdue or on YYYY-MM-DD")
+	column := fs.String("column", "", "only tasks in this column")
+	fs.Parse(args)
+
+	s, err := open()
+	if err != nil {
+		return err
+	}
+	board, err := s.client.Board(ctx)
+	if err != nil {
+		return err
+	}
+
+	keep := func(client.Task) bool { return true }
+	switch *due {
+	case "":
+	case "overdue":
+		today := time.Now().Format(time.DateOnly)
+		keep = func(t client.Task) bool { return dueDate(t) != "" && dueDate(t) < today }
+	default:
+		date, err := parseDate(*due)
+		if err != nil {
+			return err
+		}
+		keep = func(t client.Task) bool { return dueDate(t) == date }
+	}
+	var columnID *string
+	if *column != "" {
+		col, err := findColumn(board, *column)
+		if err != nil {
+			return err
+		}
+		columnID = &col.ID
+	}
+
+	titles := map[string]string{}
+	order := map[string]int{}
+	for _, col := range board.Columns {
+		titles[col.ID], order[col.ID] = col.Title, col.Order
+	}
+	var tasks []client.Task
+	for _, t := range board.Tasks {
+		if t.Deleted || t.Hidden || !keep(t) {
+			continue
+		}
+		if columnID != nil && (t.ColumnID == nil || *t.ColumnID != *columnID) {
+			continue
+		}
+		tasks = append(tasks, t)
+	}
+	// Board order, unassigned tasks first, then by due date
+	sort.SliceStable(tasks, func(i, j int) bool {
+		oi, oj := -1, -1
+		if tasks[i].ColumnID != nil {
+			oi = order[*tasks[i].ColumnID]
+		}
+		if tasks[j].ColumnID != nil {
+			oj = order[*tasks[j].ColumnID]
+		}
+		if oi != oj {
+			return oi < oj
+		}
+		return dueDate(tasks[i]) < dueDate(tasks[j])
+	})
+
+	if len(tasks) == 0 {
+		fmt.Println("No tasks")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCOLUMN\tDUE\tPRIORITY\tTITLE")
+	for _, t := range tasks {
+		col := "-"
+		if t.ColumnID != nil {
+			col = titles[*t.ColumnID]
+		}
+		priority := "-"
+		if t.Priority != nil && *t.Priority != "" {
+			priority = *t.Priority
+		}
+		date := dueDate(t)
+		if date == "" {
+			date = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.ID, col, date, priority, t.Title)
+	}
+	return w.Flush()
+}
+
+func runMove(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: todo move TASK COLUMN")
+	}
+
+	s, err := open()
+	if err != nil {
+		return err
+	}
+	board, err := s.client.Board(ctx)
+	if err != nil {
+		return err
+	}
+	task, err := findTask(board, args[0])
+	if err != nil {
+		return err
+	}
+	col, err := findColumn(board, args[1])
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.apply(ctx, client.Operation{Type: client.OpMoveTask, TaskID: task.ID, ColumnID: col.ID}); err != nil {
+		return err
+	}
+	fmt.Printf("Moved %q to %s\n", task.Title, col.Title)
+	return nil
+}
+
+// runDone moves a task to the board's first done column, or archives it
+// when the board has none, like the simple view's Complete button
+func runDone(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: todo done TASK")
+	}
+
+	s, err := open()
+	if err != nil {
+		return err
+	}
+	board, err := s.client.Board(ctx)
+	if err != nil {
+		return err
+	}
+	task, err := findTask(board, args[0])
+	if err != nil {
+		return err
+	}
+
+	columns := append([]client.Column(nil), board.Columns...)
+	sort.SliceStable(columns, func(i, j int) bool { return columns[i].Order < columns[j].Order })
+	for _, col := range columns {
+		if col.IsDone && !col.Deleted {
+			if _, err := s.apply(ctx, client.Operation{Type: client.OpMoveTask, TaskID: task.ID, ColumnID: col.ID}); err != nil {
+				return err
+			}
+			fmt.Printf("Completed %q\n", task.Title)
+			return nil
+		}
+	}
+
+	if err := s.client.Archive(ctx, task.ID); err != nil {
+		return err
+	}
+	fmt.Printf("Completed %q (archived)\n", task.Title)
+	return nil
+}
+
+func runExport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "json", "json, csv or markdown")
+	output := fs.String("o", "", "file to write (default stdout)")
+	fs.Parse(args)
+
+	s, err := open()
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return s.client.Export(ctx, *format, w)
+}
+
+// session is a signed-in client and its saved config
+type session struct {
+	cfg    *config
+	client *client.Client
+}
+
+func open() (*session, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &session{cfg: cfg, client: c}, nil
+}
+
+// apply applies operations as the CLI's device, registering it first if
+// needed, and fails unless all of them applied
+func (s *session) apply(ctx context.Context, ops ...client.Operation) (*client.Board, error) {
+	for attempt := 0; ; attempt++ {
+		if s.cfg.DeviceID == "" {
+			if err := s.registerDevice(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		results, board, err := s.client.Apply(ctx, s.cfg.DeviceID, ops...)
+		var apiErr *client.Error
+		if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound && attempt == 0 {
+			// The device was removed; register a new one
+			s.cfg.DeviceID = ""
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			if result.Status != client.ChangeApplied {
+				return nil, fmt.Errorf("change %s: %s", result.Status, result.Error)
+			}
+		}
+		return board, nil
+	}
+}
+
+func (s *session) registerDevice(ctx context.Context) error {
+	name := "todo CLI"
+	if host, err := os.Hostname(); err == nil {
+		name += " on " + host
+	}
+	device, err := s.client.RegisterDevice(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to register device: %w", err)
+	}
+	s.cfg.DeviceID = device.ID
+	return s.cfg.save()
+}
+
+// parseDate turns today, tomorrow or YYYY-MM-DD into a due date
+func parseDate(value string) (string, error) {
+	now := time.Now()
+	switch strings.ToLower(value) {
+	case "today":
+		return now.Format(time.DateOnly), nil
+	case "tomorrow":
+		return now.AddDate(0, 0, 1).Format(time.DateOnly), nil
+	}
+	if _, err := time.Parse(time.DateOnly, value); err != nil {
+		return "", fmt.Errorf("invalid date %q; use today, tomorrow or YYYY-MM-DD", value)
+	}
+	return value, nil
+}
+
+// dueDate returns a task's due date as YYYY-MM-DD, or empty
+func dueDate(t client.Task) string {
+	if len(t.DueDate) < len(time.DateOnly) {
+		return ""
+	}
+	return t.DueDate[:len(time.DateOnly)]
+}
+
+// findTask finds a live task by ID, unique ID prefix or title
+func findTask(board *client.Board, ref string) (*client.Task, error) {
+	var matches []*client.Task
+	for i := range board.Tasks {
+		t := &board.Tasks[i]
+		if t.Deleted {
+			continue
+		}
+		if t.ID == ref {
+			return t, nil
+		}
+		if strings.HasPrefix(t.ID, ref) || strings.EqualFold(t.Title, ref) {
+			matches = append(matches, t)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no task matches %q", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("%d tasks match %q; use the ID from todo list", len(matches), ref)
+	}
+}
+
+// findColumn finds a live column by ID, unique ID prefix or title
+func findColumn(board *client.Board, ref string) (*client.Column, error) {
+	var matches []*client.Column
+	for i := range board.Columns {
+		col := &board.Columns[i]
+		if col.Deleted {
+			continue
+		}
+		if col.ID == ref {
+			return col, nil
+		}
+		if strings.HasPrefix(col.ID, ref) || strings.EqualFold(col.Title, ref) {
+			matches = append(matches, col)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no column matches %q", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("%d columns match %q", len(matches), ref)
+	}
+}
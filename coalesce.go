@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errNoWritesApplied fails a coalesced transaction whose writes all failed,
+// so nothing is saved
+var errNoWritesApplied = errors.New("no coalesced writes applied")
+
+// WriteCoalescer batches a user's board writes that arrive close together
+// into one transaction and one broadcast. Dragging a card fires a sync per
+// drop; rather than a read-merge-write-broadcast each, the writes queued
+// while one is saved, or within the window after it, are saved together.
+// A write to a board that hasn't been written for a window goes straight
+// through.
+type WriteCoalescer struct {
+	data    *DataService
+	window  time.Duration
+	publish func(email string, data *KanbanData)
+
+	mu     sync.Mutex
+	users  map[string]*userWrites
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// userWrites is a user's queue of writes
+type userWrites struct {
+	pending []pendingWrite
+
+	// Set while a flush is scheduled or running; flushes of a board don't
+	// overlap
+	scheduled bool
+	timer     *time.Timer
+
+	// When the last flush finished
+	last time.Time
+}
+
+type pendingWrite struct {
+	fn   func(tx *Tx, data *KanbanData) error
+	done chan writeResult
+}
+
+type writeResult struct {
+	data *KanbanData
+	err  error
+}
+
+// NewWriteCoalescer coalesces writes to data's boards within window of each
+// other. publish, if set, is called with the saved board after each
+// transaction, e.g. to broadcast it.
+func NewWriteCoalescer(data *DataService, window time.Duration, publish func(email string, data *KanbanData)) *WriteCoalescer {
+	return &WriteCoalescer{data: data, window: window, publish: publish, users: make(map[string]*userWrites)}
+}
+
+// Update applies fn to a user's board, possibly in the same transaction as
+// other writes queued for the board, and returns the board as saved. fn
+// sees the board as left by the writes before it and may use tx to read;
+// if it fails, its changes are undone and the other writes still apply.
+//
+// The transaction is shared, so it isn't cancelled with ctx; it's bounded
+// by the query timeout instead. If ctx ends first Update returns its
+// error, and the write may still be saved.
+func (c *WriteCoalescer) Update(ctx context.Context, email string, fn func(tx *Tx, data *KanbanData) error) (*KanbanData, error) {
+	write := pendingWrite{fn: fn, done: make(chan writeResult, 1)}
+
+	c.mu.Lock()
+	if c.closed {
+		// After shutdown writes are saved one at a time
+		c.mu.Unlock()
+		c.write(email, []pendingWrite{write})
+		result := <-write.done
+		return result.data, result.err
+	}
+	u, ok := c.users[email]
+	if !ok {
+		u = &userWrites{}
+		c.users[email] = u
+	}
+	u.pending = append(u.pending, write)
+	if !u.scheduled {
+		c.schedule(email, u)
+	}
+	c.mu.Unlock()
+
+	select {
+	case result := <-write.done:
+		return result.data, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// schedule flushes a user's writes a window after the last flush, or at
+// once if that's passed. c.mu must be held.
+func (c *WriteCoalescer) schedule(email string, u *userWrites) {
+	u.scheduled = true
+	c.wg.Add(1)
+	delay := time.Until(u.last.Add(c.window))
+	if delay <= 0 || c.closed {
+		u.timer = nil
+		go c.flush(email)
+		return
+	}
+	u.timer = time.AfterFunc(delay, func() { c.flush(email) })
+}
+
+// flush saves the writes queued for a user, then schedules the next flush
+// if more arrived meanwhile
+func (c *WriteCoalescer) flush(email string) {
+	defer c.wg.Done()
+
+	c.mu.Lock()
+	u := c.users[email]
+	batch := u.pending
+	u.pending = nil
+	u.timer = nil
+	c.mu.Unlock()
+
+	c.write(email, batch)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u.last = time.Now()
+	u.scheduled = false
+	if len(u.pending) > 0 {
+		c.schedule(email, u)
+	}
+}
+
+// write saves a batch of writes in one transaction and publishes the
+// result once
+func (c *WriteCoalescer) write(email string, batch []pendingWrite) {
+	errs := make([]error, len(batch))
+	// Each write was checked against edit locks as it was queued
+	data, err := c.data.updateUserDataTx(context.Background(), email, func(tx *Tx, data *KanbanData) error {
+		applied := 0
+		for i, w := range batch {
+			before := cloneKanbanData(data)
+			if err := w.fn(tx, data); err != nil {
+				*data = *before
+				errs[i] = err
+				continue
+			}
+			errs[i] = nil
+			applied++
+		}
+		if applied == 0 {
+			return errNoWritesApplied
+		}
+		return nil
+	})
+
+	if err == nil && c.publish != nil {
+		c.publish(email, data)
+	}
+	for i, w := range batch {
+		switch {
+		case errors.Is(err, errNoWritesApplied):
+			w.done <- writeResult{err: errs[i]}
+		case err != nil:
+			w.done <- writeResult{err: err}
+		case errs[i] != nil:
+			w.done <- writeResult{err: errs[i]}
+		default:
+			w.done <- writeResult{data: data}
+		}
+	}
+}
+
+// Shutdown saves queued writes at once rather than at the end of their
+// window, and waits for them until ctx expires. Later writes are saved
+// as they arrive.
+func (c *WriteCoalescer) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.closed = true
+	for email, u := range c.users {
+		if u.timer != nil && u.timer.Stop() {
+			u.timer = nil
+			go c.flush(email)
+		}
+	}
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
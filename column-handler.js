@@ -25,11 +25,17 @@ class ColumnHandler {
 
     const headerElement = document.createElement('div');
     headerElement.className = 'column-header';
+    if (column.color) {
+      headerElement.style.borderTop = `4px solid ${column.color}`;
+    }
 
     const titleInput = document.createElement('input');
     titleInput.value = column.title;
     titleInput.placeholder = 'Enter column title';
     titleInput.dataset.columnId = column.id;
+    if (column.description) {
+      titleInput.title = column.description;
+    }
     titleInput.addEventListener('blur', (e) => this.updateColumnTitle(column.id, e.target.value));
     titleInput.addEventListener('keydown', (e) => {
       if (e.key === 'Enter') {
@@ -88,6 +94,7 @@ class ColumnHandler {
     return [...tasks].sort((a, b) => {
       // Priority weight map (higher value = higher priority)
       const priorityWeight = {
+        'urgent': 4,
         'high': 3,
         'medium': 2,
         'low': 1,
@@ -250,7 +257,7 @@ class ColumnHandler {
     this.app.data.columns.sort((a, b) => a.order - b.order);
 
     // Save changes and redraw the board
-    this.app.saveToLocalStorage();
+    this.saveColumnOrder();
     this.app.renderBoard();
   }
 
@@ -450,10 +457,25 @@ class ColumnHandler {
     // Sort columns by order
     this.app.data.columns.sort((a, b) => a.order - b.order);
 
-    this.app.saveToLocalStorage();
+    this.saveColumnOrder();
     this.app.renderBoard();
   }
 
+  /**
+   * Saves the columns' new order, on the server when signed in so that
+   * every device gets the same one
+   */
+  saveColumnOrder() {
+    const auth = this.app.authManager;
+    if (!auth || !auth.isAuthenticated) {
+      this.app.saveToLocalStorage();
+      return;
+    }
+    localStorage.setItem('kanbanData', JSON.stringify(this.app.data));
+    const ids = this.app.data.columns.filter(column => !column.deleted).map(column => column.id);
+    auth.reorderColumns(ids);
+  }
+
   /**
    * Updates a column's title
    * @param {string} columnId - The ID of the column to update
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ColumnTitleConflict describes a set of live columns sharing the same title
+type ColumnTitleConflict struct {
+	Title     string   `json:"title"`
+	ColumnIDs []string `json:"columnIds"`
+}
+
+// normalizeColumnTitle returns the comparison key for a column title
+func normalizeColumnTitle(title string) string {
+	return strings.ToLower(strings.TrimSpace(title))
+}
+
+// findColumnTitleConflicts reports live columns in merged that share a
+// title (case-insensitive) where at least one of them was created or
+// renamed relative to the previously stored server data. Duplicates that
+// already existed on the server are left alone so old boards keep syncing.
+func findColumnTitleConflicts(serverData *KanbanData, merged *KanbanData) []ColumnTitleConflict {
+	serverTitles := make(map[string]string)
+	for _, col := range serverData.Columns {
+		serverTitles[col.ID] = normalizeColumnTitle(col.Title)
+	}
+
+	groups := make(map[string][]Column)
+	var order []string
+	for _, col := range merged.Columns {
+		if col.Deleted {
+			continue
+		}
+		key := normalizeColumnTitle(col.Title)
+		if _, seen := groups[key]; !seen {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], col)
+	}
+
+	conflicts := []ColumnTitleConflict{}
+	for _, key := range order {
+		cols := groups[key]
+		if len(cols) < 2 {
+			continue
+		}
+
+		changed := false
+		for _, col := range cols {
+			if title, exists := serverTitles[col.ID]; !exists || title != key {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		conflict := ColumnTitleConflict{Title: cols[0].Title}
+		for _, col := range cols {
+			conflict.ColumnIDs = append(conflict.ColumnIDs, col.ID)
+		}
+		conflicts = append(conflicts, conflict)
+	}
+
+	return conflicts
+}
+
+// writeColumnTitleConflict responds with a structured 409 error
+func writeColumnTitleConflict(w http.ResponseWriter, conflicts []ColumnTitleConflict) {
+	writeErrorBody(w, http.StatusConflict, "duplicate_column_title", "Column titles must be unique", map[string]any{
+		"conflicts": conflicts,
+	})
+}
+
+// defaultColumnTitles are the column titles reconciled when no explicit
+// list is configured
+var defaultColumnTitles = []string{"To Do", "Doing", "Done"}
+
+// reconcileDuplicateColumns folds live columns that share one of the given
+// titles into a single column. The survivor is the column the server already
+// knew about (falling back to the first seen); tasks are reassigned to it and
+// the duplicates are marked deleted so every device converges on one ID.
+func reconcileDuplicateColumns(serverData *KanbanData, merged *KanbanData, titles []string) {
+	reconcile := make(map[string]bool)
+	for _, title := range titles {
+		reconcile[normalizeColumnTitle(title)] = true
+	}
+
+	serverColumns := make(map[string]bool)
+	for _, col := range serverData.Columns {
+		serverColumns[col.ID] = true
+	}
+
+	// Pick a survivor for each reconciled title
+	survivors := make(map[string]int)
+	for i, col := range merged.Columns {
+		key := normalizeColumnTitle(col.Title)
+		if col.Deleted || !reconcile[key] {
+			continue
+		}
+		current, exists := survivors[key]
+		if !exists || (!serverColumns[merged.Columns[current].ID] && serverColumns[col.ID]) {
+			survivors[key] = i
+		}
+	}
+
+	// Map duplicate column IDs onto their survivor
+	replacements := make(map[string]string)
+	for i, col := range merged.Columns {
+		key := normalizeColumnTitle(col.Title)
+		survivor, exists := survivors[key]
+		if col.Deleted || !exists || survivor == i {
+			continue
+		}
+		replacements[col.ID] = merged.Columns[survivor].ID
+		merged.Columns[i].Deleted = true
+	}
+
+	if len(replacements) == 0 {
+		return
+	}
+
+	for i, task := range merged.Tasks {
+		if task.ColumnID == nil {
+			continue
+		}
+		if target, exists := replacements[*task.ColumnID]; exists {
+			columnID := target
+			merged.Tasks[i].ColumnID = &columnID
+		}
+	}
+
+	log.Printf("Reconciled %d duplicate columns", len(replacements))
+}
+
+// sortedColumns returns a copy of columns ordered by their Order field
+func sortedColumns(columns []Column) []Column {
+	sorted := append([]Column{}, columns...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Order < sorted[j].Order
+	})
+	return sorted
+}
+
+// maxColumnDescriptionLength limits a column's description, in characters
+const maxColumnDescriptionLength = 500
+
+// validateColumnMetadata checks a column's color is empty or a #rgb or
+// #rrggbb hex color, and its description isn't too long
+func validateColumnMetadata(color, description string) error {
+	if color != "" {
+		hex := strings.TrimPrefix(color, "#")
+		valid := hex != color && (len(hex) == 3 || len(hex) == 6)
+		for _, r := range hex {
+			if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+				valid = false
+			}
+		}
+		if !valid {
+			return fmt.Errorf("color must be a hex color like #1e90ff")
+		}
+	}
+	if utf8.RuneCountInString(description) > maxColumnDescriptionLength {
+		return fmt.Errorf("description is limited to %d characters", maxColumnDescriptionLength)
+	}
+	return nil
+}
+
+// findInvalidColumns returns the IDs of columns with invalid metadata, and
+// the first problem found
+func findInvalidColumns(data *KanbanData) ([]string, error) {
+	var ids []string
+	var first error
+	for _, col := range data.Columns {
+		if err := validateColumnMetadata(col.Color, col.Description); err != nil {
+			ids = append(ids, col.ID)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return ids, first
+}
+
+// writeInvalidColumns responds with a structured 422 error
+func writeInvalidColumns(w http.ResponseWriter, columnIDs []string, err error) {
+	writeErrorBody(w, http.StatusUnprocessableEntity, "invalid_column", err.Error(), map[string]any{
+		"columnIds": columnIDs,
+	})
+}
+
+// errColumnOrder is returned for a reorder that doesn't list every live
+// column exactly once
+var errColumnOrder = errors.New("ids must list every column exactly once")
+
+// liveColumns returns a board's columns that aren't deleted, in order
+func liveColumns(data *KanbanData) []Column {
+	live := []Column{}
+	for _, col := range sortedColumns(data.Columns) {
+		if !col.Deleted {
+			live = append(live, col)
+		}
+	}
+	return live
+}
+
+// reorderColumns numbers a board's live columns, hidden ones included, in
+// the order of ids, left to right
+func reorderColumns(data *KanbanData, ids []string) error {
+	if len(ids) != len(liveColumns(data)) {
+		return errColumnOrder
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if findColumn(data, id) < 0 || seen[id] {
+			return errColumnOrder
+		}
+		seen[id] = true
+	}
+	for order, id := range ids {
+		data.Columns[findColumn(data, id)].Order = order
+	}
+	return nil
+}
+
+// ColumnHandler serves column ordering, so devices agree on it instead of
+// each numbering columns itself
+type ColumnHandler struct {
+	dataService *DataService
+	hub         *Hub
+}
+
+func NewColumnHandler(dataService *DataService, hub *Hub) *ColumnHandler {
+	return &ColumnHandler{dataService: dataService, hub: hub}
+}
+
+// Reorder sets the order of every live column from a list of IDs, left to
+// right, and pushes the board to the user's clients
+func (h *ColumnHandler) Reorder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	email := requestEmail(r)
+	var orderErr error
+	data, err := h.dataService.UpdateUserData(r.Context(), email, func(data *KanbanData) error {
+		orderErr = reorderColumns(data, req.IDs)
+		return orderErr
+	})
+	if orderErr != nil {
+		writeError(w, http.StatusBadRequest, orderErr.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error reordering columns: %v", err)
+		writeServerError(w, err, "Failed to reorder columns")
+		return
+	}
+
+	h.hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"version": data.Version,
+		"columns": liveColumns(data),
+	})
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxCommentLength caps a comment's body, in bytes
+const maxCommentLength = 10000
+
+// Comment is a message in a task's discussion
+type Comment struct {
+	ID        string    `json:"id"`
+	TaskID    string    `json:"taskId"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// errCommentNotFound is returned when a comment doesn't exist
+var errCommentNotFound = errors.New("comment not found")
+
+// CommentService stores task comments
+type CommentService struct {
+	db          *DB
+	dataService *DataService
+}
+
+func NewCommentService(db *DB, dataService *DataService) *CommentService {
+	return &CommentService{db: db, dataService: dataService}
+}
+
+const commentColumns = "id, task_id, author, body, created_at, updated_at"
+
+func scanComment(row interface{ Scan(...any) error }) (*Comment, error) {
+	var c Comment
+	if err := row.Scan(&c.ID, &c.TaskID, &c.Author, &c.Body, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// listComments runs a comment query and collects the rows
+func (s *CommentService) listComments(query string, args ...any) ([]Comment, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query comments: %w", err)
+	}
+	defer rows.Close()
+
+	comments := []Comment{}
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan comment: %w", err)
+		}
+		comments = append(comments, *c)
+	}
+	return comments, rows.Err()
+}
+
+// List returns a task's comments, oldest first
+func (s *CommentService) List(boardEmail, taskID string) ([]Comment, error) {
+	return s.listComments(`
+		SELECT `+commentColumns+` FROM comments
+		WHERE email = ? AND task_id = ? ORDER BY created_at, id
+	`, boardEmail, taskID)
+}
+
+// ListBoard returns every comment on a board, for exports
+func (s *CommentService) ListBoard(boardEmail string) ([]Comment, error) {
+	return s.listComments(`
+		SELECT `+commentColumns+` FROM comments
+		WHERE email = ? ORDER BY task_id, created_at, id
+	`, boardEmail)
+}
+
+// Get returns a comment by ID
+func (s *CommentService) Get(id string) (*Comment, error) {
+	c, err := scanComment(s.db.QueryRow("SELECT "+commentColumns+" FROM comments WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, errCommentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query comment: %w", err)
+	}
+	return c, nil
+}
+
+// Author returns the email that wrote a comment
+func (s *CommentService) Author(id string) (string, error) {
+	c, err := s.Get(id)
+	if err != nil {
+		return "", err
+	}
+	return c.Author, nil
+}
+
+// Create adds a comment to a task on the board
+func (s *CommentService) Create(ctx context.Context, boardEmail, taskID, author, body string) (*Comment, error) {
+	data, err := s.dataService.GetUserData(ctx, boardEmail)
+	if err != nil {
+		return nil, err
+	}
+	if findTask(data, taskID) < 0 {
+		return nil, errTaskNotFound
+	}
+
+	if err := ensureUser(s.db, boardEmail); err != nil {
+		return nil, err
+	}
+
+	id := generateID()
+	_, err = s.db.Exec(`
+		INSERT INTO comments (id, email, task_id, author, body, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+	`, id, boardEmail, taskID, author, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create comment: %w", err)
+	}
+
+	return s.Get(id)
+}
+
+// Update replaces a comment's body
+func (s *CommentService) Update(id, body string) (*Comment, error) {
+	_, err := s.db.Exec(`
+		UPDATE comments SET body = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
+	`, body, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update comment: %w", err)
+	}
+	return s.Get(id)
+}
+
+// Delete removes a comment
+func (s *CommentService) Delete(id string) error {
+	if _, err := s.db.Exec("DELETE FROM comments WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete comment: %w", err)
+	}
+	return nil
+}
+
+// CommentHandler exposes task comments over HTTP and pushes changes live
+type CommentHandler struct {
+	commentService *CommentService
+	hub            *Hub
+}
+
+func NewCommentHandler(commentService *CommentService, hub *Hub) *CommentHandler {
+	return &CommentHandler{commentService: commentService, hub: hub}
+}
+
+// commentAuthor resolves the author of the comment in the route, for OwnsResource
+func (h *CommentHandler) commentAuthor(r *http.Request) (string, error) {
+	return h.commentService.Author(mux.Vars(r)["commentId"])
+}
+
+// publish tells the board's subscribers about a comment change
+func (h *CommentHandler) publish(boardEmail, action string, comment *Comment) {
+	h.hub.PublishBoard(canonicalBoardID(boardEmail, ""), WebSocketMessage{
+		Type: "comment",
+		Data: map[string]any{"action": action, "comment": comment},
+		User: comment.Author,
+	}, nil)
+}
+
+// decodeCommentBody reads and validates a comment request body. On failure
+// it writes the error response and returns false.
+func decodeCommentBody(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		Body string `json:"body"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return "", false
+	}
+	body := strings.TrimSpace(req.Body)
+	if body == "" {
+		writeFieldErrors(w, FieldError{Field: "body", Message: "is required"})
+		return "", false
+	}
+	if len(body) > maxCommentLength {
+		writeFieldErrors(w, FieldError{Field: "body", Message: fmt.Sprintf("is limited to %d characters", maxCommentLength)})
+		return "", false
+	}
+	return body, true
+}
+
+// List returns a task's comments
+func (h *CommentHandler) List(w http.ResponseWriter, r *http.Request) {
+	comments, err := h.commentService.List(requestEmail(r), mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Error listing comments: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"comments": comments,
+	})
+}
+
+// Create adds a comment to a task
+func (h *CommentHandler) Create(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+
+	body, ok := decodeCommentBody(w, r)
+	if !ok {
+		return
+	}
+
+	comment, err := h.commentService.Create(r.Context(), email, mux.Vars(r)["id"], email, body)
+	if err == errTaskNotFound {
+		writeError(w, http.StatusNotFound, "Task not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating comment: %v", err)
+		writeServerError(w, err, "Failed to save comment")
+		return
+	}
+
+	h.publish(email, "created", comment)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"comment": comment,
+	})
+}
+
+// Update edits a comment's body
+func (h *CommentHandler) Update(w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeCommentBody(w, r)
+	if !ok {
+		return
+	}
+
+	comment, err := h.commentService.Update(mux.Vars(r)["commentId"], body)
+	if err != nil {
+		log.Printf("Error updating comment: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to save comment")
+		return
+	}
+
+	h.publish(requestEmail(r), "updated", comment)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"comment": comment,
+	})
+}
+
+// Delete removes a comment
+func (h *CommentHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	comment, err := h.commentService.Get(mux.Vars(r)["commentId"])
+	if err != nil {
+		log.Printf("Error loading comment: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	if err := h.commentService.Delete(comment.ID); err != nil {
+		log.Printf("Error deleting comment: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	h.publish(requestEmail(r), "deleted", comment)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
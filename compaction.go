@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// foldLegacyUnassignedTasks moves tasks from the legacy UnassignedTasks array
+// into Tasks with a null ColumnID. It reports whether anything changed.
+func foldLegacyUnassignedTasks(data *KanbanData) bool {
+	if data.UnassignedTasks == nil {
+		return false
+	}
+
+	existing := make(map[string]bool)
+	for _, task := range data.Tasks {
+		existing[task.ID] = true
+	}
+
+	for _, task := range data.UnassignedTasks {
+		if existing[task.ID] {
+			continue
+		}
+		task.ColumnID = nil
+		data.Tasks = append(data.Tasks, task)
+		existing[task.ID] = true
+	}
+
+	data.UnassignedTasks = nil
+	return true
+}
+
+// errAlreadyCompact ends a compaction update that has nothing to rewrite,
+// so nothing is written
+var errAlreadyCompact = errors.New("board has no legacy data")
+
+// compactLegacy folds the legacy unassignedTasks array and migrates
+// free-form priorities. It reports whether anything changed.
+func compactLegacy(data *KanbanData) bool {
+	changed := foldLegacyUnassignedTasks(data)
+	if migrateTaskPriorities(data) {
+		changed = true
+	}
+	return changed
+}
+
+// CompactLegacyData rewrites stored boards that still carry the legacy
+// unassignedTasks array or free-form priorities. It returns the number of
+// boards rewritten; a board that fails to rewrite is logged and skipped.
+func (s *DataService) CompactLegacyData() (int, error) {
+	emails, err := s.legacyBoards()
+	if err != nil {
+		return 0, err
+	}
+
+	compacted := 0
+	for _, email := range emails {
+		rewritten, err := s.compactBoard(context.Background(), email)
+		if err != nil {
+			log.Printf("Error compacting legacy data for %s: %v", email, err)
+			continue
+		}
+		if rewritten {
+			compacted++
+		}
+	}
+	return compacted, nil
+}
+
+// legacyBoards returns the boards that carried legacy data when read. The
+// copies read are only a filter; compactBoard reads each board again.
+func (s *DataService) legacyBoards() ([]string, error) {
+	rows, err := s.db.Query("SELECT email, data FROM user_data")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user data: %w", err)
+	}
+	defer rows.Close()
+
+	var emails []string
+	for rows.Next() {
+		var email, dataStr string
+		if err := rows.Scan(&email, &dataStr); err != nil {
+			return nil, fmt.Errorf("failed to scan user data: %w", err)
+		}
+
+		data, err := s.codec.Decode(dataStr)
+		if err != nil {
+			log.Printf("Skipping compaction for %s: %v", email, err)
+			continue
+		}
+		if compactLegacy(data) {
+			emails = append(emails, email)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate user data: %w", err)
+	}
+	return emails, nil
+}
+
+// compactBoard rewrites a board's legacy data in one transaction, so writes
+// since legacyBoards read it are kept and locks are honored. It reports
+// whether the board needed rewriting.
+func (s *DataService) compactBoard(ctx context.Context, email string) (bool, error) {
+	_, err := s.UpdateUserData(ctx, email, func(data *KanbanData) error {
+		if !compactLegacy(data) {
+			return errAlreadyCompact
+		}
+		return nil
+	})
+	if err == errAlreadyCompact {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RunCompaction compacts legacy data once immediately and then on every
+// interval tick. It never returns, so callers start it in a goroutine.
+func (s *DataService) RunCompaction(interval time.Duration) {
+	compact := func() {
+		count, err := s.CompactLegacyData()
+		if err != nil {
+			log.Printf("Error compacting legacy data: %v", err)
+			return
+		}
+		if count > 0 {
+			log.Printf("Compacted legacy data for %d boards", count)
+		}
+	}
+
+	compact()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		compact()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCompactionKeepsConcurrentWrites(t *testing.T) {
+	s := newTestDataService(t)
+	ctx := context.Background()
+	email := "a@example.com"
+
+	legacy := testBoard()
+	legacy.Tasks[0].Priority = strPtr("HIGH")
+	legacy.UnassignedTasks = []Task{{ID: "t2", Title: "Triage"}}
+	if err := s.SaveUserData(ctx, email, legacy); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+
+	emails, err := s.legacyBoards()
+	if err != nil || len(emails) != 1 || emails[0] != email {
+		t.Fatalf("legacyBoards = %v, %v, want %s", emails, err, email)
+	}
+
+	// A sync lands between the scan and the rewrite
+	_, err = s.UpdateUserData(ctx, email, func(data *KanbanData) error {
+		data.Tasks = append(data.Tasks, Task{ID: "t3", Title: "Added meanwhile", ColumnID: strPtr("todo")})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateUserData: %v", err)
+	}
+
+	if rewritten, err := s.compactBoard(ctx, email); err != nil || !rewritten {
+		t.Fatalf("compactBoard = %v, %v, want a rewrite", rewritten, err)
+	}
+	data, err := s.GetUserData(ctx, email)
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	ids := make(map[string]bool)
+	for _, task := range data.Tasks {
+		ids[task.ID] = true
+	}
+	if !ids["t1"] || !ids["t2"] || !ids["t3"] || data.UnassignedTasks != nil {
+		t.Errorf("tasks = %+v, want t1, the folded t2 and the concurrent t3", data.Tasks)
+	}
+	if p := data.Tasks[0].Priority; p == nil || *p != "high" {
+		t.Errorf("t1 priority = %v, want high", p)
+	}
+
+	if count, err := s.CompactLegacyData(); err != nil || count != 0 {
+		t.Errorf("CompactLegacyData on a compact board = %d, %v, want 0", count, err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMarker prefixes stored boards that are zstd-compressed. The compressed
+// bytes are base64 encoded so they fit in a TEXT column on every dialect.
+// Uncompressed boards are plain JSON, which can never start with the marker.
+const zstdMarker = "zstd:"
+
+// BoardCodec converts boards to and from their stored representation,
+// optionally compressing and encrypting them
+type BoardCodec struct {
+	compress  bool
+	encoder   *zstd.Encoder
+	decoder   *zstd.Decoder
+	encryptor *Encryptor
+}
+
+// NewBoardCodec creates a codec for the given STORAGE_COMPRESSION mode
+// ("none" or "zstd"). Compressed boards can always be read, whatever the mode.
+// With an encryptor, boards are encrypted after compression; without one,
+// encrypted boards can't be read.
+func NewBoardCodec(mode string, encryptor *Encryptor) (*BoardCodec, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+
+	return &BoardCodec{
+		compress:  mode == "zstd",
+		encoder:   encoder,
+		decoder:   decoder,
+		encryptor: encryptor,
+	}, nil
+}
+
+// Encode marshals a board, compressing and encrypting it when enabled
+func (c *BoardCodec) Encode(data *KanbanData) (string, error) {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal user data: %w", err)
+	}
+
+	stored := string(dataJSON)
+	if c.compress {
+		compressed := c.encoder.EncodeAll(dataJSON, nil)
+		stored = zstdMarker + base64.StdEncoding.EncodeToString(compressed)
+	}
+
+	if c.encryptor != nil {
+		stored, err = c.encryptor.EncryptString(stored)
+		if err != nil {
+			return "", fmt.Errorf("failed to encrypt user data: %w", err)
+		}
+	}
+	return stored, nil
+}
+
+// Decode unmarshals a stored board in plain, compressed or encrypted form
+func (c *BoardCodec) Decode(stored string) (*KanbanData, error) {
+	if strings.HasPrefix(stored, encryptedMarker) {
+		if c.encryptor == nil {
+			return nil, errors.New("user data is encrypted but ENCRYPTION_KEY is not set")
+		}
+		var err error
+		stored, err = c.encryptor.DecryptString(stored)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt user data: %w", err)
+		}
+	}
+
+	dataJSON := []byte(stored)
+
+	if strings.HasPrefix(stored, zstdMarker) {
+		compressed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, zstdMarker))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode compressed user data: %w", err)
+		}
+		dataJSON, err = c.decoder.DecodeAll(compressed, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress user data: %w", err)
+		}
+	}
+
+	var data KanbanData
+	if err := json.Unmarshal(dataJSON, &data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal user data: %w", err)
+	}
+
+	return &data, nil
+}
@@ -2,8 +2,14 @@ package main
 
 import (
 	"bufio"
+	"fmt"
+	"net/mail"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // LoadEnv loads environment variables from a .env file
@@ -47,3 +53,576 @@ func LoadEnv(filename string) error {
 
 	return nil
 }
+
+// Config is the server's runtime configuration, read from the environment
+// once by LoadConfig and passed to the services that need it; nothing else
+// reads the environment. It stays in package main with the server because
+// its sections (DirectoryConfig, QuotaConfig, PubSubConfig and the rest) are
+// declared and validated next to the services they configure.
+type Config struct {
+	Port        string
+	DatabaseURL string
+	JWTSecret   string
+	SMTP        SMTPConfig
+
+	// Database connection pool, SQLite's wait for locks and the timeout of
+	// board reads and writes
+	DBPool DBPoolConfig
+
+	// Boards kept decoded in memory (0 disables the cache), and for how long
+	BoardCacheSize int
+	BoardCacheTTL  time.Duration
+
+	// Port of the gRPC API; empty to not serve it
+	GRPCPort string
+
+	// How sign-ins hand out sessions: "token" returns a Bearer token to the
+	// frontend, "cookie" sets an HttpOnly session cookie guarded by a CSRF
+	// token
+	AuthSession string
+
+	// Apply pending schema migrations at startup; when false the server
+	// refuses to start until "todo-app migrate up" has run
+	MigrateOnStart bool
+
+	// Production mode refuses to start with development defaults such as
+	// the default JWT secret
+	Production bool
+
+	// Full syncs of a board within this long of its last save are saved
+	// together with any others in that time
+	SyncCoalesceWindow time.Duration
+
+	// Comma-separated origins allowed by CORS and WebSocket upgrades ("*"
+	// allows any)
+	AllowedOrigins []string
+	AdminEmails    []string
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// How long shutdown waits for requests and WebSocket clients to drain
+	ShutdownTimeout time.Duration
+
+	UniqueColumnTitles      bool
+	ReconcileDefaultColumns bool
+	ReconcileColumnTitles   []string
+	CompactionInterval      time.Duration
+
+	// "none" or "zstd"; compression of stored board JSON
+	StorageCompression string
+
+	// At-rest encryption of boards and attachments
+	Encryption EncryptionConfig
+
+	JobWorkers            int
+	BackupWebhookInterval time.Duration
+
+	// Backups of the SQLite database
+	DBBackup DBBackupConfig
+
+	// How often done columns are checked for tasks to auto-archive
+	AutoArchiveInterval time.Duration
+
+	// Weekday (UTC) every board is snapshotted for the history API, or "off"
+	SnapshotWeekday string
+
+	// Instance branding for pages, emails and /api/config
+	Branding BrandingConfig
+
+	Attachments AttachmentConfig
+
+	// Two-way task sync with external services
+	GoogleTasks          OAuthClientConfig
+	MicrosoftTodo        OAuthClientConfig
+	MicrosoftTenant      string
+	ExternalSyncInterval time.Duration
+
+	// Passkey sign-in; disabled without an RP ID
+	WebAuthn WebAuthnConfig
+
+	// Slack app for notifications and the /todo command
+	Slack              OAuthClientConfig
+	SlackSigningSecret string
+
+	// Exports allowed per user per window, synchronous and background ones
+	// together (0 disables the limit), and how long finished background
+	// exports can be downloaded
+	ExportRateLimit  int
+	ExportRateWindow time.Duration
+	ExportRetention  time.Duration
+
+	// Requests (and WebSocket messages) allowed per client per window; 0
+	// disables rate limiting
+	RateLimitRequests int
+	RateLimitWindow   time.Duration
+
+	// Domain of per-user inbound email addresses; empty disables the
+	// inbound parse endpoint, which requires InboundEmailKey
+	InboundEmailDomain string
+	InboundEmailKey    string
+
+	// WebSocket connections allowed per user; a new one over the cap closes
+	// the longest idle. 0 removes the cap.
+	WSMaxConnectionsPerUser int
+
+	// Messages queued per WebSocket connection, and whether a connection
+	// whose queue fills is closed ("disconnect") or misses messages ("drop")
+	WSSendQueue        int
+	WSSlowClientPolicy SlowClientPolicy
+
+	// Shares WebSocket broadcasts and cache invalidations between instances
+	PubSub PubSubConfig
+
+	// Public WebSocket URL advertised to the frontend when it differs from
+	// the page's own host (e.g. behind a separate proxy)
+	WebSocketURL string
+
+	// Percentage of users each feature flag is rolled out to, for flags
+	// set in FEATURE_FLAGS
+	FeatureFlags map[string]int
+
+	// What each user may store
+	Quotas QuotaConfig
+
+	// Periodic cleanup of expired tokens, old tombstones and orphaned rows
+	Maintenance MaintenanceConfig
+
+	// Company directory deciding who may sign in
+	Directory DirectoryConfig
+}
+
+// defaultJWTSecret is used when JWT_SECRET is unset; only suitable for development
+const defaultJWTSecret = "your-default-secret-key-change-in-production"
+
+// LoadConfig reads the configuration from environment variables, applying
+// defaults and validating values. All problems are reported together.
+func LoadConfig() (*Config, error) {
+	var problems []string
+
+	duration := func(key string, fallback time.Duration) time.Duration {
+		raw := os.Getenv(key)
+		if raw == "" {
+			return fallback
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be a positive duration like 15s, got %q", key, raw))
+			return fallback
+		}
+		return d
+	}
+
+	integer := func(key string, fallback int) int {
+		raw := os.Getenv(key)
+		if raw == "" {
+			return fallback
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be a positive integer, got %q", key, raw))
+			return fallback
+		}
+		return n
+	}
+
+	count := func(key string, fallback int) int {
+		raw := os.Getenv(key)
+		if raw == "" {
+			return fallback
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			problems = append(problems, fmt.Sprintf("%s must be zero or a positive integer, got %q", key, raw))
+			return fallback
+		}
+		return n
+	}
+
+	boolean := func(key string) bool {
+		raw := os.Getenv(key)
+		if raw == "" {
+			return false
+		}
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s must be true or false, got %q", key, raw))
+		}
+		return b
+	}
+
+	cfg := &Config{
+		Port:        envOrDefault("PORT", "3001"),
+		GRPCPort:    os.Getenv("GRPC_PORT"),
+		DatabaseURL: os.Getenv("DATABASE_URL"),
+		JWTSecret:   envOrDefault("JWT_SECRET", defaultJWTSecret),
+		AuthSession: strings.ToLower(envOrDefault("AUTH_SESSION", "token")),
+		SMTP: SMTPConfig{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+			FromName: os.Getenv("SMTP_FROM_NAME"),
+			ReplyTo:  os.Getenv("SMTP_REPLY_TO"),
+
+			DKIMDomain:   strings.ToLower(os.Getenv("DKIM_DOMAIN")),
+			DKIMSelector: os.Getenv("DKIM_SELECTOR"),
+			DKIMKeyFile:  os.Getenv("DKIM_KEY_FILE"),
+		},
+		DBPool: DBPoolConfig{
+			MaxOpenConns:    integer("DB_MAX_OPEN_CONNS", 10),
+			MaxIdleConns:    integer("DB_MAX_IDLE_CONNS", 5),
+			ConnMaxIdleTime: duration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute),
+			BusyTimeout:     duration("DB_BUSY_TIMEOUT", 5*time.Second),
+			QueryTimeout:    duration("DB_QUERY_TIMEOUT", 10*time.Second),
+		},
+		BoardCacheSize: count("BOARD_CACHE_SIZE", defaultBoardCacheSize),
+		BoardCacheTTL:  duration("BOARD_CACHE_TTL", defaultBoardCacheTTL),
+
+		MigrateOnStart: os.Getenv("MIGRATE_ON_START") == "" || boolean("MIGRATE_ON_START"),
+		Production:     boolean("PROD"),
+		AllowedOrigins: splitList(envOrDefault("ALLOWED_ORIGINS", "*")),
+		AdminEmails:    splitList(os.Getenv("ADMIN_EMAILS")),
+
+		ReadTimeout:  duration("READ_TIMEOUT", 15*time.Second),
+		WriteTimeout: duration("WRITE_TIMEOUT", 15*time.Second),
+		IdleTimeout:  duration("IDLE_TIMEOUT", 60*time.Second),
+
+		ShutdownTimeout: duration("SHUTDOWN_TIMEOUT", 15*time.Second),
+
+		SyncCoalesceWindow: duration("SYNC_COALESCE_WINDOW", 50*time.Millisecond),
+
+		UniqueColumnTitles:      boolean("UNIQUE_COLUMN_TITLES"),
+		ReconcileDefaultColumns: boolean("RECONCILE_DEFAULT_COLUMNS"),
+		ReconcileColumnTitles:   splitList(os.Getenv("RECONCILE_COLUMN_TITLES")),
+		CompactionInterval:      duration("COMPACTION_INTERVAL", 24*time.Hour),
+
+		StorageCompression: envOrDefault("STORAGE_COMPRESSION", "none"),
+
+		Encryption: EncryptionConfig{
+			Key:          os.Getenv("ENCRYPTION_KEY"),
+			PreviousKeys: splitList(os.Getenv("ENCRYPTION_PREVIOUS_KEYS")),
+		},
+
+		JobWorkers:            integer("JOB_WORKERS", 4),
+		BackupWebhookInterval: duration("BACKUP_WEBHOOK_INTERVAL", 24*time.Hour),
+
+		DBBackup: DBBackupConfig{
+			Interval: duration("DB_BACKUP_INTERVAL", 0),
+			Storage:  envOrDefault("DB_BACKUP_STORAGE", "local"),
+			Dir:      envOrDefault("DB_BACKUP_DIR", "./backups"),
+			S3Prefix: envOrDefault("DB_BACKUP_S3_PREFIX", "db-backups/"),
+			Keep:     integer("DB_BACKUP_KEEP", 7),
+		},
+
+		AutoArchiveInterval: duration("AUTO_ARCHIVE_INTERVAL", time.Hour),
+
+		SnapshotWeekday: strings.ToLower(envOrDefault("SNAPSHOT_WEEKDAY", "monday")),
+
+		ExportRateLimit:  count("EXPORT_RATE_LIMIT", 10),
+		ExportRateWindow: duration("EXPORT_RATE_WINDOW", time.Hour),
+		ExportRetention:  duration("EXPORT_RETENTION", 24*time.Hour),
+
+		RateLimitRequests: count("RATE_LIMIT_REQUESTS", 600),
+		RateLimitWindow:   duration("RATE_LIMIT_WINDOW", time.Minute),
+
+		WebSocketURL:            os.Getenv("WS_URL"),
+		WSMaxConnectionsPerUser: count("WS_MAX_CONNECTIONS_PER_USER", 10),
+		WSSendQueue:             integer("WS_SEND_QUEUE", 256),
+		WSSlowClientPolicy:      SlowClientPolicy(envOrDefault("WS_SLOW_CLIENT_POLICY", string(SlowClientDisconnect))),
+
+		PubSub: PubSubConfig{
+			Backend:  strings.ToLower(envOrDefault("PUBSUB_BACKEND", "none")),
+			RedisURL: os.Getenv("REDIS_URL"),
+			Channel:  envOrDefault("PUBSUB_CHANNEL", "todo-app"),
+		},
+
+		Quotas: QuotaConfig{
+			BoardBytes:      int64(count("QUOTA_BOARD_BYTES", 10*1024*1024)),
+			Tasks:           int64(count("QUOTA_TASKS", 10000)),
+			AttachmentBytes: int64(count("QUOTA_ATTACHMENT_BYTES", 1024*1024*1024)),
+		},
+
+		Maintenance: MaintenanceConfig{
+			Interval:           duration("MAINTENANCE_INTERVAL", time.Hour),
+			TombstoneRetention: duration("TOMBSTONE_RETENTION", 30*24*time.Hour),
+		},
+
+		Directory: DirectoryConfig{
+			LDAPURL:            os.Getenv("LDAP_URL"),
+			LDAPBindDN:         os.Getenv("LDAP_BIND_DN"),
+			LDAPBindPassword:   os.Getenv("LDAP_BIND_PASSWORD"),
+			LDAPBaseDN:         os.Getenv("LDAP_BASE_DN"),
+			LDAPGroupDN:        os.Getenv("LDAP_GROUP_DN"),
+			LDAPEmailAttribute: envOrDefault("LDAP_EMAIL_ATTRIBUTE", "mail"),
+			LDAPGroupAttribute: envOrDefault("LDAP_GROUP_ATTRIBUTE", "memberOf"),
+			LDAPCacheTTL:       duration("LDAP_CACHE_TTL", 5*time.Minute),
+			SCIMToken:          os.Getenv("SCIM_TOKEN"),
+			SCIMRequired:       boolean("SCIM_REQUIRED"),
+		},
+
+		InboundEmailDomain: os.Getenv("INBOUND_EMAIL_DOMAIN"),
+		InboundEmailKey:    os.Getenv("INBOUND_EMAIL_KEY"),
+
+		Attachments: AttachmentConfig{
+			Storage:      envOrDefault("ATTACHMENT_STORAGE", "local"),
+			Dir:          envOrDefault("ATTACHMENT_DIR", "./attachments"),
+			MaxSize:      int64(integer("ATTACHMENT_MAX_SIZE", 10*1024*1024)),
+			AllowedTypes: splitList(os.Getenv("ATTACHMENT_ALLOWED_TYPES")),
+			S3: S3Config{
+				Endpoint:  os.Getenv("S3_ENDPOINT"),
+				Bucket:    os.Getenv("S3_BUCKET"),
+				Region:    os.Getenv("S3_REGION"),
+				AccessKey: os.Getenv("S3_ACCESS_KEY"),
+				SecretKey: os.Getenv("S3_SECRET_KEY"),
+				UseSSL:    os.Getenv("S3_USE_SSL") == "" || boolean("S3_USE_SSL"),
+			},
+		},
+
+		WebAuthn: WebAuthnConfig{
+			RPID:    os.Getenv("WEBAUTHN_RP_ID"),
+			Origins: splitList(os.Getenv("WEBAUTHN_ORIGINS")),
+		},
+
+		GoogleTasks: OAuthClientConfig{
+			ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
+			ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
+		},
+		MicrosoftTodo: OAuthClientConfig{
+			ClientID:     os.Getenv("MICROSOFT_CLIENT_ID"),
+			ClientSecret: os.Getenv("MICROSOFT_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("MICROSOFT_REDIRECT_URL"),
+		},
+		MicrosoftTenant:      envOrDefault("MICROSOFT_TENANT", "common"),
+		ExternalSyncInterval: duration("EXTERNAL_SYNC_INTERVAL", 15*time.Minute),
+
+		Slack: OAuthClientConfig{
+			ClientID:     os.Getenv("SLACK_CLIENT_ID"),
+			ClientSecret: os.Getenv("SLACK_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("SLACK_REDIRECT_URL"),
+		},
+		SlackSigningSecret: os.Getenv("SLACK_SIGNING_SECRET"),
+
+		Branding: BrandingConfig{
+			AppName:      envOrDefault("BRAND_APP_NAME", defaultAppName),
+			AccentColor:  envOrDefault("BRAND_ACCENT_COLOR", defaultAccentColor),
+			SupportEmail: os.Getenv("BRAND_SUPPORT_EMAIL"),
+			LogoURL:      os.Getenv("BRAND_LOGO_URL"),
+		},
+	}
+
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("PORT must be a number between 1 and 65535, got %q", cfg.Port))
+	}
+	if cfg.GRPCPort != "" {
+		if port, err := strconv.Atoi(cfg.GRPCPort); err != nil || port < 1 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("GRPC_PORT must be a number between 1 and 65535, got %q", cfg.GRPCPort))
+		} else if cfg.GRPCPort == cfg.Port {
+			problems = append(problems, "GRPC_PORT must differ from PORT")
+		}
+	}
+
+	if cfg.Production {
+		if cfg.JWTSecret == defaultJWTSecret {
+			problems = append(problems, "JWT_SECRET must be set to a random secret when PROD=true")
+		}
+		if slices.Contains(cfg.AllowedOrigins, "*") {
+			problems = append(problems, "ALLOWED_ORIGINS must list the allowed origins when PROD=true, not *")
+		}
+		if cfg.SMTP.Host == "" {
+			problems = append(problems, "SMTP_HOST must be set when PROD=true, so sign-in links are emailed")
+		}
+	}
+
+	if cfg.SMTP.Host != "" && cfg.SMTP.Port == "" {
+		problems = append(problems, "SMTP_PORT is required when SMTP_HOST is set")
+	}
+	// Port 465 is for implicit TLS; 587 and 25 upgrade with STARTTLS
+	defaultSMTPTLS := SMTPTLSStartTLS
+	if cfg.SMTP.Port == "465" {
+		defaultSMTPTLS = SMTPTLSImplicit
+	}
+	cfg.SMTP.TLS = strings.ToLower(envOrDefault("SMTP_TLS", defaultSMTPTLS))
+	switch cfg.SMTP.TLS {
+	case SMTPTLSStartTLS, SMTPTLSImplicit, SMTPTLSNone:
+	default:
+		problems = append(problems, fmt.Sprintf("SMTP_TLS must be starttls, tls or none, got %q", cfg.SMTP.TLS))
+	}
+	if cfg.SMTP.ReplyTo != "" {
+		if _, err := mail.ParseAddress(cfg.SMTP.ReplyTo); err != nil {
+			problems = append(problems, fmt.Sprintf("SMTP_REPLY_TO must be an email address, got %q", cfg.SMTP.ReplyTo))
+		}
+	}
+	if cfg.SMTP.DKIMDomain != "" || cfg.SMTP.DKIMSelector != "" || cfg.SMTP.DKIMKeyFile != "" {
+		if cfg.SMTP.DKIMDomain == "" || cfg.SMTP.DKIMSelector == "" || cfg.SMTP.DKIMKeyFile == "" {
+			problems = append(problems, "DKIM_DOMAIN, DKIM_SELECTOR and DKIM_KEY_FILE must be set together")
+		} else if _, err := LoadDKIMSigner(cfg.SMTP.DKIMDomain, cfg.SMTP.DKIMSelector, cfg.SMTP.DKIMKeyFile); err != nil {
+			problems = append(problems, fmt.Sprintf("DKIM_KEY_FILE %v", err))
+		}
+
+		// Receivers only trust signatures aligned with the sender's domain
+		from := cfg.SMTP.From
+		if from == "" {
+			from = cfg.SMTP.Username
+		}
+		if addr, err := mail.ParseAddress(from); err == nil && cfg.SMTP.DKIMDomain != "" {
+			domain := strings.ToLower(addr.Address[strings.LastIndex(addr.Address, "@")+1:])
+			if domain != cfg.SMTP.DKIMDomain && !strings.HasSuffix(domain, "."+cfg.SMTP.DKIMDomain) {
+				problems = append(problems, fmt.Sprintf("DKIM_DOMAIN must be the domain of SMTP_FROM or a parent of it, got %q for %q", cfg.SMTP.DKIMDomain, addr.Address))
+			}
+		}
+	}
+
+	if cfg.InboundEmailDomain != "" && cfg.InboundEmailKey == "" {
+		problems = append(problems, "INBOUND_EMAIL_KEY is required when INBOUND_EMAIL_DOMAIN is set")
+	}
+
+	if _, ok := weekdays[cfg.SnapshotWeekday]; !ok && cfg.SnapshotWeekday != "off" {
+		problems = append(problems, fmt.Sprintf("SNAPSHOT_WEEKDAY must be a day of the week or off, got %q", cfg.SnapshotWeekday))
+	}
+
+	if cfg.StorageCompression != "none" && cfg.StorageCompression != "zstd" {
+		problems = append(problems, fmt.Sprintf("STORAGE_COMPRESSION must be none or zstd, got %q", cfg.StorageCompression))
+	}
+
+	if cfg.Encryption.Enabled() {
+		if _, err := decodeEncryptionKey(cfg.Encryption.Key); err != nil {
+			problems = append(problems, fmt.Sprintf("ENCRYPTION_KEY %v", err))
+		}
+		for _, key := range cfg.Encryption.PreviousKeys {
+			if _, err := decodeEncryptionKey(key); err != nil {
+				problems = append(problems, fmt.Sprintf("ENCRYPTION_PREVIOUS_KEYS %v", err))
+			}
+		}
+	} else if len(cfg.Encryption.PreviousKeys) > 0 {
+		problems = append(problems, "ENCRYPTION_KEY is required when ENCRYPTION_PREVIOUS_KEYS is set")
+	}
+
+	if !hexColorPattern.MatchString(cfg.Branding.AccentColor) {
+		problems = append(problems, fmt.Sprintf("BRAND_ACCENT_COLOR must be a hex color like #4a6fa5, got %q", cfg.Branding.AccentColor))
+	}
+
+	switch cfg.Attachments.Storage {
+	case "local":
+	case "s3":
+		s3 := cfg.Attachments.S3
+		if s3.Endpoint == "" || s3.Bucket == "" || s3.AccessKey == "" || s3.SecretKey == "" {
+			problems = append(problems, "S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required when ATTACHMENT_STORAGE=s3")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("ATTACHMENT_STORAGE must be local or s3, got %q", cfg.Attachments.Storage))
+	}
+
+	if cfg.WSSlowClientPolicy != SlowClientDisconnect && cfg.WSSlowClientPolicy != SlowClientDrop {
+		problems = append(problems, fmt.Sprintf("WS_SLOW_CLIENT_POLICY must be disconnect or drop, got %q", cfg.WSSlowClientPolicy))
+	}
+
+	if rollouts, err := parseFlagRollouts(os.Getenv("FEATURE_FLAGS")); err != nil {
+		problems = append(problems, fmt.Sprintf("FEATURE_FLAGS %v", err))
+	} else {
+		cfg.FeatureFlags = rollouts
+	}
+
+	if cfg.AuthSession != "token" && cfg.AuthSession != "cookie" {
+		problems = append(problems, fmt.Sprintf("AUTH_SESSION must be token or cookie, got %q", cfg.AuthSession))
+	}
+
+	switch cfg.PubSub.Backend {
+	case "none":
+	case "redis":
+		if cfg.PubSub.RedisURL == "" {
+			problems = append(problems, "REDIS_URL is required when PUBSUB_BACKEND=redis")
+		} else if _, err := parseRedisURL(cfg.PubSub.RedisURL); err != nil {
+			problems = append(problems, fmt.Sprintf("REDIS_URL %v", err))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("PUBSUB_BACKEND must be none or redis, got %q", cfg.PubSub.Backend))
+	}
+
+	switch cfg.DBBackup.Storage {
+	case "local":
+	case "s3":
+		s3 := cfg.Attachments.S3
+		if s3.Endpoint == "" || s3.Bucket == "" || s3.AccessKey == "" || s3.SecretKey == "" {
+			problems = append(problems, "S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required when DB_BACKUP_STORAGE=s3")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("DB_BACKUP_STORAGE must be local or s3, got %q", cfg.DBBackup.Storage))
+	}
+	if dialect, _ := parseDatabaseURL(cfg.DatabaseURL); dialect != DialectSQLite && cfg.DBBackup.Interval > 0 {
+		problems = append(problems, "DB_BACKUP_INTERVAL only applies to SQLite; back up Postgres with its own tools")
+	}
+
+	if cfg.Directory.LDAPEnabled() {
+		if _, err := parseLDAPURL(cfg.Directory.LDAPURL); err != nil {
+			problems = append(problems, fmt.Sprintf("LDAP_URL %v", err))
+		}
+		if cfg.Directory.LDAPBaseDN == "" || cfg.Directory.LDAPGroupDN == "" {
+			problems = append(problems, "LDAP_BASE_DN and LDAP_GROUP_DN are required when LDAP_URL is set")
+		}
+	}
+	if cfg.Directory.LDAPBindPassword != "" && cfg.Directory.LDAPBindDN == "" {
+		problems = append(problems, "LDAP_BIND_DN is required when LDAP_BIND_PASSWORD is set")
+	}
+	if cfg.Directory.SCIMRequired && !cfg.Directory.SCIMEnabled() {
+		problems = append(problems, "SCIM_TOKEN is required when SCIM_REQUIRED is set")
+	}
+
+	if cfg.GoogleTasks.Enabled() && (cfg.GoogleTasks.ClientSecret == "" || cfg.GoogleTasks.RedirectURL == "") {
+		problems = append(problems, "GOOGLE_CLIENT_SECRET and GOOGLE_REDIRECT_URL are required when GOOGLE_CLIENT_ID is set")
+	}
+
+	if cfg.MicrosoftTodo.Enabled() && (cfg.MicrosoftTodo.ClientSecret == "" || cfg.MicrosoftTodo.RedirectURL == "") {
+		problems = append(problems, "MICROSOFT_CLIENT_SECRET and MICROSOFT_REDIRECT_URL are required when MICROSOFT_CLIENT_ID is set")
+	}
+
+	if cfg.Slack.Enabled() && (cfg.Slack.ClientSecret == "" || cfg.Slack.RedirectURL == "" || cfg.SlackSigningSecret == "") {
+		problems = append(problems, "SLACK_CLIENT_SECRET, SLACK_REDIRECT_URL and SLACK_SIGNING_SECRET are required when SLACK_CLIENT_ID is set")
+	}
+
+	// Passkeys default to the HTTPS site at the RP ID
+	if cfg.WebAuthn.Enabled() && len(cfg.WebAuthn.Origins) == 0 {
+		cfg.WebAuthn.Origins = []string{"https://" + cfg.WebAuthn.RPID}
+	}
+	for _, origin := range cfg.WebAuthn.Origins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("WEBAUTHN_ORIGINS must list origins like https://todo.example.com, got %q", origin))
+		}
+	}
+
+	if len(cfg.Attachments.AllowedTypes) == 0 {
+		cfg.Attachments.AllowedTypes = defaultAttachmentTypes
+	}
+
+	if len(cfg.ReconcileColumnTitles) == 0 {
+		cfg.ReconcileColumnTitles = defaultColumnTitles
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	return cfg, nil
+}
+
+// envOrDefault returns the environment variable or fallback when unset
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// splitList splits a comma-separated value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigProductionRequiresSMTP(t *testing.T) {
+	t.Setenv("PROD", "true")
+	t.Setenv("JWT_SECRET", "a-random-secret")
+	t.Setenv("ALLOWED_ORIGINS", "https://todo.example.com")
+	t.Setenv("SMTP_HOST", "")
+
+	_, err := LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "SMTP_HOST must be set when PROD=true") {
+		t.Fatalf("LoadConfig without SMTP_HOST: %v, want SMTP_HOST required", err)
+	}
+
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_PORT", "587")
+	if _, err := LoadConfig(); err != nil {
+		t.Errorf("LoadConfig with SMTP: %v", err)
+	}
+}
@@ -0,0 +1,804 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Experimental CRDT sync engine, dark launched behind the crdt_sync flag.
+//
+// A BoardDoc holds a board as a state-based CRDT. Tasks, columns and
+// swimlanes form LWW-element-sets: each item has an add and a remove stamp
+// and is live while its latest add is newer than its latest remove.
+// Removed items are kept, and come out as deleted like the board's own
+// soft deletes. An item's fields are last-writer-wins registers, grouped
+// where they have to change together: a task's column, swimlane and
+// position are one register, so of two concurrent moves of a task one
+// wins whole, rather than leaving the task in one move's column at the
+// other's position.
+//
+// Task order is a sequence CRDT over fractional position keys. A moved
+// task takes a key just after the task it was dropped behind, so moves of
+// different tasks interleave instead of one replica's whole order
+// replacing another's.
+//
+// Stamps are hybrid logical clocks: wall-clock milliseconds, bumped past
+// any stamp the document has seen, with the replica ID breaking ties, so
+// every replica orders every pair of writes the same way. Merge is
+// commutative, associative and idempotent, so replicas that have merged
+// the same writes hold the same board, in whatever order the writes
+// arrived; crdt_test.go checks this.
+
+// crdtStamp orders writes to a register
+type crdtStamp struct {
+	Time    int64  `json:"t"`
+	Replica string `json:"r,omitempty"`
+}
+
+func (s crdtStamp) after(o crdtStamp) bool {
+	if s.Time != o.Time {
+		return s.Time > o.Time
+	}
+	return s.Replica > o.Replica
+}
+
+// crdtRegister is a last-writer-wins register holding a JSON value
+type crdtRegister struct {
+	Value json.RawMessage `json:"v"`
+	Stamp crdtStamp       `json:"s"`
+}
+
+// crdtElement is a task, column or swimlane: its membership in the
+// board's LWW-element-set and its field registers, by group
+type crdtElement struct {
+	Added   crdtStamp               `json:"a"`
+	Removed crdtStamp               `json:"d"`
+	Fields  map[string]crdtRegister `json:"f"`
+}
+
+func (e *crdtElement) live() bool {
+	return e.Added.after(e.Removed)
+}
+
+// crdtGroups puts fields that change together in one register. Other
+// fields have a register each, named after the field.
+var crdtGroups = map[string]string{
+	"columnId":    crdtPlacement,
+	"swimlaneId":  crdtPlacement,
+	"completed":   "completion",
+	"completedAt": "completion",
+}
+
+// crdtPlacement is the register holding a task's column, swimlane and
+// position key
+const crdtPlacement = "placement"
+
+// crdtNull is the value of a register for a field the item doesn't have
+var crdtNull = json.RawMessage("null")
+
+// BoardDoc is a board as a CRDT
+type BoardDoc struct {
+	// The latest stamp time written or merged
+	Clock     int64                   `json:"clock"`
+	Tasks     map[string]*crdtElement `json:"tasks"`
+	Columns   map[string]*crdtElement `json:"columns"`
+	Swimlanes map[string]*crdtElement `json:"swimlanes"`
+	// The board's unassignedCollapsed setting
+	Collapsed crdtRegister `json:"collapsed"`
+}
+
+func newBoardDoc() *BoardDoc {
+	return &BoardDoc{
+		Tasks:     make(map[string]*crdtElement),
+		Columns:   make(map[string]*crdtElement),
+		Swimlanes: make(map[string]*crdtElement),
+		Collapsed: crdtRegister{Value: json.RawMessage("false")},
+	}
+}
+
+// NewBoardDoc converts a board into a document, as written by one replica
+func NewBoardDoc(board *KanbanData, replica string, now time.Time) (*BoardDoc, error) {
+	doc := newBoardDoc()
+	if err := doc.Observe(replica, board, nil, now, false); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// tick returns a stamp for a replica's writes, later than every stamp the
+// document holds
+func (d *BoardDoc) tick(replica string, now time.Time) crdtStamp {
+	t := now.UnixMilli()
+	if t <= d.Clock {
+		t = d.Clock + 1
+	}
+	d.Clock = t
+	return crdtStamp{Time: t, Replica: replica}
+}
+
+// crdtItem is one task, column or swimlane of a board, split into register
+// values
+type crdtItem struct {
+	id      string
+	deleted bool
+	fields  map[string]json.RawMessage
+}
+
+// crdtFields splits an item's JSON fields into register values. The id
+// and deleted fields are left out; they're the element's key and
+// membership.
+func crdtFields(item any) (map[string]json.RawMessage, error) {
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "id")
+	delete(fields, "deleted")
+
+	values := make(map[string]json.RawMessage, len(fields))
+	grouped := make(map[string]map[string]json.RawMessage)
+	for name, value := range fields {
+		group, ok := crdtGroups[name]
+		if !ok {
+			values[name] = value
+			continue
+		}
+		if grouped[group] == nil {
+			grouped[group] = make(map[string]json.RawMessage)
+		}
+		grouped[group][name] = value
+	}
+	for group, members := range grouped {
+		if values[group], err = json.Marshal(members); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// crdtItems splits a board into its tasks, columns and swimlanes. Tasks
+// still in the legacy unassignedTasks array join the end of the tasks
+// with no column, and empty column IDs mean no column, as in
+// mergeKanbanData.
+func crdtItems(board *KanbanData) (tasks, columns, swimlanes []crdtItem, err error) {
+	seen := make(map[string]bool)
+	addTask := func(task Task, unassigned bool) error {
+		if seen[task.ID] {
+			return nil
+		}
+		seen[task.ID] = true
+		if unassigned || (task.ColumnID != nil && (*task.ColumnID == "" || *task.ColumnID == "unassigned")) {
+			task.ColumnID = nil
+		}
+		fields, err := crdtFields(task)
+		if err != nil {
+			return err
+		}
+		tasks = append(tasks, crdtItem{id: task.ID, deleted: task.Deleted, fields: fields})
+		return nil
+	}
+	for _, task := range board.Tasks {
+		if err := addTask(task, false); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	for _, task := range board.UnassignedTasks {
+		if err := addTask(task, true); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	for _, col := range board.Columns {
+		fields, err := crdtFields(col)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		columns = append(columns, crdtItem{id: col.ID, deleted: col.Deleted, fields: fields})
+	}
+	for _, lane := range board.Swimlanes {
+		fields, err := crdtFields(lane)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		swimlanes = append(swimlanes, crdtItem{id: lane.ID, deleted: lane.Deleted, fields: fields})
+	}
+	return tasks, columns, swimlanes, nil
+}
+
+// crdtBase is what a replica last had of a board: a hash of each register
+// value and of each item's membership, and each task's index in board
+// order. Observe compares a replica's board with it to tell the replica's
+// own changes from others' that it missed.
+type crdtBase struct {
+	Hashes map[string]uint64 `json:"hashes"`
+	Ranks  map[string]int    `json:"ranks"`
+}
+
+func crdtHash(value []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(value)
+	return h.Sum64()
+}
+
+func crdtKey(kind, id, group string) string {
+	return kind + "/" + id + "/" + group
+}
+
+// placementWhere is a task's column and swimlane from its placement
+// register, without the position key
+func placementWhere(value json.RawMessage) json.RawMessage {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(value, &members); err != nil {
+		return value
+	}
+	delete(members, "position")
+	where, err := json.Marshal(members)
+	if err != nil {
+		return value
+	}
+	return where
+}
+
+// membershipValue is how an item's membership is hashed in a base
+func membershipValue(deleted bool) []byte {
+	if deleted {
+		return []byte("deleted")
+	}
+	return []byte("live")
+}
+
+// crdtBaseOf records a board as a replica has it
+func crdtBaseOf(board *KanbanData) (*crdtBase, error) {
+	tasks, columns, swimlanes, err := crdtItems(board)
+	if err != nil {
+		return nil, err
+	}
+	base := &crdtBase{Hashes: make(map[string]uint64), Ranks: make(map[string]int, len(tasks))}
+	for kind, items := range map[string][]crdtItem{"task": tasks, "column": columns, "swimlane": swimlanes} {
+		for _, item := range items {
+			base.Hashes[crdtKey(kind, item.id, "")] = crdtHash(membershipValue(item.deleted))
+			for group, value := range item.fields {
+				base.Hashes[crdtKey(kind, item.id, group)] = crdtHash(value)
+			}
+		}
+	}
+	for i, task := range tasks {
+		base.Ranks[task.id] = i
+	}
+	base.Hashes[crdtKey("board", "", "unassignedCollapsed")] = crdtHash(crdtBool(board.UnassignedCollapsed))
+	return base, nil
+}
+
+func crdtBool(b bool) json.RawMessage {
+	if b {
+		return json.RawMessage("true")
+	}
+	return json.RawMessage("false")
+}
+
+// Observe records what a replica changed on a board since base, the board
+// as the replica last had it, as writes stamped now. Values the replica
+// still has as they were in base aren't written, so a replica that missed
+// others' changes doesn't undo them. A nil base compares with the document
+// instead, taking the whole board as the replica's writes. Items missing
+// from the board are left alone unless removeMissing is set, for a replica
+// whose board is the whole truth.
+func (d *BoardDoc) Observe(replica string, board *KanbanData, base *crdtBase, now time.Time, removeMissing bool) error {
+	tasks, columns, swimlanes, err := crdtItems(board)
+	if err != nil {
+		return err
+	}
+	stamp := d.tick(replica, now)
+
+	// Placement is observed separately, with the order of the tasks
+	d.observeItems("task", d.Tasks, tasks, base, stamp, removeMissing)
+	d.observeItems("column", d.Columns, columns, base, stamp, removeMissing)
+	d.observeItems("swimlane", d.Swimlanes, swimlanes, base, stamp, removeMissing)
+	d.observeOrder(tasks, base, stamp)
+
+	collapsed := crdtBool(board.UnassignedCollapsed)
+	if !base.unchanged(crdtKey("board", "", "unassignedCollapsed"), collapsed) && !bytes.Equal(d.Collapsed.Value, collapsed) {
+		d.Collapsed = crdtRegister{Value: collapsed, Stamp: stamp}
+	}
+	return nil
+}
+
+// unchanged reports whether a replica still has a value as it was in base
+func (b *crdtBase) unchanged(key string, value []byte) bool {
+	if b == nil {
+		return false
+	}
+	hash, ok := b.Hashes[key]
+	return ok && hash == crdtHash(value)
+}
+
+func (d *BoardDoc) observeItems(kind string, elements map[string]*crdtElement, items []crdtItem, base *crdtBase, stamp crdtStamp, removeMissing bool) {
+	present := make(map[string]bool, len(items))
+	for _, item := range items {
+		present[item.id] = true
+		el := elements[item.id]
+		added := el == nil
+		if added {
+			el = &crdtElement{Fields: make(map[string]crdtRegister)}
+			elements[item.id] = el
+			if item.deleted {
+				el.Removed = stamp
+			} else {
+				el.Added = stamp
+			}
+		}
+
+		// Membership
+		if !added && !base.unchanged(crdtKey(kind, item.id, ""), membershipValue(item.deleted)) {
+			if item.deleted && el.live() {
+				el.Removed = stamp
+			} else if !item.deleted && !el.live() {
+				el.Added = stamp
+			}
+		}
+
+		// Fields, including those the item no longer has
+		groups := make(map[string]bool, len(item.fields))
+		for group := range item.fields {
+			groups[group] = true
+		}
+		for group := range el.Fields {
+			groups[group] = true
+		}
+		for group := range groups {
+			if kind == "task" && group == crdtPlacement {
+				continue
+			}
+			value, ok := item.fields[group]
+			if !ok {
+				value = crdtNull
+			}
+			if !added && base.unchanged(crdtKey(kind, item.id, group), value) {
+				continue
+			}
+			current, ok := el.Fields[group]
+			if !ok {
+				current.Value = crdtNull
+			}
+			if !bytes.Equal(current.Value, value) {
+				el.Fields[group] = crdtRegister{Value: value, Stamp: stamp}
+			}
+		}
+	}
+
+	if removeMissing {
+		for id, el := range elements {
+			if !present[id] && el.live() {
+				el.Removed = stamp
+			}
+		}
+	}
+}
+
+// taskPosition is a task's position key, or "" if it has none
+func (d *BoardDoc) taskPosition(id string) string {
+	el := d.Tasks[id]
+	if el == nil {
+		return ""
+	}
+	var placement struct {
+		Position string `json:"position"`
+	}
+	json.Unmarshal(el.Fields[crdtPlacement].Value, &placement)
+	return placement.Position
+}
+
+// orderedTaskIDs lists every task, live or not, in position order
+func (d *BoardDoc) orderedTaskIDs() []string {
+	ids := make([]string, 0, len(d.Tasks))
+	positions := make(map[string]string, len(d.Tasks))
+	for id := range d.Tasks {
+		ids = append(ids, id)
+		positions[id] = d.taskPosition(id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if positions[ids[i]] != positions[ids[j]] {
+			return positions[ids[i]] < positions[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// observeOrder records the tasks a replica moved: those whose column or
+// swimlane changed, and, within each column, those outside the longest run
+// still in their base order. Each moved task gets a position key just
+// after the task before it in the replica's column, or just before the
+// first unmoved one when it leads the column.
+func (d *BoardDoc) observeOrder(tasks []crdtItem, base *crdtBase, stamp crdtStamp) {
+	var ranks map[string]int
+	if base != nil {
+		ranks = base.Ranks
+	} else {
+		ranks = make(map[string]int, len(d.Tasks))
+		for i, id := range d.orderedTaskIDs() {
+			ranks[id] = i
+		}
+	}
+
+	// Each column's tasks in the replica's order
+	var columnOrder []string
+	columnTasks := make(map[string][]crdtItem)
+	for _, task := range tasks {
+		var placement struct {
+			ColumnID *string `json:"columnId"`
+		}
+		json.Unmarshal(task.fields[crdtPlacement], &placement)
+		column := ""
+		if placement.ColumnID != nil {
+			column = *placement.ColumnID
+		}
+		if _, ok := columnTasks[column]; !ok {
+			columnOrder = append(columnOrder, column)
+		}
+		columnTasks[column] = append(columnTasks[column], task)
+	}
+
+	positions := newPositionIndex(d)
+	for _, column := range columnOrder {
+		items := columnTasks[column]
+
+		// Tasks that may keep their position: placed before, in the same
+		// column and swimlane, with a rank to keep them in order by
+		var candidates []int
+		for i, task := range items {
+			where := placementWhere(task.fields[crdtPlacement])
+			current, placed := d.Tasks[task.id].Fields[crdtPlacement]
+			if !placed {
+				continue
+			}
+			if _, ranked := ranks[task.id]; !ranked {
+				continue
+			}
+			if base != nil && base.unchanged(crdtKey("task", task.id, crdtPlacement), where) {
+				candidates = append(candidates, i)
+			} else if base == nil && bytes.Equal(placementWhere(current.Value), where) {
+				candidates = append(candidates, i)
+			}
+		}
+		kept := make(map[int]bool)
+		for _, i := range longestIncreasingRun(candidates, func(i int) int { return ranks[items[i].id] }) {
+			kept[i] = true
+		}
+
+		// Runs of moved tasks go after the unmoved task before them, or
+		// before the first unmoved one
+		for start := 0; start < len(items); {
+			if kept[start] {
+				start++
+				continue
+			}
+			end := start
+			for end < len(items) && !kept[end] {
+				end++
+			}
+			var keys []string
+			switch {
+			case start > 0:
+				keys = positions.after(d.taskPosition(items[start-1].id), end-start)
+			case end < len(items):
+				keys = positions.before(d.taskPosition(items[end].id), end-start)
+			default:
+				keys = positions.after(positions.last(), end-start)
+			}
+
+			for i, key := range keys {
+				task := items[start+i]
+				var members map[string]json.RawMessage
+				json.Unmarshal(task.fields[crdtPlacement], &members)
+				members["position"], _ = json.Marshal(key)
+				value, _ := json.Marshal(members)
+				positions.move(d.taskPosition(task.id), key)
+				d.Tasks[task.id].Fields[crdtPlacement] = crdtRegister{Value: value, Stamp: stamp}
+			}
+			start = end
+		}
+	}
+}
+
+// longestIncreasingRun returns the longest subsequence of items whose
+// ranks increase, in O(n log n)
+func longestIncreasingRun(items []int, rank func(int) int) []int {
+	// tails[k] is the index into items of the smallest last item of an
+	// increasing run of length k+1
+	var tails []int
+	prev := make([]int, len(items))
+	for i, item := range items {
+		r := rank(item)
+		k := sort.Search(len(tails), func(k int) bool { return rank(items[tails[k]]) >= r })
+		if k > 0 {
+			prev[i] = tails[k-1]
+		} else {
+			prev[i] = -1
+		}
+		if k == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[k] = i
+		}
+	}
+
+	run := make([]int, len(tails))
+	i := -1
+	if len(tails) > 0 {
+		i = tails[len(tails)-1]
+	}
+	for k := len(tails) - 1; k >= 0; k-- {
+		run[k] = items[i]
+		i = prev[i]
+	}
+	return run
+}
+
+// positionIndex is the sorted position keys of a document's tasks, for
+// finding the gaps next to a key
+type positionIndex struct {
+	keys []string
+}
+
+func newPositionIndex(d *BoardDoc) *positionIndex {
+	index := &positionIndex{}
+	for id := range d.Tasks {
+		if key := d.taskPosition(id); key != "" {
+			index.keys = append(index.keys, key)
+		}
+	}
+	sort.Strings(index.keys)
+	return index
+}
+
+func (p *positionIndex) last() string {
+	if len(p.keys) == 0 {
+		return ""
+	}
+	return p.keys[len(p.keys)-1]
+}
+
+// after returns n keys between key and the next larger one, the first
+// close to key to leave room for more after it
+func (p *positionIndex) after(key string, n int) []string {
+	i := sort.SearchStrings(p.keys, key)
+	for i < len(p.keys) && p.keys[i] <= key {
+		i++
+	}
+	next := ""
+	if i < len(p.keys) {
+		next = p.keys[i]
+	}
+	return spreadKeys(key, next, n, keyLow)
+}
+
+// before returns n keys between the next smaller key and key, the last
+// close to key to leave room for more before it
+func (p *positionIndex) before(key string, n int) []string {
+	i := sort.SearchStrings(p.keys, key)
+	prev := ""
+	if i > 0 {
+		prev = p.keys[i-1]
+	}
+	return spreadKeys(prev, key, n, keyHigh)
+}
+
+// move replaces a task's old key, if it had one, with its new one
+func (p *positionIndex) move(old, key string) {
+	if old != "" {
+		if i := sort.SearchStrings(p.keys, old); i < len(p.keys) && p.keys[i] == old {
+			p.keys = append(p.keys[:i], p.keys[i+1:]...)
+		}
+	}
+	i := sort.SearchStrings(p.keys, key)
+	p.keys = append(p.keys, "")
+	copy(p.keys[i+1:], p.keys[i:])
+	p.keys[i] = key
+}
+
+// positionDigits are the digits of position keys, in sort order
+const positionDigits = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// Where in a gap a single key goes
+const (
+	keyMiddle = iota
+	keyLow
+	keyHigh
+)
+
+// spreadKeys returns n keys between a and b, evenly spread so they stay
+// short. A single key goes where bias puts it.
+func spreadKeys(a, b string, n, bias int) []string {
+	if n <= 0 {
+		return nil
+	}
+	if n == 1 {
+		return []string{keyIn(a, b, bias)}
+	}
+	mid := keyBetween(a, b)
+	left := spreadKeys(a, mid, (n-1)/2, keyMiddle)
+	right := spreadKeys(mid, b, n-1-(n-1)/2, keyMiddle)
+	return append(append(left, mid), right...)
+}
+
+// keyBetween returns the position key halfway between a and b
+func keyBetween(a, b string) string {
+	return keyIn(a, b, keyMiddle)
+}
+
+// keyIn returns a position key sorting after a and before b; an empty a
+// is the start and an empty b the end. bias picks the middle of the gap,
+// or the end next to a (keyLow) or b (keyHigh), which keeps keys short
+// when tasks are added one after another at the same place. Keys never
+// end in the lowest digit, so there's always room between two of them.
+// When a isn't below b (another replica's concurrent move can leave
+// neighbours out of order), the key goes just after a.
+func keyIn(a, b string, bias int) string {
+	if b != "" && a >= b {
+		b = ""
+	}
+	var key strings.Builder
+	onA, onB := true, b != ""
+	for i := 0; ; i++ {
+		lo, hi := 0, len(positionDigits)
+		if onA && i < len(a) {
+			lo = strings.IndexByte(positionDigits, a[i])
+		}
+		if onB && i < len(b) {
+			hi = strings.IndexByte(positionDigits, b[i])
+		}
+		if hi-lo > 1 {
+			digit := (lo + hi) / 2
+			if bias == keyLow {
+				digit = lo + 1
+			} else if bias == keyHigh {
+				digit = hi - 1
+			}
+			key.WriteByte(positionDigits[digit])
+			return key.String()
+		}
+		key.WriteByte(positionDigits[lo])
+		if hi-lo == 1 {
+			onB = false
+		}
+		if i >= len(a) {
+			onA = false
+		}
+	}
+}
+
+// Merge folds another replica's document into this one
+func (d *BoardDoc) Merge(other *BoardDoc) {
+	if other.Clock > d.Clock {
+		d.Clock = other.Clock
+	}
+	mergeElements(d.Tasks, other.Tasks)
+	mergeElements(d.Columns, other.Columns)
+	mergeElements(d.Swimlanes, other.Swimlanes)
+	if other.Collapsed.Stamp.after(d.Collapsed.Stamp) {
+		d.Collapsed = other.Collapsed
+	}
+}
+
+func mergeElements(into, from map[string]*crdtElement) {
+	for id, theirs := range from {
+		ours := into[id]
+		if ours == nil {
+			ours = &crdtElement{Fields: make(map[string]crdtRegister, len(theirs.Fields))}
+			into[id] = ours
+		}
+		if theirs.Added.after(ours.Added) {
+			ours.Added = theirs.Added
+		}
+		if theirs.Removed.after(ours.Removed) {
+			ours.Removed = theirs.Removed
+		}
+		for group, register := range theirs.Fields {
+			if current, ok := ours.Fields[group]; !ok || register.Stamp.after(current.Stamp) {
+				ours.Fields[group] = register
+			}
+		}
+	}
+}
+
+// Clone returns a copy of the document that shares nothing with it
+func (d *BoardDoc) Clone() *BoardDoc {
+	clone := newBoardDoc()
+	clone.Merge(d)
+	return clone
+}
+
+// decodeElement rebuilds an item from its registers
+func decodeElement(id string, el *crdtElement, item any) error {
+	fields := map[string]json.RawMessage{"id": json.RawMessage(fmt.Sprintf("%q", id))}
+	for group, register := range el.Fields {
+		if bytes.Equal(register.Value, crdtNull) {
+			continue
+		}
+		if !compositeGroups[group] {
+			fields[group] = register.Value
+			continue
+		}
+		var members map[string]json.RawMessage
+		if err := json.Unmarshal(register.Value, &members); err != nil {
+			return fmt.Errorf("%s: %w", group, err)
+		}
+		for name, value := range members {
+			fields[name] = value
+		}
+	}
+	if !el.live() {
+		fields["deleted"] = json.RawMessage("true")
+	}
+
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, item)
+}
+
+// compositeGroups are the registers holding several fields
+var compositeGroups = func() map[string]bool {
+	groups := make(map[string]bool)
+	for _, group := range crdtGroups {
+		groups[group] = true
+	}
+	return groups
+}()
+
+// Board converts the document back into a board. Tasks come in position
+// order, and columns and swimlanes by their order field.
+func (d *BoardDoc) Board() (*KanbanData, error) {
+	board := &KanbanData{Columns: []Column{}, Tasks: []Task{}}
+	json.Unmarshal(d.Collapsed.Value, &board.UnassignedCollapsed)
+
+	for _, id := range d.orderedTaskIDs() {
+		var task Task
+		if err := decodeElement(id, d.Tasks[id], &task); err != nil {
+			return nil, fmt.Errorf("task %s: %w", id, err)
+		}
+		board.Tasks = append(board.Tasks, task)
+	}
+
+	for id, el := range d.Columns {
+		var col Column
+		if err := decodeElement(id, el, &col); err != nil {
+			return nil, fmt.Errorf("column %s: %w", id, err)
+		}
+		board.Columns = append(board.Columns, col)
+	}
+	sort.Slice(board.Columns, func(i, j int) bool {
+		a, b := board.Columns[i], board.Columns[j]
+		if a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		return a.ID < b.ID
+	})
+
+	for id, el := range d.Swimlanes {
+		var lane Swimlane
+		if err := decodeElement(id, el, &lane); err != nil {
+			return nil, fmt.Errorf("swimlane %s: %w", id, err)
+		}
+		board.Swimlanes = append(board.Swimlanes, lane)
+	}
+	sort.Slice(board.Swimlanes, func(i, j int) bool {
+		a, b := board.Swimlanes[i], board.Swimlanes[j]
+		if a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		return a.ID < b.ID
+	})
+	return board, nil
+}
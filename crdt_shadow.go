@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The CRDT engine is dark launched. For users with the crdt_sync flag, each
+// full sync also runs through a BoardDoc kept for their board, and wherever
+// the CRDT's merge differs from mergeKanbanData's it's counted and logged.
+// Clients still get, and the server still saves, mergeKanbanData's board.
+//
+// The document follows the saved board: after each sync it takes the saved
+// board as the server's own writes, so every sync is compared from the
+// same starting point. It keeps what each client last received, by the
+// X-Client-ID header, so a client's stale copies of fields changed
+// elsewhere aren't taken for its edits; clients without one share a
+// single record.
+
+// crdtServerReplica writes the board as saved, including changes made
+// other ways than full syncs
+const crdtServerReplica = "server"
+
+// crdtMaxReplicas is how many clients' last boards are kept per user; the
+// one that synced longest ago goes first
+const crdtMaxReplicas = 8
+
+// crdtMaxDifferences caps the differences kept for the last divergence
+const crdtMaxDifferences = 20
+
+// crdtShadowState is a user's stored document and what each replica last had
+type crdtShadowState struct {
+	Doc   *BoardDoc                  `json:"doc"`
+	Bases map[string]*crdtShadowBase `json:"bases"`
+}
+
+type crdtShadowBase struct {
+	Base     *crdtBase `json:"base"`
+	SyncedAt time.Time `json:"syncedAt"`
+}
+
+func (s *crdtShadowState) base(replica string) *crdtBase {
+	if b := s.Bases[replica]; b != nil {
+		return b.Base
+	}
+	return nil
+}
+
+// CRDTDifference is one way the CRDT's merge differed: a field or the
+// membership of a task, column or swimlane ("task.title", "column.deleted",
+// "task.missing" for one only the current merge has, "task.extra" for one
+// only the CRDT has), or the order of a column's tasks ("task.order", with
+// the column's ID)
+type CRDTDifference struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+}
+
+// CRDTDivergence is a sync whose merges differed
+type CRDTDivergence struct {
+	At          time.Time        `json:"at"`
+	Email       string           `json:"email"`
+	Differences []CRDTDifference `json:"differences"`
+}
+
+// CRDTShadowStats counts shadowed syncs since the server started
+type CRDTShadowStats struct {
+	Syncs    int64 `json:"syncs"`
+	Diverged int64 `json:"diverged"`
+	// Syncs the CRDT couldn't run for; the sync itself goes ahead
+	Failures int64 `json:"failures"`
+	// Differences by kind
+	Differences    map[string]int64 `json:"differences"`
+	LastDivergence *CRDTDivergence  `json:"lastDivergence,omitempty"`
+}
+
+// CRDTShadow runs full syncs through the CRDT engine alongside the current
+// merge and compares the results
+type CRDTShadow struct {
+	flags *FeatureFlagService
+
+	mu    sync.Mutex
+	stats CRDTShadowStats
+}
+
+func NewCRDTShadow(flags *FeatureFlagService) *CRDTShadow {
+	return &CRDTShadow{flags: flags, stats: CRDTShadowStats{Differences: make(map[string]int64)}}
+}
+
+// Enabled reports whether a user's syncs are shadowed; a nil shadow is off
+func (s *CRDTShadow) Enabled(email string) bool {
+	return s != nil && s.flags.Enabled(email, FlagCRDTSync)
+}
+
+// crdtClientReplica names the replica a sync comes from
+func crdtClientReplica(r *http.Request) string {
+	return "client:" + headerClientID(r)
+}
+
+// Sync runs a full sync through the CRDT engine: server is the saved board
+// before the sync, client the board the client sent and merged what
+// mergeKanbanData made of them, after rules (the server's own sync rules,
+// which apply to the CRDT's board too). It's called in the sync's
+// transaction. Failures are logged and counted, never returned.
+func (s *CRDTShadow) Sync(tx *Tx, email, replica string, server, client, merged *KanbanData, rules func(board *KanbanData) error) {
+	differences, err := s.sync(tx, email, replica, server, client, merged, rules)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Syncs++
+	if err != nil {
+		s.stats.Failures++
+		log.Printf("Error shadowing sync for %s with the CRDT engine: %v", email, err)
+		return
+	}
+	if len(differences) == 0 {
+		return
+	}
+
+	s.stats.Diverged++
+	for _, d := range differences {
+		s.stats.Differences[d.Kind]++
+	}
+	if len(differences) > crdtMaxDifferences {
+		differences = differences[:crdtMaxDifferences]
+	}
+	s.stats.LastDivergence = &CRDTDivergence{At: time.Now().UTC(), Email: email, Differences: differences}
+	log.Printf("CRDT merge for %s differed from the sync merge: %v", email, differences)
+}
+
+func (s *CRDTShadow) sync(tx *Tx, email, replica string, server, client, merged *KanbanData, rules func(board *KanbanData) error) ([]CRDTDifference, error) {
+	now := time.Now()
+	state, err := loadCRDTShadow(tx, email)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		doc, err := NewBoardDoc(server, crdtServerReplica, now)
+		if err != nil {
+			return nil, err
+		}
+		state = &crdtShadowState{Doc: doc, Bases: make(map[string]*crdtShadowBase)}
+	}
+	doc := state.Doc
+
+	// Catch up on changes made since the last sync by operations, imports
+	// and the like, then apply the client's
+	if err := doc.Observe(crdtServerReplica, server, state.base(crdtServerReplica), now, true); err != nil {
+		return nil, err
+	}
+	if err := doc.Observe(replica, withServerSwimlanes(server, client), state.base(replica), now, false); err != nil {
+		return nil, err
+	}
+
+	board, err := doc.Board()
+	if err != nil {
+		return nil, err
+	}
+	leaveDeletedSwimlanes(board)
+	if err := rules(board); err != nil {
+		return nil, err
+	}
+	differences, err := compareMerges(board, merged)
+	if err != nil {
+		return nil, err
+	}
+
+	// Follow the saved board
+	if err := doc.Observe(crdtServerReplica, merged, nil, now, true); err != nil {
+		return nil, err
+	}
+	base, err := crdtBaseOf(merged)
+	if err != nil {
+		return nil, err
+	}
+	state.Bases[crdtServerReplica] = &crdtShadowBase{Base: base, SyncedAt: now}
+	state.Bases[replica] = &crdtShadowBase{Base: base, SyncedAt: now}
+	for len(state.Bases) > crdtMaxReplicas+1 {
+		oldest := ""
+		for name, b := range state.Bases {
+			if name != crdtServerReplica && (oldest == "" || b.SyncedAt.Before(state.Bases[oldest].SyncedAt)) {
+				oldest = name
+			}
+		}
+		delete(state.Bases, oldest)
+	}
+
+	return differences, saveCRDTShadow(tx, email, state)
+}
+
+// withServerSwimlanes gives the client's tasks without a swimlaneId the
+// server's, as mergeKanbanData does for clients that predate swimlanes; an
+// empty one takes the task out of its lane
+func withServerSwimlanes(server, client *KanbanData) *KanbanData {
+	lanes := make(map[string]*string)
+	for _, task := range server.Tasks {
+		lanes[task.ID] = task.SwimlaneID
+	}
+
+	filled := *client
+	filled.Tasks = make([]Task, len(client.Tasks))
+	for i, task := range client.Tasks {
+		if task.SwimlaneID == nil {
+			task.SwimlaneID = lanes[task.ID]
+		} else if *task.SwimlaneID == "" {
+			task.SwimlaneID = nil
+		}
+		filled.Tasks[i] = task
+	}
+	return &filled
+}
+
+func loadCRDTShadow(tx *Tx, email string) (*crdtShadowState, error) {
+	var raw string
+	err := tx.QueryRow("SELECT document FROM crdt_documents WHERE email = ?", email).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query CRDT document: %w", err)
+	}
+
+	var state crdtShadowState
+	if err := json.Unmarshal([]byte(raw), &state); err != nil {
+		return nil, fmt.Errorf("failed to decode CRDT document: %w", err)
+	}
+	if state.Doc == nil {
+		return nil, nil
+	}
+	if state.Bases == nil {
+		state.Bases = make(map[string]*crdtShadowBase)
+	}
+	return &state, nil
+}
+
+func saveCRDTShadow(tx *Tx, email string, state *crdtShadowState) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode CRDT document: %w", err)
+	}
+	if err := ensureUser(tx, email); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO crdt_documents (email, document, updated_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(email) DO UPDATE SET
+			document = excluded.document,
+			updated_at = CURRENT_TIMESTAMP
+	`, email, string(raw))
+	if err != nil {
+		return fmt.Errorf("failed to save CRDT document: %w", err)
+	}
+	return nil
+}
+
+// compareMerges lists how the CRDT's board differs from the one saved
+func compareMerges(crdt, saved *KanbanData) ([]CRDTDifference, error) {
+	crdtTasks, crdtColumns, crdtLanes, err := crdtItems(crdt)
+	if err != nil {
+		return nil, err
+	}
+	savedTasks, savedColumns, savedLanes, err := crdtItems(saved)
+	if err != nil {
+		return nil, err
+	}
+
+	var differences []CRDTDifference
+	differences = append(differences, compareItems("task", crdtTasks, savedTasks)...)
+	differences = append(differences, compareItems("column", crdtColumns, savedColumns)...)
+	differences = append(differences, compareItems("swimlane", crdtLanes, savedLanes)...)
+
+	crdtOrder, savedOrder := liveColumnTasks(crdt), liveColumnTasks(saved)
+	for column, ids := range savedOrder {
+		if !reflect.DeepEqual(crdtOrder[column], ids) {
+			differences = append(differences, CRDTDifference{Kind: "task.order", ID: column})
+		}
+	}
+	for column := range crdtOrder {
+		if _, ok := savedOrder[column]; !ok {
+			differences = append(differences, CRDTDifference{Kind: "task.order", ID: column})
+		}
+	}
+	if crdt.UnassignedCollapsed != saved.UnassignedCollapsed {
+		differences = append(differences, CRDTDifference{Kind: "board.unassignedCollapsed"})
+	}
+
+	sort.Slice(differences, func(i, j int) bool {
+		if differences[i].Kind != differences[j].Kind {
+			return differences[i].Kind < differences[j].Kind
+		}
+		return differences[i].ID < differences[j].ID
+	})
+	return differences, nil
+}
+
+func compareItems(kind string, crdt, saved []crdtItem) []CRDTDifference {
+	savedByID := make(map[string]crdtItem, len(saved))
+	for _, item := range saved {
+		savedByID[item.id] = item
+	}
+
+	var differences []CRDTDifference
+	for _, item := range crdt {
+		want, ok := savedByID[item.id]
+		if !ok {
+			differences = append(differences, CRDTDifference{Kind: kind + ".extra", ID: item.id})
+			continue
+		}
+		delete(savedByID, item.id)
+		if item.deleted != want.deleted {
+			differences = append(differences, CRDTDifference{Kind: kind + ".deleted", ID: item.id})
+		}
+		groups := make(map[string]bool)
+		for group := range item.fields {
+			groups[group] = true
+		}
+		for group := range want.fields {
+			groups[group] = true
+		}
+		for group := range groups {
+			got, wanted := item.fields[group], want.fields[group]
+			if got == nil {
+				got = crdtNull
+			}
+			if wanted == nil {
+				wanted = crdtNull
+			}
+			if string(got) != string(wanted) {
+				differences = append(differences, CRDTDifference{Kind: kind + "." + group, ID: item.id})
+			}
+		}
+	}
+	for id := range savedByID {
+		differences = append(differences, CRDTDifference{Kind: kind + ".missing", ID: id})
+	}
+	return differences
+}
+
+// liveColumnTasks lists each column's live tasks in board order, with ""
+// for unassigned tasks
+func liveColumnTasks(board *KanbanData) map[string][]string {
+	columns := make(map[string][]string)
+	for _, task := range board.Tasks {
+		if task.Deleted {
+			continue
+		}
+		column := ""
+		if task.ColumnID != nil {
+			column = *task.ColumnID
+		}
+		columns[column] = append(columns[column], task.ID)
+	}
+	return columns
+}
+
+// Stats returns a copy of the counts since the server started
+func (s *CRDTShadow) Stats() CRDTShadowStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Differences = make(map[string]int64, len(s.stats.Differences))
+	for kind, n := range s.stats.Differences {
+		stats.Differences[kind] = n
+	}
+	return stats
+}
+
+// CRDTShadowHandler shows admins how the CRDT engine's merges compare
+type CRDTShadowHandler struct {
+	shadow *CRDTShadow
+}
+
+func NewCRDTShadowHandler(shadow *CRDTShadow) *CRDTShadowHandler {
+	return &CRDTShadowHandler{shadow: shadow}
+}
+
+// Stats reports the shadowed syncs since the server started
+func (h *CRDTShadowHandler) Stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"stats":  h.shadow.Stats(),
+	})
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// Convergence tests for the CRDT engine. Each starts from a shared board,
+// lets a few replicas edit their own copies of it, and merges the copies.
+// Replicas that have merged the same edits must hold the same board
+// whatever order they merged them in, and each kind of concurrent edit
+// must resolve the way crdt.go documents.
+
+func TestKeyBetween(t *testing.T) {
+	check := func(a, b string) {
+		t.Helper()
+		key := keyBetween(a, b)
+		if key <= a || (b != "" && key >= b) || strings.HasSuffix(key, "0") {
+			t.Fatalf("keyBetween(%q, %q) = %q", a, b, key)
+		}
+	}
+
+	// Repeatedly inserting at the front, the back and the same gap
+	first, last := keyBetween("", ""), keyBetween("", "")
+	lo, hi := "", keyBetween("", "")
+	for i := 0; i < 200; i++ {
+		check("", first)
+		first = keyBetween("", first)
+		check(last, "")
+		last = keyBetween(last, "")
+		check(lo, hi)
+		lo = keyBetween(lo, hi)
+	}
+
+	// Neighbours out of order go after a
+	if key := keyBetween("m", "c"); key <= "m" {
+		t.Errorf("keyBetween(m, c) = %q, want a key after m", key)
+	}
+}
+
+// Position keys grow slowly, whether a whole board is converted at once or
+// tasks are added to the end of a column one at a time
+func TestPositionKeysStayShort(t *testing.T) {
+	board := &KanbanData{}
+	for i := 0; i < 1000; i++ {
+		board.Tasks = append(board.Tasks, Task{ID: fmt.Sprintf("t%03d", i), ColumnID: strPtr(fmt.Sprintf("c%d", i/100))})
+	}
+	doc, err := NewBoardDoc(board, "a", time.Unix(1000, 0))
+	if err != nil {
+		t.Fatalf("NewBoardDoc: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		board.Tasks = append(board.Tasks[:100+i], append([]Task{{ID: fmt.Sprintf("n%03d", i), ColumnID: strPtr("c0")}}, board.Tasks[100+i:]...)...)
+		if err := doc.Observe("a", board, nil, time.Unix(2000, 0), false); err != nil {
+			t.Fatalf("Observe: %v", err)
+		}
+	}
+
+	longest := ""
+	for id := range doc.Tasks {
+		if key := doc.taskPosition(id); len(key) > len(longest) {
+			longest = key
+		}
+	}
+	if len(longest) > 12 {
+		t.Errorf("longest position key %q, want at most 12 characters", longest)
+	}
+	if got, _ := doc.Board(); !reflect.DeepEqual(got.Tasks, board.Tasks) {
+		t.Error("tasks out of order")
+	}
+}
+
+func TestBoardDocRoundTrip(t *testing.T) {
+	board := crdtTestBoard()
+	board.UnassignedCollapsed = true
+	doc, err := NewBoardDoc(board, "a", time.Now())
+	if err != nil {
+		t.Fatalf("NewBoardDoc: %v", err)
+	}
+	got, err := doc.Board()
+	if err != nil {
+		t.Fatalf("Board: %v", err)
+	}
+	if !reflect.DeepEqual(got, board) {
+		t.Errorf("round trip = %+v, want %+v", got, board)
+	}
+}
+
+// crdtTestBoard has three columns of tasks, a swimlane and a deleted task,
+// in the order Board returns them
+func crdtTestBoard() *KanbanData {
+	board := &KanbanData{
+		Columns: []Column{
+			{ID: "c0", Title: "To Do", Order: 0},
+			{ID: "c1", Title: "Doing", Order: 1, WIPLimit: 3},
+			{ID: "c2", Title: "Done", Order: 2, IsDone: true},
+		},
+		Swimlanes: []Swimlane{{ID: "l0", Title: "Urgent"}},
+	}
+	for i := 0; i < 9; i++ {
+		board.Tasks = append(board.Tasks, Task{
+			ID:       fmt.Sprintf("t%d", i),
+			Title:    fmt.Sprintf("Task %d", i),
+			ColumnID: strPtr(fmt.Sprintf("c%d", i/3)),
+		})
+	}
+	board.Tasks[1].SwimlaneID = strPtr("l0")
+	board.Tasks[4].Labels = []string{"home"}
+	board.Tasks[7].Deleted = true
+	return board
+}
+
+// crdtReplica edits its own copy of a shared document
+type crdtReplica struct {
+	id   string
+	doc  *BoardDoc
+	base *crdtBase
+}
+
+func newCRDTReplicas(t *testing.T, board *KanbanData, ids ...string) []*crdtReplica {
+	t.Helper()
+	doc, err := NewBoardDoc(board, "origin", time.Unix(1000, 0))
+	if err != nil {
+		t.Fatalf("NewBoardDoc: %v", err)
+	}
+	base, err := crdtBaseOf(board)
+	if err != nil {
+		t.Fatalf("crdtBaseOf: %v", err)
+	}
+	replicas := make([]*crdtReplica, len(ids))
+	for i, id := range ids {
+		replicas[i] = &crdtReplica{id: id, doc: doc.Clone(), base: base}
+	}
+	return replicas
+}
+
+// edit applies a change to the replica's board and observes it at a time
+func (r *crdtReplica) edit(t *testing.T, at int64, change func(board *KanbanData)) {
+	t.Helper()
+	board, err := r.doc.Board()
+	if err != nil {
+		t.Fatalf("Board: %v", err)
+	}
+	change(board)
+	if err := r.doc.Observe(r.id, board, r.base, time.Unix(at, 0), false); err != nil {
+		t.Fatalf("Observe: %v", err)
+	}
+	if r.base, err = crdtBaseOf(board); err != nil {
+		t.Fatalf("crdtBaseOf: %v", err)
+	}
+}
+
+// mergedBoard merges the replicas' documents into a fresh copy, in order
+func mergedBoard(t *testing.T, replicas ...*crdtReplica) *KanbanData {
+	t.Helper()
+	doc := newBoardDoc()
+	for _, r := range replicas {
+		doc.Merge(r.doc)
+	}
+	board, err := doc.Board()
+	if err != nil {
+		t.Fatalf("Board: %v", err)
+	}
+	return board
+}
+
+// moveTask moves a task to an index among a column's tasks
+func moveTask(board *KanbanData, id, column string, index int) {
+	var task Task
+	tasks := []Task{}
+	for _, candidate := range board.Tasks {
+		if candidate.ID == id {
+			task = candidate
+			continue
+		}
+		tasks = append(tasks, candidate)
+	}
+	task.ColumnID = strPtr(column)
+
+	at, seen := len(tasks), 0
+	for i, candidate := range tasks {
+		if candidate.ColumnID != nil && *candidate.ColumnID == column {
+			if seen == index {
+				at = i
+				break
+			}
+			seen++
+			at = i + 1
+		}
+	}
+	board.Tasks = append(tasks[:at], append([]Task{task}, tasks[at:]...)...)
+}
+
+// columnOrder lists a column's live task IDs in board order
+func columnOrder(board *KanbanData, column string) []string {
+	ids := []string{}
+	for _, task := range board.Tasks {
+		if !task.Deleted && task.ColumnID != nil && *task.ColumnID == column {
+			ids = append(ids, task.ID)
+		}
+	}
+	return ids
+}
+
+func findTestTask(board *KanbanData, id string) Task {
+	for _, task := range board.Tasks {
+		if task.ID == id {
+			return task
+		}
+	}
+	return Task{}
+}
+
+func TestCRDTConcurrentMovesOfOneTask(t *testing.T) {
+	replicas := newCRDTReplicas(t, crdtTestBoard(), "a", "b")
+	a, b := replicas[0], replicas[1]
+	a.edit(t, 2000, func(board *KanbanData) { moveTask(board, "t0", "c1", 1) })
+	b.edit(t, 2001, func(board *KanbanData) { moveTask(board, "t0", "c2", 0) })
+
+	// The later move wins whole: the task is where b put it, and nowhere else
+	for _, board := range []*KanbanData{mergedBoard(t, a, b), mergedBoard(t, b, a)} {
+		if got := columnOrder(board, "c2"); !reflect.DeepEqual(got, []string{"t0", "t6", "t8"}) {
+			t.Errorf("c2 = %v, want t0 first", got)
+		}
+		if got := columnOrder(board, "c1"); !reflect.DeepEqual(got, []string{"t3", "t4", "t5"}) {
+			t.Errorf("c1 = %v, want a's move undone", got)
+		}
+	}
+}
+
+func TestCRDTConcurrentMovesOfDifferentTasks(t *testing.T) {
+	replicas := newCRDTReplicas(t, crdtTestBoard(), "a", "b")
+	a, b := replicas[0], replicas[1]
+	a.edit(t, 2000, func(board *KanbanData) { moveTask(board, "t0", "c0", 2) })
+	b.edit(t, 2001, func(board *KanbanData) { moveTask(board, "t3", "c0", 0) })
+
+	// Both moves survive, where a full sync keeps only the last client's
+	// order of the column
+	want := []string{"t3", "t1", "t2", "t0"}
+	if got := columnOrder(mergedBoard(t, a, b), "c0"); !reflect.DeepEqual(got, want) {
+		t.Errorf("c0 = %v, want %v", got, want)
+	}
+	boardA, _ := a.doc.Board()
+	boardB, _ := b.doc.Board()
+	if got := columnOrder(mergeKanbanData(boardA, boardB), "c0"); reflect.DeepEqual(got, want) {
+		t.Errorf("mergeKanbanData kept both moves (%v); update this test's comment", got)
+	}
+}
+
+func TestCRDTConcurrentFieldEdits(t *testing.T) {
+	replicas := newCRDTReplicas(t, crdtTestBoard(), "a", "b")
+	a, b := replicas[0], replicas[1]
+	a.edit(t, 2000, func(board *KanbanData) { board.Tasks[2].Title = "Renamed" })
+	b.edit(t, 2001, func(board *KanbanData) {
+		board.Tasks[2].Description = "Details"
+		board.Tasks[2].Completed = true
+	})
+	// a edits again without having seen b's change, which it must not undo
+	a.edit(t, 2002, func(board *KanbanData) { board.Tasks[2].Labels = []string{"x"} })
+
+	task := findTestTask(mergedBoard(t, a, b), "t2")
+	if task.Title != "Renamed" || task.Description != "Details" || !task.Completed || len(task.Labels) != 1 {
+		t.Errorf("t2 = %+v, want both replicas' edits", task)
+	}
+}
+
+func TestCRDTDeleteAndEdit(t *testing.T) {
+	replicas := newCRDTReplicas(t, crdtTestBoard(), "a", "b")
+	a, b := replicas[0], replicas[1]
+	a.edit(t, 2000, func(board *KanbanData) { board.Tasks[5].Deleted = true })
+	b.edit(t, 2001, func(board *KanbanData) { board.Tasks[5].Title = "Still wanted" })
+
+	// Editing doesn't re-add a removed task, but the edit is kept
+	task := findTestTask(mergedBoard(t, b, a), "t5")
+	if !task.Deleted || task.Title != "Still wanted" {
+		t.Errorf("t5 = %+v, want deleted with b's title", task)
+	}
+
+	// Restoring it does
+	b.edit(t, 2002, func(board *KanbanData) {
+		for i := range board.Tasks {
+			if board.Tasks[i].ID == "t7" {
+				board.Tasks[i].Deleted = false
+			}
+		}
+	})
+	if task := findTestTask(mergedBoard(t, a, b), "t7"); task.Deleted {
+		t.Errorf("t7 = %+v, want restored", task)
+	}
+}
+
+// crdtEdits is a random sequence of edits per replica, for property tests
+type crdtEdits [3][]int64
+
+func (crdtEdits) Generate(r *rand.Rand, size int) reflect.Value {
+	var edits crdtEdits
+	for i := range edits {
+		for n := r.Intn(6); n > 0; n-- {
+			edits[i] = append(edits[i], r.Int63())
+		}
+	}
+	return reflect.ValueOf(edits)
+}
+
+// randomEdit changes a board in one of several ways, chosen by seed
+func randomEdit(board *KanbanData, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	task := func() *Task { return &board.Tasks[r.Intn(len(board.Tasks))] }
+	switch r.Intn(7) {
+	case 0, 1:
+		moveTask(board, task().ID, fmt.Sprintf("c%d", r.Intn(3)), r.Intn(4))
+	case 2:
+		task().Title = fmt.Sprintf("title %d", r.Intn(100))
+	case 3:
+		task().Deleted = r.Intn(2) == 0
+	case 4:
+		board.Tasks = append(board.Tasks, Task{ID: fmt.Sprintf("n%d", r.Intn(5)), Title: "new", ColumnID: strPtr("c1")})
+	case 5:
+		col := &board.Columns[r.Intn(len(board.Columns))]
+		col.Order = r.Intn(5)
+		col.Title = fmt.Sprintf("column %d", r.Intn(100))
+	case 6:
+		task().SwimlaneID = nil
+		board.UnassignedCollapsed = !board.UnassignedCollapsed
+	}
+}
+
+func TestCRDTConverges(t *testing.T) {
+	property := func(edits crdtEdits) bool {
+		replicas := newCRDTReplicas(t, crdtTestBoard(), "a", "b", "c")
+		for i, r := range replicas {
+			for j, seed := range edits[i] {
+				// Replicas' clocks interleave, and sometimes collide
+				r.edit(t, 2000+int64(j*2+i%2), func(board *KanbanData) { randomEdit(board, seed) })
+			}
+		}
+		a, b, c := replicas[0], replicas[1], replicas[2]
+
+		// Merging is commutative and associative...
+		want := mergedBoard(t, a, b, c)
+		for _, order := range [][]*crdtReplica{{c, b, a}, {b, a, c}, {a, c, b}} {
+			if got := mergedBoard(t, order...); !reflect.DeepEqual(got, want) {
+				return false
+			}
+		}
+		ab := &crdtReplica{doc: a.doc.Clone()}
+		ab.doc.Merge(b.doc)
+		if got := mergedBoard(t, c, ab); !reflect.DeepEqual(got, want) {
+			return false
+		}
+		// ...and idempotent
+		if got := mergedBoard(t, a, b, c, a, b, c); !reflect.DeepEqual(got, want) {
+			return false
+		}
+
+		// Every task is on the board once
+		seen := make(map[string]bool)
+		for _, task := range want.Tasks {
+			if seen[task.ID] {
+				return false
+			}
+			seen[task.ID] = true
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 300}); err != nil {
+		t.Error(err)
+	}
+}
+
+// A replica that edits nothing and observes the merged board again writes
+// nothing, so converged replicas stay converged
+func TestCRDTObserveUnchangedBoard(t *testing.T) {
+	replicas := newCRDTReplicas(t, crdtTestBoard(), "a", "b")
+	a, b := replicas[0], replicas[1]
+	a.edit(t, 2000, func(board *KanbanData) { moveTask(board, "t2", "c2", 1) })
+	b.edit(t, 2001, func(board *KanbanData) { board.Tasks[8].Title = "Edited" })
+	a.doc.Merge(b.doc)
+
+	before := a.doc.Clone()
+	board, _ := a.doc.Board()
+	if err := a.doc.Observe("a", board, nil, time.Unix(3000, 0), false); err != nil {
+		t.Fatalf("Observe: %v", err)
+	}
+	before.Clock = a.doc.Clock
+	if !reflect.DeepEqual(a.doc, before) {
+		t.Error("observing the document's own board changed it")
+	}
+}
+
+func TestCRDTShadowSync(t *testing.T) {
+	app := newTestApp(t)
+	flags := NewFeatureFlagService(app.db, map[string]int{FlagCRDTSync: 100})
+	shadow := NewCRDTShadow(flags)
+	app.dataHandler.UseCRDTShadow(shadow)
+	email := "a@example.com"
+
+	sync := func(client string, board *KanbanData) *KanbanData {
+		t.Helper()
+		body, _ := json.Marshal(board)
+		req := httptest.NewRequest("POST", "/api/data/sync", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+app.token(t, email))
+		req.Header.Set("X-Client-ID", client)
+		rec := httptest.NewRecorder()
+		app.router.ServeHTTP(rec, req)
+		expectStatus(t, rec, http.StatusOK)
+		var resp boardResponse
+		decodeBody(t, rec, &resp)
+		return &resp.Data
+	}
+
+	// Two clients start from the same board
+	initial := sync("a", crdtTestBoard())
+	sync("b", initial)
+	if stats := shadow.Stats(); stats.Syncs != 2 || stats.Diverged != 0 || stats.Failures != 0 {
+		t.Fatalf("stats = %+v, want 2 syncs that agreed", stats)
+	}
+
+	// a moves t0 to the end of its column; b, not having seen that, moves
+	// t3 to the top of it
+	fromA := cloneKanbanData(initial)
+	moveTask(fromA, "t0", "c0", 2)
+	sync("a", fromA)
+	fromB := cloneKanbanData(initial)
+	moveTask(fromB, "t3", "c0", 0)
+	saved := sync("b", fromB)
+
+	// What's saved is still the usual merge's, where b's order wins
+	if got := columnOrder(saved, "c0"); !reflect.DeepEqual(got, []string{"t3", "t0", "t1", "t2"}) {
+		t.Errorf("saved c0 = %v, want b's order", got)
+	}
+	// The CRDT would have kept a's move too
+	stats := shadow.Stats()
+	if stats.Syncs != 4 || stats.Diverged != 1 || stats.Differences["task.order"] != 1 {
+		t.Errorf("stats = %+v, want the last sync to differ in task order", stats)
+	}
+	if last := stats.LastDivergence; last == nil || len(last.Differences) != 1 || last.Differences[0].ID != "c0" {
+		t.Errorf("last divergence = %+v, want c0's order", last)
+	}
+
+	// Users without the flag aren't shadowed
+	flags.rollouts[FlagCRDTSync] = 0
+	sync("a", saved)
+	if stats := shadow.Stats(); stats.Syncs != 4 {
+		t.Errorf("%d syncs shadowed with the flag off, want 4", stats.Syncs)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Dialect identifies the SQL flavour spoken by the configured database
+type Dialect string
+
+const (
+	DialectSQLite   Dialect = "sqlite3"
+	DialectPostgres Dialect = "postgres"
+)
+
+// defaultSQLitePath is used when DATABASE_URL is not set
+const defaultSQLitePath = "./todo.db"
+
+// DBPoolConfig sizes the connection pool. For SQLite, BusyTimeout is how
+// long a connection waits for another's write lock before giving up with
+// "database is locked". QueryTimeout bounds board reads and writes.
+type DBPoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxIdleTime time.Duration
+	BusyTimeout     time.Duration
+	QueryTimeout    time.Duration
+}
+
+// DB wraps *sql.DB so queries can be written once with "?" placeholders and
+// SQLite column types, and rewritten for the configured dialect
+type DB struct {
+	*sql.DB
+	dialect      Dialect
+	queryTimeout time.Duration
+}
+
+// Tx is a transaction on a DB that applies the same query rewriting. Its
+// queries run under the context it was begun with.
+type Tx struct {
+	*sql.Tx
+	dialect Dialect
+	ctx     context.Context
+}
+
+// parseDatabaseURL maps DATABASE_URL onto a driver and data source name.
+// Postgres URLs are passed through; "sqlite://path" or a bare file path
+// selects SQLite.
+func parseDatabaseURL(databaseURL string) (Dialect, string) {
+	switch {
+	case databaseURL == "":
+		return DialectSQLite, defaultSQLitePath
+	case strings.HasPrefix(databaseURL, "postgres://"), strings.HasPrefix(databaseURL, "postgresql://"):
+		return DialectPostgres, databaseURL
+	case strings.HasPrefix(databaseURL, "sqlite://"):
+		return DialectSQLite, strings.TrimPrefix(databaseURL, "sqlite://")
+	default:
+		return DialectSQLite, databaseURL
+	}
+}
+
+// openDB opens the database selected by DATABASE_URL
+func openDB(databaseURL string, pool DBPoolConfig) (*DB, error) {
+	dialect, dsn := parseDatabaseURL(databaseURL)
+	if dialect == DialectSQLite {
+		dsn = sqliteDSN(dsn, pool.BusyTimeout)
+	}
+
+	db, err := sql.Open(string(dialect), dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if dialect == DialectSQLite && (strings.Contains(dsn, ":memory:") || strings.Contains(dsn, "mode=memory")) {
+		// Every connection to an in-memory database gets its own database
+		pool.MaxOpenConns = 1
+		pool.MaxIdleConns = 1
+		pool.ConnMaxIdleTime = 0
+	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	return &DB{DB: db, dialect: dialect, queryTimeout: pool.QueryTimeout}, nil
+}
+
+// sqliteDSN adds the connection settings concurrent use needs to a SQLite
+// data source name, leaving any already given alone:
+//
+//   - WAL journaling, so reads don't wait for writes
+//   - a busy timeout, so a connection waits for the write lock instead of
+//     failing at once
+//   - synchronous=NORMAL, which is durable in WAL mode and much cheaper
+//   - BEGIN IMMEDIATE transactions, which take the write lock up front; a
+//     transaction that read first and then wrote could otherwise fail with
+//     "database is locked" regardless of the busy timeout
+func sqliteDSN(dsn string, busyTimeout time.Duration) string {
+	path, rawQuery, _ := strings.Cut(dsn, "?")
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return dsn
+	}
+	defaults := []struct{ key, alias, value string }{
+		{"_journal_mode", "_journal", "WAL"},
+		{"_busy_timeout", "_timeout", strconv.FormatInt(busyTimeout.Milliseconds(), 10)},
+		{"_synchronous", "_sync", "NORMAL"},
+		{"_txlock", "", "immediate"},
+	}
+	for _, d := range defaults {
+		if params.Has(d.key) || (d.alias != "" && params.Has(d.alias)) {
+			continue
+		}
+		params.Set(d.key, d.value)
+	}
+	return path + "?" + params.Encode()
+}
+
+// isBusy reports whether err is SQLite giving up on a lock another
+// connection holds
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// busyRetries is how many more times retryBusy tries after a busy error
+const busyRetries = 5
+
+// retryBusy calls fn until it succeeds, fails with something other than a
+// busy error, has been retried busyRetries times or ctx ends, backing off
+// with jitter in between
+func retryBusy(ctx context.Context, fn func() error) error {
+	backoff := 20 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isBusy(err) || attempt == busyRetries {
+			return err
+		}
+		select {
+		case <-time.After(backoff/2 + time.Duration(mathrand.Int63n(int64(backoff)))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// rebind rewrites "?" placeholders into the dialect's positional form
+func rebind(dialect Dialect, query string) string {
+	if dialect != DialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// ddl rewrites SQLite schema types into the dialect's equivalents
+func ddl(dialect Dialect, statement string) string {
+	if dialect != DialectPostgres {
+		return statement
+	}
+
+	replacer := strings.NewReplacer(
+		"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+		"TIMESTAMP", "TIMESTAMPTZ",
+		"BLOB", "BYTEA",
+	)
+	return replacer.Replace(statement)
+}
+
+// Dialect returns the SQL flavour of the database
+func (db *DB) Dialect() Dialect {
+	return db.dialect
+}
+
+// ByteLength is the SQL expression for the size in bytes of a text column
+func (db *DB) ByteLength(column string) string {
+	if db.dialect == DialectPostgres {
+		return "OCTET_LENGTH(" + column + ")"
+	}
+	return "LENGTH(CAST(" + column + " AS BLOB))"
+}
+
+// CreateTable runs a CREATE TABLE statement written in SQLite syntax
+func (db *DB) CreateTable(statement string) error {
+	_, err := db.DB.Exec(ddl(db.dialect, statement))
+	return err
+}
+
+// AddColumnIfMissing adds a column to an existing table unless it's already
+// there. definition is written in SQLite syntax.
+func (db *DB) AddColumnIfMissing(table, column, definition string) error {
+	var query string
+	switch db.dialect {
+	case DialectPostgres:
+		query = "SELECT COUNT(*) FROM information_schema.columns WHERE table_name = ? AND column_name = ?"
+	default:
+		query = "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+	}
+
+	var count int
+	if err := db.QueryRow(query, table, column).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	_, err := db.DB.Exec(ddl(db.dialect, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)))
+	return err
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(rebind(db.dialect, query), args...)
+}
+
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(rebind(db.dialect, query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(rebind(db.dialect, query), args...)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, rebind(db.dialect, query), args...)
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, rebind(db.dialect, query), args...)
+}
+
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return db.DB.QueryRowContext(ctx, rebind(db.dialect, query), args...)
+}
+
+// WithQueryTimeout bounds ctx by the configured query timeout, if any
+func (db *DB) WithQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, db.queryTimeout)
+}
+
+// Begin starts a transaction that rewrites queries like its parent DB
+func (db *DB) Begin() (*Tx, error) {
+	return db.BeginTx(context.Background())
+}
+
+// BeginTx starts a transaction whose queries run under ctx; it's rolled
+// back if ctx ends before it's committed
+func (db *DB) BeginTx(ctx context.Context) (*Tx, error) {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, dialect: db.dialect, ctx: ctx}, nil
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.ExecContext(tx.ctx, rebind(tx.dialect, query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.QueryContext(tx.ctx, rebind(tx.dialect, query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRowContext(tx.ctx, rebind(tx.dialect, query), args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return tx.Tx.ExecContext(ctx, rebind(tx.dialect, query), args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.QueryContext(ctx, rebind(tx.dialect, query), args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRowContext(ctx, rebind(tx.dialect, query), args...)
+}
+
+// isTimeout reports whether err is a query giving up because its context's
+// deadline passed
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// execer is satisfied by both *DB and *Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// querier is satisfied by both *DB and *Tx
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// ensureUser creates the users row for an email if it doesn't exist yet, so
+// rows in tables referencing users satisfy their foreign key
+func ensureUser(e execer, email string) error {
+	_, err := e.Exec("INSERT INTO users (email) VALUES (?) ON CONFLICT(email) DO NOTHING", email)
+	if err != nil {
+		return fmt.Errorf("failed to insert user: %w", err)
+	}
+	return nil
+}
@@ -1,22 +1,23 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
-
-	_ "github.com/mattn/go-sqlite3"
+	mathrand "math/rand"
+	"strconv"
+	"time"
 )
 
-func initDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "./todo.db")
+func initDB(cfg *Config) (*DB, error) {
+	db, err := openDB(cfg.DatabaseURL, cfg.DBPool)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+		return nil, err
 	}
 
 	// Create users table
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS users (
 		email TEXT PRIMARY KEY,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	)`)
@@ -24,10 +25,19 @@ func initDB() (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to create users table: %w", err)
 	}
 
+	// Admins can disable accounts and revoke their sessions
+	if err := db.AddColumnIfMissing("users", "disabled_at", "TIMESTAMP"); err != nil {
+		return nil, fmt.Errorf("failed to add users.disabled_at: %w", err)
+	}
+	if err := db.AddColumnIfMissing("users", "sessions_revoked_at", "TIMESTAMP"); err != nil {
+		return nil, fmt.Errorf("failed to add users.sessions_revoked_at: %w", err)
+	}
+
 	// Create data table (will store JSON data for each user)
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS user_data (
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS user_data (
 		email TEXT PRIMARY KEY,
 		data TEXT NOT NULL,
+		version INTEGER NOT NULL DEFAULT 0,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (email) REFERENCES users(email)
 	)`)
@@ -35,51 +45,583 @@ func initDB() (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to create user_data table: %w", err)
 	}
 
-	log.Println("Database initialized successfully")
+	// Boards created before versioning lack the version column
+	if err := db.AddColumnIfMissing("user_data", "version", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, fmt.Errorf("failed to add user_data.version: %w", err)
+	}
+
+	// Create calendar tokens table (secret per-user ICS feed tokens)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS calendar_tokens (
+		email TEXT PRIMARY KEY,
+		token TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create calendar_tokens table: %w", err)
+	}
+
+	// Create saved filters table (filter expressions behind share slugs)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS saved_filters (
+		slug TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		filter TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create saved_filters table: %w", err)
+	}
+
+	// Create backup webhooks table (per-user scheduled export endpoints)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS backup_webhooks (
+		email TEXT PRIMARY KEY,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_delivery_at TIMESTAMP,
+		last_status TEXT,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backup_webhooks table: %w", err)
+	}
+
+	// Create macros table (user-defined operation sequences)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS macros (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		name TEXT NOT NULL,
+		operations TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create macros table: %w", err)
+	}
+
+	// Create devices table (clients that sync queued offline changes)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS devices (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		name TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_sync_at TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create devices table: %w", err)
+	}
+
+	// Create item clocks table (when and by which device each task/column
+	// was last changed through batch sync, for conflict detection)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS item_clocks (
+		email TEXT NOT NULL,
+		item_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		changed_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (email, item_id),
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create item_clocks table: %w", err)
+	}
+
+	// Create attachments table (metadata; content lives in the attachment store)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS attachments (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		task_id TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		storage_key TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attachments table: %w", err)
+	}
+
+	// Create comments table (task discussions; email is the board owner)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS comments (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		task_id TEXT NOT NULL,
+		author TEXT NOT NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create comments table: %w", err)
+	}
+
+	// Create user settings table (JSON-encoded UserSettings)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS user_settings (
+		email TEXT PRIMARY KEY,
+		settings TEXT NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user_settings table: %w", err)
+	}
+
+	// Create archived tasks table (tasks moved off the active board)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS archived_tasks (
+		email TEXT NOT NULL,
+		task_id TEXT NOT NULL,
+		task TEXT NOT NULL,
+		column_title TEXT NOT NULL DEFAULT '',
+		archived_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (email, task_id),
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archived_tasks table: %w", err)
+	}
+
+	// Create external connections table (per-user links to other task
+	// services, with their OAuth tokens and sync state)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS external_connections (
+		email TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		access_token TEXT NOT NULL,
+		refresh_token TEXT NOT NULL,
+		token_expiry TIMESTAMP NOT NULL,
+		remote_list_id TEXT NOT NULL,
+		column_id TEXT NOT NULL DEFAULT '',
+		sync_cursor TEXT NOT NULL DEFAULT '',
+		last_synced_at TIMESTAMP,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (email, provider),
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create external_connections table: %w", err)
+	}
+
+	// Connections made before sync backoff lack its columns
+	if err := db.AddColumnIfMissing("external_connections", "failure_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, fmt.Errorf("failed to add external_connections.failure_count: %w", err)
+	}
+	if err := db.AddColumnIfMissing("external_connections", "next_attempt_at", "TIMESTAMP"); err != nil {
+		return nil, fmt.Errorf("failed to add external_connections.next_attempt_at: %w", err)
+	}
+
+	// Create external mappings table (local task <-> remote item, with the
+	// hash of the content both sides agreed on at the last sync)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS external_mappings (
+		email TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		task_id TEXT NOT NULL,
+		external_id TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		PRIMARY KEY (email, provider, task_id),
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create external_mappings table: %w", err)
+	}
+
+	// Create Home Assistant tokens table (long-lived per-user tokens for
+	// the sensor and add-task endpoints)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS homeassistant_tokens (
+		email TEXT PRIMARY KEY,
+		token TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create homeassistant_tokens table: %w", err)
+	}
+
+	// Create Grafana tokens table (long-lived per-user tokens for the stats
+	// datasource)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS grafana_tokens (
+		email TEXT PRIMARY KEY,
+		token TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create grafana_tokens table: %w", err)
+	}
+
+	// Create open task counts table (each board's open tasks at its last
+	// save of the day, for stats)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS open_task_counts (
+		email TEXT NOT NULL,
+		day TEXT NOT NULL,
+		open_count INTEGER NOT NULL,
+		PRIMARY KEY (email, day),
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create open_task_counts table: %w", err)
+	}
+
+	// Create API keys table (hashed per-user keys for scripts)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		name TEXT NOT NULL,
+		scope TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create api_keys table: %w", err)
+	}
+
+	// Create webhooks table (user endpoints notified of board events)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS webhooks (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhooks table: %w", err)
+	}
+
+	// Create webhook deliveries table (the delivery log)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id TEXT PRIMARY KEY,
+		webhook_id TEXT NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		response_status TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (webhook_id) REFERENCES webhooks(id)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook_deliveries table: %w", err)
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries (webhook_id, created_at)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to index webhook_deliveries: %w", err)
+	}
+
+	// Create WebSub tokens table (secret topic URLs for board change pings)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS websub_tokens (
+		email TEXT PRIMARY KEY,
+		token TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create websub_tokens table: %w", err)
+	}
+
+	// Create WebSub subscriptions table (verified subscriber callbacks)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS websub_subscriptions (
+		email TEXT NOT NULL,
+		callback TEXT NOT NULL,
+		topic TEXT NOT NULL,
+		secret TEXT NOT NULL DEFAULT '',
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (email, callback),
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create websub_subscriptions table: %w", err)
+	}
+
+	// Create inbound email tokens table (local parts of per-user addresses)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS inbound_email_tokens (
+		email TEXT PRIMARY KEY,
+		token TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inbound_email_tokens table: %w", err)
+	}
+
+	// Create board snapshots table (named versions for the history API)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS board_snapshots (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		name TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		day TEXT NOT NULL DEFAULT '',
+		version INTEGER NOT NULL,
+		data TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create board_snapshots table: %w", err)
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_board_snapshots_email ON board_snapshots (email, kind, day)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to index board_snapshots: %w", err)
+	}
+
+	// Create Slack installations table (a user's Slack identity and channel)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS slack_installations (
+		email TEXT PRIMARY KEY,
+		team_id TEXT NOT NULL,
+		team_name TEXT NOT NULL,
+		slack_user_id TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		webhook_url TEXT NOT NULL,
+		events TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (team_id, slack_user_id),
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create slack_installations table: %w", err)
+	}
+
+	// Create exports table (background board exports, kept until they expire)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS exports (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		format TEXT NOT NULL,
+		status TEXT NOT NULL,
+		filename TEXT,
+		content BLOB,
+		size INTEGER NOT NULL DEFAULT 0,
+		error TEXT,
+		created_at TIMESTAMP NOT NULL,
+		completed_at TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create exports table: %w", err)
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_exports_email ON exports (email, status)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to index exports: %w", err)
+	}
+
+	// Create TOTP tables (optional second factor; enabled_at is NULL until
+	// the user confirms a code, and backup codes are stored hashed)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS user_totp (
+		email TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		enabled_at TIMESTAMP,
+		last_step INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user_totp table: %w", err)
+	}
+
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS totp_backup_codes (
+		email TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at TIMESTAMP,
+		PRIMARY KEY (email, code_hash),
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create totp_backup_codes table: %w", err)
+	}
+
+	// Create WebAuthn tables (a random user handle per user, and passkeys
+	// stored as the library's credential JSON)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS webauthn_users (
+		email TEXT PRIMARY KEY,
+		user_handle BLOB NOT NULL UNIQUE,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webauthn_users table: %w", err)
+	}
+
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		name TEXT NOT NULL,
+		credential TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		last_used_at TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webauthn_credentials table: %w", err)
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_email ON webauthn_credentials (email)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to index webauthn_credentials: %w", err)
+	}
+
+	// Create activity log table (task changes, derived from board saves)
+	err = db.CreateTable(`CREATE TABLE IF NOT EXISTS activity_log (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		task_id TEXT NOT NULL,
+		action TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (email) REFERENCES users(email)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create activity_log table: %w", err)
+	}
+
+	if err := db.AddColumnIfMissing("activity_log", "detail", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, fmt.Errorf("failed to add activity_log.detail: %w", err)
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_activity_log_email ON activity_log (email, created_at)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to index activity_log: %w", err)
+	}
+
+	log.Printf("Database initialized successfully (%s)", db.Dialect())
 	return db, nil
 }
 
 type KanbanData struct {
+	Version          int64           `json:"version,omitempty"` // Bumped on every save
 	Columns          []Column        `json:"columns"`
+	Swimlanes        []Swimlane      `json:"swimlanes,omitempty"` // Optional rows crossing the columns
 	Tasks            []Task          `json:"tasks"`
 	UnassignedTasks  []Task          `json:"unassignedTasks,omitempty"` // For backward compatibility
 	UnassignedCollapsed bool          `json:"unassignedCollapsed"`
 }
 
 type Column struct {
-	ID       string `json:"id"`
-	Title    string `json:"title"`
-	Order    int    `json:"order"`
-	Deleted  bool   `json:"deleted,omitempty"`
-	Hidden   bool   `json:"hidden,omitempty"`
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Order       int    `json:"order"`
+	Deleted     bool   `json:"deleted,omitempty"`
+	Hidden      bool   `json:"hidden,omitempty"`
+	IsDone      bool   `json:"isDone,omitempty"`
+	WIPLimit    int    `json:"wipLimit,omitempty"` // Max tasks; 0 is unlimited
+	Color       string `json:"color,omitempty"`    // #rgb or #rrggbb
+	Description string `json:"description,omitempty"`
 }
 
 type Task struct {
-	ID          string  `json:"id"`
-	Title       string  `json:"title"`
-	Description string  `json:"description"`
-	DueDate     string  `json:"dueDate"`
-	Priority    *string `json:"priority"`
-	ColumnID    *string `json:"columnId"`
-	Deleted     bool    `json:"deleted,omitempty"`
-	Hidden      bool    `json:"hidden,omitempty"`
+	ID          string   `json:"id"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	DueDate     string   `json:"dueDate"`
+	Priority    *string  `json:"priority"`
+	ColumnID    *string  `json:"columnId"`
+	SwimlaneID  *string  `json:"swimlaneId,omitempty"`
+	Language    string   `json:"language,omitempty"` // BCP 47 code detected from the text
+	Labels      []string `json:"labels,omitempty"`
+	Deleted     bool     `json:"deleted,omitempty"`
+	Hidden      bool     `json:"hidden,omitempty"`
+
+	// Whether the task is done, whichever column it's in
+	Completed   bool       `json:"completed,omitempty"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+}
+
+// generateID creates an ID in the same format as the frontend's generateId
+func generateID() string {
+	const alphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+	suffix := make([]byte, 5)
+	for i := range suffix {
+		suffix[i] = alphabet[mathrand.Intn(len(alphabet))]
+	}
+	return strconv.FormatInt(time.Now().UnixMilli(), 36) + string(suffix)
 }
 
 // DataService handles database operations for user data
 type DataService struct {
-	db *sql.DB
+	db    *DB
+	cache *BoardCache
+	codec *BoardCodec
+
+	// Called with the user's email after each committed save
+	saveListeners []func(email string)
+
+	// Called with the task activity of each committed save that had any
+	activityListeners []func(email string, data *KanbanData, activity []TaskActivity)
+
+	// Batches full syncs that arrive close together
+	writes *WriteCoalescer
+
+	// Limits on board size and task count; zero values are unlimited
+	quotas QuotaConfig
+
+	// Edit locks writes are checked against, when set
+	locks *LockService
 }
 
-func NewDataService(db *sql.DB) *DataService {
-	return &DataService{db: db}
+func NewDataService(db *DB, codec *BoardCodec) *DataService {
+	s := &DataService{db: db, cache: NewBoardCache(), codec: codec}
+	s.writes = NewWriteCoalescer(s, 0, nil)
+	return s
 }
 
-// GetUserData retrieves a user's kanban data
-func (s *DataService) GetUserData(email string) (*KanbanData, error) {
-	row := s.db.QueryRow("SELECT data FROM user_data WHERE email = ?", email)
+// CoalesceWrites batches the writes made through CoalescedUpdate within
+// window of each other, calling publish once per saved batch. It must be
+// called before the service is used.
+func (s *DataService) CoalesceWrites(window time.Duration, publish func(email string, data *KanbanData)) {
+	s.writes = NewWriteCoalescer(s, window, publish)
+}
+
+// CoalescedUpdate is UpdateUserDataTx for writes that may be batched with
+// others to the same board; see WriteCoalescer.Update
+func (s *DataService) CoalescedUpdate(ctx context.Context, email string, fn func(tx *Tx, data *KanbanData) error) (*KanbanData, error) {
+	return s.writes.Update(ctx, email, s.lockChecked(ctx, email, fn))
+}
+
+// FlushWrites saves batched writes without waiting out their window
+func (s *DataService) FlushWrites(ctx context.Context) error {
+	return s.writes.Shutdown(ctx)
+}
+
+// rowQuerier is satisfied by both *DB and *Tx
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// GetUserData retrieves a user's kanban data. The query gives up when ctx
+// ends or after the configured query timeout.
+func (s *DataService) GetUserData(ctx context.Context, email string) (*KanbanData, error) {
+	if data, ok := s.cache.Get(email); ok {
+		return data, nil
+	}
+
+	ctx, cancel := s.db.WithQueryTimeout(ctx)
+	defer cancel()
+
+	generation := s.cache.Generation(email)
+	data, err := s.getUserData(ctx, s.db, email)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.Fill(email, data, generation)
+	return data, nil
+}
+
+func (s *DataService) getUserData(ctx context.Context, q rowQuerier, email string) (*KanbanData, error) {
+	row := q.QueryRowContext(ctx, "SELECT data, version FROM user_data WHERE email = ?", email)
 
 	var dataStr string
-	err := row.Scan(&dataStr)
+	var version int64
+	err := row.Scan(&dataStr, &version)
 	if err == sql.ErrNoRows {
 		// Return empty data if user has no data yet
 		return &KanbanData{
@@ -92,58 +634,196 @@ func (s *DataService) GetUserData(email string) (*KanbanData, error) {
 		return nil, fmt.Errorf("failed to query user data: %w", err)
 	}
 
-	var data KanbanData
-	if err := json.Unmarshal([]byte(dataStr), &data); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal user data: %w", err)
+	data, err := s.codec.Decode(dataStr)
+	if err != nil {
+		return nil, err
 	}
 
-	return &data, nil
+	data.Version = version
+	return data, nil
 }
 
-// SaveUserData saves or updates a user's kanban data
-func (s *DataService) SaveUserData(email string, data *KanbanData) error {
-	dataJSON, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("failed to marshal user data: %w", err)
-	}
+// SaveUserData saves or updates a user's kanban data. Like
+// UpdateUserDataTx, the transaction is rolled back if ctx ends or the
+// query timeout passes first.
+func (s *DataService) SaveUserData(ctx context.Context, email string, data *KanbanData) error {
+	ctx, cancel := s.db.WithQueryTimeout(ctx)
+	defer cancel()
 
 	// Begin transaction
-	tx, err := s.db.Begin()
+	tx, err := s.begin(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
+	activity, err := s.saveUserData(tx, email, data)
+	if err != nil {
+		return err
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		s.cache.Invalidate(email)
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.cache.Set(email, data)
+	s.notifySaved(email, data, activity)
+	return nil
+}
+
+// begin starts a board write. SQLite transactions take the write lock as
+// they begin, so that's where concurrent saves wait; if one waits out the
+// busy timeout it's retried, rather than failing the save.
+func (s *DataService) begin(ctx context.Context) (*Tx, error) {
+	var tx *Tx
+	err := retryBusy(ctx, func() error {
+		var err error
+		tx, err = s.db.BeginTx(ctx)
+		return err
+	})
+	return tx, err
+}
+
+// UpdateUserData applies fn to a user's kanban data and saves the result in
+// a single transaction. If fn returns an error nothing is written.
+func (s *DataService) UpdateUserData(ctx context.Context, email string, fn func(data *KanbanData) error) (*KanbanData, error) {
+	return s.UpdateUserDataTx(ctx, email, func(tx *Tx, data *KanbanData) error {
+		return fn(data)
+	})
+}
+
+// UpdateUserDataTx is UpdateUserData for callers that also write their own
+// rows in the same transaction. The transaction's queries run under ctx,
+// bounded by the configured query timeout; if either ends first it's
+// rolled back. Changes to what another client has locked fail with a
+// LockError.
+func (s *DataService) UpdateUserDataTx(ctx context.Context, email string, fn func(tx *Tx, data *KanbanData) error) (*KanbanData, error) {
+	return s.updateUserDataTx(ctx, email, s.lockChecked(ctx, email, fn))
+}
+
+// updateUserDataTx is UpdateUserDataTx without the lock check, for writes
+// checked already
+func (s *DataService) updateUserDataTx(ctx context.Context, email string, fn func(tx *Tx, data *KanbanData) error) (*KanbanData, error) {
+	ctx, cancel := s.db.WithQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	data, err := s.getUserData(ctx, tx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fn(tx, data); err != nil {
+		return nil, err
+	}
+
+	activity, err := s.saveUserData(tx, email, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.cache.Invalidate(email)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.cache.Set(email, data)
+	s.notifySaved(email, data, activity)
+	return data, nil
+}
+
+// OnSave registers a function called after every committed board save.
+// Listeners run synchronously and must not block; register them at startup.
+func (s *DataService) OnSave(listener func(email string)) {
+	s.saveListeners = append(s.saveListeners, listener)
+}
+
+// OnActivity registers a function called with the task activity of every
+// committed save. Like OnSave listeners, these must not block.
+func (s *DataService) OnActivity(listener func(email string, data *KanbanData, activity []TaskActivity)) {
+	s.activityListeners = append(s.activityListeners, listener)
+}
+
+func (s *DataService) notifySaved(email string, data *KanbanData, activity []TaskActivity) {
+	for _, listener := range s.saveListeners {
+		listener(email)
+	}
+	if len(activity) == 0 {
+		return
+	}
+	for _, listener := range s.activityListeners {
+		listener(email, data, activity)
+	}
+}
+
+// saveUserData writes a board and returns the task activity it recorded
+func (s *DataService) saveUserData(tx *Tx, email string, data *KanbanData) ([]TaskActivity, error) {
 	// Check if user exists, create if not
 	row := tx.QueryRow("SELECT email FROM users WHERE email = ?", email)
 	var existingEmail string
-	err = row.Scan(&existingEmail)
+	err := row.Scan(&existingEmail)
 	if err == sql.ErrNoRows {
 		// Create user
 		_, err = tx.Exec("INSERT INTO users (email) VALUES (?)", email)
 		if err != nil {
-			return fmt.Errorf("failed to insert user: %w", err)
+			return nil, fmt.Errorf("failed to insert user: %w", err)
 		}
 	} else if err != nil {
-		return fmt.Errorf("failed to query user: %w", err)
+		return nil, fmt.Errorf("failed to query user: %w", err)
 	}
 
-	// Upsert user data
-	_, err = tx.Exec(`
-		INSERT INTO user_data (email, data, updated_at) 
-		VALUES (?, ?, CURRENT_TIMESTAMP) 
+	// Detect task languages, stamp completions and log task activity
+	// against the stored version of the board
+	previous, err := s.getUserData(tx.ctx, tx, email)
+	if err != nil {
+		return nil, err
+	}
+	annotateTaskLanguages(previous, data)
+	stampTaskCompletion(previous, data, time.Now())
+	activity := diffTaskActivity(previous, data)
+	if err := recordActivity(tx, email, activity); err != nil {
+		return nil, err
+	}
+
+	// Deleted tasks go to the trash
+	if err := trashDeletedTasks(tx, email, data, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	if err := recordOpenTaskCount(tx, email, data); err != nil {
+		return nil, err
+	}
+
+	encoded, err := s.codec.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkBoardQuotas(tx, email, previous, data, encoded); err != nil {
+		return nil, err
+	}
+
+	// Upsert user data, bumping its version
+	row = tx.QueryRow(`
+		INSERT INTO user_data (email, data, version, updated_at) 
+		VALUES (?, ?, 1, CURRENT_TIMESTAMP) 
 		ON CONFLICT(email) DO UPDATE SET 
 			data = ?, 
+			version = user_data.version + 1,
 			updated_at = CURRENT_TIMESTAMP
-	`, email, string(dataJSON), string(dataJSON))
-	if err != nil {
-		return fmt.Errorf("failed to upsert user data: %w", err)
+		RETURNING version
+	`, email, encoded, encoded)
+	if err := row.Scan(&data.Version); err != nil {
+		return nil, fmt.Errorf("failed to upsert user data: %w", err)
 	}
-
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+	if err := recordBoardChanges(tx, email, previous, data); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return activity, nil
 }
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattn/go-sqlite3"
+)
+
+// dbBackupPrefix and dbBackupTimeFormat make up backup names, which sort
+// in the order they were taken
+const (
+	dbBackupPrefix     = "todo-"
+	dbBackupTimeFormat = "20060102T150405.000Z"
+)
+
+// errBackupNotFound is returned when restoring an unknown backup
+var errBackupNotFound = errors.New("backup not found")
+
+// DBBackupConfig configures backups of the SQLite database
+type DBBackupConfig struct {
+	// How often to back up; 0 leaves backups to the admin API and the
+	// "todo-app backup" command
+	Interval time.Duration
+	Storage  string // "local" or "s3"
+	Dir      string
+	S3Prefix string
+	Keep     int // Newest backups kept; older ones are deleted
+}
+
+// BackupStore holds database backups
+type BackupStore interface {
+	AttachmentStore
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// NewBackupStore returns the store selected by the configuration. S3
+// backups go to the attachments bucket.
+func NewBackupStore(cfg DBBackupConfig, s3 S3Config) (BackupStore, error) {
+	switch cfg.Storage {
+	case "local":
+		if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create backup directory: %w", err)
+		}
+		return &localAttachmentStore{dir: cfg.Dir}, nil
+	case "s3":
+		return newS3AttachmentStore(s3), nil
+	default:
+		return nil, fmt.Errorf("unknown backup storage %q", cfg.Storage)
+	}
+}
+
+// DBBackup is a stored backup of the database
+type DBBackup struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// DBBackupService takes online backups of the SQLite database with
+// VACUUM INTO, and restores them with SQLite's backup API
+type DBBackupService struct {
+	db          *DB
+	store       BackupStore
+	prefix      string
+	keep        int
+	migrator    *Migrator
+	dataService *DataService
+	hub         *Hub
+
+	// Serializes backups and restores
+	mu sync.Mutex
+}
+
+// NewDBBackupService creates the service. hub may be nil when restoring
+// from the command line.
+func NewDBBackupService(db *DB, store BackupStore, cfg DBBackupConfig, migrator *Migrator, dataService *DataService, hub *Hub) *DBBackupService {
+	prefix := ""
+	if cfg.Storage == "s3" {
+		prefix = cfg.S3Prefix
+	}
+	return &DBBackupService{
+		db:          db,
+		store:       store,
+		prefix:      prefix,
+		keep:        cfg.Keep,
+		migrator:    migrator,
+		dataService: dataService,
+		hub:         hub,
+	}
+}
+
+// Backup stores a copy of the database and deletes backups beyond the
+// retention count
+func (s *DBBackupService) Backup(ctx context.Context) (*DBBackup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backup(ctx)
+}
+
+func (s *DBBackupService) backup(ctx context.Context) (*DBBackup, error) {
+	// VACUUM INTO writes a consistent, compacted copy without blocking
+	// writers for long; it needs an empty or missing target file
+	tmp, err := os.CreateTemp("", "todo-backup-*.db")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backup file: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if _, err := s.db.Exec("VACUUM INTO ?", tmp.Name()); err != nil {
+		return nil, fmt.Errorf("failed to copy database: %w", err)
+	}
+
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat backup file: %w", err)
+	}
+
+	backup := &DBBackup{CreatedAt: time.Now().UTC().Truncate(time.Millisecond)}
+	backup.Name = dbBackupPrefix + backup.CreatedAt.Format(dbBackupTimeFormat) + ".db"
+	if err := s.store.Put(ctx, s.prefix+backup.Name, f, info.Size(), "application/vnd.sqlite3"); err != nil {
+		return nil, fmt.Errorf("failed to store backup: %w", err)
+	}
+	log.Printf("Backed up database to %s (%d bytes)", backup.Name, info.Size())
+
+	if err := s.prune(ctx); err != nil {
+		log.Printf("Error pruning database backups: %v", err)
+	}
+	return backup, nil
+}
+
+// List returns the stored backups, newest first
+func (s *DBBackupService) List(ctx context.Context) ([]DBBackup, error) {
+	keys, err := s.store.List(ctx, s.prefix+dbBackupPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	backups := []DBBackup{}
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, s.prefix)
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, dbBackupPrefix), ".db")
+		createdAt, err := time.Parse(dbBackupTimeFormat, stamp)
+		if err != nil {
+			continue // Not one of ours
+		}
+		backups = append(backups, DBBackup{Name: name, CreatedAt: createdAt})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// prune deletes the oldest backups beyond the retention count
+func (s *DBBackupService) prune(ctx context.Context) error {
+	backups, err := s.List(ctx)
+	if err != nil {
+		return err
+	}
+	for i := s.keep; i < len(backups); i++ {
+		if err := s.store.Delete(ctx, s.prefix+backups[i].Name); err != nil {
+			return fmt.Errorf("failed to delete backup %s: %w", backups[i].Name, err)
+		}
+		log.Printf("Deleted old database backup %s", backups[i].Name)
+	}
+	return nil
+}
+
+// Restore replaces the database's contents with a backup, after checking
+// the backup and taking a backup of the current database. Connected
+// clients are made to reconnect and reload their boards.
+func (s *DBBackupService) Restore(ctx context.Context, name string) (*DBBackup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backups, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, b := range backups {
+		found = found || b.Name == name
+	}
+	if !found {
+		return nil, errBackupNotFound
+	}
+
+	tmp, err := s.download(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+
+	if err := s.verify(tmp); err != nil {
+		return nil, fmt.Errorf("backup %s is unusable: %w", name, err)
+	}
+
+	safety, err := s.backup(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to back up the current database first: %w", err)
+	}
+
+	if err := s.copyInto(ctx, tmp); err != nil {
+		return nil, err
+	}
+	log.Printf("Restored database from %s; the previous state is in %s", name, safety.Name)
+
+	s.dataService.cache.Clear()
+	if s.hub != nil {
+		s.hub.Reconnect()
+	}
+	return safety, nil
+}
+
+// download copies a backup to a temporary file and returns its path
+func (s *DBBackupService) download(ctx context.Context, name string) (string, error) {
+	rc, err := s.store.Get(ctx, s.prefix+name)
+	if err != nil {
+		return "", fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer rc.Close()
+
+	f, err := os.CreateTemp("", "todo-restore-*.db")
+	if err != nil {
+		return "", fmt.Errorf("failed to create restore file: %w", err)
+	}
+	_, err = io.Copy(f, rc)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to download backup: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// verify checks a backup file's integrity, and that it wasn't migrated by
+// a newer build than this one
+func (s *DBBackupService) verify(path string) error {
+	backup, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	var result string
+	if err := backup.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("integrity check failed: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+
+	rows, err := backup.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		// Taken before migrations existed
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return err
+		}
+		if !s.migrator.Knows(version) {
+			return fmt.Errorf("it has migration %d, which this build doesn't know", version)
+		}
+	}
+	return rows.Err()
+}
+
+// copyInto overwrites the live database with a backup file using SQLite's
+// online backup API, which other connections see as a single change
+func (s *DBBackupService) copyInto(ctx context.Context, path string) error {
+	source, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	sourceConn, err := source.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer sourceConn.Close()
+	destConn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(dest any) error {
+		return sourceConn.Raw(func(src any) error {
+			backup, err := dest.(*sqlite3.SQLiteConn).Backup("main", src.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return fmt.Errorf("failed to start restore: %w", err)
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return fmt.Errorf("failed to restore: %w", err)
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// RunSchedule backs up the database every interval
+func (s *DBBackupService) RunSchedule(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := s.Backup(context.Background()); err != nil {
+			log.Printf("Error backing up database: %v", err)
+		}
+	}
+}
+
+// runBackupCommand runs "todo-app backup" and "todo-app restore NAME"
+func runBackupCommand(s *DBBackupService, args []string) error {
+	ctx := context.Background()
+	if args[0] == "backup" {
+		_, err := s.Backup(ctx)
+		return err
+	}
+
+	if len(args) < 2 {
+		backups, err := s.List(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println("usage: todo-app restore NAME; backups:")
+		for _, b := range backups {
+			fmt.Println(" ", b.Name)
+		}
+		return nil
+	}
+	_, err := s.Restore(ctx, args[1])
+	return err
+}
+
+// DBBackupHandler serves the admin backup API
+type DBBackupHandler struct {
+	backupService *DBBackupService
+}
+
+func NewDBBackupHandler(backupService *DBBackupService) *DBBackupHandler {
+	return &DBBackupHandler{backupService: backupService}
+}
+
+// List returns the stored backups, newest first
+func (h *DBBackupHandler) List(w http.ResponseWriter, r *http.Request) {
+	backups, err := h.backupService.List(r.Context())
+	if err != nil {
+		log.Printf("Error listing database backups: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"backups": backups,
+	})
+}
+
+// Create takes a backup now
+func (h *DBBackupHandler) Create(w http.ResponseWriter, r *http.Request) {
+	backup, err := h.backupService.Backup(r.Context())
+	if err != nil {
+		log.Printf("Error backing up database: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to back up database")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"backup": backup,
+	})
+}
+
+// Restore replaces the database with a backup
+func (h *DBBackupHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	safety, err := h.backupService.Restore(r.Context(), mux.Vars(r)["name"])
+	if err == errBackupNotFound {
+		writeError(w, http.StatusNotFound, "Backup not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error restoring database: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to restore backup: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":         "success",
+		"previousBackup": safety,
+	})
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func strPtr(s string) *string { return &s }
+
+// testBoard returns a board with a todo and a done column and one task
+func testBoard() *KanbanData {
+	return &KanbanData{
+		Columns: []Column{
+			{ID: "todo", Title: "To Do", Order: 0},
+			{ID: "done", Title: "Done", Order: 1, IsDone: true},
+		},
+		Tasks: []Task{
+			{ID: "t1", Title: "Write tests", ColumnID: strPtr("todo")},
+		},
+	}
+}
+
+func TestGetUserDataEmptyBoard(t *testing.T) {
+	s := newTestDataService(t)
+
+	data, err := s.GetUserData(context.Background(), "new@example.com")
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	if data.Version != 0 || len(data.Columns) != 0 || len(data.Tasks) != 0 {
+		t.Errorf("new user's board = %+v, want empty", data)
+	}
+	if data.Columns == nil || data.Tasks == nil {
+		t.Error("new user's board has nil slices, which encode as null")
+	}
+}
+
+func TestSaveUserDataRoundTrip(t *testing.T) {
+	s := newTestDataService(t)
+	ctx := context.Background()
+	email := "a@example.com"
+
+	if err := s.SaveUserData(ctx, email, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+	s.cache.Clear()
+
+	data, err := s.GetUserData(ctx, email)
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	if data.Version != 1 {
+		t.Errorf("version = %d, want 1", data.Version)
+	}
+	if len(data.Columns) != 2 || len(data.Tasks) != 1 || data.Tasks[0].Title != "Write tests" {
+		t.Errorf("board = %+v, want the saved board", data)
+	}
+}
+
+func TestUpdateUserDataBumpsVersion(t *testing.T) {
+	s := newTestDataService(t)
+	ctx := context.Background()
+	email := "a@example.com"
+
+	if err := s.SaveUserData(ctx, email, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+	for want := int64(2); want <= 3; want++ {
+		data, err := s.UpdateUserData(ctx, email, func(data *KanbanData) error {
+			data.Tasks[0].ColumnID = strPtr("done")
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("UpdateUserData: %v", err)
+		}
+		if data.Version != want {
+			t.Errorf("version = %d, want %d", data.Version, want)
+		}
+	}
+}
+
+func TestUpdateUserDataErrorWritesNothing(t *testing.T) {
+	s := newTestDataService(t)
+	ctx := context.Background()
+	email := "a@example.com"
+
+	if err := s.SaveUserData(ctx, email, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+	errRefused := errors.New("refused")
+	_, err := s.UpdateUserData(ctx, email, func(data *KanbanData) error {
+		data.Tasks = nil
+		return errRefused
+	})
+	if !errors.Is(err, errRefused) {
+		t.Fatalf("UpdateUserData error = %v, want %v", err, errRefused)
+	}
+
+	s.cache.Clear()
+	data, err := s.GetUserData(ctx, email)
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	if data.Version != 1 || len(data.Tasks) != 1 {
+		t.Errorf("board after failed update = version %d, %d tasks; want version 1, 1 task", data.Version, len(data.Tasks))
+	}
+}
+
+func TestSaveUserDataEnforcesQuotas(t *testing.T) {
+	s := newTestDataService(t)
+	ctx := context.Background()
+	email := "a@example.com"
+	s.EnforceQuotas(QuotaConfig{Tasks: 2})
+
+	addTask := func(data *KanbanData) error {
+		data.Tasks = append(data.Tasks, Task{ID: generateID(), Title: "More", ColumnID: strPtr("todo")})
+		return nil
+	}
+	if err := s.SaveUserData(ctx, email, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+	if _, err := s.UpdateUserData(ctx, email, addTask); err != nil {
+		t.Fatalf("adding a second task: %v", err)
+	}
+	var quotaErr *QuotaError
+	if _, err := s.UpdateUserData(ctx, email, addTask); !errors.As(err, &quotaErr) || quotaErr.Quota != QuotaTasks || quotaErr.Requested != 3 {
+		t.Fatalf("adding a third task: %v, want the tasks quota", err)
+	}
+
+	// Deleted tasks don't count
+	if _, err := s.UpdateUserData(ctx, email, func(data *KanbanData) error {
+		data.Tasks[0].Deleted = true
+		return addTask(data)
+	}); err != nil {
+		t.Errorf("replacing a task: %v", err)
+	}
+
+	// A board over a lowered limit can still be saved if it doesn't grow
+	s.EnforceQuotas(QuotaConfig{Tasks: 1, BoardBytes: 10})
+	if _, err := s.UpdateUserData(ctx, email, func(data *KanbanData) error {
+		data.Tasks[1].Title = "M"
+		return nil
+	}); err != nil {
+		t.Errorf("saving a board already over its quotas: %v", err)
+	}
+	if _, err := s.UpdateUserData(ctx, email, func(data *KanbanData) error {
+		data.Tasks[1].Description = "Longer than before"
+		return nil
+	}); !errors.As(err, &quotaErr) || quotaErr.Quota != QuotaBoardBytes {
+		t.Errorf("growing a board over its size quota: %v, want the board size quota", err)
+	}
+}
+
+func TestGetUserDataCaches(t *testing.T) {
+	s := newTestDataService(t)
+	ctx := context.Background()
+	email := "a@example.com"
+
+	if err := s.SaveUserData(ctx, email, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+	first, err := s.GetUserData(ctx, email)
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	// Callers may modify what they get without affecting the cache
+	first.Tasks[0].Title = "changed"
+
+	second, err := s.GetUserData(ctx, email)
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	if second.Tasks[0].Title != "Write tests" {
+		t.Errorf("cached title = %q, want %q", second.Tasks[0].Title, "Write tests")
+	}
+	if stats := s.cache.Stats(); stats.Hits != 2 || stats.Misses != 0 {
+		t.Errorf("cache hits/misses = %d/%d, want 2/0", stats.Hits, stats.Misses)
+	}
+}
+
+func TestBoardCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewBoardCache()
+	c.Limit(2, time.Minute)
+
+	c.Set("a", testBoard())
+	c.Set("b", testBoard())
+	c.Get("a")
+	c.Set("c", testBoard())
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("least recently used board b is still cached")
+	}
+	for _, email := range []string{"a", "c"} {
+		if _, ok := c.Get(email); !ok {
+			t.Errorf("board %s was evicted", email)
+		}
+	}
+	if stats := c.Stats(); stats.Evictions != 1 || stats.Entries != 2 {
+		t.Errorf("stats = %+v, want 1 eviction and 2 entries", stats)
+	}
+}
+
+func TestBoardCacheFillSkipsStaleReads(t *testing.T) {
+	c := NewBoardCache()
+	generation := c.Generation("a")
+
+	newer := testBoard()
+	newer.Version = 2
+	c.Set("a", newer)
+
+	stale := testBoard()
+	stale.Version = 1
+	c.Fill("a", stale, generation)
+
+	data, ok := c.Get("a")
+	if !ok || data.Version != 2 {
+		t.Errorf("cached board = %+v, want version 2", data)
+	}
+}
+
+func TestChangesSinceVersion(t *testing.T) {
+	s := newTestDataService(t)
+	ctx := context.Background()
+	email := "a@example.com"
+
+	if err := s.SaveUserData(ctx, email, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+	if _, err := s.UpdateUserData(ctx, email, func(data *KanbanData) error {
+		data.Tasks[0].ColumnID = strPtr("done")
+		data.Tasks = append(data.Tasks, Task{ID: "t2", Title: "Ship it", ColumnID: strPtr("todo")})
+		return nil
+	}); err != nil {
+		t.Fatalf("UpdateUserData: %v", err)
+	}
+	if _, err := s.UpdateUserData(ctx, email, func(data *KanbanData) error {
+		data.Tasks = data.Tasks[1:]
+		return nil
+	}); err != nil {
+		t.Fatalf("UpdateUserData: %v", err)
+	}
+
+	changes, err := s.Changes(ctx, email, 1, time.Time{})
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	if changes.Version != 3 {
+		t.Errorf("version = %d, want 3", changes.Version)
+	}
+	if len(changes.Columns) != 0 {
+		t.Errorf("columns = %+v, want none changed", changes.Columns)
+	}
+	if len(changes.Tasks) != 1 || changes.Tasks[0].ID != "t2" {
+		t.Errorf("tasks = %+v, want t2", changes.Tasks)
+	}
+	if len(changes.Tombstones) != 1 || changes.Tombstones[0].ID != "t1" || changes.Tombstones[0].Version != 3 {
+		t.Errorf("tombstones = %+v, want t1 at version 3", changes.Tombstones)
+	}
+}
+
+func TestCoalescedUpdateBatchesWrites(t *testing.T) {
+	s := newTestDataService(t)
+	email := "a@example.com"
+	if err := s.SaveUserData(context.Background(), email, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+
+	var mu sync.Mutex
+	var published []int64
+	s.CoalesceWrites(50*time.Millisecond, func(email string, data *KanbanData) {
+		mu.Lock()
+		published = append(published, data.Version)
+		mu.Unlock()
+	})
+
+	// The first write goes straight through; the rest wait out the window
+	// and are saved together
+	const writes = 5
+	var wg sync.WaitGroup
+	errs := make([]error, writes)
+	for i := 0; i < writes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = s.CoalescedUpdate(context.Background(), email, func(tx *Tx, data *KanbanData) error {
+				data.Tasks = append(data.Tasks, Task{ID: generateID(), Title: "task"})
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("CoalescedUpdate: %v", err)
+		}
+	}
+
+	data, err := s.GetUserData(context.Background(), email)
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	if len(data.Tasks) != 1+writes {
+		t.Errorf("%d tasks, want %d", len(data.Tasks), 1+writes)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(published) >= writes {
+		t.Errorf("published %d times for %d writes, want fewer", len(published), writes)
+	}
+	if last := published[len(published)-1]; last != data.Version {
+		t.Errorf("last published version = %d, want %d", last, data.Version)
+	}
+}
+
+func TestCoalescedUpdateIsolatesFailures(t *testing.T) {
+	s := newTestDataService(t)
+	email := "a@example.com"
+	s.CoalesceWrites(50*time.Millisecond, nil)
+
+	errRefused := errors.New("refused")
+	var wg sync.WaitGroup
+	var okErr, failErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, okErr = s.CoalescedUpdate(context.Background(), email, func(tx *Tx, data *KanbanData) error {
+			data.Tasks = append(data.Tasks, Task{ID: "kept", Title: "kept"})
+			return nil
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		_, failErr = s.CoalescedUpdate(context.Background(), email, func(tx *Tx, data *KanbanData) error {
+			data.Tasks = append(data.Tasks, Task{ID: "undone", Title: "undone"})
+			return errRefused
+		})
+	}()
+	wg.Wait()
+
+	if okErr != nil {
+		t.Errorf("successful write failed: %v", okErr)
+	}
+	if !errors.Is(failErr, errRefused) {
+		t.Errorf("failed write error = %v, want %v", failErr, errRefused)
+	}
+	data, err := s.GetUserData(context.Background(), email)
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	if len(data.Tasks) != 1 || data.Tasks[0].ID != "kept" {
+		t.Errorf("tasks = %+v, want only the successful write's", data.Tasks)
+	}
+}
+
+func TestFlushWritesSavesPending(t *testing.T) {
+	s := newTestDataService(t)
+	email := "a@example.com"
+	s.CoalesceWrites(time.Hour, nil)
+
+	// The first write goes through at once and starts the hour's window
+	if _, err := s.CoalescedUpdate(context.Background(), email, func(tx *Tx, data *KanbanData) error {
+		data.Tasks = append(data.Tasks, Task{ID: "first"})
+		return nil
+	}); err != nil {
+		t.Fatalf("CoalescedUpdate: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.CoalescedUpdate(context.Background(), email, func(tx *Tx, data *KanbanData) error {
+			data.Tasks = append(data.Tasks, Task{ID: "second"})
+			return nil
+		})
+		done <- err
+	}()
+	// Wait for the second write to be queued
+	for {
+		s.writes.mu.Lock()
+		queued := len(s.writes.users[email].pending)
+		s.writes.mu.Unlock()
+		if queued > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.FlushWrites(ctx); err != nil {
+		t.Fatalf("FlushWrites: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("queued write: %v", err)
+	}
+}
+
+// BenchmarkConcurrentSaves saves boards from many goroutines at once, as
+// concurrent syncs do, into a SQLite file with the server's pool settings
+func BenchmarkConcurrentSaves(b *testing.B) {
+	s := newDataServiceOn(b, openTestDB(b, filepath.Join(b.TempDir(), "bench.db")))
+	var next atomic.Int64
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		email := fmt.Sprintf("user%d@example.com", next.Add(1)%8)
+		board := testBoard()
+		for pb.Next() {
+			if err := s.SaveUserData(context.Background(), email, board); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkCoalescedUpdate writes one board from many goroutines at once,
+// as when dragging cards, with and without a coalescing window
+func BenchmarkCoalescedUpdate(b *testing.B) {
+	for _, window := range []time.Duration{0, 10 * time.Millisecond} {
+		b.Run(fmt.Sprintf("window=%s", window), func(b *testing.B) {
+			s := newDataServiceOn(b, openTestDB(b, filepath.Join(b.TempDir(), "bench.db")))
+			s.CoalesceWrites(window, nil)
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, err := s.CoalescedUpdate(context.Background(), "a@example.com", func(tx *Tx, data *KanbanData) error {
+						data.UnassignedCollapsed = !data.UnassignedCollapsed
+						return nil
+					})
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestChangeEmailMergesAccounts(t *testing.T) {
+	s := newTestDataService(t)
+	auth := newTestAuthService()
+	hub := NewHub()
+	go hub.Run()
+	accounts := NewAccountService(s.db, auth, s, nil, hub)
+	ctx := context.Background()
+	from, to := "a@example.com", "b@example.com"
+
+	if err := s.SaveUserData(ctx, from, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+	existing := testBoard()
+	existing.Tasks[0].Title = "Write more tests"
+	existing.Tasks = append(existing.Tasks, Task{ID: "t2", Title: "Ship it", ColumnID: strPtr("done")})
+	if err := s.SaveUserData(ctx, to, existing); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+	for _, email := range []string{from, to} {
+		if _, err := s.db.Exec("INSERT INTO user_settings (email, settings) VALUES (?, '{}')", email); err != nil {
+			t.Fatalf("inserting settings: %v", err)
+		}
+	}
+
+	token, err := auth.CreateStateToken(from, emailChangePurpose(to), emailChangeTTL)
+	if err != nil {
+		t.Fatalf("CreateStateToken: %v", err)
+	}
+	if _, err := accounts.ChangeEmail(ctx, from, "c@example.com", token, true); err != errEmailChangeToken {
+		t.Errorf("ChangeEmail to another address: %v, want %v", err, errEmailChangeToken)
+	}
+	if _, err := accounts.ChangeEmail(ctx, from, to, token, false); err != errAccountExists {
+		t.Errorf("ChangeEmail without merge: %v, want %v", err, errAccountExists)
+	}
+
+	change, err := accounts.ChangeEmail(ctx, from, to, token, true)
+	if err != nil {
+		t.Fatalf("ChangeEmail: %v", err)
+	}
+	if !change.Merged || change.Dropped["user_settings"] != 1 {
+		t.Errorf("change = %+v, want a merge dropping the old settings", change)
+	}
+	if len(change.Conflicts) != 1 || change.Conflicts[0].Field != "title" || change.Conflicts[0].Resolution != resolutionExisting {
+		t.Errorf("conflicts = %+v, want t1's title kept from the existing account", change.Conflicts)
+	}
+
+	data, err := s.GetUserData(ctx, to)
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	if len(data.Tasks) != 2 || data.Tasks[0].Title != "Write more tests" {
+		t.Errorf("merged tasks = %+v, want t1 as the existing account has it and t2", data.Tasks)
+	}
+	var rows int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM user_data WHERE email = ?", from).Scan(&rows); err != nil || rows != 0 {
+		t.Errorf("old board rows = %d, %v, want none", rows, err)
+	}
+	var revoked sql.NullTime
+	if err := s.db.QueryRow("SELECT sessions_revoked_at FROM users WHERE email = ?", from).Scan(&revoked); err != nil || !revoked.Valid {
+		t.Errorf("old sessions_revoked_at = %v, %v, want set", revoked, err)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Reliable delivery for WebSocket connections:
+//
+//	GET /api/ws?session=<session id>&seq=<last seq received>
+//
+// A connection opens with
+//
+//	server -> client  {"type": "session", "data": {"id": "...", "resumed": true, "missed": false}}
+//
+// after which the board messages it's sent carry "seq", numbered from 1 in
+// the session. The client acknowledges the messages it has applied:
+//
+//	client -> server  {"type": "ack", "data": {"seq": 12}}
+//
+// and the hub keeps the ones after the last acknowledged, up to
+// wsReplaySize. When the connection drops, the session is kept for
+// wsSessionTTL. A connection that names it in the meantime resumes it: it
+// rejoins the session's boards, and after the session message gets the
+// messages after its seq, including the board messages published while it
+// was away. "missed" is true when some of those are no longer kept, and
+// the client should reload the board. A session that's unknown, expired,
+// another user's or still in use starts a new one, with "resumed" false.
+// Other replies, such as pongs and errors, have no seq and aren't replayed.
+// Sessions live in the hub's memory, so a client that reconnects to another
+// instance or after a restart starts over.
+
+const (
+	// Messages kept per delivery session that the client hasn't acknowledged
+	wsReplaySize = 256
+
+	// How long a delivery session is kept after its connection closes
+	wsSessionTTL = 2 * time.Minute
+)
+
+// resumption is the delivery session a WebSocket client asks to resume
+type resumption struct {
+	session string
+	after   uint64
+}
+
+// sequenced is a message sent in a delivery session, with its seq added
+type sequenced struct {
+	seq     uint64
+	payload []byte
+}
+
+// deliverySession numbers a WebSocket client's board messages and keeps
+// those it hasn't acknowledged. Only touched by the Run loop.
+type deliverySession struct {
+	id     string
+	email  string
+	client *Client // nil while no connection has the session
+
+	seq     uint64      // Last seq sent
+	acked   uint64      // Last seq acknowledged
+	pending []sequenced // Sent after acked, oldest first
+
+	// Set when the connection closes: the boards to rejoin, the hub's last
+	// event ID at the time, and the time
+	boards    map[string]bool
+	viewing   string
+	lastEvent uint64
+	detached  time.Time
+}
+
+// SessionPayload is the payload of the "session" message that opens a
+// WebSocket connection
+type SessionPayload struct {
+	ID      string `json:"id"`
+	Resumed bool   `json:"resumed"`
+	Missed  bool   `json:"missed"`
+}
+
+// AckPayload is the payload of an "ack" message
+type AckPayload struct {
+	Seq uint64 `json:"seq"`
+}
+
+// ack is a client's acknowledgement on its way to the Run loop
+type ack struct {
+	client *Client
+	seq    uint64
+}
+
+// ResumeDelivery has the hub number the client's board messages and keep
+// them until they're acknowledged, resuming the named delivery session if
+// it can. It must be called before Register.
+func (c *Client) ResumeDelivery(session string, after uint64) {
+	c.resume = &resumption{session: session, after: after}
+}
+
+// withSeq adds "seq" to a marshalled WebSocketMessage
+func withSeq(payload []byte, seq uint64) []byte {
+	stamped := make([]byte, 0, len(payload)+24)
+	stamped = append(stamped, `{"seq":`...)
+	stamped = strconv.AppendUint(stamped, seq, 10)
+	if len(payload) > 2 {
+		stamped = append(stamped, ',')
+	}
+	return append(stamped, payload[1:]...)
+}
+
+// next numbers a board message for the session and keeps it until it's
+// acknowledged, dropping the oldest kept message when there are too many
+func (s *deliverySession) next(payload []byte) []byte {
+	s.seq++
+	stamped := withSeq(payload, s.seq)
+	if len(s.pending) == wsReplaySize {
+		copy(s.pending, s.pending[1:])
+		s.pending = s.pending[:len(s.pending)-1]
+	}
+	s.pending = append(s.pending, sequenced{seq: s.seq, payload: stamped})
+	return stamped
+}
+
+// ack forgets the messages up to seq
+func (s *deliverySession) ack(seq uint64) {
+	if seq <= s.acked || seq > s.seq {
+		return
+	}
+	s.acked = seq
+	i := 0
+	for i < len(s.pending) && s.pending[i].seq <= seq {
+		i++
+	}
+	s.pending = append(s.pending[:0], s.pending[i:]...)
+}
+
+// attachSession starts or resumes a WebSocket client's delivery session,
+// then queues the session message and whatever the client missed. Only
+// called from the Run loop, after the client has joined its rooms.
+func (h *Hub) attachSession(client *Client) {
+	h.expireSessions(time.Now())
+	if client.resume == nil {
+		return
+	}
+
+	session := h.sessions[client.resume.session]
+	resumed := session != nil && session.email == client.email && session.client == nil
+	if !resumed {
+		id, err := randomToken()
+		if err != nil {
+			log.Printf("Error starting delivery session for %s: %v", client.email, err)
+			return
+		}
+		session = &deliverySession{id: id, email: client.email}
+		h.sessions[id] = session
+	}
+	session.client = client
+	client.session = session
+
+	var replay [][]byte
+	missed := false
+	if resumed {
+		replay, missed = h.catchUp(session, client.resume.after)
+	}
+	client.Send(WebSocketMessage{Type: "session", Data: SessionPayload{ID: session.id, Resumed: resumed, Missed: missed}})
+	for _, payload := range replay {
+		h.deliver(client, outbound{payload: payload})
+	}
+	h.replayed.Add(uint64(len(replay)))
+}
+
+// catchUp puts a resuming client back on its session's boards and numbers
+// the board messages published since the session's connection closed. It
+// returns the kept messages after seq after; missed is true when some of
+// the messages after it are no longer kept. Only called from the Run loop.
+func (h *Hub) catchUp(session *deliverySession, after uint64) (replay [][]byte, missed bool) {
+	client := session.client
+	for board := range session.boards {
+		// Access may have been taken away in the meantime
+		if h.BoardRole(client.email, board) < BoardRoleViewer {
+			continue
+		}
+		client.boards[board] = true
+		join(h.rooms, board, client)
+	}
+	if client.boards[session.viewing] {
+		client.viewing = session.viewing
+	}
+
+	if session.lastEvent < h.lastEvent && len(h.history) > 0 && h.history[0].id > session.lastEvent+1 {
+		missed = true
+	}
+	for _, event := range h.history {
+		if event.id > session.lastEvent && client.boards[event.board] {
+			session.next(event.payload)
+		}
+	}
+
+	// The client may not have heard back about its last acks, but it can't
+	// have received messages that were never sent
+	after = max(after, session.acked)
+	if after >= session.seq {
+		return nil, missed
+	}
+	if len(session.pending) == 0 || session.pending[0].seq > after+1 {
+		missed = true
+	}
+	for _, message := range session.pending {
+		if message.seq > after {
+			replay = append(replay, message.payload)
+		}
+	}
+	return replay, missed
+}
+
+// detachSession keeps a closing client's delivery session for it to
+// resume. Only called from the Run loop.
+func (h *Hub) detachSession(client *Client) {
+	session := client.session
+	if session == nil || session.client != client {
+		return
+	}
+	session.client = nil
+	session.boards = client.boards
+	session.viewing = client.viewing
+	session.lastEvent = h.lastEvent
+	session.detached = time.Now()
+}
+
+// endSessions drops a user's delivery sessions, so that nothing is replayed
+// to a connection opened after their sessions were revoked. Only called
+// from the Run loop.
+func (h *Hub) endSessions(email string) {
+	for id, session := range h.sessions {
+		if session.email == email {
+			delete(h.sessions, id)
+		}
+	}
+}
+
+// expireSessions drops delivery sessions whose connection closed more than
+// wsSessionTTL ago. Only called from the Run loop.
+func (h *Hub) expireSessions(now time.Time) {
+	for id, session := range h.sessions {
+		if session.client == nil && now.Sub(session.detached) > wsSessionTTL {
+			delete(h.sessions, id)
+		}
+	}
+}
+
+func validateAck(message WebSocketMessage) error {
+	var payload AckPayload
+	if err := decodeMessageData(message, &payload); err != nil || payload.Seq == 0 {
+		return errors.New("invalid ack message")
+	}
+	return nil
+}
+
+// handleAck passes a client's acknowledgement to the Run loop
+func (h *Hub) handleAck(c *Client, message WebSocketMessage) {
+	var payload AckPayload
+	decodeMessageData(message, &payload) // Checked by validateAck
+	h.acks <- ack{client: c, seq: payload.Seq}
+}
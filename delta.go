@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// Delta sync protocol over the WebSocket connection:
+//
+//	client -> server  {"type": "ops", "board": "...", "data": {"requestId": "...", "ops": [Operation...]}}
+//	server -> sender  {"type": "ack", "data": {"requestId": "...", "version": n, "ops": [...]}}
+//	                  {"type": "nack", "data": {"requestId": "...", "version": n, "error": {...}}}
+//	server -> others  {"type": "delta", "board": "...", "data": {"version": n, "ops": [...]}}
+//	client -> server  {"type": "resync"}
+//	server -> sender  {"type": "state", "data": {"version": n, "board": KanbanData}}
+//
+// Operations are applied atomically to the stored board; only the applied
+// operations (with server-assigned IDs filled in) are relayed. A client that
+// reconnects, or sees a gap in delta versions, sends "resync" to receive the
+// full board. "board" defaults to the user's own board; other subscribers
+// of the board's channel receive the deltas. Users the delta_sync feature
+// flag is off for get a "delta sync disabled" nack and keep to full syncs.
+
+// OpsRequest is the payload of an "ops" message
+type OpsRequest struct {
+	RequestID string      `json:"requestId"`
+	Ops       []Operation `json:"ops"`
+}
+
+// DeltaPayload is the payload of "ack" and "delta" messages
+type DeltaPayload struct {
+	RequestID string      `json:"requestId,omitempty"`
+	Version   int64       `json:"version"`
+	Ops       []Operation `json:"ops"`
+}
+
+// NackPayload is the payload of a "nack" message
+type NackPayload struct {
+	RequestID string          `json:"requestId,omitempty"`
+	Version   int64           `json:"version"`
+	Error     *OperationError `json:"error"`
+}
+
+// StatePayload is the payload of a "state" message. Board is left out of
+// the state a WebSocket connection opens with unless it asked for it.
+type StatePayload struct {
+	Version int64       `json:"version"`
+	Board   *KanbanData `json:"board,omitempty"`
+}
+
+// decodeMessageData converts a message's generic data into v
+func decodeMessageData(message WebSocketMessage, v any) error {
+	raw, err := json.Marshal(message.Data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// registerDeltaHandlers wires the delta protocol message types into the hub
+func (h *DataHandler) registerDeltaHandlers() {
+	// ops checks the role itself so the nack carries the request ID
+	h.hub.Handle("ops", MessageSpec{MaxSize: maxMessageSize, Handler: h.handleOpsMessage})
+	h.hub.Handle("resync", MessageSpec{Role: BoardRoleViewer, Handler: h.handleResyncMessage})
+}
+
+// handleOpsMessage applies a client's operations and relays the delta
+func (h *DataHandler) handleOpsMessage(client *Client, message WebSocketMessage) {
+	boardID := canonicalBoardID(client.email, message.Board)
+	if h.hub.BoardRole(client.email, boardID) < BoardRoleEditor {
+		client.Send(WebSocketMessage{Type: "nack", Board: message.Board, Data: NackPayload{
+			Error: &OperationError{Index: -1, Err: "forbidden"},
+		}})
+		return
+	}
+
+	var req OpsRequest
+	if !h.flags.Enabled(client.email, FlagDeltaSync) {
+		// The client falls back to full syncs
+		decodeMessageData(message, &req)
+		client.Send(WebSocketMessage{Type: "nack", Data: NackPayload{
+			RequestID: req.RequestID,
+			Error:     &OperationError{Index: -1, Err: "delta sync disabled"},
+		}})
+		return
+	}
+	if err := decodeMessageData(message, &req); err != nil || len(req.Ops) == 0 {
+		client.Send(WebSocketMessage{Type: "nack", Data: NackPayload{
+			RequestID: req.RequestID,
+			Error:     &OperationError{Index: -1, Err: "invalid ops message"},
+		}})
+		return
+	}
+
+	ctx, cancel := h.dataService.db.WithQueryTimeout(withClientID(client.Context(), client.clientID))
+	defer cancel()
+	data, err := h.dataService.UpdateUserData(ctx, boardID, func(data *KanbanData) error {
+		return applyOperations(data, req.Ops)
+	})
+
+	var opErr *OperationError
+	if errors.As(err, &opErr) {
+		// Tell the client the current version so it can resync
+		current, _ := h.dataService.GetUserData(ctx, boardID)
+		nack := NackPayload{RequestID: req.RequestID, Error: opErr}
+		if current != nil {
+			nack.Version = current.Version
+		}
+		client.Send(WebSocketMessage{Type: "nack", Data: nack})
+		return
+	}
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		client.Send(WebSocketMessage{Type: "nack", Data: NackPayload{
+			RequestID: req.RequestID,
+			Error:     &OperationError{Index: -1, Err: quotaErr.Error(), Code: "quota_exceeded"},
+		}})
+		return
+	}
+	var lockErr *LockError
+	if errors.As(err, &lockErr) {
+		client.Send(WebSocketMessage{Type: "nack", Data: NackPayload{
+			RequestID: req.RequestID,
+			Error:     &OperationError{Index: -1, Err: lockErr.Error(), Code: "locked"},
+		}})
+		return
+	}
+	if err != nil {
+		log.Printf("Error applying ops to board %s: %v", boardID, err)
+		client.Send(WebSocketMessage{Type: "nack", Data: NackPayload{
+			RequestID: req.RequestID,
+			Error:     &OperationError{Index: -1, Err: "server error"},
+		}})
+		return
+	}
+
+	client.Send(WebSocketMessage{Type: "ack", Data: DeltaPayload{
+		RequestID: req.RequestID,
+		Version:   data.Version,
+		Ops:       req.Ops,
+	}})
+
+	h.hub.PublishBoard(boardID, WebSocketMessage{Type: "delta", Data: DeltaPayload{
+		Version: data.Version,
+		Ops:     req.Ops,
+	}}, client)
+}
+
+// handleResyncMessage sends the full board to a client
+func (h *DataHandler) handleResyncMessage(client *Client, message WebSocketMessage) {
+	h.sendState(client, canonicalBoardID(client.email, message.Board), true)
+}
+
+// sendState sends a client a "state" message with the board's version, and
+// with the board itself when full is set
+func (h *DataHandler) sendState(client *Client, boardID string, full bool) {
+	ctx, cancel := h.dataService.db.WithQueryTimeout(client.Context())
+	defer cancel()
+	data, err := h.dataService.GetUserData(ctx, boardID)
+	if err != nil {
+		log.Printf("Error getting board %s for state message: %v", boardID, err)
+		return
+	}
+
+	payload := StatePayload{Version: data.Version}
+	if full {
+		payload.Board = data
+	}
+	client.Send(WebSocketMessage{Type: "state", Board: boardID, Data: payload})
+}
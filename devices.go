@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// maxBatchChanges caps the number of queued changes accepted in one batch
+const maxBatchChanges = 500
+
+// Device is a client installation that queues changes while offline
+type Device struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastSyncAt *time.Time `json:"lastSyncAt,omitempty"`
+}
+
+// errDeviceNotFound is returned when a device doesn't exist or belongs to
+// another user
+var errDeviceNotFound = errors.New("device not found")
+
+// QueuedChange is one operation a device recorded, with the device's clock
+// time of the change
+type QueuedChange struct {
+	ClientTimestamp time.Time `json:"clientTimestamp"`
+	Operation       Operation `json:"operation"`
+}
+
+// Batch change outcomes
+const (
+	ChangeApplied  = "applied"
+	ChangeConflict = "conflict"
+	ChangeFailed   = "failed"
+)
+
+// ChangeResult reports the outcome of one queued change, by its index in
+// the submitted batch
+type ChangeResult struct {
+	Index     int        `json:"index"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	Operation *Operation `json:"operation,omitempty"`
+
+	// Set when the change would overfill a column
+	WIPLimit *WIPLimitError `json:"wipLimit,omitempty"`
+}
+
+// itemClock records the last batch-synced change to an item
+type itemClock struct {
+	deviceID  string
+	changedAt time.Time
+}
+
+// DeviceService registers devices and applies their queued changes
+type DeviceService struct {
+	db          *DB
+	dataService *DataService
+}
+
+func NewDeviceService(db *DB, dataService *DataService) *DeviceService {
+	return &DeviceService{db: db, dataService: dataService}
+}
+
+// Register creates a new device for a user
+func (s *DeviceService) Register(email, name string) (*Device, error) {
+	if err := ensureUser(s.db, email); err != nil {
+		return nil, err
+	}
+
+	id := generateID()
+	_, err := s.db.Exec(`
+		INSERT INTO devices (id, email, name, created_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	`, id, email, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register device: %w", err)
+	}
+
+	return s.Get(email, id)
+}
+
+// Get returns one of a user's devices
+func (s *DeviceService) Get(email, id string) (*Device, error) {
+	row := s.db.QueryRow(`
+		SELECT id, name, created_at, last_sync_at
+		FROM devices WHERE id = ? AND email = ?
+	`, id, email)
+
+	var device Device
+	var lastSync sql.NullTime
+	err := row.Scan(&device.ID, &device.Name, &device.CreatedAt, &lastSync)
+	if err == sql.ErrNoRows {
+		return nil, errDeviceNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device: %w", err)
+	}
+
+	if lastSync.Valid {
+		device.LastSyncAt = &lastSync.Time
+	}
+	return &device, nil
+}
+
+// List returns a user's devices
+func (s *DeviceService) List(email string) ([]Device, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, created_at, last_sync_at
+		FROM devices WHERE email = ? ORDER BY created_at
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query devices: %w", err)
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var device Device
+		var lastSync sql.NullTime
+		if err := rows.Scan(&device.ID, &device.Name, &device.CreatedAt, &lastSync); err != nil {
+			return nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+		if lastSync.Valid {
+			device.LastSyncAt = &lastSync.Time
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// operationItemID returns the task, column or swimlane an operation changes
+func operationItemID(op *Operation) string {
+	switch op.Type {
+	case OpCreateColumn, OpUpdateColumn, OpDeleteColumn:
+		return op.ColumnID
+	case OpCreateSwimlane, OpUpdateSwimlane, OpDeleteSwimlane:
+		return op.SwimlaneID
+	default:
+		return op.TaskID
+	}
+}
+
+// loadItemClock returns the clock for an item, or nil if it has none
+func loadItemClock(tx *Tx, email, itemID string) (*itemClock, error) {
+	var clock itemClock
+	err := tx.QueryRow(`
+		SELECT device_id, changed_at FROM item_clocks WHERE email = ? AND item_id = ?
+	`, email, itemID).Scan(&clock.deviceID, &clock.changedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query item clock: %w", err)
+	}
+	return &clock, nil
+}
+
+// ApplyBatch applies a device's queued changes in client timestamp order.
+// Each change succeeds or fails on its own. A change conflicts, and is
+// skipped, when another device has since changed the same item at a later
+// time. Timestamps in the future are clamped to the server's clock so a
+// skewed device can't win every conflict. The changes apply to board, the
+// user's own or a workspace board.
+func (s *DeviceService) ApplyBatch(ctx context.Context, email, board, deviceID string, changes []QueuedChange) (*KanbanData, []ChangeResult, error) {
+	if _, err := s.Get(email, deviceID); err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now().UTC()
+	order := make([]int, len(changes))
+	for i := range changes {
+		order[i] = i
+		ts := changes[i].ClientTimestamp.UTC()
+		if ts.IsZero() || ts.After(now) {
+			ts = now
+		}
+		changes[i].ClientTimestamp = ts
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return changes[order[a]].ClientTimestamp.Before(changes[order[b]].ClientTimestamp)
+	})
+
+	results := make([]ChangeResult, len(changes))
+	data, err := s.dataService.UpdateUserDataTx(ctx, board, func(tx *Tx, data *KanbanData) error {
+		for _, i := range order {
+			change := &changes[i]
+			op := &change.Operation
+			results[i] = ChangeResult{Index: i}
+
+			if itemID := operationItemID(op); itemID != "" {
+				clock, err := loadItemClock(tx, board, itemID)
+				if err != nil {
+					return err
+				}
+				if clock != nil && clock.deviceID != deviceID && clock.changedAt.After(change.ClientTimestamp) {
+					results[i].Status = ChangeConflict
+					results[i].Error = "item was changed on another device"
+					continue
+				}
+			}
+
+			if err := applyOperation(data, op); err != nil {
+				results[i].Status = ChangeFailed
+				results[i].Error = err.Error()
+				errors.As(err, &results[i].WIPLimit)
+				continue
+			}
+
+			// Create operations only know their item ID once applied
+			_, err := tx.Exec(`
+				INSERT INTO item_clocks (email, item_id, device_id, changed_at)
+				VALUES (?, ?, ?, ?)
+				ON CONFLICT(email, item_id) DO UPDATE SET
+					device_id = excluded.device_id,
+					changed_at = excluded.changed_at
+			`, board, operationItemID(op), deviceID, change.ClientTimestamp)
+			if err != nil {
+				return fmt.Errorf("failed to record item clock: %w", err)
+			}
+
+			results[i].Status = ChangeApplied
+			results[i].Operation = op
+		}
+
+		_, err := tx.Exec("UPDATE devices SET last_sync_at = CURRENT_TIMESTAMP WHERE id = ?", deviceID)
+		if err != nil {
+			return fmt.Errorf("failed to update device: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, results, nil
+}
+
+// DeviceHandler exposes device registration and batch sync over HTTP
+type DeviceHandler struct {
+	deviceService *DeviceService
+	hub           *Hub
+}
+
+func NewDeviceHandler(deviceService *DeviceService, hub *Hub) *DeviceHandler {
+	return &DeviceHandler{deviceService: deviceService, hub: hub}
+}
+
+// Register creates a device and returns its ID
+func (h *DeviceHandler) Register(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	device, err := h.deviceService.Register(requestEmail(r), req.Name)
+	if err != nil {
+		log.Printf("Error registering device: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to register device")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"device": device,
+	})
+}
+
+// List returns the user's devices
+func (h *DeviceHandler) List(w http.ResponseWriter, r *http.Request) {
+	devices, err := h.deviceService.List(requestEmail(r))
+	if err != nil {
+		log.Printf("Error listing devices: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"devices": devices,
+	})
+}
+
+// SyncBatch applies a device's queued changes to the user's board, or the
+// workspace board named by ?board=, and reports each outcome
+func (h *DeviceHandler) SyncBatch(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+	board := canonicalBoardID(email, queryBoard(r))
+
+	var req struct {
+		DeviceID string         `json:"deviceId"`
+		Changes  []QueuedChange `json:"changes"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.DeviceID == "" {
+		writeError(w, http.StatusBadRequest, "deviceId is required")
+		return
+	}
+	if len(req.Changes) > maxBatchChanges {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d changes per batch", maxBatchChanges))
+		return
+	}
+
+	data, results, err := h.deviceService.ApplyBatch(r.Context(), email, board, req.DeviceID, req.Changes)
+	if err == errDeviceNotFound {
+		writeError(w, http.StatusNotFound, "Unknown device")
+		return
+	}
+	if err != nil {
+		log.Printf("Error applying batch: %v", err)
+		writeServerError(w, err, "Failed to apply changes")
+		return
+	}
+
+	// Push the result to connected clients
+	h.hub.PublishBoard(board, WebSocketMessage{Type: "sync", Data: data}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"version": data.Version,
+		"results": results,
+		"data":    data,
+	})
+}
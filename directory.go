@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A company directory can decide who may sign in to a self-hosted server,
+// in either or both of two ways:
+//
+//   - LDAP: only users whose entry under LDAP_BASE_DN has their address in
+//     LDAP_EMAIL_ATTRIBUTE and LDAP_GROUP_DN in LDAP_GROUP_ATTRIBUTE (the
+//     memberOf overlay on OpenLDAP, built in to Active Directory) may sign
+//     in. Answers are cached for LDAP_CACHE_TTL, and the last answer stands
+//     in while the server can't be reached.
+//   - SCIM: an identity provider creates and disables users through
+//     /scim/v2/Users with SCIM_TOKEN. With SCIM_REQUIRED, only users it
+//     created may sign in.
+//
+// The check runs with the account check on every session token and API
+// key, so removing someone from the group or deprovisioning them signs them
+// out everywhere.
+
+// errNotInDirectory rejects users the directory doesn't let sign in
+var errNotInDirectory = errors.New("not allowed to sign in to this server")
+
+// DirectoryConfig connects sign-in to a company directory
+type DirectoryConfig struct {
+	// ldap://host:389 or ldaps://host:636; empty to not consult LDAP
+	LDAPURL string
+	// Account searches are made as; empty binds anonymously
+	LDAPBindDN       string
+	LDAPBindPassword string
+	// Where users are searched for, and the group they must be in
+	LDAPBaseDN  string
+	LDAPGroupDN string
+	// Attributes of a user's entry holding their address and their groups
+	LDAPEmailAttribute string
+	LDAPGroupAttribute string
+	// How long a lookup's answer is reused
+	LDAPCacheTTL time.Duration
+
+	// Bearer token of the SCIM provisioning API; empty disables it
+	SCIMToken string
+	// Only users provisioned over SCIM may sign in
+	SCIMRequired bool
+}
+
+// LDAPEnabled reports whether sign-in is restricted to an LDAP group
+func (c DirectoryConfig) LDAPEnabled() bool {
+	return c.LDAPURL != ""
+}
+
+// SCIMEnabled reports whether the SCIM provisioning API is served
+func (c DirectoryConfig) SCIMEnabled() bool {
+	return c.SCIMToken != ""
+}
+
+// Enabled reports whether the directory restricts sign-in at all
+func (c DirectoryConfig) Enabled() bool {
+	return c.LDAPEnabled() || c.SCIMRequired
+}
+
+// directoryAnswer is a cached LDAP group lookup
+type directoryAnswer struct {
+	member bool
+	at     time.Time
+}
+
+// DirectoryService checks users against the directory and provisions them
+// over SCIM
+type DirectoryService struct {
+	db           *DB
+	adminService *AdminService
+	cfg          DirectoryConfig
+	ldap         ldapAddress
+
+	mu      sync.Mutex
+	answers map[string]directoryAnswer
+}
+
+func NewDirectoryService(db *DB, adminService *AdminService, cfg DirectoryConfig) *DirectoryService {
+	// LoadConfig has validated the URL
+	addr, _ := parseLDAPURL(cfg.LDAPURL)
+	return &DirectoryService{
+		db:           db,
+		adminService: adminService,
+		cfg:          cfg,
+		ldap:         addr,
+		answers:      make(map[string]directoryAnswer),
+	}
+}
+
+// Check returns an AccountCheck running next and then refusing users the
+// directory doesn't let sign in
+func (s *DirectoryService) Check(next AccountCheck) AccountCheck {
+	return func(email string, issuedAt time.Time) error {
+		if err := next(email, issuedAt); err != nil {
+			return err
+		}
+		return s.Allowed(email)
+	}
+}
+
+// Allowed returns errNotInDirectory if the user may not sign in
+func (s *DirectoryService) Allowed(email string) error {
+	if s.cfg.SCIMRequired {
+		var scimID sql.NullString
+		err := s.db.QueryRow("SELECT scim_id FROM users WHERE email = ?", email).Scan(&scimID)
+		if err == sql.ErrNoRows || (err == nil && !scimID.Valid) {
+			return errNotInDirectory
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check provisioning: %w", err)
+		}
+	}
+
+	if s.cfg.LDAPEnabled() {
+		member, err := s.InGroup(email)
+		if err != nil {
+			return err
+		}
+		if !member {
+			return errNotInDirectory
+		}
+	}
+	return nil
+}
+
+// InGroup reports whether the user is in LDAP_GROUP_DN
+func (s *DirectoryService) InGroup(email string) (bool, error) {
+	key := strings.ToLower(email)
+	s.mu.Lock()
+	answer, cached := s.answers[key]
+	s.mu.Unlock()
+	if cached && time.Since(answer.at) < s.cfg.LDAPCacheTTL {
+		return answer.member, nil
+	}
+
+	member, err := s.lookup(email)
+	if err != nil {
+		if cached {
+			log.Printf("Error looking up %s in LDAP, keeping the last answer: %v", email, err)
+			return answer.member, nil
+		}
+		return false, err
+	}
+
+	s.mu.Lock()
+	s.answers[key] = directoryAnswer{member: member, at: time.Now()}
+	s.mu.Unlock()
+	return member, nil
+}
+
+// lookup asks the LDAP server whether the user is in the group
+func (s *DirectoryService) lookup(email string) (bool, error) {
+	conn, err := dialLDAP(s.ldap)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if err := conn.bind(s.cfg.LDAPBindDN, s.cfg.LDAPBindPassword); err != nil {
+		return false, err
+	}
+	n, err := conn.count(s.cfg.LDAPBaseDN, ldapAnd(
+		ldapEquals(s.cfg.LDAPEmailAttribute, email),
+		ldapEquals(s.cfg.LDAPGroupAttribute, s.cfg.LDAPGroupDN),
+	))
+	if err != nil {
+		return false, fmt.Errorf("failed to search ldap: %w", err)
+	}
+	return n > 0, nil
+}
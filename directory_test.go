@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// serveLDAP runs an LDAP server on a local port that answers binds, and
+// searches with one entry when the filter's first value is in members. It
+// returns the server's URL and a function stopping it.
+func serveLDAP(t *testing.T, members ...string) (string, func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go answerLDAP(conn, members)
+		}
+	}()
+	return "ldap://" + ln.Addr().String(), func() { ln.Close() }
+}
+
+func answerLDAP(conn net.Conn, members []string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(id []byte, ops ...[]byte) {
+		for _, op := range ops {
+			conn.Write(ber(berSequence, ber(berInteger, id), op))
+		}
+	}
+	success := append(berInt(berEnumerated, 0), append(ber(berOctetString, nil), ber(berOctetString, nil)...)...)
+
+	for {
+		_, message, err := readBER(r)
+		if err != nil {
+			return
+		}
+		_, id, rest, _ := parseBER(message)
+		tag, op, _, _ := parseBER(rest)
+		switch tag {
+		case ldapBindRequest:
+			reply(id, ber(ldapBindResponse, success))
+		case ldapSearchRequest:
+			// Skip the base DN, scope, aliases, limits and typesOnly
+			for i := 0; i < 6; i++ {
+				_, _, op, _ = parseBER(op)
+			}
+			_, filter, _, _ := parseBER(op)
+			_, equality, _, _ := parseBER(filter)
+			_, _, value, _ := parseBER(equality)
+			_, email, _, _ := parseBER(value)
+
+			var ops [][]byte
+			for _, member := range members {
+				if string(email) == member {
+					ops = append(ops, ber(ldapSearchEntry, ber(berOctetString, []byte("uid="+member)), ber(berSequence)))
+				}
+			}
+			reply(id, append(ops, ber(ldapSearchDone, success))...)
+		default:
+			return
+		}
+	}
+}
+
+func TestLDAPGroupRestrictsSignIn(t *testing.T) {
+	ldapURL, stop := serveLDAP(t, "a@example.com")
+	db := newTestDB(t)
+	directory := NewDirectoryService(db, nil, DirectoryConfig{
+		LDAPURL:            ldapURL,
+		LDAPBaseDN:         "dc=example,dc=com",
+		LDAPGroupDN:        "cn=todo,ou=groups,dc=example,dc=com",
+		LDAPEmailAttribute: "mail",
+		LDAPGroupAttribute: "memberOf",
+	})
+	auth := newTestAuthService()
+	auth.OnAuthenticate(directory.Check(func(string, time.Time) error { return nil }))
+
+	if _, err := auth.CreateJWT("a@example.com"); err != nil {
+		t.Errorf("signing in a group member: %v", err)
+	}
+	if _, err := auth.CreateJWT("b@example.com"); err != errNotInDirectory {
+		t.Errorf("signing in someone outside the group: %v, want %v", err, errNotInDirectory)
+	}
+
+	// With the cache expired and the server gone, the last answers stand
+	stop()
+	if err := directory.Allowed("a@example.com"); err != nil {
+		t.Errorf("member while LDAP is down: %v", err)
+	}
+	if err := directory.Allowed("b@example.com"); err != errNotInDirectory {
+		t.Errorf("non-member while LDAP is down: %v, want %v", err, errNotInDirectory)
+	}
+	if err := directory.Allowed("c@example.com"); err == nil {
+		t.Error("unknown user while LDAP is down was let in")
+	}
+}
+
+func TestSCIMProvisioning(t *testing.T) {
+	app := newTestApp(t)
+	admin := NewAdminService(app.db, app.hub, app.dataService.cache)
+	directory := NewDirectoryService(app.db, admin, DirectoryConfig{SCIMToken: "scim-secret", SCIMRequired: true})
+	app.auth.OnAuthenticate(directory.Check(admin.CheckAccount))
+
+	scim := NewSCIMHandler(directory, "scim-secret")
+	app.router.HandleFunc("/scim/v2/Users", scim.Authenticate(scim.ListUsers)).Methods("GET")
+	app.router.HandleFunc("/scim/v2/Users", scim.Authenticate(scim.CreateUser)).Methods("POST")
+	app.router.HandleFunc("/scim/v2/Users/{id}", scim.Authenticate(scim.GetUser)).Methods("GET")
+	app.router.HandleFunc("/scim/v2/Users/{id}", scim.Authenticate(scim.PatchUser)).Methods("PATCH")
+	app.router.HandleFunc("/scim/v2/Users/{id}", scim.Authenticate(scim.DeleteUser)).Methods("DELETE")
+	do := func(method, path, token string, body any) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewReader(encoded))
+		req.Header.Set("Content-Type", scimContentType)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		app.router.ServeHTTP(rec, req)
+		return rec
+	}
+	email := "a@example.com"
+
+	if _, err := app.auth.CreateJWT(email); err != errNotInDirectory {
+		t.Fatalf("signing in before provisioning: %v, want %v", err, errNotInDirectory)
+	}
+	user := map[string]any{"userName": email, "externalId": "idp-1", "active": true}
+	expectStatus(t, do("POST", "/scim/v2/Users", "wrong", user), http.StatusUnauthorized)
+	rec := do("POST", "/scim/v2/Users", "scim-secret", user)
+	expectStatus(t, rec, http.StatusCreated)
+	var created SCIMUser
+	decodeBody(t, rec, &created)
+	if created.ID == "" || created.UserName != email || !created.Active {
+		t.Fatalf("created user = %+v", created)
+	}
+	expectStatus(t, do("POST", "/scim/v2/Users", "scim-secret", user), http.StatusConflict)
+
+	token := app.token(t, email)
+	rec = do("GET", "/scim/v2/Users?filter="+url.QueryEscape(`userName eq "a@example.com"`), "scim-secret", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var list struct {
+		TotalResults int        `json:"totalResults"`
+		Resources    []SCIMUser `json:"Resources"`
+	}
+	decodeBody(t, rec, &list)
+	if list.TotalResults != 1 || len(list.Resources) != 1 || list.Resources[0].ID != created.ID {
+		t.Errorf("filtered list = %+v, want the created user", list)
+	}
+
+	// Deactivating signs the user out, even with the string some identity
+	// providers send
+	rec = do("PATCH", "/scim/v2/Users/"+created.ID, "scim-secret", map[string]any{
+		"Operations": []map[string]any{{"op": "Replace", "path": "active", "value": "False"}},
+	})
+	expectStatus(t, rec, http.StatusOK)
+	var patched SCIMUser
+	decodeBody(t, rec, &patched)
+	if patched.Active {
+		t.Error("user still active after PATCH")
+	}
+	if _, err := app.auth.VerifyJWT(token); err != errAccountDisabled {
+		t.Errorf("session of a deactivated user: %v, want %v", err, errAccountDisabled)
+	}
+
+	expectStatus(t, do("DELETE", "/scim/v2/Users/"+created.ID, "scim-secret", nil), http.StatusNoContent)
+	expectStatus(t, do("GET", "/scim/v2/Users/"+created.ID, "scim-secret", nil), http.StatusNotFound)
+	if _, err := app.auth.CreateJWT(email); err != errAccountDisabled {
+		t.Errorf("signing in after deprovisioning: %v, want %v", err, errAccountDisabled)
+	}
+}
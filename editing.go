@@ -0,0 +1,60 @@
+package main
+
+import "log"
+
+// Editing indicators over the WebSocket connection:
+//
+//	client -> server  {"type": "editing", "board": "...", "data": {"taskId": "...", "editing": true}}
+//	server -> others  {"type": "editing", "board": "...", "user": "...", "data": {"taskId": "...", "editing": true}}
+//
+// A client sends editing: true when it opens a task for editing and false
+// when it's done, so others can warn before two people change the same card.
+// The events are relayed to the board's other subscribers and never stored.
+// When a connection closes, stop events are relayed for whatever it was
+// still editing.
+
+// maxEditingPerClient caps the tasks a connection can hold as being edited
+const maxEditingPerClient = 20
+
+// editingTask is a task a connection is editing
+type editingTask struct {
+	board  string
+	taskID string
+}
+
+// EditingPayload is the payload of an "editing" message
+type EditingPayload struct {
+	TaskID  string `json:"taskId"`
+	Editing bool   `json:"editing"`
+}
+
+// handleEditing relays a client's editing-start or editing-stop event
+func (h *Hub) handleEditing(c *Client, message WebSocketMessage) {
+	boardID := canonicalBoardID(c.email, message.Board)
+	var payload EditingPayload
+	decodeMessageData(message, &payload) // Checked by validateEditing
+
+	// Handlers run on the client's ReadPump, the only user of c.editing
+	key := editingTask{board: boardID, taskID: payload.TaskID}
+	if payload.Editing {
+		if !c.editing[key] && len(c.editing) >= maxEditingPerClient {
+			log.Printf("Ignoring editing event from %s: too many tasks being edited", c.email)
+			return
+		}
+		c.editing[key] = true
+	} else {
+		delete(c.editing, key)
+	}
+
+	h.PublishBoard(boardID, WebSocketMessage{Type: "editing", User: c.email, Data: payload}, c)
+}
+
+// stopEditing relays stop events for every task a closing client was still
+// editing. It's called from the client's ReadPump as it exits.
+func (c *Client) stopEditing() {
+	for task := range c.editing {
+		payload := EditingPayload{TaskID: task.taskID, Editing: false}
+		c.hub.PublishBoard(task.board, WebSocketMessage{Type: "editing", User: c.email, Data: payload}, c)
+	}
+	c.editing = nil
+}
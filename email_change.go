@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Changing an account's email:
+//
+//	POST /api/account/email {"email": "new@example.com"}
+//	POST /api/account/email {"email": "new@example.com", "token": "...", "merge": true}
+//
+// The first call emails a link to the new address, proving the user can
+// read it; the second, with the token from the link, moves everything
+// stored for the account to the new address, signs out every session of
+// the old one and starts a session for the new one.
+//
+// If an account already exists at the new address, the change is refused
+// with account_exists unless merge is set. Merging keeps that account and
+// adds the user's to it: boards are merged, and where both accounts have
+// the same task, column or swimlane the existing account's copy is kept and
+// listed in "conflicts". Rows that can only exist once per account, like
+// settings, credentials and integration tokens, are kept from the existing
+// account too; "dropped" counts the user's rows given up that way, by
+// table.
+
+// emailChangeTTL is how long an email change link stays valid
+const emailChangeTTL = time.Hour
+
+// resolutionExisting marks board items whose copy in the account being
+// merged into was kept
+const resolutionExisting = "existing"
+
+var (
+	// errEmailChangeToken is returned for a missing, expired or foreign
+	// email change token
+	errEmailChangeToken = errors.New("invalid or expired email change token")
+
+	// errAccountExists is returned when changing to the address of another
+	// account without asking to merge
+	errAccountExists = errors.New("an account already exists at that address")
+
+	// errSameEmail is returned when changing to the current address
+	errSameEmail = errors.New("that is already the account's address")
+)
+
+// EmailChange reports a completed email change
+type EmailChange struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Merged bool   `json:"merged"`
+	// Rows of the old account dropped in favour of the existing account's,
+	// by table
+	Dropped map[string]int64 `json:"dropped,omitempty"`
+	// Board items both accounts had, where the existing account's copy was
+	// kept; clientValue is the old account's
+	Conflicts []MergeConflict `json:"conflicts,omitempty"`
+
+	board *KanbanData
+}
+
+// emailChangePurpose ties a change token to the address it verifies
+func emailChangePurpose(to string) string {
+	return "change-email:" + to
+}
+
+// RequestEmailChange emails a link to the new address confirming the change
+// and returns it. The email is in the user's language, or else locale (the
+// request's).
+func (s *AccountService) RequestEmailChange(email, to, baseURL, locale string) (string, error) {
+	if to == email {
+		return "", errSameEmail
+	}
+	// The account moves to an address that may sign in
+	if err := s.authService.CheckAccount(to, time.Time{}); err != nil {
+		return "", err
+	}
+	token, err := s.authService.CreateStateToken(email, emailChangePurpose(to), emailChangeTTL)
+	if err != nil {
+		return "", err
+	}
+	link := baseURL + "/?change-email=" + token + "&email=" + url.QueryEscape(to)
+
+	if s.authService.EmailEnabled() {
+		locale = s.authService.EmailLocale(email, locale)
+		subject := translate(locale, "Confirm your new %s email address", s.authService.branding.AppName)
+		body := translate(locale, "Someone asked to change the email of the %s account %s to this address.\n\nTo confirm, open the link below while signed in to that account:\n\n%s\n\nThe link expires in an hour. If you didn't ask for this, ignore this email.", s.authService.branding.AppName, email, link)
+		if err := s.authService.SendEmail(to, locale, subject, body); err != nil {
+			return "", err
+		}
+	}
+	return link, nil
+}
+
+// ChangeEmail moves the account to the address confirmed by token, merging
+// it into the account already there if merge is set
+func (s *AccountService) ChangeEmail(ctx context.Context, email, to, token string, merge bool) (*EmailChange, error) {
+	confirmed, err := s.authService.VerifyStateToken(token, emailChangePurpose(to))
+	if err != nil || confirmed != email {
+		return nil, errEmailChangeToken
+	}
+	if to == email {
+		return nil, errSameEmail
+	}
+
+	tx, err := s.dataService.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var disabledAt sql.NullTime
+	err = tx.QueryRow("SELECT disabled_at FROM users WHERE email = ?", to).Scan(&disabledAt)
+	exists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to query user: %w", err)
+	}
+	if exists && disabledAt.Valid {
+		return nil, errAccountDisabled
+	}
+	if exists && !merge {
+		return nil, errAccountExists
+	}
+
+	change := &EmailChange{From: email, To: to, Merged: exists, Dropped: make(map[string]int64)}
+	if !exists {
+		_, err = tx.Exec(`
+			INSERT INTO users (email, created_at, changes_pruned_version, changes_pruned_at, current_workspace)
+			SELECT ?, created_at, changes_pruned_version, changes_pruned_at, current_workspace FROM users WHERE email = ?
+		`, to, email)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert user: %w", err)
+		}
+		if err := ensureUser(tx, to); err != nil {
+			return nil, err
+		}
+	} else if err := s.mergeBoards(tx, email, to, change); err != nil {
+		return nil, err
+	}
+
+	// Rows follow the account, except those clashing with the existing
+	// account's. Webhook deliveries follow their webhooks, and the old users
+	// row stays behind to revoke its sessions.
+	for _, table := range accountTables {
+		if table.where != "" || table.name == "users" {
+			continue
+		}
+		if table.collides != "" {
+			res, err := tx.Exec("DELETE FROM "+table.name+" WHERE email = ? AND "+table.collides, email, to)
+			if err != nil {
+				return nil, fmt.Errorf("failed to drop from %s: %w", table.name, err)
+			}
+			if n, err := res.RowsAffected(); err == nil && n > 0 {
+				change.Dropped[table.name] = n
+			}
+		}
+		if _, err := tx.Exec("UPDATE "+table.name+" SET email = ? WHERE email = ?", to, email); err != nil {
+			return nil, fmt.Errorf("failed to move %s: %w", table.name, err)
+		}
+	}
+
+	// The address also names the user's board and signs their comments
+	if _, err := tx.Exec("UPDATE share_links SET board = ? WHERE board = ?", to, email); err != nil {
+		return nil, fmt.Errorf("failed to move share links: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE comments SET author = ? WHERE author = ?", to, email); err != nil {
+		return nil, fmt.Errorf("failed to move comments: %w", err)
+	}
+
+	// And records what they created and who they invited to workspaces, and
+	// who is invited
+	for _, column := range []struct{ table, name string }{
+		{"workspaces", "created_by"},
+		{"workspace_boards", "created_by"},
+		{"workspace_invitations", "invited_by"},
+		{"workspace_invitations", "email"},
+	} {
+		if _, err := tx.Exec("UPDATE "+column.table+" SET "+column.name+" = ? WHERE "+column.name+" = ?", to, email); err != nil {
+			return nil, fmt.Errorf("failed to move %s: %w", column.table, err)
+		}
+	}
+
+	if err := ensureUser(tx, email); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("UPDATE users SET sessions_revoked_at = ? WHERE email = ?", time.Now().UTC().Truncate(time.Second), email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.dataService.cache.Invalidate(email)
+	s.dataService.cache.Invalidate(to)
+	s.hub.Disconnect(email)
+	if change.board != nil {
+		s.hub.PublishBoard(canonicalBoardID(to, ""), WebSocketMessage{Type: "sync", Data: change.board}, nil)
+	}
+	log.Printf("Changed account email %s to %s (merged: %t)", email, to, exists)
+	return change, nil
+}
+
+// mergeBoards merges the user's board into the existing account's, keeping
+// its copy of items both have, and removes the user's
+func (s *AccountService) mergeBoards(tx *Tx, email, to string, change *EmailChange) error {
+	from, err := s.dataService.getUserData(tx.ctx, tx, email)
+	if err != nil {
+		return err
+	}
+	existing, err := s.dataService.getUserData(tx.ctx, tx, to)
+	if err != nil {
+		return err
+	}
+	if len(from.Columns) == 0 && len(from.Tasks) == 0 && len(from.Swimlanes) == 0 {
+		return nil
+	}
+
+	requested := mergeKanbanData(existing, from)
+	merged := mergeKanbanData(existing, from)
+	merged.UnassignedCollapsed = existing.UnassignedCollapsed
+	noVersions := func() (map[boardItemKey]int64, error) { return nil, nil }
+	kept, err := applyMergeStrategy(existing, merged, 0, serverWins{}, noVersions)
+	if err != nil {
+		return err
+	}
+	change.Conflicts = syncConflicts(from, requested, merged, resolutionExisting, kept, nil)
+
+	if _, err := s.dataService.saveUserData(tx, to, merged); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM user_data WHERE email = ?", email); err != nil {
+		return fmt.Errorf("failed to delete user data: %w", err)
+	}
+	change.board = merged
+	return nil
+}
+
+// ChangeEmail emails a confirmation link to the new address when called
+// without a token, and moves the account to it when called with the token
+// from that link
+func (h *AccountHandler) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+		Token string `json:"token"`
+		Merge bool   `json:"merge"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email == "" || !strings.Contains(req.Email, "@") {
+		writeError(w, http.StatusBadRequest, "Invalid email address")
+		return
+	}
+
+	email := requestEmail(r)
+	if req.Token == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		link, err := h.accountService.RequestEmailChange(email, req.Email, fmt.Sprintf("%s://%s", scheme, r.Host), requestLocale(r))
+		if err == errSameEmail {
+			writeError(w, http.StatusBadRequest, "That is already your email address")
+			return
+		}
+		if err == errAccountDisabled || err == errNotInDirectory {
+			writeSignInError(w, err)
+			return
+		}
+		if err != nil {
+			log.Printf("Error requesting email change: %v", err)
+			writeError(w, http.StatusInternalServerError, "Failed to send confirmation email")
+			return
+		}
+
+		resp := map[string]any{
+			"status":  "pending",
+			"message": "Check your new address to confirm the change",
+		}
+		if h.accountService.authService.RevealLinks() {
+			resp["confirmUrl"] = link // For development only
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	change, err := h.accountService.ChangeEmail(r.Context(), email, req.Email, req.Token, req.Merge)
+	switch err {
+	case nil:
+	case errEmailChangeToken:
+		writeError(w, http.StatusBadRequest, "Invalid or expired confirmation link")
+		return
+	case errSameEmail:
+		writeError(w, http.StatusBadRequest, "That is already your email address")
+		return
+	case errAccountExists:
+		writeErrorCode(w, http.StatusConflict, "account_exists", "An account already exists at that address; confirm again to merge into it")
+		return
+	case errAccountDisabled:
+		writeError(w, http.StatusForbidden, "Account disabled")
+		return
+	default:
+		log.Printf("Error changing account email: %v", err)
+		writeServerError(w, err, "Failed to change email")
+		return
+	}
+
+	token, err := h.accountService.authService.CreateJWT(change.To)
+	if err != nil {
+		writeSignInError(w, err)
+		return
+	}
+	resp := map[string]any{
+		"status": "success",
+		"email":  change.To,
+		"change": change,
+	}
+	// The new session is of the same kind as the one that asked
+	if _, err := r.Cookie(sessionCookie); err == nil && r.Header.Get("Authorization") == "" {
+		if err := setSessionCookie(w, r, token); err != nil {
+			log.Printf("Error starting cookie session: %v", err)
+			writeError(w, http.StatusInternalServerError, "Authentication error")
+			return
+		}
+	} else {
+		resp["token"] = token
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
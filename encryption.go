@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// encryptedMarker prefixes encrypted text values. It's followed by the key
+// ID, a colon and the base64 nonce and ciphertext. Plain JSON and
+// compressed boards never start with it.
+const encryptedMarker = "enc:"
+
+// encryptedBlobMagic starts encrypted binary content. It's followed by a
+// one-byte key ID length, the key ID, the nonce and the ciphertext.
+var encryptedBlobMagic = []byte("TDENC1")
+
+// EncryptionConfig holds the at-rest encryption keys, base64-encoded
+// 32-byte AES keys. PreviousKeys can still decrypt but aren't used for
+// new values.
+type EncryptionConfig struct {
+	Key          string
+	PreviousKeys []string
+}
+
+// Enabled reports whether at-rest encryption is configured
+func (c EncryptionConfig) Enabled() bool {
+	return c.Key != ""
+}
+
+// KeyProvider supplies the keys for encryption at rest. Keys have IDs so
+// values written under an old key can be read after rotating to a new one.
+// EnvKeyProvider takes the keys from the configuration; a provider backed
+// by a KMS can fetch or unwrap them there instead.
+type KeyProvider interface {
+	// CurrentKeyID names the key new values are encrypted with
+	CurrentKeyID() string
+	// Key returns the 32-byte AES key with the given ID
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// decodeEncryptionKey parses a base64 AES-256 key
+func decodeEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("not valid base64")
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// EnvKeyProvider serves the keys from ENCRYPTION_KEY and
+// ENCRYPTION_PREVIOUS_KEYS. A key's ID is derived from the key itself.
+type EnvKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func NewEnvKeyProvider(cfg EncryptionConfig) (*EnvKeyProvider, error) {
+	p := &EnvKeyProvider{keys: make(map[string][]byte)}
+	for i, encoded := range append([]string{cfg.Key}, cfg.PreviousKeys...) {
+		key, err := decodeEncryptionKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key: %w", err)
+		}
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:4])
+		if i == 0 {
+			p.current = id
+		}
+		p.keys[id] = key
+	}
+	return p, nil
+}
+
+func (p *EnvKeyProvider) CurrentKeyID() string {
+	return p.current
+}
+
+func (p *EnvKeyProvider) Key(ctx context.Context, id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+	return key, nil
+}
+
+// Encryptor seals values with AES-GCM under the provider's current key and
+// opens values sealed under any key it provides
+type Encryptor struct {
+	provider KeyProvider
+
+	mu    sync.Mutex
+	aeads map[string]cipher.AEAD
+}
+
+func NewEncryptor(provider KeyProvider) *Encryptor {
+	return &Encryptor{provider: provider, aeads: make(map[string]cipher.AEAD)}
+}
+
+// aead returns the cipher for a key, fetching the key only once
+func (e *Encryptor) aead(id string) (cipher.AEAD, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if aead, ok := e.aeads[id]; ok {
+		return aead, nil
+	}
+
+	key, err := e.provider.Key(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	e.aeads[id] = aead
+	return aead, nil
+}
+
+// seal encrypts plaintext under the current key, returning the key ID and
+// the nonce followed by the ciphertext
+func (e *Encryptor) seal(plaintext []byte) (string, []byte, error) {
+	id := e.provider.CurrentKeyID()
+	aead, err := e.aead(id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return id, aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts the output of seal
+func (e *Encryptor) open(id string, sealed []byte) ([]byte, error) {
+	aead, err := e.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is truncated")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+// EncryptString encrypts a text value for storage
+func (e *Encryptor) EncryptString(plaintext string) (string, error) {
+	id, sealed, err := e.seal([]byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return encryptedMarker + id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptString decrypts a value from EncryptString
+func (e *Encryptor) DecryptString(stored string) (string, error) {
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(stored, encryptedMarker), ":")
+	if !ok {
+		return "", errors.New("malformed encrypted value")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("malformed encrypted value")
+	}
+	plaintext, err := e.open(id, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// EncryptBlob encrypts binary content for storage
+func (e *Encryptor) EncryptBlob(plaintext []byte) ([]byte, error) {
+	id, sealed, err := e.seal(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := make([]byte, 0, len(encryptedBlobMagic)+1+len(id)+len(sealed))
+	blob = append(blob, encryptedBlobMagic...)
+	blob = append(blob, byte(len(id)))
+	blob = append(blob, id...)
+	return append(blob, sealed...), nil
+}
+
+// DecryptBlob decrypts content from EncryptBlob. Content stored before
+// encryption was enabled is returned as it is.
+func (e *Encryptor) DecryptBlob(blob []byte) ([]byte, error) {
+	if !bytes.HasPrefix(blob, encryptedBlobMagic) {
+		return blob, nil
+	}
+
+	rest := blob[len(encryptedBlobMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return nil, errors.New("encrypted content is truncated")
+	}
+	id := string(rest[1 : 1+rest[0]])
+	return e.open(id, rest[1+rest[0]:])
+}
+
+// encryptedAttachmentStore encrypts attachment content on its way into
+// another store. Attachments stored before encryption are still readable.
+type encryptedAttachmentStore struct {
+	AttachmentStore
+	encryptor *Encryptor
+}
+
+// NewEncryptedAttachmentStore wraps a store with encryption at rest
+func NewEncryptedAttachmentStore(store AttachmentStore, encryptor *Encryptor) AttachmentStore {
+	return &encryptedAttachmentStore{AttachmentStore: store, encryptor: encryptor}
+}
+
+func (s *encryptedAttachmentStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	// Uploads are capped at ATTACHMENT_MAX_SIZE, so they fit in memory
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	blob, err := s.encryptor.EncryptBlob(plaintext)
+	if err != nil {
+		return err
+	}
+	return s.AttachmentStore.Put(ctx, key, bytes.NewReader(blob), int64(len(blob)), contentType)
+}
+
+func (s *encryptedAttachmentStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	rc, err := s.AttachmentStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	blob, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := s.encryptor.DecryptBlob(blob)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(plaintext)), nil
+}
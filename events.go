@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server-Sent Events fallback for networks that break WebSockets:
+//
+//	GET /api/events?board=<board id>&token=<session token>
+//
+// The stream carries the messages a WebSocket client receives, one per
+// "data:" line. Messages published to a board have an "id:" of the form
+// <epoch>-<n>. A client that reconnects with Last-Event-ID (or the
+// lastEventId query parameter, for clients that reconnect by hand) first
+// gets the board messages it missed. When those have fallen out of the
+// hub's history, or the ID is from another instance or before a restart,
+// it gets a "state" message with the whole board instead. The stream is
+// receive-only; changes go through the REST API.
+
+const (
+	// Board messages the hub keeps for resuming event streams
+	eventHistorySize = 256
+
+	// Comment sent on idle event streams so proxies don't time them out
+	eventKeepAlive = 25 * time.Second
+
+	// Milliseconds EventSource waits before reconnecting
+	eventRetryMillis = 3000
+)
+
+// boardEvent is a board message kept in the hub's history
+type boardEvent struct {
+	id      uint64
+	board   string
+	payload []byte
+}
+
+// resumeRequest puts an event stream's client on a board and asks for the
+// board messages recorded after an event ID
+type resumeRequest struct {
+	client *Client
+	board  string
+	after  uint64
+	reply  chan resumeResult
+}
+
+// resumeResult lists the messages a resuming stream missed. ok is false
+// when they're no longer all in the history.
+type resumeResult struct {
+	events []outbound
+	ok     bool
+	last   uint64
+}
+
+// record adds a board message to the history and returns its event ID.
+// Only called from the Run loop.
+func (h *Hub) record(message boardMessage) uint64 {
+	h.lastEvent++
+	if len(h.history) == eventHistorySize {
+		copy(h.history, h.history[1:])
+		h.history = h.history[:len(h.history)-1]
+	}
+	h.history = append(h.history, boardEvent{id: h.lastEvent, board: message.board, payload: message.payload})
+	return h.lastEvent
+}
+
+// resumeEvents handles a resumeRequest. Only called from the Run loop.
+func (h *Hub) resumeEvents(req resumeRequest) resumeResult {
+	client := req.client
+	result := resumeResult{last: h.lastEvent}
+	if !h.users[client.email][client] {
+		return result
+	}
+
+	if !client.boards[req.board] {
+		h.markPresence(client)
+		client.boards[req.board] = true
+		join(h.rooms, req.board, client)
+	}
+	if client.viewing != req.board {
+		client.viewing = req.board
+		h.markPresence(client)
+	}
+
+	if req.after == 0 || req.after > h.lastEvent {
+		return result
+	}
+	if req.after < h.lastEvent && h.history[0].id > req.after+1 {
+		return result
+	}
+	result.ok = true
+	for _, event := range h.history {
+		if event.id > req.after && event.board == req.board {
+			result.events = append(result.events, outbound{id: event.id, payload: event.payload})
+		}
+	}
+	return result
+}
+
+// eventID formats a hub event ID for the stream
+func (h *Hub) eventID(id uint64) string {
+	return h.epoch + "-" + strconv.FormatUint(id, 10)
+}
+
+// parseEventID returns the event ID a client last saw, or 0 when it's not
+// one of this hub's
+func (h *Hub) parseEventID(value string) uint64 {
+	epoch, n, found := strings.Cut(value, "-")
+	if !found || epoch != h.epoch {
+		return 0
+	}
+	id, err := strconv.ParseUint(n, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// EventsHandler serves the Server-Sent Events stream
+type EventsHandler struct {
+	dataService *DataService
+	authService *AuthService
+	hub         *Hub
+}
+
+func NewEventsHandler(dataService *DataService, authService *AuthService, hub *Hub) *EventsHandler {
+	return &EventsHandler{dataService: dataService, authService: authService, hub: hub}
+}
+
+// Stream streams a board's messages as a hub client, like a WebSocket
+// connection. EventSource can't set headers, so the session token may be
+// passed in the query like for /api/ws.
+func (h *EventsHandler) Stream(w http.ResponseWriter, r *http.Request) {
+	var email string
+	var err error
+	if token := r.URL.Query().Get("token"); token != "" {
+		email, err = h.authService.VerifyJWT(token)
+	} else {
+		email, err = h.authService.AuthenticateRequest(r)
+	}
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Invalid token")
+		return
+	}
+
+	boardID := canonicalBoardID(email, r.URL.Query().Get("board"))
+	if h.hub.BoardRole(email, boardID) < BoardRoleViewer {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetryMillis)
+
+	// The stream stands in for the WritePump, reading the client's queue
+	client := NewClient(h.hub, nil, email)
+	h.hub.Register(client)
+	defer func() {
+		h.hub.Unregister(client)
+		h.hub.pumps.Done()
+	}()
+
+	// Joining the board and collecting what the client missed happen
+	// together, so nothing is sent twice or lost in between
+	reply := make(chan resumeResult, 1)
+	h.hub.resume <- resumeRequest{client: client, board: boardID, after: h.hub.parseEventID(lastEventID), reply: reply}
+	resumed := <-reply
+
+	write := func(message outbound) bool {
+		if message.id != 0 {
+			fmt.Fprintf(w, "id: %s\n", h.hub.eventID(message.id))
+		}
+		fmt.Fprintf(w, "data: %s\n\n", message.payload)
+		return rc.Flush() == nil
+	}
+
+	if lastEventID != "" && !resumed.ok {
+		// Read after joining, so no change falls between the state and the
+		// stream
+		data, err := h.dataService.GetUserData(r.Context(), boardID)
+		if err != nil {
+			log.Printf("Error getting board %s for event stream: %v", boardID, err)
+			return
+		}
+		payload, err := json.Marshal(WebSocketMessage{Type: "state", Board: boardID, Data: StatePayload{Version: data.Version, Board: data}})
+		if err != nil {
+			log.Printf("Error marshalling board state: %v", err)
+			return
+		}
+		if !write(outbound{id: resumed.last, payload: payload}) {
+			return
+		}
+	}
+	for _, message := range resumed.events {
+		if !write(message) {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	ownBoard := boardID == canonicalBoardID(email, "")
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.done:
+			// Tell the client why, with the WebSocket close code, then end
+			// the response; EventSource reconnects unless the client stops it
+			message := WebSocketMessage{Type: "close", Data: map[string]any{
+				"code":   client.closeCode,
+				"reason": client.closeReason,
+			}}
+			if payload, err := json.Marshal(message); err == nil {
+				write(outbound{payload: payload})
+			}
+			return
+		case message := <-client.send:
+			// The client also sits in its own board's room
+			if !ownBoard {
+				var envelope struct {
+					Board string `json:"board"`
+				}
+				if json.Unmarshal(message.payload, &envelope) == nil && envelope.Board != "" && envelope.Board != boardID {
+					continue
+				}
+			}
+			if !write(message) {
+				return
+			}
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			if rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// BoardExport is the document written by the JSON export
+type BoardExport struct {
+	Email               string     `json:"email"`
+	ExportedAt          time.Time  `json:"exportedAt"`
+	Columns             []Column   `json:"columns"`
+	Swimlanes           []Swimlane `json:"swimlanes,omitempty"`
+	Tasks               []Task     `json:"tasks"`
+	UnassignedCollapsed bool       `json:"unassignedCollapsed"`
+	Comments            []Comment  `json:"comments,omitempty"`
+}
+
+// buildBoardExport flattens a user's board into an export document.
+// Deleted and hidden items are dropped unless includeDeleted is set.
+func buildBoardExport(email string, data *KanbanData, includeDeleted bool) *BoardExport {
+	export := &BoardExport{
+		Email:               email,
+		ExportedAt:          time.Now().UTC(),
+		Columns:             []Column{},
+		Tasks:               []Task{},
+		UnassignedCollapsed: data.UnassignedCollapsed,
+	}
+
+	for _, col := range data.Columns {
+		if !includeDeleted && (col.Deleted || col.Hidden) {
+			continue
+		}
+		export.Columns = append(export.Columns, col)
+	}
+
+	for _, lane := range data.Swimlanes {
+		if !includeDeleted && lane.Deleted {
+			continue
+		}
+		export.Swimlanes = append(export.Swimlanes, lane)
+	}
+
+	// Fold legacy unassigned tasks into the task list
+	tasks := append([]Task{}, data.Tasks...)
+	for _, task := range data.UnassignedTasks {
+		task.ColumnID = nil
+		tasks = append(tasks, task)
+	}
+
+	for _, task := range tasks {
+		if !includeDeleted && (task.Deleted || task.Hidden) {
+			continue
+		}
+		export.Tasks = append(export.Tasks, task)
+	}
+
+	return export
+}
+
+// exportExtensions maps supported export formats to their file extension
+var exportExtensions = map[string]string{
+	"json":     "json",
+	"csv":      "csv",
+	"markdown": "md",
+}
+
+// exportContentTypes maps supported export formats to their Content-Type
+var exportContentTypes = map[string]string{
+	"json":     "application/json",
+	"csv":      "text/csv; charset=utf-8",
+	"markdown": "text/markdown; charset=utf-8",
+}
+
+// exportFilename names the download of an export
+func exportFilename(export *BoardExport, format string) string {
+	return fmt.Sprintf("kanban-export-%s.%s", export.ExportedAt.Format("2006-01-02"), exportExtensions[format])
+}
+
+// loadBoardExport builds a user's export document. Comments are only
+// included in JSON, the one format that can represent them.
+func loadBoardExport(ctx context.Context, dataService *DataService, commentService *CommentService, email, format string, includeDeleted bool) (*BoardExport, error) {
+	data, err := dataService.GetUserData(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	export := buildBoardExport(email, data, includeDeleted)
+	if format == "json" {
+		if export.Comments, err = commentService.ListBoard(email); err != nil {
+			return nil, err
+		}
+	}
+	return export, nil
+}
+
+// writeBoardExport encodes an export document in the given format
+func writeBoardExport(w io.Writer, format string, export *BoardExport) error {
+	switch format {
+	case "csv":
+		return writeBoardCSV(w, export)
+	case "markdown":
+		return writeBoardMarkdown(w, export)
+	default:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(export)
+	}
+}
+
+// ExportData streams the user's board, or the workspace board named by
+// ?board=, as a downloadable JSON, CSV or Markdown file
+func (h *DataHandler) ExportData(w http.ResponseWriter, r *http.Request) {
+	board := canonicalBoardID(requestEmail(r), queryBoard(r))
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if _, ok := exportExtensions[format]; !ok {
+		writeError(w, http.StatusBadRequest, "Unsupported export format")
+		return
+	}
+
+	includeDeleted := false
+	if raw := r.URL.Query().Get("include_deleted"); raw != "" {
+		var err error
+		includeDeleted, err = strconv.ParseBool(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid include_deleted value")
+			return
+		}
+	}
+
+	export, err := loadBoardExport(r.Context(), h.dataService, h.commentService, board, format, includeDeleted)
+	if err != nil {
+		log.Printf("Error building export: %v", err)
+		writeServerError(w, err, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename(export, format)))
+	w.Header().Set("Content-Type", exportContentTypes[format])
+	if err := writeBoardExport(w, format, export); err != nil {
+		log.Printf("Error writing %s export: %v", format, err)
+	}
+}
+
+// writeBoardCSV writes columns and tasks as rows of a single CSV file,
+// distinguished by the leading "type" field
+func writeBoardCSV(w io.Writer, export *BoardExport) error {
+	writer := csv.NewWriter(w)
+
+	header := []string{"type", "id", "title", "description", "dueDate", "priority", "columnId", "columnTitle", "order", "deleted", "hidden", "color"}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	columnTitles := make(map[string]string)
+	for _, col := range export.Columns {
+		columnTitles[col.ID] = col.Title
+		row := []string{
+			"column", col.ID, col.Title, col.Description, "", "", "", "",
+			strconv.Itoa(col.Order),
+			strconv.FormatBool(col.Deleted),
+			strconv.FormatBool(col.Hidden),
+			col.Color,
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	for _, task := range export.Tasks {
+		priority := ""
+		if task.Priority != nil {
+			priority = *task.Priority
+		}
+		columnID := ""
+		if task.ColumnID != nil {
+			columnID = *task.ColumnID
+		}
+		row := []string{
+			"task", task.ID, task.Title, task.Description, task.DueDate, priority,
+			columnID, columnTitles[columnID], "",
+			strconv.FormatBool(task.Deleted),
+			strconv.FormatBool(task.Hidden),
+			"",
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Export job statuses
+const (
+	ExportQueued  = "queued"
+	ExportRunning = "running"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// exportMaxAttempts is how often a failing export job is tried
+const exportMaxAttempts = 3
+
+// errExportNotFound is returned when an export doesn't exist or has expired
+var errExportNotFound = errors.New("export not found")
+
+// errExportInProgress is returned when the user already has an export
+// waiting or running
+var errExportInProgress = errors.New("an export is already in progress")
+
+// errExportNotReady is returned when downloading an unfinished export
+var errExportNotReady = errors.New("export is not ready")
+
+// ExportJob describes a background board export
+type ExportJob struct {
+	ID          string     `json:"id"`
+	Format      string     `json:"format"`
+	Status      string     `json:"status"`
+	Size        int64      `json:"size"`
+	Error       string     `json:"error,omitempty"`
+	DownloadURL string     `json:"downloadUrl,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+}
+
+// ExportService runs board exports on the job queue and keeps the files
+// until they expire, so large boards aren't cut off by the write timeout
+type ExportService struct {
+	db             *DB
+	dataService    *DataService
+	commentService *CommentService
+	jobs           *JobQueue
+	limiter        *RateLimiter
+	retention      time.Duration
+}
+
+// NewExportService creates the service. Exports per user are limited to
+// limit per window, sync and async together; a limit of 0 disables it.
+func NewExportService(db *DB, dataService *DataService, commentService *CommentService, jobs *JobQueue, limit int, window, retention time.Duration) *ExportService {
+	s := &ExportService{
+		db:             db,
+		dataService:    dataService,
+		commentService: commentService,
+		jobs:           jobs,
+		retention:      retention,
+	}
+	if limit > 0 {
+		s.limiter = NewRateLimiter(limit, window)
+	}
+	return s
+}
+
+// Allow counts an export against the user's budget
+func (s *ExportService) Allow(email string) RateLimitStatus {
+	if s.limiter == nil {
+		return RateLimitStatus{allowed: true}
+	}
+	return s.limiter.Allow("export:" + email)
+}
+
+// FailInterrupted marks exports left waiting or running by a previous
+// process as failed; their jobs were lost with it
+func (s *ExportService) FailInterrupted() error {
+	_, err := s.db.Exec(`
+		UPDATE exports SET status = ?, error = ?, completed_at = ?
+		WHERE status IN (?, ?)
+	`, ExportFailed, "interrupted by a server restart", time.Now().UTC(), ExportQueued, ExportRunning)
+	if err != nil {
+		return fmt.Errorf("failed to update interrupted exports: %w", err)
+	}
+	return nil
+}
+
+// Request queues an export of the user's board. Only one export per user
+// may be waiting or running at a time.
+func (s *ExportService) Request(email, format string, includeDeleted bool) (*ExportJob, error) {
+	now := time.Now().UTC()
+	if _, err := s.db.Exec("DELETE FROM exports WHERE expires_at <= ?", now); err != nil {
+		return nil, fmt.Errorf("failed to prune exports: %w", err)
+	}
+
+	var pending int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM exports WHERE email = ? AND status IN (?, ?)", email, ExportQueued, ExportRunning).Scan(&pending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query exports: %w", err)
+	}
+	if pending > 0 {
+		return nil, errExportInProgress
+	}
+
+	if err := ensureUser(s.db, email); err != nil {
+		return nil, err
+	}
+
+	job := &ExportJob{
+		ID:        generateID(),
+		Format:    format,
+		Status:    ExportQueued,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.retention),
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO exports (id, email, format, status, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, job.ID, email, format, job.Status, job.CreatedAt, job.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store export: %w", err)
+	}
+
+	attempt := 0
+	err = s.jobs.Enqueue(Job{
+		Name:        "export:" + job.ID,
+		MaxAttempts: exportMaxAttempts,
+		Run: func(ctx context.Context) error {
+			attempt++
+			err := s.run(job.ID, email, format, includeDeleted)
+			if err != nil && attempt >= exportMaxAttempts {
+				s.fail(job.ID, err)
+			}
+			return err
+		},
+	})
+	if err != nil {
+		s.fail(job.ID, err)
+		return nil, fmt.Errorf("failed to queue export: %w", err)
+	}
+
+	return job, nil
+}
+
+// run builds an export and stores the file
+func (s *ExportService) run(id, email, format string, includeDeleted bool) error {
+	if _, err := s.db.Exec("UPDATE exports SET status = ? WHERE id = ?", ExportRunning, id); err != nil {
+		return fmt.Errorf("failed to update export: %w", err)
+	}
+
+	export, err := loadBoardExport(context.Background(), s.dataService, s.commentService, email, format, includeDeleted)
+	if err != nil {
+		return fmt.Errorf("failed to build export: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeBoardExport(&buf, format, export); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+		UPDATE exports SET status = ?, filename = ?, content = ?, size = ?, completed_at = ?
+		WHERE id = ?
+	`, ExportReady, exportFilename(export, format), buf.Bytes(), buf.Len(), time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("failed to store export file: %w", err)
+	}
+	return nil
+}
+
+// fail records that an export won't be completed
+func (s *ExportService) fail(id string, cause error) {
+	_, err := s.db.Exec(`
+		UPDATE exports SET status = ?, error = ?, completed_at = ? WHERE id = ?
+	`, ExportFailed, cause.Error(), time.Now().UTC(), id)
+	if err != nil {
+		log.Printf("Error recording failed export %s: %v", id, err)
+	}
+}
+
+// Get returns one of the user's unexpired exports
+func (s *ExportService) Get(email, id string) (*ExportJob, error) {
+	var job ExportJob
+	var errMsg sql.NullString
+	var completedAt sql.NullTime
+	err := s.db.QueryRow(`
+		SELECT id, format, status, size, error, created_at, completed_at, expires_at
+		FROM exports WHERE id = ? AND email = ? AND expires_at > ?
+	`, id, email, time.Now().UTC()).Scan(&job.ID, &job.Format, &job.Status, &job.Size, &errMsg, &job.CreatedAt, &completedAt, &job.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, errExportNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query export: %w", err)
+	}
+
+	job.Error = errMsg.String
+	if completedAt.Valid {
+		job.CompletedAt = &completedAt.Time
+	}
+	if job.Status == ExportReady {
+		job.DownloadURL = "/api/exports/" + job.ID + "/download"
+	}
+	return &job, nil
+}
+
+// File returns a finished export with its filename and contents
+func (s *ExportService) File(email, id string) (*ExportJob, string, []byte, error) {
+	job, err := s.Get(email, id)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if job.Status != ExportReady {
+		return nil, "", nil, errExportNotReady
+	}
+
+	var filename string
+	var content []byte
+	err = s.db.QueryRow("SELECT filename, content FROM exports WHERE id = ?", id).Scan(&filename, &content)
+	if err == sql.ErrNoRows {
+		return nil, "", nil, errExportNotFound
+	}
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to read export: %w", err)
+	}
+	return job, filename, content, nil
+}
+
+// ExportHandler serves background exports and throttles synchronous ones
+type ExportHandler struct {
+	exportService *ExportService
+}
+
+func NewExportHandler(exportService *ExportService) *ExportHandler {
+	return &ExportHandler{exportService: exportService}
+}
+
+// Throttle applies the per-user export limit to a synchronous export handler
+func (h *ExportHandler) Throttle(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := h.exportService.Allow(requestEmail(r))
+		if !status.allowed {
+			writeRateLimited(w, status)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Create queues an export and returns its status URL
+func (h *ExportHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Format         string `json:"format"`
+		IncludeDeleted bool   `json:"includeDeleted"`
+	}
+	if r.ContentLength != 0 {
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+	}
+	if req.Format == "" {
+		req.Format = "json"
+	}
+	if _, ok := exportExtensions[req.Format]; !ok {
+		writeError(w, http.StatusBadRequest, "Unsupported export format")
+		return
+	}
+
+	email := requestEmail(r)
+	status := h.exportService.Allow(email)
+	if !status.allowed {
+		writeRateLimited(w, status)
+		return
+	}
+
+	job, err := h.exportService.Request(email, req.Format, req.IncludeDeleted)
+	if err == errExportInProgress {
+		writeError(w, http.StatusConflict, "An export is already in progress")
+		return
+	}
+	if err != nil {
+		log.Printf("Error requesting export: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to start export")
+		return
+	}
+
+	statusURL := "/api/exports/" + job.ID
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", statusURL)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":    "success",
+		"export":    job,
+		"statusUrl": statusURL,
+	})
+}
+
+// Get reports an export's progress, with its download URL once ready
+func (h *ExportHandler) Get(w http.ResponseWriter, r *http.Request) {
+	job, err := h.exportService.Get(requestEmail(r), mux.Vars(r)["id"])
+	if err == errExportNotFound {
+		writeError(w, http.StatusNotFound, "Export not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading export: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"export": job,
+	})
+}
+
+// Download serves a finished export file
+func (h *ExportHandler) Download(w http.ResponseWriter, r *http.Request) {
+	job, filename, content, err := h.exportService.File(requestEmail(r), mux.Vars(r)["id"])
+	if err == errExportNotFound {
+		writeError(w, http.StatusNotFound, "Export not found")
+		return
+	}
+	if err == errExportNotReady {
+		writeError(w, http.StatusConflict, "Export is not ready")
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading export: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Content-Type", exportContentTypes[job.Format])
+	http.ServeContent(w, r, filename, *job.CompletedAt, bytes.NewReader(content))
+}
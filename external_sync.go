@@ -0,0 +1,1100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How long after a board save the mirrors are pushed, so bursts of edits
+// become one sync
+const externalSyncDebounce = 10 * time.Second
+
+// Backoff after failed syncs: the delay doubles per consecutive failure
+// up to the maximum. Scheduled and on-save syncs wait it out; a manual sync
+// doesn't.
+const (
+	externalSyncBackoffBase = time.Minute
+	externalSyncBackoffMax  = 6 * time.Hour
+)
+
+// externalSyncBackoff returns the delay after the given number of
+// consecutive failures
+func externalSyncBackoff(failures int) time.Duration {
+	delay := externalSyncBackoffBase
+	for i := 1; i < failures && delay < externalSyncBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > externalSyncBackoffMax {
+		delay = externalSyncBackoffMax
+	}
+	return delay
+}
+
+// taskProvidersFromConfig returns the providers with a configured OAuth
+// client, keyed by provider name
+func taskProvidersFromConfig(cfg *Config) map[string]TaskProvider {
+	providers := map[string]TaskProvider{}
+	if cfg.GoogleTasks.Enabled() {
+		providers[providerGoogleTasks] = NewGoogleTasksProvider(cfg.GoogleTasks)
+	}
+	if cfg.MicrosoftTodo.Enabled() {
+		providers[providerMicrosoftTodo] = NewMicrosoftTodoProvider(cfg.MicrosoftTodo, cfg.MicrosoftTenant)
+	}
+	return providers
+}
+
+// OAuthClientConfig is an OAuth client registered with an external provider
+type OAuthClientConfig struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// Enabled reports whether the client is configured
+func (c OAuthClientConfig) Enabled() bool {
+	return c.ClientID != ""
+}
+
+// oauthToken is an OAuth token endpoint's reply
+type oauthToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// oauthClient runs the authorization code flow against one provider
+type oauthClient struct {
+	cfg        OAuthClientConfig
+	authURL    string
+	tokenURL   string
+	scope      string
+	authParams url.Values // provider-specific consent page parameters
+	client     *http.Client
+}
+
+// AuthCodeURL returns the provider's consent page URL
+func (o *oauthClient) AuthCodeURL(state string) string {
+	params := url.Values{
+		"client_id":     {o.cfg.ClientID},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"response_type": {"code"},
+		"scope":         {o.scope},
+		"state":         {state},
+	}
+	for key, values := range o.authParams {
+		params[key] = values
+	}
+	return o.authURL + "?" + params.Encode()
+}
+
+// Exchange trades an authorization code for tokens
+func (o *oauthClient) Exchange(ctx context.Context, code string) (*oauthToken, error) {
+	return o.requestToken(ctx, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.cfg.RedirectURL},
+	})
+}
+
+// Refresh gets a new access token with a refresh token
+func (o *oauthClient) Refresh(ctx context.Context, refreshToken string) (*oauthToken, error) {
+	return o.requestToken(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"scope":         {o.scope},
+	})
+}
+
+func (o *oauthClient) requestToken(ctx context.Context, params url.Values) (*oauthToken, error) {
+	params.Set("client_id", o.cfg.ClientID)
+	params.Set("client_secret", o.cfg.ClientSecret)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.tokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("token endpoint returned %s: %s", resp.Status, detail)
+	}
+
+	var token oauthToken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("failed to decode token: %w", err)
+	}
+	return &token, nil
+}
+
+// remoteError is a non-2xx reply from a provider's API
+type remoteError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Detail     string
+}
+
+func (e *remoteError) Error() string {
+	return fmt.Sprintf("%s %s: %d: %s", e.Method, e.URL, e.StatusCode, e.Detail)
+}
+
+// isRemoteNotFound reports whether a provider said the item doesn't exist
+func isRemoteNotFound(err error) bool {
+	var remote *remoteError
+	return errors.As(err, &remote) && (remote.StatusCode == http.StatusNotFound || remote.StatusCode == http.StatusGone)
+}
+
+// doJSON makes an authorized JSON API call, decoding the reply into out if given
+func doJSON(ctx context.Context, client *http.Client, token, method, rawURL string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &remoteError{Method: method, URL: rawURL, StatusCode: resp.StatusCode, Detail: string(detail)}
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// RemoteTask is a task in an external service, in the fields that are
+// mirrored
+type RemoteTask struct {
+	ID        string
+	Title     string
+	Notes     string
+	Due       string // YYYY-MM-DD or ""
+	Completed bool
+	Deleted   bool
+	Updated   time.Time
+}
+
+// TaskProvider is an external task service that boards can be mirrored
+// with. The sync logic is shared; providers only translate.
+type TaskProvider interface {
+	// OAuth returns the client used to connect accounts
+	OAuth() *oauthClient
+
+	// ListChanges returns the remote tasks changed since the connection's
+	// cursor (all of them when it's empty) and the cursor for next time
+	ListChanges(ctx context.Context, token string, c *ExternalConnection) ([]RemoteTask, string, error)
+
+	CreateTask(ctx context.Context, token string, c *ExternalConnection, task RemoteTask) (string, error)
+	UpdateTask(ctx context.Context, token string, c *ExternalConnection, id string, task RemoteTask) error
+	DeleteTask(ctx context.Context, token string, c *ExternalConnection, id string) error
+}
+
+// providerSlug is a provider's name as used in URLs
+func providerSlug(provider string) string {
+	return strings.ReplaceAll(provider, "_", "-")
+}
+
+// ExternalConnection links a user's board, or one column of it, to a task
+// list in another service
+type ExternalConnection struct {
+	Provider     string     `json:"provider"`
+	RemoteListID string     `json:"remoteListId"`           // "" is the provider's default list
+	ColumnID     string     `json:"columnId"`               // "" mirrors the whole board
+	LastSyncedAt *time.Time `json:"lastSyncedAt,omitempty"` // last successful sync
+	LastError    string     `json:"lastError,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt"`
+
+	// Consecutive failed syncs, and when the next scheduled one may run
+	FailureCount  int        `json:"failureCount"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+
+	email        string
+	accessToken  string
+	refreshToken string
+	tokenExpiry  time.Time
+	cursor       string
+}
+
+// inScope reports whether a task is mirrored by the connection
+func (c *ExternalConnection) inScope(task Task) bool {
+	if task.Deleted {
+		return false
+	}
+	if c.ColumnID == "" {
+		return true
+	}
+	return task.ColumnID != nil && *task.ColumnID == c.ColumnID
+}
+
+// externalMapping pairs a local task with a remote item
+type externalMapping struct {
+	taskID     string
+	externalID string
+	hash       string
+}
+
+// ExternalSyncStatus is a connection as shown to admins
+type ExternalSyncStatus struct {
+	Email string `json:"email"`
+	ExternalConnection
+	MappedTasks int `json:"mappedTasks"`
+}
+
+// errConnectionNotFound is returned when a user hasn't connected a provider
+var errConnectionNotFound = errors.New("connection not found")
+
+// errNothingToSync aborts a board update that turned out to change nothing
+var errNothingToSync = errors.New("nothing to sync")
+
+// normalizeDueDate reduces a due date to YYYY-MM-DD, or "" if unset
+func normalizeDueDate(value string) string {
+	if t, ok := parseDueDate(value); ok {
+		return t.Format("2006-01-02")
+	}
+	return ""
+}
+
+// mirrorHash fingerprints the fields kept in sync with a remote task
+func mirrorHash(title, notes, due string) string {
+	sum := sha256.Sum256([]byte(title + "\x00" + notes + "\x00" + normalizeDueDate(due)))
+	return hex.EncodeToString(sum[:16])
+}
+
+func localMirrorHash(task Task) string {
+	return mirrorHash(task.Title, task.Description, task.DueDate)
+}
+
+func (t RemoteTask) mirrorHash() string {
+	return mirrorHash(t.Title, t.Notes, t.Due)
+}
+
+// remoteTaskFromLocal builds the mirrored fields of a task
+func remoteTaskFromLocal(task Task) RemoteTask {
+	return RemoteTask{Title: task.Title, Notes: task.Description, Due: normalizeDueDate(task.DueDate)}
+}
+
+// loadMappings returns a connection's mappings keyed by local task ID
+func loadMappings(q querier, email, provider string) (map[string]*externalMapping, error) {
+	rows, err := q.Query(`
+		SELECT task_id, external_id, hash FROM external_mappings
+		WHERE email = ? AND provider = ?
+	`, email, provider)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mappings: %w", err)
+	}
+	defer rows.Close()
+
+	mappings := make(map[string]*externalMapping)
+	for rows.Next() {
+		var m externalMapping
+		if err := rows.Scan(&m.taskID, &m.externalID, &m.hash); err != nil {
+			return nil, fmt.Errorf("failed to scan mapping: %w", err)
+		}
+		mappings[m.taskID] = &m
+	}
+	return mappings, rows.Err()
+}
+
+// saveMapping inserts or updates a mapping
+func saveMapping(e execer, email, provider string, m *externalMapping) error {
+	_, err := e.Exec(`
+		INSERT INTO external_mappings (email, provider, task_id, external_id, hash)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(email, provider, task_id) DO UPDATE SET
+			external_id = excluded.external_id,
+			hash = excluded.hash
+	`, email, provider, m.taskID, m.externalID, m.hash)
+	if err != nil {
+		return fmt.Errorf("failed to save mapping: %w", err)
+	}
+	return nil
+}
+
+// deleteMapping removes a mapping
+func deleteMapping(e execer, email, provider, taskID string) error {
+	_, err := e.Exec(`
+		DELETE FROM external_mappings WHERE email = ? AND provider = ? AND task_id = ?
+	`, email, provider, taskID)
+	if err != nil {
+		return fmt.Errorf("failed to delete mapping: %w", err)
+	}
+	return nil
+}
+
+// ExternalSyncService mirrors boards with external task services
+type ExternalSyncService struct {
+	db          *DB
+	dataService *DataService
+	authService *AuthService
+	jobs        *JobQueue
+	hub         *Hub
+	providers   map[string]TaskProvider
+
+	// Pending debounced syncs, by email
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+
+	// One lock per connection, so queued syncs of it never overlap
+	locks sync.Map
+}
+
+func NewExternalSyncService(db *DB, dataService *DataService, authService *AuthService, jobs *JobQueue, hub *Hub, providers map[string]TaskProvider) *ExternalSyncService {
+	s := &ExternalSyncService{
+		db:          db,
+		dataService: dataService,
+		authService: authService,
+		jobs:        jobs,
+		hub:         hub,
+		providers:   providers,
+		pending:     make(map[string]*time.Timer),
+	}
+
+	// Local changes are pushed shortly after each save; remote changes are
+	// picked up by the schedule
+	dataService.OnSave(s.scheduleSync)
+	return s
+}
+
+// Enabled reports whether a provider is configured
+func (s *ExternalSyncService) Enabled(provider string) bool {
+	_, ok := s.providers[provider]
+	return ok
+}
+
+// AuthURL returns the provider's consent page URL for connecting an account
+func (s *ExternalSyncService) AuthURL(email, provider string) (string, error) {
+	state, err := s.authService.CreateStateToken(email, provider, 10*time.Minute)
+	if err != nil {
+		return "", err
+	}
+	return s.providers[provider].OAuth().AuthCodeURL(state), nil
+}
+
+// Connect completes the OAuth flow and stores the user's connection. The
+// whole board is mirrored to the default list until configured.
+func (s *ExternalSyncService) Connect(ctx context.Context, provider, state, code string) (string, error) {
+	email, err := s.authService.VerifyStateToken(state, provider)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := s.providers[provider].OAuth().Exchange(ctx, code)
+	if err != nil {
+		return "", err
+	}
+
+	if err := ensureUser(s.db, email); err != nil {
+		return "", err
+	}
+
+	expiry := time.Now().UTC().Add(time.Duration(token.ExpiresIn) * time.Second)
+	_, err = s.db.Exec(`
+		INSERT INTO external_connections
+			(email, provider, access_token, refresh_token, token_expiry, remote_list_id, created_at)
+		VALUES (?, ?, ?, ?, ?, '', CURRENT_TIMESTAMP)
+		ON CONFLICT(email, provider) DO UPDATE SET
+			access_token = excluded.access_token,
+			refresh_token = excluded.refresh_token,
+			token_expiry = excluded.token_expiry,
+			last_error = '',
+			failure_count = 0,
+			next_attempt_at = NULL
+	`, email, provider, token.AccessToken, token.RefreshToken, expiry)
+	if err != nil {
+		return "", fmt.Errorf("failed to save connection: %w", err)
+	}
+
+	s.enqueueSync(email, provider)
+	return email, nil
+}
+
+const connectionColumns = `email, provider, access_token, refresh_token, token_expiry, remote_list_id,
+	column_id, sync_cursor, last_synced_at, last_error, created_at, failure_count, next_attempt_at`
+
+func scanConnection(row interface{ Scan(...any) error }) (*ExternalConnection, error) {
+	var c ExternalConnection
+	var lastSynced, nextAttempt sql.NullTime
+	err := row.Scan(&c.email, &c.Provider, &c.accessToken, &c.refreshToken, &c.tokenExpiry, &c.RemoteListID,
+		&c.ColumnID, &c.cursor, &lastSynced, &c.LastError, &c.CreatedAt, &c.FailureCount, &nextAttempt)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastSynced.Valid {
+		c.LastSyncedAt = &lastSynced.Time
+	}
+	if nextAttempt.Valid {
+		c.NextAttemptAt = &nextAttempt.Time
+	}
+	return &c, nil
+}
+
+// Get returns one of a user's connections
+func (s *ExternalSyncService) Get(email, provider string) (*ExternalConnection, error) {
+	c, err := scanConnection(s.db.QueryRow(`
+		SELECT `+connectionColumns+` FROM external_connections WHERE email = ? AND provider = ?
+	`, email, provider))
+	if err == sql.ErrNoRows {
+		return nil, errConnectionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query connection: %w", err)
+	}
+	return c, nil
+}
+
+// Status returns every connection with its sync state, for admins
+func (s *ExternalSyncService) Status() ([]ExternalSyncStatus, error) {
+	counts := make(map[string]int)
+	rows, err := s.db.Query(`
+		SELECT email, provider, COUNT(*) FROM external_mappings GROUP BY email, provider
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count mappings: %w", err)
+	}
+	for rows.Next() {
+		var email, provider string
+		var count int
+		if err := rows.Scan(&email, &provider, &count); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan mapping count: %w", err)
+		}
+		counts[provider+":"+email] = count
+	}
+	rows.Close()
+
+	rows, err = s.db.Query(`
+		SELECT ` + connectionColumns + ` FROM external_connections ORDER BY email, provider
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query connections: %w", err)
+	}
+	defer rows.Close()
+
+	statuses := []ExternalSyncStatus{}
+	for rows.Next() {
+		c, err := scanConnection(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan connection: %w", err)
+		}
+		statuses = append(statuses, ExternalSyncStatus{
+			Email:              c.email,
+			ExternalConnection: *c,
+			MappedTasks:        counts[c.Provider+":"+c.email],
+		})
+	}
+	return statuses, rows.Err()
+}
+
+// Configure chooses what is mirrored: one column (or "" for the whole
+// board) and the remote list. The next sync removes remote copies of tasks
+// that left the mirror; switching lists starts a fresh mirror instead,
+// leaving the old list as it is.
+func (s *ExternalSyncService) Configure(email, provider, columnID, listID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var currentListID string
+	err = tx.QueryRow(`
+		SELECT remote_list_id FROM external_connections WHERE email = ? AND provider = ?
+	`, email, provider).Scan(&currentListID)
+	if err == sql.ErrNoRows {
+		return errConnectionNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query connection: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE external_connections SET column_id = ?, remote_list_id = ?
+		WHERE email = ? AND provider = ?
+	`, columnID, listID, email, provider)
+	if err != nil {
+		return fmt.Errorf("failed to update connection: %w", err)
+	}
+
+	if listID != currentListID {
+		_, err = tx.Exec(`
+			UPDATE external_connections SET sync_cursor = '' WHERE email = ? AND provider = ?
+		`, email, provider)
+		if err != nil {
+			return fmt.Errorf("failed to reset sync cursor: %w", err)
+		}
+		_, err = tx.Exec("DELETE FROM external_mappings WHERE email = ? AND provider = ?", email, provider)
+		if err != nil {
+			return fmt.Errorf("failed to reset mappings: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.enqueueSync(email, provider)
+	return nil
+}
+
+// Disconnect removes a connection and its mappings. Remote tasks are left
+// in place.
+func (s *ExternalSyncService) Disconnect(email, provider string) error {
+	for _, table := range []string{"external_mappings", "external_connections"} {
+		_, err := s.db.Exec("DELETE FROM "+table+" WHERE email = ? AND provider = ?", email, provider)
+		if err != nil {
+			return fmt.Errorf("failed to delete from %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// accessToken returns a valid access token, refreshing it when needed
+func (s *ExternalSyncService) accessToken(ctx context.Context, p TaskProvider, c *ExternalConnection) (string, error) {
+	if time.Now().Add(time.Minute).Before(c.tokenExpiry) {
+		return c.accessToken, nil
+	}
+
+	token, err := p.OAuth().Refresh(ctx, c.refreshToken)
+	if err != nil {
+		return "", err
+	}
+
+	c.accessToken = token.AccessToken
+	c.tokenExpiry = time.Now().UTC().Add(time.Duration(token.ExpiresIn) * time.Second)
+	// Some providers rotate refresh tokens, others keep the original
+	if token.RefreshToken != "" {
+		c.refreshToken = token.RefreshToken
+	}
+	_, err = s.db.Exec(`
+		UPDATE external_connections SET access_token = ?, refresh_token = ?, token_expiry = ?
+		WHERE email = ? AND provider = ?
+	`, c.accessToken, c.refreshToken, c.tokenExpiry, c.email, c.Provider)
+	if err != nil {
+		return "", fmt.Errorf("failed to save refreshed token: %w", err)
+	}
+	return c.accessToken, nil
+}
+
+// pullRemoteChanges applies remote changes to the board. When a task
+// changed on both sides since the last sync, the side changed most recently
+// wins; a losing local edit is pushed back out by pushLocalChanges.
+func (s *ExternalSyncService) pullRemoteChanges(ctx context.Context, c *ExternalConnection, remote []RemoteTask) error {
+	aging, err := s.dataService.TaskAging(ctx, c.email)
+	if err != nil {
+		return err
+	}
+
+	data, err := s.dataService.UpdateUserDataTx(ctx, c.email, func(tx *Tx, data *KanbanData) error {
+		mappings, err := loadMappings(tx, c.email, c.Provider)
+		if err != nil {
+			return err
+		}
+		byExternal := make(map[string]*externalMapping, len(mappings))
+		for _, m := range mappings {
+			byExternal[m.externalID] = m
+		}
+
+		changed := false
+		for _, rt := range remote {
+			m, mapped := byExternal[rt.ID]
+			if !mapped {
+				// Import new open tasks created on the other side
+				if rt.Deleted || rt.Completed || rt.Title == "" {
+					continue
+				}
+				task := Task{ID: generateID(), Title: rt.Title, Description: rt.Notes, DueDate: rt.Due}
+				if c.ColumnID != "" && findColumn(data, c.ColumnID) >= 0 {
+					columnID := c.ColumnID
+					task.ColumnID = &columnID
+				}
+				data.Tasks = append(data.Tasks, task)
+				if err := saveMapping(tx, c.email, c.Provider, &externalMapping{taskID: task.ID, externalID: rt.ID, hash: rt.mirrorHash()}); err != nil {
+					return err
+				}
+				changed = true
+				continue
+			}
+
+			i := findTask(data, m.taskID)
+			if i < 0 {
+				// Deleted or archived locally; the push removes it remotely
+				continue
+			}
+			if rt.Deleted {
+				data.Tasks[i].Deleted = true
+				if err := deleteMapping(tx, c.email, c.Provider, m.taskID); err != nil {
+					return err
+				}
+				changed = true
+				continue
+			}
+
+			remoteHash := rt.mirrorHash()
+			if remoteHash == m.hash {
+				continue
+			}
+			if localMirrorHash(data.Tasks[i]) != m.hash {
+				if age, ok := aging[m.taskID]; ok && age.LastActivityAt.After(rt.Updated) {
+					continue
+				}
+			}
+
+			data.Tasks[i].Title = rt.Title
+			data.Tasks[i].Description = rt.Notes
+			data.Tasks[i].DueDate = rt.Due
+			m.hash = remoteHash
+			if err := saveMapping(tx, c.email, c.Provider, m); err != nil {
+				return err
+			}
+			changed = true
+		}
+
+		if !changed {
+			return errNothingToSync
+		}
+		return nil
+	})
+	if err == errNothingToSync {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Show the imported changes on open boards
+	s.hub.PublishBoard(canonicalBoardID(c.email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+	return nil
+}
+
+// pushLocalChanges creates, updates and deletes remote tasks to match the
+// mirrored part of the board
+func (s *ExternalSyncService) pushLocalChanges(ctx context.Context, p TaskProvider, token string, c *ExternalConnection) error {
+	data, err := s.dataService.GetUserData(ctx, c.email)
+	if err != nil {
+		return err
+	}
+	mappings, err := loadMappings(s.db, c.email, c.Provider)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, task := range data.Tasks {
+		if !c.inScope(task) {
+			continue
+		}
+		seen[task.ID] = true
+		hash := localMirrorHash(task)
+
+		m, mapped := mappings[task.ID]
+		if mapped && m.hash == hash {
+			continue
+		}
+
+		if mapped {
+			err = p.UpdateTask(ctx, token, c, m.externalID, remoteTaskFromLocal(task))
+		} else {
+			m = &externalMapping{taskID: task.ID}
+			m.externalID, err = p.CreateTask(ctx, token, c, remoteTaskFromLocal(task))
+		}
+		if err != nil {
+			return err
+		}
+
+		m.hash = hash
+		if err := saveMapping(s.db, c.email, c.Provider, m); err != nil {
+			return err
+		}
+	}
+
+	// Tasks deleted, archived or moved out of the mirrored column
+	for taskID, m := range mappings {
+		if seen[taskID] {
+			continue
+		}
+		if err := p.DeleteTask(ctx, token, c, m.externalID); err != nil && !isRemoteNotFound(err) {
+			return err
+		}
+		if err := deleteMapping(s.db, c.email, c.Provider, taskID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync runs one two-way sync of a connection and records the outcome
+func (s *ExternalSyncService) Sync(ctx context.Context, email, provider string) error {
+	p, ok := s.providers[provider]
+	if !ok {
+		return nil
+	}
+	lock, _ := s.locks.LoadOrStore(provider+":"+email, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	c, err := s.Get(email, provider)
+	if err == errConnectionNotFound {
+		// Disconnected since being scheduled
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cursor, err := s.sync(ctx, p, c)
+
+	var dbErr error
+	if err == nil {
+		_, dbErr = s.db.Exec(`
+			UPDATE external_connections SET sync_cursor = ?, last_synced_at = ?, last_error = '',
+				failure_count = 0, next_attempt_at = NULL
+			WHERE email = ? AND provider = ?
+		`, cursor, time.Now().UTC(), email, provider)
+	} else {
+		failures := c.FailureCount + 1
+		log.Printf("Error syncing %s for %s (failure %d): %v", provider, email, failures, err)
+		_, dbErr = s.db.Exec(`
+			UPDATE external_connections SET last_error = ?, failure_count = ?, next_attempt_at = ?
+			WHERE email = ? AND provider = ?
+		`, err.Error(), failures, time.Now().UTC().Add(externalSyncBackoff(failures)), email, provider)
+	}
+	if dbErr != nil {
+		log.Printf("Error recording %s sync for %s: %v", provider, email, dbErr)
+	}
+	return err
+}
+
+func (s *ExternalSyncService) sync(ctx context.Context, p TaskProvider, c *ExternalConnection) (string, error) {
+	token, err := s.accessToken(ctx, p, c)
+	if err != nil {
+		return "", err
+	}
+
+	remote, cursor, err := p.ListChanges(ctx, token, c)
+	var remoteErr *remoteError
+	if errors.As(err, &remoteErr) && remoteErr.StatusCode == http.StatusGone && c.cursor != "" {
+		// The provider expired the cursor; start over with a full listing,
+		// which the stored hashes turn into a no-op for unchanged tasks
+		c.cursor = ""
+		remote, cursor, err = p.ListChanges(ctx, token, c)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := s.pullRemoteChanges(ctx, c, remote); err != nil {
+		return "", err
+	}
+	if err := s.pushLocalChanges(ctx, p, token, c); err != nil {
+		return "", err
+	}
+	return cursor, nil
+}
+
+// enqueueSync queues a sync job for a connection. Failures are retried by
+// the schedule with the connection's backoff, not by the job queue.
+func (s *ExternalSyncService) enqueueSync(email, provider string) {
+	err := s.jobs.Enqueue(Job{
+		Name:        provider + ":" + email,
+		MaxAttempts: 1,
+		Run: func(ctx context.Context) error {
+			return s.Sync(ctx, email, provider)
+		},
+	})
+	if err != nil {
+		log.Printf("Error queueing %s sync for %s: %v", provider, email, err)
+	}
+}
+
+// userProviders returns the providers a user has connected that aren't
+// backing off
+func (s *ExternalSyncService) userProviders(email string) ([]string, error) {
+	rows, err := s.db.Query(`
+		SELECT provider FROM external_connections
+		WHERE email = ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?)
+	`, email, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query connections: %w", err)
+	}
+	defer rows.Close()
+
+	var providers []string
+	for rows.Next() {
+		var provider string
+		if err := rows.Scan(&provider); err != nil {
+			return nil, fmt.Errorf("failed to scan connection: %w", err)
+		}
+		providers = append(providers, provider)
+	}
+	return providers, rows.Err()
+}
+
+// scheduleSync queues debounced syncs of a user's connections after a
+// board save
+func (s *ExternalSyncService) scheduleSync(email string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if timer, ok := s.pending[email]; ok {
+		timer.Reset(externalSyncDebounce)
+		return
+	}
+	s.pending[email] = time.AfterFunc(externalSyncDebounce, func() {
+		s.mu.Lock()
+		delete(s.pending, email)
+		s.mu.Unlock()
+
+		providers, err := s.userProviders(email)
+		if err != nil {
+			log.Printf("Error scheduling external sync for %s: %v", email, err)
+			return
+		}
+		for _, provider := range providers {
+			s.enqueueSync(email, provider)
+		}
+	})
+}
+
+// RunSchedule syncs every connection on each interval tick, picking up
+// remote changes
+func (s *ExternalSyncService) RunSchedule(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		rows, err := s.db.Query(`
+			SELECT email, provider FROM external_connections
+			WHERE next_attempt_at IS NULL OR next_attempt_at <= ?
+		`, time.Now().UTC())
+		if err != nil {
+			log.Printf("Error querying external connections: %v", err)
+			continue
+		}
+		type connection struct{ email, provider string }
+		var connections []connection
+		for rows.Next() {
+			var c connection
+			if err := rows.Scan(&c.email, &c.provider); err == nil {
+				connections = append(connections, c)
+			}
+		}
+		rows.Close()
+
+		for _, c := range connections {
+			if s.Enabled(c.provider) {
+				s.enqueueSync(c.email, c.provider)
+			}
+		}
+	}
+}
+
+// ExternalSyncHandler exposes external connections over HTTP, under
+// /api/integrations/{provider} with the provider's slug
+type ExternalSyncHandler struct {
+	externalSyncService *ExternalSyncService
+}
+
+func NewExternalSyncHandler(externalSyncService *ExternalSyncService) *ExternalSyncHandler {
+	return &ExternalSyncHandler{externalSyncService: externalSyncService}
+}
+
+// provider resolves the route's provider, writing a 404 if it isn't enabled
+func (h *ExternalSyncHandler) provider(w http.ResponseWriter, r *http.Request) (string, bool) {
+	provider := strings.ReplaceAll(mux.Vars(r)["provider"], "-", "_")
+	if !h.externalSyncService.Enabled(provider) {
+		writeError(w, http.StatusNotFound, "Unknown integration")
+		return "", false
+	}
+	return provider, true
+}
+
+// Connect returns the consent page URL the client should navigate to
+func (h *ExternalSyncHandler) Connect(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.provider(w, r)
+	if !ok {
+		return
+	}
+
+	authURL, err := h.externalSyncService.AuthURL(requestEmail(r), provider)
+	if err != nil {
+		log.Printf("Error building %s auth URL: %v", provider, err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"url":    authURL,
+	})
+}
+
+// Callback finishes the OAuth flow the provider redirects back to
+func (h *ExternalSyncHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.provider(w, r)
+	if !ok {
+		return
+	}
+
+	redirect := "/?integration=" + providerSlug(provider)
+	query := r.URL.Query()
+	if errParam := query.Get("error"); errParam != "" {
+		http.Redirect(w, r, redirect+"&error="+url.QueryEscape(errParam), http.StatusFound)
+		return
+	}
+
+	if _, err := h.externalSyncService.Connect(r.Context(), provider, query.Get("state"), query.Get("code")); err != nil {
+		log.Printf("Error connecting %s: %v", provider, err)
+		writeError(w, http.StatusBadRequest, "Failed to connect integration")
+		return
+	}
+
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// Get returns the connection and its sync status
+func (h *ExternalSyncHandler) Get(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.provider(w, r)
+	if !ok {
+		return
+	}
+
+	conn, err := h.externalSyncService.Get(requestEmail(r), provider)
+	if err == errConnectionNotFound {
+		writeError(w, http.StatusNotFound, "Integration is not connected")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading %s connection: %v", provider, err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     "success",
+		"connection": conn,
+	})
+}
+
+// Update chooses the mirrored column and remote list
+func (h *ExternalSyncHandler) Update(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.provider(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		ColumnID     string `json:"columnId"`
+		RemoteListID string `json:"remoteListId"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	err := h.externalSyncService.Configure(requestEmail(r), provider, req.ColumnID, req.RemoteListID)
+	if err == errConnectionNotFound {
+		writeError(w, http.StatusNotFound, "Integration is not connected")
+		return
+	}
+	if err != nil {
+		log.Printf("Error configuring %s: %v", provider, err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Delete disconnects the integration
+func (h *ExternalSyncHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.provider(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.externalSyncService.Disconnect(requestEmail(r), provider); err != nil {
+		log.Printf("Error disconnecting %s: %v", provider, err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Status lists every connection's sync state, for admins
+func (h *ExternalSyncHandler) Status(w http.ResponseWriter, r *http.Request) {
+	statuses, err := h.externalSyncService.Status()
+	if err != nil {
+		log.Printf("Error loading sync status: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":      "success",
+		"connections": statuses,
+	})
+}
+
+// SyncNow queues an immediate sync, skipping any backoff
+func (h *ExternalSyncHandler) SyncNow(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.provider(w, r)
+	if !ok {
+		return
+	}
+
+	email := requestEmail(r)
+	if _, err := h.externalSyncService.Get(email, provider); err != nil {
+		writeError(w, http.StatusNotFound, "Integration is not connected")
+		return
+	}
+
+	h.externalSyncService.enqueueSync(email, provider)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
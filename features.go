@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Feature flags let big features roll out gradually. Each flag's rollout
+// comes from FEATURE_FLAGS (falling back to its default): on, off, or a
+// percentage of users, picked by hashing the email so a user stays in or
+// out as the rollout grows. A per-user override stored in the database
+// wins over the rollout; admins can set one for any flag, and users can
+// opt in or out of beta flags themselves.
+
+// Flag names
+const (
+	FlagDeltaSync = "delta_sync"
+	FlagCRDTSync  = "crdt_sync"
+)
+
+// FeatureFlag describes a flag
+type FeatureFlag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Users may turn a beta flag on or off for themselves
+	Beta bool `json:"beta"`
+	// Percentage of users the flag is on for without FEATURE_FLAGS
+	DefaultRollout int `json:"-"`
+}
+
+// featureFlags lists every flag the server knows
+var featureFlags = []FeatureFlag{
+	{Name: FlagDeltaSync, Description: "Send board changes as operations over the WebSocket instead of full syncs", Beta: true, DefaultRollout: 100},
+	{Name: FlagCRDTSync, Description: "Also merge full syncs with the experimental CRDT engine and report where it differs; the usual merge's result is still what's saved"},
+}
+
+func lookupFeatureFlag(name string) (FeatureFlag, bool) {
+	for _, flag := range featureFlags {
+		if flag.Name == name {
+			return flag, true
+		}
+	}
+	return FeatureFlag{}, false
+}
+
+// parseFlagRollouts parses FEATURE_FLAGS, a comma-separated list of
+// name=on, name=off or name=N% entries, into percentages by flag
+func parseFlagRollouts(value string) (map[string]int, error) {
+	rollouts := make(map[string]int)
+	for _, entry := range splitList(value) {
+		name, setting, ok := strings.Cut(entry, "=")
+		name, setting = strings.TrimSpace(name), strings.ToLower(strings.TrimSpace(setting))
+		if !ok {
+			return nil, fmt.Errorf("entry %q must be name=on, name=off or name=N%%", entry)
+		}
+		if _, known := lookupFeatureFlag(name); !known {
+			return nil, fmt.Errorf("unknown flag %q", name)
+		}
+
+		switch setting {
+		case "on":
+			rollouts[name] = 100
+		case "off":
+			rollouts[name] = 0
+		default:
+			percent, err := strconv.Atoi(strings.TrimSuffix(setting, "%"))
+			if err != nil || !strings.HasSuffix(setting, "%") || percent < 0 || percent > 100 {
+				return nil, fmt.Errorf("%s must be on, off or a percentage from 0%% to 100%%, got %q", name, setting)
+			}
+			rollouts[name] = percent
+		}
+	}
+	return rollouts, nil
+}
+
+// rolloutBucket places a user in one of 100 buckets for a flag; the flag
+// name is mixed in so each flag's rollout reaches a different set of users
+func rolloutBucket(flag, email string) int {
+	h := fnv.New32a()
+	h.Write([]byte(flag + ":" + strings.ToLower(email)))
+	return int(h.Sum32() % 100)
+}
+
+// FlagState is a flag as it applies to one user
+type FlagState struct {
+	FeatureFlag
+	Enabled bool `json:"enabled"`
+	// Set when a stored override, not the rollout, decides the flag
+	Overridden bool `json:"overridden"`
+}
+
+// FeatureFlagService evaluates flags for users and stores their overrides
+type FeatureFlagService struct {
+	db       *DB
+	rollouts map[string]int
+}
+
+func NewFeatureFlagService(db *DB, rollouts map[string]int) *FeatureFlagService {
+	return &FeatureFlagService{db: db, rollouts: rollouts}
+}
+
+// rolledOut reports whether a flag is on for a user before overrides
+func (s *FeatureFlagService) rolledOut(flag FeatureFlag, email string) bool {
+	percent := flag.DefaultRollout
+	if s != nil {
+		if configured, ok := s.rollouts[flag.Name]; ok {
+			percent = configured
+		}
+	}
+	return rolloutBucket(flag.Name, email) < percent
+}
+
+// Enabled reports whether a flag is on for a user. Handlers call it to
+// gate a feature; unknown flags are off, and if the override can't be read
+// the rollout decides. A nil service applies the default rollouts.
+func (s *FeatureFlagService) Enabled(email, name string) bool {
+	flag, ok := lookupFeatureFlag(name)
+	if !ok {
+		return false
+	}
+	if s == nil {
+		return s.rolledOut(flag, email)
+	}
+
+	var enabled int
+	err := s.db.QueryRow("SELECT enabled FROM feature_flag_overrides WHERE email = ? AND flag = ?", email, name).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return s.rolledOut(flag, email)
+	}
+	if err != nil {
+		log.Printf("Error loading %s override for %s: %v", name, email, err)
+		return s.rolledOut(flag, email)
+	}
+	return enabled == 1
+}
+
+// ForUser returns every flag as it applies to a user
+func (s *FeatureFlagService) ForUser(email string) ([]FlagState, error) {
+	rows, err := s.db.Query("SELECT flag, enabled FROM feature_flag_overrides WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query flag overrides: %w", err)
+	}
+	defer rows.Close()
+
+	overrides := make(map[string]bool)
+	for rows.Next() {
+		var flag string
+		var enabled int
+		if err := rows.Scan(&flag, &enabled); err != nil {
+			return nil, fmt.Errorf("failed to scan flag override: %w", err)
+		}
+		overrides[flag] = enabled == 1
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	states := make([]FlagState, 0, len(featureFlags))
+	for _, flag := range featureFlags {
+		state := FlagState{FeatureFlag: flag, Enabled: s.rolledOut(flag, email)}
+		if enabled, ok := overrides[flag.Name]; ok {
+			state.Enabled, state.Overridden = enabled, true
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states, nil
+}
+
+// SetOverride turns a flag on or off for a user regardless of the rollout
+func (s *FeatureFlagService) SetOverride(email, name string, enabled bool) error {
+	value := 0
+	if enabled {
+		value = 1
+	}
+
+	if err := ensureUser(s.db, email); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO feature_flag_overrides (email, flag, enabled, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(email, flag) DO UPDATE SET
+			enabled = excluded.enabled,
+			updated_at = CURRENT_TIMESTAMP
+	`, email, name, value)
+	if err != nil {
+		return fmt.Errorf("failed to save flag override: %w", err)
+	}
+	return nil
+}
+
+// ClearOverride hands a flag back to the rollout for a user
+func (s *FeatureFlagService) ClearOverride(email, name string) error {
+	_, err := s.db.Exec("DELETE FROM feature_flag_overrides WHERE email = ? AND flag = ?", email, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete flag override: %w", err)
+	}
+	return nil
+}
+
+// FeatureFlagHandler exposes flags to clients and overrides to admins
+type FeatureFlagHandler struct {
+	flagService *FeatureFlagService
+}
+
+func NewFeatureFlagHandler(flagService *FeatureFlagService) *FeatureFlagHandler {
+	return &FeatureFlagHandler{flagService: flagService}
+}
+
+// writeFlags responds with a user's flags, as a name to enabled map for
+// quick checks and as a list with descriptions for settings screens
+func (h *FeatureFlagHandler) writeFlags(w http.ResponseWriter, email string) {
+	states, err := h.flagService.ForUser(email)
+	if err != nil {
+		log.Printf("Error loading flags: %v", err)
+		writeServerError(w, err, "Server error")
+		return
+	}
+
+	enabled := make(map[string]bool, len(states))
+	for _, state := range states {
+		enabled[state.Name] = state.Enabled
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"flags":   enabled,
+		"details": states,
+	})
+}
+
+// List returns the requesting user's flags
+func (h *FeatureFlagHandler) List(w http.ResponseWriter, r *http.Request) {
+	h.writeFlags(w, requestEmail(r))
+}
+
+// flagFromRequest returns the flag named in the path, writing a 404 for
+// unknown flags and, when beta is set, a 403 for flags users can't toggle
+func flagFromRequest(w http.ResponseWriter, r *http.Request, beta bool) (FeatureFlag, bool) {
+	flag, ok := lookupFeatureFlag(mux.Vars(r)["name"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "Flag not found")
+		return flag, false
+	}
+	if beta && !flag.Beta {
+		writeError(w, http.StatusForbidden, "Only beta flags can be toggled")
+		return flag, false
+	}
+	return flag, true
+}
+
+// setOverride applies an override from a {"enabled": bool} body
+func (h *FeatureFlagHandler) setOverride(w http.ResponseWriter, r *http.Request, email string, flag FeatureFlag) {
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Enabled == nil {
+		writeFieldErrors(w, FieldError{Field: "enabled", Message: "is required"})
+		return
+	}
+
+	if err := h.flagService.SetOverride(email, flag.Name, *req.Enabled); err != nil {
+		log.Printf("Error saving flag override: %v", err)
+		writeServerError(w, err, "Failed to save flag")
+		return
+	}
+	h.writeFlags(w, email)
+}
+
+func (h *FeatureFlagHandler) clearOverride(w http.ResponseWriter, email string, flag FeatureFlag) {
+	if err := h.flagService.ClearOverride(email, flag.Name); err != nil {
+		log.Printf("Error deleting flag override: %v", err)
+		writeServerError(w, err, "Failed to reset flag")
+		return
+	}
+	h.writeFlags(w, email)
+}
+
+// Toggle opts the requesting user in or out of a beta flag
+func (h *FeatureFlagHandler) Toggle(w http.ResponseWriter, r *http.Request) {
+	if flag, ok := flagFromRequest(w, r, true); ok {
+		h.setOverride(w, r, requestEmail(r), flag)
+	}
+}
+
+// Reset returns a beta flag to the rollout for the requesting user
+func (h *FeatureFlagHandler) Reset(w http.ResponseWriter, r *http.Request) {
+	if flag, ok := flagFromRequest(w, r, true); ok {
+		h.clearOverride(w, requestEmail(r), flag)
+	}
+}
+
+// AdminList returns a user's flags
+func (h *FeatureFlagHandler) AdminList(w http.ResponseWriter, r *http.Request) {
+	h.writeFlags(w, mux.Vars(r)["email"])
+}
+
+// AdminSet overrides any flag for a user
+func (h *FeatureFlagHandler) AdminSet(w http.ResponseWriter, r *http.Request) {
+	if flag, ok := flagFromRequest(w, r, false); ok {
+		h.setOverride(w, r, mux.Vars(r)["email"], flag)
+	}
+}
+
+// AdminClear removes a user's override of a flag
+func (h *FeatureFlagHandler) AdminClear(w http.ResponseWriter, r *http.Request) {
+	if flag, ok := flagFromRequest(w, r, false); ok {
+		h.clearOverride(w, mux.Vars(r)["email"], flag)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseFlagRollouts(t *testing.T) {
+	tests := []struct {
+		value string
+		want  map[string]int
+		ok    bool
+	}{
+		{value: "", want: map[string]int{}, ok: true},
+		{value: "delta_sync=on", want: map[string]int{FlagDeltaSync: 100}, ok: true},
+		{value: " delta_sync = OFF ", want: map[string]int{FlagDeltaSync: 0}, ok: true},
+		{value: "delta_sync=25%", want: map[string]int{FlagDeltaSync: 25}, ok: true},
+		{value: "delta_sync=25"},
+		{value: "delta_sync=101%"},
+		{value: "delta_sync"},
+		{value: "nope=on"},
+	}
+	for _, tc := range tests {
+		got, err := parseFlagRollouts(tc.value)
+		if (err == nil) != tc.ok {
+			t.Errorf("parseFlagRollouts(%q) error = %v, want ok %v", tc.value, err, tc.ok)
+			continue
+		}
+		if tc.ok && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseFlagRollouts(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestFlagRolloutPercentage(t *testing.T) {
+	flags := NewFeatureFlagService(newTestDB(t), map[string]int{FlagDeltaSync: 30})
+
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		email := fmt.Sprintf("user%d@example.com", i)
+		on := flags.Enabled(email, FlagDeltaSync)
+		if on {
+			enabled++
+		}
+		// A user's bucket doesn't change
+		if flags.Enabled(email, FlagDeltaSync) != on {
+			t.Fatalf("%s flipped between checks", email)
+		}
+	}
+	if enabled < 250 || enabled > 350 {
+		t.Errorf("flag on for %d of 1000 users, want about 300", enabled)
+	}
+}
+
+func TestFlagOverrides(t *testing.T) {
+	flags := NewFeatureFlagService(newTestDB(t), map[string]int{FlagDeltaSync: 0})
+	email := "a@example.com"
+
+	if flags.Enabled(email, FlagDeltaSync) {
+		t.Fatal("flag on at a 0% rollout")
+	}
+	if flags.Enabled(email, "unknown") {
+		t.Error("unknown flag is on")
+	}
+
+	if err := flags.SetOverride(email, FlagDeltaSync, true); err != nil {
+		t.Fatalf("SetOverride: %v", err)
+	}
+	if !flags.Enabled(email, FlagDeltaSync) {
+		t.Error("override didn't turn the flag on")
+	}
+	if flags.Enabled("b@example.com", FlagDeltaSync) {
+		t.Error("override leaked to another user")
+	}
+
+	states, err := flags.ForUser(email)
+	if err != nil {
+		t.Fatalf("ForUser: %v", err)
+	}
+	var deltaSync FlagState
+	for _, state := range states {
+		if state.Name == FlagDeltaSync {
+			deltaSync = state
+		}
+	}
+	if len(states) != len(featureFlags) || !deltaSync.Enabled || !deltaSync.Overridden {
+		t.Errorf("ForUser = %+v, want delta_sync on and overridden", states)
+	}
+
+	if err := flags.ClearOverride(email, FlagDeltaSync); err != nil {
+		t.Fatalf("ClearOverride: %v", err)
+	}
+	if flags.Enabled(email, FlagDeltaSync) {
+		t.Error("flag still on after clearing the override")
+	}
+
+	// Without a service the default rollouts apply
+	var none *FeatureFlagService
+	if !none.Enabled(email, FlagDeltaSync) {
+		t.Error("delta_sync off by default")
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// filterSlugLength is the number of characters in a share slug
+const filterSlugLength = 10
+
+// BoardFilter is a filter expression over a board's tasks
+type BoardFilter struct {
+	Query      string   `json:"query,omitempty"`
+	ColumnIDs  []string `json:"columnIds,omitempty"`
+	Priorities []string `json:"priorities,omitempty"`
+	DueBefore  string   `json:"dueBefore,omitempty"`
+	DueAfter   string   `json:"dueAfter,omitempty"`
+	Labels     []string `json:"labels,omitempty"` // Any of them, ignoring case
+}
+
+// normalize canonicalizes a filter so equivalent expressions encode the same
+func (f *BoardFilter) normalize() {
+	f.Query = strings.TrimSpace(f.Query)
+	sort.Strings(f.ColumnIDs)
+	sort.Strings(f.Priorities)
+	sort.Strings(f.Labels)
+}
+
+// validate checks the filter's date bounds are well formed
+func (f *BoardFilter) validate() error {
+	for _, value := range []string{f.DueBefore, f.DueAfter} {
+		if value == "" {
+			continue
+		}
+		if _, ok := parseDueDate(value); !ok {
+			return fmt.Errorf("invalid date %q", value)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether a task satisfies the filter
+func (f *BoardFilter) Matches(task Task) bool {
+	if f.Query != "" {
+		query := strings.ToLower(f.Query)
+		if !strings.Contains(strings.ToLower(task.Title), query) &&
+			!strings.Contains(strings.ToLower(task.Description), query) {
+			return false
+		}
+	}
+
+	if len(f.ColumnIDs) > 0 {
+		columnID := ""
+		if task.ColumnID != nil {
+			columnID = *task.ColumnID
+		}
+		if !containsString(f.ColumnIDs, columnID) {
+			return false
+		}
+	}
+
+	if len(f.Priorities) > 0 {
+		if task.Priority == nil || !containsString(f.Priorities, *task.Priority) {
+			return false
+		}
+	}
+
+	if len(f.Labels) > 0 {
+		matched := false
+		for _, label := range task.Labels {
+			for _, want := range f.Labels {
+				if strings.EqualFold(label, want) {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if f.DueBefore != "" || f.DueAfter != "" {
+		due, ok := parseDueDate(task.DueDate)
+		if !ok {
+			return false
+		}
+		if before, ok := parseDueDate(f.DueBefore); ok && !due.Before(before) {
+			return false
+		}
+		if after, ok := parseDueDate(f.DueAfter); ok && !due.After(after) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// containsString reports whether values contains s
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterService stores filter expressions under short share slugs
+type FilterService struct {
+	db *DB
+}
+
+func NewFilterService(db *DB) *FilterService {
+	return &FilterService{db: db}
+}
+
+// filterSlug derives a stable slug from the owner and canonical expression,
+// so saving the same filter twice yields the same link
+func filterSlug(email string, encoded []byte) string {
+	sum := sha256.Sum256(append([]byte(email+"\n"), encoded...))
+	return base64.RawURLEncoding.EncodeToString(sum[:])[:filterSlugLength]
+}
+
+// Save stores a filter and returns its share slug
+func (s *FilterService) Save(email string, filter BoardFilter) (string, error) {
+	filter.normalize()
+
+	encoded, err := json.Marshal(filter)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal filter: %w", err)
+	}
+
+	slug := filterSlug(email, encoded)
+
+	if err := ensureUser(s.db, email); err != nil {
+		return "", err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO saved_filters (slug, email, filter, created_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(slug) DO NOTHING
+	`, slug, email, string(encoded))
+	if err != nil {
+		return "", fmt.Errorf("failed to save filter: %w", err)
+	}
+
+	return slug, nil
+}
+
+// errFilterNotFound is returned when a slug doesn't match a saved filter
+var errFilterNotFound = errors.New("filter not found")
+
+// Get decodes the filter stored under a slug and returns it with its owner
+func (s *FilterService) Get(slug string) (*BoardFilter, string, error) {
+	row := s.db.QueryRow("SELECT email, filter FROM saved_filters WHERE slug = ?", slug)
+
+	var email, encoded string
+	if err := row.Scan(&email, &encoded); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", errFilterNotFound
+		}
+		return nil, "", fmt.Errorf("failed to query filter: %w", err)
+	}
+
+	var filter BoardFilter
+	if err := json.Unmarshal([]byte(encoded), &filter); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal filter: %w", err)
+	}
+
+	return &filter, email, nil
+}
+
+// FilterHandler exposes saved filters over HTTP
+type FilterHandler struct {
+	filterService *FilterService
+}
+
+func NewFilterHandler(filterService *FilterService) *FilterHandler {
+	return &FilterHandler{filterService: filterService}
+}
+
+// Create saves a filter expression and returns its share slug
+func (h *FilterHandler) Create(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+
+	var filter BoardFilter
+	if !decodeJSON(w, r, &filter) {
+		return
+	}
+	if err := filter.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	slug, err := h.filterService.Save(email, filter)
+	if err != nil {
+		log.Printf("Error saving filter: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to save filter")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+		"slug":   slug,
+		"path":   "/api/filters/" + slug,
+	})
+}
+
+// Get decodes a share slug back into its filter expression. Any signed-in
+// user may resolve a slug; the filter only describes a view, not board data.
+func (h *FilterHandler) Get(w http.ResponseWriter, r *http.Request) {
+	filter, owner, err := h.filterService.Get(mux.Vars(r)["slug"])
+	if err == errFilterNotFound {
+		writeError(w, http.StatusNotFound, "Filter not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading filter: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"filter": filter,
+		"owner":  owner,
+	})
+}
+
+// Page sizes for GET /api/data/get
+const (
+	defaultTaskPageSize = 100
+	maxTaskPageSize     = 1000
+)
+
+// TaskQuery selects and pages the tasks returned by GET /api/data/get
+type TaskQuery struct {
+	Filter BoardFilter
+
+	// Only tasks with logged activity at or after this time, when set
+	UpdatedSince time.Time
+
+	// Tasks after the one with this ID, up to Limit of them. A zero Limit
+	// returns every match.
+	After string
+	Limit int
+}
+
+// parseTaskQuery reads columnId, priority and label (each repeatable),
+// dueBefore, updatedSince, limit and cursor. It reports false when none of
+// them are set, as the whole board is returned then.
+func parseTaskQuery(values url.Values) (TaskQuery, bool, error) {
+	var q TaskQuery
+	set := false
+	for _, name := range []string{"columnId", "priority", "label", "dueBefore", "updatedSince", "limit", "cursor"} {
+		if values.Has(name) {
+			set = true
+		}
+	}
+	if !set {
+		return q, false, nil
+	}
+
+	q.Filter.ColumnIDs = values["columnId"]
+	for _, raw := range values["priority"] {
+		priority, ok := normalizePriority(raw)
+		if !ok {
+			return q, true, errInvalidPriority
+		}
+		q.Filter.Priorities = append(q.Filter.Priorities, priority)
+	}
+	q.Filter.Labels = values["label"]
+	q.Filter.DueBefore = values.Get("dueBefore")
+	if err := q.Filter.validate(); err != nil {
+		return q, true, err
+	}
+
+	if raw := values.Get("updatedSince"); raw != "" {
+		since, ok := parseDueDate(raw)
+		if !ok {
+			return q, true, fmt.Errorf("updatedSince must be YYYY-MM-DD or an RFC 3339 time")
+		}
+		q.UpdatedSince = since
+	}
+
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxTaskPageSize {
+			return q, true, fmt.Errorf("limit must be between 1 and %d", maxTaskPageSize)
+		}
+		q.Limit = limit
+	}
+	if raw := values.Get("cursor"); raw != "" {
+		after, err := base64.RawURLEncoding.DecodeString(raw)
+		if err != nil || len(after) == 0 {
+			return q, true, errInvalidCursor
+		}
+		q.After = string(after)
+		if q.Limit == 0 {
+			q.Limit = defaultTaskPageSize
+		}
+	}
+	return q, true, nil
+}
+
+// errInvalidCursor is returned for cursors that weren't issued by the
+// server, or whose task has since left the board
+var errInvalidCursor = errors.New("invalid cursor")
+
+// Select returns the live tasks matching the query in board order, and the
+// cursor for the next page, or "" on the last one. aging supplies each
+// task's last activity for UpdatedSince.
+func (q *TaskQuery) Select(tasks []Task, aging map[string]TaskAge) ([]Task, string, error) {
+	start := 0
+	if q.After != "" {
+		start = -1
+		for i, task := range tasks {
+			if task.ID == q.After {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			return nil, "", errInvalidCursor
+		}
+	}
+
+	selected := []Task{}
+	for _, task := range tasks[start:] {
+		if task.Deleted || !q.Filter.Matches(task) {
+			continue
+		}
+		if !q.UpdatedSince.IsZero() && aging[task.ID].LastActivityAt.Before(q.UpdatedSince) {
+			continue
+		}
+		if q.Limit > 0 && len(selected) == q.Limit {
+			last := selected[len(selected)-1].ID
+			return selected, base64.RawURLEncoding.EncodeToString([]byte(last)), nil
+		}
+		selected = append(selected, task)
+	}
+	return selected, "", nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	providerGoogleTasks = "google_tasks"
+
+	googleAuthURL    = "https://accounts.google.com/o/oauth2/v2/auth"
+	googleTokenURL   = "https://oauth2.googleapis.com/token"
+	googleTasksAPI   = "https://tasks.googleapis.com/tasks/v1"
+	googleTasksScope = "https://www.googleapis.com/auth/tasks"
+)
+
+// googleTask is a task in the Google Tasks API
+type googleTask struct {
+	ID      string `json:"id,omitempty"`
+	Title   string `json:"title"`
+	Notes   string `json:"notes"`
+	Status  string `json:"status,omitempty"`
+	Due     string `json:"due,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Updated string `json:"updated,omitempty"`
+}
+
+// GoogleTasksProvider mirrors boards with Google Tasks lists. Google Tasks
+// has no push notifications, so remote changes are found by polling with
+// updatedMin.
+type GoogleTasksProvider struct {
+	oauth  *oauthClient
+	client *http.Client
+}
+
+func NewGoogleTasksProvider(cfg OAuthClientConfig) *GoogleTasksProvider {
+	client := &http.Client{Timeout: 30 * time.Second}
+	return &GoogleTasksProvider{
+		oauth: &oauthClient{
+			cfg:      cfg,
+			authURL:  googleAuthURL,
+			tokenURL: googleTokenURL,
+			scope:    googleTasksScope,
+			// Ask for a refresh token every time, so reconnecting works
+			authParams: url.Values{"access_type": {"offline"}, "prompt": {"consent"}},
+			client:     client,
+		},
+		client: client,
+	}
+}
+
+func (p *GoogleTasksProvider) OAuth() *oauthClient {
+	return p.oauth
+}
+
+// tasksURL returns the URL of the connection's task list, or of one task in it
+func (p *GoogleTasksProvider) tasksURL(c *ExternalConnection, taskID string) string {
+	listID := c.RemoteListID
+	if listID == "" {
+		listID = "@default"
+	}
+	u := googleTasksAPI + "/lists/" + url.PathEscape(listID) + "/tasks"
+	if taskID != "" {
+		u += "/" + url.PathEscape(taskID)
+	}
+	return u
+}
+
+func toGoogleTask(task RemoteTask) googleTask {
+	remote := googleTask{Title: task.Title, Notes: task.Notes}
+	if task.Due != "" {
+		remote.Due = task.Due + "T00:00:00.000Z"
+	}
+	return remote
+}
+
+func (p *GoogleTasksProvider) ListChanges(ctx context.Context, token string, c *ExternalConnection) ([]RemoteTask, string, error) {
+	// Changes made while listing are picked up next time
+	cursor := time.Now().UTC().Format(time.RFC3339)
+
+	var tasks []RemoteTask
+	pageToken := ""
+	for {
+		params := url.Values{
+			"maxResults":    {"100"},
+			"showCompleted": {"true"},
+			"showHidden":    {"true"},
+			"showDeleted":   {"true"},
+		}
+		if c.cursor != "" {
+			params.Set("updatedMin", c.cursor)
+		}
+		if pageToken != "" {
+			params.Set("pageToken", pageToken)
+		}
+
+		var page struct {
+			Items         []googleTask `json:"items"`
+			NextPageToken string       `json:"nextPageToken"`
+		}
+		if err := doJSON(ctx, p.client, token, http.MethodGet, p.tasksURL(c, "")+"?"+params.Encode(), nil, &page); err != nil {
+			return nil, "", err
+		}
+
+		for _, item := range page.Items {
+			updated, _ := time.Parse(time.RFC3339, item.Updated)
+			tasks = append(tasks, RemoteTask{
+				ID:        item.ID,
+				Title:     item.Title,
+				Notes:     item.Notes,
+				Due:       normalizeDueDate(item.Due),
+				Completed: item.Status == "completed",
+				Deleted:   item.Deleted,
+				Updated:   updated,
+			})
+		}
+		if page.NextPageToken == "" {
+			return tasks, cursor, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (p *GoogleTasksProvider) CreateTask(ctx context.Context, token string, c *ExternalConnection, task RemoteTask) (string, error) {
+	var created googleTask
+	if err := doJSON(ctx, p.client, token, http.MethodPost, p.tasksURL(c, ""), toGoogleTask(task), &created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func (p *GoogleTasksProvider) UpdateTask(ctx context.Context, token string, c *ExternalConnection, id string, task RemoteTask) error {
+	return doJSON(ctx, p.client, token, http.MethodPatch, p.tasksURL(c, id), toGoogleTask(task), nil)
+}
+
+func (p *GoogleTasksProvider) DeleteTask(ctx context.Context, token string, c *ExternalConnection, id string) error {
+	return doJSON(ctx, p.client, token, http.MethodDelete, p.tasksURL(c, id), nil, nil)
+}
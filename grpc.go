@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	todov1 "github.com/example/todo-app/api/todo/v1"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The gRPC API (api/todo/v1/todo.proto) serves the same boards as the REST
+// and WebSocket APIs on GRPC_PORT, for tools that prefer typed contracts.
+// Calls authenticate with "authorization: Bearer <token>" or "x-api-key"
+// metadata. ApplyOperations goes through applyOperations like WebSocket
+// "ops" messages, and each Watch stream is a hub client like a WebSocket
+// connection, so it counts towards presence and the per-user connection
+// limit.
+
+// grpcTodoService implements todov1.TodoServiceServer
+type grpcTodoService struct {
+	todov1.UnimplementedTodoServiceServer
+
+	dataService *DataService
+	hub         *Hub
+	policy      *PolicyEnforcer
+}
+
+// NewGRPCServer returns a gRPC server with the todo service registered
+func NewGRPCServer(dataService *DataService, hub *Hub, policy *PolicyEnforcer) *grpc.Server {
+	s := &grpcTodoService{dataService: dataService, hub: hub, policy: policy}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(s.authenticateUnary),
+		grpc.StreamInterceptor(s.authenticateStream),
+		grpc.MaxRecvMsgSize(int(maxBoardBodySize(dataService.quotas))),
+	)
+	todov1.RegisterTodoServiceServer(server, s)
+	return server
+}
+
+// authenticate checks a call's credentials and adds the email (and API key
+// scope) to its context, where requestEmail's gRPC counterpart grpcEmail
+// finds it
+func (s *grpcTodoService) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if keys := md.Get("x-api-key"); len(keys) > 0 && keys[0] != "" {
+		email, scope, err := s.policy.authenticateKey(keys[0])
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		ctx = context.WithValue(ctx, apiKeyScopeContextKey, scope)
+		return context.WithValue(ctx, emailContextKey, email), nil
+	}
+
+	var token string
+	if auth := md.Get("authorization"); len(auth) > 0 {
+		token = strings.TrimPrefix(auth[0], "Bearer ")
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing credentials")
+	}
+	email, err := s.policy.authService.VerifyJWT(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return context.WithValue(ctx, emailContextKey, email), nil
+}
+
+func (s *grpcTodoService) authenticateUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *grpcTodoService) authenticateStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// authenticatedStream is a stream whose context carries the caller
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcEmail returns the caller of an authenticated call
+func grpcEmail(ctx context.Context) string {
+	email, _ := ctx.Value(emailContextKey).(string)
+	return email
+}
+
+// board resolves the board a call addresses, checking the caller holds at
+// least min on it
+func (s *grpcTodoService) board(ctx context.Context, board string, min BoardRole) (string, error) {
+	email := grpcEmail(ctx)
+	if s.policy.BoardRole(email, board) < min {
+		return "", status.Error(codes.PermissionDenied, "forbidden")
+	}
+	if min > BoardRoleViewer {
+		if scope, _ := ctx.Value(apiKeyScopeContextKey).(string); scope == APIKeyScopeRead {
+			return "", status.Error(codes.PermissionDenied, "API key is read-only")
+		}
+	}
+	return canonicalBoardID(email, board), nil
+}
+
+// GetBoard returns a board without deleted items
+func (s *grpcTodoService) GetBoard(ctx context.Context, req *todov1.GetBoardRequest) (*todov1.Board, error) {
+	boardID, err := s.board(ctx, req.Board, BoardRoleViewer)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.dataService.GetUserData(ctx, boardID)
+	if err != nil {
+		log.Printf("Error getting board %s for gRPC: %v", boardID, err)
+		return nil, grpcServerError(err)
+	}
+	return boardToProto(boardID, data), nil
+}
+
+// grpcServerError is the status of an unexpected failure: Unavailable for
+// database timeouts and lock waits, like REST's 503, ResourceExhausted for
+// saves over a quota, Aborted for writes to what another client has
+// locked, otherwise Internal
+func grpcServerError(err error) error {
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		return status.Error(codes.ResourceExhausted, quotaErr.Error())
+	}
+	var lockErr *LockError
+	if errors.As(err, &lockErr) {
+		return status.Error(codes.Aborted, lockErr.Error())
+	}
+	if isTimeout(err) || isBusy(err) {
+		return status.Error(codes.Unavailable, "database is busy, try again shortly")
+	}
+	return status.Error(codes.Internal, "server error")
+}
+
+// ApplyOperations applies operations atomically and relays the delta to
+// the board's subscribers
+func (s *grpcTodoService) ApplyOperations(ctx context.Context, req *todov1.ApplyOperationsRequest) (*todov1.ApplyOperationsResponse, error) {
+	boardID, err := s.board(ctx, req.Board, BoardRoleEditor)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Operations) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "operations are required")
+	}
+
+	ops := make([]Operation, len(req.Operations))
+	for i, op := range req.Operations {
+		ops[i] = operationFromProto(op)
+	}
+	data, err := s.dataService.UpdateUserData(ctx, boardID, func(data *KanbanData) error {
+		return applyOperations(data, ops)
+	})
+
+	var opErr *OperationError
+	if errors.As(err, &opErr) {
+		if opErr.WIPLimit != nil {
+			return nil, status.Error(codes.FailedPrecondition, opErr.Error())
+		}
+		return nil, status.Error(codes.InvalidArgument, opErr.Error())
+	}
+	if err != nil {
+		log.Printf("Error applying gRPC ops to board %s: %v", boardID, err)
+		return nil, grpcServerError(err)
+	}
+
+	s.hub.PublishBoard(boardID, WebSocketMessage{Type: "delta", User: grpcEmail(ctx), Data: DeltaPayload{
+		Version: data.Version,
+		Ops:     ops,
+	}}, nil)
+
+	resp := &todov1.ApplyOperationsResponse{Version: data.Version}
+	for _, op := range ops {
+		resp.Operations = append(resp.Operations, operationToProto(op))
+	}
+	return resp, nil
+}
+
+// Watch streams a board's messages as a hub client, starting with its
+// current state
+func (s *grpcTodoService) Watch(req *todov1.WatchRequest, stream todov1.TodoService_WatchServer) error {
+	ctx := stream.Context()
+	boardID, err := s.board(ctx, req.Board, BoardRoleViewer)
+	if err != nil {
+		return err
+	}
+	email := grpcEmail(ctx)
+
+	// The stream stands in for the WritePump, reading the client's queue
+	client := NewClient(s.hub, nil, email)
+	s.hub.Register(client)
+	defer func() {
+		s.hub.Unregister(client)
+		s.hub.pumps.Done()
+	}()
+	if boardID != canonicalBoardID(email, "") {
+		s.hub.subscribe <- subscription{client: client, board: boardID, subscribe: true, view: true}
+	}
+
+	// Registered first, so no change falls between the state and the stream
+	data, err := s.dataService.GetUserData(ctx, boardID)
+	if err != nil {
+		log.Printf("Error getting board %s for gRPC watch: %v", boardID, err)
+		return grpcServerError(err)
+	}
+	err = stream.Send(&todov1.BoardEvent{Type: "state", Board: boardID, Version: data.Version, State: boardToProto(boardID, data)})
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-client.done:
+			return watchClosedStatus(client)
+		case message := <-client.send:
+			event, err := boardEventFromMessage(message.payload)
+			if err != nil {
+				log.Printf("Error converting message for gRPC watch: %v", err)
+				continue
+			}
+			// The client also sits in its own board's room
+			if event.Board != "" && event.Board != boardID {
+				continue
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// watchClosedStatus explains why the hub closed a Watch stream's client
+func watchClosedStatus(client *Client) error {
+	switch client.closeCode {
+	case closeSessionRevoked:
+		return status.Error(codes.Unauthenticated, "session revoked")
+	case closeTooManyConnections:
+		return status.Error(codes.ResourceExhausted, "too many connections")
+	case websocket.CloseTryAgainLater:
+		return status.Error(codes.ResourceExhausted, "too slow")
+	default:
+		return status.Error(codes.Unavailable, "server going away")
+	}
+}
+
+// boardEventFromMessage converts a hub message to a BoardEvent, with typed
+// fields for board states and deltas
+func boardEventFromMessage(payload []byte) (*todov1.BoardEvent, error) {
+	var message struct {
+		Type  string          `json:"type"`
+		Data  json.RawMessage `json:"data"`
+		User  string          `json:"user"`
+		Board string          `json:"board"`
+	}
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return nil, err
+	}
+
+	event := &todov1.BoardEvent{Type: message.Type, Board: message.Board, User: message.User}
+	switch message.Type {
+	case "sync":
+		var data KanbanData
+		if err := json.Unmarshal(message.Data, &data); err != nil {
+			return nil, err
+		}
+		event.Version = data.Version
+		event.State = boardToProto(message.Board, &data)
+	case "delta":
+		var delta DeltaPayload
+		if err := json.Unmarshal(message.Data, &delta); err != nil {
+			return nil, err
+		}
+		event.Version = delta.Version
+		for _, op := range delta.Ops {
+			event.Operations = append(event.Operations, operationToProto(op))
+		}
+	default:
+		event.DataJson = string(message.Data)
+	}
+	return event, nil
+}
+
+// boardToProto converts a board, leaving out deleted items
+func boardToProto(boardID string, data *KanbanData) *todov1.Board {
+	board := &todov1.Board{Id: boardID, Version: data.Version}
+	for _, col := range data.Columns {
+		if !col.Deleted {
+			board.Columns = append(board.Columns, columnToProto(col))
+		}
+	}
+	for _, lane := range data.Swimlanes {
+		if !lane.Deleted {
+			board.Swimlanes = append(board.Swimlanes, swimlaneToProto(lane))
+		}
+	}
+	for _, task := range data.Tasks {
+		if !task.Deleted {
+			board.Tasks = append(board.Tasks, taskToProto(task))
+		}
+	}
+	return board
+}
+
+func columnToProto(col Column) *todov1.Column {
+	return &todov1.Column{
+		Id:          col.ID,
+		Title:       col.Title,
+		Order:       int32(col.Order),
+		Hidden:      col.Hidden,
+		IsDone:      col.IsDone,
+		WipLimit:    int32(col.WIPLimit),
+		Color:       col.Color,
+		Description: col.Description,
+	}
+}
+
+func columnFromProto(col *todov1.Column) *Column {
+	if col == nil {
+		return nil
+	}
+	return &Column{
+		ID:          col.Id,
+		Title:       col.Title,
+		Order:       int(col.Order),
+		Hidden:      col.Hidden,
+		IsDone:      col.IsDone,
+		WIPLimit:    int(col.WipLimit),
+		Color:       col.Color,
+		Description: col.Description,
+	}
+}
+
+func swimlaneToProto(lane Swimlane) *todov1.Swimlane {
+	return &todov1.Swimlane{Id: lane.ID, Title: lane.Title, Order: int32(lane.Order)}
+}
+
+func swimlaneFromProto(lane *todov1.Swimlane) *Swimlane {
+	if lane == nil {
+		return nil
+	}
+	return &Swimlane{ID: lane.Id, Title: lane.Title, Order: int(lane.Order)}
+}
+
+func taskToProto(task Task) *todov1.Task {
+	completedAt := ""
+	if task.CompletedAt != nil {
+		completedAt = task.CompletedAt.Format(time.RFC3339)
+	}
+	return &todov1.Task{
+		Id:          task.ID,
+		Title:       task.Title,
+		Description: task.Description,
+		DueDate:     task.DueDate,
+		Priority:    task.Priority,
+		ColumnId:    task.ColumnID,
+		SwimlaneId:  task.SwimlaneID,
+		Language:    task.Language,
+		Hidden:      task.Hidden,
+		Completed:   task.Completed,
+		CompletedAt: completedAt,
+	}
+}
+
+func taskFromProto(task *todov1.Task) *Task {
+	if task == nil {
+		return nil
+	}
+	return &Task{
+		ID:          task.Id,
+		Title:       task.Title,
+		Description: task.Description,
+		DueDate:     task.DueDate,
+		Priority:    task.Priority,
+		ColumnID:    task.ColumnId,
+		SwimlaneID:  task.SwimlaneId,
+		Hidden:      task.Hidden,
+		Completed:   task.Completed,
+	}
+}
+
+func operationToProto(op Operation) *todov1.Operation {
+	out := &todov1.Operation{
+		Type:       op.Type,
+		TaskId:     op.TaskID,
+		ColumnId:   op.ColumnID,
+		SwimlaneId: op.SwimlaneID,
+	}
+	if op.Task != nil {
+		out.Task = taskToProto(*op.Task)
+	}
+	if op.Column != nil {
+		out.Column = columnToProto(*op.Column)
+	}
+	if op.Swimlane != nil {
+		out.Swimlane = swimlaneToProto(*op.Swimlane)
+	}
+	if c := op.Changes; c != nil {
+		out.Changes = &todov1.OperationChanges{
+			Title:       c.Title,
+			Description: c.Description,
+			DueDate:     c.DueDate,
+			Priority:    c.Priority,
+			Order:       int32Ptr(c.Order),
+			Hidden:      c.Hidden,
+			IsDone:      c.IsDone,
+			WipLimit:    int32Ptr(c.WIPLimit),
+			SwimlaneId:  c.SwimlaneID,
+			Color:       c.Color,
+			Completed:   c.Completed,
+		}
+	}
+	return out
+}
+
+func operationFromProto(op *todov1.Operation) Operation {
+	out := Operation{
+		Type:       op.Type,
+		TaskID:     op.TaskId,
+		ColumnID:   op.ColumnId,
+		SwimlaneID: op.SwimlaneId,
+		Task:       taskFromProto(op.Task),
+		Column:     columnFromProto(op.Column),
+		Swimlane:   swimlaneFromProto(op.Swimlane),
+	}
+	if c := op.Changes; c != nil {
+		out.Changes = &OperationChanges{
+			Title:       c.Title,
+			Description: c.Description,
+			DueDate:     c.DueDate,
+			Priority:    c.Priority,
+			Order:       intPtr(c.Order),
+			Hidden:      c.Hidden,
+			IsDone:      c.IsDone,
+			WIPLimit:    intPtr(c.WipLimit),
+			SwimlaneID:  c.SwimlaneId,
+			Color:       c.Color,
+			Completed:   c.Completed,
+		}
+	}
+	return out
+}
+
+func int32Ptr(v *int) *int32 {
+	if v == nil {
+		return nil
+	}
+	n := int32(*v)
+	return &n
+}
+
+func intPtr(v *int32) *int {
+	if v == nil {
+		return nil
+	}
+	n := int(*v)
+	return &n
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -14,12 +18,14 @@ import (
 type AuthHandler struct {
 	authService *AuthService
 	dataService *DataService
+	totpService *TOTPService
 }
 
-func NewAuthHandler(authService *AuthService, dataService *DataService) *AuthHandler {
+func NewAuthHandler(authService *AuthService, dataService *DataService, totpService *TOTPService) *AuthHandler {
 	return &AuthHandler{
 		authService: authService,
 		dataService: dataService,
+		totpService: totpService,
 	}
 }
 
@@ -30,14 +36,13 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		Email string `json:"email"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request format", http.StatusBadRequest)
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	// Validate email
 	if req.Email == "" || !strings.Contains(req.Email, "@") {
-		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "Invalid email address")
 		return
 	}
 
@@ -49,20 +54,22 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	baseURL := fmt.Sprintf("%s://%s", scheme, r.Host)
 
 	// Generate magic link
-	magicLink, err := h.authService.GenerateMagicLink(req.Email, baseURL)
+	magicLink, err := h.authService.GenerateMagicLink(req.Email, baseURL, requestLocale(r))
 	if err != nil {
 		log.Printf("Error generating magic link: %v", err)
-		http.Error(w, "Failed to generate login link", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "Failed to generate login link")
 		return
 	}
 
-	// Return success response with magic link for development
+	resp := map[string]string{
+		"status":  "success",
+		"message": translate(responseLocale(w), "Magic link has been sent"),
+	}
+	if h.authService.RevealLinks() {
+		resp["magicLink"] = magicLink // For development only
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":    "success",
-		"message":   "Magic link has been sent",
-		"magicLink": magicLink, // For development only
-	})
+	json.NewEncoder(w).Encode(resp)
 }
 
 // HandleMagicLink processes a magic link token and redirects to the frontend
@@ -70,52 +77,73 @@ func (h *AuthHandler) HandleMagicLink(w http.ResponseWriter, r *http.Request) {
 	// Get token from query
 	token := r.URL.Query().Get("token")
 	if token == "" {
-		http.Error(w, "Missing token", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "Missing token")
 		return
 	}
 
 	// Verify token
 	email, err := h.authService.VerifyMagicLinkToken(token)
 	if err != nil {
-		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "Invalid or expired token")
 		return
 	}
 
-	// Create JWT token
-	jwtToken, err := h.authService.CreateJWT(email)
+	// Users with two-factor authentication finish signing in with a code
+	challenge, err := h.totpService.Challenge(email)
 	if err != nil {
-		log.Printf("Error creating JWT: %v", err)
-		http.Error(w, "Authentication error", http.StatusInternalServerError)
+		log.Printf("Error creating two-factor challenge: %v", err)
+		writeError(w, http.StatusInternalServerError, "Authentication error")
+		return
+	}
+	if challenge != "" {
+		http.Redirect(w, r, fmt.Sprintf("/?mfa=%s&email=%s", challenge, url.QueryEscape(email)), http.StatusFound)
 		return
 	}
 
-	// Redirect to frontend with token
-	redirectURL := fmt.Sprintf("/?token=%s&email=%s", jwtToken, email)
-	http.Redirect(w, r, redirectURL, http.StatusFound)
-}
+	// Check the account now so a disabled user isn't sent on with a code
+	if err := h.authService.CheckAccount(email, time.Time{}); err != nil {
+		writeSignInError(w, err)
+		return
+	}
 
-// VerifyToken checks if a JWT token is valid
-func (h *AuthHandler) VerifyToken(w http.ResponseWriter, r *http.Request) {
-	// Get token from Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Missing authorization header", http.StatusUnauthorized)
+	// With cookie sessions the browser is signed in right away
+	if h.authService.cookieSessions {
+		token, err := h.authService.CreateJWT(email)
+		if err != nil {
+			writeSignInError(w, err)
+			return
+		}
+		if err := setSessionCookie(w, r, token); err != nil {
+			log.Printf("Error starting cookie session: %v", err)
+			writeError(w, http.StatusInternalServerError, "Authentication error")
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
-	// Extract token from Bearer format
-	authParts := strings.Split(authHeader, " ")
-	if len(authParts) != 2 || authParts[0] != "Bearer" {
-		http.Error(w, "Invalid authorization format", http.StatusUnauthorized)
+	// Redirect to frontend with a one-time code for POST /api/auth/exchange
+	code, err := h.authService.CreateExchangeCode(email)
+	if err != nil {
+		log.Printf("Error creating exchange code: %v", err)
+		writeError(w, http.StatusInternalServerError, "Authentication error")
 		return
 	}
+	http.Redirect(w, r, "/?code="+code, http.StatusFound)
+}
 
-	tokenString := authParts[1]
+// VerifyToken checks if a JWT token (Bearer or session cookie) is valid
+func (h *AuthHandler) VerifyToken(w http.ResponseWriter, r *http.Request) {
+	tokenString, err := sessionToken(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
 
 	// Verify token
 	email, err := h.authService.VerifyJWT(tokenString)
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		writeError(w, http.StatusUnauthorized, "Invalid token")
 		return
 	}
 
@@ -129,175 +157,317 @@ func (h *AuthHandler) VerifyToken(w http.ResponseWriter, r *http.Request) {
 
 // DataHandler handles data-related endpoints
 type DataHandler struct {
-	dataService *DataService
-	authService *AuthService
-	hub         *Hub
-}
+	dataService    *DataService
+	authService    *AuthService
+	commentService *CommentService
+	hub            *Hub
 
-func NewDataHandler(dataService *DataService, authService *AuthService, hub *Hub) *DataHandler {
-	return &DataHandler{
-		dataService: dataService,
-		authService: authService,
-		hub:         hub,
-	}
+	// Reject syncs that would leave two live columns with the same title
+	uniqueColumnTitles bool
+
+	// Column titles whose duplicates are folded together on sync (nil when disabled)
+	reconcileColumnTitles []string
+
+	// Accepts WebSocket upgrades from ALLOWED_ORIGINS
+	upgrader websocket.Upgrader
+
+	// Gates features being rolled out; nil applies the default rollouts
+	flags *FeatureFlagService
+
+	// Runs syncs through the experimental CRDT engine for comparison; nil
+	// when disabled
+	crdt *CRDTShadow
+
+	// Returns the merge strategy a user picked for full syncs; nil when
+	// settings aren't consulted
+	mergeStrategySetting func(email string) string
 }
 
-// Middleware to authenticate requests
-func (h *DataHandler) authenticate(r *http.Request) (string, error) {
-	// Get token from Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		return "", fmt.Errorf("missing authorization header")
+func NewDataHandler(dataService *DataService, authService *AuthService, commentService *CommentService, hub *Hub, cfg *Config) *DataHandler {
+	var reconcileTitles []string
+	if cfg.ReconcileDefaultColumns {
+		reconcileTitles = cfg.ReconcileColumnTitles
 	}
 
-	// Extract token from Bearer format
-	authParts := strings.Split(authHeader, " ")
-	if len(authParts) != 2 || authParts[0] != "Bearer" {
-		return "", fmt.Errorf("invalid authorization format")
+	h := &DataHandler{
+		dataService:           dataService,
+		authService:           authService,
+		commentService:        commentService,
+		hub:                   hub,
+		uniqueColumnTitles:    cfg.UniqueColumnTitles,
+		reconcileColumnTitles: reconcileTitles,
+		upgrader:              websocket.Upgrader{CheckOrigin: checkWebSocketOrigin(cfg.AllowedOrigins)},
 	}
+	h.registerDeltaHandlers()
+	return h
+}
 
-	tokenString := authParts[1]
+// UseFlags gates features being rolled out by the given flags
+func (h *DataHandler) UseFlags(flags *FeatureFlagService) {
+	h.flags = flags
+}
 
-	// Verify token
-	email, err := h.authService.VerifyJWT(tokenString)
-	if err != nil {
-		return "", fmt.Errorf("invalid token: %w", err)
-	}
+// UseCRDTShadow runs the syncs of users with the crdt_sync flag through the
+// CRDT engine too
+func (h *DataHandler) UseCRDTShadow(shadow *CRDTShadow) {
+	h.crdt = shadow
+}
 
-	return email, nil
+// UseMergeStrategySetting has full syncs that don't name a merge strategy
+// use the one the user picked
+func (h *DataHandler) UseMergeStrategySetting(setting func(email string) string) {
+	h.mergeStrategySetting = setting
 }
 
-// GetData retrieves user data without saving client data
+// GetData retrieves user data without saving client data. ?board= reads a
+// workspace board instead of the user's own.
 func (h *DataHandler) GetData(w http.ResponseWriter, r *http.Request) {
-	// Authenticate request
-	email, err := h.authenticate(r)
+	board := canonicalBoardID(requestEmail(r), queryBoard(r))
+
+	// Get server data
+	serverData, err := h.dataService.GetUserData(r.Context(), board)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		log.Printf("Error getting user data: %v", err)
+		writeServerError(w, err, "Server error")
 		return
 	}
 
-	// Get server data
-	serverData, err := h.dataService.GetUserData(email)
+	// Filters and paging, checked before any work is done
+	query, paged, err := parseTaskQuery(r.URL.Query())
 	if err != nil {
-		log.Printf("Error getting user data: %v", err)
-		http.Error(w, "Server error", http.StatusInternalServerError)
+		if err == errInvalidCursor {
+			writeErrorCode(w, http.StatusBadRequest, "invalid_cursor", "Invalid cursor")
+		} else {
+			writeError(w, http.StatusBadRequest, err.Error())
+		}
 		return
 	}
 
-	// Return success with server data
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{
-		"status": "success",
-		"data":   serverData,
-	})
-}
+	// Optionally sort tasks, e.g. ?sort=priority,dueDate
+	if raw := r.URL.Query().Get("sort"); raw != "" {
+		compare, err := parseTaskSort(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		serverData = sortTasks(serverData, compare)
+	}
 
-// SyncData synchronizes user data between client and server
-func (h *DataHandler) SyncData(w http.ResponseWriter, r *http.Request) {
-	// Authenticate request
-	email, err := h.authenticate(r)
+	// Days since each task's last activity, for fading stale cards
+	aging, err := h.dataService.TaskAging(r.Context(), board)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		log.Printf("Error getting task aging: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
 		return
 	}
 
+	// Narrow the tasks to the requested page. Columns and swimlanes are
+	// always sent whole.
+	nextCursor := ""
+	if paged {
+		page := *serverData
+		page.Tasks, nextCursor, err = query.Select(serverData.Tasks, aging)
+		if err == errInvalidCursor {
+			writeErrorCode(w, http.StatusBadRequest, "invalid_cursor", "Invalid cursor")
+			return
+		}
+		page.UnassignedTasks = nil
+		serverData = &page
+
+		pageAging := make(map[string]TaskAge, len(page.Tasks))
+		for _, task := range page.Tasks {
+			if age, ok := aging[task.ID]; ok {
+				pageAging[task.ID] = age
+			}
+		}
+		aging = pageAging
+	}
+
+	// Return success with server data, streamed task by task
+	w.Header().Set("Content-Type", "application/json")
+	if err := writeBoardResponse(w, serverData, aging, nextCursor); err != nil {
+		log.Printf("Error writing user data: %v", err)
+	}
+}
+
+// SyncData synchronizes user data between client and server. ?board=
+// syncs a workspace board instead of the user's own.
+func (h *DataHandler) SyncData(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+	boardID := canonicalBoardID(email, queryBoard(r))
+
 	// Parse request body
 	var clientData KanbanData
-	if err := json.NewDecoder(r.Body).Decode(&clientData); err != nil {
-		http.Error(w, "Invalid request format", http.StatusBadRequest)
+	if !decodeJSONLimit(w, r, &clientData, maxBoardBodySize(h.dataService.quotas)) {
 		return
 	}
 
-	// Get server data
-	serverData, err := h.dataService.GetUserData(email)
-	if err != nil {
-		log.Printf("Error getting user data: %v", err)
-		http.Error(w, "Server error", http.StatusInternalServerError)
+	// Priorities are validated, after folding case and legacy synonyms
+	if invalid := normalizeTaskPriorities(&clientData); len(invalid) > 0 {
+		writeInvalidPriority(w, invalid)
+		return
+	}
+	if invalid, err := findInvalidColumns(&clientData); err != nil {
+		writeInvalidColumns(w, invalid, err)
 		return
 	}
 
-	// Merge client and server data
-	mergedData := mergeKanbanData(serverData, &clientData)
+	// Which copy wins where the boards disagree, e.g. ?strategy=serverWins
+	strategyName := r.URL.Query().Get("strategy")
+	if !validMergeStrategy(strategyName) {
+		writeFieldErrors(w, invalidMergeStrategy("strategy"))
+		return
+	}
+	if strategyName == "" && h.mergeStrategySetting != nil {
+		strategyName = h.mergeStrategySetting(email)
+	}
+	strategy, ok := mergeStrategies[strategyName]
+	if !ok {
+		strategyName, strategy = mergeClientWins, clientWins{}
+	}
+
+	// Merge with the server's board and save. Syncs arriving in quick
+	// succession, as when dragging cards, are merged in turn and saved in
+	// one transaction; the saved board is then published once to every
+	// client on the board, including the sender, so all of them end up with
+	// the same state.
+	var conflicts []ColumnTitleConflict
+	var syncReport []MergeConflict
+	var wipViolations []WIPLimitError
+	var locked []EditLock
+	shadow := h.crdt.Enabled(email)
+	mergedData, err := h.dataService.CoalescedUpdate(r.Context(), boardID, func(tx *Tx, serverData *KanbanData) error {
+		// What the client asked for, before the strategy and the rules
+		requested := mergeKanbanData(serverData, &clientData)
+		merged := cloneKanbanData(requested)
+		versions := func() (map[boardItemKey]int64, error) { return itemVersions(tx, boardID) }
+		kept, err := applyMergeStrategy(serverData, merged, clientData.Version, strategy, versions)
+		if err != nil {
+			return err
+		}
+		rules := func(board *KanbanData) error {
+			// Archived tasks stay archived even if the client still has them
+			if err := h.dataService.dropArchivedTasks(tx, boardID, board); err != nil {
+				return err
+			}
+			// And deleted ones stay deleted
+			if err := h.dataService.dropTrashedTasks(tx, boardID, board); err != nil {
+				return err
+			}
 
-	// Log summary of the merged data
-	log.Printf("Merged data summary: %d columns, %d tasks", len(mergedData.Columns), len(mergedData.Tasks))
-	for _, task := range mergedData.Tasks {
-		if task.ColumnID == nil {
-			log.Printf("Task %s is unassigned (columnId is null)", task.ID)
+			// Fold independently created default columns into one
+			if h.reconcileColumnTitles != nil {
+				reconcileDuplicateColumns(serverData, board, h.reconcileColumnTitles)
+			}
+			return nil
+		}
+		if err := rules(merged); err != nil {
+			return err
 		}
-	}
 
-	// Save merged data to server
-	if err := h.dataService.SaveUserData(email, mergedData); err != nil {
+		// Items another client has locked keep the server's copy
+		locked = h.dataService.locks.Keep(r.Context(), boardID, serverData, merged)
+
+		// Optionally refuse merges that produce duplicate column titles
+		if h.uniqueColumnTitles {
+			if conflicts = findColumnTitleConflicts(serverData, merged); len(conflicts) > 0 {
+				return errors.New("duplicate column titles")
+			}
+		}
+
+		// Full syncs carry work done offline, so columns pushed over their
+		// WIP limit are flagged in the response rather than refused
+		wipViolations = findWIPLimitViolations(serverData, merged)
+
+		syncReport = syncConflicts(&clientData, requested, merged, strategyName, kept, locked)
+
+		if shadow {
+			h.crdt.Sync(tx, boardID, crdtClientReplica(r), serverData, &clientData, merged, rules)
+		}
+		*serverData = *merged
+		return nil
+	})
+	if len(conflicts) > 0 {
+		writeColumnTitleConflict(w, conflicts)
+		return
+	}
+	if err != nil {
 		log.Printf("Error saving user data: %v", err)
-		http.Error(w, "Failed to save data", http.StatusInternalServerError)
+		writeServerError(w, err, "Failed to save data")
 		return
 	}
 
-	// Broadcast merged data to ALL connected clients including the sender
-	// This ensures all clients have the exact same state after any sync operation
-	message := WebSocketMessage{
-		Type: "sync",
-		Data: mergedData,
-		User: "", // Empty user to broadcast to everyone
+	// Log summary of the merged data
+	log.Printf("Merged data summary: %d columns, %d tasks", len(mergedData.Columns), len(mergedData.Tasks))
+	for _, task := range mergedData.Tasks {
+		if task.ColumnID == nil {
+			log.Printf("Task %s is unassigned (columnId is null)", task.ID)
+		}
 	}
 
-	// Broadcast to all clients without filtering by email
-	h.hub.Broadcast(message, "")
-
 	// Return success with merged data for two-way sync
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{
+	response := map[string]any{
 		"status": "success",
 		"data":   mergedData,
-	})
+	}
+	if len(wipViolations) > 0 {
+		response["wipLimitViolations"] = wipViolations
+	}
+	if len(locked) > 0 {
+		response["locked"] = locked
+	}
+	if len(syncReport) > 0 || strategyName == mergeManual {
+		// Always a list for manual, so clients can tell a clean sync apart
+		if syncReport == nil {
+			syncReport = []MergeConflict{}
+		}
+		response["conflicts"] = syncReport
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 // HandleWebSocket upgrades the HTTP connection to a WebSocket connection
 func (h *DataHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Get token from query parameter for WebSocket connection
+	// Get token from query parameter for WebSocket connection, or from the
+	// session cookie
 	token := r.URL.Query().Get("token")
 	if token == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "Missing token")
 		return
 	}
 
 	// Verify token directly since we can't use h.authenticate which expects Authorization header
 	email, err := h.authService.VerifyJWT(token)
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		writeError(w, http.StatusUnauthorized, "Invalid token")
 		return
 	}
 
 	// Upgrade HTTP connection to WebSocket
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow all origins in development
-		},
-	}
-
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Error upgrading to WebSocket: %v", err)
 		return
 	}
 
-	// Check for and close any existing connections for this user
-	for client := range h.hub.clients {
-		if client.email == email {
-			log.Printf("Found existing connection for user %s, keeping both connections", email)
-			// We're keeping both connections instead of closing the old one
-			// This allows a user to have multiple tabs/devices connected
-		}
+	// Register client in the hub. Users may connect from several tabs and
+	// devices, up to the hub's per-user limit.
+	client := NewClient(h.hub, conn, email)
+	client.clientID = strings.TrimSpace(r.URL.Query().Get("clientId"))
+	if len(client.clientID) > maxClientIDLength {
+		client.clientID = client.clientID[:maxClientIDLength]
 	}
 
-	// Register client in the hub
-	client := &Client{
-		hub:   h.hub,
-		conn:  conn,
-		send:  make(chan []byte, 256),
-		email: email,
-	}
+	// Resume the delivery session the client had before a dropped
+	// connection, if it's still kept
+	after, _ := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+	client.ResumeDelivery(r.URL.Query().Get("session"), after)
 
 	h.hub.Register(client)
 	log.Printf("WebSocket client registered: %s", email)
@@ -305,6 +475,11 @@ func (h *DataHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Start goroutines for reading and writing
 	go client.WritePump()
 	go client.ReadPump()
+
+	// The board is read after the client joined its room, so a change saved
+	// in between is in the state or broadcast after it, never lost between a
+	// client's last read and its subscription
+	h.sendState(client, canonicalBoardID(email, ""), r.URL.Query().Get("state") == "full")
 }
 
 // mergeKanbanData performs a safe merge between server and client data
@@ -314,6 +489,8 @@ func (h *DataHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 // 3. Tasks and columns that are marked as deleted are preserved but hidden from UI
 // 4. Tasks that exist on the server but not in the client are preserved
 // 5. Tasks with null or empty columnId are considered "unassigned"
+// 6. Swimlanes merge like columns; a task's swimlaneId is kept from the server when the client omits it
+// 7. Each task appears once; a task in both tasks and the legacy unassignedTasks keeps its tasks copy
 func mergeKanbanData(serverData *KanbanData, clientData *KanbanData) *KanbanData {
 	result := &KanbanData{
 		Columns:             []Column{},
@@ -322,41 +499,15 @@ func mergeKanbanData(serverData *KanbanData, clientData *KanbanData) *KanbanData
 	}
 
 	// Create maps for faster lookups
-	serverColumns := make(map[string]Column)
-	clientColumns := make(map[string]Column)
-
-	// Track all task IDs across both client and server
-	allServerTaskIDs := make(map[string]bool)
-	allClientTaskIDs := make(map[string]bool)
-
-	// Populate column maps
-	for _, col := range serverData.Columns {
-		serverColumns[col.ID] = col
-	}
+	clientColumns := make(map[string]bool)
 	for _, col := range clientData.Columns {
-		clientColumns[col.ID] = col
+		clientColumns[col.ID] = true
 	}
 
-	// Record all task IDs from server tasks
+	// Record the server's swimlane for each task
+	serverSwimlaneIDs := make(map[string]*string)
 	for _, task := range serverData.Tasks {
-		allServerTaskIDs[task.ID] = true
-	}
-	// If server data still has unassignedTasks as separate array (for backward compatibility)
-	if len(serverData.UnassignedTasks) > 0 {
-		for _, task := range serverData.UnassignedTasks {
-			allServerTaskIDs[task.ID] = true
-		}
-	}
-
-	// Record all task IDs from client
-	for _, task := range clientData.Tasks {
-		allClientTaskIDs[task.ID] = true
-	}
-	// If client data still has unassignedTasks as separate array (for backward compatibility)
-	if len(clientData.UnassignedTasks) > 0 {
-		for _, task := range clientData.UnassignedTasks {
-			allClientTaskIDs[task.ID] = true
-		}
+		serverSwimlaneIDs[task.ID] = task.SwimlaneID
 	}
 
 	// Merge columns - prioritize client columns
@@ -365,17 +516,37 @@ func mergeKanbanData(serverData *KanbanData, clientData *KanbanData) *KanbanData
 		result.Columns = append(result.Columns, col)
 	}
 
-	// Add server columns that don't exist in client
-	for id, col := range serverColumns {
-		if _, exists := clientColumns[id]; !exists {
+	// Add server columns that don't exist in client, in the server's order
+	for _, col := range serverData.Columns {
+		if !clientColumns[col.ID] {
+			clientColumns[col.ID] = true
 			result.Columns = append(result.Columns, col)
 		}
 	}
 
-	// For tasks, use client state exclusively unless a task only exists on server
+	// Merge swimlanes the same way - clients that predate swimlanes send
+	// none, which keeps every lane the server knows about
+	clientSwimlanes := make(map[string]bool)
+	for _, lane := range clientData.Swimlanes {
+		clientSwimlanes[lane.ID] = true
+		result.Swimlanes = append(result.Swimlanes, lane)
+	}
+	for _, lane := range serverData.Swimlanes {
+		if !clientSwimlanes[lane.ID] {
+			result.Swimlanes = append(result.Swimlanes, lane)
+		}
+	}
+
+	// For tasks, use client state exclusively unless a task only exists on
+	// server. Each task is added once, from the first place it's found.
+	added := make(map[string]bool)
 
 	// First, add all client tasks
 	for _, task := range clientData.Tasks {
+		if added[task.ID] {
+			continue
+		}
+		added[task.ID] = true
 		// Fix for unassigned tasks: ensure empty string columnId is treated as null
 		// This is critical for proper handling of unassigned tasks
 		if task.ColumnID != nil {
@@ -385,11 +556,22 @@ func mergeKanbanData(serverData *KanbanData, clientData *KanbanData) *KanbanData
 				task.ColumnID = nil
 			}
 		}
+		// Clients that predate swimlanes don't send swimlaneId, so a missing
+		// one keeps the server's; an empty string takes the task out of its lane
+		if task.SwimlaneID == nil {
+			task.SwimlaneID = serverSwimlaneIDs[task.ID]
+		} else if *task.SwimlaneID == "" {
+			task.SwimlaneID = nil
+		}
 		result.Tasks = append(result.Tasks, task)
 	}
 
 	// If client still uses unassignedTasks array, add those too
 	for _, task := range clientData.UnassignedTasks {
+		if added[task.ID] {
+			continue
+		}
+		added[task.ID] = true
 		// Make sure these tasks have no columnId
 		task.ColumnID = nil
 		log.Printf("Adding unassigned task %s from legacy unassignedTasks array", task.ID)
@@ -399,7 +581,8 @@ func mergeKanbanData(serverData *KanbanData, clientData *KanbanData) *KanbanData
 	// Then add server tasks that don't exist in the client at all
 	// These are tasks that might have been added on another device
 	for _, task := range serverData.Tasks {
-		if !allClientTaskIDs[task.ID] {
+		if !added[task.ID] {
+			added[task.ID] = true
 			// Fix for unassigned tasks: ensure empty string columnId is treated as null
 			if task.ColumnID != nil {
 				columnIDVal := *task.ColumnID
@@ -414,7 +597,8 @@ func mergeKanbanData(serverData *KanbanData, clientData *KanbanData) *KanbanData
 
 	// If server still uses unassignedTasks array, add those too
 	for _, task := range serverData.UnassignedTasks {
-		if !allClientTaskIDs[task.ID] {
+		if !added[task.ID] {
+			added[task.ID] = true
 			// Make sure these tasks have no columnId
 			task.ColumnID = nil
 			log.Printf("Adding unassigned task %s from server's legacy unassignedTasks array", task.ID)
@@ -422,6 +606,8 @@ func mergeKanbanData(serverData *KanbanData, clientData *KanbanData) *KanbanData
 		}
 	}
 
+	leaveDeletedSwimlanes(result)
+
 	// Final verification pass to ensure all unassigned tasks have null columnId
 	for i, task := range result.Tasks {
 		if task.ColumnID != nil {
@@ -437,3 +623,19 @@ func mergeKanbanData(serverData *KanbanData, clientData *KanbanData) *KanbanData
 	return result
 }
 
+// leaveDeletedSwimlanes takes tasks out of lanes that are deleted or gone,
+// as deleteSwimlane does
+func leaveDeletedSwimlanes(data *KanbanData) {
+	liveSwimlanes := make(map[string]bool)
+	for _, lane := range data.Swimlanes {
+		if !lane.Deleted {
+			liveSwimlanes[lane.ID] = true
+		}
+	}
+	for i, task := range data.Tasks {
+		if task.SwimlaneID != nil && !liveSwimlanes[*task.SwimlaneID] {
+			data.Tasks[i].SwimlaneID = nil
+		}
+	}
+}
+
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errorResponse is the body of an error response
+type errorResponse struct {
+	Status      string       `json:"status"`
+	Code        string       `json:"code"`
+	Message     string       `json:"message"`
+	FieldErrors []FieldError `json:"fieldErrors"`
+}
+
+type boardResponse struct {
+	Status     string     `json:"status"`
+	Data       KanbanData `json:"data"`
+	NextCursor string     `json:"nextCursor"`
+}
+
+func taskIDs(tasks []Task) []string {
+	ids := make([]string, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.ID
+	}
+	return ids
+}
+
+func TestDataRoutesRequireAuth(t *testing.T) {
+	app := newTestApp(t)
+	for _, route := range []struct{ method, path string }{
+		{"GET", "/api/data/get"},
+		{"POST", "/api/data/sync"},
+		{"GET", "/api/data/changes?since=0"},
+		{"POST", "/api/tasks/quick-add"},
+	} {
+		rec := app.do(t, route.method, route.path, "", nil)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s unauthenticated: status %d, want %d", route.method, route.path, rec.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestLoginReturnsMagicLinkOnlyInDevelopment(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		want bool
+	}{
+		{"development", Config{}, true},
+		{"production", Config{Production: true}, false},
+		{"smtp", Config{SMTP: SMTPConfig{Host: "127.0.0.1", Port: "1"}}, false},
+	} {
+		tc.cfg.JWTSecret, tc.cfg.AuthSession = testSecret, "token"
+		auth := NewAuthService(&tc.cfg)
+		handler := NewAuthHandler(auth, nil, nil)
+
+		req := httptest.NewRequest("POST", "/api/auth/login", strings.NewReader(`{"email": "a@example.com"}`))
+		rec := httptest.NewRecorder()
+		handler.Login(rec, req)
+		var resp struct {
+			MagicLink string `json:"magicLink"`
+		}
+		decodeBody(t, rec, &resp)
+		if got := resp.MagicLink != ""; got != tc.want {
+			t.Errorf("%s: magic link returned = %t, want %t (status %d)", tc.name, got, tc.want, rec.Code)
+		}
+	}
+}
+
+func TestSyncDataMergesWithServerBoard(t *testing.T) {
+	app := newTestApp(t)
+	email := "a@example.com"
+
+	rec := app.do(t, "POST", "/api/data/sync", email, testBoard())
+	expectStatus(t, rec, http.StatusOK)
+	var first boardResponse
+	decodeBody(t, rec, &first)
+	if first.Data.Version != 1 || len(first.Data.Tasks) != 1 {
+		t.Fatalf("first sync returned version %d with %d tasks, want version 1 with 1 task", first.Data.Version, len(first.Data.Tasks))
+	}
+
+	// A second device adds a task without having seen the first
+	other := testBoard()
+	other.Tasks = []Task{{ID: "t2", Title: "From another device", ColumnID: strPtr("todo")}}
+	rec = app.do(t, "POST", "/api/data/sync", email, other)
+	expectStatus(t, rec, http.StatusOK)
+	var second boardResponse
+	decodeBody(t, rec, &second)
+	if second.Data.Version != 2 {
+		t.Errorf("version = %d, want 2", second.Data.Version)
+	}
+	ids := taskIDs(second.Data.Tasks)
+	if len(ids) != 2 {
+		t.Errorf("merged tasks = %v, want t1 and t2", ids)
+	}
+
+	stored, err := app.dataService.GetUserData(context.Background(), email)
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	if stored.Version != 2 || len(stored.Tasks) != 2 {
+		t.Errorf("stored board = version %d with %d tasks, want version 2 with 2", stored.Version, len(stored.Tasks))
+	}
+}
+
+func TestSyncDataRejectsInvalidBodies(t *testing.T) {
+	app := newTestApp(t)
+	email := "a@example.com"
+
+	badPriority := testBoard()
+	badPriority.Tasks[0].Priority = strPtr("whenever")
+
+	for _, tc := range []struct {
+		name   string
+		body   any
+		status int
+		code   string
+	}{
+		{"malformed JSON", `{"columns": [`, http.StatusBadRequest, "invalid_json"},
+		{"unknown field", `{"columns": [], "tasks": [], "colour": "red"}`, http.StatusBadRequest, "invalid_json"},
+		{"invalid priority", badPriority, http.StatusUnprocessableEntity, "invalid_priority"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := app.do(t, "POST", "/api/data/sync", email, tc.body)
+			expectStatus(t, rec, tc.status)
+			var body errorResponse
+			decodeBody(t, rec, &body)
+			if body.Code != tc.code {
+				t.Errorf("code = %q, want %q", body.Code, tc.code)
+			}
+		})
+	}
+
+	if data, _ := app.dataService.GetUserData(context.Background(), email); data.Version != 0 {
+		t.Errorf("rejected syncs saved the board at version %d", data.Version)
+	}
+}
+
+func TestSyncDataManualMerge(t *testing.T) {
+	app := newTestApp(t)
+	email := "a@example.com"
+	expectStatus(t, app.do(t, "POST", "/api/data/sync", email, testBoard()), http.StatusOK)
+
+	board := testBoard()
+	board.Columns[0].Title = "Backlog"
+	rec := app.do(t, "POST", "/api/data/sync?strategy=manual", email, board)
+	expectStatus(t, rec, http.StatusOK)
+	var manual struct {
+		Data      KanbanData      `json:"data"`
+		Conflicts []MergeConflict `json:"conflicts"`
+	}
+	decodeBody(t, rec, &manual)
+	if manual.Data.Columns[0].Title != "To Do" {
+		t.Errorf("column title = %q, want the server's", manual.Data.Columns[0].Title)
+	}
+	if len(manual.Conflicts) != 1 || manual.Conflicts[0].ID != "todo" || manual.Conflicts[0].Field != "title" || manual.Conflicts[0].Resolution != mergeManual {
+		t.Errorf("conflicts = %+v, want the todo column's title", manual.Conflicts)
+	}
+
+	// Without the parameter the user's setting applies
+	app.dataHandler.UseMergeStrategySetting(func(string) string { return mergeServerWins })
+	rec = app.do(t, "POST", "/api/data/sync", email, board)
+	expectStatus(t, rec, http.StatusOK)
+	decodeBody(t, rec, &manual)
+	if manual.Data.Columns[0].Title != "To Do" {
+		t.Errorf("column title = %q, want the server's", manual.Data.Columns[0].Title)
+	}
+
+	expectStatus(t, app.do(t, "POST", "/api/data/sync?strategy=mine", email, board), http.StatusUnprocessableEntity)
+}
+
+func TestReorderColumns(t *testing.T) {
+	app := newTestApp(t)
+	email := "a@example.com"
+	board := testBoard()
+	board.Columns = append(board.Columns,
+		Column{ID: "review", Title: "Review", Order: 1, Hidden: true},
+		Column{ID: "old", Title: "Old", Order: 1, Deleted: true},
+	)
+	if err := app.dataService.SaveUserData(context.Background(), email, board); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+	viewer := connectFakeClient(app.hub, email)
+
+	for _, ids := range [][]string{
+		{"done", "todo"},                   // Missing one
+		{"done", "todo", "review", "todo"}, // Listed twice
+		{"done", "todo", "old"},            // Deleted
+		{"done", "todo", "nope"},           // Unknown
+	} {
+		expectStatus(t, app.do(t, "PATCH", "/api/columns/reorder", email, map[string]any{"ids": ids}), http.StatusBadRequest)
+	}
+
+	rec := app.do(t, "PATCH", "/api/columns/reorder", email, map[string]any{"ids": []string{"done", "review", "todo"}})
+	expectStatus(t, rec, http.StatusOK)
+	var body struct {
+		Columns []Column `json:"columns"`
+	}
+	decodeBody(t, rec, &body)
+	var got []string
+	for _, col := range body.Columns {
+		got = append(got, fmt.Sprintf("%s=%d", col.ID, col.Order))
+	}
+	if want := "done=0 review=1 todo=2"; strings.Join(got, " ") != want {
+		t.Errorf("columns = %v, want %s", got, want)
+	}
+	receive(t, viewer, "sync")
+}
+
+func TestSyncDataOverQuota(t *testing.T) {
+	app := newTestApp(t)
+	app.dataService.EnforceQuotas(QuotaConfig{Tasks: 1})
+	email := "a@example.com"
+
+	board := testBoard()
+	board.Tasks = append(board.Tasks, Task{ID: "t2", Title: "Two", ColumnID: strPtr("todo")})
+	rec := app.do(t, "POST", "/api/data/sync", email, board)
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+	var body struct {
+		Code  string     `json:"code"`
+		Quota QuotaError `json:"quota"`
+	}
+	decodeBody(t, rec, &body)
+	if body.Code != "quota_exceeded" || body.Quota.Quota != QuotaTasks || body.Quota.Limit != 1 {
+		t.Errorf("error = %+v, want the tasks quota", body)
+	}
+}
+
+func TestSyncDataAcceptsLargeBoards(t *testing.T) {
+	app := newTestApp(t)
+	app.dataService.EnforceQuotas(QuotaConfig{BoardBytes: 10 * 1024 * 1024})
+	email := "a@example.com"
+
+	// Full syncs are bounded by the board quota, not the 1MB of other requests
+	board := testBoard()
+	board.Tasks[0].Description = strings.Repeat("x", 2*maxRequestBodySize)
+	expectStatus(t, app.do(t, "POST", "/api/data/sync", email, board), http.StatusOK)
+
+	large := strings.Repeat("x", 2*maxRequestBodySize)
+	expectStatus(t, app.do(t, "POST", "/api/tasks/quick-add", email, map[string]string{"text": large}), http.StatusRequestEntityTooLarge)
+}
+
+func TestGetDataPagesAndFilters(t *testing.T) {
+	app := newTestApp(t)
+	email := "a@example.com"
+
+	board := testBoard()
+	board.Tasks = []Task{
+		{ID: "t1", Title: "One", ColumnID: strPtr("todo")},
+		{ID: "t2", Title: "Two", ColumnID: strPtr("done")},
+		{ID: "t3", Title: "Three", ColumnID: strPtr("todo")},
+	}
+	if err := app.dataService.SaveUserData(context.Background(), email, board); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+
+	rec := app.do(t, "GET", "/api/data/get", email, nil)
+	expectStatus(t, rec, http.StatusOK)
+	var whole boardResponse
+	decodeBody(t, rec, &whole)
+	if len(whole.Data.Tasks) != 3 || whole.NextCursor != "" {
+		t.Errorf("unpaged board has %d tasks and cursor %q, want 3 and none", len(whole.Data.Tasks), whole.NextCursor)
+	}
+
+	var seen []string
+	path := "/api/data/get?limit=2"
+	for page := 0; ; page++ {
+		if page > 3 {
+			t.Fatal("paging didn't end")
+		}
+		rec := app.do(t, "GET", path, email, nil)
+		expectStatus(t, rec, http.StatusOK)
+		var resp boardResponse
+		decodeBody(t, rec, &resp)
+		if len(resp.Data.Columns) != 2 {
+			t.Errorf("page %d has %d columns, want every column", page, len(resp.Data.Columns))
+		}
+		seen = append(seen, taskIDs(resp.Data.Tasks)...)
+		if resp.NextCursor == "" {
+			break
+		}
+		path = "/api/data/get?limit=2&cursor=" + resp.NextCursor
+	}
+	if len(seen) != 3 {
+		t.Errorf("paged through tasks %v, want all 3 once", seen)
+	}
+
+	rec = app.do(t, "GET", "/api/data/get?columnId=todo", email, nil)
+	expectStatus(t, rec, http.StatusOK)
+	var filtered boardResponse
+	decodeBody(t, rec, &filtered)
+	if ids := taskIDs(filtered.Data.Tasks); len(ids) != 2 || ids[0] == "t2" || ids[1] == "t2" {
+		t.Errorf("tasks in todo = %v, want t1 and t3", ids)
+	}
+
+	rec = app.do(t, "GET", "/api/data/get?cursor=bogus", email, nil)
+	expectStatus(t, rec, http.StatusBadRequest)
+	var body errorResponse
+	decodeBody(t, rec, &body)
+	if body.Code != "invalid_cursor" {
+		t.Errorf("code = %q, want invalid_cursor", body.Code)
+	}
+}
+
+func TestChangesRequiresSince(t *testing.T) {
+	app := newTestApp(t)
+	for _, path := range []string{"/api/data/changes", "/api/data/changes?since=yesterday"} {
+		rec := app.do(t, "GET", path, "a@example.com", nil)
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	app := newTestApp(t)
+	email := "a@example.com"
+	if err := app.dataService.SaveUserData(context.Background(), email, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+
+	type pollResponse struct {
+		Changes BoardChanges `json:"changes"`
+	}
+
+	// Behind the board, the changes come back at once
+	rec := app.do(t, "GET", "/api/data/poll?since=0", email, nil)
+	expectStatus(t, rec, http.StatusOK)
+	var caughtUp pollResponse
+	decodeBody(t, rec, &caughtUp)
+	if caughtUp.Changes.Version != 1 || len(caughtUp.Changes.Tasks) != 1 {
+		t.Errorf("changes = %+v, want version 1 with t1", caughtUp.Changes)
+	}
+
+	// Up to date and nothing happens
+	rec = app.do(t, "GET", "/api/data/poll?since=1&timeout=1", email, nil)
+	expectStatus(t, rec, http.StatusNoContent)
+
+	// A save while waiting wakes the poll
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- app.do(t, "GET", "/api/data/poll?since=1&timeout=10", email, nil)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); app.hub.Stats().Connections < 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("poll didn't join the hub")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	board := testBoard()
+	board.Tasks[0].Title = "Renamed"
+	expectStatus(t, app.do(t, "POST", "/api/data/sync", email, board), http.StatusOK)
+
+	select {
+	case rec := <-done:
+		expectStatus(t, rec, http.StatusOK)
+		var woken pollResponse
+		decodeBody(t, rec, &woken)
+		if woken.Changes.Version != 2 || len(woken.Changes.Tasks) != 1 || woken.Changes.Tasks[0].Title != "Renamed" {
+			t.Errorf("changes = %+v, want version 2 with the renamed task", woken.Changes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("poll wasn't woken by the save")
+	}
+
+	for _, path := range []string{"/api/data/poll", "/api/data/poll?since=x", "/api/data/poll?since=1&timeout=31"} {
+		expectStatus(t, app.do(t, "GET", path, email, nil), http.StatusBadRequest)
+	}
+}
+
+func TestWebSocketOpensWithState(t *testing.T) {
+	app := newTestApp(t)
+	email := "a@example.com"
+	if err := app.dataService.SaveUserData(context.Background(), email, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+	server := httptest.NewServer(app.router)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws?token=" + url.QueryEscape(app.token(t, email))
+
+	tests := []struct {
+		query     string
+		wantBoard bool
+	}{
+		{"", false},
+		{"&state=full", true},
+	}
+	for _, tc := range tests {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+tc.query, nil)
+		if err != nil {
+			t.Fatalf("dialing WebSocket: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var message struct {
+			Type string       `json:"type"`
+			Data StatePayload `json:"data"`
+		}
+		for message.Type != "state" {
+			if err := conn.ReadJSON(&message); err != nil {
+				t.Fatalf("waiting for state: %v", err)
+			}
+		}
+		conn.Close()
+
+		if message.Data.Version != 1 || (message.Data.Board != nil) != tc.wantBoard {
+			t.Errorf("%q: state = %+v, want version 1, with the board %v", tc.query, message.Data, tc.wantBoard)
+		}
+	}
+}
+
+func TestQuickAdd(t *testing.T) {
+	app := newTestApp(t)
+	email := "a@example.com"
+	if err := app.dataService.SaveUserData(context.Background(), email, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+
+	type taskResponse struct {
+		Task Task `json:"task"`
+	}
+
+	rec := app.do(t, "POST", "/api/tasks/quick-add", email, map[string]any{"text": "Pay rent 2030-01-05 !high #finance", "columnId": "todo"})
+	expectStatus(t, rec, http.StatusCreated)
+	var added taskResponse
+	decodeBody(t, rec, &added)
+	task := added.Task
+	if task.ID == "" || task.Title != "Pay rent" || task.DueDate != "2030-01-05" {
+		t.Errorf("task = %+v, want Pay rent due 2030-01-05", task)
+	}
+	if task.Priority == nil || *task.Priority != PriorityHigh {
+		t.Errorf("priority = %v, want %s", task.Priority, PriorityHigh)
+	}
+	if len(task.Labels) != 1 || task.Labels[0] != "finance" {
+		t.Errorf("labels = %v, want [finance]", task.Labels)
+	}
+
+	rec = app.do(t, "POST", "/api/tasks/quick-add", email, map[string]any{"text": "Just looking", "dryRun": true})
+	expectStatus(t, rec, http.StatusOK)
+
+	data, err := app.dataService.GetUserData(context.Background(), email)
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	if len(data.Tasks) != 2 {
+		t.Errorf("board has %d tasks, want 2: the dry run shouldn't add one", len(data.Tasks))
+	}
+
+	for _, tc := range []struct {
+		name  string
+		body  map[string]any
+		field string
+	}{
+		{"no title", map[string]any{"text": "tomorrow !high"}, "text"},
+		{"unknown priority", map[string]any{"text": "Nap !someday"}, "priority"},
+		{"unknown time zone", map[string]any{"text": "Nap", "tz": "Mars/Olympus"}, "tz"},
+		{"unknown column", map[string]any{"text": "Nap", "columnId": "nope"}, "columnId"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := app.do(t, "POST", "/api/tasks/quick-add", email, tc.body)
+			expectStatus(t, rec, http.StatusUnprocessableEntity)
+			var body errorResponse
+			decodeBody(t, rec, &body)
+			if len(body.FieldErrors) != 1 || body.FieldErrors[0].Field != tc.field {
+				t.Errorf("field errors = %+v, want one for %s", body.FieldErrors, tc.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testSecret signs the session tokens of test servers
+const testSecret = "test-secret"
+
+// newTestDB opens an in-memory SQLite database with the full schema. It's
+// closed when the test ends.
+func newTestDB(t testing.TB) *DB {
+	t.Helper()
+	return openTestDB(t, ":memory:")
+}
+
+// openTestDB opens a database with the full schema and the server's default
+// pool settings. It's closed when the test ends.
+func openTestDB(t testing.TB, databaseURL string) *DB {
+	t.Helper()
+	db, err := initDB(&Config{
+		DatabaseURL: databaseURL,
+		DBPool: DBPoolConfig{
+			MaxOpenConns:    10,
+			MaxIdleConns:    5,
+			ConnMaxIdleTime: 5 * time.Minute,
+			BusyTimeout:     5 * time.Second,
+			QueryTimeout:    10 * time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatalf("initDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		t.Fatalf("NewMigrator: %v", err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+	return db
+}
+
+// newTestDataService returns a DataService on a fresh in-memory database
+func newTestDataService(t testing.TB) *DataService {
+	t.Helper()
+	return newDataServiceOn(t, newTestDB(t))
+}
+
+func newDataServiceOn(t testing.TB, db *DB) *DataService {
+	t.Helper()
+	codec, err := NewBoardCodec("none", nil)
+	if err != nil {
+		t.Fatalf("NewBoardCodec: %v", err)
+	}
+	return NewDataService(db, codec)
+}
+
+// newTestAuthService returns an AuthService that signs tokens with
+// testSecret and, without SMTP, hands magic links back instead of mailing
+// them
+func newTestAuthService() *AuthService {
+	return NewAuthService(&Config{JWTSecret: testSecret, AuthSession: "token"})
+}
+
+// testApp wires the services and routes the tests exercise, as main does
+type testApp struct {
+	db          *DB
+	auth        *AuthService
+	dataService *DataService
+	dataHandler *DataHandler
+	hub         *Hub
+	locks       *LockService
+	workspaces  *WorkspaceService
+	router      *mux.Router
+}
+
+func newTestApp(t testing.TB) *testApp {
+	t.Helper()
+	cfg := &Config{JWTSecret: testSecret, AuthSession: "token", AllowedOrigins: []string{"*"}}
+
+	dataService := newTestDataService(t)
+	db := dataService.db
+	auth := newTestAuthService()
+
+	hub := NewHub()
+	hub.LimitQueues(64, SlowClientDrop)
+	go hub.Run()
+	dataService.CoalesceWrites(time.Millisecond, func(email string, data *KanbanData) {
+		hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+	})
+
+	locks := NewLockService(hub)
+	dataService.UseLocks(locks)
+
+	workspaces := NewWorkspaceService(db, auth, dataService, hub)
+	hub.UseSharedBoards(workspaces.BoardRole)
+
+	authHandler := NewAuthHandler(auth, dataService, NewTOTPService(db, auth, "Test"))
+	dataHandler := NewDataHandler(dataService, auth, NewCommentService(db, dataService), hub, cfg)
+	quickAddHandler := NewQuickAddHandler(dataService, hub)
+	policy := NewPolicyEnforcer(auth, NewAPIKeyService(db, auth), cfg)
+	policy.UseSharedBoards(workspaces.BoardRole)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/auth/login", authHandler.Login).Methods("POST")
+	r.HandleFunc("/api/auth/magic-link", authHandler.HandleMagicLink).Methods("GET")
+	r.HandleFunc("/api/auth/exchange", authHandler.Exchange).Methods("POST")
+
+	canView := policy.HasBoardRole(BoardRoleViewer, queryBoard)
+	canEdit := policy.HasBoardRole(BoardRoleEditor, queryBoard)
+	r.Handle("/api/data/sync", policy.Require(decompressRequest(dataHandler.SyncData), canEdit)).Methods("POST")
+	r.Handle("/api/data/get", policy.Require(dataHandler.GetData, canView)).Methods("GET")
+	r.Handle("/api/data/changes", policy.Require(dataHandler.Changes, canView)).Methods("GET")
+	r.Handle("/api/data/poll", policy.Require(dataHandler.Poll, canView)).Methods("GET")
+	r.Handle("/api/tasks/quick-add", policy.Require(quickAddHandler.QuickAdd)).Methods("POST")
+	r.Handle("/api/columns/reorder", policy.Require(NewColumnHandler(dataService, hub).Reorder)).Methods("PATCH")
+	r.HandleFunc("/api/ws", dataHandler.HandleWebSocket)
+
+	lockHandler := NewLockHandler(locks)
+	r.Handle("/api/locks", policy.Require(lockHandler.List)).Methods("GET")
+	r.Handle("/api/locks", policy.Require(lockHandler.Claim)).Methods("POST")
+	r.Handle("/api/locks/{kind}", policy.Require(lockHandler.Release)).Methods("DELETE")
+	r.Handle("/api/locks/{kind}/{id}", policy.Require(lockHandler.Release)).Methods("DELETE")
+
+	shareHandler := NewShareHandler(NewShareService(db, auth), dataService, cfg)
+	r.Handle("/api/boards/{id}/share-link", policy.Require(shareHandler.Create, policy.HasBoardRole(BoardRoleOwner, pathBoard))).Methods("POST")
+
+	return &testApp{db: db, auth: auth, dataService: dataService, dataHandler: dataHandler, hub: hub, locks: locks, workspaces: workspaces, router: r}
+}
+
+// token returns a session token for email
+func (a *testApp) token(t testing.TB, email string) string {
+	t.Helper()
+	token, err := a.auth.CreateJWT(email)
+	if err != nil {
+		t.Fatalf("CreateJWT: %v", err)
+	}
+	return token
+}
+
+// do sends a request to the app as email (unauthenticated if empty) and
+// returns the recorded response
+func (a *testApp) do(t testing.TB, method, path, email string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	return a.doClient(t, method, path, email, "", body)
+}
+
+// doClient is do for a request from a client with an X-Client-ID
+func (a *testApp) doClient(t testing.TB, method, path, email, client string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Reader
+	switch b := body.(type) {
+	case nil:
+		reader = bytes.NewReader(nil)
+	case string:
+		reader = bytes.NewReader([]byte(b))
+	default:
+		encoded, err := json.Marshal(b)
+		if err != nil {
+			t.Fatalf("encoding request body: %v", err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if email != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token(t, email))
+	}
+	if client != "" {
+		req.Header.Set("X-Client-ID", client)
+	}
+	rec := httptest.NewRecorder()
+	a.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeBody decodes a JSON response body into v
+func decodeBody(t testing.TB, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+	}
+}
+
+// expectStatus fails the test unless the response has the given status
+func expectStatus(t testing.TB, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d; body: %s", rec.Code, status, rec.Body.String())
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HomeAssistantService manages the long-lived tokens Home Assistant uses to
+// read sensors and add tasks
+type HomeAssistantService struct {
+	db          *DB
+	authService *AuthService
+}
+
+func NewHomeAssistantService(db *DB, authService *AuthService) *HomeAssistantService {
+	return &HomeAssistantService{db: db, authService: authService}
+}
+
+// RotateToken creates a new token for a user, invalidating any old one
+func (s *HomeAssistantService) RotateToken(email string) (string, error) {
+	token, err := s.authService.generateSecureToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	if err := ensureUser(s.db, email); err != nil {
+		return "", err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO homeassistant_tokens (email, token, created_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(email) DO UPDATE SET
+			token = excluded.token,
+			created_at = CURRENT_TIMESTAMP
+	`, email, token)
+	if err != nil {
+		return "", fmt.Errorf("failed to store Home Assistant token: %w", err)
+	}
+
+	return token, nil
+}
+
+// EmailForToken returns the user owning a token
+func (s *HomeAssistantService) EmailForToken(token string) (string, error) {
+	var email string
+	err := s.db.QueryRow("SELECT email FROM homeassistant_tokens WHERE token = ?", token).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("unknown Home Assistant token")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query Home Assistant token: %w", err)
+	}
+	return email, nil
+}
+
+// HomeAssistantSensor is the sensor payload. State is the number of tasks
+// due today or overdue; the rest are exposed as attributes.
+type HomeAssistantSensor struct {
+	State       int            `json:"state"`
+	Open        int            `json:"open"`
+	Overdue     int            `json:"overdue"`
+	DueToday    int            `json:"due_today"`
+	DueThisWeek int            `json:"due_this_week"`
+	Unassigned  int            `json:"unassigned"`
+	Columns     map[string]int `json:"columns"`
+}
+
+// buildHomeAssistantSensor counts a board's open tasks. Tasks in done
+// columns aren't open; due counts leave out the user's muted columns.
+func buildHomeAssistantSensor(data *KanbanData, settings *UserSettings, now time.Time) HomeAssistantSensor {
+	sensor := HomeAssistantSensor{Columns: map[string]int{}}
+
+	columns := make(map[string]Column)
+	for _, col := range data.Columns {
+		if !col.Deleted {
+			columns[col.ID] = col
+			if !col.IsDone {
+				sensor.Columns[col.Title] = 0
+			}
+		}
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	weekEnd := today.AddDate(0, 0, 7)
+
+	for _, task := range data.Tasks {
+		if task.Deleted || task.Hidden {
+			continue
+		}
+		if task.ColumnID == nil {
+			sensor.Unassigned++
+		} else if col, ok := columns[*task.ColumnID]; !ok || col.IsDone {
+			continue
+		} else {
+			sensor.Columns[col.Title]++
+		}
+		sensor.Open++
+
+		due, ok := parseDueDate(task.DueDate)
+		if !ok || settings.ColumnMuted(task.ColumnID) {
+			continue
+		}
+		// Compare calendar dates, whatever the stored time of day
+		due = time.Date(due.Year(), due.Month(), due.Day(), 0, 0, 0, 0, time.UTC)
+		switch {
+		case due.Before(today):
+			sensor.Overdue++
+		case due.Equal(today):
+			sensor.DueToday++
+		}
+		if due.Before(weekEnd) && !due.Before(today) {
+			sensor.DueThisWeek++
+		}
+	}
+
+	sensor.State = sensor.Overdue + sensor.DueToday
+	return sensor
+}
+
+// HomeAssistantHandler serves the Home Assistant sensor and actions
+type HomeAssistantHandler struct {
+	homeAssistantService *HomeAssistantService
+	dataService          *DataService
+	settingsService      *SettingsService
+	hub                  *Hub
+}
+
+func NewHomeAssistantHandler(homeAssistantService *HomeAssistantService, dataService *DataService, settingsService *SettingsService, hub *Hub) *HomeAssistantHandler {
+	return &HomeAssistantHandler{
+		homeAssistantService: homeAssistantService,
+		dataService:          dataService,
+		settingsService:      settingsService,
+		hub:                  hub,
+	}
+}
+
+// CreateToken issues a new long-lived token for the authenticated user
+func (h *HomeAssistantHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	token, err := h.homeAssistantService.RotateToken(requestEmail(r))
+	if err != nil {
+		log.Printf("Error rotating Home Assistant token: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to create token")
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := fmt.Sprintf("%s://%s/api/homeassistant", scheme, r.Host)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":    "success",
+		"token":     token,
+		"sensorUrl": base + "/sensor",
+		"tasksUrl":  base + "/tasks",
+	})
+}
+
+// authenticate resolves the request's Home Assistant token, writing a 401
+// if it's missing or unknown
+func (h *HomeAssistantHandler) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token, err := bearerToken(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return "", false
+	}
+
+	email, err := h.homeAssistantService.EmailForToken(token)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Invalid token")
+		return "", false
+	}
+	return email, true
+}
+
+// Sensor returns task counts for a RESTful sensor. Dates are compared in
+// the server's time zone unless ?tz= names another.
+func (h *HomeAssistantHandler) Sensor(w http.ResponseWriter, r *http.Request) {
+	email, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Unknown time zone")
+			return
+		}
+		now = now.In(loc)
+	}
+
+	data, err := h.dataService.GetUserData(r.Context(), email)
+	if err != nil {
+		log.Printf("Error getting user data: %v", err)
+		writeServerError(w, err, "Server error")
+		return
+	}
+	settings, err := h.settingsService.Get(email)
+	if err != nil {
+		log.Printf("Error loading settings: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildHomeAssistantSensor(data, settings, now))
+}
+
+// AddTask adds a task, for a rest_command service. The column may be given
+// by ID or title; without one the task is unassigned.
+func (h *HomeAssistantHandler) AddTask(w http.ResponseWriter, r *http.Request) {
+	email, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		DueDate     string `json:"dueDate"`
+		Priority    string `json:"priority"`
+		Column      string `json:"column"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" {
+		writeError(w, http.StatusBadRequest, "title is required")
+		return
+	}
+	if req.DueDate != "" {
+		if _, ok := parseDueDate(req.DueDate); !ok {
+			writeError(w, http.StatusBadRequest, "dueDate must be YYYY-MM-DD")
+			return
+		}
+	}
+
+	if req.Priority != "" && !validPriority(req.Priority) {
+		writeError(w, http.StatusBadRequest, errInvalidPriority.Error())
+		return
+	}
+
+	task := Task{Title: req.Title, Description: req.Description, DueDate: req.DueDate}
+	if req.Priority != "" {
+		task.Priority = &req.Priority
+	}
+
+	var columnErr error
+	data, err := h.dataService.UpdateUserData(r.Context(), email, func(data *KanbanData) error {
+		if req.Column != "" {
+			for _, col := range data.Columns {
+				if !col.Deleted && (col.ID == req.Column || strings.EqualFold(col.Title, req.Column)) {
+					columnID := col.ID
+					task.ColumnID = &columnID
+					break
+				}
+			}
+			if task.ColumnID == nil {
+				columnErr = fmt.Errorf("column %q not found", req.Column)
+				return columnErr
+			}
+		}
+
+		op := Operation{Type: OpCreateTask, Task: &task}
+		if err := applyOperation(data, &op); err != nil {
+			return err
+		}
+		task = *op.Task
+		return nil
+	})
+	if columnErr != nil {
+		writeError(w, http.StatusBadRequest, columnErr.Error())
+		return
+	}
+	var wipErr *WIPLimitError
+	if errors.As(err, &wipErr) {
+		writeWIPLimitExceeded(w, wipErr)
+		return
+	}
+	if err != nil {
+		log.Printf("Error adding task from Home Assistant: %v", err)
+		writeServerError(w, err, "Failed to add task")
+		return
+	}
+
+	h.hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"task":   task,
+	})
+}
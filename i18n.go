@@ -0,0 +1,128 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// Server strings are written in English, which is also their key in the
+// translation files: locales/<code>.json maps each English string (a
+// format string where it takes arguments) to its translation. Strings
+// missing from a locale stay in English.
+//
+// API responses are in the user's language setting, or else the best match
+// for the request's Accept-Language, and say which in Content-Language.
+// Error messages are translated as they're written. Emails use the
+// recipient's setting, or the language of the request that sent them.
+
+// defaultLocale is the language server strings are written in
+const defaultLocale = "en"
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// translations maps each locale to its strings, by English string
+var translations = func() map[string]map[string]string {
+	all := map[string]map[string]string{defaultLocale: {}}
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err) // embedded at build time
+	}
+	for _, file := range files {
+		raw, err := localeFiles.ReadFile("locales/" + file.Name())
+		if err != nil {
+			panic(err)
+		}
+		catalog := make(map[string]string)
+		if err := json.Unmarshal(raw, &catalog); err != nil {
+			panic(fmt.Sprintf("locales/%s: %v", file.Name(), err))
+		}
+		all[strings.TrimSuffix(file.Name(), path.Ext(file.Name()))] = catalog
+	}
+	return all
+}()
+
+// supportedLocales lists the locales with translations, English first
+var supportedLocales = func() []string {
+	locales := []string{defaultLocale}
+	for locale := range translations {
+		if locale != defaultLocale {
+			locales = append(locales, locale)
+		}
+	}
+	sort.Strings(locales[1:])
+	return locales
+}()
+
+// localeMatcher picks the supported locale closest to what a client asks
+// for, falling back to English
+var localeMatcher = func() language.Matcher {
+	tags := make([]language.Tag, len(supportedLocales))
+	for i, locale := range supportedLocales {
+		tags[i] = language.MustParse(locale)
+	}
+	return language.NewMatcher(tags)
+}()
+
+// supportedLocale reports whether a locale has translations
+func supportedLocale(locale string) bool {
+	_, ok := translations[locale]
+	return ok
+}
+
+// negotiateLocale picks the locale for an Accept-Language header
+func negotiateLocale(acceptLanguage string) string {
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(tags) == 0 {
+		return defaultLocale
+	}
+	_, index, confidence := localeMatcher.Match(tags...)
+	if confidence == language.No {
+		return defaultLocale
+	}
+	return supportedLocales[index]
+}
+
+// translate returns an English string in a locale, formatted with args
+// when there are any
+func translate(locale, text string, args ...any) string {
+	if translated, ok := translations[locale][text]; ok {
+		text = translated
+	}
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// responseLocale is the locale a response is written in
+func responseLocale(w http.ResponseWriter) string {
+	if locale := w.Header().Get("Content-Language"); supportedLocale(locale) {
+		return locale
+	}
+	return defaultLocale
+}
+
+// requestLocale is the locale negotiated for a request
+func requestLocale(r *http.Request) string {
+	return negotiateLocale(r.Header.Get("Accept-Language"))
+}
+
+// LocaleMiddleware answers API requests in the language they ask for;
+// Require switches to the user's own setting once it knows who they are
+func LocaleMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w.Header().Set("Content-Language", requestLocale(r))
+			w.Header().Add("Vary", "Accept-Language")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestNegotiateLocale(t *testing.T) {
+	tests := []struct{ acceptLanguage, want string }{
+		{"", "en"},
+		{"fr-CH, fr;q=0.9, en;q=0.8", "fr"},
+		{"de-AT", "de"},
+		{"es-419,es;q=0.9", "es"},
+		{"ja", "en"},
+		{"en-GB,de;q=0.5", "en"},
+		{"not a language;;", "en"},
+	}
+	for _, tc := range tests {
+		if got := negotiateLocale(tc.acceptLanguage); got != tc.want {
+			t.Errorf("negotiateLocale(%q) = %q, want %q", tc.acceptLanguage, got, tc.want)
+		}
+	}
+}
+
+func TestTranslationsKeepFormatVerbs(t *testing.T) {
+	verbs := regexp.MustCompile(`%[a-z%]`)
+	for locale, catalog := range translations {
+		for english, translated := range catalog {
+			if len(verbs.FindAllString(english, -1)) != len(verbs.FindAllString(translated, -1)) {
+				t.Errorf("%s: %q doesn't take the arguments of %q", locale, translated, english)
+			}
+		}
+	}
+}
+
+func TestErrorMessagesTranslated(t *testing.T) {
+	auth := newTestAuthService()
+	languages := map[string]string{"a@example.com": "de"}
+	auth.OnLanguage(func(email string) string { return languages[email] })
+	policy := NewPolicyEnforcer(auth, nil, &Config{})
+	handler := LocaleMiddleware(policy.Require(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "User not found")
+	}))
+
+	tests := []struct {
+		email       string
+		wantLocale  string
+		wantMessage string
+	}{
+		// The request's Accept-Language
+		{"b@example.com", "fr", "Utilisateur introuvable"},
+		// The user's setting wins over it
+		{"a@example.com", "de", "Benutzer nicht gefunden"},
+	}
+	for _, tc := range tests {
+		token, err := auth.CreateJWT(tc.email)
+		if err != nil {
+			t.Fatalf("CreateJWT: %v", err)
+		}
+		req := httptest.NewRequest("GET", "/api/thing", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept-Language", "fr-FR,fr;q=0.9")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		var body struct{ Message string }
+		json.NewDecoder(rec.Body).Decode(&body)
+		if got := rec.Header().Get("Content-Language"); got != tc.wantLocale {
+			t.Errorf("%s: Content-Language = %q, want %q", tc.email, got, tc.wantLocale)
+		}
+		if body.Message != tc.wantMessage {
+			t.Errorf("%s: message = %q, want %q", tc.email, body.Message, tc.wantMessage)
+		}
+	}
+}
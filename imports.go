@@ -16,4 +16,6 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	_ "github.com/golang-jwt/jwt/v5"
 	_ "github.com/gorilla/websocket"
+	_ "github.com/lib/pq"
+	_ "github.com/klauspost/compress/zstd"
 )
\ No newline at end of file
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+)
+
+// inboundEmailMaxSize caps an inbound parse request, attachments included
+const inboundEmailMaxSize = 25 << 20
+
+// inboundEmailMaxDescription caps the email body kept as a task description
+const inboundEmailMaxDescription = 10000
+
+// InboundEmailService maps per-user inbound addresses to boards and turns
+// emails into tasks
+type InboundEmailService struct {
+	db          *DB
+	dataService *DataService
+	domain      string
+}
+
+func NewInboundEmailService(db *DB, dataService *DataService, domain string) *InboundEmailService {
+	return &InboundEmailService{db: db, dataService: dataService, domain: strings.ToLower(domain)}
+}
+
+// Enabled reports whether an inbound domain is configured
+func (s *InboundEmailService) Enabled() bool {
+	return s.domain != ""
+}
+
+// RotateAddress gives a user a new inbound address, retiring the old one.
+// The local part is random and lowercase, since mail systems may fold case.
+func (s *InboundEmailService) RotateAddress(email string) (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate address: %w", err)
+	}
+	token := hex.EncodeToString(b)
+
+	if err := ensureUser(s.db, email); err != nil {
+		return "", err
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO inbound_email_tokens (email, token, created_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(email) DO UPDATE SET
+			token = excluded.token,
+			created_at = CURRENT_TIMESTAMP
+	`, email, token)
+	if err != nil {
+		return "", fmt.Errorf("failed to store inbound address: %w", err)
+	}
+
+	return token + "@" + s.domain, nil
+}
+
+// EmailForAddress returns the user owning an inbound address, or "" if it
+// isn't one of theirs
+func (s *InboundEmailService) EmailForAddress(address string) (string, error) {
+	address = strings.ToLower(address)
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok || domain != s.domain {
+		return "", nil
+	}
+
+	var email string
+	err := s.db.QueryRow("SELECT email FROM inbound_email_tokens WHERE token = ?", local).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query inbound address: %w", err)
+	}
+	return email, nil
+}
+
+// AddTask creates an unassigned task from an email
+func (s *InboundEmailService) AddTask(ctx context.Context, email, subject, body string) (*KanbanData, error) {
+	task := Task{
+		Title:       strings.TrimSpace(subject),
+		Description: strings.TrimSpace(body),
+	}
+	if task.Title == "" {
+		task.Title = "(no subject)"
+	}
+	if len(task.Description) > inboundEmailMaxDescription {
+		task.Description = strings.ToValidUTF8(task.Description[:inboundEmailMaxDescription], "")
+	}
+
+	return s.dataService.UpdateUserData(ctx, email, func(data *KanbanData) error {
+		return applyOperation(data, &Operation{Type: OpCreateTask, Task: &task})
+	})
+}
+
+// inboundRecipients lists the recipient addresses of an inbound parse
+// request. Mailgun sends "recipient"; SendGrid sends "to" and an "envelope"
+// whose "to" holds the actual recipients.
+func inboundRecipients(r *http.Request) []string {
+	var lists []string
+	lists = append(lists, r.PostFormValue("recipient"), r.PostFormValue("to"))
+
+	var envelope struct {
+		To []string `json:"to"`
+	}
+	if raw := r.PostFormValue("envelope"); raw != "" && json.Unmarshal([]byte(raw), &envelope) == nil {
+		lists = append(lists, envelope.To...)
+	}
+
+	var addresses []string
+	for _, list := range lists {
+		if list == "" {
+			continue
+		}
+		parsed, err := mail.ParseAddressList(list)
+		if err != nil {
+			// Mailgun's recipient may be a bare comma-separated list
+			addresses = append(addresses, splitList(list)...)
+			continue
+		}
+		for _, addr := range parsed {
+			addresses = append(addresses, addr.Address)
+		}
+	}
+	return addresses
+}
+
+// inboundBody returns an inbound email's plain text, preferring Mailgun's
+// reply-stripped text
+func inboundBody(r *http.Request) string {
+	for _, field := range []string{"stripped-text", "body-plain", "text"} {
+		if value := r.PostFormValue(field); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// InboundEmailHandler serves the inbound parse webhook and address management
+type InboundEmailHandler struct {
+	inboundService *InboundEmailService
+	hub            *Hub
+	key            string
+}
+
+func NewInboundEmailHandler(inboundService *InboundEmailService, hub *Hub, key string) *InboundEmailHandler {
+	return &InboundEmailHandler{inboundService: inboundService, hub: hub, key: key}
+}
+
+// CreateAddress issues the user's inbound address, replacing any previous one
+func (h *InboundEmailHandler) CreateAddress(w http.ResponseWriter, r *http.Request) {
+	if !h.inboundService.Enabled() {
+		writeError(w, http.StatusNotFound, "Inbound email is not configured")
+		return
+	}
+
+	address, err := h.inboundService.RotateAddress(requestEmail(r))
+	if err != nil {
+		log.Printf("Error rotating inbound address: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to create address")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"address": address,
+	})
+}
+
+// Receive accepts Mailgun and SendGrid inbound parse posts, authenticated
+// by the INBOUND_EMAIL_KEY in the "key" query parameter. Mail for unknown
+// addresses is acknowledged and dropped so providers don't retry it.
+func (h *InboundEmailHandler) Receive(w http.ResponseWriter, r *http.Request) {
+	if !h.inboundService.Enabled() {
+		writeError(w, http.StatusNotFound, "Inbound email is not configured")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("key")), []byte(h.key)) != 1 {
+		writeError(w, http.StatusUnauthorized, "Invalid key")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, inboundEmailMaxSize)
+	if err := r.ParseMultipartForm(inboundEmailMaxSize); err != nil && err != http.ErrNotMultipart {
+		writeError(w, http.StatusBadRequest, "Invalid form")
+		return
+	}
+
+	subject := r.PostFormValue("subject")
+	body := inboundBody(r)
+
+	created := 0
+	seen := make(map[string]bool)
+	for _, address := range inboundRecipients(r) {
+		email, err := h.inboundService.EmailForAddress(address)
+		if err != nil {
+			log.Printf("Error resolving inbound address: %v", err)
+			writeError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		if email == "" || seen[email] {
+			continue
+		}
+		seen[email] = true
+
+		data, err := h.inboundService.AddTask(r.Context(), email, subject, body)
+		if err != nil {
+			log.Printf("Error adding task from email for %s: %v", email, err)
+			writeServerError(w, err, "Server error")
+			return
+		}
+		h.hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+		created++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"created": created,
+	})
+}
@@ -1,6 +1,18 @@
 // Initialize the app
 import KanbanApp from './app.js';
 
-document.addEventListener('DOMContentLoaded', () => {
+document.addEventListener('DOMContentLoaded', async () => {
+  // Runtime configuration from the server; the app falls back to defaults
+  // if it can't be loaded
+  window.appConfig = {};
+  try {
+    const response = await fetch('/api/config');
+    if (response.ok) {
+      window.appConfig = await response.json();
+    }
+  } catch (error) {
+    console.error('Failed to load server config:', error);
+  }
+
   window.kanbanApp = new KanbanApp();
 });
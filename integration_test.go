@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// postJSON posts body to url and decodes the JSON response into v,
+// failing unless the status is 200
+func postJSON(t *testing.T, client *http.Client, url, token string, body, v any) {
+	t.Helper()
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("encoding request: %v", err)
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST %s: status %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decoding response from %s: %v", url, err)
+	}
+}
+
+// readSync reads WebSocket messages until a sync arrives and returns its
+// board
+func readSync(t *testing.T, conn *websocket.Conn) KanbanData {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var message struct {
+			Type string     `json:"type"`
+			Data KanbanData `json:"data"`
+		}
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("waiting for sync broadcast: %v", err)
+		}
+		if message.Type == "sync" {
+			return message.Data
+		}
+	}
+}
+
+// TestSignInSyncBroadcast signs in with a magic link, opens two WebSocket
+// connections and checks that a sync from one device reaches both. Run it
+// with -race.
+func TestSignInSyncBroadcast(t *testing.T) {
+	app := newTestApp(t)
+	server := httptest.NewServer(app.router)
+	defer server.Close()
+
+	client := server.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	email := "a@example.com"
+
+	// Request a magic link; without SMTP it comes back in the response
+	var login struct {
+		MagicLink string `json:"magicLink"`
+	}
+	postJSON(t, client, server.URL+"/api/auth/login", "", map[string]string{"email": email}, &login)
+	if !strings.HasPrefix(login.MagicLink, server.URL+"/api/auth/magic-link?token=") {
+		t.Fatalf("magic link = %q", login.MagicLink)
+	}
+
+	// Following it redirects to the app with a one-time code
+	resp, err := client.Get(login.MagicLink)
+	if err != nil {
+		t.Fatalf("following magic link: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("magic link status = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("parsing redirect: %v", err)
+	}
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("redirect %q has no code", location)
+	}
+
+	// The code is exchanged for a session token, once
+	var session struct {
+		Token string `json:"token"`
+	}
+	postJSON(t, client, server.URL+"/api/auth/exchange", "", map[string]string{"code": code}, &session)
+	if session.Token == "" {
+		t.Fatal("exchange returned no token")
+	}
+
+	// Two devices connect
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws?token=" + url.QueryEscape(session.Token)
+	var conns []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("dialing WebSocket: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	// Wait for both to be registered before syncing
+	for deadline := time.Now().Add(5 * time.Second); app.hub.Stats().Connections < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("WebSocket connections weren't registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// One device syncs; every connection gets the saved board
+	var synced struct {
+		Data KanbanData `json:"data"`
+	}
+	postJSON(t, client, server.URL+"/api/data/sync", session.Token, testBoard(), &synced)
+	if synced.Data.Version != 1 {
+		t.Errorf("synced version = %d, want 1", synced.Data.Version)
+	}
+	for i, conn := range conns {
+		board := readSync(t, conn)
+		if board.Version != synced.Data.Version || len(board.Tasks) != 1 || board.Tasks[0].ID != "t1" {
+			t.Errorf("connection %d got version %d with %d tasks, want the synced board", i, board.Version, len(board.Tasks))
+		}
+	}
+
+	// A bad token can't connect
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL+"x", nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("dialing with a bad token: err %v, want status %d", err, http.StatusUnauthorized)
+	}
+}
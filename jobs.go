@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Job is a unit of background work run by the JobQueue
+type Job struct {
+	Name string
+	Run  func(ctx context.Context) error
+
+	// Attempts before giving up; failed attempts are retried with exponential backoff
+	MaxAttempts int
+}
+
+type queuedJob struct {
+	job     Job
+	attempt int
+}
+
+// errQueueFull is returned when a job can't be queued without blocking
+var errQueueFull = errors.New("job queue is full")
+
+// errQueueClosed is returned when enqueueing after shutdown
+var errQueueClosed = errors.New("job queue is shut down")
+
+// jobRetryBaseDelay is the delay before the first retry; it doubles per attempt
+const jobRetryBaseDelay = 30 * time.Second
+
+// JobQueue runs jobs on a fixed pool of background workers
+type JobQueue struct {
+	jobs    chan *queuedJob
+	workers int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewJobQueue(workers int, buffer int) *JobQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &JobQueue{
+		jobs:    make(chan *queuedJob, buffer),
+		workers: workers,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Start launches the workers
+func (q *JobQueue) Start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Enqueue schedules a job without blocking
+func (q *JobQueue) Enqueue(job Job) error {
+	if job.MaxAttempts < 1 {
+		job.MaxAttempts = 1
+	}
+	return q.push(&queuedJob{job: job, attempt: 1})
+}
+
+func (q *JobQueue) push(queued *queuedJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errQueueClosed
+	}
+
+	select {
+	case q.jobs <- queued:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+func (q *JobQueue) work() {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case queued, ok := <-q.jobs:
+			if !ok {
+				return
+			}
+			q.run(queued)
+		}
+	}
+}
+
+func (q *JobQueue) run(queued *queuedJob) {
+	err := queued.job.Run(q.ctx)
+	if err == nil {
+		return
+	}
+
+	if queued.attempt >= queued.job.MaxAttempts {
+		log.Printf("Job %s failed after %d attempts: %v", queued.job.Name, queued.attempt, err)
+		return
+	}
+
+	delay := jobRetryBaseDelay << (queued.attempt - 1)
+	log.Printf("Job %s failed (attempt %d), retrying in %s: %v", queued.job.Name, queued.attempt, delay, err)
+
+	retry := &queuedJob{job: queued.job, attempt: queued.attempt + 1}
+	time.AfterFunc(delay, func() {
+		if err := q.push(retry); err != nil {
+			log.Printf("Dropping retry of job %s: %v", queued.job.Name, err)
+		}
+	})
+}
+
+// Shutdown stops accepting jobs, lets workers finish queued jobs and waits
+// for them until ctx expires, after which running jobs are cancelled
+func (q *JobQueue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// languageUndetermined is the BCP 47 code stored when a task's text is too
+// short or ambiguous to tell
+const languageUndetermined = "und"
+
+// languageStopwords holds common function words for the Latin-script
+// languages the detector knows. Text is scored by how many of its words
+// appear in each list.
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "to", "of", "for", "with", "on", "in", "is", "it", "this", "that", "my", "your", "a", "an", "at", "from", "be", "are", "about", "up", "out"},
+	"es": {"el", "la", "los", "las", "de", "del", "y", "que", "en", "un", "una", "para", "con", "por", "es", "mi", "al", "se", "lo", "como", "sobre"},
+	"fr": {"le", "la", "les", "de", "des", "du", "et", "un", "une", "pour", "avec", "dans", "sur", "est", "ce", "mon", "ma", "mes", "au", "aux", "pas", "qui"},
+	"de": {"der", "die", "das", "und", "zu", "den", "dem", "mit", "für", "ist", "ein", "eine", "nicht", "von", "auf", "im", "auch", "sich", "mein", "meine"},
+	"it": {"il", "lo", "la", "gli", "le", "di", "e", "che", "per", "con", "un", "una", "è", "del", "della", "non", "sono", "mio", "nel", "alla"},
+	"pt": {"o", "a", "os", "as", "de", "do", "da", "e", "que", "em", "um", "uma", "para", "com", "não", "no", "na", "meu", "minha", "dos", "das"},
+	"nl": {"de", "het", "een", "en", "van", "op", "te", "voor", "met", "is", "niet", "dat", "die", "naar", "ook", "mijn", "aan", "bij"},
+}
+
+// languageStopwordSets is languageStopwords as lookup sets
+var languageStopwordSets = func() map[string]map[string]bool {
+	sets := make(map[string]map[string]bool, len(languageStopwords))
+	for lang, words := range languageStopwords {
+		set := make(map[string]bool, len(words))
+		for _, word := range words {
+			set[word] = true
+		}
+		sets[lang] = set
+	}
+	return sets
+}()
+
+// scriptLanguages maps scripts used by a single common language (or one
+// language far more than any other) to its code
+var scriptLanguages = []struct {
+	table *unicode.RangeTable
+	lang  string
+}{
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Hangul, "ko"},
+	{unicode.Han, "zh"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Greek, "el"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Thai, "th"},
+	{unicode.Devanagari, "hi"},
+}
+
+// detectLanguage guesses the language of some text, returning a BCP 47 code
+// or languageUndetermined. Non-Latin scripts decide on their own; Latin text
+// needs at least one stopword and a clear winner.
+func detectLanguage(text string) string {
+	// Kana mark Japanese even when mixed with Han, so check scripts in order
+	for _, script := range scriptLanguages {
+		for _, r := range text {
+			if unicode.Is(script.table, r) {
+				return script.lang
+			}
+		}
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	best, bestScore, runnerUp := languageUndetermined, 0, 0
+	for lang, set := range languageStopwordSets {
+		score := 0
+		for _, word := range words {
+			if set[word] {
+				score++
+			}
+		}
+		switch {
+		case score > bestScore:
+			best, bestScore, runnerUp = lang, score, bestScore
+		case score > runnerUp:
+			runnerUp = score
+		}
+	}
+
+	if bestScore == 0 || bestScore == runnerUp {
+		return languageUndetermined
+	}
+	return best
+}
+
+// annotateTaskLanguages sets the language of tasks that have none or whose
+// text changed since the previous version of the board
+func annotateTaskLanguages(previous, data *KanbanData) {
+	old := make(map[string]Task, len(previous.Tasks))
+	for _, task := range previous.Tasks {
+		old[task.ID] = task
+	}
+
+	for i, task := range data.Tasks {
+		prev, existed := old[task.ID]
+		if existed && prev.Title == task.Title && prev.Description == task.Description {
+			// Keep the stored language when a client drops the field, and a
+			// client's own choice when it sets one
+			if task.Language == "" {
+				data.Tasks[i].Language = prev.Language
+			}
+			if data.Tasks[i].Language != "" {
+				continue
+			}
+		} else if !existed && task.Language != "" {
+			// Trust the language of tasks arriving with one, e.g. from imports
+			continue
+		}
+		data.Tasks[i].Language = detectLanguage(task.Title + "\n" + task.Description)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// ldapTimeout bounds dialing and each directory lookup
+const ldapTimeout = 10 * time.Second
+
+// ldapMaxMessage caps the size of a message read from the server
+const ldapMaxMessage = 1 << 20
+
+// BER tags of the LDAP messages used (RFC 4511)
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+
+	ldapBindRequest    = 0x60
+	ldapBindResponse   = 0x61
+	ldapUnbindRequest  = 0x42
+	ldapSearchRequest  = 0x63
+	ldapSearchEntry    = 0x64
+	ldapSearchDone     = 0x65
+	ldapSearchRef      = 0x73
+	ldapSimpleAuth     = 0x80
+	ldapFilterAnd      = 0xa0
+	ldapFilterEquality = 0xa3
+)
+
+// ldapAddress is a parsed LDAP_URL: ldap://host[:port] or ldaps://host[:port]
+// for TLS
+type ldapAddress struct {
+	host string
+	tls  bool
+}
+
+func parseLDAPURL(raw string) (ldapAddress, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return ldapAddress{}, errors.New("must look like ldap://host:389 or ldaps://host:636")
+	}
+
+	addr := ldapAddress{host: u.Host, tls: u.Scheme == "ldaps"}
+	if u.Port() == "" {
+		port := "389"
+		if addr.tls {
+			port = "636"
+		}
+		addr.host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return addr, nil
+}
+
+// ldapConn speaks just enough LDAP for a simple bind and a search
+type ldapConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	messageID int
+}
+
+func dialLDAP(addr ldapAddress) (*ldapConn, error) {
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	var conn net.Conn
+	var err error
+	if addr.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr.host, &tls.Config{ServerName: hostOnly(addr.host)})
+	} else {
+		conn, err = dialer.Dial("tcp", addr.host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ldap: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Close unbinds and closes the connection
+func (c *ldapConn) Close() error {
+	c.messageID++
+	c.conn.Write(ber(berSequence, berInt(berInteger, c.messageID), []byte{ldapUnbindRequest, 0}))
+	return c.conn.Close()
+}
+
+// bind authenticates with a DN and password; an empty DN binds anonymously
+func (c *ldapConn) bind(dn, password string) error {
+	_, err := c.request(ber(ldapBindRequest,
+		berInt(berInteger, 3),
+		ber(berOctetString, []byte(dn)),
+		ber(ldapSimpleAuth, []byte(password)),
+	), func(tag byte, content []byte) (bool, error) {
+		if tag != ldapBindResponse {
+			return false, fmt.Errorf("unexpected ldap response 0x%02x to bind", tag)
+		}
+		return true, ldapResult(content)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to bind to ldap: %w", err)
+	}
+	return nil
+}
+
+// count searches the subtree under baseDN and returns how many entries
+// match filter, without fetching their attributes
+func (c *ldapConn) count(baseDN string, filter []byte) (int, error) {
+	return c.request(ber(ldapSearchRequest,
+		ber(berOctetString, []byte(baseDN)),
+		berInt(berEnumerated, 2), // wholeSubtree
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, 0),
+		berInt(berInteger, int(ldapTimeout/time.Second)),
+		ber(berBoolean, []byte{0}),
+		filter,
+		ber(berSequence, ber(berOctetString, []byte("1.1"))), // no attributes
+	), func(tag byte, content []byte) (bool, error) {
+		switch tag {
+		case ldapSearchEntry, ldapSearchRef:
+			return false, nil
+		case ldapSearchDone:
+			return true, ldapResult(content)
+		}
+		return false, fmt.Errorf("unexpected ldap response 0x%02x to search", tag)
+	})
+}
+
+// request sends an operation and hands each response to handle until it
+// reports the last one. It returns how many search entries came back.
+func (c *ldapConn) request(op []byte, handle func(tag byte, content []byte) (bool, error)) (int, error) {
+	c.messageID++
+	if _, err := c.conn.Write(ber(berSequence, berInt(berInteger, c.messageID), op)); err != nil {
+		return 0, err
+	}
+
+	entries := 0
+	for {
+		tag, message, err := readBER(c.r)
+		if err != nil {
+			return 0, err
+		}
+		if tag != berSequence {
+			return 0, errors.New("malformed ldap message")
+		}
+		tag, id, rest, err := parseBER(message)
+		if err != nil || tag != berInteger {
+			return 0, errors.New("malformed ldap message")
+		}
+		if berValue(id) != c.messageID {
+			// Message ID 0 is an unsolicited notice, such as of disconnection
+			return 0, fmt.Errorf("unexpected ldap message %d", berValue(id))
+		}
+		tag, content, _, err := parseBER(rest)
+		if err != nil {
+			return 0, errors.New("malformed ldap message")
+		}
+		if tag == ldapSearchEntry {
+			entries++
+		}
+		done, err := handle(tag, content)
+		if err != nil || done {
+			return entries, err
+		}
+	}
+}
+
+// ldapResult returns the error an LDAPResult reports, if any
+func ldapResult(content []byte) error {
+	tag, code, rest, err := parseBER(content)
+	if err != nil || tag != berEnumerated {
+		return errors.New("malformed ldap result")
+	}
+	if berValue(code) == 0 {
+		return nil
+	}
+	_, _, rest, _ = parseBER(rest) // matchedDN
+	_, message, _, _ := parseBER(rest)
+	return fmt.Errorf("ldap result %d: %s", berValue(code), message)
+}
+
+// ldapAnd is a filter matching entries every one of filters matches
+func ldapAnd(filters ...[]byte) []byte {
+	return ber(ldapFilterAnd, filters...)
+}
+
+// ldapEquals is a filter matching entries whose attribute has value.
+// Values are sent as they are, so they need no escaping.
+func ldapEquals(attribute, value string) []byte {
+	return ber(ldapFilterEquality, ber(berOctetString, []byte(attribute)), ber(berOctetString, []byte(value)))
+}
+
+// ber encodes one BER element of the given contents
+func ber(tag byte, contents ...[]byte) []byte {
+	var body []byte
+	for _, content := range contents {
+		body = append(body, content...)
+	}
+
+	out := []byte{tag}
+	if n := len(body); n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, body...)
+}
+
+// berInt encodes a non-negative integer or enumerated value
+func berInt(tag byte, v int) []byte {
+	var body []byte
+	for ; v > 0; v >>= 8 {
+		body = append([]byte{byte(v)}, body...)
+	}
+	if len(body) == 0 || body[0]&0x80 != 0 {
+		body = append([]byte{0}, body...)
+	}
+	return ber(tag, body)
+}
+
+// berValue decodes the content of an integer or enumerated element
+func berValue(content []byte) int {
+	v := 0
+	for _, b := range content {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// readBER reads one BER element from r
+func readBER(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 4 {
+			return 0, nil, errors.New("unsupported ber length")
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > ldapMaxMessage {
+		return 0, nil, errors.New("ldap message too large")
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return 0, nil, err
+	}
+	return tag, content, nil
+}
+
+// parseBER splits the first BER element off b, returning its tag, its
+// content and what follows it
+func parseBER(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	tag, length, header := b[0], int(b[1]), 2
+	if b[1]&0x80 != 0 {
+		n := int(b[1] & 0x7f)
+		if n == 0 || n > 4 || len(b) < 2+n {
+			return 0, nil, nil, errors.New("unsupported ber length")
+		}
+		length = 0
+		for _, c := range b[2 : 2+n] {
+			length = length<<8 | int(c)
+		}
+		header += n
+	}
+	if len(b)-header < length {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return tag, b[header : header+length], b[header+length:], nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Load testing:
+//
+//	todo-app loadgen -clients 200 -users 20 -rate 100 -duration 30s
+//
+// serves the sync and WebSocket routes from a local test server backed by a
+// scratch SQLite database, connects simulated WebSocket clients spread over
+// the users' boards, and posts full syncs at a steady rate. It reports how
+// long syncs took to reach each client on the board, and how many messages
+// the hub delivered and dropped. Hub and sync settings (WS_SEND_QUEUE,
+// WS_SLOW_CLIENT_POLICY, SYNC_COALESCE_WINDOW, DB_*) come from the
+// environment as for the server; the per-user connection cap is lifted.
+
+// loadgenTaskID is the task each sync rewrites; its title carries the
+// sync's sequence number, so clients can tell which sync a broadcast is of
+const loadgenTaskID = "loadgen"
+
+// LoadgenOptions shapes a load test
+type LoadgenOptions struct {
+	Clients  int           // WebSocket connections
+	Users    int           // Boards the connections and syncs are spread over
+	Rate     float64       // Syncs per second, across every board
+	Duration time.Duration // How long to send syncs for
+
+	// Connections that take SlowDelay over each message, to exercise the
+	// slow-client policy
+	SlowClients int
+	SlowDelay   time.Duration
+}
+
+// LoadgenReport is the outcome of a load test
+type LoadgenReport struct {
+	Syncs      int // Syncs posted
+	SyncErrors int // Syncs that failed or were refused
+
+	// Sync broadcasts received by clients, and the time from posting each
+	// sync to its broadcast reaching a client. Syncs coalesced into a later
+	// one are only broadcast as part of it.
+	Broadcasts int
+	Latency    []time.Duration // Sorted
+
+	// Clients the server closed with a close frame other than the one sent
+	// at the end, and clients that never received their board's last sync
+	Disconnected int
+	Behind       int
+
+	Hub HubStats
+}
+
+// Percentile returns the broadcast latency at or under which p percent of
+// broadcasts arrived
+func (r *LoadgenReport) Percentile(p float64) time.Duration {
+	if len(r.Latency) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.Latency))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(r.Latency) {
+		i = len(r.Latency) - 1
+	}
+	return r.Latency[i]
+}
+
+// runLoadgen runs "todo-app loadgen" and prints the report
+func runLoadgen(cfg *Config, args []string) error {
+	flags := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	var opts LoadgenOptions
+	flags.IntVar(&opts.Clients, "clients", 100, "WebSocket connections")
+	flags.IntVar(&opts.Users, "users", 10, "boards to spread connections and syncs over")
+	flags.Float64Var(&opts.Rate, "rate", 50, "syncs per second, across every board")
+	flags.DurationVar(&opts.Duration, "duration", 10*time.Second, "how long to send syncs for")
+	flags.IntVar(&opts.SlowClients, "slow-clients", 0, "connections that read slowly")
+	flags.DurationVar(&opts.SlowDelay, "slow-delay", 100*time.Millisecond, "time a slow connection takes per message")
+	verbose := flags.Bool("v", false, "show the server's log")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if opts.Clients < 1 || opts.Users < 1 || opts.Rate <= 0 || opts.Duration <= 0 {
+		return fmt.Errorf("-clients, -users, -rate and -duration must be positive")
+	}
+	if opts.SlowClients > opts.Clients {
+		return fmt.Errorf("-slow-clients can't exceed -clients")
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+	fmt.Printf("Load testing with %d clients on %d boards, %g syncs/s for %s\n", opts.Clients, opts.Users, opts.Rate, opts.Duration)
+
+	report, err := RunLoadgen(context.Background(), cfg, opts)
+	if err != nil {
+		return err
+	}
+
+	elapsed := opts.Duration.Seconds()
+	fmt.Printf("Syncs:       %d posted (%.1f/s), %d failed\n", report.Syncs, float64(report.Syncs)/elapsed, report.SyncErrors)
+	fmt.Printf("Broadcasts:  %d received\n", report.Broadcasts)
+	fmt.Printf("Latency:     p50 %s  p90 %s  p99 %s  max %s\n",
+		report.Percentile(50).Round(time.Microsecond), report.Percentile(90).Round(time.Microsecond),
+		report.Percentile(99).Round(time.Microsecond), report.Percentile(100).Round(time.Microsecond))
+	fmt.Printf("Hub:         %d delivered, %d dropped, %d slow clients closed (queue %d, policy %s)\n",
+		report.Hub.MessagesDelivered, report.Hub.MessagesDropped, report.Hub.SlowClientsClosed, report.Hub.SendQueue, report.Hub.SlowClientPolicy)
+	fmt.Printf("Clients:     %d disconnected, %d behind at the end\n", report.Disconnected, report.Behind)
+	return nil
+}
+
+// loadgenClient is a simulated WebSocket connection
+type loadgenClient struct {
+	conn *websocket.Conn
+	user int
+	slow time.Duration
+
+	// Only touched by the client's reader until done is closed
+	latency    []time.Duration
+	broadcasts int
+	closed     bool // By the server
+
+	// Sequence number of the latest sync received
+	lastSeq atomic.Int64
+
+	done chan struct{}
+}
+
+// RunLoadgen runs a load test against a test server of its own and
+// returns the report
+func RunLoadgen(ctx context.Context, cfg *Config, opts LoadgenOptions) (*LoadgenReport, error) {
+	dir, err := os.MkdirTemp("", "todo-loadgen")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A scratch database with the server's settings
+	scratch := *cfg
+	scratch.DatabaseURL = filepath.Join(dir, "loadgen.db")
+	db, err := initDB(&scratch)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrator.Up(); err != nil {
+		return nil, err
+	}
+
+	codec, err := NewBoardCodec(cfg.StorageCompression, nil)
+	if err != nil {
+		return nil, err
+	}
+	dataService := NewDataService(db, codec)
+	dataService.cache.Limit(cfg.BoardCacheSize, cfg.BoardCacheTTL)
+	authService := NewAuthService(&scratch)
+
+	hub := NewHub()
+	hub.LimitQueues(cfg.WSSendQueue, cfg.WSSlowClientPolicy)
+	dataService.CoalesceWrites(cfg.SyncCoalesceWindow, func(email string, data *KanbanData) {
+		hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+	})
+	go hub.Run()
+
+	dataHandler := NewDataHandler(dataService, authService, NewCommentService(db, dataService), hub, &scratch)
+	policy := NewPolicyEnforcer(authService, NewAPIKeyService(db, authService), &scratch)
+	r := mux.NewRouter()
+	r.Handle("/api/data/sync", policy.Require(dataHandler.SyncData, policy.HasBoardRole(BoardRoleEditor, queryBoard))).Methods("POST")
+	r.HandleFunc("/api/ws", dataHandler.HandleWebSocket)
+	// Small socket send buffers, as over a real network, so slow clients'
+	// backlogs reach the hub's queues rather than sitting in the kernel
+	server := httptest.NewUnstartedServer(r)
+	server.Listener = smallBufferListener{server.Listener}
+	server.Start()
+	defer server.Close()
+
+	// Each user starts with a column and the task syncs rewrite
+	tokens := make([]string, opts.Users)
+	for i := range tokens {
+		email := fmt.Sprintf("loadgen-%d@example.com", i)
+		if err := dataService.SaveUserData(ctx, email, loadgenBoard(0)); err != nil {
+			return nil, err
+		}
+		if tokens[i], err = authService.CreateJWT(email); err != nil {
+			return nil, err
+		}
+	}
+
+	// Sequence numbers of syncs by when they were posted, and the last
+	// posted to each board
+	var sentMu sync.Mutex
+	sent := make(map[int64]time.Time)
+	lastSent := make([]int64, opts.Users)
+
+	var stopping atomic.Bool
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws?token="
+	clients := make([]*loadgenClient, opts.Clients)
+	for i := range clients {
+		c := &loadgenClient{user: i % opts.Users, done: make(chan struct{})}
+		dialer := websocket.DefaultDialer
+		if i < opts.SlowClients {
+			c.slow = opts.SlowDelay
+			dialer = &slowDialer
+		}
+		c.conn, _, err = dialer.DialContext(ctx, wsURL+url.QueryEscape(tokens[c.user]), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect client %d: %w", i, err)
+		}
+		defer c.conn.Close()
+		clients[i] = c
+
+		go func() {
+			defer close(c.done)
+			for {
+				var message struct {
+					Type string `json:"type"`
+					Data struct {
+						Tasks []Task `json:"tasks"`
+					} `json:"data"`
+				}
+				if err := c.conn.ReadJSON(&message); err != nil {
+					// The hub says goodbye with 1001 when it shuts down
+					var closeErr *websocket.CloseError
+					if errors.As(err, &closeErr) {
+						c.closed = closeErr.Code != websocket.CloseGoingAway
+					} else {
+						c.closed = !stopping.Load()
+					}
+					return
+				}
+				received := time.Now()
+				if message.Type == "sync" {
+					c.broadcasts++
+					for _, task := range message.Data.Tasks {
+						seq, err := strconv.ParseInt(task.Title, 10, 64)
+						if task.ID != loadgenTaskID || err != nil || seq <= c.lastSeq.Load() {
+							continue
+						}
+						c.lastSeq.Store(seq)
+						sentMu.Lock()
+						at, ok := sent[seq]
+						sentMu.Unlock()
+						if ok {
+							c.latency = append(c.latency, received.Sub(at))
+						}
+					}
+				}
+				if c.slow > 0 {
+					time.Sleep(c.slow)
+				}
+			}
+		}()
+	}
+	for deadline := time.Now().Add(10 * time.Second); hub.Stats().Connections < opts.Clients; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("clients didn't all connect")
+		}
+	}
+
+	// Syncs are posted on schedule whether or not earlier ones have
+	// finished, so a slow server shows up as latency rather than a lower
+	// rate
+	report := &LoadgenReport{}
+	var syncErrors atomic.Int64
+	var inFlight sync.WaitGroup
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+	end := time.After(opts.Duration)
+	var seq int64
+send:
+	for {
+		select {
+		case <-ticker.C:
+		case <-end:
+			break send
+		case <-ctx.Done():
+			break send
+		}
+		seq++
+		user := int(seq % int64(opts.Users))
+		body, err := json.Marshal(loadgenBoard(seq))
+		if err != nil {
+			return nil, err
+		}
+
+		sentMu.Lock()
+		sent[seq] = time.Now()
+		lastSent[user] = seq
+		sentMu.Unlock()
+
+		inFlight.Add(1)
+		go func(token string) {
+			defer inFlight.Done()
+			req, err := http.NewRequest("POST", server.URL+"/api/data/sync", bytes.NewReader(body))
+			if err != nil {
+				syncErrors.Add(1)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := httpClient.Do(req)
+			if err != nil {
+				syncErrors.Add(1)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				syncErrors.Add(1)
+			}
+		}(tokens[user])
+	}
+	ticker.Stop()
+	inFlight.Wait()
+	report.Syncs = int(seq)
+	report.SyncErrors = int(syncErrors.Load())
+
+	// Give the last broadcasts a few seconds to arrive, then hang up
+	caughtUp := func() bool {
+		for _, c := range clients {
+			if c.lastSeq.Load() != lastSent[c.user] {
+				return false
+			}
+		}
+		return true
+	}
+	for deadline := time.Now().Add(5 * time.Second); !caughtUp() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	report.Hub = hub.Stats()
+	stopping.Store(true)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hub.Shutdown(shutdownCtx)
+
+	for _, c := range clients {
+		c.conn.Close()
+		<-c.done
+		report.Broadcasts += c.broadcasts
+		report.Latency = append(report.Latency, c.latency...)
+		if c.closed {
+			report.Disconnected++
+		}
+		if c.lastSeq.Load() != lastSent[c.user] {
+			report.Behind++
+		}
+	}
+	sort.Slice(report.Latency, func(i, j int) bool { return report.Latency[i] < report.Latency[j] })
+	return report, nil
+}
+
+// smallBufferListener accepts connections with a small send buffer
+type smallBufferListener struct {
+	net.Listener
+}
+
+func (l smallBufferListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetWriteBuffer(16 << 10)
+	}
+	return conn, err
+}
+
+// slowDialer connects slow clients with a small socket receive buffer, so
+// the kernel doesn't absorb the backlog and it builds up in the hub
+var slowDialer = websocket.Dialer{
+	NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetReadBuffer(4096)
+		}
+		return conn, nil
+	},
+	HandshakeTimeout: 10 * time.Second,
+}
+
+// loadgenBoard is the board a load test sync posts, its task titled with
+// the sync's sequence number
+func loadgenBoard(seq int64) *KanbanData {
+	column := "todo"
+	return &KanbanData{
+		Columns: []Column{{ID: column, Title: "To Do"}},
+		Tasks:   []Task{{ID: loadgenTaskID, Title: strconv.FormatInt(seq, 10), ColumnID: &column}},
+	}
+}
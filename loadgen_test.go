@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunLoadgen(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	report, err := RunLoadgen(context.Background(), cfg, LoadgenOptions{
+		Clients:  6,
+		Users:    3,
+		Rate:     100,
+		Duration: 300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("RunLoadgen: %v", err)
+	}
+	if report.Syncs == 0 || report.SyncErrors > 0 {
+		t.Errorf("%d syncs posted, %d failed; want some, none failed", report.Syncs, report.SyncErrors)
+	}
+	if report.Broadcasts == 0 || len(report.Latency) == 0 {
+		t.Errorf("%d broadcasts with %d latencies, want some", report.Broadcasts, len(report.Latency))
+	}
+	if report.Behind > 0 || report.Disconnected > 0 || report.Hub.MessagesDropped > 0 {
+		t.Errorf("report = %+v, want every client caught up", report)
+	}
+	if p50, max := report.Percentile(50), report.Percentile(100); p50 <= 0 || p50 > max {
+		t.Errorf("p50 %s, max %s", p50, max)
+	}
+}
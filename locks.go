@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Soft edit locks:
+//
+//	POST   /api/locks              {"kind": "task", "id": "<task id>", "ttl": 30}
+//	DELETE /api/locks/{kind}/{id}    (/api/locks/board for the board lock)
+//	GET    /api/locks
+//
+// A client claims a short-lived lock on a task, a column or the whole
+// board ("kind": "board", no ID) while someone edits it. Clients are told
+// apart by their X-Client-ID header, which claiming requires. Claiming a
+// lock the client already holds renews it. The board's WebSocket
+// subscribers get
+//
+//	{"type": "lock", "data": {"kind", "id", "user", "client", "expiresAt"}}
+//	{"type": "unlock", "data": {...}}
+//
+// when a lock is claimed or renewed, and when it's released or expires.
+// While a lock is held, other clients' writes may not change what it
+// covers: a task lock the task, a column lock the column and which tasks
+// are in it, and a board lock anything. Operations and REST edits that
+// would are refused with a LockError. Full syncs carry work done offline,
+// so they save everything else and keep the server's copy of locked items.
+// Locks live in memory, on the instance that granted them.
+
+const (
+	// Lock lifetimes, in seconds
+	defaultLockTTL = 30
+	maxLockTTL     = 300
+
+	// Longest client ID taken from X-Client-ID
+	maxClientIDLength = 64
+)
+
+// Kinds of edit lock
+const (
+	LockTask   = "task"
+	LockColumn = "column"
+	LockBoard  = "board"
+)
+
+// EditLock is a client's claim on part of a board
+type EditLock struct {
+	Kind      string    `json:"kind"`
+	ID        string    `json:"id,omitempty"`
+	User      string    `json:"user"`
+	Client    string    `json:"client"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// LockError reports a write to something another client holds a lock on
+type LockError struct {
+	Lock EditLock `json:"lock"`
+}
+
+func (e *LockError) Error() string {
+	if e.Lock.Kind == LockBoard {
+		return "board is locked by another client"
+	}
+	return fmt.Sprintf("%s %s is locked by another client", e.Lock.Kind, e.Lock.ID)
+}
+
+// writeLockError responds to a write refused by an edit lock
+func writeLockError(w http.ResponseWriter, e *LockError) {
+	writeErrorBody(w, http.StatusConflict, "locked", "Someone else is editing this", map[string]any{
+		"lock": e.Lock,
+	})
+}
+
+// heldLock is a granted lock and the timer that expires it
+type heldLock struct {
+	lock  EditLock
+	timer *time.Timer
+}
+
+// LockService grants edit locks and checks board writes against them
+type LockService struct {
+	hub *Hub
+
+	mu sync.Mutex
+	// Locks by board, then by kind and ID
+	boards map[string]map[string]*heldLock
+}
+
+func NewLockService(hub *Hub) *LockService {
+	return &LockService{hub: hub, boards: make(map[string]map[string]*heldLock)}
+}
+
+func lockKey(kind, id string) string {
+	return kind + ":" + id
+}
+
+// headerClientID returns a request's X-Client-ID, trimmed and cut to
+// maxClientIDLength
+func headerClientID(r *http.Request) string {
+	id := strings.TrimSpace(r.Header.Get("X-Client-ID"))
+	if len(id) > maxClientIDLength {
+		id = id[:maxClientIDLength]
+	}
+	return id
+}
+
+// withClientID names the client a board write comes from
+func withClientID(ctx context.Context, client string) context.Context {
+	if client == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, clientIDContextKey, client)
+}
+
+// contextClientID returns the client a board write comes from, or "" when
+// it didn't say
+func contextClientID(ctx context.Context) string {
+	client, _ := ctx.Value(clientIDContextKey).(string)
+	return client
+}
+
+// Claim grants a client a lock, or renews the one it holds. When another
+// client holds it, Claim fails with a LockError.
+func (s *LockService) Claim(board, kind, id, user, client string, ttl time.Duration) (EditLock, error) {
+	key := lockKey(kind, id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := s.boards[board][key]
+	if held != nil && held.lock.Client != client {
+		return EditLock{}, &LockError{Lock: held.lock}
+	}
+
+	lock := EditLock{Kind: kind, ID: id, User: user, Client: client, ExpiresAt: time.Now().Add(ttl).UTC()}
+	if held != nil {
+		held.timer.Stop()
+	}
+	held = &heldLock{lock: lock}
+	held.timer = time.AfterFunc(ttl, func() { s.expire(board, key, held) })
+	if s.boards[board] == nil {
+		s.boards[board] = make(map[string]*heldLock)
+	}
+	s.boards[board][key] = held
+
+	s.publish(board, "lock", lock)
+	return lock, nil
+}
+
+// Release gives up a client's lock. It reports whether the client held it.
+func (s *LockService) Release(board, kind, id, client string) bool {
+	key := lockKey(kind, id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := s.boards[board][key]
+	if held == nil || held.lock.Client != client {
+		return false
+	}
+	held.timer.Stop()
+	s.remove(board, key)
+	s.publish(board, "unlock", held.lock)
+	return true
+}
+
+// expire drops a lock when its time is up, unless it was renewed or
+// released meanwhile
+func (s *LockService) expire(board, key string, held *heldLock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.boards[board][key] != held {
+		return
+	}
+	s.remove(board, key)
+	s.publish(board, "unlock", held.lock)
+}
+
+// remove drops a lock. s.mu must be held.
+func (s *LockService) remove(board, key string) {
+	delete(s.boards[board], key)
+	if len(s.boards[board]) == 0 {
+		delete(s.boards, board)
+	}
+}
+
+// publish tells the board's subscribers about a lock. s.mu must be held,
+// so events go out in the order locks change.
+func (s *LockService) publish(board, messageType string, lock EditLock) {
+	if s.hub != nil {
+		s.hub.PublishBoard(board, WebSocketMessage{Type: messageType, User: lock.User, Data: lock}, nil)
+	}
+}
+
+// Locks returns the locks held on a board
+func (s *LockService) Locks(board string) []EditLock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	locks := []EditLock{}
+	for _, held := range s.boards[board] {
+		locks = append(locks, held.lock)
+	}
+	return locks
+}
+
+// othersLocks returns the locks on a board held by clients other than the
+// given one. It's nil-safe, for services without locks.
+func (s *LockService) othersLocks(board, client string) []EditLock {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var locks []EditLock
+	for _, held := range s.boards[board] {
+		if held.lock.Client != client {
+			locks = append(locks, held.lock)
+		}
+	}
+	return locks
+}
+
+// Check returns a LockError if the write that turned before into after, by
+// the client named in ctx, changed something another client has locked
+func (s *LockService) Check(ctx context.Context, board string, before, after *KanbanData) error {
+	for _, lock := range s.othersLocks(board, contextClientID(ctx)) {
+		if lockConflict(lock, before, after) {
+			return &LockError{Lock: lock}
+		}
+	}
+	return nil
+}
+
+// Keep undoes the changes a write by the client named in ctx made to
+// things other clients have locked, putting back their copies from before.
+// It returns the locks whose items it kept.
+func (s *LockService) Keep(ctx context.Context, board string, before, after *KanbanData) []EditLock {
+	var kept []EditLock
+	for _, lock := range s.othersLocks(board, contextClientID(ctx)) {
+		if !lockConflict(lock, before, after) {
+			continue
+		}
+		kept = append(kept, lock)
+		switch lock.Kind {
+		case LockBoard:
+			*after = *cloneKanbanData(before)
+		case LockColumn:
+			restoreColumn(before, after, lock.ID)
+			for _, id := range changedMembers(before, after, lock.ID) {
+				restoreTask(before, after, id)
+			}
+		case LockTask:
+			restoreTask(before, after, lock.ID)
+		}
+	}
+	return kept
+}
+
+// lockConflict reports whether turning before into after changed what a
+// lock covers
+func lockConflict(lock EditLock, before, after *KanbanData) bool {
+	switch lock.Kind {
+	case LockBoard:
+		a, b := *before, *after
+		a.Version, b.Version = 0, 0
+		return !sameJSON(a, b)
+	case LockColumn:
+		i, j := columnIndex(before, lock.ID), columnIndex(after, lock.ID)
+		if (i < 0) != (j < 0) || (i >= 0 && before.Columns[i] != after.Columns[j]) {
+			return true
+		}
+		return len(changedMembers(before, after, lock.ID)) > 0
+	case LockTask:
+		a, aok := findLockedTask(before, lock.ID)
+		b, bok := findLockedTask(after, lock.ID)
+		return aok != bok || !sameJSON(a, b)
+	}
+	return false
+}
+
+// locksCover reports whether any of the locks covers an item, given two
+// copies of it: for a task in a locked column, either copy being in it is
+// enough
+func locksCover(locks []EditLock, key boardItemKey, copies ...any) bool {
+	for _, lock := range locks {
+		switch {
+		case lock.Kind == LockBoard:
+			return true
+		case lock.Kind == LockTask && key.kind == changeTask && key.id == lock.ID:
+			return true
+		case lock.Kind == LockColumn && key.kind == changeColumn && key.id == lock.ID:
+			return true
+		case lock.Kind == LockColumn && key.kind == changeTask:
+			for _, item := range copies {
+				if task := item.(Task); task.ColumnID != nil && *task.ColumnID == lock.ID {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// sameJSON reports whether a and b encode the same
+func sameJSON(a, b any) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	return err == nil && string(x) == string(y)
+}
+
+// columnIndex returns the index of a column, deleted or not, or -1
+func columnIndex(data *KanbanData, id string) int {
+	for i, column := range data.Columns {
+		if column.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// findLockedTask finds a task in a board's tasks or legacy unassigned tasks
+func findLockedTask(data *KanbanData, id string) (Task, bool) {
+	for _, tasks := range [][]Task{data.Tasks, data.UnassignedTasks} {
+		for _, task := range tasks {
+			if task.ID == id {
+				return task, true
+			}
+		}
+	}
+	return Task{}, false
+}
+
+// columnMembers returns the IDs of the tasks in a column
+func columnMembers(data *KanbanData, column string) map[string]bool {
+	members := make(map[string]bool)
+	for _, task := range data.Tasks {
+		if task.ColumnID != nil && *task.ColumnID == column {
+			members[task.ID] = true
+		}
+	}
+	return members
+}
+
+// changedMembers returns the tasks that moved into or out of a column
+func changedMembers(before, after *KanbanData, column string) []string {
+	was, is := columnMembers(before, column), columnMembers(after, column)
+	var changed []string
+	for id := range was {
+		if !is[id] {
+			changed = append(changed, id)
+		}
+	}
+	for id := range is {
+		if !was[id] {
+			changed = append(changed, id)
+		}
+	}
+	return changed
+}
+
+// restoreColumn puts a column in after back the way it is in before
+func restoreColumn(before, after *KanbanData, id string) {
+	i, j := columnIndex(before, id), columnIndex(after, id)
+	switch {
+	case i >= 0 && j >= 0:
+		after.Columns[j] = before.Columns[i]
+	case i >= 0:
+		after.Columns = append(after.Columns, before.Columns[i])
+	case j >= 0:
+		after.Columns = append(after.Columns[:j], after.Columns[j+1:]...)
+	}
+}
+
+// restoreTask puts a task in after back the way it is in before, keeping
+// its place in the list
+func restoreTask(before, after *KanbanData, id string) {
+	original, existed := findLockedTask(before, id)
+	after.UnassignedTasks = removeTask(after.UnassignedTasks, id)
+	for i, task := range after.Tasks {
+		if task.ID != id {
+			continue
+		}
+		if existed {
+			after.Tasks[i] = original
+		} else {
+			after.Tasks = append(after.Tasks[:i], after.Tasks[i+1:]...)
+		}
+		return
+	}
+	if existed {
+		after.Tasks = append(after.Tasks, original)
+	}
+}
+
+func removeTask(tasks []Task, id string) []Task {
+	for i, task := range tasks {
+		if task.ID == id {
+			return append(tasks[:i], tasks[i+1:]...)
+		}
+	}
+	return tasks
+}
+
+// lockChecked wraps a board write so that it fails with a LockError when it
+// changes something another client has locked
+func (s *DataService) lockChecked(ctx context.Context, email string, fn func(tx *Tx, data *KanbanData) error) func(tx *Tx, data *KanbanData) error {
+	if s.locks == nil {
+		return fn
+	}
+	return func(tx *Tx, data *KanbanData) error {
+		if len(s.locks.othersLocks(email, contextClientID(ctx))) == 0 {
+			return fn(tx, data)
+		}
+		before := cloneKanbanData(data)
+		if err := fn(tx, data); err != nil {
+			return err
+		}
+		return s.locks.Check(ctx, email, before, data)
+	}
+}
+
+// UseLocks checks board writes against edit locks. It must be called
+// before the service is used.
+func (s *DataService) UseLocks(locks *LockService) {
+	s.locks = locks
+}
+
+// LockHandler serves the edit lock API on the user's own board
+type LockHandler struct {
+	locks *LockService
+}
+
+func NewLockHandler(locks *LockService) *LockHandler {
+	return &LockHandler{locks: locks}
+}
+
+// ClaimLockRequest is the body of POST /api/locks
+type ClaimLockRequest struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+	// Seconds the lock lasts unless renewed; defaultLockTTL when 0
+	TTL int `json:"ttl"`
+}
+
+// Claim claims or renews a lock for the requesting client
+func (h *LockHandler) Claim(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+	client := headerClientID(r)
+	if client == "" {
+		writeError(w, http.StatusBadRequest, "X-Client-ID is required")
+		return
+	}
+
+	var req ClaimLockRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var fieldErrors []FieldError
+	switch req.Kind {
+	case LockTask, LockColumn:
+		if req.ID == "" || len(req.ID) > 128 {
+			fieldErrors = append(fieldErrors, FieldError{Field: "id", Message: "is required"})
+		}
+	case LockBoard:
+		req.ID = ""
+	default:
+		fieldErrors = append(fieldErrors, FieldError{Field: "kind", Message: "must be task, column or board"})
+	}
+	if req.TTL == 0 {
+		req.TTL = defaultLockTTL
+	}
+	if req.TTL < 1 || req.TTL > maxLockTTL {
+		fieldErrors = append(fieldErrors, FieldError{Field: "ttl", Message: fmt.Sprintf("must be between 1 and %d seconds", maxLockTTL)})
+	}
+	if len(fieldErrors) > 0 {
+		writeFieldErrors(w, fieldErrors...)
+		return
+	}
+
+	lock, err := h.locks.Claim(canonicalBoardID(email, ""), req.Kind, req.ID, email, client, time.Duration(req.TTL)*time.Second)
+	var lockErr *LockError
+	if errors.As(err, &lockErr) {
+		writeLockError(w, lockErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"lock":   lock,
+	})
+}
+
+// Release gives up the requesting client's lock
+func (h *LockHandler) Release(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	if vars["kind"] == LockBoard {
+		id = ""
+	}
+	if !h.locks.Release(canonicalBoardID(requestEmail(r), ""), vars["kind"], id, headerClientID(r)) {
+		writeError(w, http.StatusNotFound, "Lock not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// List returns the locks held on the user's board
+func (h *LockHandler) List(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"locks":  h.locks.Locks(canonicalBoardID(requestEmail(r), "")),
+	})
+}
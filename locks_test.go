@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestLockConflict(t *testing.T) {
+	before := testBoard()
+	before.Tasks = append(before.Tasks, Task{ID: "t2", Title: "Ship it", ColumnID: strPtr("done")})
+
+	tests := []struct {
+		name   string
+		lock   EditLock
+		change func(data *KanbanData)
+		want   bool
+	}{
+		{"task edited", EditLock{Kind: LockTask, ID: "t1"}, func(d *KanbanData) { d.Tasks[0].Title = "x" }, true},
+		{"task removed", EditLock{Kind: LockTask, ID: "t1"}, func(d *KanbanData) { d.Tasks = d.Tasks[1:] }, true},
+		{"other task edited", EditLock{Kind: LockTask, ID: "t1"}, func(d *KanbanData) { d.Tasks[1].Title = "x" }, false},
+		{"column renamed", EditLock{Kind: LockColumn, ID: "todo"}, func(d *KanbanData) { d.Columns[0].Title = "x" }, true},
+		{"task moved into column", EditLock{Kind: LockColumn, ID: "todo"}, func(d *KanbanData) { d.Tasks[1].ColumnID = strPtr("todo") }, true},
+		{"task in column edited", EditLock{Kind: LockColumn, ID: "todo"}, func(d *KanbanData) { d.Tasks[0].Title = "x" }, false},
+		{"board changed", EditLock{Kind: LockBoard}, func(d *KanbanData) { d.Tasks[1].Title = "x" }, true},
+		{"board saved unchanged", EditLock{Kind: LockBoard}, func(d *KanbanData) { d.Version++ }, false},
+	}
+	for _, tc := range tests {
+		after := cloneKanbanData(before)
+		tc.change(after)
+		if got := lockConflict(tc.lock, before, after); got != tc.want {
+			t.Errorf("%s: conflict = %v, want %v", tc.name, got, tc.want)
+		}
+
+		// Keeping another client's locked items leaves nothing in conflict
+		tc.lock.Client = "phone"
+		locks := NewLockService(nil)
+		locks.boards["a@example.com"] = map[string]*heldLock{lockKey(tc.lock.Kind, tc.lock.ID): {lock: tc.lock}}
+		locks.Keep(context.Background(), "a@example.com", before, after)
+		if lockConflict(tc.lock, before, after) {
+			t.Errorf("%s: still in conflict after Keep", tc.name)
+		}
+	}
+}
+
+func TestLocksRefuseOtherClients(t *testing.T) {
+	app := newTestApp(t)
+	email := "a@example.com"
+	ctx := context.Background()
+	if err := app.dataService.SaveUserData(ctx, email, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+	viewer := connectFakeClient(app.hub, email)
+
+	claim := map[string]any{"kind": "task", "id": "t1"}
+	expectStatus(t, app.doClient(t, "POST", "/api/locks", email, "phone", claim), http.StatusOK)
+	if message := receive(t, viewer, "lock"); message.User != email {
+		t.Errorf("lock event = %+v, want one from %s", message, email)
+	}
+	rec := app.doClient(t, "POST", "/api/locks", email, "laptop", claim)
+	expectStatus(t, rec, http.StatusConflict)
+	var refused errorResponse
+	decodeBody(t, rec, &refused)
+	if refused.Code != "locked" {
+		t.Errorf("code = %q, want locked", refused.Code)
+	}
+
+	rename := func(data *KanbanData) error {
+		data.Tasks[0].Title = "Renamed"
+		return nil
+	}
+	var lockErr *LockError
+	if _, err := app.dataService.UpdateUserData(withClientID(ctx, "laptop"), email, rename); !errors.As(err, &lockErr) {
+		t.Fatalf("edit from another client: %v, want a LockError", err)
+	}
+
+	// A full sync saves the rest and keeps the locked task as it was
+	board := testBoard()
+	board.Tasks[0].Title = "Renamed"
+	board.Tasks = append(board.Tasks, Task{ID: "t2", Title: "New", ColumnID: strPtr("todo")})
+	rec = app.doClient(t, "POST", "/api/data/sync", email, "laptop", board)
+	expectStatus(t, rec, http.StatusOK)
+	var synced struct {
+		Data      KanbanData      `json:"data"`
+		Locked    []EditLock      `json:"locked"`
+		Conflicts []MergeConflict `json:"conflicts"`
+	}
+	decodeBody(t, rec, &synced)
+	if len(synced.Data.Tasks) != 2 || synced.Data.Tasks[0].Title != "Write tests" || len(synced.Locked) != 1 {
+		t.Errorf("synced = %+v, want t2 added and t1 kept", synced)
+	}
+	if len(synced.Conflicts) != 1 || synced.Conflicts[0].Field != "title" || synced.Conflicts[0].Resolution != "locked" {
+		t.Errorf("conflicts = %+v, want t1's title kept for the lock", synced.Conflicts)
+	}
+
+	// The holder may edit it, and once it's released so may others
+	if _, err := app.dataService.UpdateUserData(withClientID(ctx, "phone"), email, rename); err != nil {
+		t.Fatalf("edit from the lock holder: %v", err)
+	}
+	expectStatus(t, app.doClient(t, "DELETE", "/api/locks/task/t1", email, "laptop", nil), http.StatusNotFound)
+	expectStatus(t, app.doClient(t, "DELETE", "/api/locks/task/t1", email, "phone", nil), http.StatusNoContent)
+	receive(t, viewer, "unlock")
+	if _, err := app.dataService.UpdateUserData(withClientID(ctx, "laptop"), email, rename); err != nil {
+		t.Errorf("edit after the lock was released: %v", err)
+	}
+}
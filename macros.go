@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxMacroOperations caps the number of steps in a macro
+const maxMacroOperations = 100
+
+// Macro is a named sequence of operations a user can run in one step.
+// String fields in the operations may be "$name" placeholders filled from
+// the params supplied when the macro is run.
+type Macro struct {
+	ID         string          `json:"id"`
+	Name       string          `json:"name"`
+	Operations json.RawMessage `json:"operations"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	UpdatedAt  time.Time       `json:"updatedAt"`
+}
+
+// errMacroNotFound is returned when a macro doesn't exist
+var errMacroNotFound = errors.New("macro not found")
+
+// MacroService stores macros and runs them against users' boards
+type MacroService struct {
+	db          *DB
+	dataService *DataService
+}
+
+func NewMacroService(db *DB, dataService *DataService) *MacroService {
+	return &MacroService{db: db, dataService: dataService}
+}
+
+// validateMacroOperations checks a macro's operations decode and aren't too many
+func validateMacroOperations(raw json.RawMessage) error {
+	var ops []Operation
+	if err := json.Unmarshal(raw, &ops); err != nil {
+		return errors.New("operations must be an array of operations")
+	}
+	if len(ops) == 0 || len(ops) > maxMacroOperations {
+		return fmt.Errorf("macros must have between 1 and %d operations", maxMacroOperations)
+	}
+	return nil
+}
+
+// List returns a user's macros
+func (s *MacroService) List(email string) ([]Macro, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, operations, created_at, updated_at
+		FROM macros WHERE email = ? ORDER BY name
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query macros: %w", err)
+	}
+	defer rows.Close()
+
+	macros := []Macro{}
+	for rows.Next() {
+		var m Macro
+		var operations string
+		if err := rows.Scan(&m.ID, &m.Name, &operations, &m.CreatedAt, &m.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan macro: %w", err)
+		}
+		m.Operations = json.RawMessage(operations)
+		macros = append(macros, m)
+	}
+	return macros, rows.Err()
+}
+
+// Get returns a macro by ID
+func (s *MacroService) Get(id string) (*Macro, error) {
+	row := s.db.QueryRow(`
+		SELECT id, name, operations, created_at, updated_at
+		FROM macros WHERE id = ?
+	`, id)
+
+	var m Macro
+	var operations string
+	err := row.Scan(&m.ID, &m.Name, &operations, &m.CreatedAt, &m.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errMacroNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query macro: %w", err)
+	}
+	m.Operations = json.RawMessage(operations)
+	return &m, nil
+}
+
+// Owner returns the email that owns a macro
+func (s *MacroService) Owner(id string) (string, error) {
+	var email string
+	err := s.db.QueryRow("SELECT email FROM macros WHERE id = ?", id).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", errMacroNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query macro: %w", err)
+	}
+	return email, nil
+}
+
+// Create stores a new macro
+func (s *MacroService) Create(email, name string, operations json.RawMessage) (*Macro, error) {
+	if err := ensureUser(s.db, email); err != nil {
+		return nil, err
+	}
+
+	id := generateID()
+	_, err := s.db.Exec(`
+		INSERT INTO macros (id, email, name, operations, created_at, updated_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+	`, id, email, name, string(operations))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create macro: %w", err)
+	}
+
+	return s.Get(id)
+}
+
+// Update replaces a macro's name and operations
+func (s *MacroService) Update(id, name string, operations json.RawMessage) (*Macro, error) {
+	_, err := s.db.Exec(`
+		UPDATE macros SET name = ?, operations = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, name, string(operations), id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update macro: %w", err)
+	}
+
+	return s.Get(id)
+}
+
+// Delete removes a macro
+func (s *MacroService) Delete(id string) error {
+	if _, err := s.db.Exec("DELETE FROM macros WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete macro: %w", err)
+	}
+	return nil
+}
+
+// bindMacroParams substitutes "$name" string values in the operations JSON
+// with the matching params
+func bindMacroParams(raw json.RawMessage, params map[string]string) (json.RawMessage, error) {
+	bound := []byte(raw)
+	for name, value := range params {
+		placeholder, _ := json.Marshal("$" + name)
+		replacement, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		bound = bytes.ReplaceAll(bound, placeholder, replacement)
+	}
+	return bound, nil
+}
+
+// Run applies a macro's operations to the user's board atomically: either
+// every operation succeeds and the board is saved, or nothing changes
+func (s *MacroService) Run(ctx context.Context, email string, macro *Macro, params map[string]string) (*KanbanData, []Operation, error) {
+	bound, err := bindMacroParams(macro.Operations, params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ops []Operation
+	if err := json.Unmarshal(bound, &ops); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode macro operations: %w", err)
+	}
+
+	data, err := s.dataService.UpdateUserData(ctx, email, func(data *KanbanData) error {
+		return applyOperations(data, ops)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, ops, nil
+}
+
+// MacroHandler exposes macros over HTTP
+type MacroHandler struct {
+	macroService *MacroService
+	hub          *Hub
+}
+
+func NewMacroHandler(macroService *MacroService, hub *Hub) *MacroHandler {
+	return &MacroHandler{macroService: macroService, hub: hub}
+}
+
+// macroOwner resolves the owner of the macro in the route, for OwnsResource
+func (h *MacroHandler) macroOwner(r *http.Request) (string, error) {
+	return h.macroService.Owner(mux.Vars(r)["id"])
+}
+
+// decodeMacroRequest reads and validates a macro create/update body. On
+// failure it writes the error response and returns false.
+func decodeMacroRequest(w http.ResponseWriter, r *http.Request) (string, json.RawMessage, bool) {
+	var req struct {
+		Name       string          `json:"name"`
+		Operations json.RawMessage `json:"operations"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return "", nil, false
+	}
+	if req.Name == "" {
+		writeFieldErrors(w, FieldError{Field: "name", Message: "is required"})
+		return "", nil, false
+	}
+	if err := validateMacroOperations(req.Operations); err != nil {
+		writeErrorBody(w, http.StatusUnprocessableEntity, "validation_failed", err.Error(), map[string]any{
+			"fieldErrors": []FieldError{{Field: "operations", Message: err.Error()}},
+		})
+		return "", nil, false
+	}
+	return req.Name, req.Operations, true
+}
+
+// List returns the user's macros
+func (h *MacroHandler) List(w http.ResponseWriter, r *http.Request) {
+	macros, err := h.macroService.List(requestEmail(r))
+	if err != nil {
+		log.Printf("Error listing macros: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"macros": macros,
+	})
+}
+
+// Create stores a new macro
+func (h *MacroHandler) Create(w http.ResponseWriter, r *http.Request) {
+	name, operations, ok := decodeMacroRequest(w, r)
+	if !ok {
+		return
+	}
+
+	macro, err := h.macroService.Create(requestEmail(r), name, operations)
+	if err != nil {
+		log.Printf("Error creating macro: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to save macro")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"macro":  macro,
+	})
+}
+
+// Update replaces a macro
+func (h *MacroHandler) Update(w http.ResponseWriter, r *http.Request) {
+	name, operations, ok := decodeMacroRequest(w, r)
+	if !ok {
+		return
+	}
+
+	macro, err := h.macroService.Update(mux.Vars(r)["id"], name, operations)
+	if err != nil {
+		log.Printf("Error updating macro: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to save macro")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"macro":  macro,
+	})
+}
+
+// Delete removes a macro
+func (h *MacroHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if err := h.macroService.Delete(mux.Vars(r)["id"]); err != nil {
+		log.Printf("Error deleting macro: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Run executes a macro against the user's board
+func (h *MacroHandler) Run(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+
+	var req struct {
+		Params map[string]string `json:"params"`
+	}
+	if r.ContentLength != 0 {
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+	}
+
+	macro, err := h.macroService.Get(mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Error loading macro: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	data, ops, err := h.macroService.Run(r.Context(), email, macro, req.Params)
+	var opErr *OperationError
+	if errors.As(err, &opErr) {
+		writeErrorBody(w, http.StatusUnprocessableEntity, "operation_failed", opErr.Error(), map[string]any{
+			"failed": opErr,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error running macro: %v", err)
+		writeServerError(w, err, "Failed to run macro")
+		return
+	}
+
+	// Push the result to connected clients
+	h.hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     "success",
+		"operations": ops,
+		"data":       data,
+	})
+}
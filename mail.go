@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Outgoing email is plain UTF-8 text, quoted-printable encoded. Messages
+// carry Date and Message-ID headers, the From display name and Reply-To
+// when configured, and a DKIM-Signature (relaxed/relaxed, rsa-sha256 or
+// ed25519-sha256) when DKIM_DOMAIN is set. They're sent over implicit TLS
+// (SMTP_TLS=tls, the default on port 465), STARTTLS (starttls, the default
+// otherwise; servers that don't offer it are refused) or, for local relays,
+// unencrypted (none).
+
+// SMTP_TLS modes
+const (
+	SMTPTLSStartTLS = "starttls"
+	SMTPTLSImplicit = "tls"
+	SMTPTLSNone     = "none"
+)
+
+// smtpTimeout bounds a whole SMTP exchange
+const smtpTimeout = 30 * time.Second
+
+// dkimSignedHeaders are the headers covered by DKIM signatures, when the
+// message has them
+var dkimSignedHeaders = []string{"From", "Reply-To", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+// mailHeader is one header of an outgoing message
+type mailHeader struct {
+	name  string
+	value string
+}
+
+// composeEmail returns the headers and encoded body of a plain-text email
+func composeEmail(from *mail.Address, replyTo, to, subject, body string, now time.Time) ([]mailHeader, []byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate message ID: %w", err)
+	}
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+
+	headers := []mailHeader{
+		{"From", from.String()},
+	}
+	if replyTo != "" {
+		headers = append(headers, mailHeader{"Reply-To", replyTo})
+	}
+	headers = append(headers,
+		mailHeader{"To", to},
+		mailHeader{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		mailHeader{"Date", now.Format(time.RFC1123Z)},
+		mailHeader{"Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain)},
+		mailHeader{"MIME-Version", "1.0"},
+		mailHeader{"Content-Type", "text/plain; charset=utf-8"},
+		mailHeader{"Content-Transfer-Encoding", "quoted-printable"},
+	)
+
+	var encoded bytes.Buffer
+	qp := quotedprintable.NewWriter(&encoded)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(body, "\r\n", "\n"))); err != nil {
+		return nil, nil, fmt.Errorf("failed to encode email body: %w", err)
+	}
+	if err := qp.Close(); err != nil {
+		return nil, nil, fmt.Errorf("failed to encode email body: %w", err)
+	}
+	return headers, encoded.Bytes(), nil
+}
+
+// renderEmail joins a message's headers and body
+func renderEmail(headers []mailHeader, body []byte) []byte {
+	var msg bytes.Buffer
+	for _, h := range headers {
+		msg.WriteString(h.name + ": " + h.value + "\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body)
+	return msg.Bytes()
+}
+
+// DKIMSigner signs outgoing email for a domain
+type DKIMSigner struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+}
+
+// LoadDKIMSigner reads a PEM private key (PKCS #1 or PKCS #8, RSA or
+// Ed25519) from a file
+func LoadDKIMSigner(domain, selector, keyFile string) (*DKIMSigner, error) {
+	raw, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("holds no PEM private key")
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("holds a %s, not a private key", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &DKIMSigner{domain: domain, selector: selector, key: key}, nil
+	case ed25519.PrivateKey:
+		return &DKIMSigner{domain: domain, selector: selector, key: key}, nil
+	default:
+		return nil, fmt.Errorf("holds a %T key; DKIM needs RSA or Ed25519", key)
+	}
+}
+
+func (d *DKIMSigner) algorithm() string {
+	if _, ok := d.key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+var (
+	wspRun      = regexp.MustCompile(`[ \t]+`)
+	trailingWSP = regexp.MustCompile(`[ \t]+\r\n`)
+)
+
+// canonicalBody applies DKIM's relaxed body canonicalization
+func canonicalBody(body []byte) []byte {
+	s := strings.ReplaceAll(string(body), "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\n", "\r\n")
+	s = wspRun.ReplaceAllString(s, " ")
+	s = trailingWSP.ReplaceAllString(s, "\r\n")
+	s = strings.TrimRight(s, "\r\n")
+	if s == "" {
+		return nil
+	}
+	return []byte(s + "\r\n")
+}
+
+// canonicalHeader applies DKIM's relaxed header canonicalization, without
+// the trailing CRLF
+func canonicalHeader(name, value string) string {
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.TrimSpace(wspRun.ReplaceAllString(value, " "))
+	return strings.ToLower(name) + ":" + value
+}
+
+// Sign returns the DKIM-Signature header for a message
+func (d *DKIMSigner) Sign(headers []mailHeader, body []byte, now time.Time) (mailHeader, error) {
+	bodyHash := sha256.Sum256(canonicalBody(body))
+
+	var signed []string
+	var data strings.Builder
+	for _, name := range dkimSignedHeaders {
+		for _, h := range headers {
+			if strings.EqualFold(h.name, name) {
+				signed = append(signed, strings.ToLower(name))
+				data.WriteString(canonicalHeader(h.name, h.value) + "\r\n")
+				break
+			}
+		}
+	}
+
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		d.algorithm(), d.domain, d.selector, now.Unix(), strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+	data.WriteString(canonicalHeader("DKIM-Signature", value))
+
+	digest := sha256.Sum256([]byte(data.String()))
+	opts := crypto.Hash(0)
+	if _, ok := d.key.(*rsa.PrivateKey); ok {
+		opts = crypto.SHA256
+	}
+	signature, err := d.key.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		return mailHeader{}, fmt.Errorf("failed to sign email: %w", err)
+	}
+	return mailHeader{"DKIM-Signature", value + base64.StdEncoding.EncodeToString(signature)}, nil
+}
+
+// sendSMTP delivers a message to one recipient, authenticating when the
+// server supports it
+func sendSMTP(cfg SMTPConfig, from, to string, msg []byte) error {
+	addr := net.JoinHostPort(cfg.Host, cfg.Port)
+	tlsConfig := &tls.Config{ServerName: cfg.Host}
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	var err error
+	if cfg.TLS == SMTPTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if cfg.TLS == SMTPTLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("server doesn't offer STARTTLS; set SMTP_TLS to tls or none")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDKIMCanonicalization(t *testing.T) {
+	bodies := []struct{ in, want string }{
+		{"", ""},
+		{"\r\n\r\n", ""},
+		{"Hello  \t world \r\n\r\n\r\n", "Hello world\r\n"},
+		{"a\nb", "a\r\nb\r\n"},
+	}
+	for _, tc := range bodies {
+		if got := string(canonicalBody([]byte(tc.in))); got != tc.want {
+			t.Errorf("canonicalBody(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+
+	if got := canonicalHeader("Subject", " Your \t login\r\n link "); got != "subject:Your login link" {
+		t.Errorf("canonicalHeader = %q", got)
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "dkim.pem")
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyFile, pemKey, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	signer, err := LoadDKIMSigner("example.com", "mail", keyFile)
+	if err != nil {
+		t.Fatalf("LoadDKIMSigner: %v", err)
+	}
+
+	now := time.Now()
+	from := &mail.Address{Name: "Todo", Address: "noreply@example.com"}
+	headers, body, err := composeEmail(from, "help@example.com", "a@example.com", "Your login link", "Hi\n", now)
+	if err != nil {
+		t.Fatalf("composeEmail: %v", err)
+	}
+	signature, err := signer.Sign(headers, body, now)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(signature.value, "; ") {
+		name, value, _ := strings.Cut(tag, "=")
+		tags[name] = value
+	}
+	if tags["a"] != "rsa-sha256" || tags["d"] != "example.com" || tags["s"] != "mail" {
+		t.Errorf("signature tags = %v", tags)
+	}
+	if tags["h"] != "from:reply-to:to:subject:date:message-id:mime-version:content-type:content-transfer-encoding" {
+		t.Errorf("signed headers = %q", tags["h"])
+	}
+	bodyHash := sha256.Sum256([]byte("Hi\r\n"))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		t.Errorf("bh = %q, want the hash of the canonical body", tags["bh"])
+	}
+
+	// Verify as a receiver would: the signed headers, then the signature
+	// header with b= empty
+	var data strings.Builder
+	for _, h := range headers {
+		data.WriteString(canonicalHeader(h.name, h.value) + "\r\n")
+	}
+	unsigned := strings.TrimSuffix(signature.value, tags["b"])
+	data.WriteString(canonicalHeader("DKIM-Signature", unsigned))
+	digest := sha256.Sum256([]byte(data.String()))
+	b, _ := base64.StdEncoding.DecodeString(tags["b"])
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], b); err != nil {
+		t.Errorf("signature doesn't verify: %v", err)
+	}
+}
+
+// fakeSMTPServer accepts one message and returns its envelope and data
+func fakeSMTPServer(t *testing.T, extensions ...string) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+		var transcript strings.Builder
+		reply("220 fake ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				received <- transcript.String()
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"):
+				for _, ext := range extensions {
+					reply("250-" + ext)
+				}
+				reply("250 fake")
+			case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+				transcript.WriteString(strings.TrimSpace(line) + "\n")
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					data, err := r.ReadString('\n')
+					if err != nil || data == ".\r\n" {
+						break
+					}
+					transcript.WriteString(data)
+				}
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				received <- transcript.String()
+				return
+			default:
+				reply("502 unsupported")
+			}
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestSendEmail(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+	host, port, _ := net.SplitHostPort(addr)
+	auth := NewAuthService(&Config{SMTP: SMTPConfig{
+		Host: host, Port: port, Username: "user", Password: "pass",
+		From: "noreply@example.com", FromName: "Todo Team", ReplyTo: "help@example.com",
+		TLS: SMTPTLSNone,
+	}})
+
+	if err := auth.SendEmail("a@example.com", "en", "Your login link", "Click here"); err != nil {
+		t.Fatalf("SendEmail: %v", err)
+	}
+	transcript := <-received
+	for _, want := range []string{
+		"MAIL FROM:<noreply@example.com>",
+		"RCPT TO:<a@example.com>",
+		"From: \"Todo Team\" <noreply@example.com>\r\n",
+		"Reply-To: help@example.com\r\n",
+		"Message-ID: <",
+		"Content-Transfer-Encoding: quoted-printable\r\n",
+		"\r\n\r\nClick here",
+	} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("message is missing %q:\n%s", want, transcript)
+		}
+	}
+}
+
+func TestSendEmailRequiresSTARTTLS(t *testing.T) {
+	addr, _ := fakeSMTPServer(t)
+	host, port, _ := net.SplitHostPort(addr)
+	auth := NewAuthService(&Config{SMTP: SMTPConfig{
+		Host: host, Port: port, Username: "user", Password: "pass",
+		From: "noreply@example.com", TLS: SMTPTLSStartTLS,
+	}})
+
+	err := auth.SendEmail("a@example.com", "en", "Your login link", "Click here")
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("SendEmail without STARTTLS = %v, want it refused", err)
+	}
+}
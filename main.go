@@ -1,17 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 	_ "github.com/mattn/go-sqlite3"
+	"google.golang.org/grpc"
 )
 
+// version is the build version, set with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
 	// Load environment variables from .env file
 	err := LoadEnv(".env")
@@ -20,67 +27,657 @@ func main() {
 		return
 	}
 
+	// Load and validate configuration
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if cfg.JWTSecret == defaultJWTSecret {
+		log.Printf("Warning: JWT_SECRET is not set, using the development default; set PROD=true to refuse this")
+	}
+
+	// "todo-app loadgen" load-tests the sync and WebSocket path against a
+	// scratch database and exits
+	if len(os.Args) > 1 && os.Args[1] == "loadgen" {
+		if err := runLoadgen(cfg, os.Args[2:]); err != nil {
+			log.Fatalf("Load test failed: %v", err)
+		}
+		return
+	}
+
 	// Initialize database
-	db, err := initDB()
+	db, err := initDB(cfg)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer db.Close()
 
+	// Schema migrations: "todo-app migrate up|down [n]|status" manages them
+	// by hand; otherwise pending ones run now unless MIGRATE_ON_START=false
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(migrator, os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+	if err := migrator.Check(); err == errMigrationsPending && cfg.MigrateOnStart {
+		if _, err := migrator.Up(); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+	} else if err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	// Initialize services
-	authService := NewAuthService()
-	dataService := NewDataService(db)
+	authService := NewAuthService(cfg)
+
+	// Boards and attachments are encrypted at rest when a key is configured
+	var encryptor *Encryptor
+	if cfg.Encryption.Enabled() {
+		keys, err := NewEnvKeyProvider(cfg.Encryption)
+		if err != nil {
+			log.Fatalf("Failed to initialize encryption: %v", err)
+		}
+		encryptor = NewEncryptor(keys)
+	}
+
+	codec, err := NewBoardCodec(cfg.StorageCompression, encryptor)
+	if err != nil {
+		log.Fatalf("Failed to initialize storage codec: %v", err)
+	}
+	dataService := NewDataService(db, codec)
+	dataService.cache.Limit(cfg.BoardCacheSize, cfg.BoardCacheTTL)
+	dataService.EnforceQuotas(cfg.Quotas)
+	calendarService := NewCalendarService(db, authService)
+	filterService := NewFilterService(db)
+	macroService := NewMacroService(db, dataService)
+	templateService := NewTemplateService(db, dataService)
+	deviceService := NewDeviceService(db, dataService)
+	commentService := NewCommentService(db, dataService)
+	settingsService := NewSettingsService(db)
+	archiveService := NewArchiveService(db, dataService)
+	trashService := NewTrashService(db, dataService)
+	homeAssistantService := NewHomeAssistantService(db, authService)
+	apiKeyService := NewAPIKeyService(db, authService)
+	statsService := NewStatsService(db, authService)
+	totpService := NewTOTPService(db, authService, cfg.Branding.AppName)
+	webauthnService, err := NewWebAuthnService(db, cfg.WebAuthn, cfg.Branding.AppName)
+	if err != nil {
+		log.Fatalf("Failed to initialize passkeys: %v", err)
+	}
+
+	attachmentStore, err := NewAttachmentStore(cfg.Attachments)
+	if err != nil {
+		log.Fatalf("Failed to initialize attachment storage: %v", err)
+	}
+	if encryptor != nil {
+		attachmentStore = NewEncryptedAttachmentStore(attachmentStore, encryptor)
+	}
+
+	// "todo-app reencrypt" rewrites stored data with the current key and exits
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		if err := runReencrypt(db, codec, attachmentStore); err != nil {
+			log.Fatalf("Re-encryption failed: %v", err)
+		}
+		return
+	}
+
+	// SQLite databases are backed up on DB_BACKUP_INTERVAL and through the
+	// admin API; "todo-app backup" and "todo-app restore NAME" do it by hand
+	var backupStore BackupStore
+	if db.Dialect() == DialectSQLite {
+		backupStore, err = NewBackupStore(cfg.DBBackup, cfg.Attachments.S3)
+		if err != nil {
+			log.Fatalf("Failed to initialize backup storage: %v", err)
+		}
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "backup" || os.Args[1] == "restore") {
+		if backupStore == nil {
+			log.Fatalf("Backups are only supported with SQLite")
+		}
+		dbBackupService := NewDBBackupService(db, backupStore, cfg.DBBackup, migrator, dataService, nil)
+		if err := runBackupCommand(dbBackupService, os.Args[1:]); err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+	attachmentService := NewAttachmentService(db, dataService, attachmentStore, cfg.Attachments)
+	attachmentService.LimitStorage(cfg.Quotas.AttachmentBytes)
+
+	// Background job queue
+	jobs := NewJobQueue(cfg.JobWorkers, 1024)
+	jobs.Start()
+
+	backupService := NewBackupWebhookService(db, dataService, authService, commentService, jobs)
+	go backupService.RunSchedule(cfg.BackupWebhookInterval)
+	webhookService := NewWebhookService(db, dataService, authService, jobs)
+	websubService := NewWebSubService(db, dataService, authService, jobs)
+	inboundEmailService := NewInboundEmailService(db, dataService, cfg.InboundEmailDomain)
+	exportService := NewExportService(db, dataService, commentService, jobs, cfg.ExportRateLimit, cfg.ExportRateWindow, cfg.ExportRetention)
+	if err := exportService.FailInterrupted(); err != nil {
+		log.Printf("Error failing interrupted exports: %v", err)
+	}
+	slackService := NewSlackService(db, dataService, authService, jobs, cfg.Slack, cfg.SlackSigningSecret)
+
+	snapshotService := NewSnapshotService(db, dataService)
+	if weekday, ok := weekdays[cfg.SnapshotWeekday]; ok {
+		go snapshotService.RunSchedule(weekday)
+	}
 
 	// Initialize WebSocket hub
 	hub := NewHub()
+	hub.LimitConnections(cfg.WSMaxConnectionsPerUser)
+	hub.LimitQueues(cfg.WSSendQueue, cfg.WSSlowClientPolicy)
+
+	// Syncs arriving in quick succession are saved and broadcast together
+	dataService.CoalesceWrites(cfg.SyncCoalesceWindow, func(email string, data *KanbanData) {
+		hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+	})
+
+	// Share broadcasts and cache invalidations with other instances
+	broker, err := NewBroker(cfg.PubSub)
+	if err != nil {
+		log.Fatalf("Failed to set up pub/sub: %v", err)
+	}
+	var relay *ClusterRelay
+	if broker != nil {
+		relay = NewClusterRelay(broker, hub, dataService.cache)
+		log.Printf("Relaying WebSocket messages through %s channel %q", cfg.PubSub.Backend, cfg.PubSub.Channel)
+	}
 	go hub.Run()
 
+	// Clients may lock what they're editing; writes from others are checked
+	lockService := NewLockService(hub)
+	dataService.UseLocks(lockService)
+
+	// Fold legacy unassignedTasks arrays into tasks, once now and periodically
+	go dataService.RunCompaction(cfg.CompactionInterval)
+
+	var dbBackupHandler *DBBackupHandler
+	if backupStore != nil {
+		dbBackupService := NewDBBackupService(db, backupStore, cfg.DBBackup, migrator, dataService, hub)
+		if cfg.DBBackup.Interval > 0 {
+			go dbBackupService.RunSchedule(cfg.DBBackup.Interval)
+		}
+		dbBackupHandler = NewDBBackupHandler(dbBackupService)
+	}
+
+	// Admins can disable accounts and revoke sessions; every token and API
+	// key is checked against the user's account
+	adminService := NewAdminService(db, hub, dataService.cache)
+	authService.OnAuthenticate(adminService.CheckAccount)
+
+	// A company directory can restrict who signs in and provision users
+	directoryService := NewDirectoryService(db, adminService, cfg.Directory)
+	if cfg.Directory.Enabled() {
+		authService.OnAuthenticate(directoryService.Check(adminService.CheckAccount))
+	}
+
+	// Messages and emails are in the user's language setting, if they chose one
+	authService.OnLanguage(settingsService.Language)
+
+	// Feature flags roll out per FEATURE_FLAGS, with per-user overrides
+	flagService := NewFeatureFlagService(db, cfg.FeatureFlags)
+
+	// Workspace members get access to their workspaces' boards
+	workspaceService := NewWorkspaceService(db, authService, dataService, hub)
+	hub.UseSharedBoards(workspaceService.BoardRole)
+
 	// Initialize handlers
-	authHandler := NewAuthHandler(authService, dataService)
-	dataHandler := NewDataHandler(dataService, authService, hub)
+	authHandler := NewAuthHandler(authService, dataService, totpService)
+	totpHandler := NewTOTPHandler(totpService, authService)
+	webauthnHandler := NewWebAuthnHandler(webauthnService, authService)
+	dataHandler := NewDataHandler(dataService, authService, commentService, hub, cfg)
+	dataHandler.UseFlags(flagService)
+	crdtShadow := NewCRDTShadow(flagService)
+	dataHandler.UseCRDTShadow(crdtShadow)
+	dataHandler.UseMergeStrategySetting(settingsService.MergeStrategy)
+	crdtShadowHandler := NewCRDTShadowHandler(crdtShadow)
+	calendarHandler := NewCalendarHandler(calendarService, dataService)
+	filterHandler := NewFilterHandler(filterService)
+	backupHandler := NewBackupWebhookHandler(backupService)
+	webhookHandler := NewWebhookHandler(webhookService)
+	websubHandler := NewWebSubHandler(websubService, jobs)
+	scimHandler := NewSCIMHandler(directoryService, cfg.Directory.SCIMToken)
+	inboundEmailHandler := NewInboundEmailHandler(inboundEmailService, hub, cfg.InboundEmailKey)
+	snapshotHandler := NewSnapshotHandler(snapshotService, dataService)
+	slackHandler := NewSlackHandler(slackService, hub)
+	exportHandler := NewExportHandler(exportService)
+	macroHandler := NewMacroHandler(macroService, hub)
+	templateHandler := NewTemplateHandler(templateService, hub)
+	deviceHandler := NewDeviceHandler(deviceService, hub)
+	configHandler := NewConfigHandler(cfg)
+	attachmentHandler := NewAttachmentHandler(attachmentService, cfg.Attachments)
+	commentHandler := NewCommentHandler(commentService, hub)
+	settingsHandler := NewSettingsHandler(settingsService)
+	quotaHandler := NewQuotaHandler(NewQuotaService(db, dataService, cfg.Quotas))
+	lockHandler := NewLockHandler(lockService)
+	archiveHandler := NewArchiveHandler(archiveService, hub)
+	trashHandler := NewTrashHandler(trashService, hub)
+	homeAssistantHandler := NewHomeAssistantHandler(homeAssistantService, dataService, settingsService, hub)
+	swimlaneHandler := NewSwimlaneHandler(dataService, hub)
+	columnHandler := NewColumnHandler(dataService, hub)
+	grafanaHandler := NewGrafanaHandler(statsService)
+	reportHandler := NewReportHandler(statsService, dataService)
+	apiKeyHandler := NewAPIKeyHandler(apiKeyService)
+	shareHandler := NewShareHandler(NewShareService(db, authService), dataService, cfg)
+	adminHandler := NewAdminHandler(adminService)
+	flagHandler := NewFeatureFlagHandler(flagService)
+	accountHandler := NewAccountHandler(NewAccountService(db, authService, dataService, attachmentService, hub))
+	workspaceHandler := NewWorkspaceHandler(workspaceService)
+	simpleHandler := NewSimpleHandler(authService, dataService, archiveService, totpService, hub, cfg)
+	presenceHandler := NewPresenceHandler(hub)
+	eventsHandler := NewEventsHandler(dataService, authService, hub)
+	quickAddHandler := NewQuickAddHandler(dataService, hub)
+
+	autoArchiveService := NewAutoArchiveService(db, dataService, settingsService, hub)
+	go autoArchiveService.RunSchedule(cfg.AutoArchiveInterval)
+
+	// Purge expired tokens, old tombstones and orphaned rows periodically
+	maintenanceService := NewMaintenanceService(db, authService, attachmentService, cfg.Maintenance)
+	go maintenanceService.RunSchedule(cfg.Maintenance.Interval)
+	maintenanceHandler := NewMaintenanceHandler(maintenanceService)
+
+	// External task sync providers are offered when their OAuth client is configured
+	externalSyncService := NewExternalSyncService(db, dataService, authService, jobs, hub, taskProvidersFromConfig(cfg))
+	go externalSyncService.RunSchedule(cfg.ExternalSyncInterval)
+	externalSyncHandler := NewExternalSyncHandler(externalSyncService)
+
+	// Route authorization policies
+	policy := NewPolicyEnforcer(authService, apiKeyService, cfg)
+	policy.UseSharedBoards(workspaceService.BoardRole)
 
 	// Setup router
 	r := mux.NewRouter()
 
+	// Public runtime configuration for the frontend
+	r.HandleFunc("/api/config", configHandler.Get).Methods("GET")
+
 	// Auth routes
 	r.HandleFunc("/api/auth/login", authHandler.Login).Methods("POST")
 	r.HandleFunc("/api/auth/verify", authHandler.VerifyToken).Methods("GET")
 	r.HandleFunc("/api/auth/magic-link", authHandler.HandleMagicLink).Methods("GET")
+	r.HandleFunc("/api/auth/exchange", authHandler.Exchange).Methods("POST")
+	r.HandleFunc("/api/auth/logout", authHandler.Logout).Methods("POST")
+	r.HandleFunc("/api/auth/totp/verify", totpHandler.Verify).Methods("POST")
+	r.Handle("/api/auth/totp", policy.Require(totpHandler.Get, SessionOnly)).Methods("GET")
+	r.Handle("/api/auth/totp", policy.Require(totpHandler.Delete, SessionOnly)).Methods("DELETE")
+	r.Handle("/api/auth/totp/enroll", policy.Require(totpHandler.Enroll, SessionOnly)).Methods("POST")
+	r.Handle("/api/auth/totp/confirm", policy.Require(totpHandler.Confirm, SessionOnly)).Methods("POST")
+	r.Handle("/api/auth/totp/backup-codes", policy.Require(totpHandler.RegenerateBackupCodes, SessionOnly)).Methods("POST")
+	r.HandleFunc("/api/auth/webauthn/login/begin", webauthnHandler.LoginBegin).Methods("POST")
+	r.HandleFunc("/api/auth/webauthn/login/finish", webauthnHandler.LoginFinish).Methods("POST")
+	r.Handle("/api/auth/webauthn/register/begin", policy.Require(webauthnHandler.RegisterBegin, SessionOnly)).Methods("POST")
+	r.Handle("/api/auth/webauthn/register/finish", policy.Require(webauthnHandler.RegisterFinish, SessionOnly)).Methods("POST")
+	r.Handle("/api/auth/webauthn/credentials", policy.Require(webauthnHandler.List, SessionOnly)).Methods("GET")
+	r.Handle("/api/auth/webauthn/credentials/{id}", policy.Require(webauthnHandler.Delete, SessionOnly)).Methods("DELETE")
 
-	// Data routes (protected)
-	r.HandleFunc("/api/data/sync", dataHandler.SyncData).Methods("POST")
-	r.HandleFunc("/api/data/get", dataHandler.GetData).Methods("GET")
+	// Data routes (protected). Routes on the caller's own board and account
+	// only need a signed-in user; those taking ?board= check the role the
+	// caller holds on it.
+	canView := policy.HasBoardRole(BoardRoleViewer, queryBoard)
+	canEdit := policy.HasBoardRole(BoardRoleEditor, queryBoard)
+	r.Handle("/api/data/sync", policy.Require(decompressRequest(dataHandler.SyncData), canEdit)).Methods("POST")
+	r.Handle("/api/data/get", policy.Require(dataHandler.GetData, canView)).Methods("GET")
+	r.Handle("/api/data/changes", policy.Require(dataHandler.Changes, canView)).Methods("GET")
+	r.Handle("/api/data/poll", policy.Require(dataHandler.Poll, canView)).Methods("GET")
+	r.Handle("/api/data/export", policy.Require(exportHandler.Throttle(dataHandler.ExportData), canView)).Methods("GET")
+	r.Handle("/api/exports", policy.Require(exportHandler.Create)).Methods("POST")
+	r.Handle("/api/exports/{id}", policy.Require(exportHandler.Get)).Methods("GET")
+	r.Handle("/api/exports/{id}/download", policy.Require(exportHandler.Download)).Methods("GET")
+	r.Handle("/api/data/import/markdown", policy.Require(dataHandler.ImportMarkdown, canEdit)).Methods("POST")
+	r.Handle("/api/data/sync/batch", policy.Require(deviceHandler.SyncBatch, canEdit)).Methods("POST")
+
+	// Device routes (clients that queue changes offline)
+	r.Handle("/api/devices", policy.Require(deviceHandler.List)).Methods("GET")
+	r.Handle("/api/devices", policy.Require(deviceHandler.Register)).Methods("POST")
+
+	// Calendar routes (feed is protected by its own secret token)
+	r.Handle("/api/calendar/token", policy.Require(calendarHandler.CreateFeedToken)).Methods("POST")
+	r.HandleFunc("/api/calendar.ics", calendarHandler.Feed).Methods("GET")
+
+	// Saved filter routes
+	r.Handle("/api/filters", policy.Require(filterHandler.Create)).Methods("POST")
+	r.Handle("/api/filters/{slug}", policy.Require(filterHandler.Get)).Methods("GET")
+
+	// Backup webhook routes
+	r.Handle("/api/backup-webhook", policy.Require(backupHandler.Get)).Methods("GET")
+	r.Handle("/api/backup-webhook", policy.Require(backupHandler.Register)).Methods("PUT")
+	r.Handle("/api/backup-webhook", policy.Require(backupHandler.Delete)).Methods("DELETE")
+
+	// Event webhook routes
+	r.Handle("/api/webhooks", policy.Require(webhookHandler.List)).Methods("GET")
+	r.Handle("/api/webhooks", policy.Require(webhookHandler.Create)).Methods("POST")
+	r.Handle("/api/webhooks/{id}", policy.Require(webhookHandler.Delete)).Methods("DELETE")
+	r.Handle("/api/webhooks/{id}/deliveries", policy.Require(webhookHandler.Deliveries)).Methods("GET")
+
+	// WebSub hub; topic URLs carry their own token
+	r.Handle("/api/websub/token", policy.Require(websubHandler.CreateToken)).Methods("POST")
+	r.HandleFunc("/api/websub/hub", websubHandler.Hub).Methods("POST")
+	r.HandleFunc("/api/websub/topics/{token}", websubHandler.Topic).Methods("GET")
+
+	// Inbound email; the parse webhook authenticates with INBOUND_EMAIL_KEY
+	r.Handle("/api/inbound-email/address", policy.Require(inboundEmailHandler.CreateAddress)).Methods("POST")
+	r.HandleFunc("/api/inbound-email/parse", inboundEmailHandler.Receive).Methods("POST")
+
+	// SCIM provisioning; authenticates with SCIM_TOKEN
+	r.HandleFunc("/scim/v2/ServiceProviderConfig", scimHandler.Authenticate(scimHandler.ServiceProviderConfig)).Methods("GET")
+	r.HandleFunc("/scim/v2/Users", scimHandler.Authenticate(scimHandler.ListUsers)).Methods("GET")
+	r.HandleFunc("/scim/v2/Users", scimHandler.Authenticate(scimHandler.CreateUser)).Methods("POST")
+	r.HandleFunc("/scim/v2/Users/{id}", scimHandler.Authenticate(scimHandler.GetUser)).Methods("GET")
+	r.HandleFunc("/scim/v2/Users/{id}", scimHandler.Authenticate(scimHandler.ReplaceUser)).Methods("PUT")
+	r.HandleFunc("/scim/v2/Users/{id}", scimHandler.Authenticate(scimHandler.PatchUser)).Methods("PATCH")
+	r.HandleFunc("/scim/v2/Users/{id}", scimHandler.Authenticate(scimHandler.DeleteUser)).Methods("DELETE")
+
+	// Board history (snapshots)
+	r.Handle("/api/history", policy.Require(snapshotHandler.List)).Methods("GET")
+	r.Handle("/api/history", policy.Require(snapshotHandler.Create)).Methods("POST")
+	r.Handle("/api/history/{id}", policy.Require(snapshotHandler.Get)).Methods("GET")
+	r.Handle("/api/history/{id}", policy.Require(snapshotHandler.Delete)).Methods("DELETE")
+	r.Handle("/api/history/{id}/compare", policy.Require(snapshotHandler.Compare)).Methods("GET")
+
+	// Slack app; the command endpoint verifies Slack's request signature
+	r.Handle("/api/slack", policy.Require(slackHandler.Get)).Methods("GET")
+	r.Handle("/api/slack", policy.Require(slackHandler.Update)).Methods("PUT")
+	r.Handle("/api/slack", policy.Require(slackHandler.Delete)).Methods("DELETE")
+	r.Handle("/api/slack/connect", policy.Require(slackHandler.Connect)).Methods("POST")
+	r.HandleFunc("/api/slack/callback", slackHandler.Callback).Methods("GET")
+	r.HandleFunc("/api/slack/commands", slackHandler.Command).Methods("POST")
+
+	// Macro routes
+	ownsMacro := OwnsResource(macroHandler.macroOwner)
+	r.Handle("/api/macros", policy.Require(macroHandler.List)).Methods("GET")
+	r.Handle("/api/macros", policy.Require(macroHandler.Create)).Methods("POST")
+	r.Handle("/api/macros/{id}", policy.Require(macroHandler.Update, ownsMacro)).Methods("PUT")
+	r.Handle("/api/macros/{id}", policy.Require(macroHandler.Delete, ownsMacro)).Methods("DELETE")
+	r.Handle("/api/macros/{id}/run", policy.Require(macroHandler.Run, ownsMacro)).Methods("POST")
+
+	// Template routes
+	ownsTemplate := OwnsResource(templateHandler.templateOwner)
+	r.Handle("/api/templates", policy.Require(templateHandler.List)).Methods("GET")
+	r.Handle("/api/templates", policy.Require(templateHandler.Create)).Methods("POST")
+	r.Handle("/api/templates/{id}", policy.Require(templateHandler.Update, ownsTemplate)).Methods("PUT")
+	r.Handle("/api/templates/{id}", policy.Require(templateHandler.Delete, ownsTemplate)).Methods("DELETE")
+	r.Handle("/api/templates/{id}/apply", policy.Require(templateHandler.Apply, ownsTemplate)).Methods("POST")
+
+	// Attachment routes
+	ownsAttachment := OwnsResource(attachmentHandler.attachmentOwner)
+	r.Handle("/api/tasks/{id}/attachments", policy.Require(attachmentHandler.List)).Methods("GET")
+	r.Handle("/api/tasks/{id}/attachments", policy.Require(attachmentHandler.Upload)).Methods("POST")
+	r.Handle("/api/attachments/{id}", policy.Require(attachmentHandler.Download, ownsAttachment)).Methods("GET")
+	r.Handle("/api/attachments/{id}", policy.Require(attachmentHandler.Delete, ownsAttachment)).Methods("DELETE")
+
+	// User settings routes
+	r.Handle("/api/settings", policy.Require(settingsHandler.Get)).Methods("GET")
+	r.Handle("/api/settings", policy.Require(settingsHandler.Update)).Methods("PUT")
+
+	// Storage used against the quotas
+	r.Handle("/api/usage", policy.Require(quotaHandler.Get)).Methods("GET")
+
+	// Soft edit locks on the user's board
+	r.Handle("/api/locks", policy.Require(lockHandler.List)).Methods("GET")
+	r.Handle("/api/locks", policy.Require(lockHandler.Claim)).Methods("POST")
+	r.Handle("/api/locks/{kind}", policy.Require(lockHandler.Release)).Methods("DELETE")
+	r.Handle("/api/locks/{kind}/{id}", policy.Require(lockHandler.Release)).Methods("DELETE")
+
+	// Feature flag routes (users can only toggle beta flags)
+	r.Handle("/api/flags", policy.Require(flagHandler.List)).Methods("GET")
+	r.Handle("/api/flags/{name}", policy.Require(flagHandler.Toggle)).Methods("PUT")
+	r.Handle("/api/flags/{name}", policy.Require(flagHandler.Reset)).Methods("DELETE")
+
+	// Archive routes
+	r.Handle("/api/tasks/{id}/archive", policy.Require(archiveHandler.Archive)).Methods("POST")
+	r.Handle("/api/tasks/quick-add", policy.Require(quickAddHandler.QuickAdd)).Methods("POST")
+	r.Handle("/api/archive", policy.Require(archiveHandler.List)).Methods("GET")
+	r.Handle("/api/archive/{id}/restore", policy.Require(archiveHandler.Restore)).Methods("POST")
+
+	// Workspace routes
+	wsViewer := workspaceService.Require(WorkspaceRoleViewer)
+	wsMember := workspaceService.Require(WorkspaceRoleMember)
+	wsAdmin := workspaceService.Require(WorkspaceRoleAdmin)
+	wsOwner := workspaceService.Require(WorkspaceRoleOwner)
+	r.Handle("/api/workspaces", policy.Require(workspaceHandler.List)).Methods("GET")
+	r.Handle("/api/workspaces", policy.Require(workspaceHandler.Create, SessionOnly)).Methods("POST")
+	r.Handle("/api/workspaces/current", policy.Require(workspaceHandler.Current)).Methods("GET")
+	r.Handle("/api/workspaces/current", policy.Require(workspaceHandler.Switch)).Methods("PUT")
+	r.Handle("/api/workspaces/invitations/accept", policy.Require(workspaceHandler.AcceptInvitation, SessionOnly)).Methods("POST")
+	r.Handle("/api/workspaces/{id}", policy.Require(workspaceHandler.Get, wsViewer)).Methods("GET")
+	r.Handle("/api/workspaces/{id}", policy.Require(workspaceHandler.Rename, wsAdmin)).Methods("PATCH")
+	r.Handle("/api/workspaces/{id}", policy.Require(workspaceHandler.Delete, wsOwner, SessionOnly)).Methods("DELETE")
+	r.Handle("/api/workspaces/{id}/members/{email}", policy.Require(workspaceHandler.SetRole, wsAdmin, SessionOnly)).Methods("PATCH")
+	r.Handle("/api/workspaces/{id}/members/{email}", policy.Require(workspaceHandler.RemoveMember, wsViewer, SessionOnly)).Methods("DELETE")
+	r.Handle("/api/workspaces/{id}/invitations", policy.Require(workspaceHandler.Invitations, wsAdmin)).Methods("GET")
+	r.Handle("/api/workspaces/{id}/invitations", policy.Require(workspaceHandler.Invite, wsAdmin, SessionOnly)).Methods("POST")
+	r.Handle("/api/workspaces/{id}/invitations/{invitationId}", policy.Require(workspaceHandler.RevokeInvitation, wsAdmin, SessionOnly)).Methods("DELETE")
+	r.Handle("/api/workspaces/{id}/boards", policy.Require(workspaceHandler.Boards, wsViewer)).Methods("GET")
+	r.Handle("/api/workspaces/{id}/boards", policy.Require(workspaceHandler.CreateBoard, wsMember)).Methods("POST")
+	r.Handle("/api/workspaces/{id}/boards/{boardId}", policy.Require(workspaceHandler.RenameBoard, wsAdmin)).Methods("PATCH")
+	r.Handle("/api/workspaces/{id}/boards/{boardId}", policy.Require(workspaceHandler.DeleteBoard, wsAdmin)).Methods("DELETE")
+	r.Handle("/api/workspaces/{id}/labels", policy.Require(workspaceHandler.Labels, wsViewer)).Methods("GET")
+	r.Handle("/api/workspaces/{id}/labels", policy.Require(workspaceHandler.CreateLabel, wsAdmin)).Methods("POST")
+	r.Handle("/api/workspaces/{id}/labels/{name}", policy.Require(workspaceHandler.DeleteLabel, wsAdmin)).Methods("DELETE")
+
+	// Trash routes
+	r.Handle("/api/trash", policy.Require(trashHandler.List)).Methods("GET")
+	r.Handle("/api/trash/{id}/restore", policy.Require(trashHandler.Restore)).Methods("POST")
+
+	// External task sync routes (providers redirect to the callback)
+	r.Handle("/api/integrations/{provider}", policy.Require(externalSyncHandler.Get)).Methods("GET")
+	r.Handle("/api/integrations/{provider}", policy.Require(externalSyncHandler.Update)).Methods("PUT")
+	r.Handle("/api/integrations/{provider}", policy.Require(externalSyncHandler.Delete)).Methods("DELETE")
+	r.Handle("/api/integrations/{provider}/connect", policy.Require(externalSyncHandler.Connect)).Methods("GET")
+	r.Handle("/api/integrations/{provider}/sync", policy.Require(externalSyncHandler.SyncNow)).Methods("POST")
+	r.HandleFunc("/api/integrations/{provider}/callback", externalSyncHandler.Callback).Methods("GET")
+	r.Handle("/api/admin/sync-status", policy.Require(externalSyncHandler.Status, policy.Admin())).Methods("GET")
+
+	// Admin user management routes
+	r.Handle("/api/admin/users", policy.Require(adminHandler.ListUsers, policy.Admin())).Methods("GET")
+	r.Handle("/api/admin/users/{email}", policy.Require(adminHandler.GetUser, policy.Admin())).Methods("GET")
+	r.Handle("/api/admin/users/{email}/disable", policy.Require(adminHandler.Disable, policy.Admin())).Methods("POST")
+	r.Handle("/api/admin/users/{email}/enable", policy.Require(adminHandler.Enable, policy.Admin())).Methods("POST")
+	r.Handle("/api/admin/users/{email}/revoke-sessions", policy.Require(adminHandler.RevokeSessions, policy.Admin())).Methods("POST")
+	r.Handle("/api/admin/users/{email}/flags", policy.Require(flagHandler.AdminList, policy.Admin())).Methods("GET")
+	r.Handle("/api/admin/users/{email}/flags/{name}", policy.Require(flagHandler.AdminSet, policy.Admin())).Methods("PUT")
+	r.Handle("/api/admin/users/{email}/flags/{name}", policy.Require(flagHandler.AdminClear, policy.Admin())).Methods("DELETE")
+	r.Handle("/api/admin/websocket", policy.Require(adminHandler.WebSocketStats, policy.Admin())).Methods("GET")
+	r.Handle("/api/admin/cache", policy.Require(adminHandler.CacheStats, policy.Admin())).Methods("GET")
+	r.Handle("/api/admin/maintenance", policy.Require(maintenanceHandler.Stats, policy.Admin())).Methods("GET")
+	r.Handle("/api/admin/maintenance/run", policy.Require(maintenanceHandler.Run, policy.Admin())).Methods("POST")
+	r.Handle("/api/admin/crdt", policy.Require(crdtShadowHandler.Stats, policy.Admin())).Methods("GET")
+
+	// Admin database backup routes (SQLite only)
+	if dbBackupHandler != nil {
+		r.Handle("/api/admin/backups", policy.Require(dbBackupHandler.List, policy.Admin())).Methods("GET")
+		r.Handle("/api/admin/backups", policy.Require(dbBackupHandler.Create, policy.Admin())).Methods("POST")
+		r.Handle("/api/admin/backups/{name}/restore", policy.Require(dbBackupHandler.Restore, policy.Admin())).Methods("POST")
+	}
+
+	// Home Assistant routes (sensor and actions use the long-lived token)
+	r.Handle("/api/homeassistant/token", policy.Require(homeAssistantHandler.CreateToken)).Methods("POST")
+	r.HandleFunc("/api/homeassistant/sensor", homeAssistantHandler.Sensor).Methods("GET")
+	r.HandleFunc("/api/homeassistant/tasks", homeAssistantHandler.AddTask).Methods("POST")
+
+	// API key routes (keys can't manage keys)
+	r.Handle("/api/keys", policy.Require(apiKeyHandler.List, SessionOnly)).Methods("GET")
+	r.Handle("/api/keys", policy.Require(apiKeyHandler.Create, SessionOnly)).Methods("POST")
+	r.Handle("/api/keys/{id}", policy.Require(apiKeyHandler.Delete, SessionOnly)).Methods("DELETE")
+
+	// Account export, deletion and email changes (deleting and changing
+	// the email need the emailed confirmation)
+	r.Handle("/api/account", policy.Require(accountHandler.Delete, SessionOnly)).Methods("DELETE")
+	r.Handle("/api/account/email", policy.Require(accountHandler.ChangeEmail, SessionOnly)).Methods("POST")
+	r.Handle("/api/account/export", policy.Require(exportHandler.Throttle(accountHandler.Export), SessionOnly)).Methods("GET")
+
+	// Grafana JSON datasource routes (all but the token use the long-lived token)
+	r.Handle("/api/grafana/token", policy.Require(grafanaHandler.CreateToken)).Methods("POST")
+	r.HandleFunc("/api/grafana/", grafanaHandler.Test).Methods("GET")
+	r.HandleFunc("/api/grafana/metrics", grafanaHandler.Metrics).Methods("POST")
+	r.HandleFunc("/api/grafana/query", grafanaHandler.Query).Methods("POST")
+
+	// Reports
+	r.Handle("/api/reports/summary", policy.Require(reportHandler.Summary)).Methods("GET")
+
+	// Column routes
+	r.Handle("/api/columns/reorder", policy.Require(columnHandler.Reorder)).Methods("PATCH")
+
+	// Swimlane routes
+	r.Handle("/api/swimlanes", policy.Require(swimlaneHandler.List)).Methods("GET")
+	r.Handle("/api/swimlanes", policy.Require(swimlaneHandler.Create)).Methods("POST")
+	r.Handle("/api/swimlanes/order", policy.Require(swimlaneHandler.Reorder)).Methods("PUT")
+	r.Handle("/api/swimlanes/{id}", policy.Require(swimlaneHandler.Update)).Methods("PUT")
+	r.Handle("/api/swimlanes/{id}", policy.Require(swimlaneHandler.Delete)).Methods("DELETE")
+
+	// Public share links (the shared board needs only the link's token)
+	canShare := policy.HasBoardRole(BoardRoleOwner, pathBoard)
+	r.Handle("/api/boards/{id}/share-link", policy.Require(shareHandler.Create, canShare)).Methods("POST")
+	r.Handle("/api/boards/{id}/share-links", policy.Require(shareHandler.List, canShare)).Methods("GET")
+	r.Handle("/api/boards/{id}/share-links/{linkId}", policy.Require(shareHandler.Revoke, canShare)).Methods("DELETE")
+	r.HandleFunc("/api/share/{token}", shareHandler.Get).Methods("GET")
+	r.HandleFunc("/share/{token}", shareHandler.Page).Methods("GET")
+
+	// Comment routes
+	ownsComment := OwnsResource(commentHandler.commentAuthor)
+	r.Handle("/api/tasks/{id}/comments", policy.Require(commentHandler.List)).Methods("GET")
+	r.Handle("/api/tasks/{id}/comments", policy.Require(commentHandler.Create)).Methods("POST")
+	r.Handle("/api/tasks/{id}/comments/{commentId}", policy.Require(commentHandler.Update, ownsComment)).Methods("PUT")
+	r.Handle("/api/tasks/{id}/comments/{commentId}", policy.Require(commentHandler.Delete, ownsComment)).Methods("DELETE")
 
 	// WebSocket route for real-time updates
 	r.HandleFunc("/api/ws", dataHandler.HandleWebSocket)
+	// Server-Sent Events fallback for networks that break WebSockets
+	r.HandleFunc("/api/events", eventsHandler.Stream).Methods("GET")
+	r.Handle("/api/presence", policy.Require(presenceHandler.Get, canView)).Methods("GET")
+
+	// Plain HTML views that work without JavaScript
+	r.HandleFunc("/simple", simpleHandler.Board).Methods("GET")
+	r.HandleFunc("/simple/login", simpleHandler.LoginForm).Methods("GET")
+	r.HandleFunc("/simple/login", simpleHandler.Login).Methods("POST")
+	r.HandleFunc("/simple/auth", simpleHandler.Auth).Methods("GET")
+	r.HandleFunc("/simple/auth/totp", simpleHandler.AuthTOTP).Methods("POST")
+	r.HandleFunc("/simple/logout", simpleHandler.Logout).Methods("POST")
+	r.HandleFunc("/simple/tasks", simpleHandler.AddTask).Methods("POST")
+	r.HandleFunc("/simple/tasks/{id}/complete", simpleHandler.CompleteTask).Methods("POST")
+
+	// Unknown API routes get a JSON error rather than the frontend's 404
+	r.PathPrefix("/api/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "Not found")
+	})
 
-	// Static file server for frontend
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./")))
+	// Frontend assets embedded in the binary
+	r.PathPrefix("/").Handler(frontendHandler(cfg.Branding))
 
 	// Setup CORS
 	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"}, // In production, change to your domain
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowOriginFunc:  func(origin string) bool { return originAllowed(cfg.AllowedOrigins, origin) },
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-API-Key", csrfHeader, "X-Client-ID"},
+		ExposedHeaders:   []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After"},
 		AllowCredentials: true,
 	})
 
-	// Get port from environment or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3001"
+	// Cookie-authenticated API requests must carry the CSRF token
+	var handler http.Handler = CSRFMiddleware(r)
+
+	// Answer API requests in the language they ask for
+	handler = LocaleMiddleware(handler)
+
+	// Compress large text and JSON responses
+	handler = CompressionMiddleware(handler)
+
+	// Rate limit API requests and WebSocket messages per user (or address)
+	if cfg.RateLimitRequests > 0 {
+		limiter := NewRateLimiter(cfg.RateLimitRequests, cfg.RateLimitWindow)
+		handler = limiter.Middleware(authService, handler)
+		hub.LimitMessages(limiter)
 	}
 
 	// Start server
 	server := &http.Server{
-		Addr:         ":" + port,
-		Handler:      c.Handler(r),
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:         ":" + cfg.Port,
+		Handler:      c.Handler(handler),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+
+	// Stop on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Printf("Server starting on port %s", cfg.Port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server error: %v", err)
+		}
+	}()
+
+	// The gRPC API listens on its own port
+	var grpcServer *grpc.Server
+	if cfg.GRPCPort != "" {
+		listener, err := net.Listen("tcp", ":"+cfg.GRPCPort)
+		if err != nil {
+			log.Fatalf("Failed to listen for gRPC: %v", err)
+		}
+		grpcServer = NewGRPCServer(dataService, hub, policy)
+		go func() {
+			log.Printf("gRPC server starting on port %s", cfg.GRPCPort)
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Fatalf("gRPC server error: %v", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	log.Println("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// WebSocket connections are hijacked, so the hub closes them itself.
+	// This also ends event streams, which would otherwise hold up the HTTP
+	// server's shutdown, and gRPC Watch streams.
+	if err := hub.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error closing WebSocket clients: %v", err)
+	}
+
+	// Save syncs waiting to be coalesced now, rather than keeping their
+	// requests waiting out the window
+	if err := dataService.FlushWrites(shutdownCtx); err != nil {
+		log.Printf("Error flushing board writes: %v", err)
+	}
+
+	// Stop accepting requests and let in-flight ones finish
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			grpcServer.Stop()
+		}
+	}
+
+	// Let queued background jobs finish
+	if err := jobs.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error draining job queue: %v", err)
+	}
+
+	if relay != nil {
+		relay.Close()
 	}
 
-	log.Printf("Server starting on port %s", port)
-	log.Fatal(server.ListenAndServe())
+	// The database is closed last by the deferred db.Close
+	log.Println("Server stopped")
 }
 
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MaintenanceConfig schedules the cleanup of data nothing needs any more
+type MaintenanceConfig struct {
+	// How often maintenance runs
+	Interval time.Duration
+	// How long tombstones of removed items are kept for incremental sync
+	TombstoneRetention time.Duration
+}
+
+// shareLinkRetention is how long expired share links stay listed for
+// their owners before they're deleted
+const shareLinkRetention = 30 * 24 * time.Hour
+
+// What maintenance cleans up, as reported in runs and totals
+const (
+	cleanedMagicLinks    = "magicLinks"
+	cleanedExchangeCodes = "exchangeCodes"
+	cleanedShareLinks    = "shareLinks"
+	cleanedExports       = "exports"
+	cleanedWebSubs       = "websubSubscriptions"
+	cleanedTombstones    = "tombstones"
+	cleanedTrash         = "trashedTasks"
+	cleanedOrphans       = "orphanedRows"
+)
+
+// MaintenanceRun reports what one run cleaned up
+type MaintenanceRun struct {
+	StartedAt time.Time `json:"startedAt"`
+	Duration  float64   `json:"durationSeconds"`
+	// Rows, or in-memory entries for tokens, removed by kind
+	Cleaned map[string]int64 `json:"cleaned"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// MaintenanceStats counts what maintenance cleaned up since the server
+// started
+type MaintenanceStats struct {
+	Runs     int64            `json:"runs"`
+	Failures int64            `json:"failures"`
+	Cleaned  map[string]int64 `json:"cleaned"`
+	LastRun  *MaintenanceRun  `json:"lastRun,omitempty"`
+}
+
+// MaintenanceService purges expired tokens, old tombstones and rows left
+// behind by deleted users
+type MaintenanceService struct {
+	db                *DB
+	authService       *AuthService
+	attachmentService *AttachmentService
+	cfg               MaintenanceConfig
+
+	// Held for a whole run, so a manual run waits for a scheduled one
+	running sync.Mutex
+
+	mu    sync.Mutex
+	stats MaintenanceStats
+}
+
+func NewMaintenanceService(db *DB, authService *AuthService, attachmentService *AttachmentService, cfg MaintenanceConfig) *MaintenanceService {
+	return &MaintenanceService{
+		db:                db,
+		authService:       authService,
+		attachmentService: attachmentService,
+		cfg:               cfg,
+		stats:             MaintenanceStats{Cleaned: make(map[string]int64)},
+	}
+}
+
+// Run cleans up once. The run is recorded in the stats even when it fails
+// part way; what was cleaned before the failure is counted.
+func (s *MaintenanceService) Run(ctx context.Context) (*MaintenanceRun, error) {
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	run := &MaintenanceRun{StartedAt: time.Now().UTC(), Cleaned: make(map[string]int64)}
+	err := s.clean(ctx, run)
+	run.Duration = time.Since(run.StartedAt).Seconds()
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	s.mu.Lock()
+	s.stats.Runs++
+	if err != nil {
+		s.stats.Failures++
+	}
+	for kind, n := range run.Cleaned {
+		s.stats.Cleaned[kind] += n
+	}
+	s.stats.LastRun = run
+	s.mu.Unlock()
+
+	return run, err
+}
+
+func (s *MaintenanceService) clean(ctx context.Context, run *MaintenanceRun) error {
+	magicLinks, codes := s.authService.PurgeExpiredTokens()
+	run.Cleaned[cleanedMagicLinks] = int64(magicLinks)
+	run.Cleaned[cleanedExchangeCodes] = int64(codes)
+
+	now := time.Now().UTC()
+	expired := []struct {
+		kind, query string
+		before      time.Time
+	}{
+		{cleanedShareLinks, "DELETE FROM share_links WHERE expires_at <= ?", now.Add(-shareLinkRetention)},
+		{cleanedExports, "DELETE FROM exports WHERE expires_at <= ?", now},
+		{cleanedWebSubs, "DELETE FROM websub_subscriptions WHERE expires_at <= ?", now},
+	}
+	for _, e := range expired {
+		result, err := s.db.ExecContext(ctx, e.query, e.before)
+		if err != nil {
+			return fmt.Errorf("failed to delete expired %s: %w", e.kind, err)
+		}
+		run.Cleaned[e.kind] = rowsAffected(result)
+	}
+
+	n, err := s.pruneTombstones(ctx, now.Add(-s.cfg.TombstoneRetention))
+	if err != nil {
+		return err
+	}
+	run.Cleaned[cleanedTombstones] = n
+
+	n, err = s.purgeTrash(ctx, now.Add(-trashRetention))
+	if err != nil {
+		return err
+	}
+	run.Cleaned[cleanedTrash] = n
+
+	n, err = s.deleteOrphans(ctx)
+	if err != nil {
+		return err
+	}
+	run.Cleaned[cleanedOrphans] = n
+	return nil
+}
+
+// rowsAffected counts a statement's rows, or 0 when the driver can't
+func rowsAffected(result sql.Result) int64 {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// pruneTombstones deletes the board_changes tombstones recorded before the
+// cutoff. Each board remembers the newest version and the cutoff it lost,
+// so Changes can tell clients behind them to fetch the whole board.
+func (s *MaintenanceService) pruneTombstones(ctx context.Context, cutoff time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users SET
+			changes_pruned_version = (
+				SELECT MAX(version) FROM board_changes
+				WHERE board_changes.email = users.email AND removed = 1 AND changed_at < ?
+			),
+			changes_pruned_at = ?
+		WHERE email IN (SELECT email FROM board_changes WHERE removed = 1 AND changed_at < ?)
+	`, cutoff, cutoff, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record pruned board changes: %w", err)
+	}
+
+	result, err := tx.Exec("DELETE FROM board_changes WHERE removed = 1 AND changed_at < ?", cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete tombstones: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return rowsAffected(result), nil
+}
+
+// purgeTrash permanently deletes the tasks trashed before the cutoff, with
+// their comments and attachments
+func (s *MaintenanceService) purgeTrash(ctx context.Context, cutoff time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	const purged = "EXISTS (SELECT 1 FROM trashed_tasks t WHERE t.email = %[1]s.email AND t.task_id = %[1]s.task_id AND t.deleted_at <= ?)"
+	var files []Attachment
+	rows, err := tx.Query("SELECT storage_key FROM attachments WHERE "+fmt.Sprintf(purged, "attachments"), cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query purged attachments: %w", err)
+	}
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.storageKey); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan purged attachment: %w", err)
+		}
+		files = append(files, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate purged attachments: %w", err)
+	}
+
+	for _, table := range []string{"attachments", "comments"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE "+fmt.Sprintf(purged, table), cutoff); err != nil {
+			return 0, fmt.Errorf("failed to delete purged %s: %w", table, err)
+		}
+	}
+	result, err := tx.Exec("DELETE FROM trashed_tasks WHERE deleted_at <= ?", cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge trash: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.attachmentService.DeleteContent(ctx, files)
+	return rowsAffected(result), nil
+}
+
+// deleteOrphans deletes rows whose user is gone, e.g. left behind by an
+// account deletion that failed part way, along with their attachment files.
+// Tables are visited parents first, so rows of parents deleted here go too.
+func (s *MaintenanceService) deleteOrphans(ctx context.Context) (int64, error) {
+	var files []Attachment
+	rows, err := s.db.QueryContext(ctx, "SELECT storage_key FROM attachments WHERE email NOT IN (SELECT email FROM users)")
+	if err != nil {
+		return 0, fmt.Errorf("failed to query orphaned attachments: %w", err)
+	}
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.storageKey); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan orphaned attachment: %w", err)
+		}
+		files = append(files, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate orphaned attachments: %w", err)
+	}
+
+	var deleted int64
+	for i := len(accountTables) - 1; i >= 0; i-- {
+		table := accountTables[i]
+		if table.name == "users" {
+			continue
+		}
+		result, err := s.db.ExecContext(ctx, "DELETE FROM "+table.name+" WHERE "+table.orphanFilter())
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete orphaned rows from %s: %w", table.name, err)
+		}
+		if n := rowsAffected(result); n > 0 {
+			log.Printf("Deleted %d orphaned rows from %s", n, table.name)
+			deleted += n
+		}
+	}
+
+	s.attachmentService.DeleteContent(ctx, files)
+	return deleted, nil
+}
+
+// Stats returns the totals since the server started and the last run
+func (s *MaintenanceService) Stats() MaintenanceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	stats.Cleaned = make(map[string]int64, len(s.stats.Cleaned))
+	for kind, n := range s.stats.Cleaned {
+		stats.Cleaned[kind] = n
+	}
+	return stats
+}
+
+// RunSchedule runs maintenance once immediately and then on every interval
+// tick
+func (s *MaintenanceService) RunSchedule(interval time.Duration) {
+	maintain := func() {
+		run, err := s.Run(context.Background())
+		if err != nil {
+			log.Printf("Error running maintenance: %v", err)
+			return
+		}
+		var total int64
+		for _, n := range run.Cleaned {
+			total += n
+		}
+		if total > 0 {
+			log.Printf("Maintenance cleaned up %v", run.Cleaned)
+		}
+	}
+
+	maintain()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		maintain()
+	}
+}
+
+// MaintenanceHandler shows admins what maintenance cleaned up and runs it
+// on demand
+type MaintenanceHandler struct {
+	maintenanceService *MaintenanceService
+}
+
+func NewMaintenanceHandler(maintenanceService *MaintenanceService) *MaintenanceHandler {
+	return &MaintenanceHandler{maintenanceService: maintenanceService}
+}
+
+// Stats reports the totals since the server started and the last run
+func (h *MaintenanceHandler) Stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"stats":  h.maintenanceService.Stats(),
+	})
+}
+
+// Run runs maintenance now and reports what it cleaned up
+func (h *MaintenanceHandler) Run(w http.ResponseWriter, r *http.Request) {
+	run, err := h.maintenanceService.Run(r.Context())
+	if err != nil {
+		log.Printf("Error running maintenance: %v", err)
+		writeServerError(w, err, "Maintenance failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"run":    run,
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPruneTombstones(t *testing.T) {
+	s := newTestDataService(t)
+	maintenance := NewMaintenanceService(s.db, newTestAuthService(), nil, MaintenanceConfig{})
+	ctx := context.Background()
+	email := "a@example.com"
+
+	if err := s.SaveUserData(ctx, email, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+	if _, err := s.UpdateUserData(ctx, email, func(data *KanbanData) error {
+		data.Tasks = data.Tasks[1:]
+		return nil
+	}); err != nil {
+		t.Fatalf("UpdateUserData: %v", err)
+	}
+
+	if n, err := maintenance.pruneTombstones(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("pruneTombstones before the cutoff = %d, %v, want nothing pruned", n, err)
+	}
+	if n, err := maintenance.pruneTombstones(ctx, time.Now().Add(time.Minute)); err != nil || n != 1 {
+		t.Fatalf("pruneTombstones = %d, %v, want 1", n, err)
+	}
+
+	if _, err := s.Changes(ctx, email, 1, time.Time{}); err != errChangesPruned {
+		t.Errorf("Changes from before the pruned tombstone: %v, want %v", err, errChangesPruned)
+	}
+	if _, err := s.Changes(ctx, email, 0, time.Now().Add(-time.Hour)); err != errChangesPruned {
+		t.Errorf("Changes from a time before the cutoff: %v, want %v", err, errChangesPruned)
+	}
+	changes, err := s.Changes(ctx, email, 2, time.Time{})
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	if len(changes.Tombstones) != 0 {
+		t.Errorf("tombstones = %+v, want none", changes.Tombstones)
+	}
+}
+
+func TestMaintenanceDeletesOrphans(t *testing.T) {
+	s := newTestDataService(t)
+	maintenance := NewMaintenanceService(s.db, newTestAuthService(), nil, MaintenanceConfig{TombstoneRetention: time.Hour})
+	ctx := context.Background()
+
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		if err := s.SaveUserData(ctx, email, testBoard()); err != nil {
+			t.Fatalf("SaveUserData: %v", err)
+		}
+	}
+	// As left by an account deletion that stopped part way
+	if _, err := s.db.Exec("DELETE FROM users WHERE email = ?", "a@example.com"); err != nil {
+		t.Fatalf("deleting user: %v", err)
+	}
+
+	run, err := maintenance.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if run.Cleaned[cleanedOrphans] == 0 {
+		t.Errorf("cleaned = %v, want orphaned rows", run.Cleaned)
+	}
+
+	var boards int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM user_data").Scan(&boards); err != nil {
+		t.Fatalf("counting boards: %v", err)
+	}
+	if boards != 1 {
+		t.Errorf("%d boards left, want only b's", boards)
+	}
+
+	stats := maintenance.Stats()
+	if stats.Runs != 1 || stats.Failures != 0 || stats.Cleaned[cleanedOrphans] != run.Cleaned[cleanedOrphans] {
+		t.Errorf("stats = %+v, want one run counted", stats)
+	}
+}
+
+func TestPurgeExpiredTokens(t *testing.T) {
+	auth := newTestAuthService()
+	if _, err := auth.GenerateMagicLink("a@example.com", "http://localhost", "en"); err != nil {
+		t.Fatalf("GenerateMagicLink: %v", err)
+	}
+	auth.tokens["stale"] = magicLinkToken{email: "b@example.com", expires: time.Now().Add(-time.Second)}
+
+	if _, err := auth.VerifyMagicLinkToken("stale"); err == nil {
+		t.Error("expired magic link accepted")
+	}
+	if magicLinks, _ := auth.PurgeExpiredTokens(); magicLinks != 1 || len(auth.tokens) != 1 {
+		t.Errorf("purged %d magic links leaving %d, want 1 purged and 1 left", magicLinks, len(auth.tokens))
+	}
+}
+
+func TestTrashRestoreAndPurge(t *testing.T) {
+	s := newTestDataService(t)
+	trash := NewTrashService(s.db, s)
+	maintenance := NewMaintenanceService(s.db, newTestAuthService(), nil, MaintenanceConfig{})
+	ctx := context.Background()
+	email := "a@example.com"
+
+	if err := s.SaveUserData(ctx, email, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+	remove := func(data *KanbanData) error {
+		data.Tasks[0].Deleted = true
+		return nil
+	}
+	data, err := s.UpdateUserData(ctx, email, remove)
+	if err != nil {
+		t.Fatalf("UpdateUserData: %v", err)
+	}
+	if len(data.Tasks) != 0 {
+		t.Errorf("tasks = %+v, want the deleted task off the board", data.Tasks)
+	}
+	trashed, err := trash.List(email)
+	if err != nil || len(trashed) != 1 || trashed[0].Task.ID != "t1" || trashed[0].Task.Deleted {
+		t.Fatalf("List = %+v, %v, want t1", trashed, err)
+	}
+
+	data, err = trash.Restore(ctx, email, "t1")
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if len(data.Tasks) != 1 || data.Tasks[0].Title != "Write tests" || *data.Tasks[0].ColumnID != "todo" {
+		t.Errorf("restored tasks = %+v, want t1 back in todo", data.Tasks)
+	}
+
+	// Once the restore window has passed, it's gone for good
+	if _, err := s.UpdateUserData(ctx, email, remove); err != nil {
+		t.Fatalf("UpdateUserData: %v", err)
+	}
+	old := time.Now().UTC().Add(-trashRetention - time.Hour)
+	if _, err := s.db.Exec("UPDATE trashed_tasks SET deleted_at = ?", old); err != nil {
+		t.Fatalf("backdating trash: %v", err)
+	}
+	if trashed, err := trash.List(email); err != nil || len(trashed) != 0 {
+		t.Errorf("List = %+v, %v, want nothing past the window", trashed, err)
+	}
+	if _, err := trash.Restore(ctx, email, "t1"); err != errTrashedTaskNotFound {
+		t.Errorf("Restore past the window: %v, want %v", err, errTrashedTaskNotFound)
+	}
+	run, err := maintenance.Run(ctx)
+	if err != nil || run.Cleaned[cleanedTrash] != 1 {
+		t.Errorf("Run = %+v, %v, want 1 trashed task purged", run, err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// unassignedHeading is the Markdown section used for tasks without a column
+const unassignedHeading = "Unassigned"
+
+// maxMarkdownImportSize caps the size of an uploaded Markdown document
+const maxMarkdownImportSize = 1024 * 1024 // 1MB
+
+// writeBoardMarkdown renders a board as a Markdown checklist: one "##"
+// heading per column followed by "- [ ]" items, with descriptions indented
+// beneath their task
+func writeBoardMarkdown(w io.Writer, export *BoardExport) error {
+	tasksByColumn := make(map[string][]Task)
+	var unassigned []Task
+	for _, task := range export.Tasks {
+		if task.ColumnID == nil {
+			unassigned = append(unassigned, task)
+			continue
+		}
+		tasksByColumn[*task.ColumnID] = append(tasksByColumn[*task.ColumnID], task)
+	}
+
+	writeSection := func(title string, tasks []Task) error {
+		if _, err := fmt.Fprintf(w, "## %s\n\n", title); err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			if _, err := fmt.Fprintf(w, "- [ ] %s\n", task.Title); err != nil {
+				return err
+			}
+			for _, line := range strings.Split(strings.TrimSpace(task.Description), "\n") {
+				if line == "" {
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "  %s\n", line); err != nil {
+					return err
+				}
+			}
+		}
+		_, err := fmt.Fprintln(w)
+		return err
+	}
+
+	if len(unassigned) > 0 {
+		if err := writeSection(unassignedHeading, unassigned); err != nil {
+			return err
+		}
+	}
+
+	for _, col := range sortedColumns(export.Columns) {
+		if err := writeSection(col.Title, tasksByColumn[col.ID]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// markdownSection is a parsed "##" heading with its checklist items
+type markdownSection struct {
+	Title string
+	Tasks []Task
+}
+
+// parseMarkdownChecklist reads "## Heading" sections and "- [ ] item" lines.
+// Items that appear before any heading, or under the Unassigned heading, are
+// returned with an empty section title. Indented lines following an item
+// become its description.
+func parseMarkdownChecklist(r io.Reader) ([]markdownSection, error) {
+	sections := []markdownSection{{}}
+	current := &sections[0]
+	var lastTask *Task
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+
+		switch {
+		case strings.HasPrefix(line, "## "):
+			title := strings.TrimSpace(strings.TrimPrefix(line, "## "))
+			if strings.EqualFold(title, unassignedHeading) {
+				title = ""
+			}
+			sections = append(sections, markdownSection{Title: title})
+			current = &sections[len(sections)-1]
+			lastTask = nil
+		case strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* "):
+			title := strings.TrimSpace(line[2:])
+			for _, box := range []string{"[ ]", "[x]", "[X]"} {
+				title = strings.TrimSpace(strings.TrimPrefix(title, box))
+			}
+			if title == "" {
+				continue
+			}
+			current.Tasks = append(current.Tasks, Task{Title: title})
+			lastTask = &current.Tasks[len(current.Tasks)-1]
+		case line != "" && lastTask != nil && raw != line:
+			// Indented continuation lines belong to the previous item
+			if lastTask.Description != "" {
+				lastTask.Description += "\n"
+			}
+			lastTask.Description += line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return sections, nil
+}
+
+// applyMarkdownImport adds the parsed sections to a board. Sections reuse a
+// live column with the same title (case-insensitive) or create a new one.
+// It returns the number of columns and tasks created.
+func applyMarkdownImport(data *KanbanData, sections []markdownSection) (int, int) {
+	columnIDs := make(map[string]string)
+	maxOrder := -1
+	for _, col := range data.Columns {
+		if col.Order > maxOrder {
+			maxOrder = col.Order
+		}
+		if !col.Deleted {
+			columnIDs[normalizeColumnTitle(col.Title)] = col.ID
+		}
+	}
+
+	columnsCreated, tasksCreated := 0, 0
+	for _, section := range sections {
+		var columnID *string
+		if section.Title != "" {
+			key := normalizeColumnTitle(section.Title)
+			id, exists := columnIDs[key]
+			if !exists {
+				id = generateID()
+				maxOrder++
+				data.Columns = append(data.Columns, Column{ID: id, Title: section.Title, Order: maxOrder})
+				columnIDs[key] = id
+				columnsCreated++
+			}
+			columnID = &id
+		}
+
+		for _, task := range section.Tasks {
+			task.ID = generateID()
+			task.ColumnID = columnID
+			data.Tasks = append(data.Tasks, task)
+			tasksCreated++
+		}
+	}
+
+	return columnsCreated, tasksCreated
+}
+
+// ImportMarkdown adds columns and tasks from a Markdown checklist to the
+// user's board, or the workspace board named by ?board=
+func (h *DataHandler) ImportMarkdown(w http.ResponseWriter, r *http.Request) {
+	board := canonicalBoardID(requestEmail(r), queryBoard(r))
+
+	sections, err := parseMarkdownChecklist(http.MaxBytesReader(w, r.Body, maxMarkdownImportSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid Markdown document")
+		return
+	}
+
+	var columnsCreated, tasksCreated int
+	data, err := h.dataService.UpdateUserData(r.Context(), board, func(data *KanbanData) error {
+		columnsCreated, tasksCreated = applyMarkdownImport(data, sections)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error importing Markdown: %v", err)
+		writeServerError(w, err, "Failed to save data")
+		return
+	}
+
+	// Let connected clients pick up the imported items
+	h.hub.PublishBoard(board, WebSocketMessage{Type: "sync", Data: data}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":         "success",
+		"columnsCreated": columnsCreated,
+		"tasksCreated":   tasksCreated,
+		"data":           data,
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Merge strategies for full syncs:
+//
+//	POST /api/data/sync?strategy=serverWins
+//
+// A full sync merges the client's board into the server's. Items only one
+// side has are kept; for tasks, columns and swimlanes both sides have but
+// disagree on, the strategy picks which copy is saved:
+//
+//	clientWins     the client's (the default)
+//	serverWins     the server's
+//	lastWriteWins  the server's if it changed after the board version the
+//	               client sent, otherwise the client's
+//	manual         the server's, for the client to resolve and sync again
+//
+// Without the parameter, the user's mergeStrategy setting is used. The
+// version at which each server item last changed comes from board_changes;
+// a client that doesn't send its version is taken to have written last.
+//
+// The response's "conflicts" lists, field by field, where the saved board
+// differs from what the client sent, and why: the strategy's name when it
+// kept the server's copy, "locked" for items another client has locked,
+// "dropped" for items no longer on the board (archived, or folded into
+// another column), and "changed" for other changes made while saving. It's
+// left out when there are none, except with manual, which always has it.
+
+// Merge strategy names
+const (
+	mergeClientWins    = "clientWins"
+	mergeServerWins    = "serverWins"
+	mergeLastWriteWins = "lastWriteWins"
+	mergeManual        = "manual"
+)
+
+// mergeStrategyNames lists the strategies in the order they're documented
+var mergeStrategyNames = []string{mergeClientWins, mergeServerWins, mergeLastWriteWins, mergeManual}
+
+// MergeStrategy decides which copy of an item a full sync saves
+type MergeStrategy interface {
+	// KeepServer reports whether the item keeps the server's copy
+	KeepServer(item MergeItem) bool
+}
+
+// MergeItem is a task, column or swimlane whose client and server copies
+// differ
+type MergeItem struct {
+	Type      string
+	ID        string
+	Conflicts []MergeConflict
+
+	// Board version the client's copy was based on; 0 when it didn't say
+	ClientVersion int64
+
+	// Version at which the server's copy last changed; 0 when unknown
+	ServerVersion int64
+}
+
+// MergeConflict is a field of an item that the client's and the server's
+// copies disagree on. An item dropped whole has no field, and its
+// clientValue is the item.
+type MergeConflict struct {
+	Type        string `json:"type"` // task, column or swimlane
+	ID          string `json:"id"`
+	Field       string `json:"field,omitempty"`
+	ClientValue any    `json:"clientValue"`
+	ServerValue any    `json:"serverValue"`
+	Resolution  string `json:"resolution,omitempty"`
+}
+
+// Resolutions of conflicts other than a strategy's
+const (
+	resolutionLocked  = "locked"
+	resolutionDropped = "dropped"
+	resolutionChanged = "changed"
+)
+
+type clientWins struct{}
+
+func (clientWins) KeepServer(MergeItem) bool { return false }
+
+type serverWins struct{}
+
+func (serverWins) KeepServer(MergeItem) bool { return true }
+
+type lastWriteWins struct{}
+
+func (lastWriteWins) KeepServer(item MergeItem) bool {
+	return item.ClientVersion > 0 && item.ServerVersion > item.ClientVersion
+}
+
+// manualMerge keeps the server's copy until the client has resolved the
+// conflicts
+type manualMerge struct{}
+
+func (manualMerge) KeepServer(MergeItem) bool { return true }
+
+var mergeStrategies = map[string]MergeStrategy{
+	mergeClientWins:    clientWins{},
+	mergeServerWins:    serverWins{},
+	mergeLastWriteWins: lastWriteWins{},
+	mergeManual:        manualMerge{},
+}
+
+// validMergeStrategy reports whether name is a merge strategy, or "" for
+// the default
+func validMergeStrategy(name string) bool {
+	_, ok := mergeStrategies[name]
+	return ok || name == ""
+}
+
+// invalidMergeStrategy describes a strategy that isn't one of the names
+func invalidMergeStrategy(field string) FieldError {
+	return FieldError{Field: field, Message: "must be one of " + strings.Join(mergeStrategyNames, ", ")}
+}
+
+// applyMergeStrategy puts back into merged, a board from mergeKanbanData,
+// the server's copy of the items the strategy keeps, and returns them.
+// clientVersion is the board version the client sent. versions, which
+// returns the version at which each server item last changed, is only
+// called when items differ.
+func applyMergeStrategy(serverData, merged *KanbanData, clientVersion int64, strategy MergeStrategy, versions func() (map[boardItemKey]int64, error)) (map[boardItemKey]bool, error) {
+	if _, ok := strategy.(clientWins); ok {
+		return nil, nil
+	}
+
+	server := boardItems(serverData)
+	var changed map[boardItemKey]int64
+	kept := make(map[boardItemKey]bool)
+	resolve := func(key boardItemKey, item any) (any, error) {
+		serverItem, ok := server[key]
+		if !ok {
+			return item, nil
+		}
+		conflicts := itemConflicts(key, item, serverItem)
+		if len(conflicts) == 0 {
+			return item, nil
+		}
+		if changed == nil {
+			var err error
+			if changed, err = versions(); err != nil {
+				return nil, err
+			}
+		}
+		candidate := MergeItem{
+			Type:          key.kind,
+			ID:            key.id,
+			Conflicts:     conflicts,
+			ClientVersion: clientVersion,
+			ServerVersion: changed[key],
+		}
+		if !strategy.KeepServer(candidate) {
+			return item, nil
+		}
+		kept[key] = true
+		return serverItem, nil
+	}
+
+	for i, col := range merged.Columns {
+		item, err := resolve(boardItemKey{changeColumn, col.ID}, col)
+		if err != nil {
+			return nil, err
+		}
+		merged.Columns[i] = item.(Column)
+	}
+	for i, lane := range merged.Swimlanes {
+		item, err := resolve(boardItemKey{changeSwimlane, lane.ID}, lane)
+		if err != nil {
+			return nil, err
+		}
+		merged.Swimlanes[i] = item.(Swimlane)
+	}
+	for i, task := range merged.Tasks {
+		item, err := resolve(boardItemKey{changeTask, task.ID}, task)
+		if err != nil {
+			return nil, err
+		}
+		merged.Tasks[i] = item.(Task)
+	}
+	if len(kept) > 0 {
+		leaveDeletedSwimlanes(merged)
+	}
+	return kept, nil
+}
+
+// syncConflicts lists where saved differs from requested, the board the
+// client asked for, in the items the client sent. kept are the items the
+// strategy kept the server's copy of, and locked the locks whose items
+// were kept.
+func syncConflicts(clientData, requested, saved *KanbanData, strategy string, kept map[boardItemKey]bool, locked []EditLock) []MergeConflict {
+	sent := boardItems(clientData)
+	final := boardItems(saved)
+	var conflicts []MergeConflict
+	report := func(key boardItemKey, item any) {
+		if _, ok := sent[key]; !ok {
+			return
+		}
+		savedItem, ok := final[key]
+		if !ok {
+			conflicts = append(conflicts, MergeConflict{Type: key.kind, ID: key.id, ClientValue: item, Resolution: resolutionDropped})
+			return
+		}
+		resolution := resolutionChanged
+		switch {
+		case kept[key]:
+			resolution = strategy
+		case locksCover(locked, key, item, savedItem):
+			resolution = resolutionLocked
+		}
+		for _, conflict := range itemConflicts(key, item, savedItem) {
+			conflict.Resolution = resolution
+			conflicts = append(conflicts, conflict)
+		}
+	}
+
+	for _, col := range requested.Columns {
+		report(boardItemKey{changeColumn, col.ID}, col)
+	}
+	for _, lane := range requested.Swimlanes {
+		report(boardItemKey{changeSwimlane, lane.ID}, lane)
+	}
+	for _, task := range requested.Tasks {
+		report(boardItemKey{changeTask, task.ID}, task)
+	}
+	return conflicts
+}
+
+// serverFilledFields are taken from the server's copy on save when a client
+// leaves them out, so leaving them out isn't a disagreement
+var serverFilledFields = map[string]bool{"language": true, "completedAt": true}
+
+// itemConflicts lists the fields in which two copies of an item differ.
+// Empty and missing lists are the same.
+func itemConflicts(key boardItemKey, client, server any) []MergeConflict {
+	clientValue, serverValue := reflect.ValueOf(client), reflect.ValueOf(server)
+	var conflicts []MergeConflict
+	for i := 0; i < clientValue.NumField(); i++ {
+		a, b := clientValue.Field(i), serverValue.Field(i)
+		field := jsonFieldName(clientValue.Type().Field(i))
+		if serverFilledFields[field] && a.IsZero() {
+			continue
+		}
+		if a.Kind() == reflect.Slice && a.Len() == 0 && b.Len() == 0 {
+			continue
+		}
+		if reflect.DeepEqual(a.Interface(), b.Interface()) {
+			continue
+		}
+		conflicts = append(conflicts, MergeConflict{
+			Type:        key.kind,
+			ID:          key.id,
+			Field:       field,
+			ClientValue: a.Interface(),
+			ServerValue: b.Interface(),
+		})
+	}
+	return conflicts
+}
+
+// jsonFieldName returns the name a struct field is marshalled under
+func jsonFieldName(field reflect.StructField) string {
+	if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" {
+		return name
+	}
+	return field.Name
+}
+
+// itemVersions returns the version at which each of a board's items last
+// changed
+func itemVersions(tx *Tx, email string) (map[boardItemKey]int64, error) {
+	rows, err := tx.Query("SELECT item_type, item_id, version FROM board_changes WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query board changes: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make(map[boardItemKey]int64)
+	for rows.Next() {
+		var key boardItemKey
+		var version int64
+		if err := rows.Scan(&key.kind, &key.id, &version); err != nil {
+			return nil, fmt.Errorf("failed to scan board change: %w", err)
+		}
+		versions[key] = version
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate board changes: %w", err)
+	}
+	return versions, nil
+}
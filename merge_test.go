@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// mergeInput is a server and client board for property tests of
+// mergeKanbanData. Both draw IDs from the same small pools so they overlap,
+// and tasks may sit in the legacy unassignedTasks array, in tasks, or both.
+type mergeInput struct {
+	Server, Client *KanbanData
+}
+
+func (mergeInput) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(mergeInput{
+		Server: randomBoard(r, "server"),
+		Client: randomBoard(r, "client"),
+	})
+}
+
+// GoString shows the boards in failure messages
+func (in mergeInput) GoString() string {
+	return fmt.Sprintf("server %+v, client %+v", *in.Server, *in.Client)
+}
+
+// randomBoard builds a board whose task titles start with side, so merged
+// tasks can be traced back to the board they came from
+func randomBoard(r *rand.Rand, side string) *KanbanData {
+	pick := func(options ...string) *string {
+		choice := options[r.Intn(len(options))]
+		if choice == "nil" {
+			return nil
+		}
+		return &choice
+	}
+	randomTask := func(id string) Task {
+		return Task{
+			ID:         id,
+			Title:      fmt.Sprintf("%s %s %d", side, id, r.Intn(3)),
+			ColumnID:   pick("nil", "", "unassigned", "c0", "c1", "c2", "c3"),
+			SwimlaneID: pick("nil", "", "l0", "l1", "l2"),
+			Deleted:    r.Intn(5) == 0,
+		}
+	}
+
+	board := &KanbanData{Columns: []Column{}, Tasks: []Task{}, UnassignedCollapsed: r.Intn(2) == 0}
+	for i := 0; i < 4; i++ {
+		if r.Intn(2) == 0 {
+			board.Columns = append(board.Columns, Column{ID: fmt.Sprintf("c%d", i), Title: side, Order: r.Intn(4), Deleted: r.Intn(5) == 0})
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if r.Intn(2) == 0 {
+			board.Swimlanes = append(board.Swimlanes, Swimlane{ID: fmt.Sprintf("l%d", i), Title: side, Deleted: r.Intn(5) == 0})
+		}
+	}
+	for _, i := range r.Perm(10) {
+		id := fmt.Sprintf("t%d", i)
+		if r.Intn(5) < 2 {
+			board.Tasks = append(board.Tasks, randomTask(id))
+		}
+		if r.Intn(7) == 0 {
+			board.UnassignedTasks = append(board.UnassignedTasks, randomTask(id))
+		}
+	}
+	return board
+}
+
+// checkMerge runs a property against many generated inputs
+func checkMerge(t *testing.T, property func(in mergeInput) bool) {
+	t.Helper()
+	if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// boardTaskIDs returns the distinct task IDs on a board, in both arrays
+func boardTaskIDs(data *KanbanData) map[string]bool {
+	ids := make(map[string]bool)
+	for _, tasks := range [][]Task{data.Tasks, data.UnassignedTasks} {
+		for _, task := range tasks {
+			ids[task.ID] = true
+		}
+	}
+	return ids
+}
+
+func sortedIDs(ids map[string]bool) []string {
+	sorted := make([]string, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func TestMergeKeepsEveryTaskOnce(t *testing.T) {
+	checkMerge(t, func(in mergeInput) bool {
+		merged := mergeKanbanData(in.Server, in.Client)
+
+		want := boardTaskIDs(in.Server)
+		for id := range boardTaskIDs(in.Client) {
+			want[id] = true
+		}
+		seen := make(map[string]bool)
+		for _, task := range merged.Tasks {
+			if seen[task.ID] || !want[task.ID] {
+				return false
+			}
+			seen[task.ID] = true
+		}
+		return len(seen) == len(want) && len(merged.UnassignedTasks) == 0
+	})
+}
+
+func TestMergePrefersClientTasks(t *testing.T) {
+	checkMerge(t, func(in mergeInput) bool {
+		merged := mergeKanbanData(in.Server, in.Client)
+		client := boardTaskIDs(in.Client)
+		for _, task := range merged.Tasks {
+			fromClient := strings.HasPrefix(task.Title, "client ")
+			if client[task.ID] != fromClient {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestMergePrefersCurrentTasksOverLegacyUnassigned(t *testing.T) {
+	checkMerge(t, func(in mergeInput) bool {
+		merged := mergeKanbanData(in.Server, in.Client)
+		current := make(map[string]Task)
+		for _, task := range in.Client.Tasks {
+			current[task.ID] = task
+		}
+		for _, task := range merged.Tasks {
+			if want, ok := current[task.ID]; ok && task.Title != want.Title {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestMergeNormalizesColumnsAndLanes(t *testing.T) {
+	checkMerge(t, func(in mergeInput) bool {
+		merged := mergeKanbanData(in.Server, in.Client)
+		liveLanes := make(map[string]bool)
+		for _, lane := range merged.Swimlanes {
+			if !lane.Deleted {
+				liveLanes[lane.ID] = true
+			}
+		}
+		legacy := make(map[string]bool)
+		for _, task := range in.Client.UnassignedTasks {
+			legacy[task.ID] = true
+		}
+
+		for _, task := range merged.Tasks {
+			if task.ColumnID != nil && (*task.ColumnID == "" || *task.ColumnID == "unassigned") {
+				return false
+			}
+			if task.SwimlaneID != nil && !liveLanes[*task.SwimlaneID] {
+				return false
+			}
+		}
+		// Tasks taken from the client's legacy array have no column
+		for _, task := range merged.Tasks {
+			inCurrent := false
+			for _, current := range in.Client.Tasks {
+				inCurrent = inCurrent || current.ID == task.ID
+			}
+			if legacy[task.ID] && !inCurrent && task.ColumnID != nil {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestMergeIsIdempotent(t *testing.T) {
+	checkMerge(t, func(in mergeInput) bool {
+		merged := mergeKanbanData(in.Server, in.Client)
+
+		// Syncing the same client state again changes nothing
+		if !reflect.DeepEqual(mergeKanbanData(merged, in.Client), merged) {
+			return false
+		}
+		// Nor does a client that's already up to date
+		return reflect.DeepEqual(mergeKanbanData(merged, merged), merged)
+	})
+}
+
+func TestMergeIsDeterministic(t *testing.T) {
+	checkMerge(t, func(in mergeInput) bool {
+		return reflect.DeepEqual(mergeKanbanData(in.Server, in.Client), mergeKanbanData(in.Server, in.Client))
+	})
+}
+
+// The merge favours the client's copy of an item, so it isn't commutative;
+// but which items survive doesn't depend on which side sent them
+func TestMergeItemsCommute(t *testing.T) {
+	checkMerge(t, func(in mergeInput) bool {
+		ab := mergeKanbanData(in.Server, in.Client)
+		ba := mergeKanbanData(in.Client, in.Server)
+
+		columnIDs := func(data *KanbanData) map[string]bool {
+			ids := make(map[string]bool)
+			for _, col := range data.Columns {
+				ids[col.ID] = true
+			}
+			return ids
+		}
+		laneIDs := func(data *KanbanData) map[string]bool {
+			ids := make(map[string]bool)
+			for _, lane := range data.Swimlanes {
+				ids[lane.ID] = true
+			}
+			return ids
+		}
+		return reflect.DeepEqual(sortedIDs(boardTaskIDs(ab)), sortedIDs(boardTaskIDs(ba))) &&
+			reflect.DeepEqual(sortedIDs(columnIDs(ab)), sortedIDs(columnIDs(ba))) &&
+			reflect.DeepEqual(sortedIDs(laneIDs(ab)), sortedIDs(laneIDs(ba)))
+	})
+}
+
+func TestMergeStrategies(t *testing.T) {
+	server := testBoard()
+	server.Version = 5
+	server.Tasks[0].Title = "Server title"
+	client := testBoard()
+	client.Tasks[0].Title = "Client title"
+	client.Tasks = append(client.Tasks, Task{ID: "t2", Title: "New", ColumnID: strPtr("todo")})
+
+	// t1 last changed on the server at version 4
+	versions := func() (map[boardItemKey]int64, error) {
+		return map[boardItemKey]int64{{changeTask, "t1"}: 4}, nil
+	}
+	tests := []struct {
+		strategy      string
+		clientVersion int64
+		want          string
+	}{
+		{mergeClientWins, 3, "Client title"},
+		{mergeServerWins, 5, "Server title"},
+		{mergeLastWriteWins, 3, "Server title"},
+		{mergeLastWriteWins, 4, "Client title"},
+		{mergeLastWriteWins, 0, "Client title"},
+		{mergeManual, 5, "Server title"},
+	}
+	for _, tc := range tests {
+		client.Version = tc.clientVersion
+		requested := mergeKanbanData(server, client)
+		merged := cloneKanbanData(requested)
+		kept, err := applyMergeStrategy(server, merged, client.Version, mergeStrategies[tc.strategy], versions)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.strategy, err)
+		}
+		if len(merged.Tasks) != 2 || merged.Tasks[0].Title != tc.want {
+			t.Errorf("%s from version %d: tasks = %+v, want t1 titled %q and t2", tc.strategy, tc.clientVersion, merged.Tasks, tc.want)
+		}
+
+		// Only the differing field of the items put back is reported
+		conflicts := syncConflicts(client, requested, merged, tc.strategy, kept, nil)
+		want := []MergeConflict{}
+		if tc.want == "Server title" {
+			want = append(want, MergeConflict{Type: changeTask, ID: "t1", Field: "title", ClientValue: "Client title", ServerValue: "Server title", Resolution: tc.strategy})
+		}
+		if len(conflicts) != len(want) || (len(want) > 0 && conflicts[0] != want[0]) {
+			t.Errorf("%s from version %d: conflicts = %+v, want %+v", tc.strategy, tc.clientVersion, conflicts, want)
+		}
+	}
+}
+
+func TestSyncConflictsResolutions(t *testing.T) {
+	client := testBoard()
+	client.Columns = append(client.Columns, Column{ID: "todo2", Title: "To Do", Order: 2})
+	client.Tasks = append(client.Tasks,
+		Task{ID: "t2", Title: "Mine", ColumnID: strPtr("todo2")},
+		Task{ID: "t3", Title: "Archived", ColumnID: strPtr("done")},
+	)
+	requested := mergeKanbanData(&KanbanData{}, client)
+
+	// t1 was locked, the duplicate column folded into todo along with t2,
+	// and t3 archived
+	saved := testBoard()
+	saved.Tasks = append(saved.Tasks, Task{ID: "t2", Title: "Mine", ColumnID: strPtr("todo")})
+	saved.Tasks[0].Title = "Theirs"
+	locked := []EditLock{{Kind: LockTask, ID: "t1"}}
+
+	got := make(map[string]string)
+	for _, conflict := range syncConflicts(client, requested, saved, mergeClientWins, nil, locked) {
+		got[conflict.ID+"."+conflict.Field] = conflict.Resolution
+	}
+	want := map[string]string{
+		"todo2.":      resolutionDropped,
+		"t1.title":    resolutionLocked,
+		"t2.columnId": resolutionChanged,
+		"t3.":         resolutionDropped,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resolutions = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	providerMicrosoftTodo = "microsoft_todo"
+
+	microsoftLoginURL  = "https://login.microsoftonline.com/"
+	microsoftGraphAPI  = "https://graph.microsoft.com/v1.0"
+	microsoftTodoScope = "offline_access Tasks.ReadWrite"
+)
+
+// graphDateTime is a Microsoft Graph dateTimeTimeZone
+type graphDateTime struct {
+	DateTime string `json:"dateTime"`
+	TimeZone string `json:"timeZone"`
+}
+
+// todoTask is a task in the Microsoft To Do API
+type todoTask struct {
+	ID    string `json:"id,omitempty"`
+	Title string `json:"title"`
+	Body  struct {
+		Content     string `json:"content"`
+		ContentType string `json:"contentType"`
+	} `json:"body"`
+	DueDateTime          *graphDateTime `json:"dueDateTime"`
+	Status               string         `json:"status,omitempty"`
+	LastModifiedDateTime string         `json:"lastModifiedDateTime,omitempty"`
+	Removed              *struct{}      `json:"@removed,omitempty"`
+}
+
+// MicrosoftTodoProvider mirrors boards with Microsoft To Do lists, which
+// also appear as tasks in Outlook. Remote changes are read from the list's
+// delta query, whose deltaLink is the sync cursor.
+type MicrosoftTodoProvider struct {
+	oauth  *oauthClient
+	client *http.Client
+}
+
+// NewMicrosoftTodoProvider creates the provider for an Entra ID tenant;
+// "common" accepts both work and personal accounts
+func NewMicrosoftTodoProvider(cfg OAuthClientConfig, tenant string) *MicrosoftTodoProvider {
+	client := &http.Client{Timeout: 30 * time.Second}
+	base := microsoftLoginURL + url.PathEscape(tenant) + "/oauth2/v2.0"
+	return &MicrosoftTodoProvider{
+		oauth: &oauthClient{
+			cfg:      cfg,
+			authURL:  base + "/authorize",
+			tokenURL: base + "/token",
+			scope:    microsoftTodoScope,
+			client:   client,
+		},
+		client: client,
+	}
+}
+
+func (p *MicrosoftTodoProvider) OAuth() *oauthClient {
+	return p.oauth
+}
+
+// listID returns the connection's list, looking up the default "Tasks"
+// list when none is configured
+func (p *MicrosoftTodoProvider) listID(ctx context.Context, token string, c *ExternalConnection) (string, error) {
+	if c.RemoteListID != "" {
+		return c.RemoteListID, nil
+	}
+
+	var lists struct {
+		Value []struct {
+			ID                string `json:"id"`
+			WellknownListName string `json:"wellknownListName"`
+		} `json:"value"`
+	}
+	if err := doJSON(ctx, p.client, token, http.MethodGet, microsoftGraphAPI+"/me/todo/lists", nil, &lists); err != nil {
+		return "", err
+	}
+	for _, list := range lists.Value {
+		if list.WellknownListName == "defaultList" {
+			// Remembered for the rest of this sync
+			c.RemoteListID = list.ID
+			return list.ID, nil
+		}
+	}
+	return "", &remoteError{Method: http.MethodGet, URL: "/me/todo/lists", StatusCode: http.StatusNotFound, Detail: "no default task list"}
+}
+
+// tasksURL returns the URL of the connection's task list, or of one task in it
+func (p *MicrosoftTodoProvider) tasksURL(ctx context.Context, token string, c *ExternalConnection, taskID string) (string, error) {
+	listID, err := p.listID(ctx, token, c)
+	if err != nil {
+		return "", err
+	}
+	u := microsoftGraphAPI + "/me/todo/lists/" + url.PathEscape(listID) + "/tasks"
+	if taskID != "" {
+		u += "/" + url.PathEscape(taskID)
+	}
+	return u, nil
+}
+
+func toTodoTask(task RemoteTask) todoTask {
+	remote := todoTask{Title: task.Title}
+	remote.Body.Content = task.Notes
+	remote.Body.ContentType = "text"
+	if task.Due != "" {
+		remote.DueDateTime = &graphDateTime{DateTime: task.Due + "T00:00:00", TimeZone: "UTC"}
+	}
+	return remote
+}
+
+func (p *MicrosoftTodoProvider) ListChanges(ctx context.Context, token string, c *ExternalConnection) ([]RemoteTask, string, error) {
+	next := c.cursor
+	if next == "" {
+		tasksURL, err := p.tasksURL(ctx, token, c, "")
+		if err != nil {
+			return nil, "", err
+		}
+		next = tasksURL + "/delta"
+	}
+
+	var tasks []RemoteTask
+	for {
+		var page struct {
+			Value     []todoTask `json:"value"`
+			NextLink  string     `json:"@odata.nextLink"`
+			DeltaLink string     `json:"@odata.deltaLink"`
+		}
+		if err := doJSON(ctx, p.client, token, http.MethodGet, next, nil, &page); err != nil {
+			return nil, "", err
+		}
+
+		for _, item := range page.Value {
+			due := ""
+			if item.DueDateTime != nil && len(item.DueDateTime.DateTime) >= 10 {
+				due = normalizeDueDate(item.DueDateTime.DateTime[:10])
+			}
+			updated, _ := time.Parse(time.RFC3339, item.LastModifiedDateTime)
+			tasks = append(tasks, RemoteTask{
+				ID:        item.ID,
+				Title:     item.Title,
+				Notes:     item.Body.Content,
+				Due:       due,
+				Completed: item.Status == "completed",
+				Deleted:   item.Removed != nil,
+				Updated:   updated,
+			})
+		}
+
+		if page.NextLink == "" {
+			return tasks, page.DeltaLink, nil
+		}
+		next = page.NextLink
+	}
+}
+
+func (p *MicrosoftTodoProvider) CreateTask(ctx context.Context, token string, c *ExternalConnection, task RemoteTask) (string, error) {
+	tasksURL, err := p.tasksURL(ctx, token, c, "")
+	if err != nil {
+		return "", err
+	}
+	var created todoTask
+	if err := doJSON(ctx, p.client, token, http.MethodPost, tasksURL, toTodoTask(task), &created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func (p *MicrosoftTodoProvider) UpdateTask(ctx context.Context, token string, c *ExternalConnection, id string, task RemoteTask) error {
+	taskURL, err := p.tasksURL(ctx, token, c, id)
+	if err != nil {
+		return err
+	}
+	return doJSON(ctx, p.client, token, http.MethodPatch, taskURL, toTodoTask(task), nil)
+}
+
+func (p *MicrosoftTodoProvider) DeleteTask(ctx context.Context, token string, c *ExternalConnection, id string) error {
+	taskURL, err := p.tasksURL(ctx, token, c, id)
+	if err != nil {
+		return err
+	}
+	return doJSON(ctx, p.client, token, http.MethodDelete, taskURL, nil, nil)
+}
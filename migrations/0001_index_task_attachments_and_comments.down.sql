@@ -0,0 +1,2 @@
+DROP INDEX idx_comments_task;
+DROP INDEX idx_attachments_task;
@@ -0,0 +1,3 @@
+-- Attachments and comments are listed per task
+CREATE INDEX idx_attachments_task ON attachments (email, task_id, created_at);
+CREATE INDEX idx_comments_task ON comments (email, task_id, created_at);
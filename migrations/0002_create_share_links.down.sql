@@ -0,0 +1,2 @@
+DROP INDEX idx_share_links_board;
+DROP TABLE share_links;
@@ -0,0 +1,15 @@
+-- Read-only public links to a board; only a hash of each link's token is
+-- kept
+CREATE TABLE share_links (
+	id TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	board TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	prefix TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	views INTEGER NOT NULL DEFAULT 0,
+	last_viewed_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (email) REFERENCES users(email)
+);
+CREATE INDEX idx_share_links_board ON share_links (board, created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN changes_pruned_at;
+ALTER TABLE users DROP COLUMN changes_pruned_version;
@@ -0,0 +1,4 @@
+-- Maintenance deletes old tombstones from board_changes; clients catching
+-- up from before the newest deleted one must fetch the whole board
+ALTER TABLE users ADD COLUMN changes_pruned_version INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN changes_pruned_at TIMESTAMP;
@@ -0,0 +1 @@
+DROP TABLE crdt_documents;
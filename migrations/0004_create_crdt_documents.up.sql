@@ -0,0 +1,8 @@
+-- The experimental CRDT engine's copy of each board it shadows (users with
+-- the crdt_sync flag), with what each syncing client last received
+CREATE TABLE crdt_documents (
+	email TEXT PRIMARY KEY,
+	document TEXT NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (email) REFERENCES users(email)
+);
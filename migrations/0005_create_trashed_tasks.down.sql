@@ -0,0 +1,2 @@
+DROP INDEX idx_trashed_tasks_deleted_at;
+DROP TABLE trashed_tasks;
@@ -0,0 +1,11 @@
+-- Deleted tasks, kept for restoring until maintenance purges them
+CREATE TABLE trashed_tasks (
+	email TEXT NOT NULL,
+	task_id TEXT NOT NULL,
+	task TEXT NOT NULL,
+	column_title TEXT NOT NULL DEFAULT '',
+	deleted_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (email, task_id),
+	FOREIGN KEY (email) REFERENCES users(email)
+);
+CREATE INDEX idx_trashed_tasks_deleted_at ON trashed_tasks (deleted_at);
@@ -0,0 +1,9 @@
+ALTER TABLE users DROP COLUMN current_workspace;
+DROP TABLE workspace_labels;
+DROP INDEX idx_workspace_boards_workspace;
+DROP TABLE workspace_boards;
+DROP INDEX idx_workspace_invitations_workspace;
+DROP TABLE workspace_invitations;
+DROP INDEX idx_workspace_members_email;
+DROP TABLE workspace_members;
+DROP TABLE workspaces;
@@ -0,0 +1,55 @@
+-- Workspaces group users around shared boards and labels. A workspace
+-- board's data lives in user_data like any other board, keyed by its ID.
+CREATE TABLE workspaces (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	created_by TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE workspace_members (
+	workspace_id TEXT NOT NULL,
+	email TEXT NOT NULL,
+	role TEXT NOT NULL,
+	joined_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (workspace_id, email),
+	FOREIGN KEY (workspace_id) REFERENCES workspaces(id),
+	FOREIGN KEY (email) REFERENCES users(email)
+);
+CREATE INDEX idx_workspace_members_email ON workspace_members (email);
+
+-- Only a hash of each invitation's token is kept
+CREATE TABLE workspace_invitations (
+	id TEXT PRIMARY KEY,
+	workspace_id TEXT NOT NULL,
+	email TEXT NOT NULL,
+	role TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	invited_by TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (workspace_id) REFERENCES workspaces(id)
+);
+CREATE INDEX idx_workspace_invitations_workspace ON workspace_invitations (workspace_id, created_at);
+
+CREATE TABLE workspace_boards (
+	id TEXT PRIMARY KEY,
+	workspace_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	created_by TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (workspace_id) REFERENCES workspaces(id)
+);
+CREATE INDEX idx_workspace_boards_workspace ON workspace_boards (workspace_id, created_at);
+
+CREATE TABLE workspace_labels (
+	workspace_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	color TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (workspace_id, name),
+	FOREIGN KEY (workspace_id) REFERENCES workspaces(id)
+);
+
+-- The workspace each user last switched to; empty for their own board
+ALTER TABLE users ADD COLUMN current_workspace TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+DROP INDEX idx_users_scim_id;
+ALTER TABLE users DROP COLUMN scim_external_id;
+ALTER TABLE users DROP COLUMN scim_id;
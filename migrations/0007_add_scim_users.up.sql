@@ -0,0 +1,5 @@
+-- Users provisioned by an identity provider over SCIM: the ID the
+-- provisioning API knows them by and the identity provider's own
+ALTER TABLE users ADD COLUMN scim_id TEXT;
+ALTER TABLE users ADD COLUMN scim_external_id TEXT NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX idx_users_scim_id ON users (scim_id);
@@ -0,0 +1,6 @@
+-- Workspace boards are stored like users' boards, under a users row of
+-- their own; this marks those rows with their workspace, so they aren't
+-- taken for people
+ALTER TABLE users ADD COLUMN workspace_id TEXT NOT NULL DEFAULT '';
+UPDATE users SET workspace_id = (SELECT workspace_id FROM workspace_boards WHERE workspace_boards.id = users.email)
+WHERE email IN (SELECT id FROM workspace_boards);
@@ -0,0 +1,10 @@
+-- A flag forced on or off for a user, whatever its rollout. Databases set
+-- up before this migration have the table already.
+CREATE TABLE IF NOT EXISTS feature_flag_overrides (
+	email TEXT NOT NULL,
+	flag TEXT NOT NULL,
+	enabled INTEGER NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (email, flag),
+	FOREIGN KEY (email) REFERENCES users(email)
+);
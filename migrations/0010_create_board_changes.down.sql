@@ -0,0 +1 @@
+DROP TABLE board_changes;
@@ -0,0 +1,13 @@
+-- The version at which each task, column and swimlane last changed or left
+-- the board, for incremental sync. Databases set up before this migration
+-- have the table already.
+CREATE TABLE IF NOT EXISTS board_changes (
+	email TEXT NOT NULL,
+	item_type TEXT NOT NULL,
+	item_id TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	removed INTEGER NOT NULL DEFAULT 0,
+	changed_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (email, item_type, item_id),
+	FOREIGN KEY (email) REFERENCES users(email)
+);
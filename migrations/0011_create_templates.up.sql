@@ -0,0 +1,12 @@
+-- Saved tasks and board layouts. Databases set up before this migration
+-- have the table already.
+CREATE TABLE IF NOT EXISTS templates (
+	id TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	name TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	content TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (email) REFERENCES users(email)
+);
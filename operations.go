@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Operation types understood by applyOperation
+const (
+	OpCreateTask   = "createTask"
+	OpUpdateTask   = "updateTask"
+	OpMoveTask     = "moveTask"
+	OpDeleteTask   = "deleteTask"
+	OpCreateColumn = "createColumn"
+	OpUpdateColumn = "updateColumn"
+	OpDeleteColumn = "deleteColumn"
+
+	OpCreateSwimlane = "createSwimlane"
+	OpUpdateSwimlane = "updateSwimlane"
+	OpDeleteSwimlane = "deleteSwimlane"
+)
+
+// Operation is a single change to a board. Which fields are used depends on
+// Type; see applyOperation.
+type Operation struct {
+	Type       string `json:"type"`
+	TaskID     string `json:"taskId,omitempty"`
+	ColumnID   string `json:"columnId,omitempty"`
+	SwimlaneID string `json:"swimlaneId,omitempty"`
+
+	// Full item for create operations
+	Task     *Task     `json:"task,omitempty"`
+	Column   *Column   `json:"column,omitempty"`
+	Swimlane *Swimlane `json:"swimlane,omitempty"`
+
+	// Changed fields for update operations
+	Changes *OperationChanges `json:"changes,omitempty"`
+}
+
+// OperationChanges lists the fields an update operation sets. Nil fields are
+// left unchanged; an empty Priority, SwimlaneID or Color clears it.
+type OperationChanges struct {
+	Title       *string `json:"title,omitempty"`
+	Description *string `json:"description,omitempty"`
+	DueDate     *string `json:"dueDate,omitempty"`
+	Priority    *string `json:"priority,omitempty"`
+	Order       *int    `json:"order,omitempty"`
+	Hidden      *bool   `json:"hidden,omitempty"`
+	IsDone      *bool   `json:"isDone,omitempty"`
+	WIPLimit    *int    `json:"wipLimit,omitempty"`
+	SwimlaneID  *string `json:"swimlaneId,omitempty"`
+	Color       *string `json:"color,omitempty"`
+	Completed   *bool   `json:"completed,omitempty"`
+}
+
+// OperationError reports which operation in a sequence failed
+type OperationError struct {
+	Index int    `json:"index"`
+	Type  string `json:"type"`
+	Err   string `json:"error"`
+
+	// Set when the operation would overfill a column
+	Code     string         `json:"code,omitempty"`
+	WIPLimit *WIPLimitError `json:"wipLimit,omitempty"`
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("operation %d (%s): %s", e.Index, e.Type, e.Err)
+}
+
+// findTask returns the index of a live task, or -1
+func findTask(data *KanbanData, id string) int {
+	for i, task := range data.Tasks {
+		if task.ID == id && !task.Deleted {
+			return i
+		}
+	}
+	return -1
+}
+
+// findColumn returns the index of a live column, or -1
+func findColumn(data *KanbanData, id string) int {
+	for i, col := range data.Columns {
+		if col.ID == id && !col.Deleted {
+			return i
+		}
+	}
+	return -1
+}
+
+// findSwimlane returns the index of a live swimlane, or -1
+func findSwimlane(data *KanbanData, id string) int {
+	for i, lane := range data.Swimlanes {
+		if lane.ID == id && !lane.Deleted {
+			return i
+		}
+	}
+	return -1
+}
+
+// applyOperations applies a sequence of operations in order. It stops at the
+// first failure, so callers should run it inside UpdateUserData to discard
+// partial changes.
+func applyOperations(data *KanbanData, ops []Operation) error {
+	for i, op := range ops {
+		if err := applyOperation(data, &ops[i]); err != nil {
+			opErr := &OperationError{Index: i, Type: op.Type, Err: err.Error()}
+			var wipErr *WIPLimitError
+			if errors.As(err, &wipErr) {
+				opErr.Code = "wip_limit_exceeded"
+				opErr.WIPLimit = wipErr
+			}
+			return opErr
+		}
+	}
+	return nil
+}
+
+// applyOperation applies one operation to a board. Create operations assign
+// an ID when none is given and record it back on op.
+func applyOperation(data *KanbanData, op *Operation) error {
+	switch op.Type {
+	case OpCreateTask:
+		if op.Task == nil || op.Task.Title == "" {
+			return fmt.Errorf("task with a title is required")
+		}
+		task := *op.Task
+		if task.ID == "" {
+			task.ID = generateID()
+		} else if findTask(data, task.ID) >= 0 {
+			return fmt.Errorf("task %s already exists", task.ID)
+		}
+		if task.ColumnID != nil {
+			if *task.ColumnID == "" {
+				task.ColumnID = nil
+			} else if findColumn(data, *task.ColumnID) < 0 {
+				return fmt.Errorf("column %s not found", *task.ColumnID)
+			} else if err := checkWIPLimit(data, *task.ColumnID); err != nil {
+				return err
+			}
+		}
+		if task.Priority != nil && *task.Priority == "" {
+			task.Priority = nil
+		}
+		if err := validateTaskPriority(task.Priority); err != nil {
+			return err
+		}
+		if task.SwimlaneID != nil {
+			if *task.SwimlaneID == "" {
+				task.SwimlaneID = nil
+			} else if findSwimlane(data, *task.SwimlaneID) < 0 {
+				return fmt.Errorf("swimlane %s not found", *task.SwimlaneID)
+			}
+		}
+		data.Tasks = append(data.Tasks, task)
+		op.TaskID = task.ID
+		op.Task = &task
+
+	case OpUpdateTask:
+		i := findTask(data, op.TaskID)
+		if i < 0 {
+			return fmt.Errorf("task %s not found", op.TaskID)
+		}
+		if op.Changes == nil {
+			return fmt.Errorf("changes are required")
+		}
+		task, c := &data.Tasks[i], op.Changes
+		if c.Title != nil {
+			if *c.Title == "" {
+				return fmt.Errorf("title cannot be empty")
+			}
+			task.Title = *c.Title
+		}
+		if c.Description != nil {
+			task.Description = *c.Description
+		}
+		if c.DueDate != nil {
+			task.DueDate = *c.DueDate
+		}
+		if c.Priority != nil {
+			if *c.Priority == "" {
+				task.Priority = nil
+			} else if !validPriority(*c.Priority) {
+				return errInvalidPriority
+			} else {
+				priority := *c.Priority
+				task.Priority = &priority
+			}
+		}
+		if c.Hidden != nil {
+			task.Hidden = *c.Hidden
+		}
+		if c.Completed != nil && *c.Completed != task.Completed {
+			task.Completed = *c.Completed
+			task.CompletedAt = nil
+			if task.Completed {
+				now := time.Now().UTC()
+				task.CompletedAt = &now
+			}
+		}
+		if c.SwimlaneID != nil {
+			if *c.SwimlaneID == "" {
+				task.SwimlaneID = nil
+			} else if findSwimlane(data, *c.SwimlaneID) < 0 {
+				return fmt.Errorf("swimlane %s not found", *c.SwimlaneID)
+			} else {
+				swimlaneID := *c.SwimlaneID
+				task.SwimlaneID = &swimlaneID
+			}
+		}
+
+	case OpMoveTask:
+		i := findTask(data, op.TaskID)
+		if i < 0 {
+			return fmt.Errorf("task %s not found", op.TaskID)
+		}
+		// A swimlane, when given, is changed along with the column
+		if op.SwimlaneID != "" {
+			if findSwimlane(data, op.SwimlaneID) < 0 {
+				return fmt.Errorf("swimlane %s not found", op.SwimlaneID)
+			}
+			swimlaneID := op.SwimlaneID
+			data.Tasks[i].SwimlaneID = &swimlaneID
+		}
+		if op.ColumnID == "" {
+			data.Tasks[i].ColumnID = nil
+			break
+		}
+		if findColumn(data, op.ColumnID) < 0 {
+			return fmt.Errorf("column %s not found", op.ColumnID)
+		}
+		if current := data.Tasks[i].ColumnID; current == nil || *current != op.ColumnID {
+			if err := checkWIPLimit(data, op.ColumnID); err != nil {
+				return err
+			}
+		}
+		columnID := op.ColumnID
+		data.Tasks[i].ColumnID = &columnID
+
+	case OpDeleteTask:
+		i := findTask(data, op.TaskID)
+		if i < 0 {
+			return fmt.Errorf("task %s not found", op.TaskID)
+		}
+		data.Tasks[i].Deleted = true
+
+	case OpCreateColumn:
+		if op.Column == nil || op.Column.Title == "" {
+			return fmt.Errorf("column with a title is required")
+		}
+		if op.Column.WIPLimit < 0 {
+			return fmt.Errorf("wipLimit cannot be negative")
+		}
+		if err := validateColumnMetadata(op.Column.Color, op.Column.Description); err != nil {
+			return err
+		}
+		col := *op.Column
+		if col.ID == "" {
+			col.ID = generateID()
+		} else if findColumn(data, col.ID) >= 0 {
+			return fmt.Errorf("column %s already exists", col.ID)
+		}
+		data.Columns = append(data.Columns, col)
+		op.ColumnID = col.ID
+		op.Column = &col
+
+	case OpUpdateColumn:
+		i := findColumn(data, op.ColumnID)
+		if i < 0 {
+			return fmt.Errorf("column %s not found", op.ColumnID)
+		}
+		if op.Changes == nil {
+			return fmt.Errorf("changes are required")
+		}
+		col, c := &data.Columns[i], op.Changes
+		if c.Title != nil {
+			if *c.Title == "" {
+				return fmt.Errorf("title cannot be empty")
+			}
+			col.Title = *c.Title
+		}
+		if c.Order != nil {
+			col.Order = *c.Order
+		}
+		if c.Hidden != nil {
+			col.Hidden = *c.Hidden
+		}
+		if c.IsDone != nil {
+			col.IsDone = *c.IsDone
+		}
+		if c.WIPLimit != nil {
+			if *c.WIPLimit < 0 {
+				return fmt.Errorf("wipLimit cannot be negative")
+			}
+			col.WIPLimit = *c.WIPLimit
+		}
+		if c.Color != nil || c.Description != nil {
+			color, description := col.Color, col.Description
+			if c.Color != nil {
+				color = *c.Color
+			}
+			if c.Description != nil {
+				description = *c.Description
+			}
+			if err := validateColumnMetadata(color, description); err != nil {
+				return err
+			}
+			col.Color, col.Description = color, description
+		}
+
+	case OpDeleteColumn:
+		i := findColumn(data, op.ColumnID)
+		if i < 0 {
+			return fmt.Errorf("column %s not found", op.ColumnID)
+		}
+		data.Columns[i].Deleted = true
+		// Tasks in a deleted column become unassigned
+		for j, task := range data.Tasks {
+			if task.ColumnID != nil && *task.ColumnID == op.ColumnID {
+				data.Tasks[j].ColumnID = nil
+			}
+		}
+
+	case OpCreateSwimlane:
+		if op.Swimlane == nil || op.Swimlane.Title == "" {
+			return fmt.Errorf("swimlane with a title is required")
+		}
+		lane := *op.Swimlane
+		if lane.ID == "" {
+			lane.ID = generateID()
+		} else if findSwimlane(data, lane.ID) >= 0 {
+			return fmt.Errorf("swimlane %s already exists", lane.ID)
+		}
+		data.Swimlanes = append(data.Swimlanes, lane)
+		op.SwimlaneID = lane.ID
+		op.Swimlane = &lane
+
+	case OpUpdateSwimlane:
+		i := findSwimlane(data, op.SwimlaneID)
+		if i < 0 {
+			return fmt.Errorf("swimlane %s not found", op.SwimlaneID)
+		}
+		if op.Changes == nil {
+			return fmt.Errorf("changes are required")
+		}
+		lane, c := &data.Swimlanes[i], op.Changes
+		if c.Title != nil {
+			if *c.Title == "" {
+				return fmt.Errorf("title cannot be empty")
+			}
+			lane.Title = *c.Title
+		}
+		if c.Order != nil {
+			lane.Order = *c.Order
+		}
+
+	case OpDeleteSwimlane:
+		i := findSwimlane(data, op.SwimlaneID)
+		if i < 0 {
+			return fmt.Errorf("swimlane %s not found", op.SwimlaneID)
+		}
+		data.Swimlanes[i].Deleted = true
+		// Tasks in a deleted swimlane keep their column but leave the lane
+		for j, task := range data.Tasks {
+			if task.SwimlaneID != nil && *task.SwimlaneID == op.SwimlaneID {
+				data.Tasks[j].SwimlaneID = nil
+			}
+		}
+
+	default:
+		return fmt.Errorf("unknown operation type %q", op.Type)
+	}
+
+	return nil
+}
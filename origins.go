@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originAllowed reports whether a browser origin is in ALLOWED_ORIGINS.
+// Entries are origins like https://todo.example.com, may hold one "*"
+// wildcard (https://*.example.com), and "*" alone allows any origin. The
+// same check guards CORS and WebSocket upgrades.
+func originAllowed(allowed []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, entry := range allowed {
+		entry = strings.ToLower(entry)
+		if entry == "*" || entry == origin {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(entry, "*"); ok &&
+			len(origin) >= len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWebSocketOrigin returns the upgrader's CheckOrigin: connections from
+// the page's own host, from allowed origins, and from non-browser clients
+// that send no Origin are accepted
+func checkWebSocketOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		return originAllowed(allowed, origin)
+	}
+}
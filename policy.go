@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type contextKey string
+
+// emailContextKey holds the authenticated email on guarded requests
+const emailContextKey contextKey = "email"
+
+// apiKeyScopeContextKey holds the scope of the API key a guarded request
+// authenticated with; it's unset for session tokens
+const apiKeyScopeContextKey contextKey = "apiKeyScope"
+
+// clientIDContextKey holds the X-Client-ID of a guarded request, the client
+// its board writes are checked against edit locks as
+const clientIDContextKey contextKey = "clientID"
+
+// requestEmail returns the authenticated email for a request that passed
+// through PolicyEnforcer.Require
+func requestEmail(r *http.Request) string {
+	email, _ := r.Context().Value(emailContextKey).(string)
+	return email
+}
+
+// requestAPIKeyScope returns the scope of the API key a request used, or ""
+// if it used a session token
+func requestAPIKeyScope(r *http.Request) string {
+	scope, _ := r.Context().Value(apiKeyScopeContextKey).(string)
+	return scope
+}
+
+// Policy decides whether an authenticated user may perform a request. A nil
+// error allows the request; any error rejects it with 403 Forbidden.
+type Policy func(r *http.Request, email string) error
+
+// BoardRole is a user's level of access to a board
+type BoardRole int
+
+const (
+	BoardRoleNone BoardRole = iota
+	BoardRoleViewer
+	BoardRoleEditor
+	BoardRoleOwner
+)
+
+// errForbidden is the generic policy rejection
+var errForbidden = errors.New("forbidden")
+
+// PolicyEnforcer authenticates requests and applies route policies
+type PolicyEnforcer struct {
+	authService   *AuthService
+	apiKeyService *APIKeyService
+	admins        map[string]bool
+
+	// Roles on workspace boards; nil until workspaces are set up
+	sharedBoards SharedBoardRoles
+}
+
+func NewPolicyEnforcer(authService *AuthService, apiKeyService *APIKeyService, cfg *Config) *PolicyEnforcer {
+	admins := make(map[string]bool)
+	for _, email := range cfg.AdminEmails {
+		admins[strings.ToLower(email)] = true
+	}
+
+	return &PolicyEnforcer{
+		authService:   authService,
+		apiKeyService: apiKeyService,
+		admins:        admins,
+	}
+}
+
+// Require wraps a handler so it only runs for authenticated users that
+// satisfy every policy. Requests authenticate with a session token or an
+// X-API-Key header; read-scoped keys may only make GET requests. The
+// authenticated email is available to the handler via requestEmail.
+func (p *PolicyEnforcer) Require(handler http.HandlerFunc, policies ...Policy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		var email string
+		var err error
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			var scope string
+			email, scope, err = p.authenticateKey(key)
+			if err != nil {
+				writeError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			if scope == APIKeyScopeRead && r.Method != http.MethodGet && r.Method != http.MethodHead {
+				writeError(w, http.StatusForbidden, "API key is read-only")
+				return
+			}
+			ctx = context.WithValue(ctx, apiKeyScopeContextKey, scope)
+		} else {
+			email, err = p.authService.AuthenticateRequest(r)
+			if err != nil {
+				writeError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+		}
+
+		ctx = context.WithValue(ctx, emailContextKey, email)
+		ctx = withClientID(ctx, headerClientID(r))
+		r = r.WithContext(ctx)
+
+		// Answer in the user's own language when they picked one
+		if locale := p.authService.UserLocale(email); supportedLocale(locale) && w.Header().Get("Content-Language") != "" {
+			w.Header().Set("Content-Language", locale)
+		}
+
+		for _, policy := range policies {
+			if err := policy(r, email); err != nil {
+				writeError(w, http.StatusForbidden, err.Error())
+				return
+			}
+		}
+
+		handler(w, r)
+	})
+}
+
+// authenticateKey returns the user and scope of an API key whose account
+// may sign in
+func (p *PolicyEnforcer) authenticateKey(key string) (string, string, error) {
+	email, scope, err := p.apiKeyService.Authenticate(key)
+	if err == nil {
+		err = p.authService.CheckAccount(email, time.Time{})
+	}
+	return email, scope, err
+}
+
+// SessionOnly refuses requests made with an API key, for routes such as
+// key management that scripts shouldn't reach
+func SessionOnly(r *http.Request, email string) error {
+	if requestAPIKeyScope(r) != "" {
+		return errors.New("not available with an API key")
+	}
+	return nil
+}
+
+// IsAdmin reports whether an email is in the ADMIN_EMAILS allowlist
+func (p *PolicyEnforcer) IsAdmin(email string) bool {
+	return p.admins[strings.ToLower(email)]
+}
+
+// Admin allows only users listed in ADMIN_EMAILS
+func (p *PolicyEnforcer) Admin() Policy {
+	return func(r *http.Request, email string) error {
+		if !p.IsAdmin(email) {
+			return errors.New("admin access required")
+		}
+		return nil
+	}
+}
+
+// OwnsResource allows the request when the resource's owner, as resolved
+// by owner, is the authenticated user
+func OwnsResource(owner func(r *http.Request) (string, error)) Policy {
+	return func(r *http.Request, email string) error {
+		ownerEmail, err := owner(r)
+		if err != nil || ownerEmail != email {
+			return errForbidden
+		}
+		return nil
+	}
+}
+
+// SharedBoardRoles resolves a user's role on boards other than their own,
+// which belong to workspaces
+type SharedBoardRoles func(email, boardID string) BoardRole
+
+// boardRole resolves a user's role on a board. Each user owns a single
+// board, addressed by their email or the alias "default"; other boards are
+// workspace boards, open to the workspace's members when shared is set.
+func boardRole(shared SharedBoardRoles, email string, boardID string) BoardRole {
+	if boardID == "" || boardID == "default" || boardID == email {
+		return BoardRoleOwner
+	}
+	if shared != nil {
+		return shared(email, boardID)
+	}
+	return BoardRoleNone
+}
+
+// canonicalBoardID resolves a board alias to the board's canonical ID, so
+// that "default" and the owner's email name the same board
+func canonicalBoardID(email string, boardID string) string {
+	if boardID == "" || boardID == "default" {
+		return email
+	}
+	return boardID
+}
+
+// queryBoard addresses the board named by the "board" query parameter, the
+// requesting user's own when it's absent
+func queryBoard(r *http.Request) string {
+	return r.URL.Query().Get("board")
+}
+
+// UseSharedBoards gives workspace members their roles on workspace boards;
+// without it users only have access to their own board
+func (p *PolicyEnforcer) UseSharedBoards(shared SharedBoardRoles) {
+	p.sharedBoards = shared
+}
+
+// BoardRole resolves a user's role on a board
+func (p *PolicyEnforcer) BoardRole(email string, boardID string) BoardRole {
+	return boardRole(p.sharedBoards, email, boardID)
+}
+
+// HasBoardRole allows the request when the user holds at least min on the
+// board identified by boardID
+func (p *PolicyEnforcer) HasBoardRole(min BoardRole, boardID func(r *http.Request) string) Policy {
+	return func(r *http.Request, email string) error {
+		if p.BoardRole(email, boardID(r)) < min {
+			return errForbidden
+		}
+		return nil
+	}
+}
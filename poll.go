@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Long-polling fallback for clients that can hold neither a WebSocket nor
+// an event stream open:
+//
+//	GET /api/data/poll?since=<version>&timeout=<seconds>
+//
+// answers at once with the board's changes (as /api/data/changes would) if
+// it's past the version. Otherwise the request waits, as a hub client, for
+// a message on the user's board, and answers with the changes once the
+// board moves past the version. After timeout seconds (at most and by
+// default 30) with no change it answers 204, and the client polls again
+// with the same version.
+
+// maxPollWait is how long a poll waits for a change
+const maxPollWait = 30 * time.Second
+
+// Poll waits for the user's board, or the workspace board named by ?board=,
+// to change after a version
+func (h *DataHandler) Poll(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+	board := canonicalBoardID(email, queryBoard(r))
+
+	raw := r.URL.Query().Get("since")
+	if raw == "" {
+		writeError(w, http.StatusBadRequest, "since is required")
+		return
+	}
+	version, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || version < 0 {
+		writeError(w, http.StatusBadRequest, "since must be a board version")
+		return
+	}
+
+	wait := maxPollWait
+	if raw := r.URL.Query().Get("timeout"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds < 1 || seconds > int(maxPollWait/time.Second) {
+			writeError(w, http.StatusBadRequest, "timeout must be between 1 and 30 seconds")
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	// The wait may outlast the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 10*time.Second))
+
+	// Join the board's room before reading the board, so a save in between
+	// still wakes the poll
+	client := NewClient(h.hub, nil, email)
+	h.hub.Register(client)
+	defer func() {
+		h.hub.Unregister(client)
+		h.hub.pumps.Done()
+	}()
+	if board != email {
+		h.hub.subscribe <- subscription{client: client, board: board, subscribe: true, view: true}
+	}
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		data, err := h.dataService.GetUserData(r.Context(), board)
+		if err != nil {
+			log.Printf("Error getting board for poll: %v", err)
+			writeServerError(w, err, "Server error")
+			return
+		}
+		if data.Version > version {
+			break
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.done:
+			// Closed by the hub, e.g. on shutdown; the client polls again
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-timeout.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-client.send:
+			// Something was published for the user; check the version
+		}
+	}
+
+	changes, err := h.dataService.Changes(r.Context(), board, version, time.Time{})
+	if err != nil {
+		writeChangesError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"changes": changes,
+	})
+}
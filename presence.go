@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// PresenceEntry is a user connected to a board
+type PresenceEntry struct {
+	User string `json:"user"`
+	// The board shown by the user's most recently active connection
+	Viewing     string `json:"viewing"`
+	Connections int    `json:"connections"`
+}
+
+// presenceRequest asks the Run loop for a board's presence
+type presenceRequest struct {
+	board string
+	reply chan []PresenceEntry
+}
+
+// handleView handles {"type": "view", "board": "<board id>"}, sent when a
+// client switches boards. It subscribes the client to the board and reports
+// the board as the one it's showing.
+func (h *Hub) handleView(c *Client, message WebSocketMessage) {
+	boardID := canonicalBoardID(c.email, message.Board)
+	h.subscribe <- subscription{client: c, board: boardID, subscribe: true, view: true}
+}
+
+// Presence returns who is connected to a board and what they're viewing
+func (h *Hub) Presence(boardID string) []PresenceEntry {
+	reply := make(chan []PresenceEntry, 1)
+	h.presence <- presenceRequest{board: boardID, reply: reply}
+	return <-reply
+}
+
+// markPresence notes that the presence of a client's boards changed. Only
+// called from the Run loop.
+func (h *Hub) markPresence(client *Client) {
+	for board := range client.boards {
+		h.presenceDirty[board] = true
+	}
+}
+
+// boardPresence lists the users subscribed to a board, ordered by email.
+// Only called from the Run loop.
+func (h *Hub) boardPresence(boardID string) []PresenceEntry {
+	entries := make(map[string]*PresenceEntry)
+	latest := make(map[string]int64)
+	for client := range h.rooms[boardID] {
+		entry, ok := entries[client.email]
+		if !ok {
+			entry = &PresenceEntry{User: client.email}
+			entries[client.email] = entry
+		}
+		entry.Connections++
+		if active := client.lastActive.Load(); active >= latest[client.email] {
+			latest[client.email] = active
+			entry.Viewing = client.viewing
+		}
+	}
+
+	presence := make([]PresenceEntry, 0, len(entries))
+	for _, entry := range entries {
+		presence = append(presence, *entry)
+	}
+	sort.Slice(presence, func(i, j int) bool { return presence[i].User < presence[j].User })
+	return presence
+}
+
+// flushPresence sends a presence message to the subscribers of every board
+// whose presence changed. Only called from the Run loop.
+func (h *Hub) flushPresence() {
+	for board := range h.presenceDirty {
+		delete(h.presenceDirty, board)
+
+		payload, err := json.Marshal(WebSocketMessage{
+			Type:  "presence",
+			Board: board,
+			Data:  map[string]any{"users": h.boardPresence(board)},
+		})
+		if err != nil {
+			log.Printf("Error marshalling presence: %v", err)
+			continue
+		}
+		for client := range h.rooms[board] {
+			h.deliver(client, outbound{payload: payload})
+		}
+	}
+}
+
+// PresenceHandler serves presence snapshots
+type PresenceHandler struct {
+	hub *Hub
+}
+
+func NewPresenceHandler(hub *Hub) *PresenceHandler {
+	return &PresenceHandler{hub: hub}
+}
+
+// Get lists who is connected to a board (?board=, the user's own by
+// default) and which board each of them is viewing
+func (h *PresenceHandler) Get(w http.ResponseWriter, r *http.Request) {
+	boardID := canonicalBoardID(requestEmail(r), r.URL.Query().Get("board"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"board":  boardID,
+		"users":  h.hub.Presence(boardID),
+	})
+}
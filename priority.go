@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Task priorities, from least to most pressing
+const (
+	PriorityLow    = "low"
+	PriorityMedium = "medium"
+	PriorityHigh   = "high"
+	PriorityUrgent = "urgent"
+)
+
+// priorityRanks orders the priorities; tasks without one rank 0
+var priorityRanks = map[string]int{
+	PriorityLow:    1,
+	PriorityMedium: 2,
+	PriorityHigh:   3,
+	PriorityUrgent: 4,
+}
+
+// legacyPriorities maps free-form values stored before priorities were
+// validated onto the enum
+var legacyPriorities = map[string]string{
+	"lowest":   PriorityLow,
+	"normal":   PriorityMedium,
+	"med":      PriorityMedium,
+	"highest":  PriorityUrgent,
+	"critical": PriorityUrgent,
+}
+
+// validPriority reports whether a priority is one of the enum values
+func validPriority(priority string) bool {
+	_, ok := priorityRanks[priority]
+	return ok
+}
+
+// priorityRank returns a task priority's rank
+func priorityRank(priority *string) int {
+	if priority == nil {
+		return 0
+	}
+	return priorityRanks[*priority]
+}
+
+// normalizePriority maps a priority onto the enum, ignoring case and
+// accepting legacy synonyms. It reports false for values it can't place.
+func normalizePriority(raw string) (string, bool) {
+	priority := strings.ToLower(strings.TrimSpace(raw))
+	if validPriority(priority) {
+		return priority, true
+	}
+	if mapped, ok := legacyPriorities[priority]; ok {
+		return mapped, true
+	}
+	return "", false
+}
+
+// errInvalidPriority describes the accepted priorities
+var errInvalidPriority = fmt.Errorf("priority must be one of %s, %s, %s or %s", PriorityLow, PriorityMedium, PriorityHigh, PriorityUrgent)
+
+// validateTaskPriority checks an optional priority is an enum value
+func validateTaskPriority(priority *string) error {
+	if priority != nil && !validPriority(*priority) {
+		return errInvalidPriority
+	}
+	return nil
+}
+
+// normalizeTaskPriorities canonicalizes every task's priority, clearing
+// empty ones. It returns the IDs of tasks whose priority can't be placed.
+func normalizeTaskPriorities(data *KanbanData) []string {
+	var invalid []string
+	for _, tasks := range [][]Task{data.Tasks, data.UnassignedTasks} {
+		for i, task := range tasks {
+			if task.Priority == nil {
+				continue
+			}
+			if strings.TrimSpace(*task.Priority) == "" {
+				tasks[i].Priority = nil
+				continue
+			}
+			priority, ok := normalizePriority(*task.Priority)
+			if !ok {
+				invalid = append(invalid, task.ID)
+				continue
+			}
+			tasks[i].Priority = &priority
+		}
+	}
+	return invalid
+}
+
+// writeInvalidPriority responds with a structured 422 error
+func writeInvalidPriority(w http.ResponseWriter, taskIDs []string) {
+	writeErrorBody(w, http.StatusUnprocessableEntity, "invalid_priority", errInvalidPriority.Error(), map[string]any{
+		"taskIds": taskIDs,
+	})
+}
+
+// migrateTaskPriorities rewrites stored priorities onto the enum, dropping
+// values that can't be placed. It reports whether anything changed.
+func migrateTaskPriorities(data *KanbanData) bool {
+	changed := false
+	for _, tasks := range [][]Task{data.Tasks, data.UnassignedTasks} {
+		for i, task := range tasks {
+			if task.Priority == nil || validPriority(*task.Priority) {
+				continue
+			}
+			if priority, ok := normalizePriority(*task.Priority); ok {
+				tasks[i].Priority = &priority
+			} else {
+				tasks[i].Priority = nil
+			}
+			changed = true
+		}
+	}
+	return changed
+}
+
+// taskSortKeys are the keys accepted by parseTaskSort. Each compares two tasks
+// in ascending order.
+var taskSortKeys = map[string]func(a, b *Task) int{
+	// Most pressing first; tasks without a priority last
+	"priority": func(a, b *Task) int {
+		return priorityRank(b.Priority) - priorityRank(a.Priority)
+	},
+	// Earliest first; tasks without a due date last
+	"dueDate": func(a, b *Task) int {
+		dueA, okA := parseDueDate(a.DueDate)
+		dueB, okB := parseDueDate(b.DueDate)
+		switch {
+		case okA && okB:
+			return dueA.Compare(dueB)
+		case okA:
+			return -1
+		case okB:
+			return 1
+		}
+		return 0
+	},
+	"title": func(a, b *Task) int {
+		return strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+	},
+}
+
+// parseTaskSort parses a comma-separated list of sort keys, each optionally
+// prefixed with "-" to reverse it, into a comparison function
+func parseTaskSort(raw string) (func(a, b *Task) int, error) {
+	var compares []func(a, b *Task) int
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		reverse := strings.HasPrefix(field, "-")
+		compare, ok := taskSortKeys[strings.TrimPrefix(field, "-")]
+		if !ok {
+			return nil, fmt.Errorf("unknown sort key %q", field)
+		}
+		if reverse {
+			ascending := compare
+			compare = func(a, b *Task) int { return ascending(b, a) }
+		}
+		compares = append(compares, compare)
+	}
+
+	return func(a, b *Task) int {
+		for _, compare := range compares {
+			if c := compare(a, b); c != 0 {
+				return c
+			}
+		}
+		return 0
+	}, nil
+}
+
+// sortTasks returns a copy of data with its tasks sorted; data itself may be
+// shared with the cache, so it's left untouched
+func sortTasks(data *KanbanData, compare func(a, b *Task) int) *KanbanData {
+	sorted := *data
+	sorted.Tasks = append([]Task{}, data.Tasks...)
+	sort.SliceStable(sorted.Tasks, func(i, j int) bool {
+		return compare(&sorted.Tasks[i], &sorted.Tasks[j]) < 0
+	})
+	return &sorted
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// When several instances run behind a load balancer, each hub only reaches
+// the clients connected to it. A ClusterRelay forwards board messages,
+// session revocations and board cache invalidations to the other instances
+// through a pub/sub broker, and applies theirs locally. Presence and
+// connection stats stay per instance.
+
+// PubSubConfig selects the broker shared by instances
+type PubSubConfig struct {
+	// "none" (single instance) or "redis"
+	Backend string
+	// redis://[user:password@]host:port, or rediss:// for TLS
+	RedisURL string
+	// Pub/sub channel the instances share
+	Channel string
+}
+
+// Broker carries messages between instances
+type Broker interface {
+	// Publish sends a message to every instance, including this one
+	Publish(payload []byte) error
+	// Subscribe calls handle with each message until Close. onReconnect is
+	// called after the subscription is restored, as messages may have been
+	// missed.
+	Subscribe(handle func(payload []byte), onReconnect func())
+	Close() error
+}
+
+// NewBroker returns the configured broker, or nil when instances don't
+// share one
+func NewBroker(cfg PubSubConfig) (Broker, error) {
+	switch cfg.Backend {
+	case "redis":
+		return newRedisBroker(cfg)
+	default:
+		return nil, nil
+	}
+}
+
+// clusterMessage is what instances publish to each other
+type clusterMessage struct {
+	// The publishing instance, which ignores its own messages
+	Origin string `json:"origin"`
+	// "board", "disconnect" or "invalidate"
+	Kind    string          `json:"kind"`
+	Board   string          `json:"board,omitempty"`
+	Email   string          `json:"email,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// relayQueueSize bounds the messages waiting to be published
+const relayQueueSize = 1024
+
+// ClusterRelay connects a hub and board cache to the other instances
+type ClusterRelay struct {
+	broker Broker
+	origin string
+	hub    *Hub
+	cache  *BoardCache
+	queue  chan []byte
+}
+
+// NewClusterRelay starts relaying between the hub and cache and the broker
+func NewClusterRelay(broker Broker, hub *Hub, cache *BoardCache) *ClusterRelay {
+	r := &ClusterRelay{
+		broker: broker,
+		origin: generateID(),
+		hub:    hub,
+		cache:  cache,
+		queue:  make(chan []byte, relayQueueSize),
+	}
+	hub.relay = r
+	cache.NotifyWrites(r.publishInvalidate)
+
+	go r.publishLoop()
+	go broker.Subscribe(r.receive, func() {
+		// Invalidations may have been missed while disconnected
+		log.Printf("Cluster subscription restored, clearing board cache")
+		cache.Clear()
+	})
+	return r
+}
+
+// publish queues a message for the other instances. It never blocks; when
+// the broker falls behind, messages are dropped and clients catch up on
+// their next sync.
+func (r *ClusterRelay) publish(message clusterMessage) {
+	message.Origin = r.origin
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshalling cluster message: %v", err)
+		return
+	}
+
+	select {
+	case r.queue <- payload:
+	default:
+		log.Printf("Cluster publish queue full, dropping %s message", message.Kind)
+	}
+}
+
+func (r *ClusterRelay) publishLoop() {
+	for payload := range r.queue {
+		if err := r.broker.Publish(payload); err != nil {
+			log.Printf("Error publishing cluster message: %v", err)
+		}
+	}
+}
+
+func (r *ClusterRelay) publishBoard(boardID string, payload []byte) {
+	r.publish(clusterMessage{Kind: "board", Board: boardID, Payload: payload})
+}
+
+func (r *ClusterRelay) publishDisconnect(email string) {
+	r.publish(clusterMessage{Kind: "disconnect", Email: email})
+}
+
+func (r *ClusterRelay) publishInvalidate(email string) {
+	r.publish(clusterMessage{Kind: "invalidate", Email: email})
+}
+
+// receive applies a message from another instance
+func (r *ClusterRelay) receive(payload []byte) {
+	var message clusterMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		log.Printf("Ignoring malformed cluster message: %v", err)
+		return
+	}
+	if message.Origin == r.origin {
+		return
+	}
+
+	switch message.Kind {
+	case "board":
+		r.hub.boards <- boardMessage{board: message.Board, payload: message.Payload}
+	case "disconnect":
+		r.hub.disconnectLocal(message.Email)
+	case "invalidate":
+		r.cache.Drop(message.Email)
+	}
+}
+
+// Close disconnects from the broker; later messages fail to publish
+func (r *ClusterRelay) Close() error {
+	return r.broker.Close()
+}
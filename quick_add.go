@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/example/todo-app/quickadd"
+)
+
+// QuickAddHandler creates tasks from one line of text, parsed on the server
+// so every client reads it the same way
+type QuickAddHandler struct {
+	dataService *DataService
+	hub         *Hub
+}
+
+func NewQuickAddHandler(dataService *DataService, hub *Hub) *QuickAddHandler {
+	return &QuickAddHandler{dataService: dataService, hub: hub}
+}
+
+// QuickAdd parses text such as "Pay rent tomorrow 5pm !high #finance" into
+// a task and adds it to the board. Relative dates and times are in the
+// server's time zone unless tz names another. With dryRun, the parsed task
+// is returned without being added.
+func (h *QuickAddHandler) QuickAdd(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+
+	var req struct {
+		Text     string `json:"text"`
+		TZ       string `json:"tz"`
+		ColumnID string `json:"columnId"`
+		DryRun   bool   `json:"dryRun"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	now := time.Now()
+	if req.TZ != "" {
+		loc, err := time.LoadLocation(req.TZ)
+		if err != nil {
+			writeFieldErrors(w, FieldError{Field: "tz", Message: "is not a known time zone"})
+			return
+		}
+		now = now.In(loc)
+	}
+
+	entry := quickadd.Parse(req.Text, now)
+	var fieldErrors []FieldError
+	if entry.Title == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "text", Message: "must include a title"})
+	}
+	task := Task{Title: entry.Title, DueDate: entry.DueDate(), Labels: entry.Labels}
+	if entry.Priority != "" {
+		priority, ok := normalizePriority(entry.Priority)
+		if !ok {
+			fieldErrors = append(fieldErrors, FieldError{Field: "priority", Message: fmt.Sprintf("must be one of %s, %s, %s or %s", PriorityLow, PriorityMedium, PriorityHigh, PriorityUrgent)})
+		}
+		task.Priority = &priority
+	}
+	if len(fieldErrors) > 0 {
+		writeFieldErrors(w, fieldErrors...)
+		return
+	}
+	if req.ColumnID != "" {
+		task.ColumnID = &req.ColumnID
+	}
+
+	if req.DryRun {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"status": "success",
+			"task":   task,
+		})
+		return
+	}
+
+	var columnErr error
+	data, err := h.dataService.UpdateUserData(r.Context(), email, func(data *KanbanData) error {
+		if task.ColumnID != nil && findColumn(data, *task.ColumnID) < 0 {
+			columnErr = errors.New("is not a column on the board")
+			return columnErr
+		}
+		op := Operation{Type: OpCreateTask, Task: &task}
+		if err := applyOperation(data, &op); err != nil {
+			return err
+		}
+		task = *op.Task
+		return nil
+	})
+	if columnErr != nil {
+		writeFieldErrors(w, FieldError{Field: "columnId", Message: columnErr.Error()})
+		return
+	}
+	var wipErr *WIPLimitError
+	if errors.As(err, &wipErr) {
+		writeWIPLimitExceeded(w, wipErr)
+		return
+	}
+	if err != nil {
+		log.Printf("Error adding quick-add task: %v", err)
+		writeServerError(w, err, "Failed to add task")
+		return
+	}
+
+	h.hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"task":   task,
+	})
+}
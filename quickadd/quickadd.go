@@ -0,0 +1,320 @@
+// Package quickadd parses one-line task entries such as
+//
+//	Pay rent tomorrow 5pm !high #finance
+//
+// into a title, due date, priority and labels, so every client that offers
+// a quick-add box reads them the same way.
+//
+// Recognized anywhere in the text:
+//
+//   - Dates: today, tomorrow, weekday names (the next one after today,
+//     optionally after "next"), "in N days" or "in N weeks", YYYY-MM-DD, and
+//     month-day pairs such as "jan 5" or "5 january" (the next one to come).
+//     "on", "by" or "due" before a date is dropped with it.
+//   - Times: 5pm, 5:30pm, 5 pm, 17:00 and noon, optionally after "at". A
+//     time without a date is today.
+//   - Priorities: a word after "!", such as !high. Callers decide which
+//     words are valid.
+//   - Labels: a word after "#", such as #finance.
+//
+// Only the first date, time and priority count; later ones stay in the
+// title, as does everything else.
+package quickadd
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is a parsed task entry
+type Entry struct {
+	Title string
+
+	// Due is nil without a date or time. Without a time, it's midnight in
+	// the location of the now passed to Parse.
+	Due     *time.Time
+	HasTime bool
+
+	// Lowercased word after "!", or empty
+	Priority string
+
+	// Words after "#" in the order given, without repeats
+	Labels []string
+}
+
+// DueDate formats the due date the way tasks store it: YYYY-MM-DD without a
+// time, RFC 3339 with one, and empty without a due date
+func (e Entry) DueDate() string {
+	switch {
+	case e.Due == nil:
+		return ""
+	case e.HasTime:
+		return e.Due.Format(time.RFC3339)
+	default:
+		return e.Due.Format(time.DateOnly)
+	}
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+var months = map[string]time.Month{
+	"jan": time.January, "january": time.January,
+	"feb": time.February, "february": time.February,
+	"mar": time.March, "march": time.March,
+	"apr": time.April, "april": time.April,
+	"may": time.May,
+	"jun": time.June, "june": time.June,
+	"jul": time.July, "july": time.July,
+	"aug": time.August, "august": time.August,
+	"sep": time.September, "sept": time.September, "september": time.September,
+	"oct": time.October, "october": time.October,
+	"nov": time.November, "november": time.November,
+	"dec": time.December, "december": time.December,
+}
+
+// Parse parses a task entry. Relative dates count from now, in now's
+// location.
+func Parse(text string, now time.Time) Entry {
+	var entry Entry
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	var date *time.Time
+	hour, minute := -1, 0
+	seenLabels := make(map[string]bool)
+
+	words := strings.Fields(text)
+	var title []string
+	for i := 0; i < len(words); {
+		word := words[i]
+
+		if entry.Priority == "" && len(word) > 1 && word[0] == '!' && isWord(word[1:]) {
+			entry.Priority = strings.ToLower(word[1:])
+			i++
+			continue
+		}
+		if len(word) > 1 && word[0] == '#' && isWord(word[1:]) {
+			label := word[1:]
+			if !seenLabels[strings.ToLower(label)] {
+				seenLabels[strings.ToLower(label)] = true
+				entry.Labels = append(entry.Labels, label)
+			}
+			i++
+			continue
+		}
+		if date == nil {
+			if d, n := matchDate(words[i:], today); n > 0 {
+				date = &d
+				i += n
+				continue
+			}
+		}
+		if hour < 0 {
+			if h, m, n := matchTime(words[i:]); n > 0 {
+				hour, minute = h, m
+				i += n
+				continue
+			}
+		}
+
+		title = append(title, word)
+		i++
+	}
+
+	entry.Title = strings.Join(title, " ")
+	if date == nil && hour >= 0 {
+		date = &today
+	}
+	if date != nil {
+		due := *date
+		if hour >= 0 {
+			due = time.Date(due.Year(), due.Month(), due.Day(), hour, minute, 0, 0, due.Location())
+			entry.HasTime = true
+		}
+		entry.Due = &due
+	}
+	return entry
+}
+
+// isWord reports whether s is letters, digits, "-" and "_" only
+func isWord(s string) bool {
+	for _, r := range s {
+		if !(r == '-' || r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r > 127) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// matchDate matches a date at the start of words, returning it and the
+// number of words it takes, or 0 when there's none
+func matchDate(words []string, today time.Time) (time.Time, int) {
+	lower := make([]string, len(words))
+	for i, word := range words {
+		lower[i] = strings.ToLower(strings.TrimRight(word, ",."))
+	}
+
+	// A leading "on", "by" or "due" only goes with a date
+	if len(lower) > 1 && (lower[0] == "on" || lower[0] == "by" || lower[0] == "due") {
+		if d, n := matchDate(words[1:], today); n > 0 {
+			return d, n + 1
+		}
+		return time.Time{}, 0
+	}
+
+	switch lower[0] {
+	case "today":
+		return today, 1
+	case "tomorrow", "tmrw":
+		return today.AddDate(0, 0, 1), 1
+	case "next":
+		if len(lower) > 1 {
+			if day, ok := weekdays[lower[1]]; ok {
+				return nextWeekday(today, day), 2
+			}
+		}
+		return time.Time{}, 0
+	case "in":
+		if len(lower) > 2 {
+			n, err := strconv.Atoi(lower[1])
+			if err != nil || n < 0 || n > 3660 {
+				return time.Time{}, 0
+			}
+			switch lower[2] {
+			case "day", "days":
+				return today.AddDate(0, 0, n), 3
+			case "week", "weeks":
+				return today.AddDate(0, 0, 7*n), 3
+			}
+		}
+		return time.Time{}, 0
+	}
+
+	if day, ok := weekdays[lower[0]]; ok {
+		return nextWeekday(today, day), 1
+	}
+	if d, err := time.ParseInLocation(time.DateOnly, lower[0], today.Location()); err == nil {
+		return d, 1
+	}
+	if len(lower) > 1 {
+		if month, ok := months[lower[0]]; ok {
+			if day, err := strconv.Atoi(lower[1]); err == nil {
+				if d, ok := nextMonthDay(today, month, day); ok {
+					return d, 2
+				}
+			}
+		}
+		if month, ok := months[lower[1]]; ok {
+			if day, err := strconv.Atoi(lower[0]); err == nil {
+				if d, ok := nextMonthDay(today, month, day); ok {
+					return d, 2
+				}
+			}
+		}
+	}
+	return time.Time{}, 0
+}
+
+// nextWeekday returns the first day after today that falls on day
+func nextWeekday(today time.Time, day time.Weekday) time.Time {
+	ahead := (int(day) - int(today.Weekday()) + 7) % 7
+	if ahead == 0 {
+		ahead = 7
+	}
+	return today.AddDate(0, 0, ahead)
+}
+
+// nextMonthDay returns the next month-day from today on, this year or next
+func nextMonthDay(today time.Time, month time.Month, day int) (time.Time, bool) {
+	for year := today.Year(); year <= today.Year()+1; year++ {
+		d := time.Date(year, month, day, 0, 0, 0, 0, today.Location())
+		if d.Day() != day {
+			// Normalized past the end of the month, e.g. feb 30
+			continue
+		}
+		if !d.Before(today) {
+			return d, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// matchTime matches a time of day at the start of words, returning the hour,
+// minute and number of words it takes, or 0 words when there's none
+func matchTime(words []string) (int, int, int) {
+	lower := make([]string, len(words))
+	for i, word := range words {
+		lower[i] = strings.ToLower(strings.TrimRight(word, ",."))
+	}
+
+	if len(lower) > 1 && lower[0] == "at" {
+		if h, m, n := matchTime(words[1:]); n > 0 {
+			return h, m, n + 1
+		}
+		return 0, 0, 0
+	}
+	if lower[0] == "noon" {
+		return 12, 0, 1
+	}
+
+	// "5 pm" as two words
+	if len(lower) > 1 && (lower[1] == "am" || lower[1] == "pm") {
+		if h, m, ok := parseClock(lower[0] + lower[1]); ok {
+			return h, m, 2
+		}
+	}
+	if h, m, ok := parseClock(lower[0]); ok {
+		return h, m, 1
+	}
+	return 0, 0, 0
+}
+
+// parseClock parses 5pm, 5:30pm or 17:00. Bare numbers aren't times.
+func parseClock(s string) (int, int, bool) {
+	suffix := ""
+	if strings.HasSuffix(s, "am") || strings.HasSuffix(s, "pm") {
+		s, suffix = s[:len(s)-2], s[len(s)-2:]
+	}
+	hourPart, minutePart, hasMinutes := strings.Cut(s, ":")
+	if suffix == "" && !hasMinutes {
+		return 0, 0, false
+	}
+
+	hour, err := strconv.Atoi(hourPart)
+	if err != nil || len(hourPart) > 2 {
+		return 0, 0, false
+	}
+	minute := 0
+	if hasMinutes {
+		if len(minutePart) != 2 {
+			return 0, 0, false
+		}
+		if minute, err = strconv.Atoi(minutePart); err != nil || minute > 59 {
+			return 0, 0, false
+		}
+	}
+
+	switch suffix {
+	case "":
+		if hour > 23 {
+			return 0, 0, false
+		}
+	default:
+		if hour < 1 || hour > 12 {
+			return 0, 0, false
+		}
+		hour %= 12
+		if suffix == "pm" {
+			hour += 12
+		}
+	}
+	return hour, minute, true
+}
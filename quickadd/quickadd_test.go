@@ -0,0 +1,68 @@
+package quickadd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	// A Wednesday morning
+	now := time.Date(2024, time.March, 13, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		text     string
+		title    string
+		due      string
+		priority string
+		labels   []string
+	}{
+		{text: "Buy milk", title: "Buy milk"},
+		{text: "Pay rent tomorrow 5pm !high #finance", title: "Pay rent", due: "2024-03-14T17:00:00Z", priority: "high", labels: []string{"finance"}},
+		{text: "Call mom today", title: "Call mom", due: "2024-03-13"},
+		{text: "Standup at 9:15am", title: "Standup", due: "2024-03-13T09:15:00Z"},
+		{text: "Lunch noon", title: "Lunch", due: "2024-03-13T12:00:00Z"},
+		{text: "Deploy 17:00", title: "Deploy", due: "2024-03-13T17:00:00Z"},
+		{text: "Review friday", title: "Review", due: "2024-03-15"},
+		{text: "Review wednesday", title: "Review", due: "2024-03-20"},
+		{text: "Retro next monday 3 pm", title: "Retro", due: "2024-03-18T15:00:00Z"},
+		{text: "Renew passport in 2 weeks", title: "Renew passport", due: "2024-03-27"},
+		{text: "Taxes due 2024-04-15", title: "Taxes", due: "2024-04-15"},
+		{text: "Party on 5 january", title: "Party", due: "2025-01-05"},
+		{text: "Dentist by mar 20,", title: "Dentist", due: "2024-03-20"},
+		{text: "File feb 30", title: "File feb 30"},
+		{text: "Read chapter 12", title: "Read chapter 12"},
+		{text: "Plan !LOW !high #Work #work #home", title: "Plan !high", priority: "low", labels: []string{"Work", "home"}},
+		{text: "Fix bug! #", title: "Fix bug! #"},
+		{text: "today tomorrow", title: "tomorrow", due: "2024-03-13"},
+		{text: "  ", title: ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.text, func(t *testing.T) {
+			entry := Parse(tc.text, now)
+			if entry.Title != tc.title {
+				t.Errorf("title = %q, want %q", entry.Title, tc.title)
+			}
+			if due := entry.DueDate(); due != tc.due {
+				t.Errorf("due = %q, want %q", due, tc.due)
+			}
+			if entry.Priority != tc.priority {
+				t.Errorf("priority = %q, want %q", entry.Priority, tc.priority)
+			}
+			if !reflect.DeepEqual(entry.Labels, tc.labels) {
+				t.Errorf("labels = %q, want %q", entry.Labels, tc.labels)
+			}
+		})
+	}
+}
+
+func TestParseUsesNowLocation(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	// Late evening in UTC is already tomorrow in Tokyo
+	now := time.Date(2024, time.March, 13, 20, 0, 0, 0, time.UTC).In(tokyo)
+
+	entry := Parse("Call tomorrow 8am", now)
+	if got, want := entry.DueDate(), "2024-03-15T08:00:00+09:00"; got != want {
+		t.Errorf("due = %q, want %q", got, want)
+	}
+}
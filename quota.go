@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// QuotaConfig caps what each user may store, so one user can't fill the
+// disk. 0 disables a limit.
+type QuotaConfig struct {
+	// Stored size of a board, after compression and encryption
+	BoardBytes int64 `json:"boardBytes"`
+	// Tasks on a board, not counting deleted ones
+	Tasks int64 `json:"tasks"`
+	// Total size of a user's attachments
+	AttachmentBytes int64 `json:"attachmentBytes"`
+}
+
+// defaultMaxBoardBodySize bounds requests carrying a whole board when
+// there's no board quota
+const defaultMaxBoardBodySize = 64 * 1024 * 1024 // 64MB
+
+// maxBoardBodySize bounds requests carrying a whole board, such as full
+// syncs, rather than the maxRequestBodySize of other requests. The board
+// quota counts boards as stored, possibly compressed, so requests may be
+// four times its size.
+func maxBoardBodySize(quotas QuotaConfig) int64 {
+	if quotas.BoardBytes <= 0 {
+		return defaultMaxBoardBodySize
+	}
+	return max(4*quotas.BoardBytes, maxRequestBodySize)
+}
+
+// Quota names, as reported in errors
+const (
+	QuotaBoardBytes      = "boardBytes"
+	QuotaTasks           = "tasks"
+	QuotaAttachmentBytes = "attachmentBytes"
+)
+
+// QuotaError reports a change that would take a user over a quota
+type QuotaError struct {
+	Quota string `json:"quota"`
+	Limit int64  `json:"limit"`
+	// Usage the change would have brought the user to
+	Requested int64 `json:"requested"`
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota exceeded: %d is over the limit of %d", e.Quota, e.Requested, e.Limit)
+}
+
+// writeQuotaError responds to a change over a quota: 413 when it's too
+// much data, 422 when it's too many tasks
+func writeQuotaError(w http.ResponseWriter, e *QuotaError) {
+	status := http.StatusRequestEntityTooLarge
+	message := fmt.Sprintf("Storage limit reached: %s would be %d, the limit is %d", e.Quota, e.Requested, e.Limit)
+	if e.Quota == QuotaTasks {
+		status = http.StatusUnprocessableEntity
+		message = fmt.Sprintf("Task limit reached: boards may have at most %d tasks", e.Limit)
+	}
+	writeErrorBody(w, status, "quota_exceeded", message, map[string]any{
+		"quota": e,
+	})
+}
+
+// EnforceQuotas refuses board saves over the board size and task quotas.
+// It must be called before the service is used.
+func (s *DataService) EnforceQuotas(quotas QuotaConfig) {
+	s.quotas = quotas
+}
+
+// liveTaskCount counts a board's tasks that aren't deleted
+func liveTaskCount(data *KanbanData) int64 {
+	var n int64
+	for _, tasks := range [][]Task{data.Tasks, data.UnassignedTasks} {
+		for _, task := range tasks {
+			if !task.Deleted {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// checkBoardQuotas refuses a save that takes a board over a quota. Boards
+// already over one (say, after a limit was lowered) can still be saved as
+// long as they don't grow, so users can get back under it.
+func (s *DataService) checkBoardQuotas(tx *Tx, email string, previous, data *KanbanData, encoded string) error {
+	if limit := s.quotas.Tasks; limit > 0 {
+		if n := liveTaskCount(data); n > limit && n > liveTaskCount(previous) {
+			return &QuotaError{Quota: QuotaTasks, Limit: limit, Requested: n}
+		}
+	}
+
+	if limit := s.quotas.BoardBytes; limit > 0 && int64(len(encoded)) > limit {
+		var stored int64
+		err := tx.QueryRow("SELECT "+s.db.ByteLength("data")+" FROM user_data WHERE email = ?", email).Scan(&stored)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to query board size: %w", err)
+		}
+		if int64(len(encoded)) > stored {
+			return &QuotaError{Quota: QuotaBoardBytes, Limit: limit, Requested: int64(len(encoded))}
+		}
+	}
+	return nil
+}
+
+// QuotaUsage is how much of each quota a user has used
+type QuotaUsage struct {
+	BoardBytes      int64 `json:"boardBytes"`
+	Tasks           int64 `json:"tasks"`
+	AttachmentBytes int64 `json:"attachmentBytes"`
+}
+
+// QuotaService reports usage against the quotas
+type QuotaService struct {
+	db          *DB
+	dataService *DataService
+	quotas      QuotaConfig
+}
+
+func NewQuotaService(db *DB, dataService *DataService, quotas QuotaConfig) *QuotaService {
+	return &QuotaService{db: db, dataService: dataService, quotas: quotas}
+}
+
+// Usage returns what a user stores, measured the way the quotas are
+func (s *QuotaService) Usage(ctx context.Context, email string) (*QuotaUsage, error) {
+	data, err := s.dataService.GetUserData(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	usage := &QuotaUsage{Tasks: liveTaskCount(data)}
+
+	size := s.db.ByteLength
+	err = s.db.QueryRow(`
+		SELECT
+			COALESCE((SELECT `+size("data")+` FROM user_data WHERE email = ?), 0),
+			COALESCE((SELECT SUM(size) FROM attachments WHERE email = ?), 0)
+	`, email, email).Scan(&usage.BoardBytes, &usage.AttachmentBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query storage usage: %w", err)
+	}
+	return usage, nil
+}
+
+// QuotaHandler shows users their usage
+type QuotaHandler struct {
+	quotaService *QuotaService
+}
+
+func NewQuotaHandler(quotaService *QuotaService) *QuotaHandler {
+	return &QuotaHandler{quotaService: quotaService}
+}
+
+// Get returns the user's usage and the limits (0 is unlimited)
+func (h *QuotaHandler) Get(w http.ResponseWriter, r *http.Request) {
+	usage, err := h.quotaService.Usage(r.Context(), requestEmail(r))
+	if err != nil {
+		log.Printf("Error loading storage usage: %v", err)
+		writeServerError(w, err, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"usage":  usage,
+		"limits": h.quotaService.quotas,
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitStatus is a client's standing in its current window. It's sent
+// as headers on API responses and as the data of "rate_limit" WebSocket
+// messages.
+type RateLimitStatus struct {
+	Limit      int       `json:"limit"`
+	Remaining  int       `json:"remaining"`
+	Reset      time.Time `json:"reset"`
+	RetryAfter int       `json:"retryAfter,omitempty"` // Seconds; set once limited
+	allowed    bool
+}
+
+// rateWindow counts one client's requests in a fixed window
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// RateLimiter allows each client a number of requests per fixed window.
+// HTTP requests and WebSocket messages from the same user share a budget.
+type RateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+	lastSweep time.Time
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: make(map[string]*rateWindow),
+	}
+}
+
+// Allow counts a request from a client and reports its status
+func (l *RateLimiter) Allow(key string) RateLimitStatus {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget clients whose window has ended, at most once per window
+	if now.Sub(l.lastSweep) >= l.window {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= l.window {
+				delete(l.windows, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+
+	status := RateLimitStatus{Limit: l.limit, Reset: w.start.Add(l.window)}
+	if w.count >= l.limit {
+		status.RetryAfter = int(math.Ceil(status.Reset.Sub(now).Seconds()))
+		return status
+	}
+	w.count++
+	status.Remaining = l.limit - w.count
+	status.allowed = true
+	return status
+}
+
+// Limited reports whether a client has used up its current window, without
+// counting a request
+func (l *RateLimiter) Limited(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w, ok := l.windows[key]
+	return ok && time.Since(w.start) < l.window && w.count >= l.limit
+}
+
+// clientIP returns the address a request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitKey identifies the client a request counts against: its API key,
+// its user when it carries a valid session token, otherwise its address
+func rateLimitKey(r *http.Request, authService *AuthService) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return "key:" + hashAPIKey(key)
+	}
+	if email, err := authService.AuthenticateRequest(r); err == nil {
+		return "user:" + email
+	}
+	return "ip:" + clientIP(r)
+}
+
+// setRateLimitHeaders describes a status in X-RateLimit-* headers
+func setRateLimitHeaders(w http.ResponseWriter, status RateLimitStatus) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(status.Reset.Unix(), 10))
+}
+
+// writeRateLimited responds with a structured 429 error
+func writeRateLimited(w http.ResponseWriter, status RateLimitStatus) {
+	w.Header().Set("Retry-After", strconv.Itoa(status.RetryAfter))
+	writeErrorBody(w, http.StatusTooManyRequests, "rate_limited", "Too many requests, retry after "+strconv.Itoa(status.RetryAfter)+"s", map[string]any{
+		"retryAfter": status.RetryAfter,
+		"limit":      status.Limit,
+		"reset":      status.Reset,
+	})
+}
+
+// Middleware applies the limit to API requests and the plain HTML views.
+// Frontend assets aren't counted.
+func (l *RateLimiter) Middleware(authService *AuthService, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limited := strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/simple")
+		if !limited || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		status := l.Allow(rateLimitKey(r, authService))
+		setRateLimitHeaders(w, status)
+		if !status.allowed {
+			writeRateLimited(w, status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisTimeout bounds dialing and each publish round trip
+const redisTimeout = 5 * time.Second
+
+// redisAddress is a parsed REDIS_URL: redis://[user:password@]host[:port]
+// or rediss:// for TLS
+type redisAddress struct {
+	host     string
+	username string
+	password string
+	tls      bool
+}
+
+func parseRedisURL(raw string) (redisAddress, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return redisAddress{}, errors.New("must look like redis://[:password@]host:port")
+	}
+
+	addr := redisAddress{host: u.Host, tls: u.Scheme == "rediss"}
+	if u.Port() == "" {
+		addr.host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		addr.username = u.User.Username()
+		addr.password, _ = u.User.Password()
+	}
+	return addr, nil
+}
+
+// redisConn speaks just enough of the Redis protocol (RESP) for pub/sub
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRedis(addr redisAddress) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout, KeepAlive: 15 * time.Second}
+	var conn net.Conn
+	var err error
+	if addr.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr.host, &tls.Config{ServerName: hostOnly(addr.host)})
+	} else {
+		conn, err = dialer.Dial("tcp", addr.host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if addr.password != "" {
+		args := []string{"AUTH", addr.password}
+		if addr.username != "" {
+			args = []string{"AUTH", addr.username, addr.password}
+		}
+		conn.SetDeadline(time.Now().Add(redisTimeout))
+		if _, err := c.do(args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to authenticate to redis: %w", err)
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return c, nil
+}
+
+// hostOnly strips the port from a host:port address
+func hostOnly(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// send writes a command as an array of bulk strings
+func (c *redisConn) send(args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// do sends a command and reads its reply
+func (c *redisConn) do(args ...string) (any, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+// reply reads one reply: a string, int64, []any, nil, or an error reply
+// returned as the error
+func (c *redisConn) reply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed redis reply")
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errors.New("malformed redis reply")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errors.New("malformed redis reply")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply type %q", kind)
+	}
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// redisBroker publishes and subscribes on one Redis pub/sub channel, with a
+// connection for each so the subscriber can block on reads
+type redisBroker struct {
+	addr    redisAddress
+	channel string
+
+	mu  sync.Mutex
+	pub *redisConn
+	sub *redisConn
+
+	closed chan struct{}
+}
+
+func newRedisBroker(cfg PubSubConfig) (*redisBroker, error) {
+	addr, err := parseRedisURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	return &redisBroker{addr: addr, channel: cfg.Channel, closed: make(chan struct{})}, nil
+}
+
+// Publish sends a message to every subscribed instance, reconnecting once
+// if the connection was lost
+func (b *redisBroker) Publish(payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	select {
+	case <-b.closed:
+		return errors.New("redis broker closed")
+	default:
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.pub == nil {
+			if b.pub, err = dialRedis(b.addr); err != nil {
+				continue
+			}
+		}
+		b.pub.conn.SetDeadline(time.Now().Add(redisTimeout))
+		if _, err = b.pub.do("PUBLISH", b.channel, string(payload)); err == nil {
+			return nil
+		}
+		b.pub.Close()
+		b.pub = nil
+	}
+	return err
+}
+
+// Subscribe receives messages until Close, resubscribing with backoff after
+// the connection drops
+func (b *redisBroker) Subscribe(handle func(payload []byte), onReconnect func()) {
+	backoff := time.Second
+	for connected := false; ; {
+		err := b.subscribe(handle, func() {
+			if connected {
+				onReconnect()
+			}
+			connected = true
+			backoff = time.Second
+		})
+
+		select {
+		case <-b.closed:
+			return
+		default:
+		}
+		log.Printf("Redis subscription lost, reconnecting in %s: %v", backoff, err)
+		select {
+		case <-b.closed:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// subscribe runs one subscription until its connection fails
+func (b *redisBroker) subscribe(handle func(payload []byte), subscribed func()) error {
+	conn, err := dialRedis(b.addr)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	select {
+	case <-b.closed:
+		b.mu.Unlock()
+		conn.Close()
+		return errors.New("redis broker closed")
+	default:
+	}
+	b.sub = conn
+	b.mu.Unlock()
+	defer conn.Close()
+
+	conn.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := conn.do("SUBSCRIBE", b.channel); err != nil {
+		return err
+	}
+	conn.conn.SetDeadline(time.Time{})
+	subscribed()
+
+	for {
+		reply, err := conn.reply()
+		if err != nil {
+			return err
+		}
+		// Messages arrive as ["message", channel, payload]
+		items, ok := reply.([]any)
+		if !ok || len(items) != 3 || items[0] != "message" {
+			continue
+		}
+		if payload, ok := items[2].(string); ok {
+			handle([]byte(payload))
+		}
+	}
+}
+
+func (b *redisBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(b.closed)
+	if b.pub != nil {
+		b.pub.Close()
+	}
+	if b.sub != nil {
+		b.sub.Close()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+)
+
+// runReencrypt rewrites every stored board, snapshot and attachment with the
+// current encryption key and compression mode. Run it as "todo-app
+// reencrypt" with the server stopped, after enabling encryption or rotating
+// the key; once it finishes, the previous keys can be dropped.
+func runReencrypt(db *DB, codec *BoardCodec, store AttachmentStore) error {
+	boards, err := reencryptBoards(db, codec, "user_data", "email")
+	if err != nil {
+		return err
+	}
+	snapshots, err := reencryptBoards(db, codec, "board_snapshots", "id")
+	if err != nil {
+		return err
+	}
+	attachments, err := reencryptAttachments(db, store)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Re-encrypted %d boards, %d snapshots and %d attachments", boards, snapshots, attachments)
+	return nil
+}
+
+// reencryptBoards re-encodes the data column of every row in a table of
+// stored boards, identified by key
+func reencryptBoards(db *DB, codec *BoardCodec, table, key string) (int, error) {
+	ids, err := queryStrings(db, "SELECT "+key+" FROM "+table)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s: %w", table, err)
+	}
+
+	for _, id := range ids {
+		var stored string
+		if err := db.QueryRow("SELECT data FROM "+table+" WHERE "+key+" = ?", id).Scan(&stored); err != nil {
+			return 0, fmt.Errorf("failed to read %s %s: %w", table, id, err)
+		}
+		data, err := codec.Decode(stored)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode %s %s: %w", table, id, err)
+		}
+		encoded, err := codec.Encode(data)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode %s %s: %w", table, id, err)
+		}
+		if _, err := db.Exec("UPDATE "+table+" SET data = ? WHERE "+key+" = ?", encoded, id); err != nil {
+			return 0, fmt.Errorf("failed to update %s %s: %w", table, id, err)
+		}
+	}
+	return len(ids), nil
+}
+
+// reencryptAttachments copies every attachment to a new storage key through
+// the store, which encrypts with the current key, then removes the old copy
+func reencryptAttachments(db *DB, store AttachmentStore) (int, error) {
+	ctx := context.Background()
+	ids, err := queryStrings(db, "SELECT id FROM attachments")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list attachments: %w", err)
+	}
+
+	for _, id := range ids {
+		var email, oldKey, contentType string
+		err := db.QueryRow("SELECT email, storage_key, content_type FROM attachments WHERE id = ?", id).Scan(&email, &oldKey, &contentType)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read attachment %s: %w", id, err)
+		}
+
+		rc, err := store.Get(ctx, oldKey)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open attachment %s: %w", id, err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read attachment %s: %w", id, err)
+		}
+
+		newKey := email + "/" + generateID()
+		if err := store.Put(ctx, newKey, bytes.NewReader(content), int64(len(content)), contentType); err != nil {
+			return 0, fmt.Errorf("failed to store attachment %s: %w", id, err)
+		}
+		if _, err := db.Exec("UPDATE attachments SET storage_key = ? WHERE id = ?", newKey, id); err != nil {
+			store.Delete(ctx, newKey)
+			return 0, fmt.Errorf("failed to update attachment %s: %w", id, err)
+		}
+		if err := store.Delete(ctx, oldKey); err != nil {
+			log.Printf("Error deleting old attachment content %s: %v", oldKey, err)
+		}
+	}
+	return len(ids), nil
+}
+
+// queryStrings returns the single string column of a query's rows
+func queryStrings(db *DB, query string) ([]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultReportDays is the range of a summary report without from and to
+const defaultReportDays = 84
+
+// ReportSummary describes a board's flow over a range of UTC days
+type ReportSummary struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// Tasks completed per week, starting on Mondays
+	Throughput []WeeklyCount `json:"throughput"`
+
+	// Tasks in each column at the end of each day
+	CumulativeFlow CumulativeFlow `json:"cumulativeFlow"`
+
+	CycleTime CycleTime    `json:"cycleTime"`
+	Overdue   OverdueCount `json:"overdue"`
+}
+
+// WeeklyCount is a count for the week starting on Week
+type WeeklyCount struct {
+	Week      string `json:"week"`
+	Completed int    `json:"completed"`
+}
+
+// CumulativeFlow holds one count per day for each live column, plus the
+// unassigned tasks
+type CumulativeFlow struct {
+	Days       []string     `json:"days"`
+	Columns    []ColumnFlow `json:"columns"`
+	Unassigned []int        `json:"unassigned"`
+}
+
+type ColumnFlow struct {
+	ColumnID string `json:"columnId"`
+	Title    string `json:"title"`
+	Counts   []int  `json:"counts"`
+}
+
+// CycleTime is the average time from a task's creation to its completion,
+// over the tasks completed in the range whose creation was logged
+type CycleTime struct {
+	AverageHours float64 `json:"averageHours"`
+	Tasks        int     `json:"tasks"`
+}
+
+// OverdueCount counts tasks not yet completed that were due before today,
+// now
+type OverdueCount struct {
+	Total      int            `json:"total"`
+	Unassigned int            `json:"unassigned"`
+	Columns    map[string]int `json:"columns"`
+}
+
+// reportDay returns midnight UTC of a time's day
+func reportDay(t time.Time) time.Time {
+	day, _ := time.Parse("2006-01-02", statsDay(t))
+	return day
+}
+
+// reportWeek returns the Monday starting a day's week
+func reportWeek(day time.Time) time.Time {
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// Summary reports on a board from its activity log. The cumulative flow is
+// worked out backwards from the board's current state, undoing logged
+// changes; moves logged before they recorded their columns can't be undone,
+// so older days may be approximate.
+func (s *StatsService) Summary(email string, data *KanbanData, from, to, now time.Time) (*ReportSummary, error) {
+	days := statsDays(from, to)
+	if len(days) == 0 {
+		return nil, fmt.Errorf("empty report range")
+	}
+	rangeEnd := days[len(days)-1].AddDate(0, 0, 1)
+
+	rows, err := s.db.Query(`
+		SELECT task_id, action, detail, created_at FROM activity_log
+		WHERE email = ?
+		ORDER BY created_at
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query activity: %w", err)
+	}
+	defer rows.Close()
+
+	var activity []TaskActivity
+	for rows.Next() {
+		var a TaskActivity
+		if err := rows.Scan(&a.TaskID, &a.Action, &a.Detail, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan activity: %w", err)
+		}
+		activity = append(activity, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate activity: %w", err)
+	}
+
+	summary := &ReportSummary{
+		From:       statsDay(days[0]),
+		To:         statsDay(days[len(days)-1]),
+		Throughput: []WeeklyCount{},
+	}
+
+	// Throughput and cycle time
+	weeks := make(map[string]int)
+	created := make(map[string]time.Time)
+	var cycleTotal time.Duration
+	for _, a := range activity {
+		switch a.Action {
+		case ActivityCreated:
+			if _, ok := created[a.TaskID]; !ok {
+				created[a.TaskID] = a.CreatedAt
+			}
+		case ActivityCompleted:
+			if a.CreatedAt.Before(days[0]) || !a.CreatedAt.Before(rangeEnd) {
+				continue
+			}
+			weeks[statsDay(reportWeek(reportDay(a.CreatedAt)))]++
+			if start, ok := created[a.TaskID]; ok {
+				cycleTotal += a.CreatedAt.Sub(start)
+				summary.CycleTime.Tasks++
+			}
+		}
+	}
+	for week := reportWeek(days[0]); week.Before(rangeEnd); week = week.AddDate(0, 0, 7) {
+		key := statsDay(week)
+		summary.Throughput = append(summary.Throughput, WeeklyCount{Week: key, Completed: weeks[key]})
+	}
+	if summary.CycleTime.Tasks > 0 {
+		summary.CycleTime.AverageHours = cycleTotal.Hours() / float64(summary.CycleTime.Tasks)
+	}
+
+	summary.CumulativeFlow = cumulativeFlow(data, activity, days)
+	summary.Overdue = countOverdue(data, now)
+	return summary, nil
+}
+
+// cumulativeFlow counts the tasks in each column at the end of each day by
+// undoing the logged changes, newest first, from the board's current state
+func cumulativeFlow(data *KanbanData, activity []TaskActivity, days []time.Time) CumulativeFlow {
+	// Each task's column label, or "" while it's not on the board
+	current := make(map[string]string, len(data.Tasks))
+	where := make(map[string]string, len(data.Tasks))
+	for _, task := range data.Tasks {
+		where[task.ID] = columnLabel(task.ColumnID)
+		if !task.Deleted {
+			current[task.ID] = where[task.ID]
+		}
+	}
+
+	flow := CumulativeFlow{Days: make([]string, len(days)), Columns: []ColumnFlow{}}
+	index := make(map[string]int)
+	for _, col := range sortedColumns(data.Columns) {
+		if col.Deleted {
+			continue
+		}
+		index[col.ID] = len(flow.Columns)
+		flow.Columns = append(flow.Columns, ColumnFlow{ColumnID: col.ID, Title: col.Title, Counts: make([]int, len(days))})
+	}
+	flow.Unassigned = make([]int, len(days))
+
+	next := len(activity) - 1
+	for i := len(days) - 1; i >= 0; i-- {
+		flow.Days[i] = statsDay(days[i])
+		end := days[i].AddDate(0, 0, 1)
+		for ; next >= 0 && !activity[next].CreatedAt.Before(end); next-- {
+			a := activity[next]
+			switch a.Action {
+			case ActivityCreated:
+				delete(current, a.TaskID)
+			case ActivityDeleted:
+				if column, ok := where[a.TaskID]; ok {
+					current[a.TaskID] = column
+				}
+			case ActivityMoved, ActivityCompleted:
+				if old, _, found := strings.Cut(a.Detail, " -> "); found {
+					current[a.TaskID] = old
+				}
+			}
+		}
+
+		for _, column := range current {
+			if column == "none" {
+				flow.Unassigned[i]++
+			} else if c, ok := index[column]; ok {
+				flow.Columns[c].Counts[i]++
+			}
+		}
+	}
+	return flow
+}
+
+// countOverdue counts tasks not yet completed that were due before today
+// (UTC), by column title
+func countOverdue(data *KanbanData, now time.Time) OverdueCount {
+	overdue := OverdueCount{Columns: map[string]int{}}
+	columns := make(map[string]Column)
+	for _, col := range data.Columns {
+		if !col.Deleted {
+			columns[col.ID] = col
+		}
+	}
+
+	today := reportDay(now)
+	for _, task := range data.Tasks {
+		if task.Deleted || task.Hidden || task.Completed {
+			continue
+		}
+		due, ok := parseDueDate(task.DueDate)
+		if !ok || !reportDay(due).Before(today) {
+			continue
+		}
+		if task.ColumnID == nil {
+			overdue.Unassigned++
+		} else if col, ok := columns[*task.ColumnID]; !ok {
+			continue
+		} else {
+			overdue.Columns[col.Title]++
+		}
+		overdue.Total++
+	}
+	return overdue
+}
+
+// ReportHandler serves board reports
+type ReportHandler struct {
+	statsService *StatsService
+	dataService  *DataService
+}
+
+func NewReportHandler(statsService *StatsService, dataService *DataService) *ReportHandler {
+	return &ReportHandler{statsService: statsService, dataService: dataService}
+}
+
+// Summary reports throughput, cumulative flow, cycle time and overdue
+// tasks. from and to are YYYY-MM-DD days, defaulting to the last 12 weeks.
+func (h *ReportHandler) Summary(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+	now := time.Now()
+
+	to := reportDay(now)
+	from := to.AddDate(0, 0, 1-defaultReportDays)
+	for _, param := range []struct {
+		name string
+		day  *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		raw := r.URL.Query().Get(param.name)
+		if raw == "" {
+			continue
+		}
+		day, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s date; use YYYY-MM-DD", param.name))
+			return
+		}
+		*param.day = day
+	}
+	if to.Before(from) {
+		writeError(w, http.StatusBadRequest, "from is after to")
+		return
+	}
+	if to.Sub(from) >= maxStatsDays*24*time.Hour {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Range is limited to %d days", maxStatsDays))
+		return
+	}
+
+	data, err := h.dataService.GetUserData(r.Context(), email)
+	if err != nil {
+		log.Printf("Error getting user data: %v", err)
+		writeServerError(w, err, "Server error")
+		return
+	}
+	summary, err := h.statsService.Summary(email, data, from, to, now)
+	if err != nil {
+		log.Printf("Error building report: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"report": summary,
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// API errors are JSON envelopes, so clients can branch on a stable code
+// rather than parse messages:
+//
+//	{"status": "error", "code": "invalid_json", "message": "...", "fieldErrors": [{"field": "...", "message": "..."}]}
+//
+// Some errors carry more detail next to the code, such as "wipLimit" or
+// "retryAfter". The /simple views answer with plain text, as they're read by
+// people rather than scripts.
+
+// maxRequestBodySize bounds JSON request bodies, matching the WebSocket
+// message limit. Requests carrying a whole board are bounded by
+// maxBoardBodySize instead.
+const maxRequestBodySize = 1024 * 1024 // 1MB
+
+// FieldError is a problem with one field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// errorCodes are the codes of errors without a more specific one
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "validation_failed",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusBadGateway:            "bad_gateway",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// errorCode returns the default code for a status
+func errorCode(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return "internal_error"
+	}
+	return "error"
+}
+
+// writeErrorBody responds with an error envelope plus any extra fields.
+// The message is translated into the response's language.
+func writeErrorBody(w http.ResponseWriter, status int, code, message string, extra map[string]any) {
+	body := map[string]any{
+		"status":  "error",
+		"code":    code,
+		"message": translate(responseLocale(w), message),
+	}
+	for key, value := range extra {
+		body[key] = value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError responds with an error envelope carrying the status's default
+// code
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeErrorBody(w, status, errorCode(status), message, nil)
+}
+
+// writeErrorCode responds with an error envelope and a specific code
+func writeErrorCode(w http.ResponseWriter, status int, code, message string) {
+	writeErrorBody(w, status, code, message, nil)
+}
+
+// writeServerError responds to an unexpected failure. Database queries that
+// timed out, or couldn't get a lock, answer 503 with a Retry-After, since
+// trying again shortly may work; anything else is a 500 with message.
+// Saves refused by a quota or an edit lock, which can come out of any board
+// write, get their quota or lock error instead.
+func writeServerError(w http.ResponseWriter, err error, message string) {
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		writeQuotaError(w, quotaErr)
+		return
+	}
+	var lockErr *LockError
+	if errors.As(err, &lockErr) {
+		writeLockError(w, lockErr)
+		return
+	}
+	if isTimeout(err) || isBusy(err) {
+		w.Header().Set("Retry-After", "1")
+		writeErrorCode(w, http.StatusServiceUnavailable, "database_unavailable", "The database is busy, try again shortly")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, message)
+}
+
+// writeFieldErrors responds with a 422 listing what's wrong with each field
+func writeFieldErrors(w http.ResponseWriter, fieldErrors ...FieldError) {
+	locale := responseLocale(w)
+	for i := range fieldErrors {
+		fieldErrors[i].Message = translate(locale, fieldErrors[i].Message)
+	}
+
+	message := "Invalid request"
+	if len(fieldErrors) == 1 {
+		message = fieldErrors[0].Field + " " + fieldErrors[0].Message
+	}
+	writeErrorBody(w, http.StatusUnprocessableEntity, "validation_failed", message, map[string]any{
+		"fieldErrors": fieldErrors,
+	})
+}
+
+// decodeJSON strictly decodes a request body of at most maxRequestBodySize
+// into v: unknown fields, wrongly typed values and trailing data are
+// rejected. On failure it writes the error response and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	return decodeJSONLimit(w, r, v, maxRequestBodySize)
+}
+
+// decodeJSONLimit is decodeJSON for a body of at most limit bytes
+func decodeJSONLimit(w http.ResponseWriter, r *http.Request, v any, limit int64) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if err == nil {
+		if _, extra := dec.Token(); extra != io.EOF {
+			err = errors.New("trailing data")
+		}
+	}
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body must be at most %d bytes", limit))
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if field == "" {
+			field = "body"
+		}
+		writeErrorBody(w, http.StatusBadRequest, "invalid_json", "Invalid request format", map[string]any{
+			"fieldErrors": []FieldError{{Field: field, Message: "must be " + jsonTypeName(typeErr.Type.Kind())}},
+		})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		writeErrorBody(w, http.StatusBadRequest, "invalid_json", "Invalid request format", map[string]any{
+			"fieldErrors": []FieldError{{Field: field, Message: "is not a known field"}},
+		})
+	default:
+		writeErrorCode(w, http.StatusBadRequest, "invalid_json", "Request body must be a single JSON value")
+	}
+	return false
+}
+
+// jsonTypeName describes a Go kind in JSON terms
+func jsonTypeName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// writeBoardResponse writes {"status": "success", "data": <board>, "aging":
+// <aging>} one task at a time through a buffer, so a big board goes out in
+// chunks rather than being marshalled into one piece first. The JSON is the
+// same as encoding the response as a whole. A nextCursor, when given, is
+// added after aging.
+func writeBoardResponse(w io.Writer, data *KanbanData, aging map[string]TaskAge, nextCursor string) error {
+	bw := bufio.NewWriterSize(w, 32<<10)
+	enc := json.NewEncoder(bw)
+
+	bw.WriteString(`{"status":"success","data":{`)
+	if data.Version != 0 {
+		bw.WriteString(`"version":` + strconv.FormatInt(data.Version, 10) + `,`)
+	}
+	bw.WriteString(`"columns":`)
+	if err := enc.Encode(data.Columns); err != nil {
+		return err
+	}
+	if len(data.Swimlanes) > 0 {
+		bw.WriteString(`,"swimlanes":`)
+		if err := enc.Encode(data.Swimlanes); err != nil {
+			return err
+		}
+	}
+	bw.WriteString(`,"tasks":`)
+	if data.Tasks == nil {
+		bw.WriteString("null")
+	} else {
+		bw.WriteString("[")
+		for i := range data.Tasks {
+			if i > 0 {
+				bw.WriteString(",")
+			}
+			if err := enc.Encode(&data.Tasks[i]); err != nil {
+				return err
+			}
+		}
+		bw.WriteString("]")
+	}
+	if len(data.UnassignedTasks) > 0 {
+		bw.WriteString(`,"unassignedTasks":`)
+		if err := enc.Encode(data.UnassignedTasks); err != nil {
+			return err
+		}
+	}
+	bw.WriteString(`,"unassignedCollapsed":` + strconv.FormatBool(data.UnassignedCollapsed) + `},"aging":`)
+	if err := enc.Encode(aging); err != nil {
+		return err
+	}
+	if nextCursor != "" {
+		bw.WriteString(`,"nextCursor":`)
+		if err := enc.Encode(nextCursor); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SCIM 2.0 provisioning (RFC 7643, 7644), for identity providers such as
+// Okta and Entra ID, authenticated with "Authorization: Bearer $SCIM_TOKEN":
+//
+//	GET    /scim/v2/ServiceProviderConfig
+//	GET    /scim/v2/Users              ?filter=userName eq "..."&startIndex=1&count=100
+//	POST   /scim/v2/Users              creates (or adopts) the user at userName
+//	GET    /scim/v2/Users/{id}
+//	PUT    /scim/v2/Users/{id}
+//	PATCH  /scim/v2/Users/{id}         replaces active or externalId
+//	DELETE /scim/v2/Users/{id}
+//
+// A user's userName is their email address and can't be changed. Setting
+// active to false disables the account like an admin would; deleting
+// deprovisions and disables it, leaving its data for an admin to delete.
+// Attributes other than userName, externalId and active are accepted and
+// ignored.
+
+const (
+	scimContentType  = "application/scim+json"
+	scimUserSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+
+	// scimMaxResults caps the users returned per page
+	scimMaxResults = 100
+)
+
+var (
+	// errSCIMUserExists is returned when provisioning an address twice
+	errSCIMUserExists = errors.New("user is already provisioned")
+
+	// scimFilterPattern is the one filter supported: an attribute equal to
+	// a string
+	scimFilterPattern = regexp.MustCompile(`(?i)^\s*(userName|externalId)\s+eq\s+("(?:[^"\\]|\\.)*")\s*$`)
+)
+
+// SCIMUser is a provisioned user as SCIM represents them
+type SCIMUser struct {
+	Schemas    []string    `json:"schemas"`
+	ID         string      `json:"id"`
+	ExternalID string      `json:"externalId,omitempty"`
+	UserName   string      `json:"userName"`
+	Emails     []SCIMEmail `json:"emails"`
+	Active     bool        `json:"active"`
+	Meta       SCIMMeta    `json:"meta"`
+}
+
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Primary bool   `json:"primary"`
+}
+
+type SCIMMeta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	Location     string     `json:"location,omitempty"`
+}
+
+// scimUserQuery selects provisioned users for scanSCIMUser
+const scimUserQuery = "SELECT email, scim_id, scim_external_id, disabled_at, created_at FROM users WHERE scim_id IS NOT NULL"
+
+func scanSCIMUser(row interface{ Scan(...any) error }) (*SCIMUser, error) {
+	var u SCIMUser
+	var disabledAt, createdAt sql.NullTime
+	if err := row.Scan(&u.UserName, &u.ID, &u.ExternalID, &disabledAt, &createdAt); err != nil {
+		return nil, err
+	}
+	u.Schemas = []string{scimUserSchema}
+	u.Emails = []SCIMEmail{{Value: u.UserName, Primary: true}}
+	u.Active = !disabledAt.Valid
+	u.Meta.ResourceType = "User"
+	if createdAt.Valid {
+		u.Meta.Created = &createdAt.Time
+	}
+	return &u, nil
+}
+
+// SCIMUser returns a provisioned user by SCIM ID
+func (s *DirectoryService) SCIMUser(id string) (*SCIMUser, error) {
+	u, err := scanSCIMUser(s.db.QueryRow(scimUserQuery+" AND scim_id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user: %w", err)
+	}
+	return u, nil
+}
+
+// SCIMUsers returns a page of provisioned users, optionally only those
+// whose attribute ("userName" or "externalId") is value, and how many there
+// are in all. start counts from 1.
+func (s *DirectoryService) SCIMUsers(attribute, value string, start, count int) ([]SCIMUser, int, error) {
+	where, args := "", []any{}
+	switch strings.ToLower(attribute) {
+	case "username":
+		where, args = " AND email = ?", []any{value}
+	case "externalid":
+		where, args = " AND scim_external_id = ?", []any{value}
+	}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE scim_id IS NOT NULL"+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	rows, err := s.db.Query(scimUserQuery+where+" ORDER BY email LIMIT ? OFFSET ?", append(args, count, start-1)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []SCIMUser{}
+	for rows.Next() {
+		u, err := scanSCIMUser(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, *u)
+	}
+	return users, total, rows.Err()
+}
+
+// Provision creates the user at email, or adopts the account already
+// there, and marks them provisioned. The identity provider decides whether
+// they're active.
+func (s *DirectoryService) Provision(email, externalID string, active bool) (*SCIMUser, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := ensureUser(tx, email); err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec("UPDATE users SET scim_id = ?, scim_external_id = ? WHERE email = ? AND scim_id IS NULL", generateID(), externalID, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to provision user: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, errSCIMUserExists
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if err := s.adminService.SetDisabled(email, !active); err != nil {
+		return nil, err
+	}
+	log.Printf("Provisioned %s over SCIM (active: %t)", email, active)
+	return s.scimUserByEmail(email)
+}
+
+// UpdateSCIMUser sets a provisioned user's external ID and whether they're
+// active; nil leaves either as it is
+func (s *DirectoryService) UpdateSCIMUser(id string, externalID *string, active *bool) (*SCIMUser, error) {
+	u, err := s.SCIMUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if externalID != nil {
+		if _, err := s.db.Exec("UPDATE users SET scim_external_id = ? WHERE scim_id = ?", *externalID, id); err != nil {
+			return nil, fmt.Errorf("failed to update user: %w", err)
+		}
+	}
+	if active != nil && *active != u.Active {
+		if err := s.adminService.SetDisabled(u.UserName, !*active); err != nil {
+			return nil, err
+		}
+		log.Printf("Set %s active over SCIM: %t", u.UserName, *active)
+	}
+	return s.SCIMUser(id)
+}
+
+// Deprovision disables a provisioned user and forgets their SCIM ID. Their
+// data stays until an admin deletes the account.
+func (s *DirectoryService) Deprovision(id string) error {
+	u, err := s.SCIMUser(id)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.Exec("UPDATE users SET scim_id = NULL, scim_external_id = '' WHERE scim_id = ?", id); err != nil {
+		return fmt.Errorf("failed to deprovision user: %w", err)
+	}
+	if err := s.adminService.SetDisabled(u.UserName, true); err != nil {
+		return err
+	}
+	log.Printf("Deprovisioned %s over SCIM", u.UserName)
+	return nil
+}
+
+func (s *DirectoryService) scimUserByEmail(email string) (*SCIMUser, error) {
+	u, err := scanSCIMUser(s.db.QueryRow(scimUserQuery+" AND email = ?", email))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user: %w", err)
+	}
+	return u, nil
+}
+
+// SCIMHandler serves the SCIM provisioning API
+type SCIMHandler struct {
+	directoryService *DirectoryService
+	token            string
+}
+
+func NewSCIMHandler(directoryService *DirectoryService, token string) *SCIMHandler {
+	return &SCIMHandler{directoryService: directoryService, token: token}
+}
+
+// Authenticate wraps a handler so it only runs for requests carrying the
+// SCIM token
+func (h *SCIMHandler) Authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.token == "" {
+			writeSCIMError(w, http.StatusNotFound, "", "SCIM provisioning is not configured")
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+			writeSCIMError(w, http.StatusUnauthorized, "", "Invalid token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// ServiceProviderConfig describes what the API supports
+func (h *SCIMHandler) ServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	writeSCIM(w, http.StatusOK, map[string]any{
+		"schemas":        []string{scimConfigSchema},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": scimMaxResults},
+		"changePassword": map[string]bool{"supported": false},
+		"sort":           map[string]bool{"supported": false},
+		"etag":           map[string]bool{"supported": false},
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "The SCIM_TOKEN configured on the server",
+		}},
+	})
+}
+
+// ListUsers returns a page of provisioned users
+func (h *SCIMHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var attribute, value string
+	if filter := query.Get("filter"); filter != "" {
+		m := scimFilterPattern.FindStringSubmatch(filter)
+		if m == nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidFilter", `Only userName eq "..." and externalId eq "..." filters are supported`)
+			return
+		}
+		attribute = m[1]
+		value, _ = strconv.Unquote(m[2])
+	}
+	start, count := 1, scimMaxResults
+	if raw := query.Get("startIndex"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 1 {
+			start = n
+		}
+	}
+	if raw := query.Get("count"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n >= 0 && n < scimMaxResults {
+			count = n
+		}
+	}
+
+	users, total, err := h.directoryService.SCIMUsers(attribute, value, start, count)
+	if err != nil {
+		log.Printf("Error listing SCIM users: %v", err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Server error")
+		return
+	}
+	for i := range users {
+		users[i].Meta.Location = scimLocation(r, users[i].ID)
+	}
+	writeSCIM(w, http.StatusOK, map[string]any{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   start,
+		"itemsPerPage": len(users),
+		"Resources":    users,
+	})
+}
+
+// scimUserRequest is the part of a SCIM user a POST or PUT can set
+type scimUserRequest struct {
+	UserName   string          `json:"userName"`
+	ExternalID *string         `json:"externalId"`
+	Active     json.RawMessage `json:"active"`
+	Emails     []SCIMEmail     `json:"emails"`
+}
+
+// email is the address userName holds, or failing that the primary email
+func (req *scimUserRequest) email() string {
+	if email := strings.TrimSpace(req.UserName); email != "" {
+		return email
+	}
+	for _, e := range req.Emails {
+		if e.Primary {
+			return strings.TrimSpace(e.Value)
+		}
+	}
+	return ""
+}
+
+// CreateUser provisions a user
+func (h *SCIMHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var req scimUserRequest
+	if !decodeSCIM(w, r, &req) {
+		return
+	}
+	email := req.email()
+	if !strings.Contains(email, "@") {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "userName must be an email address")
+		return
+	}
+	active, err := scimBool(req.Active, true)
+	if err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "active must be a boolean")
+		return
+	}
+	externalID := ""
+	if req.ExternalID != nil {
+		externalID = *req.ExternalID
+	}
+
+	u, err := h.directoryService.Provision(email, externalID, active)
+	if err == errSCIMUserExists {
+		writeSCIMError(w, http.StatusConflict, "uniqueness", "A user with that userName is already provisioned")
+		return
+	}
+	if err != nil {
+		log.Printf("Error provisioning SCIM user: %v", err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Server error")
+		return
+	}
+	u.Meta.Location = scimLocation(r, u.ID)
+	w.Header().Set("Location", u.Meta.Location)
+	writeSCIM(w, http.StatusCreated, u)
+}
+
+// GetUser returns a provisioned user
+func (h *SCIMHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	u, err := h.directoryService.SCIMUser(mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMUserError(w, err)
+		return
+	}
+	u.Meta.Location = scimLocation(r, u.ID)
+	writeSCIM(w, http.StatusOK, u)
+}
+
+// ReplaceUser sets a user's externalId and active from a full
+// representation
+func (h *SCIMHandler) ReplaceUser(w http.ResponseWriter, r *http.Request) {
+	var req scimUserRequest
+	if !decodeSCIM(w, r, &req) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	u, err := h.directoryService.SCIMUser(id)
+	if err != nil {
+		writeSCIMUserError(w, err)
+		return
+	}
+	if email := req.email(); email != "" && !strings.EqualFold(email, u.UserName) {
+		writeSCIMError(w, http.StatusBadRequest, "mutability", "userName can't be changed")
+		return
+	}
+	active, err := scimBool(req.Active, true)
+	if err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "active must be a boolean")
+		return
+	}
+	externalID := ""
+	if req.ExternalID != nil {
+		externalID = *req.ExternalID
+	}
+
+	h.updateUser(w, r, id, &externalID, &active)
+}
+
+// PatchUser applies a PatchOp's operations to a user
+func (h *SCIMHandler) PatchUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Operations []struct {
+			Op    string          `json:"op"`
+			Path  string          `json:"path"`
+			Value json.RawMessage `json:"value"`
+		} `json:"Operations"`
+	}
+	if !decodeSCIM(w, r, &req) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	u, err := h.directoryService.SCIMUser(id)
+	if err != nil {
+		writeSCIMUserError(w, err)
+		return
+	}
+
+	var externalID *string
+	var active *bool
+	for _, op := range req.Operations {
+		// Without a path the value holds the attributes to set
+		values := map[string]json.RawMessage{}
+		if op.Path == "" {
+			if err := json.Unmarshal(op.Value, &values); err != nil {
+				writeSCIMError(w, http.StatusBadRequest, "invalidValue", "value must be an object when there's no path")
+				return
+			}
+		} else {
+			values[op.Path] = op.Value
+		}
+
+		switch strings.ToLower(op.Op) {
+		case "add", "replace":
+		case "remove":
+			if strings.EqualFold(op.Path, "externalId") {
+				externalID = new(string)
+				continue
+			}
+			writeSCIMError(w, http.StatusBadRequest, "mutability", "Only externalId can be removed")
+			return
+		default:
+			writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", fmt.Sprintf("Unsupported op %q", op.Op))
+			return
+		}
+		for path, raw := range values {
+			switch strings.ToLower(path) {
+			case "active":
+				v, err := scimBool(raw, true)
+				if err != nil {
+					writeSCIMError(w, http.StatusBadRequest, "invalidValue", "active must be a boolean")
+					return
+				}
+				active = &v
+			case "externalid":
+				var v string
+				if err := json.Unmarshal(raw, &v); err != nil {
+					writeSCIMError(w, http.StatusBadRequest, "invalidValue", "externalId must be a string")
+					return
+				}
+				externalID = &v
+			case "username":
+				var v string
+				if err := json.Unmarshal(raw, &v); err != nil || !strings.EqualFold(v, u.UserName) {
+					writeSCIMError(w, http.StatusBadRequest, "mutability", "userName can't be changed")
+					return
+				}
+			}
+		}
+	}
+
+	h.updateUser(w, r, id, externalID, active)
+}
+
+func (h *SCIMHandler) updateUser(w http.ResponseWriter, r *http.Request, id string, externalID *string, active *bool) {
+	u, err := h.directoryService.UpdateSCIMUser(id, externalID, active)
+	if err != nil {
+		writeSCIMUserError(w, err)
+		return
+	}
+	u.Meta.Location = scimLocation(r, u.ID)
+	writeSCIM(w, http.StatusOK, u)
+}
+
+// DeleteUser deprovisions a user
+func (h *SCIMHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	if err := h.directoryService.Deprovision(mux.Vars(r)["id"]); err != nil {
+		writeSCIMUserError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scimBool reads a boolean, accepting the "True" and "False" strings some
+// identity providers send; a missing value is fallback
+func scimBool(raw json.RawMessage, fallback bool) (bool, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return fallback, nil
+	}
+	var v bool
+	if err := json.Unmarshal(raw, &v); err == nil {
+		return v, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(strings.ToLower(s))
+}
+
+// scimLocation is the URL of a user in the API
+func scimLocation(r *http.Request, id string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/scim/v2/Users/%s", scheme, r.Host, id)
+}
+
+// decodeSCIM decodes a request body, answering a SCIM error if it can't.
+// Unknown attributes are allowed, since identity providers send many.
+func decodeSCIM(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize)).Decode(v); err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "Invalid request body")
+		return false
+	}
+	return true
+}
+
+func writeSCIM(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeSCIMError answers with a SCIM error; scimType may be empty
+func writeSCIMError(w http.ResponseWriter, status int, scimType, detail string) {
+	body := map[string]any{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	writeSCIM(w, status, body)
+}
+
+// writeSCIMUserError answers a failed lookup or update of a user
+func writeSCIMUserError(w http.ResponseWriter, err error) {
+	if err == errUserNotFound {
+		writeSCIMError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+	log.Printf("Error updating SCIM user: %v", err)
+	writeSCIMError(w, http.StatusInternalServerError, "", "Server error")
+}
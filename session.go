@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Following a magic link redirects to /?code=<code> rather than putting
+// the session token in the URL, where it would end up in browser history
+// and access logs. The frontend swaps the code for a session with
+// POST /api/auth/exchange. Codes work once and are kept in memory, like
+// magic link tokens.
+//
+// Sessions are Bearer tokens, or with AUTH_SESSION=cookie an HttpOnly
+// session cookie. Cookie sessions come with a csrf_token cookie that the
+// frontend can read; state-changing API requests authenticated by the cookie
+// must echo it in an X-CSRF-Token header (double submit). Another site can
+// make the browser send the cookies but can't read them to set the header.
+
+// exchangeCodeTTL is how long a magic link's exchange code stays valid
+const exchangeCodeTTL = time.Minute
+
+// sessionCookie holds the session token for clients that ask for a cookie
+// instead of a token, and csrfCookie the token to echo in csrfHeader
+const (
+	sessionCookie = "session"
+	csrfCookie    = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+var (
+	errExchangeCode = errors.New("invalid or expired code")
+	errCSRFToken    = errors.New("invalid CSRF token")
+)
+
+// exchangeCode is a pending sign-in waiting to be exchanged for a session
+type exchangeCode struct {
+	email   string
+	expires time.Time
+}
+
+// CreateExchangeCode issues a one-time code that RedeemExchangeCode turns
+// back into the user's email
+func (s *AuthService) CreateExchangeCode(email string) (string, error) {
+	code, err := randomToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate code: %w", err)
+	}
+
+	now := time.Now()
+	s.codesMu.Lock()
+	defer s.codesMu.Unlock()
+	for key, c := range s.codes {
+		if now.After(c.expires) {
+			delete(s.codes, key)
+		}
+	}
+	s.codes[code] = exchangeCode{email: email, expires: now.Add(exchangeCodeTTL)}
+	return code, nil
+}
+
+// RedeemExchangeCode removes a code and returns its email; each code works
+// once
+func (s *AuthService) RedeemExchangeCode(code string) (string, error) {
+	s.codesMu.Lock()
+	defer s.codesMu.Unlock()
+
+	c, ok := s.codes[code]
+	if !ok {
+		return "", errExchangeCode
+	}
+	delete(s.codes, code)
+	if time.Now().After(c.expires) {
+		return "", errExchangeCode
+	}
+	return c.email, nil
+}
+
+// randomToken returns 32 random bytes as unpadded URL-safe base64
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// setSessionCookie stores a session token in an HttpOnly cookie that
+// browsers only send on same-site requests, next to a fresh CSRF token
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string) error {
+	csrf, err := randomToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate CSRF token: %w", err)
+	}
+
+	expires := time.Now().Add(7 * 24 * time.Hour)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	// Readable by the frontend, which echoes it in csrfHeader
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    csrf,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{sessionCookie, csrfCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: name == sessionCookie,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+// StartSession signs a user in at the end of a sign-in flow. session is
+// "cookie" or "token", or empty for the AUTH_SESSION default. The response
+// carries the email, and the token unless it went into a cookie.
+func (s *AuthService) StartSession(w http.ResponseWriter, r *http.Request, email, session string) {
+	token, err := s.CreateJWT(email)
+	if err != nil {
+		writeSignInError(w, err)
+		return
+	}
+
+	response := map[string]string{
+		"status": "success",
+		"email":  email,
+	}
+	if session == "cookie" || (session == "" && s.cookieSessions) {
+		if err := setSessionCookie(w, r, token); err != nil {
+			log.Printf("Error starting cookie session: %v", err)
+			writeError(w, http.StatusInternalServerError, "Authentication error")
+			return
+		}
+	} else {
+		response["token"] = token
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// checkCSRF verifies the double-submit token of a state-changing request
+// authenticated by the session cookie. Requests with an Authorization or
+// X-API-Key header don't use the cookie, and other requests can't change
+// anything.
+func checkCSRF(r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != "" {
+		return nil
+	}
+	if _, err := r.Cookie(sessionCookie); err != nil {
+		return nil
+	}
+
+	cookie, err := r.Cookie(csrfCookie)
+	header := r.Header.Get(csrfHeader)
+	if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+		return errCSRFToken
+	}
+	return nil
+}
+
+// CSRFMiddleware rejects API requests that fail checkCSRF. The /simple
+// views use their own cookie and form tokens.
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			if err := checkCSRF(r); err != nil {
+				writeErrorCode(w, http.StatusForbidden, "invalid_csrf_token", "Invalid CSRF token")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Exchange swaps a magic link's code for a session. With "session":
+// "cookie" (the default with AUTH_SESSION=cookie) the token is set as an
+// HttpOnly cookie instead of returned.
+func (h *AuthHandler) Exchange(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code    string `json:"code"`
+		Session string `json:"session"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Code == "" {
+		writeFieldErrors(w, FieldError{Field: "code", Message: "is required"})
+		return
+	}
+	if req.Session != "" && req.Session != "token" && req.Session != "cookie" {
+		writeFieldErrors(w, FieldError{Field: "session", Message: "must be token or cookie"})
+		return
+	}
+
+	email, err := h.authService.RedeemExchangeCode(req.Code)
+	if err != nil {
+		writeErrorCode(w, http.StatusUnauthorized, "invalid_code", "Invalid or expired code")
+		return
+	}
+
+	h.authService.StartSession(w, r, email, req.Session)
+}
+
+// Logout clears the session and CSRF cookies. Bearer tokens are simply
+// discarded by the client.
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	clearSessionCookie(w, r)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// UserSettings are a user's preferences that the server acts on
+type UserSettings struct {
+	// Columns whose tasks never produce notifications (reminders, digests)
+	MutedColumns []string `json:"mutedColumns"`
+
+	// Days a task may sit in a done column before it's archived; 0 disables
+	AutoArchiveDays int `json:"autoArchiveDays"`
+
+	// Locale for server messages and emails; empty follows the browser
+	Language string `json:"language,omitempty"`
+
+	// How full syncs settle disagreements when they don't name a strategy;
+	// empty is clientWins
+	MergeStrategy string `json:"mergeStrategy,omitempty"`
+}
+
+// ColumnMuted reports whether a task in the given column should be left
+// out of notifications. Unassigned tasks are never muted.
+func (s *UserSettings) ColumnMuted(columnID *string) bool {
+	if columnID == nil {
+		return false
+	}
+	return containsString(s.MutedColumns, *columnID)
+}
+
+// NotifiableTasks returns the live tasks the user wants to hear about
+func (s *UserSettings) NotifiableTasks(data *KanbanData) []Task {
+	var tasks []Task
+	for _, task := range data.Tasks {
+		if task.Deleted || s.ColumnMuted(task.ColumnID) {
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// SettingsService stores user settings
+type SettingsService struct {
+	db *DB
+}
+
+func NewSettingsService(db *DB) *SettingsService {
+	return &SettingsService{db: db}
+}
+
+// Get returns a user's settings, or the defaults if none are saved
+func (s *SettingsService) Get(email string) (*UserSettings, error) {
+	var raw string
+	err := s.db.QueryRow("SELECT settings FROM user_settings WHERE email = ?", email).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return &UserSettings{MutedColumns: []string{}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query settings: %w", err)
+	}
+
+	var settings UserSettings
+	if err := json.Unmarshal([]byte(raw), &settings); err != nil {
+		return nil, fmt.Errorf("failed to decode settings: %w", err)
+	}
+	if settings.MutedColumns == nil {
+		settings.MutedColumns = []string{}
+	}
+	return &settings, nil
+}
+
+// Language returns the locale a user picked, or "" to follow their browser
+func (s *SettingsService) Language(email string) string {
+	settings, err := s.Get(email)
+	if err != nil {
+		log.Printf("Error loading language setting: %v", err)
+		return ""
+	}
+	return settings.Language
+}
+
+// MergeStrategy returns the merge strategy a user picked, or "" for the
+// default
+func (s *SettingsService) MergeStrategy(email string) string {
+	settings, err := s.Get(email)
+	if err != nil {
+		log.Printf("Error loading merge strategy setting: %v", err)
+		return ""
+	}
+	return settings.MergeStrategy
+}
+
+// List returns every saved user's settings, keyed by email
+func (s *SettingsService) List() (map[string]*UserSettings, error) {
+	rows, err := s.db.Query("SELECT email, settings FROM user_settings")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query settings: %w", err)
+	}
+	defer rows.Close()
+
+	all := make(map[string]*UserSettings)
+	for rows.Next() {
+		var email, raw string
+		if err := rows.Scan(&email, &raw); err != nil {
+			return nil, fmt.Errorf("failed to scan settings: %w", err)
+		}
+		var settings UserSettings
+		if err := json.Unmarshal([]byte(raw), &settings); err != nil {
+			return nil, fmt.Errorf("failed to decode settings for %s: %w", email, err)
+		}
+		all[email] = &settings
+	}
+	return all, rows.Err()
+}
+
+// Save replaces a user's settings
+func (s *SettingsService) Save(email string, settings *UserSettings) error {
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to encode settings: %w", err)
+	}
+
+	if err := ensureUser(s.db, email); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO user_settings (email, settings, updated_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(email) DO UPDATE SET
+			settings = excluded.settings,
+			updated_at = CURRENT_TIMESTAMP
+	`, email, string(raw))
+	if err != nil {
+		return fmt.Errorf("failed to save settings: %w", err)
+	}
+	return nil
+}
+
+// SettingsHandler exposes user settings over HTTP
+type SettingsHandler struct {
+	settingsService *SettingsService
+}
+
+func NewSettingsHandler(settingsService *SettingsService) *SettingsHandler {
+	return &SettingsHandler{settingsService: settingsService}
+}
+
+// Get returns the user's settings
+func (h *SettingsHandler) Get(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.settingsService.Get(requestEmail(r))
+	if err != nil {
+		log.Printf("Error loading settings: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"settings": settings,
+	})
+}
+
+// Update replaces the user's settings
+func (h *SettingsHandler) Update(w http.ResponseWriter, r *http.Request) {
+	var settings UserSettings
+	if !decodeJSON(w, r, &settings) {
+		return
+	}
+
+	if settings.AutoArchiveDays < 0 {
+		writeError(w, http.StatusBadRequest, "autoArchiveDays cannot be negative")
+		return
+	}
+	if settings.Language != "" && !supportedLocale(settings.Language) {
+		writeFieldErrors(w, FieldError{Field: "language", Message: "must be one of " + strings.Join(supportedLocales, ", ")})
+		return
+	}
+	if !validMergeStrategy(settings.MergeStrategy) {
+		writeFieldErrors(w, invalidMergeStrategy("mergeStrategy"))
+		return
+	}
+
+	// Drop duplicates and blanks
+	muted := []string{}
+	for _, id := range settings.MutedColumns {
+		if id != "" && !containsString(muted, id) {
+			muted = append(muted, id)
+		}
+	}
+	settings.MutedColumns = muted
+
+	if err := h.settingsService.Save(requestEmail(r), &settings); err != nil {
+		log.Printf("Error saving settings: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to save settings")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"settings": settings,
+	})
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Public share links give read-only access to a board without signing in:
+//
+//	POST   /api/boards/{id}/share-link            {"expiresAt": "..."}
+//	GET    /api/boards/{id}/share-links
+//	DELETE /api/boards/{id}/share-links/{linkId}
+//	GET    /api/share/{token}                     board as JSON
+//	GET    /share/{token}                         board as a page
+//
+// The token is random and only its hash is stored, so the URL works until
+// it expires or its link is deleted. Views are counted. The shared board
+// leaves out deleted and hidden items and the owner's email, and nothing
+// under /share or /api/share can change it.
+
+const (
+	// shareLinkPrefix starts every share token
+	shareLinkPrefix = "tds_"
+
+	// How long a share link lasts when no expiry is given, and at most
+	defaultShareLinkTTL = 30 * 24 * time.Hour
+	maxShareLinkTTL     = 365 * 24 * time.Hour
+)
+
+var (
+	errShareLinkNotFound = errors.New("share link not found")
+	errShareLinkExpired  = errors.New("share link expired")
+)
+
+// ShareLink describes a public link to a board. The URL is only returned
+// when the link is created.
+type ShareLink struct {
+	ID           string     `json:"id"`
+	Board        string     `json:"board"`
+	Prefix       string     `json:"prefix"` // First characters of the token, to tell links apart
+	URL          string     `json:"url,omitempty"`
+	ExpiresAt    time.Time  `json:"expiresAt"`
+	Views        int        `json:"views"`
+	LastViewedAt *time.Time `json:"lastViewedAt,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt"`
+}
+
+// SharedBoard is the read-only board served to share link visitors
+type SharedBoard struct {
+	Version   int64      `json:"version"`
+	Columns   []Column   `json:"columns"`
+	Swimlanes []Swimlane `json:"swimlanes,omitempty"`
+	Tasks     []Task     `json:"tasks"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+}
+
+// ShareService issues, lists and resolves share links
+type ShareService struct {
+	db          *DB
+	authService *AuthService
+}
+
+func NewShareService(db *DB, authService *AuthService) *ShareService {
+	return &ShareService{db: db, authService: authService}
+}
+
+// Create issues a link to a board, returning its token along with its
+// description
+func (s *ShareService) Create(email, board string, expiresAt time.Time) (string, *ShareLink, error) {
+	secret, err := s.authService.generateSecureToken(32)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate share token: %w", err)
+	}
+	token := shareLinkPrefix + secret
+
+	if err := ensureUser(s.db, email); err != nil {
+		return "", nil, err
+	}
+
+	link := &ShareLink{
+		ID:        generateID(),
+		Board:     board,
+		Prefix:    token[:len(shareLinkPrefix)+6],
+		ExpiresAt: expiresAt.UTC(),
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO share_links (id, email, board, token_hash, prefix, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, link.ID, email, board, hashAPIKey(token), link.Prefix, link.ExpiresAt, link.CreatedAt)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to store share link: %w", err)
+	}
+
+	return token, link, nil
+}
+
+// List returns a board's links, newest first, expired ones included
+func (s *ShareService) List(board string) ([]ShareLink, error) {
+	rows, err := s.db.Query(`
+		SELECT id, board, prefix, expires_at, views, last_viewed_at, created_at
+		FROM share_links WHERE board = ? ORDER BY created_at DESC
+	`, board)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query share links: %w", err)
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		var link ShareLink
+		var lastViewed sql.NullTime
+		if err := rows.Scan(&link.ID, &link.Board, &link.Prefix, &link.ExpiresAt, &link.Views, &lastViewed, &link.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan share link: %w", err)
+		}
+		if lastViewed.Valid {
+			link.LastViewedAt = &lastViewed.Time
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// Revoke deletes one of a board's links
+func (s *ShareService) Revoke(board, id string) error {
+	result, err := s.db.Exec("DELETE FROM share_links WHERE id = ? AND board = ?", id, board)
+	if err != nil {
+		return fmt.Errorf("failed to delete share link: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errShareLinkNotFound
+	}
+	return nil
+}
+
+// Open returns the board a token shares and when the link expires,
+// counting the view
+func (s *ShareService) Open(token string) (string, time.Time, error) {
+	hash := hashAPIKey(token)
+
+	var board string
+	var expiresAt time.Time
+	err := s.db.QueryRow("SELECT board, expires_at FROM share_links WHERE token_hash = ?", hash).Scan(&board, &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, errShareLinkNotFound
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to query share link: %w", err)
+	}
+	if !time.Now().Before(expiresAt) {
+		return "", time.Time{}, errShareLinkExpired
+	}
+
+	if _, err := s.db.Exec("UPDATE share_links SET views = views + 1, last_viewed_at = ? WHERE token_hash = ?", time.Now().UTC(), hash); err != nil {
+		log.Printf("Error counting share link view: %v", err)
+	}
+	return board, expiresAt, nil
+}
+
+// ShareHandler manages share links and serves shared boards
+type ShareHandler struct {
+	shareService *ShareService
+	dataService  *DataService
+	cfg          *Config
+}
+
+func NewShareHandler(shareService *ShareService, dataService *DataService, cfg *Config) *ShareHandler {
+	return &ShareHandler{shareService: shareService, dataService: dataService, cfg: cfg}
+}
+
+// pathBoard addresses the board named in the path
+func pathBoard(r *http.Request) string {
+	return mux.Vars(r)["id"]
+}
+
+// Create issues a share link for the board, expiring at expiresAt
+// (default 30 days, at most a year from now)
+func (h *ShareHandler) Create(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+
+	var req struct {
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}
+	if r.ContentLength != 0 && !decodeJSON(w, r, &req) {
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(defaultShareLinkTTL)
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) || req.ExpiresAt.After(now.Add(maxShareLinkTTL)) {
+			writeFieldErrors(w, FieldError{Field: "expiresAt", Message: "must be in the future and within a year"})
+			return
+		}
+		expiresAt = *req.ExpiresAt
+	}
+
+	token, link, err := h.shareService.Create(email, canonicalBoardID(email, pathBoard(r)), expiresAt)
+	if err != nil {
+		log.Printf("Error creating share link: %v", err)
+		writeServerError(w, err, "Failed to create share link")
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	link.URL = fmt.Sprintf("%s://%s/share/%s", scheme, r.Host, token)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"link":   link,
+	})
+}
+
+// List returns the board's share links with their view counts
+func (h *ShareHandler) List(w http.ResponseWriter, r *http.Request) {
+	links, err := h.shareService.List(canonicalBoardID(requestEmail(r), pathBoard(r)))
+	if err != nil {
+		log.Printf("Error listing share links: %v", err)
+		writeServerError(w, err, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"links":  links,
+	})
+}
+
+// Revoke deletes a share link; its URL stops working at once
+func (h *ShareHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	err := h.shareService.Revoke(canonicalBoardID(requestEmail(r), pathBoard(r)), mux.Vars(r)["linkId"])
+	if err == errShareLinkNotFound {
+		writeError(w, http.StatusNotFound, "Share link not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking share link: %v", err)
+		writeServerError(w, err, "Failed to revoke share link")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+	})
+}
+
+// sharedBoard opens the link in the path and loads its board
+func (h *ShareHandler) sharedBoard(r *http.Request) (*SharedBoard, error) {
+	board, expiresAt, err := h.shareService.Open(mux.Vars(r)["token"])
+	if err != nil {
+		return nil, err
+	}
+	data, err := h.dataService.GetUserData(r.Context(), board)
+	if err != nil {
+		return nil, err
+	}
+
+	live := buildBoardExport(board, data, false)
+	return &SharedBoard{
+		Version:   data.Version,
+		Columns:   live.Columns,
+		Swimlanes: live.Swimlanes,
+		Tasks:     live.Tasks,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// Get serves a shared board as JSON
+func (h *ShareHandler) Get(w http.ResponseWriter, r *http.Request) {
+	shared, err := h.sharedBoard(r)
+	switch {
+	case err == errShareLinkNotFound:
+		writeError(w, http.StatusNotFound, "Share link not found")
+		return
+	case err == errShareLinkExpired:
+		writeErrorCode(w, http.StatusGone, "share_link_expired", "Share link expired")
+		return
+	case err != nil:
+		log.Printf("Error loading shared board: %v", err)
+		writeServerError(w, err, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"board":  shared,
+	})
+}
+
+// Page serves a shared board as a plain HTML page
+func (h *ShareHandler) Page(w http.ResponseWriter, r *http.Request) {
+	shared, err := h.sharedBoard(r)
+	switch {
+	case err == errShareLinkNotFound:
+		http.Error(w, "This link doesn't exist or was revoked", http.StatusNotFound)
+		return
+	case err == errShareLinkExpired:
+		http.Error(w, "This link has expired", http.StatusGone)
+		return
+	case err != nil:
+		log.Printf("Error loading shared board: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	page := simplePage{
+		AppName: h.cfg.Branding.AppName,
+		Title:   "Shared board",
+		Columns: buildSimpleColumns(&KanbanData{Columns: shared.Columns, Tasks: shared.Tasks}),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	if err := simpleTemplates.ExecuteTemplate(w, "shared", page); err != nil {
+		log.Printf("Error rendering shared page: %v", err)
+	}
+}
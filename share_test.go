@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShareLinks(t *testing.T) {
+	shares := NewShareService(newTestDB(t), newTestAuthService())
+	email := "a@example.com"
+
+	token, link, err := shares.Create(email, email, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		board, _, err := shares.Open(token)
+		if err != nil || board != email {
+			t.Fatalf("Open = %q, %v, want %q", board, err, email)
+		}
+	}
+	if _, _, err := shares.Open(token + "x"); err != errShareLinkNotFound {
+		t.Errorf("Open with a wrong token: %v, want %v", err, errShareLinkNotFound)
+	}
+
+	links, err := shares.List(email)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(links) != 1 || links[0].ID != link.ID || links[0].Views != 2 || links[0].LastViewedAt == nil {
+		t.Errorf("links = %+v, want one link viewed twice", links)
+	}
+
+	if err := shares.Revoke("b@example.com", link.ID); err != errShareLinkNotFound {
+		t.Errorf("revoking from another board: %v, want %v", err, errShareLinkNotFound)
+	}
+	if err := shares.Revoke(email, link.ID); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if _, _, err := shares.Open(token); err != errShareLinkNotFound {
+		t.Errorf("Open after revoking: %v, want %v", err, errShareLinkNotFound)
+	}
+
+	expired, _, err := shares.Create(email, email, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, _, err := shares.Open(expired); err != errShareLinkExpired {
+		t.Errorf("Open an expired link: %v, want %v", err, errShareLinkExpired)
+	}
+}
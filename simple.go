@@ -0,0 +1,488 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// simpleSessionCookie holds the session token for the plain HTML views,
+// which can't send an Authorization header
+const simpleSessionCookie = "simple_session"
+
+// simpleTemplates renders the plain HTML views. They use no scripts and
+// only a little inline CSS, so they work with screen readers, text browsers
+// and scripts that scrape HTML.
+var simpleTemplates = template.Must(template.New("simple").Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} - {{.AppName}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 0 auto; padding: 1em; line-height: 1.5; }
+.skip { position: absolute; left: -999em; }
+.skip:focus { position: static; }
+li form { display: inline; }
+</style>
+</head>
+<body>
+<a class="skip" href="#main">Skip to content</a>
+<header><p><strong>{{.AppName}}</strong>{{if .Email}} &mdash; signed in as {{.Email}}{{end}}</p></header>
+<main id="main">
+<h1>{{.Title}}</h1>
+{{if .Notice}}<p role="status">{{.Notice}}</p>{{end}}
+{{if .Error}}<p role="alert"><strong>Error:</strong> {{.Error}}</p>{{end}}
+{{end}}
+
+{{define "footer"}}</main>
+</body>
+</html>
+{{end}}
+
+{{define "login"}}{{template "header" .}}
+<form method="post" action="/simple/login">
+<p><label for="email">Email address</label><br>
+<input type="email" id="email" name="email" required autocomplete="email"></p>
+<p><button type="submit">Send sign-in link</button></p>
+</form>
+{{if .MagicLink}}<p>Development mode, no email was sent: <a href="{{.MagicLink}}">sign in</a>.</p>{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "totp"}}{{template "header" .}}
+<form method="post" action="/simple/auth/totp">
+<input type="hidden" name="challenge" value="{{.Challenge}}">
+<p><label for="code">Code from your authenticator app, or a backup code</label><br>
+<input type="text" id="code" name="code" required autocomplete="one-time-code"></p>
+<p><button type="submit">Verify</button></p>
+</form>
+{{template "footer" .}}{{end}}
+
+{{define "board"}}{{template "header" .}}
+<nav aria-label="Columns"><ul>
+{{range .Columns}}<li><a href="#col-{{or .ID "unassigned"}}">{{.Title}}</a> ({{len .Tasks}})</li>
+{{end}}</ul></nav>
+
+{{range .Columns}}
+<section aria-labelledby="col-{{or .ID "unassigned"}}">
+<h2 id="col-{{or .ID "unassigned"}}">{{.Title}}{{if .Done}} (done){{end}}</h2>
+{{if .Tasks}}<ul>
+{{range .Tasks}}<li>{{.Title}}{{if .Priority}}, priority {{.Priority}}{{end}}{{if .DueDate}}, due {{.DueDate}}{{end}}
+{{if not .Done}}<form method="post" action="/simple/tasks/{{.ID}}/complete">
+<input type="hidden" name="csrf" value="{{$.CSRF}}">
+<button type="submit" aria-label="Complete {{.Title}}">Complete</button>
+</form>{{end}}</li>
+{{end}}</ul>{{else}}<p>No tasks.</p>{{end}}
+</section>
+{{end}}
+
+<section aria-labelledby="add-task">
+<h2 id="add-task">Add a task</h2>
+<form method="post" action="/simple/tasks">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<p><label for="title">Title</label><br>
+<input type="text" id="title" name="title" required></p>
+<p><label for="column">Column</label><br>
+<select id="column" name="column">
+<option value="">Unassigned</option>
+{{range .Columns}}{{if .ID}}<option value="{{.ID}}">{{.Title}}</option>{{end}}
+{{end}}</select></p>
+<p><label for="dueDate">Due date (optional, YYYY-MM-DD)</label><br>
+<input type="date" id="dueDate" name="dueDate"></p>
+<p><label for="priority">Priority (optional)</label><br>
+<select id="priority" name="priority">
+<option value="">None</option>
+<option value="low">Low</option>
+<option value="medium">Medium</option>
+<option value="high">High</option>
+<option value="urgent">Urgent</option>
+</select></p>
+<p><button type="submit">Add task</button></p>
+</form>
+</section>
+
+<form method="post" action="/simple/logout">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<p><button type="submit">Sign out</button></p>
+</form>
+{{template "footer" .}}{{end}}
+
+{{define "shared"}}{{template "header" .}}
+{{range .Columns}}
+<section aria-labelledby="col-{{or .ID "unassigned"}}">
+<h2 id="col-{{or .ID "unassigned"}}">{{.Title}}{{if .Done}} (done){{end}}</h2>
+{{if .Tasks}}<ul>
+{{range .Tasks}}<li>{{.Title}}{{if .Priority}}, priority {{.Priority}}{{end}}{{if .DueDate}}, due {{.DueDate}}{{end}}</li>
+{{end}}</ul>{{else}}<p>No tasks.</p>{{end}}
+</section>
+{{else}}<p>This board is empty.</p>
+{{end}}
+{{template "footer" .}}{{end}}
+`))
+
+// simpleTask and simpleColumn are the board as the board template sees it
+type simpleTask struct {
+	ID       string
+	Title    string
+	DueDate  string
+	Priority string
+	Done     bool
+}
+
+type simpleColumn struct {
+	ID    string // Empty for unassigned tasks
+	Title string
+	Done  bool
+	Tasks []simpleTask
+}
+
+// simplePage is the data passed to every template
+type simplePage struct {
+	AppName   string
+	Title     string
+	Email     string
+	Notice    string
+	Error     string
+	CSRF      string
+	MagicLink string
+	Challenge string // Pending two-factor sign-in
+	Columns   []simpleColumn
+}
+
+// buildSimpleColumns lists a board's live columns in order, followed by
+// unassigned tasks when there are any
+func buildSimpleColumns(data *KanbanData) []simpleColumn {
+	var columns []simpleColumn
+	index := make(map[string]int)
+	for _, col := range sortedColumns(data.Columns) {
+		if col.Deleted || col.Hidden {
+			continue
+		}
+		index[col.ID] = len(columns)
+		columns = append(columns, simpleColumn{ID: col.ID, Title: col.Title, Done: col.IsDone})
+	}
+
+	var unassigned []simpleTask
+	for _, task := range data.Tasks {
+		if task.Deleted || task.Hidden {
+			continue
+		}
+		t := simpleTask{ID: task.ID, Title: task.Title, DueDate: task.DueDate}
+		if task.Priority != nil {
+			t.Priority = *task.Priority
+		}
+		if task.ColumnID == nil {
+			unassigned = append(unassigned, t)
+			continue
+		}
+		if i, ok := index[*task.ColumnID]; ok {
+			t.Done = columns[i].Done
+			columns[i].Tasks = append(columns[i].Tasks, t)
+		}
+	}
+
+	if len(unassigned) > 0 {
+		columns = append(columns, simpleColumn{Title: "Unassigned", Tasks: unassigned})
+	}
+	return columns
+}
+
+// SimpleHandler serves the plain HTML views under /simple. They sign in
+// with the usual magic links and keep the session in a cookie; forms carry
+// a CSRF token derived from the session.
+type SimpleHandler struct {
+	authService    *AuthService
+	dataService    *DataService
+	archiveService *ArchiveService
+	totpService    *TOTPService
+	hub            *Hub
+	cfg            *Config
+}
+
+func NewSimpleHandler(authService *AuthService, dataService *DataService, archiveService *ArchiveService, totpService *TOTPService, hub *Hub, cfg *Config) *SimpleHandler {
+	return &SimpleHandler{
+		authService:    authService,
+		dataService:    dataService,
+		archiveService: archiveService,
+		totpService:    totpService,
+		hub:            hub,
+		cfg:            cfg,
+	}
+}
+
+// simpleCSRFToken derives a form token from a session token
+func simpleCSRFToken(session string) string {
+	sum := sha256.Sum256([]byte("simple-csrf:" + session))
+	return hex.EncodeToString(sum[:16])
+}
+
+// session returns the signed-in user and their session token
+func (h *SimpleHandler) session(r *http.Request) (string, string, bool) {
+	cookie, err := r.Cookie(simpleSessionCookie)
+	if err != nil {
+		return "", "", false
+	}
+	email, err := h.authService.VerifyJWT(cookie.Value)
+	if err != nil {
+		return "", "", false
+	}
+	return email, cookie.Value, true
+}
+
+// requireSession returns the signed-in user for a form post, redirecting
+// to the login page or rejecting a bad CSRF token otherwise
+func (h *SimpleHandler) requireSession(w http.ResponseWriter, r *http.Request) (string, bool) {
+	email, session, ok := h.session(r)
+	if !ok {
+		http.Redirect(w, r, "/simple/login", http.StatusSeeOther)
+		return "", false
+	}
+	expected := simpleCSRFToken(session)
+	if subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(expected)) != 1 {
+		http.Error(w, "Invalid form token, reload the page and try again", http.StatusForbidden)
+		return "", false
+	}
+	return email, true
+}
+
+func (h *SimpleHandler) render(w http.ResponseWriter, name string, page simplePage) {
+	page.AppName = h.cfg.Branding.AppName
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := simpleTemplates.ExecuteTemplate(w, name, page); err != nil {
+		log.Printf("Error rendering %s page: %v", name, err)
+	}
+}
+
+// redirectBoard sends the browser back to the board with a notice or error
+func redirectBoard(w http.ResponseWriter, r *http.Request, key, message string) {
+	http.Redirect(w, r, "/simple?"+url.Values{key: {message}}.Encode(), http.StatusSeeOther)
+}
+
+// Board lists the user's tasks by column, with forms to add and complete them
+func (h *SimpleHandler) Board(w http.ResponseWriter, r *http.Request) {
+	email, session, ok := h.session(r)
+	if !ok {
+		http.Redirect(w, r, "/simple/login", http.StatusSeeOther)
+		return
+	}
+
+	data, err := h.dataService.GetUserData(r.Context(), email)
+	if err != nil {
+		log.Printf("Error getting user data: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.render(w, "board", simplePage{
+		Title:   "Your tasks",
+		Email:   email,
+		Notice:  r.URL.Query().Get("notice"),
+		Error:   r.URL.Query().Get("error"),
+		CSRF:    simpleCSRFToken(session),
+		Columns: buildSimpleColumns(data),
+	})
+}
+
+// LoginForm asks for an email address
+func (h *SimpleHandler) LoginForm(w http.ResponseWriter, r *http.Request) {
+	h.render(w, "login", simplePage{Title: "Sign in"})
+}
+
+// Login sends a magic link landing on /simple/auth
+func (h *SimpleHandler) Login(w http.ResponseWriter, r *http.Request) {
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	if email == "" || !strings.Contains(email, "@") {
+		h.render(w, "login", simplePage{Title: "Sign in", Error: "Enter a valid email address."})
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	link, err := h.authService.GenerateMagicLinkTo(email, fmt.Sprintf("%s://%s", scheme, r.Host), "/simple/auth", requestLocale(r))
+	if err != nil {
+		log.Printf("Error generating magic link: %v", err)
+		h.render(w, "login", simplePage{Title: "Sign in", Error: "Couldn't create a sign-in link, try again."})
+		return
+	}
+
+	page := simplePage{Title: "Sign in", Notice: "Check your email for a sign-in link."}
+	// Without SMTP nothing is sent, so show the link as the main app does
+	if h.authService.RevealLinks() {
+		page.MagicLink = link
+	}
+	h.render(w, "login", page)
+}
+
+// Auth verifies a magic link and starts a cookie session, asking for a
+// code first if the user has two-factor authentication
+func (h *SimpleHandler) Auth(w http.ResponseWriter, r *http.Request) {
+	email, err := h.authService.VerifyMagicLinkToken(r.URL.Query().Get("token"))
+	if err != nil {
+		h.render(w, "login", simplePage{Title: "Sign in", Error: "That sign-in link is invalid or has expired."})
+		return
+	}
+
+	challenge, err := h.totpService.Challenge(email)
+	if err != nil {
+		log.Printf("Error creating two-factor challenge: %v", err)
+		http.Error(w, "Authentication error", http.StatusInternalServerError)
+		return
+	}
+	if challenge != "" {
+		h.render(w, "totp", simplePage{Title: "Two-factor authentication", Challenge: challenge})
+		return
+	}
+
+	h.startSession(w, r, email)
+}
+
+// AuthTOTP finishes a two-factor sign-in
+func (h *SimpleHandler) AuthTOTP(w http.ResponseWriter, r *http.Request) {
+	challenge := r.PostFormValue("challenge")
+	email, err := h.totpService.CompleteChallenge(challenge, r.PostFormValue("code"))
+	switch err {
+	case nil:
+		h.startSession(w, r, email)
+	case errTOTPInvalidCode:
+		h.render(w, "totp", simplePage{Title: "Two-factor authentication", Challenge: challenge, Error: "That code is invalid or was already used."})
+	case errTOTPTooManyTries:
+		h.render(w, "totp", simplePage{Title: "Two-factor authentication", Challenge: challenge, Error: "Too many attempts, try again later."})
+	case errTOTPChallenge, errTOTPNotEnrolled:
+		h.render(w, "login", simplePage{Title: "Sign in", Error: "That sign-in has expired, request a new link."})
+	default:
+		log.Printf("Error checking two-factor code: %v", err)
+		http.Error(w, "Authentication error", http.StatusInternalServerError)
+	}
+}
+
+// startSession sets the session cookie and opens the board
+func (h *SimpleHandler) startSession(w http.ResponseWriter, r *http.Request, email string) {
+	token, err := h.authService.CreateJWT(email)
+	if err != nil {
+		writeSignInError(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     simpleSessionCookie,
+		Value:    token,
+		Path:     "/simple",
+		Expires:  time.Now().Add(7 * 24 * time.Hour),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/simple", http.StatusSeeOther)
+}
+
+// Logout ends the cookie session
+func (h *SimpleHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requireSession(w, r); !ok {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     simpleSessionCookie,
+		Path:     "/simple",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/simple/login", http.StatusSeeOther)
+}
+
+// AddTask creates a task from the add form
+func (h *SimpleHandler) AddTask(w http.ResponseWriter, r *http.Request) {
+	email, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	task := Task{
+		Title:   strings.TrimSpace(r.PostFormValue("title")),
+		DueDate: r.PostFormValue("dueDate"),
+	}
+	if task.Title == "" {
+		redirectBoard(w, r, "error", "Enter a title for the task.")
+		return
+	}
+	if task.DueDate != "" {
+		if _, ok := parseDueDate(task.DueDate); !ok {
+			redirectBoard(w, r, "error", "Enter the due date as YYYY-MM-DD.")
+			return
+		}
+	}
+	if priority := r.PostFormValue("priority"); priority != "" {
+		task.Priority = &priority
+	}
+	if column := r.PostFormValue("column"); column != "" {
+		task.ColumnID = &column
+	}
+
+	data, err := h.dataService.UpdateUserData(r.Context(), email, func(data *KanbanData) error {
+		return applyOperation(data, &Operation{Type: OpCreateTask, Task: &task})
+	})
+	if err != nil {
+		redirectBoard(w, r, "error", "Couldn't add the task: "+err.Error()+".")
+		return
+	}
+
+	h.hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+	redirectBoard(w, r, "notice", fmt.Sprintf("Added %q.", task.Title))
+}
+
+// errNoDoneColumn means a board has nowhere to move completed tasks
+var errNoDoneColumn = errors.New("no done column")
+
+// CompleteTask moves a task to the board's first done column, or archives
+// it when the board has none
+func (h *SimpleHandler) CompleteTask(w http.ResponseWriter, r *http.Request) {
+	email, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+	taskID := mux.Vars(r)["id"]
+
+	var title string
+	data, err := h.dataService.UpdateUserData(r.Context(), email, func(data *KanbanData) error {
+		i := findTask(data, taskID)
+		if i < 0 {
+			return errTaskNotFound
+		}
+		title = data.Tasks[i].Title
+		for _, col := range sortedColumns(data.Columns) {
+			if col.IsDone && !col.Deleted {
+				return applyOperation(data, &Operation{Type: OpMoveTask, TaskID: taskID, ColumnID: col.ID})
+			}
+		}
+		return errNoDoneColumn
+	})
+	if err == errNoDoneColumn {
+		data, err = h.archiveService.Archive(r.Context(), email, taskID)
+	}
+	if err == errTaskNotFound {
+		redirectBoard(w, r, "error", "That task no longer exists.")
+		return
+	}
+	if err != nil {
+		log.Printf("Error completing task: %v", err)
+		redirectBoard(w, r, "error", "Couldn't complete the task: "+err.Error()+".")
+		return
+	}
+
+	h.hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+	redirectBoard(w, r, "notice", fmt.Sprintf("Completed %q.", title))
+}
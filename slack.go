@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	slackAuthURL  = "https://slack.com/oauth/v2/authorize"
+	slackTokenURL = "https://slack.com/api/oauth.v2.access"
+
+	// An incoming webhook for the channel picked during install, and the
+	// /todo command
+	slackScope = "incoming-webhook,commands"
+
+	// slackStatePurpose marks OAuth state tokens for the Slack install flow
+	slackStatePurpose = "slack"
+
+	// slackMaxClockSkew bounds the age of a signed Slack request
+	slackMaxClockSkew = 5 * time.Minute
+)
+
+// slackDefaultEvents are notified until the user picks others
+var slackDefaultEvents = []string{WebhookEventTaskCreated, WebhookEventTaskCompleted}
+
+// SlackInstallation links a user's board to their Slack identity and the
+// channel notifications go to
+type SlackInstallation struct {
+	TeamID      string    `json:"teamId"`
+	TeamName    string    `json:"teamName"`
+	SlackUserID string    `json:"slackUserId"`
+	Channel     string    `json:"channel"`
+	Events      []string  `json:"events"`
+	CreatedAt   time.Time `json:"createdAt"`
+
+	webhookURL string
+}
+
+// slackAccess is Slack's oauth.v2.access reply
+type slackAccess struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+	Team  struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"team"`
+	AuthedUser struct {
+		ID string `json:"id"`
+	} `json:"authed_user"`
+	IncomingWebhook struct {
+		Channel string `json:"channel"`
+		URL     string `json:"url"`
+	} `json:"incoming_webhook"`
+}
+
+// errSlackNotInstalled is returned when a user hasn't connected Slack
+var errSlackNotInstalled = errors.New("Slack is not connected")
+
+// slackEscape escapes text for Slack's mrkdwn
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// verifySlackSignature checks a request's X-Slack-Signature against its body
+func verifySlackSignature(secret string, header http.Header, body []byte, now time.Time) error {
+	ts, err := strconv.ParseInt(header.Get("X-Slack-Request-Timestamp"), 10, 64)
+	if err != nil {
+		return errors.New("missing request timestamp")
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > slackMaxClockSkew || age < -slackMaxClockSkew {
+		return errors.New("stale request")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%d:", ts)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// SlackService installs the Slack app for users, sends their task
+// notifications and maps Slack users back to boards
+type SlackService struct {
+	db            *DB
+	dataService   *DataService
+	authService   *AuthService
+	jobs          *JobQueue
+	oauth         *oauthClient
+	signingSecret string
+}
+
+func NewSlackService(db *DB, dataService *DataService, authService *AuthService, jobs *JobQueue, cfg OAuthClientConfig, signingSecret string) *SlackService {
+	s := &SlackService{
+		db:          db,
+		dataService: dataService,
+		authService: authService,
+		jobs:        jobs,
+		oauth: &oauthClient{
+			cfg:      cfg,
+			authURL:  slackAuthURL,
+			tokenURL: slackTokenURL,
+			scope:    slackScope,
+			client:   &http.Client{Timeout: 30 * time.Second},
+		},
+		signingSecret: signingSecret,
+	}
+	if s.Enabled() {
+		dataService.OnActivity(s.notify)
+	}
+	return s
+}
+
+// Enabled reports whether a Slack app is configured
+func (s *SlackService) Enabled() bool {
+	return s.oauth.cfg.Enabled()
+}
+
+// AuthURL returns Slack's install page URL for a user
+func (s *SlackService) AuthURL(email string) (string, error) {
+	state, err := s.authService.CreateStateToken(email, slackStatePurpose, 10*time.Minute)
+	if err != nil {
+		return "", err
+	}
+	return s.oauth.AuthCodeURL(state), nil
+}
+
+// Install completes the OAuth flow and stores the user's installation
+func (s *SlackService) Install(ctx context.Context, state, code string) (string, error) {
+	email, err := s.authService.VerifyStateToken(state, slackStatePurpose)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{
+		"client_id":     {s.oauth.cfg.ClientID},
+		"client_secret": {s.oauth.cfg.ClientSecret},
+		"code":          {code},
+		"redirect_uri":  {s.oauth.cfg.RedirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.oauth.tokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.oauth.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var access slackAccess
+	if err := json.NewDecoder(resp.Body).Decode(&access); err != nil {
+		return "", fmt.Errorf("failed to decode token: %w", err)
+	}
+	if !access.OK || access.IncomingWebhook.URL == "" {
+		return "", fmt.Errorf("Slack install failed: %s", access.Error)
+	}
+
+	if err := ensureUser(s.db, email); err != nil {
+		return "", err
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO slack_installations (email, team_id, team_name, slack_user_id, channel, webhook_url, events, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(email) DO UPDATE SET
+			team_id = excluded.team_id,
+			team_name = excluded.team_name,
+			slack_user_id = excluded.slack_user_id,
+			channel = excluded.channel,
+			webhook_url = excluded.webhook_url,
+			created_at = CURRENT_TIMESTAMP
+	`, email, access.Team.ID, access.Team.Name, access.AuthedUser.ID, access.IncomingWebhook.Channel,
+		access.IncomingWebhook.URL, strings.Join(slackDefaultEvents, ","))
+	if err != nil {
+		return "", fmt.Errorf("failed to store Slack installation: %w", err)
+	}
+	return email, nil
+}
+
+// Get returns a user's installation
+func (s *SlackService) Get(email string) (*SlackInstallation, error) {
+	var install SlackInstallation
+	var events string
+	err := s.db.QueryRow(`
+		SELECT team_id, team_name, slack_user_id, channel, webhook_url, events, created_at
+		FROM slack_installations WHERE email = ?
+	`, email).Scan(&install.TeamID, &install.TeamName, &install.SlackUserID, &install.Channel, &install.webhookURL, &events, &install.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errSlackNotInstalled
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Slack installation: %w", err)
+	}
+	install.Events = splitList(events)
+	if install.Events == nil {
+		install.Events = []string{}
+	}
+	return &install, nil
+}
+
+// SetEvents chooses which task events are sent to Slack
+func (s *SlackService) SetEvents(email string, events []string) error {
+	result, err := s.db.Exec("UPDATE slack_installations SET events = ? WHERE email = ?", strings.Join(events, ","), email)
+	if err != nil {
+		return fmt.Errorf("failed to update Slack events: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errSlackNotInstalled
+	}
+	return nil
+}
+
+// Uninstall forgets a user's installation
+func (s *SlackService) Uninstall(email string) error {
+	if _, err := s.db.Exec("DELETE FROM slack_installations WHERE email = ?", email); err != nil {
+		return fmt.Errorf("failed to delete Slack installation: %w", err)
+	}
+	return nil
+}
+
+// EmailForSlackUser maps a Slack user to the board they installed the app for
+func (s *SlackService) EmailForSlackUser(teamID, userID string) (string, error) {
+	var email string
+	err := s.db.QueryRow(`
+		SELECT email FROM slack_installations WHERE team_id = ? AND slack_user_id = ?
+	`, teamID, userID).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", errSlackNotInstalled
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query Slack installation: %w", err)
+	}
+	return email, nil
+}
+
+// slackEventText describes a task event for a Slack message
+func slackEventText(event string, task Task, column *Column) string {
+	title := "*" + slackEscape(task.Title) + "*"
+	switch event {
+	case WebhookEventTaskCreated:
+		return "New task: " + title
+	case WebhookEventTaskCompleted:
+		return "Completed: " + title
+	case WebhookEventTaskMoved:
+		if column != nil {
+			return "Moved " + title + " to *" + slackEscape(column.Title) + "*"
+		}
+		return "Moved " + title + " to Unassigned"
+	}
+	return title
+}
+
+// notify queues Slack messages for the events of a board save. Like
+// webhook dispatch, the installation lookup happens in a job.
+func (s *SlackService) notify(email string, data *KanbanData, activity []TaskActivity) {
+	type message struct {
+		event string
+		text  string
+	}
+
+	var messages []message
+	for _, entry := range activity {
+		i := findTask(data, entry.TaskID)
+		if i < 0 {
+			continue
+		}
+		task := data.Tasks[i]
+		var column *Column
+		if task.ColumnID != nil {
+			if c := findColumn(data, *task.ColumnID); c >= 0 {
+				column = &data.Columns[c]
+			}
+		}
+		for _, event := range activityWebhookEvents(entry.Action) {
+			messages = append(messages, message{event: event, text: slackEventText(event, task, column)})
+		}
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	err := s.jobs.Enqueue(Job{
+		Name: "slack-notify:" + email,
+		Run: func(ctx context.Context) error {
+			install, err := s.Get(email)
+			if err == errSlackNotInstalled {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			var lines []string
+			for _, m := range messages {
+				if containsString(install.Events, m.event) {
+					lines = append(lines, m.text)
+				}
+			}
+			if len(lines) == 0 {
+				return nil
+			}
+			return s.post(email, install.webhookURL, strings.Join(lines, "\n"))
+		},
+	})
+	if err != nil {
+		log.Printf("Error queueing Slack notification for %s: %v", email, err)
+	}
+}
+
+// post sends a message to an installation's incoming webhook, in a job of
+// its own so failures are retried
+func (s *SlackService) post(email, webhookURL, text string) error {
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+
+	return s.jobs.Enqueue(Job{
+		Name:        "slack-post:" + email,
+		MaxAttempts: 3,
+		Run: func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(payload))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := s.oauth.client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode >= 300 {
+				detail, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+				return fmt.Errorf("Slack webhook returned %s: %s", resp.Status, detail)
+			}
+			return nil
+		},
+	})
+}
+
+// AddTask creates an unassigned task from a slash command
+func (s *SlackService) AddTask(ctx context.Context, email, title string) (*KanbanData, error) {
+	task := Task{Title: title}
+	return s.dataService.UpdateUserData(ctx, email, func(data *KanbanData) error {
+		return applyOperation(data, &Operation{Type: OpCreateTask, Task: &task})
+	})
+}
+
+// SlackHandler serves the Slack install flow, settings and slash command
+type SlackHandler struct {
+	slackService *SlackService
+	hub          *Hub
+}
+
+func NewSlackHandler(slackService *SlackService, hub *Hub) *SlackHandler {
+	return &SlackHandler{slackService: slackService, hub: hub}
+}
+
+// enabled writes a 404 unless a Slack app is configured
+func (h *SlackHandler) enabled(w http.ResponseWriter) bool {
+	if !h.slackService.Enabled() {
+		writeError(w, http.StatusNotFound, "Slack is not configured")
+		return false
+	}
+	return true
+}
+
+// Connect returns the Slack install page URL the client should navigate to
+func (h *SlackHandler) Connect(w http.ResponseWriter, r *http.Request) {
+	if !h.enabled(w) {
+		return
+	}
+
+	authURL, err := h.slackService.AuthURL(requestEmail(r))
+	if err != nil {
+		log.Printf("Error building Slack auth URL: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"url":    authURL,
+	})
+}
+
+// Callback finishes the install flow Slack redirects back to
+func (h *SlackHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	if !h.enabled(w) {
+		return
+	}
+
+	redirect := "/?integration=slack"
+	query := r.URL.Query()
+	if errParam := query.Get("error"); errParam != "" {
+		http.Redirect(w, r, redirect+"&error="+url.QueryEscape(errParam), http.StatusFound)
+		return
+	}
+
+	if _, err := h.slackService.Install(r.Context(), query.Get("state"), query.Get("code")); err != nil {
+		log.Printf("Error installing Slack: %v", err)
+		writeError(w, http.StatusBadRequest, "Failed to connect Slack")
+		return
+	}
+
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// Get returns the user's installation
+func (h *SlackHandler) Get(w http.ResponseWriter, r *http.Request) {
+	install, err := h.slackService.Get(requestEmail(r))
+	if err == errSlackNotInstalled {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading Slack installation: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"slack":  install,
+	})
+}
+
+// Update chooses the task events sent to Slack
+func (h *SlackHandler) Update(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Events []string `json:"events"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var events []string
+	for _, event := range req.Events {
+		if !containsString(webhookEvents, event) {
+			writeError(w, http.StatusBadRequest, "unknown event "+event)
+			return
+		}
+		if !containsString(events, event) {
+			events = append(events, event)
+		}
+	}
+
+	err := h.slackService.SetEvents(requestEmail(r), events)
+	if err == errSlackNotInstalled {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating Slack events: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Delete disconnects Slack
+func (h *SlackHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if err := h.slackService.Uninstall(requestEmail(r)); err != nil {
+		log.Printf("Error deleting Slack installation: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// slackReply answers a slash command with a message only the caller sees
+func slackReply(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"response_type": "ephemeral",
+		"text":          text,
+	})
+}
+
+// Command handles the /todo slash command: "/todo <title>" adds an
+// unassigned task to the caller's board
+func (h *SlackHandler) Command(w http.ResponseWriter, r *http.Request) {
+	if !h.enabled(w) {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if err := verifySlackSignature(h.slackService.signingSecret, r.Header, body, time.Now()); err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid form")
+		return
+	}
+
+	email, err := h.slackService.EmailForSlackUser(form.Get("team_id"), form.Get("user_id"))
+	if err == errSlackNotInstalled {
+		slackReply(w, "Your Slack account isn't linked to a board yet. Connect Slack from the board's settings first.")
+		return
+	}
+	if err != nil {
+		log.Printf("Error resolving Slack user: %v", err)
+		slackReply(w, "Something went wrong, try again.")
+		return
+	}
+
+	title := strings.TrimSpace(form.Get("text"))
+	if title == "" || title == "help" {
+		slackReply(w, "Usage: `"+form.Get("command")+" <task title>` adds a task to your board.")
+		return
+	}
+
+	data, err := h.slackService.AddTask(r.Context(), email, title)
+	if err != nil {
+		log.Printf("Error adding task from Slack: %v", err)
+		slackReply(w, "Couldn't add the task: "+slackEscape(err.Error()))
+		return
+	}
+	h.hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+	slackReply(w, "Added *"+slackEscape(title)+"* to your board.")
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Snapshot kinds
+const (
+	SnapshotManual    = "manual"
+	SnapshotScheduled = "scheduled"
+)
+
+// ActivityRemoved marks a task that left the board between two snapshots,
+// e.g. by being archived
+const ActivityRemoved = "removed"
+
+// snapshotCheckInterval is how often the weekly snapshot schedule is checked
+const snapshotCheckInterval = time.Hour
+
+// errSnapshotNotFound is returned when a snapshot doesn't exist
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+// weekdays maps SNAPSHOT_WEEKDAY values to days
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// BoardSnapshot describes a saved version of a board
+type BoardSnapshot struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"`
+	Version   int64     `json:"version"` // The board version captured
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// SnapshotChange is a task's change between two versions of a board
+type SnapshotChange struct {
+	TaskID string `json:"taskId"`
+	Title  string `json:"title"`
+	Action string `json:"action"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// SnapshotTotals counts a board's tasks at one point in time
+type SnapshotTotals struct {
+	Tasks int `json:"tasks"`
+	Open  int `json:"open"`
+}
+
+// snapshotTotals counts a board's live tasks and those still open
+func snapshotTotals(data *KanbanData) SnapshotTotals {
+	totals := SnapshotTotals{Open: openTaskCount(data)}
+	for _, task := range data.Tasks {
+		if !task.Deleted {
+			totals.Tasks++
+		}
+	}
+	return totals
+}
+
+// compareBoards lists the task changes from before to after, including
+// tasks that left the board entirely
+func compareBoards(before, after *KanbanData) []SnapshotChange {
+	titles := make(map[string]string)
+	remaining := make(map[string]bool)
+	for _, task := range after.Tasks {
+		titles[task.ID] = task.Title
+		remaining[task.ID] = true
+	}
+
+	changes := []SnapshotChange{}
+	for _, entry := range diffTaskActivity(before, after) {
+		changes = append(changes, SnapshotChange{
+			TaskID: entry.TaskID,
+			Title:  titles[entry.TaskID],
+			Action: entry.Action,
+			Detail: entry.Detail,
+		})
+	}
+	for _, task := range before.Tasks {
+		if !task.Deleted && !remaining[task.ID] {
+			changes = append(changes, SnapshotChange{TaskID: task.ID, Title: task.Title, Action: ActivityRemoved})
+		}
+	}
+	return changes
+}
+
+// SnapshotService saves named versions of boards, by hand or weekly
+type SnapshotService struct {
+	db          *DB
+	dataService *DataService
+}
+
+func NewSnapshotService(db *DB, dataService *DataService) *SnapshotService {
+	return &SnapshotService{db: db, dataService: dataService}
+}
+
+// Create saves the current board under a name. Scheduled snapshots pass the
+// day they're for, so each is only taken once.
+func (s *SnapshotService) Create(ctx context.Context, email, name, kind, day string) (*BoardSnapshot, error) {
+	data, err := s.dataService.GetUserData(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := s.dataService.codec.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ensureUser(s.db, email); err != nil {
+		return nil, err
+	}
+
+	snapshot := &BoardSnapshot{
+		ID:        generateID(),
+		Name:      name,
+		Kind:      kind,
+		Version:   data.Version,
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO board_snapshots (id, email, name, kind, day, version, data, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, snapshot.ID, email, snapshot.Name, snapshot.Kind, day, snapshot.Version, encoded, snapshot.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store snapshot: %w", err)
+	}
+	return snapshot, nil
+}
+
+// List returns a user's snapshots, newest first
+func (s *SnapshotService) List(email string) ([]BoardSnapshot, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, kind, version, created_at FROM board_snapshots
+		WHERE email = ? ORDER BY created_at DESC
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query snapshots: %w", err)
+	}
+	defer rows.Close()
+
+	snapshots := []BoardSnapshot{}
+	for rows.Next() {
+		var snapshot BoardSnapshot
+		if err := rows.Scan(&snapshot.ID, &snapshot.Name, &snapshot.Kind, &snapshot.Version, &snapshot.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan snapshot: %w", err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, rows.Err()
+}
+
+// Get returns one of a user's snapshots with the board it saved
+func (s *SnapshotService) Get(email, id string) (*BoardSnapshot, *KanbanData, error) {
+	var snapshot BoardSnapshot
+	var encoded string
+	err := s.db.QueryRow(`
+		SELECT id, name, kind, version, created_at, data FROM board_snapshots
+		WHERE id = ? AND email = ?
+	`, id, email).Scan(&snapshot.ID, &snapshot.Name, &snapshot.Kind, &snapshot.Version, &snapshot.CreatedAt, &encoded)
+	if err == sql.ErrNoRows {
+		return nil, nil, errSnapshotNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query snapshot: %w", err)
+	}
+
+	data, err := s.dataService.codec.Decode(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	data.Version = snapshot.Version
+	return &snapshot, data, nil
+}
+
+// Delete removes one of a user's snapshots
+func (s *SnapshotService) Delete(email, id string) error {
+	result, err := s.db.Exec("DELETE FROM board_snapshots WHERE id = ? AND email = ?", id, email)
+	if err != nil {
+		return fmt.Errorf("failed to delete snapshot: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errSnapshotNotFound
+	}
+	return nil
+}
+
+// SnapshotAll takes the scheduled snapshot of every board that doesn't
+// have one for today yet
+func (s *SnapshotService) SnapshotAll(now time.Time) {
+	day := now.UTC().Format("2006-01-02")
+
+	rows, err := s.db.Query(`
+		SELECT email FROM user_data WHERE email NOT IN (
+			SELECT email FROM board_snapshots WHERE kind = ? AND day = ?
+		)
+	`, SnapshotScheduled, day)
+	if err != nil {
+		log.Printf("Error querying boards to snapshot: %v", err)
+		return
+	}
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			log.Printf("Error scanning board to snapshot: %v", err)
+			break
+		}
+		emails = append(emails, email)
+	}
+	rows.Close()
+
+	for _, email := range emails {
+		if _, err := s.Create(context.Background(), email, "Week of "+day, SnapshotScheduled, day); err != nil {
+			log.Printf("Error taking scheduled snapshot for %s: %v", email, err)
+		}
+	}
+	if len(emails) > 0 {
+		log.Printf("Took scheduled snapshots of %d boards", len(emails))
+	}
+}
+
+// RunSchedule snapshots every board on the configured weekday (UTC),
+// checking hourly so a restart on that day still takes them
+func (s *SnapshotService) RunSchedule(weekday time.Weekday) {
+	check := func() {
+		if now := time.Now().UTC(); now.Weekday() == weekday {
+			s.SnapshotAll(now)
+		}
+	}
+
+	check()
+	ticker := time.NewTicker(snapshotCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		check()
+	}
+}
+
+// SnapshotHandler serves the board history API
+type SnapshotHandler struct {
+	snapshotService *SnapshotService
+	dataService     *DataService
+}
+
+func NewSnapshotHandler(snapshotService *SnapshotService, dataService *DataService) *SnapshotHandler {
+	return &SnapshotHandler{snapshotService: snapshotService, dataService: dataService}
+}
+
+// List returns the user's snapshots
+func (h *SnapshotHandler) List(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := h.snapshotService.List(requestEmail(r))
+	if err != nil {
+		log.Printf("Error listing snapshots: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":    "success",
+		"snapshots": snapshots,
+	})
+}
+
+// Create snapshots the board now under the given name
+func (h *SnapshotHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	snapshot, err := h.snapshotService.Create(r.Context(), requestEmail(r), req.Name, SnapshotManual, "")
+	if err != nil {
+		log.Printf("Error creating snapshot: %v", err)
+		writeServerError(w, err, "Failed to create snapshot")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"snapshot": snapshot,
+	})
+}
+
+// Get returns a snapshot and the board it saved
+func (h *SnapshotHandler) Get(w http.ResponseWriter, r *http.Request) {
+	snapshot, data, err := h.snapshotService.Get(requestEmail(r), mux.Vars(r)["id"])
+	if err == errSnapshotNotFound {
+		writeError(w, http.StatusNotFound, "Snapshot not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading snapshot: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"snapshot": snapshot,
+		"data":     data,
+	})
+}
+
+// Delete removes a snapshot
+func (h *SnapshotHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	err := h.snapshotService.Delete(requestEmail(r), mux.Vars(r)["id"])
+	if err == errSnapshotNotFound {
+		writeError(w, http.StatusNotFound, "Snapshot not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting snapshot: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Compare lists the task changes from a snapshot to another snapshot, given
+// as ?to=<id>, or to the current board by default
+func (h *SnapshotHandler) Compare(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+
+	from, before, err := h.snapshotService.Get(email, mux.Vars(r)["id"])
+	if err == errSnapshotNotFound {
+		writeError(w, http.StatusNotFound, "Snapshot not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading snapshot: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	var to *BoardSnapshot
+	var after *KanbanData
+	if toID := r.URL.Query().Get("to"); toID != "" {
+		to, after, err = h.snapshotService.Get(email, toID)
+		if err == errSnapshotNotFound {
+			writeError(w, http.StatusNotFound, "Snapshot to compare with not found")
+			return
+		}
+	} else {
+		after, err = h.dataService.GetUserData(r.Context(), email)
+	}
+	if err != nil {
+		log.Printf("Error loading board to compare: %v", err)
+		writeServerError(w, err, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"from":   from,
+		"to":     to, // null for the current board
+		"totals": map[string]SnapshotTotals{
+			"from": snapshotTotals(before),
+			"to":   snapshotTotals(after),
+		},
+		"changes": compareBoards(before, after),
+	})
+}
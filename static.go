@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"net/http"
+	"time"
+)
+
+// frontendFiles holds the static frontend, compiled into the binary so the
+// server never serves files from its working directory (todo.db, .env, ...)
+//
+//go:embed index.html style.css *.js
+var frontendFiles embed.FS
+
+// frontendHandler serves the embedded frontend assets, with the index page
+// rendered once with the instance's branding
+func frontendHandler(branding BrandingConfig) http.Handler {
+	page, err := frontendFiles.ReadFile("index.html")
+	if err != nil {
+		panic(err) // embedded at build time
+	}
+	index := brandIndex(page, branding)
+	started := time.Now()
+
+	files := http.FileServer(http.FS(frontendFiles))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" || r.URL.Path == "/index.html" {
+			http.ServeContent(w, r, "index.html", started, bytes.NewReader(index))
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
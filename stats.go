@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Daily time series exposed to Grafana. Days are UTC calendar days.
+const (
+	MetricTasksCreated   = "tasks_created"
+	MetricTasksCompleted = "tasks_completed"
+	MetricOpenTasks      = "open_tasks"
+)
+
+// statsMetrics lists the metrics with their display labels
+var statsMetrics = []struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}{
+	{Label: "Tasks created per day", Value: MetricTasksCreated},
+	{Label: "Tasks completed per day", Value: MetricTasksCompleted},
+	{Label: "Open tasks", Value: MetricOpenTasks},
+}
+
+// knownMetric reports whether a metric is one of statsMetrics
+func knownMetric(metric string) bool {
+	for _, m := range statsMetrics {
+		if m.Value == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// maxStatsDays caps the range of a stats query
+const maxStatsDays = 3660
+
+// statsDay returns the UTC day key for a time
+func statsDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// openTaskCount counts a board's live, visible tasks outside done columns
+func openTaskCount(data *KanbanData) int {
+	done := make(map[string]bool)
+	for _, col := range data.Columns {
+		done[col.ID] = col.IsDone && !col.Deleted
+	}
+
+	open := 0
+	for _, task := range data.Tasks {
+		if task.Deleted || task.Hidden || (task.ColumnID != nil && done[*task.ColumnID]) {
+			continue
+		}
+		open++
+	}
+	return open
+}
+
+// recordOpenTaskCount stores a board's open task count for today, replacing
+// the count from any earlier save today
+func recordOpenTaskCount(tx *Tx, email string, data *KanbanData) error {
+	_, err := tx.Exec(`
+		INSERT INTO open_task_counts (email, day, open_count)
+		VALUES (?, ?, ?)
+		ON CONFLICT(email, day) DO UPDATE SET open_count = excluded.open_count
+	`, email, statsDay(time.Now()), openTaskCount(data))
+	if err != nil {
+		return fmt.Errorf("failed to record open task count: %w", err)
+	}
+	return nil
+}
+
+// StatsPoint is one day of a series
+type StatsPoint struct {
+	Day   time.Time
+	Value int
+}
+
+// StatsService computes daily series from the activity log and open task
+// counts, and manages the tokens Grafana reads them with
+type StatsService struct {
+	db          *DB
+	authService *AuthService
+}
+
+func NewStatsService(db *DB, authService *AuthService) *StatsService {
+	return &StatsService{db: db, authService: authService}
+}
+
+// RotateToken creates a new token for a user, invalidating any old one
+func (s *StatsService) RotateToken(email string) (string, error) {
+	token, err := s.authService.generateSecureToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	if err := ensureUser(s.db, email); err != nil {
+		return "", err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO grafana_tokens (email, token, created_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(email) DO UPDATE SET
+			token = excluded.token,
+			created_at = CURRENT_TIMESTAMP
+	`, email, token)
+	if err != nil {
+		return "", fmt.Errorf("failed to store Grafana token: %w", err)
+	}
+
+	return token, nil
+}
+
+// EmailForToken returns the user owning a token
+func (s *StatsService) EmailForToken(token string) (string, error) {
+	var email string
+	err := s.db.QueryRow("SELECT email FROM grafana_tokens WHERE token = ?", token).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("unknown Grafana token")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query Grafana token: %w", err)
+	}
+	return email, nil
+}
+
+// statsDays returns the UTC days from from to to, inclusive
+func statsDays(from, to time.Time) []time.Time {
+	start, _ := time.Parse("2006-01-02", statsDay(from))
+	end, _ := time.Parse("2006-01-02", statsDay(to))
+
+	var days []time.Time
+	for day := start; !day.After(end) && len(days) < maxStatsDays; day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	return days
+}
+
+// Series returns a metric's value for each day between from and to
+func (s *StatsService) Series(email, metric string, from, to time.Time) ([]StatsPoint, error) {
+	days := statsDays(from, to)
+	if len(days) == 0 {
+		return []StatsPoint{}, nil
+	}
+
+	switch metric {
+	case MetricTasksCreated:
+		return s.activitySeries(email, ActivityCreated, days)
+	case MetricTasksCompleted:
+		return s.activitySeries(email, ActivityCompleted, days)
+	case MetricOpenTasks:
+		return s.openTaskSeries(email, days)
+	default:
+		return nil, fmt.Errorf("unknown metric %q", metric)
+	}
+}
+
+// activitySeries counts activity log entries with an action per day
+func (s *StatsService) activitySeries(email, action string, days []time.Time) ([]StatsPoint, error) {
+	rows, err := s.db.Query(`
+		SELECT created_at FROM activity_log
+		WHERE email = ? AND action = ? AND created_at >= ? AND created_at < ?
+	`, email, action, days[0], days[len(days)-1].AddDate(0, 0, 1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query activity: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var at time.Time
+		if err := rows.Scan(&at); err != nil {
+			return nil, fmt.Errorf("failed to scan activity: %w", err)
+		}
+		counts[statsDay(at)]++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate activity: %w", err)
+	}
+
+	points := make([]StatsPoint, len(days))
+	for i, day := range days {
+		points[i] = StatsPoint{Day: day, Value: counts[statsDay(day)]}
+	}
+	return points, nil
+}
+
+// openTaskSeries returns the open task count at the end of each day. Days
+// without a save carry the previous count forward; days before the first
+// recorded count are left out.
+func (s *StatsService) openTaskSeries(email string, days []time.Time) ([]StatsPoint, error) {
+	rows, err := s.db.Query(`
+		SELECT day, open_count FROM open_task_counts
+		WHERE email = ? AND day <= ?
+		ORDER BY day
+	`, email, statsDay(days[len(days)-1]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query open task counts: %w", err)
+	}
+	defer rows.Close()
+
+	type sample struct {
+		day  string
+		open int
+	}
+	var samples []sample
+	for rows.Next() {
+		var smp sample
+		if err := rows.Scan(&smp.day, &smp.open); err != nil {
+			return nil, fmt.Errorf("failed to scan open task count: %w", err)
+		}
+		samples = append(samples, smp)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate open task counts: %w", err)
+	}
+
+	points := []StatsPoint{}
+	next, current := 0, -1
+	for _, day := range days {
+		key := statsDay(day)
+		for next < len(samples) && samples[next].day <= key {
+			current = samples[next].open
+			next++
+		}
+		if current >= 0 {
+			points = append(points, StatsPoint{Day: day, Value: current})
+		}
+	}
+	return points, nil
+}
+
+// GrafanaHandler implements the Grafana JSON datasource API (the
+// simpod-json-datasource plugin) over the stats series
+type GrafanaHandler struct {
+	statsService *StatsService
+}
+
+func NewGrafanaHandler(statsService *StatsService) *GrafanaHandler {
+	return &GrafanaHandler{statsService: statsService}
+}
+
+// CreateToken issues a new long-lived token for the authenticated user
+func (h *GrafanaHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	token, err := h.statsService.RotateToken(requestEmail(r))
+	if err != nil {
+		log.Printf("Error rotating Grafana token: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to create token")
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+		"token":  token,
+		"url":    fmt.Sprintf("%s://%s/api/grafana", scheme, r.Host),
+	})
+}
+
+// authenticate resolves the request's Grafana token, writing a 401 if it's
+// missing or unknown
+func (h *GrafanaHandler) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token, err := bearerToken(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return "", false
+	}
+
+	email, err := h.statsService.EmailForToken(token)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Invalid token")
+		return "", false
+	}
+	return email, true
+}
+
+// Test answers the datasource's connection test
+func (h *GrafanaHandler) Test(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.authenticate(w, r); !ok {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Metrics lists the metrics a panel can query
+func (h *GrafanaHandler) Metrics(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.authenticate(w, r); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statsMetrics)
+}
+
+// Query returns a time series per target over the panel's time range, one
+// point per day at midnight UTC
+func (h *GrafanaHandler) Query(w http.ResponseWriter, r *http.Request) {
+	email, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Range struct {
+			From time.Time `json:"from"`
+			To   time.Time `json:"to"`
+		} `json:"range"`
+		Targets []struct {
+			Target string `json:"target"`
+			Hide   bool   `json:"hide"`
+		} `json:"targets"`
+	}
+	// Not decodeJSON: Grafana sends many fields we don't read
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize)).Decode(&req); err != nil {
+		writeErrorCode(w, http.StatusBadRequest, "invalid_json", "Invalid request format")
+		return
+	}
+	if req.Range.From.IsZero() || req.Range.To.IsZero() {
+		writeError(w, http.StatusBadRequest, "range is required")
+		return
+	}
+
+	type series struct {
+		Target     string     `json:"target"`
+		Datapoints [][2]int64 `json:"datapoints"`
+	}
+	response := []series{}
+	for _, target := range req.Targets {
+		if target.Hide || target.Target == "" {
+			continue
+		}
+		if !knownMetric(target.Target) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown metric %q", target.Target))
+			return
+		}
+
+		points, err := h.statsService.Series(email, target.Target, req.Range.From, req.Range.To)
+		if err != nil {
+			log.Printf("Error computing stats: %v", err)
+			writeError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+
+		s := series{Target: target.Target, Datapoints: [][2]int64{}}
+		for _, point := range points {
+			s.Datapoints = append(s.Datapoints, [2]int64{int64(point.Value), point.Day.UnixMilli()})
+		}
+		response = append(response, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// Swimlane is a row across a board's columns, grouping tasks by something
+// like project or priority. Tasks without a swimlane sit outside any lane.
+type Swimlane struct {
+	ID      string `json:"id"`
+	Title   string `json:"title"`
+	Order   int    `json:"order"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// errSwimlaneNotFound is returned when a swimlane doesn't exist
+var errSwimlaneNotFound = errors.New("swimlane not found")
+
+// sortedSwimlanes returns a board's live swimlanes ordered by their Order field
+func sortedSwimlanes(data *KanbanData) []Swimlane {
+	lanes := []Swimlane{}
+	for _, lane := range data.Swimlanes {
+		if !lane.Deleted {
+			lanes = append(lanes, lane)
+		}
+	}
+	sort.SliceStable(lanes, func(i, j int) bool {
+		return lanes[i].Order < lanes[j].Order
+	})
+	return lanes
+}
+
+// SwimlaneHandler serves swimlane CRUD. Changes are applied as operations,
+// so they behave like the matching WebSocket ops.
+type SwimlaneHandler struct {
+	dataService *DataService
+	hub         *Hub
+}
+
+func NewSwimlaneHandler(dataService *DataService, hub *Hub) *SwimlaneHandler {
+	return &SwimlaneHandler{dataService: dataService, hub: hub}
+}
+
+// apply runs fn against the user's board and pushes the result to their
+// clients. It writes the error response and returns false on failure.
+func (h *SwimlaneHandler) apply(w http.ResponseWriter, r *http.Request, fn func(data *KanbanData) error) (*KanbanData, bool) {
+	email := requestEmail(r)
+
+	var opErr error
+	data, err := h.dataService.UpdateUserData(r.Context(), email, func(data *KanbanData) error {
+		opErr = fn(data)
+		return opErr
+	})
+	if opErr == errSwimlaneNotFound {
+		writeError(w, http.StatusNotFound, "Swimlane not found")
+		return nil, false
+	}
+	if opErr != nil {
+		writeError(w, http.StatusBadRequest, opErr.Error())
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error updating swimlanes: %v", err)
+		writeServerError(w, err, "Failed to update swimlanes")
+		return nil, false
+	}
+
+	h.hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+	return data, true
+}
+
+// List returns the user's live swimlanes in order
+func (h *SwimlaneHandler) List(w http.ResponseWriter, r *http.Request) {
+	data, err := h.dataService.GetUserData(r.Context(), requestEmail(r))
+	if err != nil {
+		log.Printf("Error getting user data: %v", err)
+		writeServerError(w, err, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":    "success",
+		"swimlanes": sortedSwimlanes(data),
+	})
+}
+
+// Create adds a swimlane, after the existing ones unless an order is given
+func (h *SwimlaneHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+		Order *int   `json:"order"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	op := Operation{Type: OpCreateSwimlane, Swimlane: &Swimlane{ID: req.ID, Title: req.Title}}
+	_, ok := h.apply(w, r, func(data *KanbanData) error {
+		if req.Order != nil {
+			op.Swimlane.Order = *req.Order
+		} else {
+			for _, lane := range data.Swimlanes {
+				if !lane.Deleted && lane.Order >= op.Swimlane.Order {
+					op.Swimlane.Order = lane.Order + 1
+				}
+			}
+		}
+		return applyOperation(data, &op)
+	})
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"swimlane": op.Swimlane,
+	})
+}
+
+// Update renames or reorders a swimlane
+func (h *SwimlaneHandler) Update(w http.ResponseWriter, r *http.Request) {
+	var changes OperationChanges
+	if !decodeJSON(w, r, &changes) {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	var lane Swimlane
+	_, ok := h.apply(w, r, func(data *KanbanData) error {
+		if findSwimlane(data, id) < 0 {
+			return errSwimlaneNotFound
+		}
+		op := Operation{Type: OpUpdateSwimlane, SwimlaneID: id, Changes: &changes}
+		if err := applyOperation(data, &op); err != nil {
+			return err
+		}
+		lane = data.Swimlanes[findSwimlane(data, id)]
+		return nil
+	})
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"swimlane": lane,
+	})
+}
+
+// Delete removes a swimlane. Its tasks stay in their columns, outside any lane.
+func (h *SwimlaneHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	_, ok := h.apply(w, r, func(data *KanbanData) error {
+		if findSwimlane(data, id) < 0 {
+			return errSwimlaneNotFound
+		}
+		return applyOperation(data, &Operation{Type: OpDeleteSwimlane, SwimlaneID: id})
+	})
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Reorder sets the order of every swimlane from a list of IDs, top to bottom
+func (h *SwimlaneHandler) Reorder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	data, ok := h.apply(w, r, func(data *KanbanData) error {
+		if len(req.IDs) != len(sortedSwimlanes(data)) {
+			return errors.New("ids must list every swimlane exactly once")
+		}
+		seen := make(map[string]bool)
+		for order, id := range req.IDs {
+			i := findSwimlane(data, id)
+			if i < 0 || seen[id] {
+				return errors.New("ids must list every swimlane exactly once")
+			}
+			seen[id] = true
+			data.Swimlanes[i].Order = order
+		}
+		return nil
+	})
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":    "success",
+		"swimlanes": sortedSwimlanes(data),
+	})
+}
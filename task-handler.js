@@ -23,8 +23,12 @@ class TaskHandler {
       taskElement.classList.add(`priority-${task.priority}-task`);
     }
 
+    if (task.completed) {
+      taskElement.classList.add('completed');
+    }
+
     // Add due-soon class if the task is due within 3 days
-    if (task.dueDate) {
+    if (task.dueDate && !task.completed) {
       const dueDate = new Date(task.dueDate);
       const today = new Date();
       const diffTime = dueDate - today;
@@ -289,7 +293,7 @@ class TaskHandler {
    * @param {string} taskId - The ID of the task to delete
    */
   confirmDeleteTask(taskId) {
-    if (confirm('Tasks cannot be permanently deleted due to database sync. The task will be marked as deleted instead. Continue?')) {
+    if (confirm('The task will be moved to the trash, where it can be restored for 30 days. Continue?')) {
       this.markTaskAsDeleted(taskId);
     }
   }
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Template kinds
+const (
+	// One task, saved from an existing task
+	TemplateTask = "task"
+	// A board layout: its columns and swimlanes, and optionally its tasks
+	TemplateBoard = "board"
+)
+
+// Template is a saved task or board layout that can be stamped out again.
+// Items keep the IDs they had when saved; applying a template gives them
+// new ones. String values may be "$name" placeholders, as in macros, filled
+// from the params supplied when the template is applied.
+type Template struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Kind      string          `json:"kind"`
+	Content   TemplateContent `json:"content"`
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// TemplateContent is what applying a template adds to a board
+type TemplateContent struct {
+	Columns   []Column   `json:"columns,omitempty"`
+	Swimlanes []Swimlane `json:"swimlanes,omitempty"`
+	Tasks     []Task     `json:"tasks"`
+}
+
+// errTemplateNotFound is returned when a template or the item it's saved
+// from doesn't exist
+var errTemplateNotFound = errors.New("template not found")
+
+// TemplateService stores templates and applies them to users' boards
+type TemplateService struct {
+	db          *DB
+	dataService *DataService
+}
+
+func NewTemplateService(db *DB, dataService *DataService) *TemplateService {
+	return &TemplateService{db: db, dataService: dataService}
+}
+
+// templateTask copies a task for a template, without its board state
+func templateTask(task Task) Task {
+	return Task{
+		ID:          task.ID,
+		Title:       task.Title,
+		Description: task.Description,
+		Priority:    task.Priority,
+		ColumnID:    task.ColumnID,
+		SwimlaneID:  task.SwimlaneID,
+		Labels:      task.Labels,
+	}
+}
+
+// contentFromBoard captures a template's content from a board. Task
+// templates hold the one task, unassigned; board templates hold the live
+// columns and swimlanes, and the live tasks in them when includeTasks is set.
+// Due dates are left out, as they wouldn't suit a later copy.
+func contentFromBoard(data *KanbanData, kind, taskID string, includeTasks bool) (TemplateContent, error) {
+	content := TemplateContent{Tasks: []Task{}}
+	if kind == TemplateTask {
+		i := findTask(data, taskID)
+		if i < 0 {
+			return content, errTemplateNotFound
+		}
+		task := templateTask(data.Tasks[i])
+		task.ColumnID, task.SwimlaneID = nil, nil
+		content.Tasks = append(content.Tasks, task)
+		return content, nil
+	}
+
+	for _, col := range data.Columns {
+		if !col.Deleted {
+			content.Columns = append(content.Columns, col)
+		}
+	}
+	for _, lane := range data.Swimlanes {
+		if !lane.Deleted {
+			content.Swimlanes = append(content.Swimlanes, lane)
+		}
+	}
+	if includeTasks {
+		for _, task := range data.Tasks {
+			if !task.Deleted {
+				content.Tasks = append(content.Tasks, templateTask(task))
+			}
+		}
+	}
+	return content, nil
+}
+
+// templateOperations turns a template's content into the operations that
+// add it to a board. Columns and swimlanes go after the board's own; tasks
+// without a column go into columnID, if given.
+func templateOperations(data *KanbanData, content TemplateContent, columnID string) []Operation {
+	nextOrder := func(orders []int) int {
+		next := 0
+		for _, order := range orders {
+			if order >= next {
+				next = order + 1
+			}
+		}
+		return next
+	}
+	var columnOrders, laneOrders []int
+	for _, col := range data.Columns {
+		columnOrders = append(columnOrders, col.Order)
+	}
+	for _, lane := range data.Swimlanes {
+		laneOrders = append(laneOrders, lane.Order)
+	}
+
+	var ops []Operation
+	columns := make(map[string]string)
+	base := nextOrder(columnOrders)
+	for i, col := range sortedColumns(content.Columns) {
+		col := col
+		id := generateID()
+		columns[col.ID] = id
+		col.ID, col.Order = id, base+i
+		ops = append(ops, Operation{Type: OpCreateColumn, Column: &col})
+	}
+	lanes := make(map[string]string)
+	base = nextOrder(laneOrders)
+	for i, lane := range content.Swimlanes {
+		lane := lane
+		id := generateID()
+		lanes[lane.ID] = id
+		lane.ID, lane.Order = id, base+i
+		ops = append(ops, Operation{Type: OpCreateSwimlane, Swimlane: &lane})
+	}
+
+	for _, task := range content.Tasks {
+		task := task
+		task.ID = ""
+		switch {
+		case task.ColumnID != nil && columns[*task.ColumnID] != "":
+			mapped := columns[*task.ColumnID]
+			task.ColumnID = &mapped
+		case columnID != "":
+			task.ColumnID = &columnID
+		default:
+			task.ColumnID = nil
+		}
+		if task.SwimlaneID != nil {
+			if mapped, ok := lanes[*task.SwimlaneID]; ok {
+				task.SwimlaneID = &mapped
+			} else {
+				task.SwimlaneID = nil
+			}
+		}
+		ops = append(ops, Operation{Type: OpCreateTask, Task: &task})
+	}
+	return ops
+}
+
+// List returns a user's templates
+func (s *TemplateService) List(email string) ([]Template, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, kind, content, created_at, updated_at
+		FROM templates WHERE email = ? ORDER BY name
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query templates: %w", err)
+	}
+	defer rows.Close()
+
+	templates := []Template{}
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, *t)
+	}
+	return templates, rows.Err()
+}
+
+// scanTemplate reads a template row
+func scanTemplate(row interface{ Scan(...any) error }) (*Template, error) {
+	var t Template
+	var content string
+	if err := row.Scan(&t.ID, &t.Name, &t.Kind, &content, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(content), &t.Content); err != nil {
+		return nil, fmt.Errorf("failed to decode template %s: %w", t.ID, err)
+	}
+	return &t, nil
+}
+
+// Get returns a template by ID
+func (s *TemplateService) Get(id string) (*Template, error) {
+	t, err := scanTemplate(s.db.QueryRow(`
+		SELECT id, name, kind, content, created_at, updated_at
+		FROM templates WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil, errTemplateNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query template: %w", err)
+	}
+	return t, nil
+}
+
+// Owner returns the email that owns a template
+func (s *TemplateService) Owner(id string) (string, error) {
+	var email string
+	err := s.db.QueryRow("SELECT email FROM templates WHERE id = ?", id).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", errTemplateNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query template: %w", err)
+	}
+	return email, nil
+}
+
+// Create saves a template from the user's board
+func (s *TemplateService) Create(ctx context.Context, email, name, kind, taskID string, includeTasks bool) (*Template, error) {
+	data, err := s.dataService.GetUserData(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	content, err := contentFromBoard(data, kind, taskID, includeTasks)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ensureUser(s.db, email); err != nil {
+		return nil, err
+	}
+	id := generateID()
+	_, err = s.db.Exec(`
+		INSERT INTO templates (id, email, name, kind, content, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+	`, id, email, name, kind, string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create template: %w", err)
+	}
+
+	return s.Get(id)
+}
+
+// Rename changes a template's name
+func (s *TemplateService) Rename(id, name string) (*Template, error) {
+	_, err := s.db.Exec(`
+		UPDATE templates SET name = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, name, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update template: %w", err)
+	}
+
+	return s.Get(id)
+}
+
+// Delete removes a template
+func (s *TemplateService) Delete(id string) error {
+	if _, err := s.db.Exec("DELETE FROM templates WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete template: %w", err)
+	}
+	return nil
+}
+
+// Apply adds a template's items to the user's board atomically, filling
+// "$name" placeholders from params
+func (s *TemplateService) Apply(ctx context.Context, email string, template *Template, columnID string, params map[string]string) (*KanbanData, []Operation, error) {
+	raw, err := json.Marshal(template.Content)
+	if err != nil {
+		return nil, nil, err
+	}
+	bound, err := bindMacroParams(raw, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	var content TemplateContent
+	if err := json.Unmarshal(bound, &content); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode template content: %w", err)
+	}
+
+	var ops []Operation
+	data, err := s.dataService.UpdateUserData(ctx, email, func(data *KanbanData) error {
+		ops = templateOperations(data, content, columnID)
+		return applyOperations(data, ops)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, ops, nil
+}
+
+// TemplateHandler exposes templates over HTTP
+type TemplateHandler struct {
+	templateService *TemplateService
+	hub             *Hub
+}
+
+func NewTemplateHandler(templateService *TemplateService, hub *Hub) *TemplateHandler {
+	return &TemplateHandler{templateService: templateService, hub: hub}
+}
+
+// templateOwner resolves the owner of the template in the route, for
+// OwnsResource
+func (h *TemplateHandler) templateOwner(r *http.Request) (string, error) {
+	return h.templateService.Owner(mux.Vars(r)["id"])
+}
+
+// List returns the user's templates
+func (h *TemplateHandler) List(w http.ResponseWriter, r *http.Request) {
+	templates, err := h.templateService.List(requestEmail(r))
+	if err != nil {
+		log.Printf("Error listing templates: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":    "success",
+		"templates": templates,
+	})
+}
+
+// Create saves a template from the user's board: {"name", "kind": "task",
+// "taskId"} or {"name", "kind": "board", "includeTasks"}
+func (h *TemplateHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name         string `json:"name"`
+		Kind         string `json:"kind"`
+		TaskID       string `json:"taskId"`
+		IncludeTasks bool   `json:"includeTasks"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var fieldErrors []FieldError
+	if req.Name == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "name", Message: "is required"})
+	}
+	switch req.Kind {
+	case TemplateTask:
+		if req.TaskID == "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: "taskId", Message: "is required for task templates"})
+		}
+	case TemplateBoard:
+	default:
+		fieldErrors = append(fieldErrors, FieldError{Field: "kind", Message: `must be "task" or "board"`})
+	}
+	if len(fieldErrors) > 0 {
+		writeFieldErrors(w, fieldErrors...)
+		return
+	}
+
+	template, err := h.templateService.Create(r.Context(), requestEmail(r), req.Name, req.Kind, req.TaskID, req.IncludeTasks)
+	if errors.Is(err, errTemplateNotFound) {
+		writeError(w, http.StatusNotFound, "Task not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating template: %v", err)
+		writeServerError(w, err, "Failed to save template")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"template": template,
+	})
+}
+
+// Update renames a template
+func (h *TemplateHandler) Update(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		writeFieldErrors(w, FieldError{Field: "name", Message: "is required"})
+		return
+	}
+
+	template, err := h.templateService.Rename(mux.Vars(r)["id"], req.Name)
+	if err != nil {
+		log.Printf("Error updating template: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to save template")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"template": template,
+	})
+}
+
+// Delete removes a template
+func (h *TemplateHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if err := h.templateService.Delete(mux.Vars(r)["id"]); err != nil {
+		log.Printf("Error deleting template: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Apply stamps a template out on the user's board. The optional body's
+// columnId places tasks that have no column of their own, and params fill
+// "$name" placeholders.
+func (h *TemplateHandler) Apply(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+
+	var req struct {
+		ColumnID string            `json:"columnId"`
+		Params   map[string]string `json:"params"`
+	}
+	if r.ContentLength != 0 {
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+	}
+
+	template, err := h.templateService.Get(mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Error loading template: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	data, ops, err := h.templateService.Apply(r.Context(), email, template, req.ColumnID, req.Params)
+	var opErr *OperationError
+	if errors.As(err, &opErr) {
+		writeErrorBody(w, http.StatusUnprocessableEntity, "operation_failed", opErr.Error(), map[string]any{
+			"failed": opErr,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error applying template: %v", err)
+		writeServerError(w, err, "Failed to apply template")
+		return
+	}
+
+	// Push the result to connected clients
+	h.hub.PublishBoard(canonicalBoardID(email, ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     "success",
+		"operations": ops,
+		"data":       data,
+	})
+}
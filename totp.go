@@ -0,0 +1,507 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238 defaults, which authenticator apps assume)
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// Steps either side of now that are accepted, for clock drift
+	totpSkew = 1
+)
+
+// totpBackupCodeCount is how many backup codes are issued at a time
+const totpBackupCodeCount = 10
+
+// totpChallengeTTL is how long a user has to enter a code after following
+// a magic link
+const totpChallengeTTL = 5 * time.Minute
+
+// totpChallengePurpose marks state tokens issued for a pending second factor
+const totpChallengePurpose = "totp"
+
+// Wrong codes allowed per user per window, against guessing
+const (
+	totpFailureLimit  = 10
+	totpFailureWindow = 15 * time.Minute
+)
+
+var (
+	errTOTPNotEnrolled    = errors.New("two-factor authentication is not set up")
+	errTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	errTOTPInvalidCode    = errors.New("invalid code")
+	errTOTPTooManyTries   = errors.New("too many attempts, try again later")
+	errTOTPChallenge      = errors.New("invalid or expired challenge")
+)
+
+// base32NoPadding encodes TOTP secrets as authenticator apps expect
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPService manages optional TOTP second factors and their backup codes
+type TOTPService struct {
+	db          *DB
+	authService *AuthService
+	issuer      string
+	failures    *RateLimiter
+}
+
+func NewTOTPService(db *DB, authService *AuthService, issuer string) *TOTPService {
+	return &TOTPService{
+		db:          db,
+		authService: authService,
+		issuer:      issuer,
+		failures:    NewRateLimiter(totpFailureLimit, totpFailureWindow),
+	}
+}
+
+// totpCode computes the code for a time step (RFC 4226 dynamic truncation)
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// normalizeOTP strips the spaces and dashes people type into codes
+func normalizeOTP(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// Enabled reports whether a user has confirmed a second factor
+func (s *TOTPService) Enabled(email string) (bool, error) {
+	var enabledAt sql.NullTime
+	err := s.db.QueryRow("SELECT enabled_at FROM user_totp WHERE email = ?", email).Scan(&enabledAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to query two-factor settings: %w", err)
+	}
+	return enabledAt.Valid, nil
+}
+
+// Status reports whether TOTP is enabled and how many backup codes are left
+func (s *TOTPService) Status(email string) (bool, int, error) {
+	enabled, err := s.Enabled(email)
+	if err != nil || !enabled {
+		return false, 0, err
+	}
+
+	var remaining int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM totp_backup_codes WHERE email = ? AND used_at IS NULL", email).Scan(&remaining)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to count backup codes: %w", err)
+	}
+	return true, remaining, nil
+}
+
+// Enroll starts TOTP setup with a new secret and returns it with its
+// otpauth:// URI. It takes effect once Confirm sees a code from it.
+func (s *TOTPService) Enroll(email string) (string, string, error) {
+	enabled, err := s.Enabled(email)
+	if err != nil {
+		return "", "", err
+	}
+	if enabled {
+		return "", "", errTOTPAlreadyEnabled
+	}
+
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	secret := base32NoPadding.EncodeToString(raw)
+
+	if err := ensureUser(s.db, email); err != nil {
+		return "", "", err
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO user_totp (email, secret, enabled_at, last_step, created_at)
+		VALUES (?, ?, NULL, 0, CURRENT_TIMESTAMP)
+		ON CONFLICT(email) DO UPDATE SET
+			secret = excluded.secret,
+			enabled_at = NULL,
+			last_step = 0,
+			created_at = CURRENT_TIMESTAMP
+	`, email, secret)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to store two-factor secret: %w", err)
+	}
+
+	label := url.PathEscape(s.issuer + ":" + email)
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {s.issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return secret, "otpauth://totp/" + label + "?" + params.Encode(), nil
+}
+
+// Confirm enables TOTP once the user proves their app has the secret, and
+// returns their first backup codes
+func (s *TOTPService) Confirm(email, code string) ([]string, error) {
+	var secret string
+	var enabledAt sql.NullTime
+	err := s.db.QueryRow("SELECT secret, enabled_at FROM user_totp WHERE email = ?", email).Scan(&secret, &enabledAt)
+	if err == sql.ErrNoRows {
+		return nil, errTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query two-factor settings: %w", err)
+	}
+	if enabledAt.Valid {
+		return nil, errTOTPAlreadyEnabled
+	}
+
+	if s.failures.Limited(email) {
+		return nil, errTOTPTooManyTries
+	}
+	step, ok := matchTOTP(secret, normalizeOTP(code), 0)
+	if !ok {
+		s.failures.Allow(email)
+		return nil, errTOTPInvalidCode
+	}
+
+	_, err = s.db.Exec("UPDATE user_totp SET enabled_at = CURRENT_TIMESTAMP, last_step = ? WHERE email = ?", step, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable two-factor authentication: %w", err)
+	}
+	return s.replaceBackupCodes(email)
+}
+
+// matchTOTP finds the time step a code belongs to, ignoring steps at or
+// before lastStep so a code can't be replayed
+func matchTOTP(secret, code string, lastStep int64) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Verify checks a TOTP or unused backup code for a user with TOTP enabled.
+// Each code works once.
+func (s *TOTPService) Verify(email, code string) error {
+	var secret string
+	var enabledAt sql.NullTime
+	var lastStep int64
+	err := s.db.QueryRow("SELECT secret, enabled_at, last_step FROM user_totp WHERE email = ?", email).Scan(&secret, &enabledAt, &lastStep)
+	if err == sql.ErrNoRows || (err == nil && !enabledAt.Valid) {
+		return errTOTPNotEnrolled
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query two-factor settings: %w", err)
+	}
+
+	if s.failures.Limited(email) {
+		return errTOTPTooManyTries
+	}
+
+	code = normalizeOTP(code)
+	if step, ok := matchTOTP(secret, code, lastStep); ok {
+		// Compare-and-set, so two requests can't both spend the same code
+		result, err := s.db.Exec("UPDATE user_totp SET last_step = ? WHERE email = ? AND last_step < ?", step, email, step)
+		if err != nil {
+			return fmt.Errorf("failed to record code use: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errTOTPInvalidCode
+		}
+		return nil
+	}
+
+	result, err := s.db.Exec(`
+		UPDATE totp_backup_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE email = ? AND code_hash = ? AND used_at IS NULL
+	`, email, hashAPIKey(code))
+	if err != nil {
+		return fmt.Errorf("failed to record backup code use: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		s.failures.Allow(email)
+		return errTOTPInvalidCode
+	}
+	return nil
+}
+
+// RegenerateBackupCodes replaces a user's backup codes after checking a code
+func (s *TOTPService) RegenerateBackupCodes(email, code string) ([]string, error) {
+	if err := s.Verify(email, code); err != nil {
+		return nil, err
+	}
+	return s.replaceBackupCodes(email)
+}
+
+// replaceBackupCodes issues new backup codes, storing only their hashes
+func (s *TOTPService) replaceBackupCodes(email string) ([]string, error) {
+	codes := make([]string, totpBackupCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf("failed to generate backup code: %w", err)
+		}
+		encoded := strings.ToLower(base32NoPadding.EncodeToString(raw))
+		codes[i] = encoded[:4] + "-" + encoded[4:]
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM totp_backup_codes WHERE email = ?", email); err != nil {
+		return nil, fmt.Errorf("failed to delete backup codes: %w", err)
+	}
+	for _, code := range codes {
+		_, err := tx.Exec("INSERT INTO totp_backup_codes (email, code_hash) VALUES (?, ?)", email, hashAPIKey(normalizeOTP(code)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to store backup code: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit backup codes: %w", err)
+	}
+	return codes, nil
+}
+
+// Disable turns TOTP off after checking a code
+func (s *TOTPService) Disable(email, code string) error {
+	if err := s.Verify(email, code); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec("DELETE FROM totp_backup_codes WHERE email = ?", email); err != nil {
+		return fmt.Errorf("failed to delete backup codes: %w", err)
+	}
+	if _, err := s.db.Exec("DELETE FROM user_totp WHERE email = ?", email); err != nil {
+		return fmt.Errorf("failed to delete two-factor settings: %w", err)
+	}
+	return nil
+}
+
+// Challenge returns a short-lived token standing in for a session until
+// the user enters a code, or "" if the user hasn't enabled TOTP
+func (s *TOTPService) Challenge(email string) (string, error) {
+	enabled, err := s.Enabled(email)
+	if err != nil || !enabled {
+		return "", err
+	}
+	return s.authService.CreateStateToken(email, totpChallengePurpose, totpChallengeTTL)
+}
+
+// CompleteChallenge checks the code for a challenge and returns its user
+func (s *TOTPService) CompleteChallenge(challenge, code string) (string, error) {
+	email, err := s.authService.VerifyStateToken(challenge, totpChallengePurpose)
+	if err != nil {
+		return "", errTOTPChallenge
+	}
+	if err := s.Verify(email, code); err != nil {
+		return "", err
+	}
+	return email, nil
+}
+
+// TOTPHandler serves two-factor setup and the login code check
+type TOTPHandler struct {
+	totpService *TOTPService
+	authService *AuthService
+}
+
+func NewTOTPHandler(totpService *TOTPService, authService *AuthService) *TOTPHandler {
+	return &TOTPHandler{totpService: totpService, authService: authService}
+}
+
+// writeTOTPError maps a code check failure to a response
+func writeTOTPError(w http.ResponseWriter, err error) {
+	switch err {
+	case errTOTPNotEnrolled:
+		writeError(w, http.StatusNotFound, "Two-factor authentication is not set up")
+	case errTOTPAlreadyEnabled:
+		writeError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+	case errTOTPInvalidCode:
+		writeErrorCode(w, http.StatusUnauthorized, "invalid_code", "Invalid code")
+	case errTOTPTooManyTries:
+		writeError(w, http.StatusTooManyRequests, "Too many attempts, try again later")
+	case errTOTPChallenge:
+		writeErrorCode(w, http.StatusUnauthorized, "invalid_challenge", "Invalid or expired challenge")
+	default:
+		log.Printf("Error checking two-factor code: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+	}
+}
+
+// decodeTOTPCode reads the {"code": ...} body shared by most endpoints
+func decodeTOTPCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return "", false
+	}
+	if req.Code == "" {
+		writeFieldErrors(w, FieldError{Field: "code", Message: "is required"})
+		return "", false
+	}
+	return req.Code, true
+}
+
+// Get reports whether two-factor authentication is enabled
+func (h *TOTPHandler) Get(w http.ResponseWriter, r *http.Request) {
+	enabled, remaining, err := h.totpService.Status(requestEmail(r))
+	if err != nil {
+		log.Printf("Error getting two-factor status: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":               "success",
+		"enabled":              enabled,
+		"backupCodesRemaining": remaining,
+	})
+}
+
+// Enroll starts setup and returns the secret and otpauth:// URI for an
+// authenticator app
+func (h *TOTPHandler) Enroll(w http.ResponseWriter, r *http.Request) {
+	secret, uri, err := h.totpService.Enroll(requestEmail(r))
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+		"secret": secret,
+		"uri":    uri,
+	})
+}
+
+// Confirm enables two-factor authentication with a first code and returns
+// the backup codes, which are only shown here
+func (h *TOTPHandler) Confirm(w http.ResponseWriter, r *http.Request) {
+	code, ok := decodeTOTPCode(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := h.totpService.Confirm(requestEmail(r), code)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":      "success",
+		"backupCodes": codes,
+	})
+}
+
+// RegenerateBackupCodes replaces the backup codes
+func (h *TOTPHandler) RegenerateBackupCodes(w http.ResponseWriter, r *http.Request) {
+	code, ok := decodeTOTPCode(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := h.totpService.RegenerateBackupCodes(requestEmail(r), code)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":      "success",
+		"backupCodes": codes,
+	})
+}
+
+// Delete turns two-factor authentication off
+func (h *TOTPHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	code, ok := decodeTOTPCode(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.totpService.Disable(requestEmail(r), code); err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Verify completes a magic link login that stopped for a second factor,
+// issuing the session token
+func (h *TOTPHandler) Verify(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var fieldErrors []FieldError
+	if req.Challenge == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "challenge", Message: "is required"})
+	}
+	if req.Code == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "code", Message: "is required"})
+	}
+	if len(fieldErrors) > 0 {
+		writeFieldErrors(w, fieldErrors...)
+		return
+	}
+
+	email, err := h.totpService.CompleteChallenge(req.Challenge, req.Code)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+
+	h.authService.StartSession(w, r, email, "")
+}
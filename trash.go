@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The trash:
+//
+//	GET  /api/trash
+//	POST /api/trash/{id}/restore
+//
+// A task marked deleted, by whichever client or integration, is taken off
+// the board when the board is saved and kept in trashed_tasks. Full syncs
+// drop tasks that are in the trash, as they do archived ones, so a client
+// that still has one can't bring it back by accident. Restoring puts it
+// back as it was deleted. Maintenance purges tasks deleted more than
+// trashRetention ago, along with their comments and attachments.
+
+// trashRetention is how long deleted tasks can be restored
+const trashRetention = 30 * 24 * time.Hour
+
+// TrashedTask is a deleted task that can still be restored
+type TrashedTask struct {
+	Task        Task      `json:"task"`
+	ColumnTitle string    `json:"columnTitle,omitempty"`
+	DeletedAt   time.Time `json:"deletedAt"`
+	PurgeAt     time.Time `json:"purgeAt"`
+}
+
+// errTrashedTaskNotFound is returned when a task isn't in the trash, or was
+// deleted too long ago to restore
+var errTrashedTaskNotFound = errors.New("trashed task not found")
+
+// trashDeletedTasks moves the tasks marked deleted off a board being saved
+// and into the trash, in the caller's transaction
+func trashDeletedTasks(tx *Tx, email string, data *KanbanData, now time.Time) error {
+	titles := make(map[string]string)
+	for _, col := range data.Columns {
+		titles[col.ID] = col.Title
+	}
+
+	trash := func(tasks []Task) ([]Task, error) {
+		kept := tasks[:0]
+		for _, task := range tasks {
+			if !task.Deleted {
+				kept = append(kept, task)
+				continue
+			}
+
+			task.Deleted = false
+			encoded, err := json.Marshal(task)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode task: %w", err)
+			}
+			columnTitle := ""
+			if task.ColumnID != nil {
+				columnTitle = titles[*task.ColumnID]
+			}
+			_, err = tx.Exec(`
+				INSERT INTO trashed_tasks (email, task_id, task, column_title, deleted_at)
+				VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT(email, task_id) DO UPDATE SET
+					task = excluded.task,
+					column_title = excluded.column_title,
+					deleted_at = excluded.deleted_at
+			`, email, task.ID, string(encoded), columnTitle, now)
+			if err != nil {
+				return nil, fmt.Errorf("failed to trash task: %w", err)
+			}
+		}
+		return kept, nil
+	}
+
+	var err error
+	if data.Tasks, err = trash(data.Tasks); err != nil {
+		return err
+	}
+	if len(data.UnassignedTasks) > 0 {
+		data.UnassignedTasks, err = trash(data.UnassignedTasks)
+	}
+	return err
+}
+
+// dropTrashedTasks removes tasks that are in the trash from a board, so a
+// client that still holds a deleted task can't sync it back
+func (s *DataService) dropTrashedTasks(q querier, email string, data *KanbanData) error {
+	rows, err := q.Query("SELECT task_id FROM trashed_tasks WHERE email = ?", email)
+	if err != nil {
+		return fmt.Errorf("failed to query trashed tasks: %w", err)
+	}
+	defer rows.Close()
+
+	trashed := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("failed to scan trashed task: %w", err)
+		}
+		trashed[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(trashed) == 0 {
+		return nil
+	}
+
+	tasks := data.Tasks[:0]
+	for _, task := range data.Tasks {
+		if !trashed[task.ID] {
+			tasks = append(tasks, task)
+		}
+	}
+	data.Tasks = tasks
+	return nil
+}
+
+// TrashService lists and restores deleted tasks
+type TrashService struct {
+	db          *DB
+	dataService *DataService
+}
+
+func NewTrashService(db *DB, dataService *DataService) *TrashService {
+	return &TrashService{db: db, dataService: dataService}
+}
+
+// List returns the user's tasks deleted within trashRetention, newest first
+func (s *TrashService) List(email string) ([]TrashedTask, error) {
+	rows, err := s.db.Query(`
+		SELECT task, column_title, deleted_at FROM trashed_tasks
+		WHERE email = ? AND deleted_at > ?
+		ORDER BY deleted_at DESC, task_id
+	`, email, time.Now().UTC().Add(-trashRetention))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trashed tasks: %w", err)
+	}
+	defer rows.Close()
+
+	trashed := []TrashedTask{}
+	for rows.Next() {
+		var t TrashedTask
+		var encoded string
+		if err := rows.Scan(&encoded, &t.ColumnTitle, &t.DeletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan trashed task: %w", err)
+		}
+		if err := json.Unmarshal([]byte(encoded), &t.Task); err != nil {
+			return nil, fmt.Errorf("failed to decode trashed task: %w", err)
+		}
+		t.PurgeAt = t.DeletedAt.Add(trashRetention)
+		trashed = append(trashed, t)
+	}
+	return trashed, rows.Err()
+}
+
+// Restore moves a task from the trash back onto the board. It returns to
+// its column if that still exists, otherwise it becomes unassigned.
+func (s *TrashService) Restore(ctx context.Context, email, taskID string) (*KanbanData, error) {
+	return s.dataService.UpdateUserDataTx(ctx, email, func(tx *Tx, data *KanbanData) error {
+		var encoded string
+		err := tx.QueryRow(`
+			SELECT task FROM trashed_tasks WHERE email = ? AND task_id = ? AND deleted_at > ?
+		`, email, taskID, time.Now().UTC().Add(-trashRetention)).Scan(&encoded)
+		if err == sql.ErrNoRows {
+			return errTrashedTaskNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to query trashed task: %w", err)
+		}
+
+		var task Task
+		if err := json.Unmarshal([]byte(encoded), &task); err != nil {
+			return fmt.Errorf("failed to decode trashed task: %w", err)
+		}
+
+		for _, existing := range data.Tasks {
+			if existing.ID == task.ID {
+				return errTaskExists
+			}
+		}
+		if task.ColumnID != nil && findColumn(data, *task.ColumnID) < 0 {
+			task.ColumnID = nil
+		}
+		data.Tasks = append(data.Tasks, task)
+
+		_, err = tx.Exec("DELETE FROM trashed_tasks WHERE email = ? AND task_id = ?", email, taskID)
+		if err != nil {
+			return fmt.Errorf("failed to remove trashed task: %w", err)
+		}
+		return nil
+	})
+}
+
+// TrashHandler exposes the trash over HTTP
+type TrashHandler struct {
+	trashService *TrashService
+	hub          *Hub
+}
+
+func NewTrashHandler(trashService *TrashService, hub *Hub) *TrashHandler {
+	return &TrashHandler{trashService: trashService, hub: hub}
+}
+
+// List returns the tasks that can be restored
+func (h *TrashHandler) List(w http.ResponseWriter, r *http.Request) {
+	trashed, err := h.trashService.List(requestEmail(r))
+	if err != nil {
+		log.Printf("Error listing trash: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"tasks":  trashed,
+	})
+}
+
+// Restore moves a deleted task back onto the board
+func (h *TrashHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	data, err := h.trashService.Restore(r.Context(), requestEmail(r), mux.Vars(r)["id"])
+	if err == errTrashedTaskNotFound {
+		writeError(w, http.StatusNotFound, "Deleted task not found")
+		return
+	}
+	if err == errTaskExists {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error restoring task: %v", err)
+		writeServerError(w, err, "Failed to restore task")
+		return
+	}
+
+	h.hub.PublishBoard(canonicalBoardID(requestEmail(r), ""), WebSocketMessage{Type: "sync", Data: data}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"data":   data,
+	})
+}
@@ -27,5 +27,26 @@ function preventDefault(e) {
   e.preventDefault();
 }
 
+/**
+ * Decodes unpadded base64url, as WebAuthn options use, into bytes
+ * @param {string} value - The base64url string
+ * @returns {ArrayBuffer} The decoded bytes
+ */
+function base64urlToBuffer(value) {
+  const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+  const binary = atob(base64 + '='.repeat((4 - base64.length % 4) % 4));
+  return Uint8Array.from(binary, c => c.charCodeAt(0)).buffer;
+}
+
+/**
+ * Encodes bytes as unpadded base64url
+ * @param {ArrayBuffer} buffer - The bytes to encode
+ * @returns {string} The base64url string
+ */
+function bufferToBase64url(buffer) {
+  const binary = String.fromCharCode(...new Uint8Array(buffer));
+  return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
 // Export utils
-export { generateId, formatDate, preventDefault };
+export { generateId, formatDate, preventDefault, base64urlToBuffer, bufferToBase64url };
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/mux"
+)
+
+// webauthnCeremonyTTL is how long a passkey registration or sign-in may
+// take between its begin and finish requests
+const webauthnCeremonyTTL = 5 * time.Minute
+
+// passkeyMaxName caps a passkey's label
+const passkeyMaxName = 100
+
+var (
+	errPasskeyNotFound  = errors.New("passkey not found")
+	errPasskeyCeremony  = errors.New("invalid or expired passkey ceremony")
+	errPasskeyRejected  = errors.New("passkey was not accepted")
+	errPasskeysDisabled = errors.New("passkeys are not configured")
+)
+
+// WebAuthnConfig configures passkey sign-in. RPID is the domain passkeys
+// are bound to (e.g. todo.example.com) and Origins the page origins that
+// may use them.
+type WebAuthnConfig struct {
+	RPID    string
+	Origins []string
+}
+
+// Enabled reports whether passkeys are configured
+func (c WebAuthnConfig) Enabled() bool {
+	return c.RPID != ""
+}
+
+// Passkey describes a registered WebAuthn credential
+type Passkey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// webauthnUser adapts a user and their credentials to the WebAuthn library.
+// The handle is random, so authenticators never see the email as the ID.
+type webauthnUser struct {
+	email       string
+	handle      []byte
+	credentials []webauthn.Credential
+}
+
+func (u *webauthnUser) WebAuthnID() []byte                         { return u.handle }
+func (u *webauthnUser) WebAuthnName() string                       { return u.email }
+func (u *webauthnUser) WebAuthnDisplayName() string                { return u.email }
+func (u *webauthnUser) WebAuthnIcon() string                       { return "" }
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+// webauthnCeremony is a begun registration or sign-in waiting to finish
+type webauthnCeremony struct {
+	email   string // Empty for sign-in, where the passkey names the user
+	session webauthn.SessionData
+	expires time.Time
+}
+
+// WebAuthnService registers passkeys and signs users in with them.
+// Ceremonies in progress are kept in memory, like magic link tokens.
+type WebAuthnService struct {
+	db       *DB
+	webauthn *webauthn.WebAuthn // nil when passkeys aren't configured
+
+	mu         sync.Mutex
+	ceremonies map[string]*webauthnCeremony
+}
+
+func NewWebAuthnService(db *DB, cfg WebAuthnConfig, displayName string) (*WebAuthnService, error) {
+	s := &WebAuthnService{db: db, ceremonies: make(map[string]*webauthnCeremony)}
+	if !cfg.Enabled() {
+		return s, nil
+	}
+
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          cfg.RPID,
+		RPDisplayName: displayName,
+		RPOrigins:     cfg.Origins,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure WebAuthn: %w", err)
+	}
+	s.webauthn = w
+	return s, nil
+}
+
+// Enabled reports whether passkeys are configured
+func (s *WebAuthnService) Enabled() bool {
+	return s.webauthn != nil
+}
+
+// passkeyID encodes a credential ID for URLs and storage
+func passkeyID(raw []byte) string {
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// loadUser reads a user's handle and credentials. With create, a user
+// without a handle gets one.
+func (s *WebAuthnService) loadUser(email string, create bool) (*webauthnUser, error) {
+	user := &webauthnUser{email: email}
+	err := s.db.QueryRow("SELECT user_handle FROM webauthn_users WHERE email = ?", email).Scan(&user.handle)
+	if err == sql.ErrNoRows && create {
+		user.handle = make([]byte, 32)
+		if _, err := rand.Read(user.handle); err != nil {
+			return nil, fmt.Errorf("failed to generate user handle: %w", err)
+		}
+		if err := ensureUser(s.db, email); err != nil {
+			return nil, err
+		}
+		if _, err := s.db.Exec("INSERT INTO webauthn_users (email, user_handle) VALUES (?, ?)", email, user.handle); err != nil {
+			return nil, fmt.Errorf("failed to store user handle: %w", err)
+		}
+	} else if err == sql.ErrNoRows {
+		return nil, errPasskeyNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to query user handle: %w", err)
+	}
+
+	rows, err := s.db.Query("SELECT credential FROM webauthn_credentials WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query passkeys: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, fmt.Errorf("failed to scan passkey: %w", err)
+		}
+		var credential webauthn.Credential
+		if err := json.Unmarshal([]byte(raw), &credential); err != nil {
+			return nil, fmt.Errorf("failed to decode passkey: %w", err)
+		}
+		user.credentials = append(user.credentials, credential)
+	}
+	return user, rows.Err()
+}
+
+// startCeremony keeps a ceremony's session data until it finishes
+func (s *WebAuthnService) startCeremony(email string, session *webauthn.SessionData) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate ceremony ID: %w", err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, c := range s.ceremonies {
+		if now.After(c.expires) {
+			delete(s.ceremonies, key)
+		}
+	}
+	s.ceremonies[id] = &webauthnCeremony{email: email, session: *session, expires: now.Add(webauthnCeremonyTTL)}
+	return id, nil
+}
+
+// takeCeremony removes and returns a ceremony; each can finish once
+func (s *WebAuthnService) takeCeremony(id string) (*webauthnCeremony, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.ceremonies[id]
+	if !ok {
+		return nil, errPasskeyCeremony
+	}
+	delete(s.ceremonies, id)
+	if time.Now().After(c.expires) {
+		return nil, errPasskeyCeremony
+	}
+	return c, nil
+}
+
+// BeginRegistration starts adding a passkey to a user's account. Passkeys
+// are created as discoverable credentials, so sign-in needs no email.
+func (s *WebAuthnService) BeginRegistration(email string) (*protocol.CredentialCreation, string, error) {
+	if !s.Enabled() {
+		return nil, "", errPasskeysDisabled
+	}
+
+	user, err := s.loadUser(email, true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.credentials))
+	for _, credential := range user.credentials {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	creation, session, err := s.webauthn.BeginRegistration(user,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(exclusions),
+	)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to begin registration: %w", err)
+	}
+
+	id, err := s.startCeremony(email, session)
+	if err != nil {
+		return nil, "", err
+	}
+	return creation, id, nil
+}
+
+// FinishRegistration verifies the authenticator's response in r and stores
+// the new passkey
+func (s *WebAuthnService) FinishRegistration(email, ceremonyID, name string, r *http.Request) (*Passkey, error) {
+	if !s.Enabled() {
+		return nil, errPasskeysDisabled
+	}
+
+	ceremony, err := s.takeCeremony(ceremonyID)
+	if err != nil || ceremony.email != email {
+		return nil, errPasskeyCeremony
+	}
+
+	user, err := s.loadUser(email, false)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := s.webauthn.FinishRegistration(user, ceremony.session, r)
+	if err != nil {
+		log.Printf("Passkey registration for %s rejected: %v", email, err)
+		return nil, errPasskeyRejected
+	}
+
+	raw, err := json.Marshal(credential)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode passkey: %w", err)
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > passkeyMaxName {
+		name = strings.ToValidUTF8(name[:passkeyMaxName], "")
+	}
+
+	passkey := &Passkey{ID: passkeyID(credential.ID), Name: name, CreatedAt: time.Now().UTC()}
+	_, err = s.db.Exec(`
+		INSERT INTO webauthn_credentials (id, email, name, credential, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, passkey.ID, email, passkey.Name, string(raw), passkey.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store passkey: %w", err)
+	}
+	return passkey, nil
+}
+
+// BeginLogin starts a sign-in with any passkey for this site
+func (s *WebAuthnService) BeginLogin() (*protocol.CredentialAssertion, string, error) {
+	if !s.Enabled() {
+		return nil, "", errPasskeysDisabled
+	}
+
+	assertion, session, err := s.webauthn.BeginDiscoverableLogin()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to begin login: %w", err)
+	}
+
+	id, err := s.startCeremony("", session)
+	if err != nil {
+		return nil, "", err
+	}
+	return assertion, id, nil
+}
+
+// FinishLogin verifies the assertion in r and returns the user it signs in
+func (s *WebAuthnService) FinishLogin(ceremonyID string, r *http.Request) (string, error) {
+	if !s.Enabled() {
+		return "", errPasskeysDisabled
+	}
+
+	ceremony, err := s.takeCeremony(ceremonyID)
+	if err != nil {
+		return "", err
+	}
+
+	var user *webauthnUser
+	credential, err := s.webauthn.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		var email string
+		err := s.db.QueryRow("SELECT email FROM webauthn_users WHERE user_handle = ?", userHandle).Scan(&email)
+		if err != nil {
+			return nil, errPasskeyNotFound
+		}
+		user, err = s.loadUser(email, false)
+		return user, err
+	}, ceremony.session, r)
+	if err != nil {
+		log.Printf("Passkey login rejected: %v", err)
+		return "", errPasskeyRejected
+	}
+
+	// A signature counter that went backwards suggests a cloned authenticator
+	if credential.Authenticator.CloneWarning {
+		log.Printf("Passkey login for %s rejected: signature counter went backwards", user.email)
+		return "", errPasskeyRejected
+	}
+
+	raw, err := json.Marshal(credential)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode passkey: %w", err)
+	}
+	_, err = s.db.Exec(`
+		UPDATE webauthn_credentials SET credential = ?, last_used_at = ?
+		WHERE id = ? AND email = ?
+	`, string(raw), time.Now().UTC(), passkeyID(credential.ID), user.email)
+	if err != nil {
+		return "", fmt.Errorf("failed to update passkey: %w", err)
+	}
+	return user.email, nil
+}
+
+// List returns a user's passkeys
+func (s *WebAuthnService) List(email string) ([]Passkey, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, created_at, last_used_at FROM webauthn_credentials
+		WHERE email = ? ORDER BY created_at
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query passkeys: %w", err)
+	}
+	defer rows.Close()
+
+	passkeys := []Passkey{}
+	for rows.Next() {
+		var p Passkey
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &lastUsed); err != nil {
+			return nil, fmt.Errorf("failed to scan passkey: %w", err)
+		}
+		if lastUsed.Valid {
+			p.LastUsedAt = &lastUsed.Time
+		}
+		passkeys = append(passkeys, p)
+	}
+	return passkeys, rows.Err()
+}
+
+// Delete removes one of a user's passkeys
+func (s *WebAuthnService) Delete(email, id string) error {
+	result, err := s.db.Exec("DELETE FROM webauthn_credentials WHERE id = ? AND email = ?", id, email)
+	if err != nil {
+		return fmt.Errorf("failed to delete passkey: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errPasskeyNotFound
+	}
+	return nil
+}
+
+// WebAuthnHandler serves passkey registration, sign-in and management
+type WebAuthnHandler struct {
+	webauthnService *WebAuthnService
+	authService     *AuthService
+}
+
+func NewWebAuthnHandler(webauthnService *WebAuthnService, authService *AuthService) *WebAuthnHandler {
+	return &WebAuthnHandler{webauthnService: webauthnService, authService: authService}
+}
+
+// writePasskeyError maps a ceremony failure to a response
+func writePasskeyError(w http.ResponseWriter, err error) {
+	switch err {
+	case errPasskeysDisabled:
+		writeError(w, http.StatusNotFound, "Passkeys are not configured")
+	case errPasskeyCeremony:
+		writeError(w, http.StatusBadRequest, "Invalid or expired passkey ceremony")
+	case errPasskeyRejected:
+		writeError(w, http.StatusUnauthorized, "Passkey was not accepted")
+	case errPasskeyNotFound:
+		writeError(w, http.StatusNotFound, "Passkey not found")
+	default:
+		log.Printf("Error handling passkey: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+	}
+}
+
+// RegisterBegin returns the options for navigator.credentials.create and
+// the ceremony ID to finish with
+func (h *WebAuthnHandler) RegisterBegin(w http.ResponseWriter, r *http.Request) {
+	creation, ceremony, err := h.webauthnService.BeginRegistration(requestEmail(r))
+	if err != nil {
+		writePasskeyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"ceremony": ceremony,
+		"options":  creation,
+	})
+}
+
+// RegisterFinish takes the authenticator's response as the body, with the
+// ceremony ID and an optional passkey name in the query
+func (h *WebAuthnHandler) RegisterFinish(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	passkey, err := h.webauthnService.FinishRegistration(requestEmail(r), query.Get("ceremony"), query.Get("name"), r)
+	if err != nil {
+		writePasskeyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"passkey": passkey,
+	})
+}
+
+// LoginBegin returns the options for navigator.credentials.get and the
+// ceremony ID to finish with
+func (h *WebAuthnHandler) LoginBegin(w http.ResponseWriter, r *http.Request) {
+	assertion, ceremony, err := h.webauthnService.BeginLogin()
+	if err != nil {
+		writePasskeyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"ceremony": ceremony,
+		"options":  assertion,
+	})
+}
+
+// LoginFinish verifies the authenticator's assertion in the body and
+// issues a session token
+func (h *WebAuthnHandler) LoginFinish(w http.ResponseWriter, r *http.Request) {
+	email, err := h.webauthnService.FinishLogin(r.URL.Query().Get("ceremony"), r)
+	if err != nil {
+		writePasskeyError(w, err)
+		return
+	}
+
+	h.authService.StartSession(w, r, email, "")
+}
+
+// List returns the user's passkeys
+func (h *WebAuthnHandler) List(w http.ResponseWriter, r *http.Request) {
+	passkeys, err := h.webauthnService.List(requestEmail(r))
+	if err != nil {
+		writePasskeyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"passkeys": passkeys,
+	})
+}
+
+// Delete removes a passkey
+func (h *WebAuthnHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if err := h.webauthnService.Delete(requestEmail(r), mux.Vars(r)["id"]); err != nil {
+		writePasskeyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Board events webhooks can subscribe to
+const (
+	WebhookEventTaskCreated   = "task.created"
+	WebhookEventTaskMoved     = "task.moved"
+	WebhookEventTaskCompleted = "task.completed"
+)
+
+var webhookEvents = []string{WebhookEventTaskCreated, WebhookEventTaskMoved, WebhookEventTaskCompleted}
+
+// Delivery states recorded in the delivery log
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryRetrying  = "retrying"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// webhookMaxAttempts is how often a delivery is tried before it's marked
+// failed; retries back off as for other jobs
+const webhookMaxAttempts = 5
+
+// webhookDeliveryLogSize is how many deliveries are kept per webhook
+const webhookDeliveryLogSize = 100
+
+// Webhook is a user's endpoint for board events. The secret is only
+// returned when the webhook is created.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// WebhookDelivery is one entry of a webhook's delivery log
+type WebhookDelivery struct {
+	ID             string          `json:"id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Attempts       int             `json:"attempts"`
+	Status         string          `json:"status"`
+	ResponseStatus string          `json:"responseStatus,omitempty"` // HTTP status or error of the last attempt
+	CreatedAt      time.Time       `json:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
+}
+
+// WebhookPayload is the body posted for an event
+type WebhookPayload struct {
+	ID        string    `json:"id"` // The delivery ID, also sent as X-Webhook-Delivery
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"createdAt"`
+	Task      Task      `json:"task"`
+	Column    *Column   `json:"column,omitempty"`
+}
+
+// errWebhookNotFound is returned when a webhook doesn't exist
+var errWebhookNotFound = errors.New("webhook not found")
+
+// activityWebhookEvents maps a logged task change to the events it fires
+func activityWebhookEvents(action string) []string {
+	switch action {
+	case ActivityCreated:
+		return []string{WebhookEventTaskCreated}
+	case ActivityMoved:
+		return []string{WebhookEventTaskMoved}
+	case ActivityCompleted:
+		return []string{WebhookEventTaskCompleted}
+	}
+	return nil
+}
+
+// WebhookService stores webhooks and delivers board events to them
+type WebhookService struct {
+	db          *DB
+	authService *AuthService
+	jobs        *JobQueue
+}
+
+func NewWebhookService(db *DB, dataService *DataService, authService *AuthService, jobs *JobQueue) *WebhookService {
+	s := &WebhookService{db: db, authService: authService, jobs: jobs}
+	dataService.OnActivity(s.dispatch)
+	return s
+}
+
+// Create registers a webhook with a fresh signing secret
+func (s *WebhookService) Create(email, rawURL string, events []string) (*Webhook, error) {
+	secret, err := s.authService.generateSecureToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+
+	if err := ensureUser(s.db, email); err != nil {
+		return nil, err
+	}
+
+	hook := &Webhook{
+		ID:        generateID(),
+		URL:       rawURL,
+		Events:    events,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO webhooks (id, email, url, secret, events, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, hook.ID, email, hook.URL, hook.Secret, strings.Join(hook.Events, ","), hook.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store webhook: %w", err)
+	}
+	return hook, nil
+}
+
+// List returns a user's webhooks without their secrets
+func (s *WebhookService) List(email string) ([]Webhook, error) {
+	rows, err := s.db.Query(`
+		SELECT id, url, events, created_at FROM webhooks
+		WHERE email = ? ORDER BY created_at
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var hook Webhook
+		var events string
+		if err := rows.Scan(&hook.ID, &hook.URL, &events, &hook.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		hook.Events = strings.Split(events, ",")
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// Delete removes one of a user's webhooks and its delivery log
+func (s *WebhookService) Delete(email, id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM webhooks WHERE id = ? AND email = ?", id, email)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errWebhookNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete webhook deliveries: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Deliveries returns the delivery log of one of a user's webhooks, newest first
+func (s *WebhookService) Deliveries(email, id string) ([]WebhookDelivery, error) {
+	var owner string
+	err := s.db.QueryRow("SELECT email FROM webhooks WHERE id = ?", id).Scan(&owner)
+	if err == sql.ErrNoRows || (err == nil && owner != email) {
+		return nil, errWebhookNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook: %w", err)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, event, payload, attempts, status, response_status, created_at, updated_at
+		FROM webhook_deliveries WHERE webhook_id = ?
+		ORDER BY created_at DESC
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload string
+		if err := rows.Scan(&d.ID, &d.Event, &payload, &d.Attempts, &d.Status, &d.ResponseStatus, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// dispatch turns the activity of a board save into payloads and queues
+// their delivery. It runs on every save, so the webhook lookup happens in
+// a job rather than here.
+func (s *WebhookService) dispatch(email string, data *KanbanData, activity []TaskActivity) {
+	now := time.Now().UTC()
+	// Callers keep using the saved board, and payloads are encoded later
+	data = cloneKanbanData(data)
+
+	var payloads []WebhookPayload
+	for _, entry := range activity {
+		events := activityWebhookEvents(entry.Action)
+		if events == nil {
+			continue
+		}
+		i := findTask(data, entry.TaskID)
+		if i < 0 {
+			continue
+		}
+		task := data.Tasks[i]
+
+		var column *Column
+		if task.ColumnID != nil {
+			if c := findColumn(data, *task.ColumnID); c >= 0 {
+				col := data.Columns[c]
+				column = &col
+			}
+		}
+
+		for _, event := range events {
+			payloads = append(payloads, WebhookPayload{Event: event, CreatedAt: now, Task: task, Column: column})
+		}
+	}
+	if len(payloads) == 0 {
+		return
+	}
+
+	err := s.jobs.Enqueue(Job{
+		Name: "webhook-dispatch:" + email,
+		Run: func(ctx context.Context) error {
+			return s.queueDeliveries(email, payloads)
+		},
+	})
+	if err != nil {
+		log.Printf("Error queueing webhooks for %s: %v", email, err)
+	}
+}
+
+// queueDeliveries logs a delivery of each payload to every webhook
+// subscribed to its event and queues them
+func (s *WebhookService) queueDeliveries(email string, payloads []WebhookPayload) error {
+	hooks, err := s.List(email)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		for _, payload := range payloads {
+			if !containsString(hook.Events, payload.Event) {
+				continue
+			}
+
+			payload.ID = generateID()
+			body, err := json.Marshal(payload)
+			if err != nil {
+				return fmt.Errorf("failed to marshal webhook payload: %w", err)
+			}
+			if err := s.logDelivery(hook.ID, payload.ID, payload.Event, body); err != nil {
+				return err
+			}
+
+			deliveryID := payload.ID
+			err = s.jobs.Enqueue(Job{
+				Name:        "webhook:" + deliveryID,
+				MaxAttempts: webhookMaxAttempts,
+				Run: func(ctx context.Context) error {
+					return s.Deliver(ctx, deliveryID)
+				},
+			})
+			if err != nil {
+				log.Printf("Error queueing webhook delivery %s: %v", deliveryID, err)
+				s.recordAttempt(deliveryID, WebhookDeliveryFailed, "not queued: "+err.Error(), false)
+			}
+		}
+	}
+	return nil
+}
+
+// logDelivery records a pending delivery, trimming the webhook's log
+func (s *WebhookService) logDelivery(webhookID, id, event string, payload []byte) error {
+	_, err := s.db.Exec(`
+		INSERT INTO webhook_deliveries (id, webhook_id, event, payload, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+	`, id, webhookID, event, string(payload), WebhookDeliveryPending)
+	if err != nil {
+		return fmt.Errorf("failed to log webhook delivery: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+		DELETE FROM webhook_deliveries WHERE webhook_id = ? AND id NOT IN (
+			SELECT id FROM webhook_deliveries WHERE webhook_id = ?
+			ORDER BY created_at DESC LIMIT ?
+		)
+	`, webhookID, webhookID, webhookDeliveryLogSize)
+	if err != nil {
+		log.Printf("Error trimming webhook deliveries for %s: %v", webhookID, err)
+	}
+	return nil
+}
+
+// recordAttempt updates a delivery after an attempt
+func (s *WebhookService) recordAttempt(id, status, responseStatus string, attempted bool) {
+	attempts := 0
+	if attempted {
+		attempts = 1
+	}
+	_, err := s.db.Exec(`
+		UPDATE webhook_deliveries
+		SET attempts = attempts + ?, status = ?, response_status = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, attempts, status, responseStatus, id)
+	if err != nil {
+		log.Printf("Error recording webhook delivery %s: %v", id, err)
+	}
+}
+
+// Deliver posts a logged delivery's payload, signed with the webhook's
+// secret, and records the outcome. An error means the job should retry.
+func (s *WebhookService) Deliver(ctx context.Context, id string) error {
+	var url, secret, event, payload string
+	var attempts int
+	err := s.db.QueryRow(`
+		SELECT w.url, w.secret, d.event, d.payload, d.attempts
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.id = ?
+	`, id).Scan(&url, &secret, &event, &payload, &attempts)
+	if err == sql.ErrNoRows {
+		// The webhook was deleted since the delivery was queued
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query webhook delivery: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader([]byte(payload)))
+	if err != nil {
+		s.recordAttempt(id, WebhookDeliveryFailed, "error: "+err.Error(), true)
+		return nil
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureHeader, signPayload(secret, []byte(payload)))
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Delivery", id)
+
+	var responseStatus string
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		responseStatus = "error: " + err.Error()
+	} else {
+		resp.Body.Close()
+		responseStatus = resp.Status
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("webhook endpoint returned %s", resp.Status)
+		}
+	}
+
+	switch {
+	case err == nil:
+		s.recordAttempt(id, WebhookDeliveryDelivered, responseStatus, true)
+	case attempts+1 >= webhookMaxAttempts:
+		s.recordAttempt(id, WebhookDeliveryFailed, responseStatus, true)
+	default:
+		s.recordAttempt(id, WebhookDeliveryRetrying, responseStatus, true)
+	}
+	return err
+}
+
+// WebhookHandler manages webhooks over HTTP
+type WebhookHandler struct {
+	webhookService *WebhookService
+}
+
+func NewWebhookHandler(webhookService *WebhookService) *WebhookHandler {
+	return &WebhookHandler{webhookService: webhookService}
+}
+
+// List returns the user's webhooks
+func (h *WebhookHandler) List(w http.ResponseWriter, r *http.Request) {
+	hooks, err := h.webhookService.List(requestEmail(r))
+	if err != nil {
+		log.Printf("Error listing webhooks: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "success",
+		"webhooks": hooks,
+	})
+}
+
+// Create registers a webhook and returns its signing secret, which is only
+// shown in this response
+func (h *WebhookHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := validateWebhookURL(req.URL); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Events) == 0 {
+		writeError(w, http.StatusBadRequest, "events must list at least one of "+strings.Join(webhookEvents, ", "))
+		return
+	}
+	var events []string
+	for _, event := range req.Events {
+		if !containsString(webhookEvents, event) {
+			writeError(w, http.StatusBadRequest, "unknown event "+event)
+			return
+		}
+		if !containsString(events, event) {
+			events = append(events, event)
+		}
+	}
+
+	hook, err := h.webhookService.Create(requestEmail(r), req.URL, events)
+	if err != nil {
+		log.Printf("Error creating webhook: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to create webhook")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "success",
+		"webhook": hook,
+	})
+}
+
+// Delete removes a webhook
+func (h *WebhookHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	err := h.webhookService.Delete(requestEmail(r), mux.Vars(r)["id"])
+	if err == errWebhookNotFound {
+		writeError(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting webhook: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Deliveries returns a webhook's recent deliveries and their outcomes
+func (h *WebhookHandler) Deliveries(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := h.webhookService.Deliveries(requestEmail(r), mux.Vars(r)["id"])
+	if err == errWebhookNotFound {
+		writeError(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error listing webhook deliveries: %v", err)
+		writeError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     "success",
+		"deliveries": deliveries,
+	})
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,26 +24,113 @@ const (
 
 	// Maximum message size allowed from peer
 	maxMessageSize = 1024 * 1024 // 1MB
+
+	// Close code sent to a connection evicted for a newer one from the same
+	// user; clients shouldn't reconnect after it
+	closeTooManyConnections = 4008
+
+	// Close code sent when a user is disabled or their sessions revoked;
+	// clients should sign out
+	closeSessionRevoked = 4001
 )
 
+// disconnection closes a user's connections, or everyone's when email is
+// empty, with a close code
+type disconnection struct {
+	email  string
+	code   int
+	reason string
+}
+
 // Client represents a connected WebSocket client
 type Client struct {
 	hub   *Hub
 	conn  *websocket.Conn
-	send  chan []byte
-	email string // User identifier
+	send  chan outbound // Never closed; done ends the WritePump
+	email string        // User identifier
+
+	// The frontend's client ID, which its edit locks are held under
+	clientID string
+
+	// Board rooms this client is in, and the board it's showing; only
+	// touched by the hub's Run loop
+	boards  map[string]bool
+	viewing string
+
+	// Tasks this client is editing; only touched by its ReadPump
+	editing map[editingTask]bool
+
+	// When the client last sent a message other than a ping or ack, in Unix
+	// nanoseconds
+	lastActive atomic.Int64
+
+	// Messages dropped because send was full
+	dropped atomic.Uint64
+
+	// The delivery session a WebSocket client asks to resume, set before it
+	// registers, and the one it has; see delivery.go. session is only
+	// touched by the Run loop.
+	resume  *resumption
+	session *deliverySession
+
+	// Bounds the work done for the client's messages; canceled when it
+	// disconnects or is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Closed by Close; the WritePump then sends the close frame and exits
+	done      chan struct{}
+	closeOnce sync.Once
+	// Close frame, set by Close before done is closed
+	closeCode   int
+	closeReason string
+}
+
+// NewClient creates a client for a user's connection
+func NewClient(hub *Hub, conn *websocket.Conn, email string) *Client {
+	c := &Client{
+		hub:   hub,
+		conn:  conn,
+		send:  make(chan outbound, hub.queueSize),
+		email: email,
+		done:  make(chan struct{}),
+
+		editing: make(map[editingTask]bool),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.lastActive.Store(time.Now().UnixNano())
+	return c
+}
+
+// Context is canceled once the client disconnects or is closed
+func (c *Client) Context() context.Context {
+	return c.ctx
+}
+
+// Close ends the connection with a close frame. It's safe to call from any
+// goroutine and more than once; only the first call counts.
+func (c *Client) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.done)
+		c.cancel()
+	})
 }
 
 // WebSocketMessage is the standard message format for WebSocket communication
 type WebSocketMessage struct {
-	Type string `json:"type"`
-	Data any    `json:"data"`
-	User string `json:"user,omitempty"`
+	Type  string `json:"type"`
+	Data  any    `json:"data"`
+	User  string `json:"user,omitempty"`
+	Board string `json:"board,omitempty"`
 }
 
 // ReadPump pumps messages from the WebSocket connection to the hub
 func (c *Client) ReadPump() {
 	defer func() {
+		c.cancel()
+		c.stopEditing()
 		c.hub.Unregister(c)
 		c.conn.Close()
 	}()
@@ -61,45 +151,32 @@ func (c *Client) ReadPump() {
 			break
 		}
 
-		// Process incoming message - forward to hub for broadcasting
 		// Parse the message to extract user information
 		var wsMessage WebSocketMessage
 		if err := json.Unmarshal(message, &wsMessage); err != nil {
 			log.Printf("Error unmarshalling WebSocket message: %v", err)
+			c.Send(WebSocketMessage{Type: "error", Data: map[string]string{"message": "invalid message"}})
 			continue
 		}
 
 		// Set the user field to the client's email
 		wsMessage.User = c.email
 
-		// Handle ping messages specially
-		if wsMessage.Type == "ping" {
-			// Reply with a pong directly to this client only
-			pongMessage := WebSocketMessage{
-				Type: "pong",
-				Data: map[string]string{"timestamp": time.Now().Format(time.RFC3339)},
-				User: "", // No need to set user for pong
-			}
-
-			pongJSON, err := json.Marshal(pongMessage)
-			if err == nil {
-				c.send <- pongJSON
-			}
-			// Don't broadcast ping messages
-			continue
+		control := wsMessage.Type == "ping" || wsMessage.Type == "ack"
+		if !control {
+			c.lastActive.Store(time.Now().UnixNano())
 		}
 
-		// Marshal the message with the updated user field
-		jsonMessage, err := json.Marshal(wsMessage)
-		if err != nil {
-			log.Printf("Error marshalling WebSocket message: %v", err)
-			continue
+		// Over-limit messages are dropped; the client is told when to retry
+		if c.hub.limiter != nil && !control {
+			if status := c.hub.limiter.Allow("user:" + c.email); !status.allowed {
+				c.Send(WebSocketMessage{Type: "rate_limit", Data: status})
+				continue
+			}
 		}
 
-		log.Printf("Received message from client %s: %s", c.email, wsMessage.Type)
-
-		// Forward to hub for broadcasting
-		c.hub.broadcast <- jsonMessage
+		// Checked against the type's spec, then handled or relayed
+		c.hub.dispatch(c, wsMessage, len(message))
 	}
 }
 
@@ -109,29 +186,29 @@ func (c *Client) WritePump() {
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.hub.pumps.Done()
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.send:
+		case <-c.done:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(c.closeCode, c.closeReason))
+			return
+		case message := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
 			w, err := c.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
 				return
 			}
-			w.Write(message)
+			w.Write(message.payload)
 
 			// Add queued messages to the current WebSocket message
 			n := len(c.send)
 			for i := 0; i < n; i++ {
 				w.Write([]byte("\n"))
-				w.Write(<-c.send)
+				w.Write((<-c.send).payload)
 			}
 
 			if err := w.Close(); err != nil {
@@ -146,46 +223,375 @@ func (c *Client) WritePump() {
 	}
 }
 
-// Hub maintains the set of active clients and broadcasts messages to the clients
+// Send queues a message for this client only
+func (c *Client) Send(message WebSocketMessage) {
+	jsonMessage, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshalling WebSocket message: %v", err)
+		return
+	}
+	c.hub.deliver(c, outbound{payload: jsonMessage})
+}
+
+// MessageHandler processes an incoming client message of a registered type
+type MessageHandler func(client *Client, message WebSocketMessage)
+
+// outbound is a message queued for a client. Messages published to a board
+// carry the event ID they were recorded under; others have ID 0.
+type outbound struct {
+	id      uint64
+	payload []byte
+}
+
+// boardMessage is delivered to the clients in a board's room, optionally
+// skipping one
+type boardMessage struct {
+	board   string
+	except  *Client
+	payload []byte
+}
+
+// subscription changes which board rooms a client is in. view also makes
+// the board the one the client is showing.
+type subscription struct {
+	client    *Client
+	board     string
+	subscribe bool
+	view      bool
+}
+
+// SlowClientPolicy decides what happens to a client whose send queue is full
+type SlowClientPolicy string
+
+const (
+	// Close the connection with 1013 (try again later); the client
+	// reconnects and reloads its board
+	SlowClientDisconnect SlowClientPolicy = "disconnect"
+	// Drop the message and keep the connection; delta clients notice the
+	// version gap and resync
+	SlowClientDrop SlowClientPolicy = "drop"
+)
+
+// HubStats is a snapshot of the hub's connections and delivery counters
+type HubStats struct {
+	Connections       int              `json:"connections"`
+	Users             int              `json:"users"`
+	Rooms             int              `json:"rooms"`
+	MessagesDelivered uint64           `json:"messagesDelivered"`
+	MessagesDropped   uint64           `json:"messagesDropped"`
+	SlowClientsClosed uint64           `json:"slowClientsClosed"`
+	Sessions          int              `json:"sessions"`
+	MessagesReplayed  uint64           `json:"messagesReplayed"`
+	SendQueue         int              `json:"sendQueue"`
+	SlowClientPolicy  SlowClientPolicy `json:"slowClientPolicy"`
+}
+
+// Hub tracks connected clients in rooms, one per user and one per board,
+// and fans messages out to a room's members. The rooms are only touched by
+// the Run loop; other goroutines talk to it over channels.
 type Hub struct {
-	clients    map[*Client]bool
-	broadcast  chan []byte
+	// Connections by user email, and by board ID they're subscribed to
+	users map[string]map[*Client]bool
+	rooms map[string]map[*Client]bool
+
+	boards     chan boardMessage
+	subscribe  chan subscription
 	register   chan *Client
 	unregister chan *Client
+	disconnect chan disconnection
+	presence   chan presenceRequest
+	resume     chan resumeRequest
+	acks       chan ack
+	stats      chan chan HubStats
+	shutdown   chan struct{}
+
+	// Boards whose presence changed during the current Run iteration
+	presenceDirty map[string]bool
+
+	// Specs of the message types clients may send; set up before Run
+	messages map[string]MessageSpec
+
+	// Limits incoming messages per user when set; set up before Run
+	limiter *RateLimiter
+
+	// Roles on workspace boards; nil until workspaces are set up
+	sharedBoards SharedBoardRoles
+
+	// Connections allowed per user, 0 for no limit; set up before Run
+	maxPerUser int
+
+	// Per-client send queue length and what to do when it fills; set up
+	// before Run
+	queueSize  int
+	slowPolicy SlowClientPolicy
+
+	// Recent board messages, oldest first, for event streams resuming after
+	// a reconnect; only touched by the Run loop. IDs are only meaningful to
+	// the hub with the same epoch.
+	history   []boardEvent
+	lastEvent uint64
+	epoch     string
+
+	// WebSocket delivery sessions by ID, kept for resuming after a
+	// reconnect; only touched by the Run loop
+	sessions map[string]*deliverySession
+
+	// Shares board messages and revocations with other instances when set;
+	// set up before Run
+	relay *ClusterRelay
+
+	delivered  atomic.Uint64
+	dropped    atomic.Uint64
+	slowClosed atomic.Uint64
+	replayed   atomic.Uint64
+
+	// Tracks running WritePumps so Shutdown can wait for close frames to flush
+	pumps  sync.WaitGroup
+	closed bool
 }
 
 // NewHub creates a new hub instance
 func NewHub() *Hub {
-	return &Hub{
-		broadcast:  make(chan []byte),
+	h := &Hub{
+		users:      make(map[string]map[*Client]bool),
+		rooms:      make(map[string]map[*Client]bool),
+		boards:     make(chan boardMessage),
+		subscribe:  make(chan subscription),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+		disconnect: make(chan disconnection),
+		presence:   make(chan presenceRequest),
+		resume:     make(chan resumeRequest),
+		acks:       make(chan ack),
+		stats:      make(chan chan HubStats),
+		shutdown:   make(chan struct{}),
+		messages:   make(map[string]MessageSpec),
+		queueSize:  256,
+		slowPolicy: SlowClientDisconnect,
+		epoch:      strconv.FormatInt(time.Now().UnixNano(), 36),
+		sessions:   make(map[string]*deliverySession),
+
+		presenceDirty: make(map[string]bool),
 	}
+	h.Handle("ping", MessageSpec{MaxSize: 1024, Handler: handlePing})
+	h.Handle("ack", MessageSpec{MaxSize: 1024, Validate: validateAck, Handler: h.handleAck})
+	h.Handle("subscribe", MessageSpec{Role: BoardRoleViewer, Handler: h.handleSubscription(true)})
+	h.Handle("unsubscribe", MessageSpec{Handler: h.handleSubscription(false)})
+	h.Handle("view", MessageSpec{Role: BoardRoleViewer, Handler: h.handleView})
+	h.Handle("editing", MessageSpec{Role: BoardRoleEditor, Validate: validateEditing, Handler: h.handleEditing})
+	h.Handle("taskMove", MessageSpec{Role: BoardRoleEditor, Validate: validateTaskMove})
+	return h
 }
 
-// Register adds a client to the hub
-func (h *Hub) Register(client *Client) {
-	h.register <- client
+// Handle registers an incoming message type. It must be called before
+// clients connect.
+func (h *Hub) Handle(messageType string, spec MessageSpec) {
+	h.messages[messageType] = spec
 }
 
-// Unregister removes a client from the hub
-func (h *Hub) Unregister(client *Client) {
-	h.unregister <- client
+// handlePing replies to a client's heartbeat with a pong
+func handlePing(c *Client, message WebSocketMessage) {
+	c.Send(WebSocketMessage{
+		Type: "pong",
+		Data: map[string]string{"timestamp": time.Now().Format(time.RFC3339)},
+	})
 }
 
-// Broadcast sends a message to all connected clients except the sender
-func (h *Hub) Broadcast(message WebSocketMessage, excludeEmail string) {
-	// Set the sender's email in the message to enable proper filtering
-	message.User = excludeEmail
+// LimitMessages counts incoming messages other than pings against a rate
+// limiter. It must be called before clients connect.
+func (h *Hub) LimitMessages(limiter *RateLimiter) {
+	h.limiter = limiter
+}
 
+// UseSharedBoards lets workspace members subscribe to and edit workspace
+// boards. It must be called before clients connect.
+func (h *Hub) UseSharedBoards(shared SharedBoardRoles) {
+	h.sharedBoards = shared
+}
+
+// BoardRole resolves a user's role on a board
+func (h *Hub) BoardRole(email string, boardID string) BoardRole {
+	return boardRole(h.sharedBoards, email, boardID)
+}
+
+// LimitConnections caps each user's concurrent connections. A connection
+// over the cap closes the user's longest idle one. It must be called before
+// clients connect.
+func (h *Hub) LimitConnections(maxPerUser int) {
+	h.maxPerUser = maxPerUser
+}
+
+// LimitQueues sets the length of each client's send queue and what happens
+// when a client falls that far behind. It must be called before clients
+// connect.
+func (h *Hub) LimitQueues(size int, policy SlowClientPolicy) {
+	h.queueSize = size
+	h.slowPolicy = policy
+}
+
+// deliver queues a message for a client, applying the slow-client policy
+// when its queue is full. It's safe to call from any goroutine.
+func (h *Hub) deliver(client *Client, message outbound) {
+	select {
+	case <-client.done:
+		return // Closing; nobody will read it
+	default:
+	}
+	select {
+	case client.send <- message:
+		h.delivered.Add(1)
+		return
+	default:
+	}
+
+	h.dropped.Add(1)
+	if h.slowPolicy == SlowClientDrop {
+		if client.dropped.Add(1) == 1 {
+			log.Printf("Client send queue full, dropping messages for %s", client.email)
+		}
+		return
+	}
+
+	// The Run loop removes the client when its ReadPump unregisters it
+	log.Printf("Client send queue full, closing connection for %s", client.email)
+	h.slowClosed.Add(1)
+	client.Close(websocket.CloseTryAgainLater, "too slow")
+}
+
+// evictIdlest closes the user's connection that has been idle longest if
+// they already hold the maximum. Only called from the Run loop.
+func (h *Hub) evictIdlest(email string) {
+	var idlest *Client
+	for client := range h.users[email] {
+		if idlest == nil || client.lastActive.Load() < idlest.lastActive.Load() {
+			idlest = client
+		}
+	}
+	if h.maxPerUser <= 0 || len(h.users[email]) < h.maxPerUser {
+		return
+	}
+
+	log.Printf("Too many connections for %s, closing the longest idle", email)
+	idlest.Close(closeTooManyConnections, "too many connections")
+	h.remove(idlest)
+}
+
+// join adds a client to a room. Only called from the Run loop.
+func join(rooms map[string]map[*Client]bool, room string, client *Client) {
+	if rooms[room] == nil {
+		rooms[room] = make(map[*Client]bool)
+	}
+	rooms[room][client] = true
+}
+
+// leave removes a client from a room, dropping the room once it's empty.
+// Only called from the Run loop.
+func leave(rooms map[string]map[*Client]bool, room string, client *Client) {
+	delete(rooms[room], client)
+	if len(rooms[room]) == 0 {
+		delete(rooms, room)
+	}
+}
+
+// remove takes a client out of every room. Only called from the Run loop.
+func (h *Hub) remove(client *Client) {
+	h.detachSession(client)
+	h.markPresence(client)
+	leave(h.users, client.email, client)
+	for board := range client.boards {
+		leave(h.rooms, board, client)
+	}
+}
+
+// PublishBoard delivers a message to every client subscribed to a board
+// except the given client (which may be nil)
+func (h *Hub) PublishBoard(boardID string, message WebSocketMessage, except *Client) {
+	message.Board = boardID
 	jsonMessage, err := json.Marshal(message)
 	if err != nil {
 		log.Printf("Error marshalling WebSocket message: %v", err)
 		return
 	}
 
-	h.broadcast <- jsonMessage
+	h.boards <- boardMessage{board: boardID, except: except, payload: jsonMessage}
+	if h.relay != nil {
+		h.relay.publishBoard(boardID, jsonMessage)
+	}
+}
+
+// handleSubscription returns the handler for the subscribe/unsubscribe
+// control messages: {"type": "subscribe", "board": "<board id>"}
+func (h *Hub) handleSubscription(subscribe bool) MessageHandler {
+	return func(c *Client, message WebSocketMessage) {
+		boardID := canonicalBoardID(c.email, message.Board)
+		h.subscribe <- subscription{client: c, board: boardID, subscribe: subscribe}
+
+		reply := "subscribed"
+		if !subscribe {
+			reply = "unsubscribed"
+		}
+		c.Send(WebSocketMessage{Type: reply, Board: boardID})
+	}
+}
+
+// Register adds a client to the hub. The client's WritePump, or whatever else
+// drains its send queue, must be started after registering and call
+// h.pumps.Done when it exits.
+func (h *Hub) Register(client *Client) {
+	h.pumps.Add(1)
+	h.register <- client
+}
+
+// Unregister removes a client from the hub
+func (h *Hub) Unregister(client *Client) {
+	h.unregister <- client
+}
+
+// Disconnect closes all of a user's connections with closeSessionRevoked,
+// on every instance
+func (h *Hub) Disconnect(email string) {
+	h.disconnectLocal(email)
+	if h.relay != nil {
+		h.relay.publishDisconnect(email)
+	}
+}
+
+// disconnectLocal closes a user's connections to this instance
+func (h *Hub) disconnectLocal(email string) {
+	h.disconnect <- disconnection{email: email, code: closeSessionRevoked, reason: "session revoked"}
+}
+
+// Reconnect closes every connection with a service-restart close frame, so
+// clients reconnect and reload their boards
+func (h *Hub) Reconnect() {
+	h.disconnect <- disconnection{code: websocket.CloseServiceRestart, reason: "reloading"}
+}
+
+// Stats returns the hub's current connections and delivery counters
+func (h *Hub) Stats() HubStats {
+	reply := make(chan HubStats, 1)
+	h.stats <- reply
+	return <-reply
+}
+
+// Shutdown closes every client connection with a going-away close frame and
+// waits until their writers have finished or ctx expires. Clients that
+// connect afterwards are turned away.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.shutdown <- struct{}{}
+
+	done := make(chan struct{})
+	go func() {
+		h.pumps.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Run starts the hub's main loop
@@ -193,49 +599,112 @@ func (h *Hub) Run() {
 	for {
 		select {
 		case client := <-h.register:
-			h.clients[client] = true
+			if h.closed {
+				// The WritePump says goodbye and exits
+				client.Close(websocket.CloseGoingAway, "")
+				continue
+			}
+			h.evictIdlest(client.email)
+			// Clients start in their own user's room and board's room
+			client.viewing = canonicalBoardID(client.email, "")
+			client.boards = map[string]bool{client.viewing: true}
+			join(h.users, client.email, client)
+			join(h.rooms, client.viewing, client)
+			// A resumed session puts the client back on its other boards
+			h.attachSession(client)
+			h.markPresence(client)
 			log.Printf("Client connected: %s", client.email)
+		case <-h.shutdown:
+			h.closed = true
+			for _, clients := range h.users {
+				for client := range clients {
+					client.Close(websocket.CloseGoingAway, "")
+					h.remove(client)
+				}
+			}
+			log.Printf("Hub shut down, all clients closed")
 		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+			if h.users[client.email][client] {
+				h.remove(client)
 				log.Printf("Client disconnected: %s", client.email)
 			}
-		case message := <-h.broadcast:
-			// Get the user from the message
-			var wsMessage WebSocketMessage
-			decoder := json.NewDecoder(bytes.NewReader(message))
-			if err := decoder.Decode(&wsMessage); err != nil {
-				log.Printf("Error decoding message: %v", err)
+			// Stops the WritePump if it's still running
+			client.Close(websocket.CloseGoingAway, "")
+		case d := <-h.disconnect:
+			for email, clients := range h.users {
+				if d.email != "" && email != d.email {
+					continue
+				}
+				for client := range clients {
+					client.Close(d.code, d.reason)
+					h.remove(client)
+				}
+			}
+			if d.code == closeSessionRevoked {
+				h.endSessions(d.email)
+			}
+			if d.email != "" {
+				log.Printf("Closed all connections for %s", d.email)
+			} else {
+				log.Printf("Closed all connections (%s)", d.reason)
+			}
+		case sub := <-h.subscribe:
+			if !h.users[sub.client.email][sub.client] {
 				continue
 			}
-
-			excludeEmail := wsMessage.User
-			if excludeEmail == "" {
-				log.Printf("Broadcasting message of type '%s' to ALL clients (including sender)", wsMessage.Type)
+			// Presence changes on the boards left as well as the one joined
+			h.markPresence(sub.client)
+			if sub.subscribe {
+				sub.client.boards[sub.board] = true
+				join(h.rooms, sub.board, sub.client)
 			} else {
-				log.Printf("Broadcasting message of type '%s' from %s to other clients", wsMessage.Type, excludeEmail)
+				delete(sub.client.boards, sub.board)
+				leave(h.rooms, sub.board, sub.client)
 			}
-
-			for client := range h.clients {
-				// If excludeEmail is empty, send to all clients
-				// Otherwise skip the sender to avoid echo
-				if excludeEmail != "" && client.email == excludeEmail {
-					log.Printf("Skipping sender: %s", client.email)
+			if sub.view {
+				sub.client.viewing = sub.board
+			} else if !sub.subscribe && sub.client.viewing == sub.board {
+				sub.client.viewing = canonicalBoardID(sub.client.email, "")
+			}
+			h.markPresence(sub.client)
+		case req := <-h.presence:
+			req.reply <- h.boardPresence(req.board)
+		case req := <-h.resume:
+			req.reply <- h.resumeEvents(req)
+		case a := <-h.acks:
+			if session := a.client.session; session != nil && session.client == a.client {
+				session.ack(a.seq)
+			}
+		case reply := <-h.stats:
+			connections := 0
+			for _, clients := range h.users {
+				connections += len(clients)
+			}
+			reply <- HubStats{
+				Connections:       connections,
+				Users:             len(h.users),
+				Rooms:             len(h.rooms),
+				MessagesDelivered: h.delivered.Load(),
+				MessagesDropped:   h.dropped.Load(),
+				SlowClientsClosed: h.slowClosed.Load(),
+				Sessions:          len(h.sessions),
+				MessagesReplayed:  h.replayed.Load(),
+				SendQueue:         h.queueSize,
+				SlowClientPolicy:  h.slowPolicy,
+			}
+		case message := <-h.boards:
+			id := h.record(message)
+			for client := range h.rooms[message.board] {
+				if client == message.except {
 					continue
 				}
-
-				log.Printf("Sending to client: %s", client.email)
-				select {
-				case client.send <- message:
-					// Message sent successfully
-				default:
-					// Client's send buffer is full, assume disconnected
-					log.Printf("Client send buffer full, removing client: %s", client.email)
-					close(client.send)
-					delete(h.clients, client)
+				payload := message.payload
+				if client.session != nil {
+					payload = client.session.next(payload)
 				}
+				h.deliver(client, outbound{id: id, payload: payload})
 			}
 		}
+		h.flushPresence()
 	}
 }
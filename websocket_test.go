@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestHub starts a hub that's shut down when the test ends
+func newTestHub(t testing.TB) *Hub {
+	t.Helper()
+	hub := NewHub()
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := hub.Shutdown(ctx); err != nil {
+			t.Errorf("hub shutdown: %v", err)
+		}
+	})
+	return hub
+}
+
+// connectFakeClient registers a client without a connection. The test
+// reads its send queue; a stand-in for the WritePump exits once the client
+// is closed.
+func connectFakeClient(hub *Hub, email string) *Client {
+	client := NewClient(hub, nil, email)
+	hub.Register(client)
+	go func() {
+		<-client.done
+		hub.pumps.Done()
+	}()
+	return client
+}
+
+// receive returns the next message of the given type queued for a client,
+// skipping others such as presence updates
+func receive(t testing.TB, client *Client, messageType string) WebSocketMessage {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case out := <-client.send:
+			var message WebSocketMessage
+			if err := json.Unmarshal(out.payload, &message); err != nil {
+				t.Fatalf("decoding queued message: %v", err)
+			}
+			if message.Type == messageType {
+				return message
+			}
+		case <-timeout:
+			t.Fatalf("no %q message for %s", messageType, client.email)
+			return WebSocketMessage{}
+		}
+	}
+}
+
+// expectNone fails if a message of the given type is queued for a client.
+// Asking the hub for its stats first lets it finish delivering whatever it
+// was.
+func expectNone(t testing.TB, client *Client, messageType string) {
+	t.Helper()
+	client.hub.Stats()
+	for {
+		select {
+		case out := <-client.send:
+			var message WebSocketMessage
+			if err := json.Unmarshal(out.payload, &message); err != nil {
+				t.Fatalf("decoding queued message: %v", err)
+			}
+			if message.Type == messageType {
+				t.Fatalf("unexpected %q message for %s: %s", messageType, client.email, out.payload)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isClosed(client *Client) bool {
+	select {
+	case <-client.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestHubPublishBoardReachesRoom(t *testing.T) {
+	hub := newTestHub(t)
+	sender := connectFakeClient(hub, "a@example.com")
+	otherTab := connectFakeClient(hub, "a@example.com")
+	stranger := connectFakeClient(hub, "b@example.com")
+
+	hub.PublishBoard("a@example.com", WebSocketMessage{Type: "sync", Data: "board"}, sender)
+
+	message := receive(t, otherTab, "sync")
+	if message.Board != "a@example.com" || message.Data != "board" {
+		t.Errorf("message = %+v, want the published board", message)
+	}
+	expectNone(t, sender, "sync")
+	expectNone(t, stranger, "sync")
+}
+
+func TestHubSubscriptionJoinsBoardRoom(t *testing.T) {
+	hub := newTestHub(t)
+	owner := connectFakeClient(hub, "a@example.com")
+	collaborator := connectFakeClient(hub, "b@example.com")
+
+	hub.subscribe <- subscription{client: collaborator, board: "a@example.com", subscribe: true}
+	hub.PublishBoard("a@example.com", WebSocketMessage{Type: "sync"}, nil)
+	receive(t, owner, "sync")
+	receive(t, collaborator, "sync")
+
+	hub.subscribe <- subscription{client: collaborator, board: "a@example.com", subscribe: false}
+	hub.PublishBoard("a@example.com", WebSocketMessage{Type: "sync"}, nil)
+	receive(t, owner, "sync")
+	expectNone(t, collaborator, "sync")
+}
+
+func TestHubUnregister(t *testing.T) {
+	hub := newTestHub(t)
+	client := connectFakeClient(hub, "a@example.com")
+	if stats := hub.Stats(); stats.Connections != 1 || stats.Users != 1 {
+		t.Fatalf("stats = %+v, want 1 connection from 1 user", stats)
+	}
+
+	hub.Unregister(client)
+	if stats := hub.Stats(); stats.Connections != 0 || stats.Rooms != 0 {
+		t.Errorf("stats after unregistering = %+v, want no connections or rooms", stats)
+	}
+	if !isClosed(client) {
+		t.Error("unregistered client wasn't closed")
+	}
+}
+
+func TestHubSlowClientDrop(t *testing.T) {
+	hub := NewHub()
+	hub.LimitQueues(1, SlowClientDrop)
+	go hub.Run()
+	client := connectFakeClient(hub, "a@example.com")
+
+	// The queue holds one message; the rest are dropped
+	for i := 0; i < 3; i++ {
+		hub.PublishBoard("a@example.com", WebSocketMessage{Type: "sync"}, nil)
+	}
+	stats := hub.Stats()
+	if stats.MessagesDropped < 2 {
+		t.Errorf("dropped %d messages, want at least 2", stats.MessagesDropped)
+	}
+	if isClosed(client) || stats.Connections != 1 || stats.SlowClientsClosed != 0 {
+		t.Errorf("slow client was disconnected under the drop policy: %+v", stats)
+	}
+}
+
+func TestHubSlowClientDisconnect(t *testing.T) {
+	hub := NewHub()
+	hub.LimitQueues(1, SlowClientDisconnect)
+	go hub.Run()
+	client := connectFakeClient(hub, "a@example.com")
+
+	for i := 0; i < 3; i++ {
+		hub.PublishBoard("a@example.com", WebSocketMessage{Type: "sync"}, nil)
+	}
+	if stats := hub.Stats(); stats.SlowClientsClosed != 1 {
+		t.Errorf("slow clients closed = %d, want 1", stats.SlowClientsClosed)
+	}
+	if !isClosed(client) {
+		t.Fatal("slow client wasn't closed")
+	}
+	if client.closeCode != 1013 {
+		t.Errorf("close code = %d, want 1013", client.closeCode)
+	}
+	if client.Context().Err() == nil {
+		t.Error("closed client's context wasn't canceled")
+	}
+}
+
+func TestHubLimitConnectionsEvictsIdlest(t *testing.T) {
+	hub := NewHub()
+	hub.LimitConnections(2)
+	go hub.Run()
+
+	idle := connectFakeClient(hub, "a@example.com")
+	idle.lastActive.Store(time.Now().Add(-time.Hour).UnixNano())
+	active := connectFakeClient(hub, "a@example.com")
+	connectFakeClient(hub, "a@example.com")
+
+	if stats := hub.Stats(); stats.Connections != 2 {
+		t.Errorf("connections = %d, want 2", stats.Connections)
+	}
+	if !isClosed(idle) || idle.closeCode != closeTooManyConnections {
+		t.Errorf("idlest connection wasn't closed with %d", closeTooManyConnections)
+	}
+	if isClosed(active) {
+		t.Error("active connection was closed")
+	}
+}
+
+func TestHubDisconnectRevokesUser(t *testing.T) {
+	hub := newTestHub(t)
+	revoked := connectFakeClient(hub, "a@example.com")
+	other := connectFakeClient(hub, "b@example.com")
+
+	hub.Disconnect("a@example.com")
+	if stats := hub.Stats(); stats.Connections != 1 {
+		t.Errorf("connections = %d, want 1", stats.Connections)
+	}
+	if !isClosed(revoked) || revoked.closeCode != closeSessionRevoked {
+		t.Errorf("revoked user's connection wasn't closed with %d", closeSessionRevoked)
+	}
+	if isClosed(other) {
+		t.Error("another user's connection was closed")
+	}
+}
+
+func TestHubShutdownClosesClients(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	clients := []*Client{connectFakeClient(hub, "a@example.com"), connectFakeClient(hub, "b@example.com")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := hub.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	for _, client := range clients {
+		if !isClosed(client) {
+			t.Errorf("client %s wasn't closed", client.email)
+		}
+	}
+
+	// Clients connecting afterwards are turned away
+	late := connectFakeClient(hub, "c@example.com")
+	if stats := hub.Stats(); !isClosed(late) || stats.Connections != 0 {
+		t.Errorf("client connected after shutdown: %+v", stats)
+	}
+}
+
+// benchmarkFanOut publishes to boards round-robin, each watched by
+// perBoard clients, and times until every watcher has the message
+func benchmarkFanOut(b *testing.B, boards, perBoard int) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Shutdown(context.Background())
+
+	// Board messages carry an event ID; presence updates don't
+	received := make(chan struct{}, perBoard)
+	names := make([]string, boards)
+	for i := range names {
+		names[i] = fmt.Sprintf("user%d@example.com", i)
+		for j := 0; j < perBoard; j++ {
+			client := connectFakeClient(hub, names[i])
+			go func() {
+				for {
+					select {
+					case out := <-client.send:
+						if out.id != 0 {
+							received <- struct{}{}
+						}
+					case <-client.done:
+						return
+					}
+				}
+			}()
+		}
+	}
+	hub.Stats()
+
+	message := WebSocketMessage{Type: "sync", Data: testBoard()}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hub.PublishBoard(names[i%boards], message, nil)
+		for j := 0; j < perBoard; j++ {
+			<-received
+		}
+	}
+	b.StopTimer()
+
+	if stats := hub.Stats(); stats.MessagesDropped > 0 {
+		b.Errorf("%d messages dropped", stats.MessagesDropped)
+	}
+}
+
+func BenchmarkHubFanOut(b *testing.B) {
+	for _, perBoard := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("clients=%d", perBoard), func(b *testing.B) {
+			benchmarkFanOut(b, 1, perBoard)
+		})
+	}
+	// Many boards: a publish should only cost its own board's clients
+	b.Run("boards=100/clients=10", func(b *testing.B) {
+		benchmarkFanOut(b, 100, 10)
+	})
+}
+
+// BenchmarkHubPublishParallel measures how many board messages the hub's
+// Run loop takes in when many goroutines publish at once
+func BenchmarkHubPublishParallel(b *testing.B) {
+	hub := NewHub()
+	hub.LimitQueues(1, SlowClientDrop)
+	go hub.Run()
+	defer hub.Shutdown(context.Background())
+	for i := 0; i < 100; i++ {
+		connectFakeClient(hub, fmt.Sprintf("user%d@example.com", i))
+	}
+
+	message := WebSocketMessage{Type: "sync", Data: testBoard()}
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		board := fmt.Sprintf("user%d@example.com", next.Add(1)%100)
+		for pb.Next() {
+			hub.PublishBoard(board, message, nil)
+		}
+	})
+}
+
+// connectDeliveryClient registers a fake client that resumes a delivery
+// session, and returns it with the session message it was sent
+func connectDeliveryClient(t testing.TB, hub *Hub, email, session string, after uint64) (*Client, SessionPayload) {
+	t.Helper()
+	client := NewClient(hub, nil, email)
+	client.ResumeDelivery(session, after)
+	hub.Register(client)
+	go func() {
+		<-client.done
+		hub.pumps.Done()
+	}()
+
+	var payload SessionPayload
+	if err := decodeMessageData(receive(t, client, "session"), &payload); err != nil {
+		t.Fatalf("decoding session message: %v", err)
+	}
+	return client, payload
+}
+
+// receiveSeqs returns the seqs of the next n messages of the given type
+// queued for a client
+func receiveSeqs(t testing.TB, client *Client, messageType string, n int) []uint64 {
+	t.Helper()
+	var seqs []uint64
+	timeout := time.After(2 * time.Second)
+	for len(seqs) < n {
+		select {
+		case out := <-client.send:
+			var message struct {
+				Type string
+				Seq  uint64
+			}
+			if err := json.Unmarshal(out.payload, &message); err != nil {
+				t.Fatalf("decoding queued message: %v", err)
+			}
+			if message.Type == messageType {
+				seqs = append(seqs, message.Seq)
+			}
+		case <-timeout:
+			t.Fatalf("got %d %q messages for %s, want %d", len(seqs), messageType, client.email, n)
+		}
+	}
+	return seqs
+}
+
+func TestHubResumesDeliverySession(t *testing.T) {
+	hub := newTestHub(t)
+	client, session := connectDeliveryClient(t, hub, "a@example.com", "", 0)
+	if session.ID == "" || session.Resumed {
+		t.Fatalf("session = %+v, want a new one", session)
+	}
+
+	hub.PublishBoard("a@example.com", WebSocketMessage{Type: "sync"}, nil)
+	hub.PublishBoard("a@example.com", WebSocketMessage{Type: "sync"}, nil)
+	if seqs := receiveSeqs(t, client, "sync", 2); seqs[0] != 1 || seqs[1] != 2 {
+		t.Fatalf("seqs = %v, want [1 2]", seqs)
+	}
+	hub.dispatch(client, WebSocketMessage{Type: "ack", Data: AckPayload{Seq: 1}}, 32)
+
+	// The second message is lost with the connection, and a third is
+	// published while the client is away
+	hub.Unregister(client)
+	hub.PublishBoard("a@example.com", WebSocketMessage{Type: "sync"}, nil)
+
+	resumed, again := connectDeliveryClient(t, hub, "a@example.com", session.ID, 1)
+	if again.ID != session.ID || !again.Resumed || again.Missed {
+		t.Fatalf("session on reconnect = %+v, want %s resumed with nothing missed", again, session.ID)
+	}
+	if seqs := receiveSeqs(t, resumed, "sync", 2); seqs[0] != 2 || seqs[1] != 3 {
+		t.Errorf("replayed seqs = %v, want [2 3]", seqs)
+	}
+	if stats := hub.Stats(); stats.Sessions != 1 || stats.MessagesReplayed != 2 {
+		t.Errorf("stats = %+v, want 1 session and 2 messages replayed", stats)
+	}
+}
+
+func TestHubResumeReportsMissedMessages(t *testing.T) {
+	hub := newTestHub(t)
+	client, session := connectDeliveryClient(t, hub, "a@example.com", "", 0)
+	hub.Unregister(client)
+
+	// More than the hub's history holds
+	for i := 0; i <= eventHistorySize; i++ {
+		hub.PublishBoard("a@example.com", WebSocketMessage{Type: "sync"}, nil)
+	}
+
+	_, again := connectDeliveryClient(t, hub, "a@example.com", session.ID, 0)
+	if !again.Resumed || !again.Missed {
+		t.Errorf("session on reconnect = %+v, want resumed with messages missed", again)
+	}
+}
+
+func TestHubDeliverySessionBelongsToItsUser(t *testing.T) {
+	hub := newTestHub(t)
+	client, session := connectDeliveryClient(t, hub, "a@example.com", "", 0)
+
+	// Neither a session in use nor another user's can be resumed
+	_, inUse := connectDeliveryClient(t, hub, "a@example.com", session.ID, 0)
+	hub.Unregister(client)
+	_, stranger := connectDeliveryClient(t, hub, "b@example.com", session.ID, 0)
+	for _, got := range []SessionPayload{inUse, stranger} {
+		if got.Resumed || got.ID == session.ID {
+			t.Errorf("session = %+v, want a new one", got)
+		}
+	}
+}
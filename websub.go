@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// websubTopicPath prefixes board topic URLs; the rest of the path is the
+// board's secret topic token
+const websubTopicPath = "/api/websub/topics/"
+
+// websubHubPath is the hub endpoint subscribers post to
+const websubHubPath = "/api/websub/hub"
+
+// Subscription leases, in seconds, when a subscriber doesn't ask for one and
+// the longest granted
+const (
+	websubDefaultLease = 10 * 24 * 60 * 60
+	websubMaxLease     = 30 * 24 * 60 * 60
+)
+
+// websubMaxSecret is the longest hub.secret accepted, as the spec requires
+const websubMaxSecret = 200
+
+// websubDebounce delays pings after a save so bursts of edits send one
+const websubDebounce = 2 * time.Second
+
+// websubClient makes verification and content delivery requests
+var websubClient = &http.Client{Timeout: 15 * time.Second}
+
+// WebSubPing is the content delivered to subscribers, and served at the
+// topic URL: a notice that the board changed, not the board itself
+type WebSubPing struct {
+	Topic     string    `json:"topic"`
+	Version   int64     `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// websubSubscription is a verified subscriber of a board's topic
+type websubSubscription struct {
+	Callback string
+	Topic    string
+	Secret   string
+}
+
+// hubURLForTopic returns the hub URL on the same host as a topic URL
+func hubURLForTopic(topic string) string {
+	u, err := url.Parse(topic)
+	if err != nil {
+		return websubHubPath
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: websubHubPath}).String()
+}
+
+// setWebSubLinks adds the discovery Link headers for a topic
+func setWebSubLinks(header http.Header, topic string) {
+	header.Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, hubURLForTopic(topic)))
+	header.Add("Link", fmt.Sprintf(`<%s>; rel="self"`, topic))
+}
+
+// WebSubService is a WebSub hub for board change notifications. Each
+// board's topic URL carries a secret token, so knowing it grants the right
+// to subscribe.
+type WebSubService struct {
+	db          *DB
+	dataService *DataService
+	authService *AuthService
+	jobs        *JobQueue
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+}
+
+func NewWebSubService(db *DB, dataService *DataService, authService *AuthService, jobs *JobQueue) *WebSubService {
+	s := &WebSubService{
+		db:          db,
+		dataService: dataService,
+		authService: authService,
+		jobs:        jobs,
+		pending:     make(map[string]*time.Timer),
+	}
+	dataService.OnSave(s.schedulePublish)
+	return s
+}
+
+// RotateToken creates a new topic token for a user. The old topic stops
+// working and its subscriptions are dropped.
+func (s *WebSubService) RotateToken(email string) (string, error) {
+	token, err := s.authService.generateSecureToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	if err := ensureUser(s.db, email); err != nil {
+		return "", err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO websub_tokens (email, token, created_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(email) DO UPDATE SET
+			token = excluded.token,
+			created_at = CURRENT_TIMESTAMP
+	`, email, token)
+	if err != nil {
+		return "", fmt.Errorf("failed to store WebSub token: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM websub_subscriptions WHERE email = ?", email); err != nil {
+		return "", fmt.Errorf("failed to drop WebSub subscriptions: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return token, nil
+}
+
+// EmailForToken returns the user owning a topic token
+func (s *WebSubService) EmailForToken(token string) (string, error) {
+	var email string
+	err := s.db.QueryRow("SELECT email FROM websub_tokens WHERE token = ?", token).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("unknown topic")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query WebSub token: %w", err)
+	}
+	return email, nil
+}
+
+// emailForTopic resolves a topic URL to the board's owner
+func (s *WebSubService) emailForTopic(topic string) (string, error) {
+	u, err := url.Parse(topic)
+	if err != nil || !u.IsAbs() || !strings.HasPrefix(u.Path, websubTopicPath) {
+		return "", fmt.Errorf("unknown topic")
+	}
+	return s.EmailForToken(strings.TrimPrefix(u.Path, websubTopicPath))
+}
+
+// Ping describes the current state of a user's board
+func (s *WebSubService) Ping(ctx context.Context, email, topic string) (*WebSubPing, error) {
+	data, err := s.dataService.GetUserData(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	return &WebSubPing{Topic: topic, Version: data.Version, UpdatedAt: time.Now().UTC()}, nil
+}
+
+// verifyIntent confirms a (un)subscription request with the subscriber by
+// asking its callback to echo a challenge
+func (s *WebSubService) verifyIntent(ctx context.Context, mode, topic, callback string, lease int) error {
+	challenge, err := s.authService.generateSecureToken(16)
+	if err != nil {
+		return fmt.Errorf("failed to generate challenge: %w", err)
+	}
+
+	u, err := url.Parse(callback)
+	if err != nil {
+		return fmt.Errorf("invalid callback: %w", err)
+	}
+	query := u.Query()
+	query.Set("hub.mode", mode)
+	query.Set("hub.topic", topic)
+	query.Set("hub.challenge", challenge)
+	if mode == "subscribe" {
+		query.Set("hub.lease_seconds", strconv.Itoa(lease))
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	resp, err := websubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 || strings.TrimSpace(string(body)) != challenge {
+		return fmt.Errorf("callback didn't confirm %s (%s)", mode, resp.Status)
+	}
+	return nil
+}
+
+// Subscribe verifies intent and then stores or renews a subscription
+func (s *WebSubService) Subscribe(ctx context.Context, email, topic, callback, secret string, lease int) error {
+	if err := s.verifyIntent(ctx, "subscribe", topic, callback, lease); err != nil {
+		return err
+	}
+
+	expires := time.Now().UTC().Add(time.Duration(lease) * time.Second)
+	_, err := s.db.Exec(`
+		INSERT INTO websub_subscriptions (email, callback, topic, secret, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(email, callback) DO UPDATE SET
+			topic = excluded.topic,
+			secret = excluded.secret,
+			expires_at = excluded.expires_at
+	`, email, callback, topic, secret, expires)
+	if err != nil {
+		return fmt.Errorf("failed to store WebSub subscription: %w", err)
+	}
+	return nil
+}
+
+// Unsubscribe verifies intent and then removes a subscription
+func (s *WebSubService) Unsubscribe(ctx context.Context, email, topic, callback string) error {
+	if err := s.verifyIntent(ctx, "unsubscribe", topic, callback, 0); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec("DELETE FROM websub_subscriptions WHERE email = ? AND callback = ?", email, callback); err != nil {
+		return fmt.Errorf("failed to delete WebSub subscription: %w", err)
+	}
+	return nil
+}
+
+// subscriptions returns a board's live subscriptions, dropping expired ones
+func (s *WebSubService) subscriptions(email string) ([]websubSubscription, error) {
+	now := time.Now().UTC()
+	if _, err := s.db.Exec("DELETE FROM websub_subscriptions WHERE email = ? AND expires_at <= ?", email, now); err != nil {
+		return nil, fmt.Errorf("failed to expire WebSub subscriptions: %w", err)
+	}
+
+	rows, err := s.db.Query("SELECT callback, topic, secret FROM websub_subscriptions WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query WebSub subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subs []websubSubscription
+	for rows.Next() {
+		var sub websubSubscription
+		if err := rows.Scan(&sub.Callback, &sub.Topic, &sub.Secret); err != nil {
+			return nil, fmt.Errorf("failed to scan WebSub subscription: %w", err)
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// schedulePublish queues a debounced ping of a board's subscribers after
+// a save
+func (s *WebSubService) schedulePublish(email string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if timer, ok := s.pending[email]; ok {
+		timer.Reset(websubDebounce)
+		return
+	}
+	s.pending[email] = time.AfterFunc(websubDebounce, func() {
+		s.mu.Lock()
+		delete(s.pending, email)
+		s.mu.Unlock()
+
+		if err := s.publish(email); err != nil {
+			log.Printf("Error publishing WebSub ping for %s: %v", email, err)
+		}
+	})
+}
+
+// publish queues delivery of a ping to each of a board's subscribers
+func (s *WebSubService) publish(email string) error {
+	subs, err := s.subscriptions(email)
+	if err != nil || len(subs) == 0 {
+		return err
+	}
+
+	for _, sub := range subs {
+		sub := sub
+		ping, err := s.Ping(context.Background(), email, sub.Topic)
+		if err != nil {
+			return err
+		}
+		content, err := json.Marshal(ping)
+		if err != nil {
+			return fmt.Errorf("failed to marshal ping: %w", err)
+		}
+
+		err = s.jobs.Enqueue(Job{
+			Name:        "websub:" + sub.Callback,
+			MaxAttempts: 3,
+			Run: func(ctx context.Context) error {
+				return s.deliver(ctx, email, sub, content)
+			},
+		})
+		if err != nil {
+			log.Printf("Error queueing WebSub delivery to %s: %v", sub.Callback, err)
+		}
+	}
+	return nil
+}
+
+// deliver posts content to a subscriber, signing it when the subscriber
+// gave a secret. A 410 Gone ends the subscription.
+func (s *WebSubService) deliver(ctx context.Context, email string, sub websubSubscription, content []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Callback, bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setWebSubLinks(req.Header, sub.Topic)
+	if sub.Secret != "" {
+		req.Header.Set("X-Hub-Signature", signPayload(sub.Secret, content))
+	}
+
+	resp, err := websubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		_, err := s.db.Exec("DELETE FROM websub_subscriptions WHERE email = ? AND callback = ?", email, sub.Callback)
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("subscriber returned %s", resp.Status)
+	}
+	return nil
+}
+
+// WebSubHandler serves the hub, the topics and topic token management
+type WebSubHandler struct {
+	websubService *WebSubService
+	jobs          *JobQueue
+}
+
+func NewWebSubHandler(websubService *WebSubService, jobs *JobQueue) *WebSubHandler {
+	return &WebSubHandler{websubService: websubService, jobs: jobs}
+}
+
+// topicURL returns the topic URL for a token as seen by this request
+func topicURL(r *http.Request, token string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s%s", scheme, r.Host, websubTopicPath, token)
+}
+
+// CreateToken issues the board's topic URL, replacing any previous one
+func (h *WebSubHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	token, err := h.websubService.RotateToken(requestEmail(r))
+	if err != nil {
+		log.Printf("Error rotating WebSub token: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to create topic")
+		return
+	}
+
+	topic := topicURL(r, token)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+		"topic":  topic,
+		"hub":    hubURLForTopic(topic),
+	})
+}
+
+// Topic serves a board's current ping with the hub discovery links
+func (h *WebSubHandler) Topic(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	email, err := h.websubService.EmailForToken(token)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Topic not found")
+		return
+	}
+
+	topic := topicURL(r, token)
+	ping, err := h.websubService.Ping(r.Context(), email, topic)
+	if err != nil {
+		log.Printf("Error building WebSub ping: %v", err)
+		writeServerError(w, err, "Server error")
+		return
+	}
+
+	setWebSubLinks(w.Header(), topic)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ping)
+}
+
+// Hub accepts subscription requests. They're checked here and verified with
+// the subscriber in the background, as the spec requires.
+func (h *WebSubHandler) Hub(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid form")
+		return
+	}
+	mode := r.PostForm.Get("hub.mode")
+	topic := r.PostForm.Get("hub.topic")
+	callback := r.PostForm.Get("hub.callback")
+	secret := r.PostForm.Get("hub.secret")
+
+	if mode != "subscribe" && mode != "unsubscribe" {
+		writeError(w, http.StatusBadRequest, "hub.mode must be subscribe or unsubscribe")
+		return
+	}
+	if err := validateWebhookURL(callback); err != nil {
+		writeError(w, http.StatusBadRequest, "hub.callback must be an absolute http or https URL")
+		return
+	}
+	if len(secret) > websubMaxSecret {
+		writeError(w, http.StatusBadRequest, "hub.secret is too long")
+		return
+	}
+	email, err := h.websubService.emailForTopic(topic)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "hub.topic is not a topic of this hub")
+		return
+	}
+
+	lease := websubDefaultLease
+	if raw := r.PostForm.Get("hub.lease_seconds"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			lease = min(n, websubMaxLease)
+		}
+	}
+
+	err = h.jobs.Enqueue(Job{
+		Name: "websub-" + mode + ":" + callback,
+		Run: func(ctx context.Context) error {
+			var err error
+			if mode == "subscribe" {
+				err = h.websubService.Subscribe(ctx, email, topic, callback, secret, lease)
+			} else {
+				err = h.websubService.Unsubscribe(ctx, email, topic, callback)
+			}
+			if err != nil {
+				log.Printf("WebSub %s of %s not verified: %v", mode, callback, err)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		log.Printf("Error queueing WebSub verification: %v", err)
+		writeError(w, http.StatusServiceUnavailable, "Hub is busy, try again later")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
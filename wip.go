@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// WIPLimitError reports a change that would put more tasks in a column than
+// its WIP limit allows
+type WIPLimitError struct {
+	ColumnID string `json:"columnId"`
+	Title    string `json:"title"`
+	Limit    int    `json:"limit"`
+	Count    int    `json:"count"`
+}
+
+func (e *WIPLimitError) Error() string {
+	return fmt.Sprintf("column %q is full (WIP limit %d)", e.Title, e.Limit)
+}
+
+// columnTaskCounts counts the live, visible tasks in each column
+func columnTaskCounts(data *KanbanData) map[string]int {
+	counts := make(map[string]int)
+	for _, task := range data.Tasks {
+		if task.Deleted || task.Hidden || task.ColumnID == nil {
+			continue
+		}
+		counts[*task.ColumnID]++
+	}
+	return counts
+}
+
+// checkWIPLimit returns a *WIPLimitError if one more task would exceed the
+// column's limit. A limit of 0 means unlimited.
+func checkWIPLimit(data *KanbanData, columnID string) error {
+	i := findColumn(data, columnID)
+	if i < 0 || data.Columns[i].WIPLimit <= 0 {
+		return nil
+	}
+
+	col := data.Columns[i]
+	count := columnTaskCounts(data)[columnID]
+	if count < col.WIPLimit {
+		return nil
+	}
+	return &WIPLimitError{ColumnID: col.ID, Title: col.Title, Limit: col.WIPLimit, Count: count}
+}
+
+// findWIPLimitViolations reports columns in merged that are over their
+// limit and gained tasks relative to the previously stored server data.
+// Columns that were already over their limit and didn't grow are left
+// alone, so lowering a limit doesn't flag every sync.
+func findWIPLimitViolations(serverData *KanbanData, merged *KanbanData) []WIPLimitError {
+	before := columnTaskCounts(serverData)
+	after := columnTaskCounts(merged)
+
+	violations := []WIPLimitError{}
+	for _, col := range merged.Columns {
+		if col.Deleted || col.WIPLimit <= 0 {
+			continue
+		}
+		if count := after[col.ID]; count > col.WIPLimit && count > before[col.ID] {
+			violations = append(violations, WIPLimitError{ColumnID: col.ID, Title: col.Title, Limit: col.WIPLimit, Count: count})
+		}
+	}
+	return violations
+}
+
+// writeWIPLimitExceeded responds with a structured 409 error
+func writeWIPLimitExceeded(w http.ResponseWriter, wipErr *WIPLimitError) {
+	writeErrorBody(w, http.StatusConflict, "wip_limit_exceeded", wipErr.Error(), map[string]any{
+		"wipLimit": wipErr,
+	})
+}
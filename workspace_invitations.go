@@ -0,0 +1,308 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Workspace invitations:
+//
+//	GET    /api/workspaces/{id}/invitations                 pending ones
+//	POST   /api/workspaces/{id}/invitations                 {"email": ..., "role": ...}
+//	DELETE /api/workspaces/{id}/invitations/{invitationId}
+//	POST   /api/workspaces/invitations/accept               {"token": ...}
+//
+// Admins invite by address. The invitee gets a link to
+// /?workspace-invite=<token>, and following it while signed in with that
+// address joins them with the invited role. Like share links, only a hash
+// of the token is stored. Inviting an address again replaces its pending
+// invitation.
+
+const (
+	// workspaceInvitationPrefix starts every invitation token
+	workspaceInvitationPrefix = "tdw_"
+
+	// workspaceInvitationTTL is how long an invitation can be accepted
+	workspaceInvitationTTL = 7 * 24 * time.Hour
+)
+
+var (
+	errInvitationNotFound = errors.New("invitation not found or expired")
+
+	// errInvitationEmail is returned when an invitation is accepted by
+	// someone signed in with a different address
+	errInvitationEmail = errors.New("this invitation is for another address")
+
+	// errAlreadyMember is returned when inviting a member
+	errAlreadyMember = errors.New("already a member of this workspace")
+)
+
+// WorkspaceInvitation is an invitation to join a workspace. The URL is only
+// returned when it's created.
+type WorkspaceInvitation struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invitedBy"`
+	URL       string    `json:"url,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Invite creates an invitation to a workspace on behalf of inviter, who
+// holds inviterRole, and emails the link to the invitee. The email is in
+// the invitee's language if they have one, or else locale (the request's).
+func (s *WorkspaceService) Invite(id, inviter, inviterRole, email, role, baseURL, locale string) (*WorkspaceInvitation, error) {
+	if role == WorkspaceRoleOwner && inviterRole != WorkspaceRoleOwner {
+		return nil, errOwnerRole
+	}
+	ws, err := s.Get(inviter, id)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := s.Role(email, id)
+	if err != nil {
+		return nil, err
+	}
+	if existing != "" {
+		return nil, errAlreadyMember
+	}
+
+	secret, err := s.authService.generateSecureToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate invitation token: %w", err)
+	}
+	token := workspaceInvitationPrefix + secret
+	now := time.Now().UTC()
+	invitation := &WorkspaceInvitation{
+		ID:        generateID(),
+		Email:     email,
+		Role:      role,
+		InvitedBy: inviter,
+		URL:       baseURL + "/?workspace-invite=" + token,
+		ExpiresAt: now.Add(workspaceInvitationTTL),
+		CreatedAt: now,
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM workspace_invitations WHERE workspace_id = ? AND email = ?", id, email); err != nil {
+		return nil, fmt.Errorf("failed to replace invitation: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO workspace_invitations (id, workspace_id, email, role, token_hash, invited_by, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, invitation.ID, id, email, role, hashAPIKey(token), inviter, invitation.ExpiresAt, invitation.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store invitation: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if s.authService.EmailEnabled() {
+		locale = s.authService.EmailLocale(email, locale)
+		subject := translate(locale, "%s invited you to %s", inviter, ws.Name)
+		body := translate(locale, "%s invited you to join the %s workspace on %s as %s.\n\nTo accept, sign in as %s and open the link below:\n\n%s\n\nThe invitation expires in 7 days.", inviter, ws.Name, s.authService.branding.AppName, translate(locale, role), email, invitation.URL)
+		if err := s.authService.SendEmail(email, locale, subject, body); err != nil {
+			return nil, err
+		}
+	}
+	return invitation, nil
+}
+
+// Invitations returns a workspace's pending invitations, newest first
+func (s *WorkspaceService) Invitations(id string) ([]WorkspaceInvitation, error) {
+	rows, err := s.db.Query(`
+		SELECT id, email, role, invited_by, expires_at, created_at
+		FROM workspace_invitations WHERE workspace_id = ? AND expires_at > ?
+		ORDER BY created_at DESC, id
+	`, id, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query invitations: %w", err)
+	}
+	defer rows.Close()
+
+	invitations := []WorkspaceInvitation{}
+	for rows.Next() {
+		var inv WorkspaceInvitation
+		if err := rows.Scan(&inv.ID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.ExpiresAt, &inv.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan invitation: %w", err)
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// RevokeInvitation deletes a pending invitation
+func (s *WorkspaceService) RevokeInvitation(id, invitationID string) error {
+	res, err := s.db.Exec("DELETE FROM workspace_invitations WHERE id = ? AND workspace_id = ?", invitationID, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete invitation: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errInvitationNotFound
+	}
+	return nil
+}
+
+// AcceptInvitation joins the user to the workspace an invitation for their
+// address is for, and returns the workspace
+func (s *WorkspaceService) AcceptInvitation(email, token string) (*Workspace, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id, workspaceID, invited, role string
+	err = tx.QueryRow(`
+		SELECT id, workspace_id, email, role FROM workspace_invitations
+		WHERE token_hash = ? AND expires_at > ?
+	`, hashAPIKey(token), time.Now().UTC()).Scan(&id, &workspaceID, &invited, &role)
+	if err == sql.ErrNoRows {
+		return nil, errInvitationNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query invitation: %w", err)
+	}
+	if !strings.EqualFold(invited, email) {
+		return nil, errInvitationEmail
+	}
+
+	if err := ensureUser(tx, email); err != nil {
+		return nil, err
+	}
+	// Someone invited twice over keeps the role they joined with
+	_, err = tx.Exec(`
+		INSERT INTO workspace_members (workspace_id, email, role, joined_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(workspace_id, email) DO NOTHING
+	`, workspaceID, email, role, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert workspace member: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM workspace_invitations WHERE id = ?", id); err != nil {
+		return nil, fmt.Errorf("failed to delete invitation: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return s.Get(email, workspaceID)
+}
+
+// Invitations lists the workspace's pending invitations
+func (h *WorkspaceHandler) Invitations(w http.ResponseWriter, r *http.Request) {
+	invitations, err := h.workspaceService.Invitations(mux.Vars(r)["id"])
+	if err != nil {
+		writeWorkspaceError(w, err, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":      "success",
+		"invitations": invitations,
+	})
+}
+
+// Invite emails an invitation to the workspace. Without SMTP the response
+// carries the link, like the login magic link.
+func (h *WorkspaceHandler) Invite(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Role == "" {
+		req.Role = WorkspaceRoleMember
+	}
+	var fieldErrors []FieldError
+	if req.Email == "" || !strings.Contains(req.Email, "@") {
+		fieldErrors = append(fieldErrors, FieldError{Field: "email", Message: "must be an email address"})
+	}
+	if !validWorkspaceRole(req.Role) {
+		fieldErrors = append(fieldErrors, invalidWorkspaceRole("role"))
+	}
+	if len(fieldErrors) > 0 {
+		writeFieldErrors(w, fieldErrors...)
+		return
+	}
+
+	actorRole, err := h.actorRole(r)
+	if err != nil {
+		writeWorkspaceError(w, err, "Server error")
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	invitation, err := h.workspaceService.Invite(mux.Vars(r)["id"], requestEmail(r), actorRole, req.Email, req.Role, fmt.Sprintf("%s://%s", scheme, r.Host), requestLocale(r))
+	if err != nil {
+		if err == errAlreadyMember || err == errOwnerRole || err == errWorkspaceNotFound {
+			writeWorkspaceError(w, err, "")
+			return
+		}
+		log.Printf("Error inviting to workspace: %v", err)
+		writeError(w, http.StatusInternalServerError, "Failed to send invitation")
+		return
+	}
+	if !h.workspaceService.authService.RevealLinks() {
+		invitation.URL = "" // Only the invitee gets the link
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     "success",
+		"invitation": invitation,
+	})
+}
+
+// RevokeInvitation deletes a pending invitation
+func (h *WorkspaceHandler) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := h.workspaceService.RevokeInvitation(vars["id"], vars["invitationId"]); err != nil {
+		writeWorkspaceError(w, err, "Failed to revoke invitation")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// AcceptInvitation joins the user to a workspace with an invitation token
+func (h *WorkspaceHandler) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	ws, err := h.workspaceService.AcceptInvitation(requestEmail(r), req.Token)
+	if err != nil {
+		writeWorkspaceError(w, err, "Failed to accept invitation")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":    "success",
+		"workspace": ws,
+	})
+}
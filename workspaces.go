@@ -0,0 +1,1002 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Workspaces let a team share boards and labels on one deployment:
+//
+//	GET    /api/workspaces                        the user's workspaces
+//	POST   /api/workspaces                        {"name": ...}
+//	GET    /api/workspaces/current                the workspace switched to
+//	PUT    /api/workspaces/current                {"id": ...}, "" for none
+//	GET    /api/workspaces/{id}                   with members, boards, labels
+//	PATCH  /api/workspaces/{id}                   {"name": ...}
+//	DELETE /api/workspaces/{id}
+//	PATCH  /api/workspaces/{id}/members/{email}   {"role": ...}
+//	DELETE /api/workspaces/{id}/members/{email}
+//	GET    /api/workspaces/{id}/boards
+//	POST   /api/workspaces/{id}/boards            {"name": ...}
+//	PATCH  /api/workspaces/{id}/boards/{boardId}  {"name": ...}
+//	DELETE /api/workspaces/{id}/boards/{boardId}
+//	GET    /api/workspaces/{id}/labels
+//	POST   /api/workspaces/{id}/labels            {"name": ..., "color": ...}
+//	DELETE /api/workspaces/{id}/labels/{name}
+//
+// Members hold one of four roles. Viewers can read the workspace's boards,
+// members can also edit them and add boards, admins manage members,
+// invitations, labels and boards and can share boards, and owners can also
+// make owners and delete the workspace. A workspace always keeps at least
+// one owner.
+//
+// A workspace board is stored like a user's own board, under its ID, so
+// everything that takes a board ID works with it: ?board= on
+// /api/data/get, /api/presence and /api/events, the WebSocket "board" of
+// subscribe, ops and resync, gRPC and share links. BoardRole gives members
+// their workspace role's access to it.
+//
+// Switching workspaces only records the user's choice, for clients to open
+// on; the user's own board stays theirs whichever workspace is current.
+
+// Workspace roles
+const (
+	WorkspaceRoleOwner  = "owner"
+	WorkspaceRoleAdmin  = "admin"
+	WorkspaceRoleMember = "member"
+	WorkspaceRoleViewer = "viewer"
+)
+
+// workspaceRoleRanks orders the roles, a role with a higher rank having
+// every permission of a lower one
+var workspaceRoleRanks = map[string]int{
+	WorkspaceRoleViewer: 1,
+	WorkspaceRoleMember: 2,
+	WorkspaceRoleAdmin:  3,
+	WorkspaceRoleOwner:  4,
+}
+
+// workspaceBoardRoles is the access each role gives to the workspace's
+// boards
+var workspaceBoardRoles = map[string]BoardRole{
+	WorkspaceRoleViewer: BoardRoleViewer,
+	WorkspaceRoleMember: BoardRoleEditor,
+	WorkspaceRoleAdmin:  BoardRoleOwner,
+	WorkspaceRoleOwner:  BoardRoleOwner,
+}
+
+// maxWorkspaceNameLength caps workspace, board and label names
+const maxWorkspaceNameLength = 100
+
+var (
+	errWorkspaceNotFound       = errors.New("workspace not found")
+	errWorkspaceBoardNotFound  = errors.New("workspace board not found")
+	errWorkspaceMemberNotFound = errors.New("workspace member not found")
+	errWorkspaceLabelNotFound  = errors.New("workspace label not found")
+	errWorkspaceLabelExists    = errors.New("a label with that name already exists")
+
+	// errLastOwner is returned when a change would leave a workspace
+	// without an owner
+	errLastOwner = errors.New("a workspace needs at least one owner")
+
+	// errOwnerRole is returned when someone other than an owner tries to
+	// make, change or remove an owner
+	errOwnerRole = errors.New("only owners can manage owners")
+)
+
+// Workspace is a team's shared space. Role is the requesting user's.
+type Workspace struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role,omitempty"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// WorkspaceMember is a user's membership of a workspace
+type WorkspaceMember struct {
+	Email    string    `json:"email"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// WorkspaceBoard is a board shared by a workspace's members. Its ID is the
+// board ID other APIs take.
+type WorkspaceBoard struct {
+	ID          string    `json:"id"`
+	WorkspaceID string    `json:"workspaceId"`
+	Name        string    `json:"name"`
+	CreatedBy   string    `json:"createdBy"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// WorkspaceLabel is a label every board of a workspace offers
+type WorkspaceLabel struct {
+	Name      string    `json:"name"`
+	Color     string    `json:"color,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// validWorkspaceRole reports whether role is one of the roles
+func validWorkspaceRole(role string) bool {
+	_, ok := workspaceRoleRanks[role]
+	return ok
+}
+
+// invalidWorkspaceRole describes a role that isn't one of the roles
+func invalidWorkspaceRole(field string) FieldError {
+	return FieldError{Field: field, Message: "must be owner, admin, member or viewer"}
+}
+
+// validateWorkspaceName checks a workspace, board or label name
+func validateWorkspaceName(name string) *FieldError {
+	if strings.TrimSpace(name) == "" {
+		return &FieldError{Field: "name", Message: "is required"}
+	}
+	if len(name) > maxWorkspaceNameLength {
+		return &FieldError{Field: "name", Message: fmt.Sprintf("is limited to %d characters", maxWorkspaceNameLength)}
+	}
+	return nil
+}
+
+// WorkspaceService stores workspaces, their members, boards and labels
+type WorkspaceService struct {
+	db          *DB
+	authService *AuthService
+	dataService *DataService
+	hub         *Hub
+}
+
+func NewWorkspaceService(db *DB, authService *AuthService, dataService *DataService, hub *Hub) *WorkspaceService {
+	return &WorkspaceService{db: db, authService: authService, dataService: dataService, hub: hub}
+}
+
+// Role returns a user's role in a workspace, or "" if they aren't a member
+func (s *WorkspaceService) Role(email, workspaceID string) (string, error) {
+	var role string
+	err := s.db.QueryRow("SELECT role FROM workspace_members WHERE workspace_id = ? AND email = ?", workspaceID, email).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query workspace member: %w", err)
+	}
+	return role, nil
+}
+
+// BoardRole resolves a user's role on a workspace board from their role in
+// its workspace. Boards that aren't a workspace's, and failed lookups, give
+// no access.
+func (s *WorkspaceService) BoardRole(email, boardID string) BoardRole {
+	var role string
+	err := s.db.QueryRow(`
+		SELECT m.role FROM workspace_boards b
+		JOIN workspace_members m ON m.workspace_id = b.workspace_id
+		WHERE b.id = ? AND m.email = ?
+	`, boardID, email).Scan(&role)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error resolving role on board %s: %v", boardID, err)
+		}
+		return BoardRoleNone
+	}
+	return workspaceBoardRoles[role]
+}
+
+// Require allows the request when the user holds at least min in the
+// workspace named by the route's {id}
+func (s *WorkspaceService) Require(min string) Policy {
+	return func(r *http.Request, email string) error {
+		role, err := s.Role(email, mux.Vars(r)["id"])
+		if err != nil {
+			return err
+		}
+		if workspaceRoleRanks[role] < workspaceRoleRanks[min] {
+			return errForbidden
+		}
+		return nil
+	}
+}
+
+// List returns the workspaces a user belongs to, by name
+func (s *WorkspaceService) List(email string) ([]Workspace, error) {
+	rows, err := s.db.Query(`
+		SELECT w.id, w.name, m.role, w.created_by, w.created_at
+		FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.email = ? ORDER BY w.name, w.id
+	`, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workspaces: %w", err)
+	}
+	defer rows.Close()
+
+	workspaces := []Workspace{}
+	for rows.Next() {
+		var ws Workspace
+		if err := rows.Scan(&ws.ID, &ws.Name, &ws.Role, &ws.CreatedBy, &ws.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan workspace: %w", err)
+		}
+		workspaces = append(workspaces, ws)
+	}
+	return workspaces, rows.Err()
+}
+
+// Get returns a workspace with the user's role in it
+func (s *WorkspaceService) Get(email, id string) (*Workspace, error) {
+	var ws Workspace
+	err := s.db.QueryRow(`
+		SELECT w.id, w.name, m.role, w.created_by, w.created_at
+		FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE w.id = ? AND m.email = ?
+	`, id, email).Scan(&ws.ID, &ws.Name, &ws.Role, &ws.CreatedBy, &ws.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errWorkspaceNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workspace: %w", err)
+	}
+	return &ws, nil
+}
+
+// Create makes a workspace owned by the user
+func (s *WorkspaceService) Create(email, name string) (*Workspace, error) {
+	ws := &Workspace{
+		ID:        generateID(),
+		Name:      strings.TrimSpace(name),
+		Role:      WorkspaceRoleOwner,
+		CreatedBy: email,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := ensureUser(tx, email); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("INSERT INTO workspaces (id, name, created_by, created_at) VALUES (?, ?, ?, ?)", ws.ID, ws.Name, email, ws.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert workspace: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO workspace_members (workspace_id, email, role, joined_at) VALUES (?, ?, ?, ?)
+	`, ws.ID, email, WorkspaceRoleOwner, ws.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert workspace member: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return ws, nil
+}
+
+// Rename changes a workspace's name
+func (s *WorkspaceService) Rename(id, name string) error {
+	res, err := s.db.Exec("UPDATE workspaces SET name = ? WHERE id = ?", strings.TrimSpace(name), id)
+	if err != nil {
+		return fmt.Errorf("failed to rename workspace: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errWorkspaceNotFound
+	}
+	return nil
+}
+
+// Delete removes a workspace with its boards, their data, its labels,
+// invitations and memberships, and closes its members' connections so
+// they drop its boards
+func (s *WorkspaceService) Delete(ctx context.Context, id string) error {
+	members, err := s.Members(id)
+	if err != nil {
+		return err
+	}
+	boards, err := s.Boards(id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, board := range boards {
+		if err := deleteAccountRows(tx, board.ID); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"workspace_boards", "workspace_labels", "workspace_invitations", "workspace_members"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE workspace_id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete from %s: %w", table, err)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM workspaces WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete workspace: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	for _, board := range boards {
+		s.dataService.cache.Invalidate(board.ID)
+	}
+	for _, member := range members {
+		s.hub.Disconnect(member.Email)
+	}
+	return nil
+}
+
+// Members returns a workspace's members, owners first
+func (s *WorkspaceService) Members(id string) ([]WorkspaceMember, error) {
+	rows, err := s.db.Query(`
+		SELECT email, role, joined_at FROM workspace_members WHERE workspace_id = ?
+		ORDER BY CASE role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 WHEN 'member' THEN 2 ELSE 3 END, email
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workspace members: %w", err)
+	}
+	defer rows.Close()
+
+	members := []WorkspaceMember{}
+	for rows.Next() {
+		var m WorkspaceMember
+		if err := rows.Scan(&m.Email, &m.Role, &m.JoinedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan workspace member: %w", err)
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// checkManageMember checks that someone with actorRole may change a
+// member's role from role to newRole ("" when removing them), and that
+// the workspace keeps an owner
+func (s *WorkspaceService) checkManageMember(tx *Tx, id, actorRole, role, newRole string) error {
+	if (role == WorkspaceRoleOwner || newRole == WorkspaceRoleOwner) && actorRole != WorkspaceRoleOwner {
+		return errOwnerRole
+	}
+	if role != WorkspaceRoleOwner || newRole == WorkspaceRoleOwner {
+		return nil
+	}
+
+	var owners int
+	err := tx.QueryRow("SELECT COUNT(*) FROM workspace_members WHERE workspace_id = ? AND role = ?", id, WorkspaceRoleOwner).Scan(&owners)
+	if err != nil {
+		return fmt.Errorf("failed to count workspace owners: %w", err)
+	}
+	if owners <= 1 {
+		return errLastOwner
+	}
+	return nil
+}
+
+// memberRole returns a member's role in the caller's transaction
+func memberRole(tx *Tx, id, email string) (string, error) {
+	var role string
+	err := tx.QueryRow("SELECT role FROM workspace_members WHERE workspace_id = ? AND email = ?", id, email).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", errWorkspaceMemberNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query workspace member: %w", err)
+	}
+	return role, nil
+}
+
+// SetRole changes a member's role on behalf of someone with actorRole
+func (s *WorkspaceService) SetRole(id, actorRole, email, role string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	current, err := memberRole(tx, id, email)
+	if err != nil {
+		return err
+	}
+	if err := s.checkManageMember(tx, id, actorRole, current, role); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE workspace_members SET role = ? WHERE workspace_id = ? AND email = ?", role, id, email)
+	if err != nil {
+		return fmt.Errorf("failed to update workspace member: %w", err)
+	}
+	return tx.Commit()
+}
+
+// RemoveMember takes someone out of a workspace on behalf of actor, who
+// holds actorRole. Anyone may leave; only admins and owners remove others.
+func (s *WorkspaceService) RemoveMember(id, actor, actorRole, email string) error {
+	if actor != email && workspaceRoleRanks[actorRole] < workspaceRoleRanks[WorkspaceRoleAdmin] {
+		return errForbidden
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	current, err := memberRole(tx, id, email)
+	if err != nil {
+		return err
+	}
+	if actor == email {
+		// Leaving doesn't need an owner's say, only another owner
+		actorRole = WorkspaceRoleOwner
+	}
+	if err := s.checkManageMember(tx, id, actorRole, current, ""); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM workspace_members WHERE workspace_id = ? AND email = ?", id, email); err != nil {
+		return fmt.Errorf("failed to delete workspace member: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// Their connections may be subscribed to the workspace's boards
+	s.hub.Disconnect(email)
+	return nil
+}
+
+// Current returns the workspace the user switched to, or nil if none (or
+// they've since left it)
+func (s *WorkspaceService) Current(email string) (*Workspace, error) {
+	var id string
+	err := s.db.QueryRow("SELECT current_workspace FROM users WHERE email = ?", email).Scan(&id)
+	if err == sql.ErrNoRows || (err == nil && id == "") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query current workspace: %w", err)
+	}
+	ws, err := s.Get(email, id)
+	if err == errWorkspaceNotFound {
+		return nil, nil
+	}
+	return ws, err
+}
+
+// Switch records the workspace the user works in, "" for none
+func (s *WorkspaceService) Switch(email, id string) (*Workspace, error) {
+	var ws *Workspace
+	if id != "" {
+		var err error
+		if ws, err = s.Get(email, id); err != nil {
+			return nil, err
+		}
+	}
+	if err := ensureUser(s.db, email); err != nil {
+		return nil, err
+	}
+	if _, err := s.db.Exec("UPDATE users SET current_workspace = ? WHERE email = ?", id, email); err != nil {
+		return nil, fmt.Errorf("failed to switch workspace: %w", err)
+	}
+	return ws, nil
+}
+
+// Boards returns a workspace's boards, oldest first
+func (s *WorkspaceService) Boards(id string) ([]WorkspaceBoard, error) {
+	rows, err := s.db.Query(`
+		SELECT id, workspace_id, name, created_by, created_at
+		FROM workspace_boards WHERE workspace_id = ? ORDER BY created_at, id
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workspace boards: %w", err)
+	}
+	defer rows.Close()
+
+	boards := []WorkspaceBoard{}
+	for rows.Next() {
+		var b WorkspaceBoard
+		if err := rows.Scan(&b.ID, &b.WorkspaceID, &b.Name, &b.CreatedBy, &b.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan workspace board: %w", err)
+		}
+		boards = append(boards, b)
+	}
+	return boards, rows.Err()
+}
+
+// CreateBoard adds an empty board to a workspace
+func (s *WorkspaceService) CreateBoard(id, email, name string) (*WorkspaceBoard, error) {
+	board := &WorkspaceBoard{
+		ID:          generateID(),
+		WorkspaceID: id,
+		Name:        strings.TrimSpace(name),
+		CreatedBy:   email,
+		CreatedAt:   time.Now().UTC(),
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO workspace_boards (id, workspace_id, name, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, board.ID, id, board.Name, email, board.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert workspace board: %w", err)
+	}
+	// The board's data hangs off a users row like a user's board does,
+	// marked as the workspace's so it isn't listed as a user
+	if _, err := tx.Exec("INSERT INTO users (email, workspace_id) VALUES (?, ?)", board.ID, id); err != nil {
+		return nil, fmt.Errorf("failed to insert board user: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return board, nil
+}
+
+// RenameBoard changes the name of a workspace's board
+func (s *WorkspaceService) RenameBoard(id, boardID, name string) error {
+	res, err := s.db.Exec("UPDATE workspace_boards SET name = ? WHERE id = ? AND workspace_id = ?", strings.TrimSpace(name), boardID, id)
+	if err != nil {
+		return fmt.Errorf("failed to rename workspace board: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errWorkspaceBoardNotFound
+	}
+	return nil
+}
+
+// DeleteBoard removes a workspace's board and everything stored for it
+func (s *WorkspaceService) DeleteBoard(ctx context.Context, id, boardID string) error {
+	tx, err := s.db.BeginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM workspace_boards WHERE id = ? AND workspace_id = ?", boardID, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete workspace board: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errWorkspaceBoardNotFound
+	}
+	if err := deleteAccountRows(tx, boardID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	s.dataService.cache.Invalidate(boardID)
+	return nil
+}
+
+// Labels returns a workspace's labels, by name
+func (s *WorkspaceService) Labels(id string) ([]WorkspaceLabel, error) {
+	rows, err := s.db.Query("SELECT name, color, created_at FROM workspace_labels WHERE workspace_id = ? ORDER BY name", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workspace labels: %w", err)
+	}
+	defer rows.Close()
+
+	labels := []WorkspaceLabel{}
+	for rows.Next() {
+		var l WorkspaceLabel
+		if err := rows.Scan(&l.Name, &l.Color, &l.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan workspace label: %w", err)
+		}
+		labels = append(labels, l)
+	}
+	return labels, rows.Err()
+}
+
+// CreateLabel adds a label to a workspace
+func (s *WorkspaceService) CreateLabel(id, name, color string) (*WorkspaceLabel, error) {
+	label := &WorkspaceLabel{Name: strings.TrimSpace(name), Color: color, CreatedAt: time.Now().UTC()}
+	res, err := s.db.Exec(`
+		INSERT INTO workspace_labels (workspace_id, name, color, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(workspace_id, name) DO NOTHING
+	`, id, label.Name, color, label.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert workspace label: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, errWorkspaceLabelExists
+	}
+	return label, nil
+}
+
+// DeleteLabel removes a label from a workspace. Tasks keep it until they're
+// edited.
+func (s *WorkspaceService) DeleteLabel(id, name string) error {
+	res, err := s.db.Exec("DELETE FROM workspace_labels WHERE workspace_id = ? AND name = ?", id, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete workspace label: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errWorkspaceLabelNotFound
+	}
+	return nil
+}
+
+// WorkspaceHandler exposes workspaces over HTTP
+type WorkspaceHandler struct {
+	workspaceService *WorkspaceService
+}
+
+func NewWorkspaceHandler(workspaceService *WorkspaceService) *WorkspaceHandler {
+	return &WorkspaceHandler{workspaceService: workspaceService}
+}
+
+// writeWorkspaceError answers a failed workspace request
+func writeWorkspaceError(w http.ResponseWriter, err error, message string) {
+	switch err {
+	case errWorkspaceNotFound, errWorkspaceBoardNotFound, errWorkspaceMemberNotFound, errWorkspaceLabelNotFound, errInvitationNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	case errLastOwner, errWorkspaceLabelExists, errAlreadyMember:
+		writeError(w, http.StatusConflict, err.Error())
+	case errOwnerRole, errForbidden, errInvitationEmail:
+		writeError(w, http.StatusForbidden, err.Error())
+	default:
+		log.Printf("Error in workspace request: %v", err)
+		writeServerError(w, err, message)
+	}
+}
+
+// actorRole returns the requester's role in the route's workspace, which
+// the route's policy has already checked
+func (h *WorkspaceHandler) actorRole(r *http.Request) (string, error) {
+	return h.workspaceService.Role(requestEmail(r), mux.Vars(r)["id"])
+}
+
+// decodeNameRequest reads a {"name": ...} body. On failure it writes the
+// error response and returns false.
+func decodeNameRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return "", false
+	}
+	if fieldErr := validateWorkspaceName(req.Name); fieldErr != nil {
+		writeFieldErrors(w, *fieldErr)
+		return "", false
+	}
+	return req.Name, true
+}
+
+// List returns the user's workspaces and the one they switched to
+func (h *WorkspaceHandler) List(w http.ResponseWriter, r *http.Request) {
+	email := requestEmail(r)
+	workspaces, err := h.workspaceService.List(email)
+	if err != nil {
+		writeWorkspaceError(w, err, "Server error")
+		return
+	}
+	current, err := h.workspaceService.Current(email)
+	if err != nil {
+		writeWorkspaceError(w, err, "Server error")
+		return
+	}
+	currentID := ""
+	if current != nil {
+		currentID = current.ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     "success",
+		"workspaces": workspaces,
+		"current":    currentID,
+	})
+}
+
+// Create makes a workspace owned by the user
+func (h *WorkspaceHandler) Create(w http.ResponseWriter, r *http.Request) {
+	name, ok := decodeNameRequest(w, r)
+	if !ok {
+		return
+	}
+	ws, err := h.workspaceService.Create(requestEmail(r), name)
+	if err != nil {
+		writeWorkspaceError(w, err, "Failed to create workspace")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":    "success",
+		"workspace": ws,
+	})
+}
+
+// Get returns a workspace with its members, boards and labels
+func (h *WorkspaceHandler) Get(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	ws, err := h.workspaceService.Get(requestEmail(r), id)
+	if err != nil {
+		writeWorkspaceError(w, err, "Server error")
+		return
+	}
+	h.writeWorkspace(w, ws)
+}
+
+// writeWorkspace responds with a workspace and its members, boards and
+// labels
+func (h *WorkspaceHandler) writeWorkspace(w http.ResponseWriter, ws *Workspace) {
+	members, err := h.workspaceService.Members(ws.ID)
+	if err != nil {
+		writeWorkspaceError(w, err, "Server error")
+		return
+	}
+	boards, err := h.workspaceService.Boards(ws.ID)
+	if err != nil {
+		writeWorkspaceError(w, err, "Server error")
+		return
+	}
+	labels, err := h.workspaceService.Labels(ws.ID)
+	if err != nil {
+		writeWorkspaceError(w, err, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":    "success",
+		"workspace": ws,
+		"members":   members,
+		"boards":    boards,
+		"labels":    labels,
+	})
+}
+
+// Rename changes a workspace's name
+func (h *WorkspaceHandler) Rename(w http.ResponseWriter, r *http.Request) {
+	name, ok := decodeNameRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := h.workspaceService.Rename(mux.Vars(r)["id"], name); err != nil {
+		writeWorkspaceError(w, err, "Failed to rename workspace")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Delete removes a workspace and its boards
+func (h *WorkspaceHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if err := h.workspaceService.Delete(r.Context(), mux.Vars(r)["id"]); err != nil {
+		writeWorkspaceError(w, err, "Failed to delete workspace")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Current returns the workspace the user switched to, with its members,
+// boards and labels, or a null workspace
+func (h *WorkspaceHandler) Current(w http.ResponseWriter, r *http.Request) {
+	ws, err := h.workspaceService.Current(requestEmail(r))
+	if err != nil {
+		writeWorkspaceError(w, err, "Server error")
+		return
+	}
+	if ws == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":    "success",
+			"workspace": nil,
+		})
+		return
+	}
+	h.writeWorkspace(w, ws)
+}
+
+// Switch records the workspace the user works in
+func (h *WorkspaceHandler) Switch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID string `json:"id"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	ws, err := h.workspaceService.Switch(requestEmail(r), req.ID)
+	if err != nil {
+		writeWorkspaceError(w, err, "Failed to switch workspace")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":    "success",
+		"workspace": ws,
+	})
+}
+
+// SetRole changes a member's role
+func (h *WorkspaceHandler) SetRole(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Role string `json:"role"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !validWorkspaceRole(req.Role) {
+		writeFieldErrors(w, invalidWorkspaceRole("role"))
+		return
+	}
+	actorRole, err := h.actorRole(r)
+	if err != nil {
+		writeWorkspaceError(w, err, "Server error")
+		return
+	}
+
+	vars := mux.Vars(r)
+	if err := h.workspaceService.SetRole(vars["id"], actorRole, vars["email"], req.Role); err != nil {
+		writeWorkspaceError(w, err, "Failed to change role")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// RemoveMember takes a member out of the workspace, or lets the user leave
+func (h *WorkspaceHandler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	actorRole, err := h.actorRole(r)
+	if err != nil {
+		writeWorkspaceError(w, err, "Server error")
+		return
+	}
+
+	vars := mux.Vars(r)
+	if err := h.workspaceService.RemoveMember(vars["id"], requestEmail(r), actorRole, vars["email"]); err != nil {
+		writeWorkspaceError(w, err, "Failed to remove member")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Boards lists the workspace's boards
+func (h *WorkspaceHandler) Boards(w http.ResponseWriter, r *http.Request) {
+	boards, err := h.workspaceService.Boards(mux.Vars(r)["id"])
+	if err != nil {
+		writeWorkspaceError(w, err, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"boards": boards,
+	})
+}
+
+// CreateBoard adds a board to the workspace
+func (h *WorkspaceHandler) CreateBoard(w http.ResponseWriter, r *http.Request) {
+	name, ok := decodeNameRequest(w, r)
+	if !ok {
+		return
+	}
+	board, err := h.workspaceService.CreateBoard(mux.Vars(r)["id"], requestEmail(r), name)
+	if err != nil {
+		writeWorkspaceError(w, err, "Failed to create board")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"board":  board,
+	})
+}
+
+// RenameBoard changes a board's name
+func (h *WorkspaceHandler) RenameBoard(w http.ResponseWriter, r *http.Request) {
+	name, ok := decodeNameRequest(w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	if err := h.workspaceService.RenameBoard(vars["id"], vars["boardId"], name); err != nil {
+		writeWorkspaceError(w, err, "Failed to rename board")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// DeleteBoard removes a board from the workspace
+func (h *WorkspaceHandler) DeleteBoard(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := h.workspaceService.DeleteBoard(r.Context(), vars["id"], vars["boardId"]); err != nil {
+		writeWorkspaceError(w, err, "Failed to delete board")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Labels lists the workspace's labels
+func (h *WorkspaceHandler) Labels(w http.ResponseWriter, r *http.Request) {
+	labels, err := h.workspaceService.Labels(mux.Vars(r)["id"])
+	if err != nil {
+		writeWorkspaceError(w, err, "Server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"labels": labels,
+	})
+}
+
+// CreateLabel adds a label to the workspace
+func (h *WorkspaceHandler) CreateLabel(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name  string `json:"name"`
+		Color string `json:"color"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var fieldErrors []FieldError
+	if fieldErr := validateWorkspaceName(req.Name); fieldErr != nil {
+		fieldErrors = append(fieldErrors, *fieldErr)
+	}
+	if req.Color != "" && !hexColorPattern.MatchString(req.Color) {
+		fieldErrors = append(fieldErrors, FieldError{Field: "color", Message: "must be a #rgb or #rrggbb hex color"})
+	}
+	if len(fieldErrors) > 0 {
+		writeFieldErrors(w, fieldErrors...)
+		return
+	}
+
+	label, err := h.workspaceService.CreateLabel(mux.Vars(r)["id"], req.Name, req.Color)
+	if err != nil {
+		writeWorkspaceError(w, err, "Failed to create label")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"label":  label,
+	})
+}
+
+// DeleteLabel removes a label from the workspace
+func (h *WorkspaceHandler) DeleteLabel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := h.workspaceService.DeleteLabel(vars["id"], vars["name"]); err != nil {
+		writeWorkspaceError(w, err, "Failed to delete label")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
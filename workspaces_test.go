@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWorkspaceBoardsFollowMembership(t *testing.T) {
+	app := newTestApp(t)
+	ws := app.workspaces
+	ctx := context.Background()
+	owner, member, outsider := "a@example.com", "b@example.com", "c@example.com"
+
+	workspace, err := ws.Create(owner, "Team")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	board, err := ws.CreateBoard(workspace.ID, owner, "Roadmap")
+	if err != nil {
+		t.Fatalf("CreateBoard: %v", err)
+	}
+	if err := app.dataService.SaveUserData(ctx, board.ID, testBoard()); err != nil {
+		t.Fatalf("SaveUserData: %v", err)
+	}
+
+	invitation, err := ws.Invite(workspace.ID, owner, WorkspaceRoleOwner, member, WorkspaceRoleMember, "http://localhost", "en")
+	if err != nil {
+		t.Fatalf("Invite: %v", err)
+	}
+	_, token, _ := strings.Cut(invitation.URL, "workspace-invite=")
+	if _, err := ws.AcceptInvitation(outsider, token); err != errInvitationEmail {
+		t.Errorf("accepting someone else's invitation: %v, want %v", err, errInvitationEmail)
+	}
+	joined, err := ws.AcceptInvitation(member, token)
+	if err != nil || joined.Role != WorkspaceRoleMember {
+		t.Fatalf("AcceptInvitation = %+v, %v, want membership", joined, err)
+	}
+	if _, err := ws.AcceptInvitation(member, token); err != errInvitationNotFound {
+		t.Errorf("accepting twice: %v, want %v", err, errInvitationNotFound)
+	}
+
+	// Members reach the board through the usual board APIs; others don't
+	if role := app.hub.BoardRole(member, board.ID); role != BoardRoleEditor {
+		t.Errorf("member's board role = %v, want editor", role)
+	}
+	rec := app.do(t, "GET", "/api/data/get?board="+board.ID, member, nil)
+	expectStatus(t, rec, http.StatusOK)
+	var got struct {
+		Data KanbanData `json:"data"`
+	}
+	decodeBody(t, rec, &got)
+	if len(got.Data.Tasks) != 1 || got.Data.Tasks[0].ID != "t1" {
+		t.Errorf("workspace board tasks = %+v, want t1", got.Data.Tasks)
+	}
+	expectStatus(t, app.do(t, "GET", "/api/data/get?board="+board.ID, outsider, nil), http.StatusForbidden)
+
+	// The board is stored under a users row, but isn't a user
+	users, err := NewAdminService(app.db, app.hub, app.dataService.cache).ListUsers()
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	for _, u := range users {
+		if u.Email == board.ID {
+			t.Errorf("workspace board %s listed as a user", board.ID)
+		}
+	}
+
+	// Only owners manage owners, and the last one can't leave
+	if err := ws.SetRole(workspace.ID, WorkspaceRoleAdmin, member, WorkspaceRoleOwner); err != errOwnerRole {
+		t.Errorf("admin making an owner: %v, want %v", err, errOwnerRole)
+	}
+	if err := ws.RemoveMember(workspace.ID, owner, WorkspaceRoleOwner, owner); err != errLastOwner {
+		t.Errorf("last owner leaving: %v, want %v", err, errLastOwner)
+	}
+	if err := ws.RemoveMember(workspace.ID, member, WorkspaceRoleMember, owner); err != errForbidden {
+		t.Errorf("member removing the owner: %v, want %v", err, errForbidden)
+	}
+
+	if _, err := ws.Switch(member, workspace.ID); err != nil {
+		t.Fatalf("Switch: %v", err)
+	}
+	if current, err := ws.Current(member); err != nil || current == nil || current.ID != workspace.ID {
+		t.Errorf("Current = %+v, %v, want the workspace", current, err)
+	}
+	if err := ws.RemoveMember(workspace.ID, member, WorkspaceRoleMember, member); err != nil {
+		t.Fatalf("leaving: %v", err)
+	}
+	if current, err := ws.Current(member); err != nil || current != nil {
+		t.Errorf("Current after leaving = %+v, %v, want none", current, err)
+	}
+	if role := app.hub.BoardRole(member, board.ID); role != BoardRoleNone {
+		t.Errorf("former member's board role = %v, want none", role)
+	}
+
+	// Deleting the workspace deletes its boards' data
+	if err := ws.Delete(ctx, workspace.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if data, err := app.dataService.GetUserData(ctx, board.ID); err != nil || data.Version != 0 {
+		t.Errorf("board after delete = %+v, %v, want nothing stored", data, err)
+	}
+}
+
+func TestChangeEmailKeepsWorkspaces(t *testing.T) {
+	app := newTestApp(t)
+	ws := app.workspaces
+	accounts := NewAccountService(app.db, app.auth, app.dataService, nil, app.hub)
+	ctx := context.Background()
+	owner, member, invitee := "a@example.com", "b@example.com", "c@example.com"
+
+	workspace, err := ws.Create(owner, "Team")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	board, err := ws.CreateBoard(workspace.ID, owner, "Roadmap")
+	if err != nil {
+		t.Fatalf("CreateBoard: %v", err)
+	}
+	invitation, err := ws.Invite(workspace.ID, owner, WorkspaceRoleOwner, member, WorkspaceRoleMember, "http://localhost", "en")
+	if err != nil {
+		t.Fatalf("Invite: %v", err)
+	}
+	_, token, _ := strings.Cut(invitation.URL, "workspace-invite=")
+	if _, err := ws.AcceptInvitation(member, token); err != nil {
+		t.Fatalf("AcceptInvitation: %v", err)
+	}
+	if _, err := ws.Invite(workspace.ID, member, WorkspaceRoleMember, invitee, WorkspaceRoleMember, "http://localhost", "en"); err != nil {
+		t.Fatalf("Invite: %v", err)
+	}
+
+	changeEmail := func(from, to string) {
+		t.Helper()
+		token, err := app.auth.CreateStateToken(from, emailChangePurpose(to), emailChangeTTL)
+		if err != nil {
+			t.Fatalf("CreateStateToken: %v", err)
+		}
+		if _, err := accounts.ChangeEmail(ctx, from, to, token, false); err != nil {
+			t.Fatalf("ChangeEmail %s to %s: %v", from, to, err)
+		}
+	}
+	changeEmail(owner, "a2@example.com")
+	changeEmail(member, "b2@example.com")
+	changeEmail(invitee, "c2@example.com")
+
+	// The member keeps their access, and what each of them created or was
+	// invited to moves with them
+	if role := app.hub.BoardRole("b2@example.com", board.ID); role != BoardRoleEditor {
+		t.Errorf("member's board role after the change = %v, want editor", role)
+	}
+	if got, err := ws.Get("a2@example.com", workspace.ID); err != nil || got.CreatedBy != "a2@example.com" || got.Role != WorkspaceRoleOwner {
+		t.Errorf("workspace = %+v, %v, want owned and created by the new address", got, err)
+	}
+	boards, err := ws.Boards(workspace.ID)
+	if err != nil || len(boards) != 1 || boards[0].CreatedBy != "a2@example.com" {
+		t.Errorf("boards = %+v, %v, want created by the new address", boards, err)
+	}
+	invitations, err := ws.Invitations(workspace.ID)
+	if err != nil || len(invitations) != 1 || invitations[0].Email != "c2@example.com" || invitations[0].InvitedBy != "b2@example.com" {
+		t.Errorf("invitations = %+v, %v, want to and from the new addresses", invitations, err)
+	}
+}
+
+// joinWorkspace invites email to a workspace as role and accepts for them
+func joinWorkspace(t *testing.T, app *testApp, workspaceID, owner, email, role string) {
+	t.Helper()
+	invitation, err := app.workspaces.Invite(workspaceID, owner, WorkspaceRoleOwner, email, role, "http://localhost", "en")
+	if err != nil {
+		t.Fatalf("Invite: %v", err)
+	}
+	_, token, _ := strings.Cut(invitation.URL, "workspace-invite=")
+	if _, err := app.workspaces.AcceptInvitation(email, token); err != nil {
+		t.Fatalf("AcceptInvitation: %v", err)
+	}
+}
+
+func TestBoardPoliciesCheckTheAddressedBoard(t *testing.T) {
+	app := newTestApp(t)
+	owner, viewer := "a@example.com", "b@example.com"
+	workspace, err := app.workspaces.Create(owner, "Team")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	board, err := app.workspaces.CreateBoard(workspace.ID, owner, "Roadmap")
+	if err != nil {
+		t.Fatalf("CreateBoard: %v", err)
+	}
+	joinWorkspace(t, app, workspace.ID, owner, viewer, WorkspaceRoleViewer)
+
+	expectStatus(t, app.do(t, "GET", "/api/data/get?board="+board.ID, viewer, nil), http.StatusOK)
+	expectStatus(t, app.do(t, "POST", "/api/boards/"+board.ID+"/share-link", viewer, nil), http.StatusForbidden)
+	expectStatus(t, app.do(t, "POST", "/api/boards/"+board.ID+"/share-link", owner, nil), http.StatusCreated)
+	expectStatus(t, app.do(t, "POST", "/api/boards/default/share-link", viewer, nil), http.StatusCreated)
+}
+
+func TestWorkspaceBoardSyncsOverREST(t *testing.T) {
+	app := newTestApp(t)
+	owner, member, viewer := "a@example.com", "b@example.com", "c@example.com"
+	workspace, err := app.workspaces.Create(owner, "Team")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	board, err := app.workspaces.CreateBoard(workspace.ID, owner, "Roadmap")
+	if err != nil {
+		t.Fatalf("CreateBoard: %v", err)
+	}
+	joinWorkspace(t, app, workspace.ID, owner, member, WorkspaceRoleMember)
+	joinWorkspace(t, app, workspace.ID, owner, viewer, WorkspaceRoleViewer)
+
+	expectStatus(t, app.do(t, "POST", "/api/data/sync?board="+board.ID, member, testBoard()), http.StatusOK)
+	expectStatus(t, app.do(t, "POST", "/api/data/sync?board="+board.ID, viewer, testBoard()), http.StatusForbidden)
+
+	data, err := app.dataService.GetUserData(context.Background(), board.ID)
+	if err != nil || len(data.Tasks) != 1 || data.Tasks[0].ID != "t1" {
+		t.Fatalf("workspace board = %+v, %v, want the member's sync", data, err)
+	}
+	if own, err := app.dataService.GetUserData(context.Background(), member); err != nil || len(own.Tasks) != 0 {
+		t.Errorf("member's own board = %+v, %v, want it untouched", own, err)
+	}
+
+	rec := app.do(t, "GET", "/api/data/changes?since=0&board="+board.ID, viewer, nil)
+	expectStatus(t, rec, http.StatusOK)
+	var changes struct {
+		Changes BoardChanges `json:"changes"`
+	}
+	decodeBody(t, rec, &changes)
+	if changes.Changes.Version != data.Version {
+		t.Errorf("changes version = %d, want %d", changes.Changes.Version, data.Version)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// Every message type a client may send is registered with the hub as a
+// MessageSpec. ReadPump rejects unknown types, messages over the type's size
+// limit, senders without the required role on the message's board and
+// payloads that fail validation, replying with
+//
+//	{"type": "error", "board": "...", "data": {"message": "...", "messageType": "..."}}
+//
+// Messages that pass go to the spec's handler, or for relayed types are sent
+// on to the board's other subscribers. Nothing a client sends is relayed
+// without a spec.
+
+// defaultMessageLimit is the size limit of message types without their own
+const defaultMessageLimit = 16 * 1024
+
+// MessageSpec describes an incoming WebSocket message type
+type MessageSpec struct {
+	// Largest accepted message in bytes; defaultMessageLimit when 0
+	MaxSize int
+	// Role the sender needs on the message's board (the sender's own board
+	// when "board" is empty)
+	Role BoardRole
+	// Checks the message; nil accepts any payload
+	Validate func(message WebSocketMessage) error
+	// Processes the message. When nil the message is relayed to the board's
+	// other subscribers with the sender in "user".
+	Handler MessageHandler
+}
+
+var (
+	errUnknownMessage  = errors.New("unknown message type")
+	errMessageTooLarge = errors.New("message too large")
+	errMessageRole     = errors.New("forbidden")
+)
+
+// check validates a message of size bytes against the spec
+func (s MessageSpec) check(c *Client, message WebSocketMessage, size int) error {
+	limit := s.MaxSize
+	if limit == 0 {
+		limit = defaultMessageLimit
+	}
+	if size > limit {
+		return errMessageTooLarge
+	}
+	if s.Role > BoardRoleNone && c.hub.BoardRole(c.email, canonicalBoardID(c.email, message.Board)) < s.Role {
+		return errMessageRole
+	}
+	if s.Validate != nil {
+		return s.Validate(message)
+	}
+	return nil
+}
+
+// dispatch checks an incoming message against its type's spec and handles
+// or relays it
+func (h *Hub) dispatch(c *Client, message WebSocketMessage, size int) {
+	spec, ok := h.messages[message.Type]
+	err := errUnknownMessage
+	if ok {
+		err = spec.check(c, message, size)
+	}
+	if err != nil {
+		log.Printf("Rejected %q message from %s: %v", message.Type, c.email, err)
+		c.Send(WebSocketMessage{
+			Type:  "error",
+			Board: message.Board,
+			Data:  map[string]string{"message": err.Error(), "messageType": message.Type},
+		})
+		return
+	}
+
+	if spec.Handler != nil {
+		spec.Handler(c, message)
+		return
+	}
+	h.PublishBoard(canonicalBoardID(c.email, message.Board), message, c)
+}
+
+// TaskMovePayload is the payload of a "taskMove" message, relayed so other
+// clients can move the card before their next sync
+type TaskMovePayload struct {
+	TaskID   string  `json:"taskId"`
+	ColumnID *string `json:"columnId"`
+	Task     any     `json:"task,omitempty"`
+}
+
+func validateTaskMove(message WebSocketMessage) error {
+	var payload TaskMovePayload
+	if err := decodeMessageData(message, &payload); err != nil || payload.TaskID == "" {
+		return errors.New("invalid taskMove message")
+	}
+	return nil
+}
+
+func validateEditing(message WebSocketMessage) error {
+	var payload EditingPayload
+	if err := decodeMessageData(message, &payload); err != nil || payload.TaskID == "" || len(payload.TaskID) > 128 {
+		return errors.New("invalid editing message")
+	}
+	return nil
+}